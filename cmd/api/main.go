@@ -30,7 +30,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
-	"github.com/rs/cors"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/httpext"
 	"github.com/sapcc/go-bits/logg"
@@ -39,12 +38,14 @@ import (
 	"github.com/sapcc/go-bits/sqlext"
 	"github.com/spf13/cobra"
 
+	"github.com/sapcc/keppel/internal/api"
 	auth "github.com/sapcc/keppel/internal/api/auth"
 	"github.com/sapcc/keppel/internal/api/clairintegration"
 	keppelv1 "github.com/sapcc/keppel/internal/api/keppel"
 	peerv1 "github.com/sapcc/keppel/internal/api/peer"
 	registryv2 "github.com/sapcc/keppel/internal/api/registry"
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
 )
 
 // AddCommandTo mounts this command into the command hierarchy.
@@ -65,7 +66,7 @@ func run(cmd *cobra.Command, args []string) {
 	cfg := keppel.ParseConfiguration()
 	auditor := keppel.InitAuditTrail()
 
-	db := must.Return(keppel.InitDB(cfg.DatabaseURL))
+	db := must.Return(keppel.InitDB(cfg.DatabaseURL, cfg.DatabasePool))
 	must.Succeed(setupDBIfRequested(db))
 	rc := must.Return(initRedis())
 	ad := must.Return(keppel.NewAuthDriver(osext.MustGetenv("KEPPEL_DRIVER_AUTH"), rc))
@@ -84,23 +85,23 @@ func run(cmd *cobra.Command, args []string) {
 	//start background goroutines
 	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
 	runPeering(ctx, cfg, db)
+	go processor.RunWebhookDeliveryWorkers(ctx, cfg, 4)
 
 	//wire up HTTP handlers
-	corsMiddleware := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"HEAD", "GET", "POST", "PUT", "DELETE"},
-		AllowedHeaders: []string{"Content-Type", "User-Agent", "Authorization", "X-Auth-Token", "X-Keppel-Sublease-Token"},
-	})
+	registryAPI := registryv2.NewAPI(cfg, ad, fd, sd, icd, db, auditor, rle)
+	if osext.GetenvBool("KEPPEL_API_JSON_ACCESS_LOG") {
+		registryAPI.EnableAccessLog(os.Stdout)
+	}
 	handler := httpapi.Compose(
 		keppelv1.NewAPI(cfg, ad, fd, sd, icd, db, auditor),
 		auth.NewAPI(cfg, ad, fd, db),
-		registryv2.NewAPI(cfg, ad, fd, sd, icd, db, auditor, rle),
+		registryAPI,
 		peerv1.NewAPI(cfg, ad, db),
 		clairintegration.NewAPI(cfg, ad),
 		&headerReflector{logg.ShowDebug}, //the header reflection endpoint is only enabled where debugging is enabled (i.e. usually in dev/QA only)
 		&guiRedirecter{db, os.Getenv("KEPPEL_GUI_URI")},
 		httpapi.HealthCheckAPI{SkipRequestLog: true},
-		httpapi.WithGlobalMiddleware(corsMiddleware.Handler),
+		api.CORSMiddleware(cfg.CORS),
 	)
 	http.Handle("/", handler)
 	http.Handle("/metrics", promhttp.Handler())
@@ -108,6 +109,14 @@ func run(cmd *cobra.Command, args []string) {
 	//start HTTP server
 	apiListenAddress := osext.GetenvOrDefault("KEPPEL_API_LISTEN_ADDRESS", ":8080")
 	must.Succeed(httpext.ListenAndServeContext(ctx, apiListenAddress, nil))
+
+	//export tracing spans that were not exported yet
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := cfg.Tracing().Shutdown(shutdownCtx)
+	if err != nil {
+		logg.Error("while shutting down tracing: %s", err.Error())
+	}
 }
 
 // Note that, since Redis is optional, this may return (nil, nil).
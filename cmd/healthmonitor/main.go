@@ -27,7 +27,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/docker/distribution/manifest/schema2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sapcc/go-bits/httpext"
@@ -163,15 +162,7 @@ func (j *healthMonitorJob) PrepareKeppelAccount() error {
 
 // Uploads a minimal complete image (one config blob, one layer blob and one manifest) for testing.
 func (j *healthMonitorJob) UploadImage() (keppel.ManifestReference, error) {
-	_, err := j.RepoClient.UploadMonolithicBlob([]byte(minimalImageConfiguration))
-	if err != nil {
-		return keppel.ManifestReference{}, err
-	}
-	_, err = j.RepoClient.UploadMonolithicBlob(minimalImageLayer())
-	if err != nil {
-		return keppel.ManifestReference{}, err
-	}
-	digest, err := j.RepoClient.UploadManifest([]byte(minimalManifest), schema2.MediaTypeManifest, "latest")
+	digest, err := j.RepoClient.UploadMinimalImage("latest")
 	return keppel.ManifestReference{Digest: digest}, err
 }
 
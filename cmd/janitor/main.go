@@ -20,8 +20,8 @@ package janitorcmd
 
 import (
 	"context"
-	"database/sql"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/dlmiddlecote/sqlstats"
@@ -35,6 +35,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
 	"github.com/sapcc/keppel/internal/tasks"
 )
 
@@ -56,7 +57,7 @@ func run(cmd *cobra.Command, args []string) {
 	cfg := keppel.ParseConfiguration()
 	auditor := keppel.InitAuditTrail()
 
-	db := must.Return(keppel.InitDB(cfg.DatabaseURL))
+	db := must.Return(keppel.InitDB(cfg.DatabaseURL, cfg.DatabasePool))
 	ad := must.Return(keppel.NewAuthDriver(osext.MustGetenv("KEPPEL_DRIVER_AUTH"), nil))
 	fd := must.Return(keppel.NewFederationDriver(osext.MustGetenv("KEPPEL_DRIVER_FEDERATION"), ad, cfg))
 	sd := must.Return(keppel.NewStorageDriver(osext.MustGetenv("KEPPEL_DRIVER_STORAGE"), ad, cfg))
@@ -65,23 +66,57 @@ func run(cmd *cobra.Command, args []string) {
 	prometheus.MustRegister(sqlstats.NewStatsCollector("keppel", db.DbMap.Db))
 
 	ctx := httpext.ContextWithSIGINT(context.Background(), 10*time.Second)
+	go processor.RunWebhookDeliveryWorkers(ctx, cfg, 4)
 
 	//start task loops
 	janitor := tasks.NewJanitor(cfg, fd, sd, icd, db, auditor)
-	go jobLoop(janitor.AnnounceNextAccountToFederation)
-	go jobLoop(janitor.DeleteNextAbandonedUpload)
-	go jobLoop(janitor.GarbageCollectManifestsInNextRepo)
-	go jobLoop(janitor.SweepBlobMountsInNextRepo)
-	go jobLoop(janitor.SweepBlobsInNextAccount)
-	go jobLoop(janitor.SweepStorageInNextAccount)
-	go jobLoop(janitor.SyncManifestsInNextRepo)
-	go jobLoop(janitor.ValidateNextBlob)
-	go jobLoop(janitor.ValidateNextManifest)
+	if osext.GetenvBool("KEPPEL_JANITOR_STREAM_MANIFEST_VALIDATION") {
+		janitor.EnableStreamingManifestValidation()
+	}
+	janitor.SetClairIndexPollInterval(getPositiveDurationFromEnv("KEPPEL_JANITOR_CLAIR_INDEX_POLL_INTERVAL", tasks.DefaultClairIndexPollInterval))
+	janitor.SetClairIndexingTime(getPositiveDurationFromEnv("KEPPEL_JANITOR_CLAIR_INDEXING_TIME", tasks.DefaultClairIndexingTime))
+	janitor.SetStaleVulnerabilityStatusAge(getPositiveDurationFromEnv("KEPPEL_JANITOR_STALE_VULNERABILITY_STATUS_AGE", tasks.DefaultStaleVulnerabilityStatusAge))
+	janitor.SetStorageReadTimeout(getDurationFromEnv("KEPPEL_JANITOR_STORAGE_READ_TIMEOUT", tasks.DefaultStorageReadTimeout))
+	if lengthStr := osext.GetenvOrDefault("KEPPEL_JANITOR_MAX_ERROR_MESSAGE_LENGTH", ""); lengthStr != "" {
+		maxLength, err := strconv.Atoi(lengthStr)
+		if err != nil || maxLength <= 0 {
+			logg.Fatal("invalid value for KEPPEL_JANITOR_MAX_ERROR_MESSAGE_LENGTH: %q", lengthStr)
+		}
+		janitor.SetMaxErrorMessageLength(maxLength)
+	}
+	intervals := tasks.DefaultJobLoopIntervals
+	intervals.Tick = getDurationFromEnv("KEPPEL_JANITOR_TICK_INTERVAL", intervals.Tick)
+	intervals.IdleBackoff = getDurationFromEnv("KEPPEL_JANITOR_IDLE_BACKOFF", intervals.IdleBackoff)
+	jobLoops := tasks.NewJobLoopGroup(ctx, intervals)
+	jobLoops.Go(janitor.AnnounceNextAccountToFederation)
+	jobLoops.Go(janitor.DeleteNextAbandonedUpload)
+	jobLoops.Go(janitor.GarbageCollectManifestsInNextRepo)
+	jobLoops.Go(janitor.SweepBlobMountsInNextRepo)
+	jobLoops.Go(janitor.SweepBlobsInNextAccount)
+	jobLoops.Go(janitor.SweepStorageInNextAccount)
+	jobLoops.Go(janitor.SyncManifestsInNextRepo)
+	//these job loops lock the rows that they are working on, so they can run
+	//multiple times concurrently
+	concurrency := 1
+	if concurrencyStr := osext.GetenvOrDefault("KEPPEL_JANITOR_CONCURRENCY", ""); concurrencyStr != "" {
+		var err error
+		concurrency, err = strconv.Atoi(concurrencyStr)
+		if err != nil || concurrency <= 0 {
+			logg.Fatal("invalid value for KEPPEL_JANITOR_CONCURRENCY: %q", concurrencyStr)
+		}
+	}
+	for i := 0; i < concurrency; i++ {
+		jobLoops.Go(janitor.ValidateNextBlob)
+		jobLoops.Go(janitor.ValidateNextManifest)
+	}
+	jobLoops.GoCron(5*time.Minute, janitor.RefreshAccountMetrics)
 	if !osext.GetenvBool("KEPPEL_CLAIR_IGNORE_STALE_INDEX_REPORTS") {
-		go cronJobLoop(1*time.Minute, janitor.CheckClairManifestState)
+		jobLoops.GoCron(1*time.Minute, func() error { return janitor.CheckClairManifestState(ctx) })
 	}
 	if cfg.ClairClient != nil {
-		go tasks.GoQueuedJobLoop(ctx, 3, janitor.CheckVulnerabilitiesForNextManifest())
+		//vulnerability checks do not get `ctx` since that would abort in-flight
+		//checks on shutdown; the job loop itself still stops polling when `ctx` expires
+		jobLoops.GoQueued(3, janitor.CheckVulnerabilitiesForNextManifest(context.Background()))
 	}
 
 	//start HTTP server for Prometheus metrics and health check
@@ -90,34 +125,40 @@ func run(cmd *cobra.Command, args []string) {
 	http.Handle("/metrics", promhttp.Handler())
 	listenAddress := osext.GetenvOrDefault("KEPPEL_JANITOR_LISTEN_ADDRESS", ":8080")
 	must.Succeed(httpext.ListenAndServeContext(ctx, listenAddress, nil))
+
+	//on shutdown, allow in-flight tasks to complete to avoid leaving inconsistencies behind
+	logg.Info("waiting for in-flight janitor tasks to complete...")
+	jobLoops.Wait()
+
+	//export tracing spans that were not exported yet
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := cfg.Tracing().Shutdown(shutdownCtx)
+	if err != nil {
+		logg.Error("while shutting down tracing: %s", err.Error())
+	}
 }
 
-// Execute a task repeatedly, but slow down when sql.ErrNoRows is returned by it.
-// (Tasks use this error value to indicate that nothing needs scraping, so we
-// can back off a bit to avoid useless database load.)
-func jobLoop(task func() error) {
-	for {
-		err := task()
-		switch err {
-		case nil:
-			//nothing to do here
-		case sql.ErrNoRows:
-			//nothing to do right now - slow down a bit to avoid useless DB polling
-			time.Sleep(10 * time.Second)
-		default:
-			logg.Error(err.Error())
-			//slow down a bit after an error to avoid hammering the DB during outages
-			time.Sleep(2 * time.Second)
-		}
+// Reads a duration in the syntax of time.ParseDuration from an environment
+// variable. Zero is accepted to allow disabling waits, but negative values are not.
+func getDurationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	valueStr := osext.GetenvOrDefault(key, "")
+	if valueStr == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil || value < 0 {
+		logg.Fatal("invalid value for %s: %q", key, valueStr)
 	}
+	return value
 }
 
-func cronJobLoop(interval time.Duration, task func() error) {
-	for {
-		err := task()
-		if err != nil {
-			logg.Error(err.Error())
-		}
-		time.Sleep(interval)
+// Like getDurationFromEnv, but zero is not accepted either. This is used for
+// durations where zero does not make sense, e.g. for polling intervals.
+func getPositiveDurationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	value := getDurationFromEnv(key, defaultValue)
+	if value == 0 {
+		logg.Fatal("invalid value for %s: %q", key, osext.GetenvOrDefault(key, ""))
 	}
+	return value
 }
@@ -0,0 +1,91 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package selftestcmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/must"
+	"github.com/spf13/cobra"
+
+	"github.com/sapcc/keppel/internal/client"
+	"github.com/sapcc/keppel/internal/selftest"
+)
+
+var longDesc = strings.TrimSpace(`
+Performs a smoke test of a Keppel instance. This creates a Keppel account with
+the given name (or a random name, if none is given), pushes a small image into
+it, pulls and validates the image, and deletes the image and the account again.
+The result of each step is reported. If any step fails, the exit code is non-zero.
+
+The environment variables must contain credentials for authenticating with the
+authentication method used by the target Keppel API.
+`)
+
+// AddCommandTo mounts this command into the command hierarchy.
+func AddCommandTo(parent *cobra.Command) {
+	cmd := &cobra.Command{
+		Use:   "selftest [<account>]",
+		Short: "Performs a smoke test of a Keppel instance.",
+		Long:  longDesc,
+		Args:  cobra.MaximumNArgs(1),
+		Run:   run,
+	}
+	parent.AddCommand(cmd)
+}
+
+func run(cmd *cobra.Command, args []string) {
+	ad, err := client.NewAuthDriver()
+	if err != nil {
+		logg.Fatal("while setting up auth driver: %s", err.Error())
+	}
+
+	var accountName string
+	if len(args) > 0 {
+		accountName = args[0]
+	} else {
+		buf := make([]byte, 4)
+		must.Return(rand.Read(buf))
+		accountName = "selftest-" + hex.EncodeToString(buf)
+	}
+	logg.Info("running self-test in account %s", accountName)
+
+	allPassed := true
+	for _, result := range selftest.Run(ad, accountName) {
+		switch {
+		case result.Skipped:
+			allPassed = false
+			logg.Info("SKIP %s (because of previous errors)", result.Name)
+		case result.Error != nil:
+			allPassed = false
+			logg.Error("FAIL %s: %s", result.Name, result.Error.Error())
+		case result.Note != "":
+			logg.Info("PASS %s (%s)", result.Name, result.Note)
+		default:
+			logg.Info("PASS %s", result.Name)
+		}
+	}
+	if !allPassed {
+		os.Exit(1)
+	}
+}
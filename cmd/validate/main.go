@@ -50,7 +50,7 @@ If the image is in a Keppel replica account, this ensures that the image is repl
 	}
 	cmd.PersistentFlags().StringVarP(&authUserName, "username", "u", "", "User name (only required for non-public images).")
 	cmd.PersistentFlags().StringVarP(&authPassword, "password", "p", "", "Password (only required for non-public images).")
-	cmd.PersistentFlags().StringVar(&platformFilterStr, "platform-filter", "[]", "When validating a multi-architecture image, only recurse into the contained images matching one of the given platforms. The filter must be given as a JSON array of objects matching each having the same format as the `manifests[].platform` field in the <https://github.com/opencontainers/image-spec/blob/master/image-index.md>.")
+	cmd.PersistentFlags().StringVar(&platformFilterStr, "platform-filter", "[]", "When validating a multi-architecture image, only recurse into the contained images matching one of the given platforms. The filter must be given either as a comma-separated list of platforms like \"linux/amd64,linux/arm/v7\", or as a JSON array of objects matching each having the same format as the `manifests[].platform` field in the <https://github.com/opencontainers/image-spec/blob/master/image-index.md>.")
 	parent.AddCommand(cmd)
 }
 
@@ -85,8 +85,7 @@ func (l logger) LogBlob(d digest.Digest, level int, err error, isCached bool) {
 }
 
 func run(cmd *cobra.Command, args []string) {
-	var platformFilter keppel.PlatformFilter
-	err := json.Unmarshal([]byte(platformFilterStr), &platformFilter)
+	platformFilter, err := parsePlatformFilter(platformFilterStr)
 	if err != nil {
 		logg.Fatal("cannot parse platform filter: " + err.Error())
 	}
@@ -114,3 +113,16 @@ func run(cmd *cobra.Command, args []string) {
 		}
 	}
 }
+
+func parsePlatformFilter(input string) (keppel.PlatformFilter, error) {
+	input = strings.TrimSpace(input)
+	if strings.HasPrefix(input, "[") {
+		var platformFilter keppel.PlatformFilter
+		err := json.Unmarshal([]byte(input), &platformFilter)
+		return platformFilter, err
+	}
+	if input == "" {
+		return nil, nil
+	}
+	return keppel.NewPlatformFilter(strings.Split(input, ",")...)
+}
@@ -49,6 +49,7 @@ func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.Federation
 func (a *API) AddTo(r *mux.Router) {
 	r.Methods("GET").Path("/keppel/v1/auth").HandlerFunc(a.handleGetAuth)
 	r.Methods("POST").Path("/keppel/v1/auth/peering").HandlerFunc(a.handlePostPeering)
+	r.Methods("POST").Path("/keppel/v1/auth/introspect").HandlerFunc(a.handlePostIntrospect)
 }
 
 func respondWithError(w http.ResponseWriter, code int, err error) bool {
@@ -62,6 +62,9 @@ var (
 		RepositoryPattern:  "fo+",
 		CanPullAnonymously: true,
 	}
+	policyAnonPullEverything = keppel.RBACPolicy{
+		CanPullAnonymously: true,
+	}
 	policyAnonFirstPull = keppel.RBACPolicy{
 		RepositoryPattern:       "fo+",
 		CanPullAnonymously:      true,
@@ -164,6 +167,21 @@ var testCases = []TestCase{
 	{Scope: "registry:catalog:*",
 		CannotDelete: true, GrantedActions: "*",
 		AdditionalScopes: []string{"keppel_account:test1:view"}},
+	//catalog access for anonymous users only shows accounts that are entirely public
+	{Scope: "registry:catalog:*", AnonymousLogin: true,
+		GrantedActions: "*"},
+	{Scope: "registry:catalog:*", AnonymousLogin: true,
+		RBACPolicy:     policyAnonPull,
+		GrantedActions: "*"},
+	{Scope: "registry:catalog:*", AnonymousLogin: true,
+		RBACPolicy:       policyAnonPullEverything,
+		GrantedActions:   "*",
+		AdditionalScopes: []string{"keppel_account:test1:catalog"}},
+	//public accounts are also shown to authenticated users without view permission
+	{Scope: "registry:catalog:*",
+		CannotPull: true, RBACPolicy: policyAnonPullEverything,
+		GrantedActions:   "*",
+		AdditionalScopes: []string{"keppel_account:test1:catalog"}},
 	//unknown resources/actions for resource type "registry"
 	{Scope: "registry:test1/foo:pull",
 		GrantedActions: ""},
@@ -998,3 +1016,58 @@ func TestIssuerKeyRotation(t *testing.T) {
 		},
 	}.Check(t, s.Handler)
 }
+
+func TestDenyDeleteViaToken(t *testing.T) {
+	s := setupPrimary(t)
+	h := s.Handler
+	service := s.Config.APIPublicHostname
+	s.AD.GrantedPermissions = "view:test1authtenant,pull:test1authtenant,push:test1authtenant,delete:test1authtenant"
+
+	req := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         fmt.Sprintf("/keppel/v1/auth?service=%s&scope=repository:test1/foo:pull,push,delete", service),
+		Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("correctusername", "correctpassword")},
+		ExpectStatus: http.StatusOK,
+	}
+
+	//without the account setting, "delete" is granted as usual
+	req.ExpectBody = jwtContents{
+		Audience: service,
+		Issuer:   "keppel-api@" + service,
+		Subject:  "correctusername",
+		Access: []jwtAccess{{
+			Type:    "repository",
+			Name:    "test1/foo",
+			Actions: []string{"pull", "push", "delete"},
+		}},
+	}
+	req.Check(t, h)
+
+	//with the account setting, "delete" is stripped even though the user has
+	//permission for it, and even if an RBAC policy grants it
+	_, err := s.DB.Exec(`UPDATE accounts SET deny_delete_via_token = TRUE WHERE name = $1`, "test1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = s.DB.Insert(&keppel.RBACPolicy{
+		AccountName:       "test1",
+		RepositoryPattern: "foo",
+		UserNamePattern:   "correctusername",
+		CanPull:           true,
+		CanDelete:         true,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.ExpectBody = jwtContents{
+		Audience: service,
+		Issuer:   "keppel-api@" + service,
+		Subject:  "correctusername",
+		Access: []jwtAccess{{
+			Type:    "repository",
+			Name:    "test1/foo",
+			Actions: []string{"pull", "push"},
+		}},
+	}
+	req.Check(t, h)
+}
@@ -0,0 +1,88 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package authapi
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// This endpoint follows RFC 7662 (OAuth 2.0 Token Introspection) as far as
+// applicable: The token is given as a form-encoded request body, and invalid
+// tokens are reported as `{"active":false}` without any further detail.
+func (a *API) handlePostIntrospect(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/auth/introspect")
+
+	//only admins may introspect tokens
+	uid, rerr := a.authDriver.AuthenticateUserFromRequest(r)
+	if rerr != nil {
+		rerr.WriteAsTextTo(w)
+		w.Write([]byte("\n"))
+		return
+	}
+	if uid == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !uid.HasPermission(keppel.CanAdministrateKeppel, "") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	//parse request body
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "request body is not valid form data: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	tokenStr := r.PostForm.Get("token")
+	if tokenStr == "" {
+		http.Error(w, `missing field "token" in request body`, http.StatusBadRequest)
+		return
+	}
+
+	//validate token
+	ti, rerr := auth.IntrospectToken(a.cfg, a.authDriver, tokenStr)
+	if rerr != nil {
+		respondwith.JSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+
+	scopes := make([]string, len(ti.Authorization.ScopeSet))
+	for idx, scope := range ti.Authorization.ScopeSet {
+		scopes[idx] = scope.String()
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"active":     true,
+		"scope":      strings.Join(scopes, " "),
+		"sub":        ti.Subject,
+		"aud":        ti.Authorization.Audience.Hostname(a.cfg),
+		"iss":        ti.Issuer,
+		"exp":        ti.ExpiresAt.Unix(),
+		"iat":        ti.IssuedAt.Unix(),
+		"token_type": "Bearer",
+	})
+}
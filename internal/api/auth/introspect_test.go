@@ -0,0 +1,142 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package authapi_test
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestIntrospectToken(t *testing.T) {
+	s := setupPrimary(t)
+	h := s.Handler
+
+	//obtain a valid token
+	_, respBodyBytes := assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/auth?service=registry.example.org&scope=keppel_api:info:access",
+		Header:       map[string]string{"Authorization": keppel.BuildBasicAuthHeader("correctusername", "correctpassword")},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	err := json.Unmarshal(respBodyBytes, &tokenResp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	validToken := tokenResp.Token
+
+	//build an expired token that is otherwise valid
+	key, err := keppel.ParseIssuerKey(test.UnitTestIssuerEd25519PrivateKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"aud":    "registry.example.org",
+		"iss":    "keppel-api@registry.example.org",
+		"sub":    "correctusername",
+		"exp":    now.Add(-1 * time.Hour).Unix(),
+		"nbf":    now.Add(-5 * time.Hour).Unix(),
+		"iat":    now.Add(-5 * time.Hour).Unix(),
+		"access": []map[string]interface{}{{"type": "keppel_api", "name": "info", "actions": []string{"access"}}},
+		"kea":    map[string]interface{}{"unittest": map[string]interface{}{"Username": "correctusername", "Perms": nil}},
+	})
+	token.Header["jwk"] = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	expiredToken, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	introspect := func(tokenStr string, headers map[string]string) assert.HTTPRequest {
+		headers["Content-Type"] = "application/x-www-form-urlencoded"
+		return assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/keppel/v1/auth/introspect",
+			Header: headers,
+			Body:   assert.StringData(url.Values{"token": {tokenStr}}.Encode()),
+		}
+	}
+	adminHeaders := func() map[string]string {
+		return map[string]string{"X-Test-Perms": "keppeladmin:"}
+	}
+
+	//introspection requires admin permission
+	req := introspect(validToken, map[string]string{})
+	req.ExpectStatus = http.StatusUnauthorized
+	req.Check(t, h)
+	req = introspect(validToken, map[string]string{"X-Test-Perms": "view:test1authtenant"})
+	req.ExpectStatus = http.StatusForbidden
+	req.Check(t, h)
+
+	//the token is required
+	req = introspect("", adminHeaders())
+	req.ExpectStatus = http.StatusBadRequest
+	req.ExpectBody = assert.StringData("missing field \"token\" in request body\n")
+	req.Check(t, h)
+
+	//introspect valid token
+	req = introspect(validToken, adminHeaders())
+	req.ExpectStatus = http.StatusOK
+	_, respBodyBytes = req.Check(t, h)
+	var result struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope"`
+		Subject   string `json:"sub"`
+		Audience  string `json:"aud"`
+		Issuer    string `json:"iss"`
+		ExpiresAt int64  `json:"exp"`
+		IssuedAt  int64  `json:"iat"`
+	}
+	err = json.Unmarshal(respBodyBytes, &result)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "active", result.Active, true)
+	assert.DeepEqual(t, "scope", result.Scope, "keppel_api:info:access")
+	assert.DeepEqual(t, "sub", result.Subject, "correctusername")
+	assert.DeepEqual(t, "aud", result.Audience, "registry.example.org")
+	assert.DeepEqual(t, "iss", result.Issuer, "keppel-api@registry.example.org")
+	assert.DeepEqual(t, "exp - iat", result.ExpiresAt-result.IssuedAt, int64(4*time.Hour/time.Second))
+
+	//introspect expired token
+	req = introspect(expiredToken, adminHeaders())
+	req.ExpectStatus = http.StatusOK
+	req.ExpectBody = assert.JSONObject{"active": false}
+	req.Check(t, h)
+
+	//introspect garbage
+	req = introspect("not-a-token", adminHeaders())
+	req.ExpectStatus = http.StatusOK
+	req.ExpectBody = assert.JSONObject{"active": false}
+	req.Check(t, h)
+}
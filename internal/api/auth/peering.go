@@ -76,7 +76,7 @@ func (a *API) handlePostPeering(w http.ResponseWriter, r *http.Request) {
 	}
 	authReq.Header.Set("Authorization", keppel.BuildBasicAuthHeader(req.UserName, req.Password))
 
-	authResp, err := http.DefaultClient.Do(authReq)
+	authResp, err := a.cfg.HTTPClientForPeers().Do(authReq)
 	if err != nil {
 		http.Error(w, "could not validate credentials: "+err.Error(), http.StatusUnauthorized)
 		return
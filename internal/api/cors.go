@@ -0,0 +1,43 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package api
+
+import (
+	"net/http"
+
+	"github.com/rs/cors"
+	"github.com/sapcc/go-bits/httpapi"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// CORSMiddleware returns an httpapi.API that adds CORS headers to all
+// responses and answers preflight requests according to the given policy. If
+// the policy does not allow any origins, responses are left unchanged.
+func CORSMiddleware(policy keppel.CORSPolicy) httpapi.API {
+	if len(policy.AllowedOrigins) == 0 {
+		return httpapi.WithGlobalMiddleware(func(h http.Handler) http.Handler { return h })
+	}
+	c := cors.New(cors.Options{
+		AllowedOrigins: policy.AllowedOrigins,
+		AllowedMethods: policy.AllowedMethods,
+		AllowedHeaders: policy.AllowedHeaders,
+	})
+	return httpapi.WithGlobalMiddleware(c.Handler)
+}
@@ -25,11 +25,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
 	"reflect"
 	"regexp"
 	"strings"
 	"time"
 
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/gorilla/mux"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/audittools"
@@ -39,6 +42,7 @@ import (
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/clair"
 	peerclient "github.com/sapcc/keppel/internal/client/peer"
 	"github.com/sapcc/keppel/internal/keppel"
 )
@@ -48,15 +52,19 @@ import (
 
 // Account represents an account in the API.
 type Account struct {
-	Name              string                `json:"name"`
-	AuthTenantID      string                `json:"auth_tenant_id"`
-	InMaintenance     bool                  `json:"in_maintenance"`
-	Metadata          map[string]string     `json:"metadata"`
-	GCPolicies        []keppel.GCPolicy     `json:"gc_policies,omitempty"`
-	RBACPolicies      []RBACPolicy          `json:"rbac_policies"`
-	ReplicationPolicy *ReplicationPolicy    `json:"replication,omitempty"`
-	ValidationPolicy  *ValidationPolicy     `json:"validation,omitempty"`
-	PlatformFilter    keppel.PlatformFilter `json:"platform_filter,omitempty"`
+	Name                   string                     `json:"name"`
+	AuthTenantID           string                     `json:"auth_tenant_id"`
+	InMaintenance          bool                       `json:"in_maintenance"`
+	Metadata               map[string]string          `json:"metadata"`
+	GCPolicies             []keppel.GCPolicy          `json:"gc_policies,omitempty"`
+	RBACPolicies           []RBACPolicy               `json:"rbac_policies"`
+	ReplicationPolicy      *ReplicationPolicy         `json:"replication,omitempty"`
+	ValidationPolicy       *ValidationPolicy          `json:"validation,omitempty"`
+	PlatformFilter         keppel.PlatformFilter      `json:"platform_filter,omitempty"`
+	DefaultPlatform        *manifestlist.PlatformSpec `json:"default_platform,omitempty"`
+	Webhook                *Webhook                   `json:"webhook,omitempty"`
+	BlockPullAboveSeverity clair.VulnerabilityStatus  `json:"block_pull_above_severity,omitempty"`
+	DenyDeleteViaToken     bool                       `json:"deny_delete_via_token,omitempty"`
 }
 
 // RBACPolicy represents an RBAC policy in the API.
@@ -74,18 +82,36 @@ type ReplicationPolicy struct {
 	UpstreamPeerHostName string
 	//only for `from_external_on_first_use`
 	ExternalPeer ReplicationExternalPeerSpec
+	//for all strategies
+	RepositoryFilter              *ReplicationRepositoryFilter
+	BlobGracePeriod               *keppel.Duration
+	MaxConcurrentBlobReplications uint64
 }
 
 // ReplicationExternalPeerSpec appears in type ReplicationPolicy.
 type ReplicationExternalPeerSpec struct {
-	URL      string `json:"url"`
-	UserName string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
+	URL      string           `json:"url"`
+	UserName string           `json:"username,omitempty"`
+	Password string           `json:"password,omitempty"`
+	CacheTTL *keppel.Duration `json:"cache_ttl,omitempty"`
+}
+
+// ReplicationRepositoryFilter appears in type ReplicationPolicy.
+type ReplicationRepositoryFilter struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// Webhook represents a webhook configuration in the API.
+type Webhook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
 }
 
 // ValidationPolicy represents a validation policy in the API.
 type ValidationPolicy struct {
-	RequiredLabels []string `json:"required_labels,omitempty"`
+	RequiredLabels         []string                        `json:"required_labels,omitempty"`
+	RequiredLabelsForLists keppel.RequiredLabelsListPolicy `json:"required_labels_for_lists,omitempty"`
 }
 
 // MarshalJSON implements the json.Marshaler interface.
@@ -93,15 +119,21 @@ func (r ReplicationPolicy) MarshalJSON() ([]byte, error) {
 	switch r.Strategy {
 	case "on_first_use":
 		data := struct {
-			Strategy             string `json:"strategy"`
-			UpstreamPeerHostName string `json:"upstream"`
-		}{r.Strategy, r.UpstreamPeerHostName}
+			Strategy             string                       `json:"strategy"`
+			UpstreamPeerHostName string                       `json:"upstream"`
+			RepositoryFilter     *ReplicationRepositoryFilter `json:"repositories,omitempty"`
+			BlobGracePeriod      *keppel.Duration             `json:"blob_replication_grace_period,omitempty"`
+			MaxConcurrent        uint64                       `json:"max_concurrent_blob_replications,omitempty"`
+		}{r.Strategy, r.UpstreamPeerHostName, r.RepositoryFilter, r.BlobGracePeriod, r.MaxConcurrentBlobReplications}
 		return json.Marshal(data)
 	case "from_external_on_first_use":
 		data := struct {
-			Strategy     string                      `json:"strategy"`
-			ExternalPeer ReplicationExternalPeerSpec `json:"upstream"`
-		}{r.Strategy, r.ExternalPeer}
+			Strategy         string                       `json:"strategy"`
+			ExternalPeer     ReplicationExternalPeerSpec  `json:"upstream"`
+			RepositoryFilter *ReplicationRepositoryFilter `json:"repositories,omitempty"`
+			BlobGracePeriod  *keppel.Duration             `json:"blob_replication_grace_period,omitempty"`
+			MaxConcurrent    uint64                       `json:"max_concurrent_blob_replications,omitempty"`
+		}{r.Strategy, r.ExternalPeer, r.RepositoryFilter, r.BlobGracePeriod, r.MaxConcurrentBlobReplications}
 		return json.Marshal(data)
 	default:
 		return nil, fmt.Errorf("do not know how to serialize ReplicationPolicy with strategy %q", r.Strategy)
@@ -111,14 +143,20 @@ func (r ReplicationPolicy) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON implements the json.Unmarshaler interface.
 func (r *ReplicationPolicy) UnmarshalJSON(buf []byte) error {
 	var s struct {
-		Strategy string          `json:"strategy"`
-		Upstream json.RawMessage `json:"upstream"`
+		Strategy        string                       `json:"strategy"`
+		Upstream        json.RawMessage              `json:"upstream"`
+		Repositories    *ReplicationRepositoryFilter `json:"repositories"`
+		BlobGracePeriod *keppel.Duration             `json:"blob_replication_grace_period"`
+		MaxConcurrent   uint64                       `json:"max_concurrent_blob_replications"`
 	}
 	err := json.Unmarshal(buf, &s)
 	if err != nil {
 		return err
 	}
 	r.Strategy = s.Strategy
+	r.RepositoryFilter = s.Repositories
+	r.BlobGracePeriod = s.BlobGracePeriod
+	r.MaxConcurrentBlobReplications = s.MaxConcurrent
 
 	switch r.Strategy {
 	case "on_first_use":
@@ -150,6 +188,11 @@ func (a *API) renderAccount(dbAccount keppel.Account) (Account, error) {
 		policies[idx] = renderRBACPolicy(p)
 	}
 
+	defaultPlatform, err := dbAccount.ParseDefaultPlatform()
+	if err != nil {
+		return Account{}, err
+	}
+
 	metadata := make(map[string]string)
 	if dbAccount.MetadataJSON != "" {
 		err := json.Unmarshal([]byte(dbAccount.MetadataJSON), &metadata)
@@ -159,47 +202,96 @@ func (a *API) renderAccount(dbAccount keppel.Account) (Account, error) {
 	}
 
 	return Account{
-		Name:              dbAccount.Name,
-		AuthTenantID:      dbAccount.AuthTenantID,
-		GCPolicies:        gcPolicies,
-		InMaintenance:     dbAccount.InMaintenance,
-		Metadata:          metadata,
-		RBACPolicies:      policies,
-		ReplicationPolicy: renderReplicationPolicy(dbAccount),
-		ValidationPolicy:  renderValidationPolicy(dbAccount),
-		PlatformFilter:    dbAccount.PlatformFilter,
+		Name:                   dbAccount.Name,
+		AuthTenantID:           dbAccount.AuthTenantID,
+		GCPolicies:             gcPolicies,
+		InMaintenance:          dbAccount.InMaintenance,
+		Metadata:               metadata,
+		RBACPolicies:           policies,
+		ReplicationPolicy:      renderReplicationPolicy(dbAccount),
+		ValidationPolicy:       renderValidationPolicy(dbAccount),
+		PlatformFilter:         dbAccount.PlatformFilter,
+		DefaultPlatform:        defaultPlatform,
+		Webhook:                renderWebhook(dbAccount),
+		BlockPullAboveSeverity: dbAccount.BlockPullAboveSeverity,
+		DenyDeleteViaToken:     dbAccount.DenyDeleteViaToken,
 	}, nil
 }
 
 func renderReplicationPolicy(dbAccount keppel.Account) *ReplicationPolicy {
 	if dbAccount.UpstreamPeerHostName != "" {
 		return &ReplicationPolicy{
-			Strategy:             "on_first_use",
-			UpstreamPeerHostName: dbAccount.UpstreamPeerHostName,
+			Strategy:                      "on_first_use",
+			UpstreamPeerHostName:          dbAccount.UpstreamPeerHostName,
+			RepositoryFilter:              renderReplicationRepositoryFilter(dbAccount),
+			BlobGracePeriod:               renderBlobReplicationGracePeriod(dbAccount),
+			MaxConcurrentBlobReplications: dbAccount.MaxConcurrentReplications,
 		}
 	}
 
 	if dbAccount.ExternalPeerURL != "" {
-		return &ReplicationPolicy{
+		result := &ReplicationPolicy{
 			Strategy: "from_external_on_first_use",
 			ExternalPeer: ReplicationExternalPeerSpec{
 				URL:      dbAccount.ExternalPeerURL,
 				UserName: dbAccount.ExternalPeerUserName,
 				//NOTE: Password is omitted here for security reasons
 			},
+			RepositoryFilter:              renderReplicationRepositoryFilter(dbAccount),
+			BlobGracePeriod:               renderBlobReplicationGracePeriod(dbAccount),
+			MaxConcurrentBlobReplications: dbAccount.MaxConcurrentReplications,
 		}
+		if dbAccount.ExternalPeerCacheTTLSecs != 0 {
+			ttl := keppel.Duration(dbAccount.ExternalPeerCacheTTL())
+			result.ExternalPeer.CacheTTL = &ttl
+		}
+		return result
 	}
 
 	return nil
 }
 
+func renderBlobReplicationGracePeriod(dbAccount keppel.Account) *keppel.Duration {
+	if dbAccount.BlobReplicationGracePeriodSecs == nil {
+		return nil
+	}
+	gracePeriod := keppel.Duration(dbAccount.BlobReplicationGracePeriod())
+	return &gracePeriod
+}
+
+func renderReplicationRepositoryFilter(dbAccount keppel.Account) *ReplicationRepositoryFilter {
+	if dbAccount.ReplicationIncludeRepos == "" && dbAccount.ReplicationExcludeRepos == "" {
+		return nil
+	}
+	var result ReplicationRepositoryFilter
+	if dbAccount.ReplicationIncludeRepos != "" {
+		result.Include = strings.Split(dbAccount.ReplicationIncludeRepos, ",")
+	}
+	if dbAccount.ReplicationExcludeRepos != "" {
+		result.Exclude = strings.Split(dbAccount.ReplicationExcludeRepos, ",")
+	}
+	return &result
+}
+
 func renderValidationPolicy(dbAccount keppel.Account) *ValidationPolicy {
 	if dbAccount.RequiredLabels == "" {
 		return nil
 	}
 
 	return &ValidationPolicy{
-		RequiredLabels: strings.Split(dbAccount.RequiredLabels, ","),
+		RequiredLabels:         strings.Split(dbAccount.RequiredLabels, ","),
+		RequiredLabelsForLists: dbAccount.RequiredLabelsListPolicy,
+	}
+}
+
+func renderWebhook(dbAccount keppel.Account) *Webhook {
+	if dbAccount.WebhookURL == "" {
+		return nil
+	}
+
+	return &Webhook{
+		URL: dbAccount.WebhookURL,
+		//NOTE: Secret is omitted here for security reasons
 	}
 }
 
@@ -357,6 +449,62 @@ func (a *API) handleGetAccount(w http.ResponseWriter, r *http.Request) {
 	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"account": accountRendered})
 }
 
+// AccountFeatures represents the set of features that are enabled for an
+// account in the API. This is derived from the account configuration (and,
+// for some features, from the Keppel deployment's configuration), so tooling
+// does not need to interpret the full account configuration.
+type AccountFeatures struct {
+	BlockPullAboveSeverity bool `json:"block_pull_above_severity"`
+	DenyDeleteViaToken     bool `json:"deny_delete_via_token"`
+	Replication            bool `json:"replication"`
+	RequiredLabels         bool `json:"required_labels"`
+	RetentionPolicies      bool `json:"retention_policies"`
+	VulnerabilityScanning  bool `json:"vulnerability_scanning"`
+	Webhooks               bool `json:"webhooks"`
+}
+
+func (a *API) renderAccountFeatures(dbAccount keppel.Account) (AccountFeatures, error) {
+	gcPolicies, err := dbAccount.ParseGCPolicies()
+	if err != nil {
+		return AccountFeatures{}, err
+	}
+	//policies with action "protect" do not cause anything to be deleted on their own
+	hasRetentionPolicies := false
+	for _, policy := range gcPolicies {
+		if policy.Action == "delete" {
+			hasRetentionPolicies = true
+			break
+		}
+	}
+
+	return AccountFeatures{
+		BlockPullAboveSeverity: dbAccount.BlockPullAboveSeverity != "",
+		DenyDeleteViaToken:     dbAccount.DenyDeleteViaToken,
+		Replication:            dbAccount.UpstreamPeerHostName != "" || dbAccount.ExternalPeerURL != "",
+		RequiredLabels:         dbAccount.RequiredLabels != "",
+		RetentionPolicies:      hasRetentionPolicies,
+		VulnerabilityScanning:  a.cfg.ClairClient != nil,
+		Webhooks:               dbAccount.WebhookURL != "",
+	}, nil
+}
+
+func (a *API) handleGetAccountFeatures(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/features")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanViewAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	features, err := a.renderAccountFeatures(*account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"features": features})
+}
+
 var looksLikeAPIVersionRx = regexp.MustCompile(`^v[0-9][1-9]*$`)
 
 func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
@@ -364,14 +512,18 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 	//decode request body
 	var req struct {
 		Account struct {
-			AuthTenantID      string                `json:"auth_tenant_id"`
-			GCPolicies        []keppel.GCPolicy     `json:"gc_policies"`
-			InMaintenance     bool                  `json:"in_maintenance"`
-			Metadata          map[string]string     `json:"metadata"`
-			RBACPolicies      []RBACPolicy          `json:"rbac_policies"`
-			ReplicationPolicy *ReplicationPolicy    `json:"replication"`
-			ValidationPolicy  *ValidationPolicy     `json:"validation"`
-			PlatformFilter    keppel.PlatformFilter `json:"platform_filter"`
+			AuthTenantID           string                     `json:"auth_tenant_id"`
+			GCPolicies             []keppel.GCPolicy          `json:"gc_policies"`
+			InMaintenance          bool                       `json:"in_maintenance"`
+			Metadata               map[string]string          `json:"metadata"`
+			RBACPolicies           []RBACPolicy               `json:"rbac_policies"`
+			ReplicationPolicy      *ReplicationPolicy         `json:"replication"`
+			ValidationPolicy       *ValidationPolicy          `json:"validation"`
+			PlatformFilter         keppel.PlatformFilter      `json:"platform_filter"`
+			DefaultPlatform        *manifestlist.PlatformSpec `json:"default_platform"`
+			Webhook                *Webhook                   `json:"webhook"`
+			BlockPullAboveSeverity string                     `json:"block_pull_above_severity"`
+			DenyDeleteViaToken     bool                       `json:"deny_delete_via_token"`
 		} `json:"account"`
 	}
 	decoder := json.NewDecoder(r.Body)
@@ -400,6 +552,11 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `account names that look like API versions are reserved for internal use`, http.StatusUnprocessableEntity)
 		return
 	}
+	req.Account.AuthTenantID, err = keppel.ValidateAccount(a.authDriver, accountName, req.Account.AuthTenantID)
+	if err != nil {
+		keppel.ErrDenied.With(err.Error()).WithStatus(http.StatusForbidden).WriteAsTextTo(w)
+		return
+	}
 
 	for _, policy := range req.Account.GCPolicies {
 		err := policy.Validate()
@@ -431,12 +588,24 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		gcPoliciesJSONStr = string(gcPoliciesJSON)
 	}
 
+	defaultPlatformJSONStr := ""
+	if dp := req.Account.DefaultPlatform; dp != nil {
+		if dp.OS == "" || dp.Architecture == "" {
+			http.Error(w, `default platform must have at least "os" and "architecture"`, http.StatusUnprocessableEntity)
+			return
+		}
+		defaultPlatformJSON, _ := json.Marshal(*dp)
+		defaultPlatformJSONStr = string(defaultPlatformJSON)
+	}
+
 	accountToCreate := keppel.Account{
-		Name:           accountName,
-		AuthTenantID:   req.Account.AuthTenantID,
-		InMaintenance:  req.Account.InMaintenance,
-		MetadataJSON:   metadataJSONStr,
-		GCPoliciesJSON: gcPoliciesJSONStr,
+		Name:                accountName,
+		AuthTenantID:        req.Account.AuthTenantID,
+		InMaintenance:       req.Account.InMaintenance,
+		DenyDeleteViaToken:  req.Account.DenyDeleteViaToken,
+		MetadataJSON:        metadataJSONStr,
+		GCPoliciesJSON:      gcPoliciesJSONStr,
+		DefaultPlatformJSON: defaultPlatformJSONStr,
 	}
 
 	//validate replication policy
@@ -462,8 +631,39 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 			accountToCreate.ExternalPeerURL = rp.ExternalPeer.URL
 			accountToCreate.ExternalPeerUserName = rp.ExternalPeer.UserName
 			accountToCreate.ExternalPeerPassword = rp.ExternalPeer.Password
+			if rp.ExternalPeer.CacheTTL != nil {
+				if *rp.ExternalPeer.CacheTTL < 0 {
+					http.Error(w, `cache TTL for "from_external_on_first_use" replication may not be negative`, http.StatusUnprocessableEntity)
+					return
+				}
+				accountToCreate.ExternalPeerCacheTTLSecs = int64(time.Duration(*rp.ExternalPeer.CacheTTL) / time.Second)
+			}
 			//NOTE: There are some delayed checks below which require the existing account to be loaded from the DB first.
 		}
+
+		if rp.RepositoryFilter != nil {
+			for _, patterns := range [][]string{rp.RepositoryFilter.Include, rp.RepositoryFilter.Exclude} {
+				for _, pattern := range patterns {
+					_, err := path.Match(pattern, "")
+					if err != nil || pattern == "" || strings.Contains(pattern, ",") {
+						http.Error(w, fmt.Sprintf(`invalid repository pattern in replication policy: %q`, pattern), http.StatusUnprocessableEntity)
+						return
+					}
+				}
+			}
+			accountToCreate.ReplicationIncludeRepos = strings.Join(rp.RepositoryFilter.Include, ",")
+			accountToCreate.ReplicationExcludeRepos = strings.Join(rp.RepositoryFilter.Exclude, ",")
+		}
+
+		if rp.BlobGracePeriod != nil {
+			if *rp.BlobGracePeriod < 0 {
+				http.Error(w, `blob replication grace period may not be negative`, http.StatusUnprocessableEntity)
+				return
+			}
+			gracePeriodSecs := int64(time.Duration(*rp.BlobGracePeriod) / time.Second)
+			accountToCreate.BlobReplicationGracePeriodSecs = &gracePeriodSecs
+		}
+		accountToCreate.MaxConcurrentReplications = rp.MaxConcurrentBlobReplications
 	}
 
 	//validate validation policy
@@ -476,7 +676,40 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		if !vp.RequiredLabelsForLists.IsValid() {
+			http.Error(w, fmt.Sprintf(`invalid value for "required_labels_for_lists": %q`, vp.RequiredLabelsForLists), http.StatusUnprocessableEntity)
+			return
+		}
+		if vp.RequiredLabelsForLists != "" && len(vp.RequiredLabels) == 0 {
+			http.Error(w, `"required_labels_for_lists" cannot be set without "required_labels"`, http.StatusUnprocessableEntity)
+			return
+		}
+
 		accountToCreate.RequiredLabels = strings.Join(vp.RequiredLabels, ",")
+		accountToCreate.RequiredLabelsListPolicy = vp.RequiredLabelsForLists
+	}
+
+	//validate webhook
+	if req.Account.Webhook != nil {
+		webhookURL, err := url.Parse(req.Account.Webhook.URL)
+		if err == nil {
+			err = keppel.CheckWebhookURL(webhookURL, a.cfg.WebhookAllowedHosts)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`invalid webhook URL: %q`, req.Account.Webhook.URL), http.StatusUnprocessableEntity)
+			return
+		}
+		accountToCreate.WebhookURL = req.Account.Webhook.URL
+		accountToCreate.WebhookSecret = req.Account.Webhook.Secret
+	}
+
+	//validate pull blocking threshold
+	if req.Account.BlockPullAboveSeverity != "" {
+		accountToCreate.BlockPullAboveSeverity, err = clair.ParseSeverity(req.Account.BlockPullAboveSeverity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
 	}
 
 	//validate platform filter
@@ -533,12 +766,19 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	//the webhook secret is redacted in GET, so when a client GETs the account,
+	//changes something unrelated, and PUTs the result, we keep the existing
+	//secret as long as the webhook URL does not change
+	if account != nil && accountToCreate.WebhookURL != "" && accountToCreate.WebhookSecret == "" && accountToCreate.WebhookURL == account.WebhookURL {
+		accountToCreate.WebhookSecret = account.WebhookSecret
+	}
+
 	//replication strategy may not be changed after account creation
 	if account != nil && req.Account.ReplicationPolicy != nil && !replicationPoliciesFunctionallyEqual(req.Account.ReplicationPolicy, renderReplicationPolicy(*account)) {
 		http.Error(w, `cannot change replication policy on existing account`, http.StatusConflict)
 		return
 	}
-	if account != nil && req.Account.PlatformFilter != nil && !reflect.DeepEqual(req.Account.PlatformFilter, account.PlatformFilter) {
+	if account != nil && req.Account.PlatformFilter != nil && !req.Account.PlatformFilter.IsEqualTo(account.PlatformFilter) {
 		http.Error(w, `cannot change platform filter on existing account`, http.StatusConflict)
 		return
 	}
@@ -615,9 +855,17 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 					return
 				}
 
+				//replicas may replicate from other replicas, but not in a circle
+				upstreamPolicy := upstreamAccount.ReplicationPolicy
+				if upstreamPolicy != nil && upstreamPolicy.Strategy == "on_first_use" && upstreamPolicy.UpstreamPeerHostName == a.cfg.APIPublicHostname {
+					msg := fmt.Sprintf("cannot replicate from %s: the account there is already a replica of this account", rp.UpstreamPeerHostName)
+					http.Error(w, msg, http.StatusConflict)
+					return
+				}
+
 				if req.Account.PlatformFilter == nil {
 					accountToCreate.PlatformFilter = upstreamAccount.PlatformFilter
-				} else if !reflect.DeepEqual(req.Account.PlatformFilter, upstreamAccount.PlatformFilter) {
+				} else if !req.Account.PlatformFilter.IsEqualTo(upstreamAccount.PlatformFilter) {
 					// check if the peer PlatformFilter matches the primary account PlatformFilter
 					jsonPlatformFilter, _ := json.Marshal(req.Account.PlatformFilter)
 					jsonFilter, _ := json.Marshal(upstreamAccount.PlatformFilter)
@@ -683,6 +931,29 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 			account.RequiredLabels = accountToCreate.RequiredLabels
 			needsUpdate = true
 		}
+		if account.RequiredLabelsListPolicy != accountToCreate.RequiredLabelsListPolicy {
+			account.RequiredLabelsListPolicy = accountToCreate.RequiredLabelsListPolicy
+			needsUpdate = true
+		}
+		if account.DefaultPlatformJSON != accountToCreate.DefaultPlatformJSON {
+			account.DefaultPlatformJSON = accountToCreate.DefaultPlatformJSON
+			needsUpdate = true
+		}
+		if account.BlockPullAboveSeverity != accountToCreate.BlockPullAboveSeverity {
+			account.BlockPullAboveSeverity = accountToCreate.BlockPullAboveSeverity
+			needsUpdate = true
+			needsAudit = true
+		}
+		if account.DenyDeleteViaToken != accountToCreate.DenyDeleteViaToken {
+			account.DenyDeleteViaToken = accountToCreate.DenyDeleteViaToken
+			needsUpdate = true
+			needsAudit = true
+		}
+		if account.WebhookURL != accountToCreate.WebhookURL || account.WebhookSecret != accountToCreate.WebhookSecret {
+			account.WebhookURL = accountToCreate.WebhookURL
+			account.WebhookSecret = accountToCreate.WebhookSecret
+			needsUpdate = true
+		}
 		if account.ExternalPeerUserName != accountToCreate.ExternalPeerUserName {
 			account.ExternalPeerUserName = accountToCreate.ExternalPeerUserName
 			needsUpdate = true
@@ -691,6 +962,23 @@ func (a *API) handlePutAccount(w http.ResponseWriter, r *http.Request) {
 			account.ExternalPeerPassword = accountToCreate.ExternalPeerPassword
 			needsUpdate = true
 		}
+		if req.Account.ReplicationPolicy != nil && account.ExternalPeerCacheTTLSecs != accountToCreate.ExternalPeerCacheTTLSecs {
+			account.ExternalPeerCacheTTLSecs = accountToCreate.ExternalPeerCacheTTLSecs
+			needsUpdate = true
+		}
+		if req.Account.ReplicationPolicy != nil && !reflect.DeepEqual(account.BlobReplicationGracePeriodSecs, accountToCreate.BlobReplicationGracePeriodSecs) {
+			account.BlobReplicationGracePeriodSecs = accountToCreate.BlobReplicationGracePeriodSecs
+			needsUpdate = true
+		}
+		if req.Account.ReplicationPolicy != nil && account.MaxConcurrentReplications != accountToCreate.MaxConcurrentReplications {
+			account.MaxConcurrentReplications = accountToCreate.MaxConcurrentReplications
+			needsUpdate = true
+		}
+		if req.Account.ReplicationPolicy != nil && (account.ReplicationIncludeRepos != accountToCreate.ReplicationIncludeRepos || account.ReplicationExcludeRepos != accountToCreate.ReplicationExcludeRepos) {
+			account.ReplicationIncludeRepos = accountToCreate.ReplicationIncludeRepos
+			account.ReplicationExcludeRepos = accountToCreate.ReplicationExcludeRepos
+			needsUpdate = true
+		}
 		if needsUpdate {
 			_, err := a.db.Update(account)
 			if respondwith.ErrorText(w, err) {
@@ -752,13 +1040,21 @@ func replicationPoliciesFunctionallyEqual(lhs, rhs *ReplicationPolicy) bool {
 		return true
 	}
 
-	//ignore pull credentials (the user shall be able to change these after account creation)
+	//ignore pull credentials, cache TTL, repository filter, blob grace period and concurrency limit (the user shall be able to change these after account creation)
 	lhsClone := *lhs
 	rhsClone := *rhs
 	lhsClone.ExternalPeer.UserName = ""
 	lhsClone.ExternalPeer.Password = ""
+	lhsClone.ExternalPeer.CacheTTL = nil
+	lhsClone.RepositoryFilter = nil
+	lhsClone.BlobGracePeriod = nil
+	lhsClone.MaxConcurrentBlobReplications = 0
 	rhsClone.ExternalPeer.UserName = ""
 	rhsClone.ExternalPeer.Password = ""
+	rhsClone.ExternalPeer.CacheTTL = nil
+	rhsClone.RepositoryFilter = nil
+	rhsClone.BlobGracePeriod = nil
+	rhsClone.MaxConcurrentBlobReplications = 0
 	return reflect.DeepEqual(lhsClone, rhsClone)
 }
 
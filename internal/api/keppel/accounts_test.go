@@ -501,7 +501,8 @@ func TestAccountsAPI(t *testing.T) {
 				"auth_tenant_id": "tenant1",
 				"rbac_policies":  newRBACPoliciesJSON,
 				"validation": assert.JSONObject{
-					"required_labels": []string{"foo", "bar"},
+					"required_labels":           []string{"foo", "bar"},
+					"required_labels_for_lists": "any_platform",
 				},
 			},
 		},
@@ -514,12 +515,33 @@ func TestAccountsAPI(t *testing.T) {
 				"metadata":       assert.JSONObject{},
 				"rbac_policies":  newRBACPoliciesJSON,
 				"validation": assert.JSONObject{
-					"required_labels": []string{"foo", "bar"},
+					"required_labels":           []string{"foo", "bar"},
+					"required_labels_for_lists": "any_platform",
 				},
 			},
 		},
 	}.Check(t, h)
 
+	//a list policy must be a known value, and requires labels to be set
+	for _, vp := range []assert.JSONObject{
+		{"required_labels": []string{"foo"}, "required_labels_for_lists": "some_platforms"},
+		{"required_labels_for_lists": "all_platforms"},
+	} {
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/keppel/v1/accounts/second",
+			Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+			Body: assert.JSONObject{
+				"account": assert.JSONObject{
+					"auth_tenant_id": "tenant1",
+					"rbac_policies":  newRBACPoliciesJSON,
+					"validation":     vp,
+				},
+			},
+			ExpectStatus: http.StatusUnprocessableEntity,
+		}.Check(t, h)
+	}
+
 	//setting an empty validation policy should be equivalent to removing it
 	assert.HTTPRequest{
 		Method: "PUT",
@@ -651,6 +673,20 @@ func TestPutAccountErrorCases(t *testing.T) {
 		ExpectBody:   assert.StringData("malformed attribute \"account.auth_tenant_id\" in request body: must not be \"invalid\"\n"),
 	}.Check(t, h)
 
+	//the auth driver can veto the creation of accounts in certain tenants
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/second",
+		Header: map[string]string{"X-Test-Perms": "change:vetoed"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "vetoed",
+			},
+		},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("cannot create account \"second\" in tenant \"vetoed\"\n"),
+	}.Check(t, h)
+
 	assert.HTTPRequest{
 		Method: "PUT",
 		Path:   "/keppel/v1/accounts/keppel-api",
@@ -1794,6 +1830,32 @@ func TestGetPutAccountReplicationFromExternalOnFirstUse(t *testing.T) {
 		ExpectStatus: http.StatusConflict,
 		ExpectBody:   assert.StringData("cannot change platform filter on existing account\n"),
 	}.Check(t, h)
+
+	//PUT on existing account with the same platform filter is allowed, even if
+	//default variants are spelled differently
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/keppel/v1/accounts/first",
+		Header: map[string]string{"X-Test-Perms": "change:tenant1"},
+		Body: assert.JSONObject{
+			"account": assert.JSONObject{
+				"auth_tenant_id": "tenant1",
+				"replication": assert.JSONObject{
+					"strategy": "from_external_on_first_use",
+					"upstream": assert.JSONObject{
+						"url":      "registry.example.com",
+						"username": "foo",
+						"password": "bar",
+					},
+				},
+				"platform_filter": []assert.JSONObject{
+					{"os": "linux", "architecture": "amd64", "variant": "v1"},
+					{"os": "linux", "architecture": "arm64"},
+				},
+			},
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, h)
 }
 
 func uploadManifest(t *testing.T, s test.Setup, account *keppel.Account, repo *keppel.Repository, manifest test.Bytes, sizeBytes uint64) keppel.Manifest {
@@ -2240,3 +2302,99 @@ func TestReplicaAccountsInheritPlatformFilter(t *testing.T) {
 		}.Check(t, s2.Handler)
 	})
 }
+
+func TestGetAccountFeatures(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//one account with nothing configured, one with everything configured
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "plain",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	})
+	//policies that only protect images do not count as retention policies
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "protected",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: `[{"match_repository":".*","action":"protect"}]`,
+	})
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:                   "fancy",
+		AuthTenantID:           "tenant1",
+		UpstreamPeerHostName:   "registry-secondary.example.org",
+		GCPoliciesJSON:         `[{"match_repository":".*","action":"protect"},{"match_repository":".*","only_untagged":true,"action":"delete"}]`,
+		RequiredLabels:         "maintainer",
+		BlockPullAboveSeverity: clair.HighSeverity,
+		DenyDeleteViaToken:     true,
+		WebhookURL:             "https://webhook.example.org/",
+	})
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/plain/features",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"features": assert.JSONObject{
+				"block_pull_above_severity": false,
+				"deny_delete_via_token":     false,
+				"replication":               false,
+				"required_labels":           false,
+				"retention_policies":        false,
+				"vulnerability_scanning":    false,
+				"webhooks":                  false,
+			},
+		},
+	}.Check(t, h)
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/protected/features",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"features": assert.JSONObject{
+				"block_pull_above_severity": false,
+				"deny_delete_via_token":     false,
+				"replication":               false,
+				"required_labels":           false,
+				"retention_policies":        false,
+				"vulnerability_scanning":    false,
+				"webhooks":                  false,
+			},
+		},
+	}.Check(t, h)
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/fancy/features",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"features": assert.JSONObject{
+				"block_pull_above_severity": true,
+				"deny_delete_via_token":     true,
+				"replication":               true,
+				"required_labels":           true,
+				"retention_policies":        true,
+				"vulnerability_scanning":    false,
+				"webhooks":                  true,
+			},
+		},
+	}.Check(t, h)
+
+	//failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/fancy/features",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/doesnotexist/features",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+}
@@ -61,14 +61,28 @@ func (a *API) AddTo(r *mux.Router) {
 	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(a.handlePutAccount)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}").HandlerFunc(a.handleDeleteAccount)
 	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/sublease").HandlerFunc(a.handlePostAccountSublease)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/usage").HandlerFunc(a.handleGetAccountUsage)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/features").HandlerFunc(a.handleGetAccountFeatures)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/vulnerability_statuses").HandlerFunc(a.handleGetVulnerabilityStatuses)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/_sync").HandlerFunc(a.handlePostAccountSync)
 
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_blobs/_check").HandlerFunc(a.handleCheckBlobs)
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests").HandlerFunc(a.handleGetManifests)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}").HandlerFunc(a.handleDeleteManifest)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/restore").HandlerFunc(a.handleRestoreManifest)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/revalidate").HandlerFunc(a.handleRevalidateManifest)
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/vulnerability_report").HandlerFunc(a.handleGetVulnerabilityReport)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/replication_status").HandlerFunc(a.handleGetReplicationStatus)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/tags").HandlerFunc(a.handleGetManifestTags)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_manifests/{digest}/platforms").HandlerFunc(a.handleGetManifestPlatforms)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tags/{tag_name}").HandlerFunc(a.handleDeleteTag)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_tag_history").HandlerFunc(a.handleGetTagHistory)
 
 	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories").HandlerFunc(a.handleGetRepositories)
 	r.Methods("DELETE").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}").HandlerFunc(a.handleDeleteRepository)
+	r.Methods("POST").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_sync").HandlerFunc(a.handlePostRepositorySync)
+	r.Methods("GET").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_metadata").HandlerFunc(a.handleGetRepositoryMetadata)
+	r.Methods("PUT").Path("/keppel/v1/accounts/{account:[a-z0-9-]{1,48}}/repositories/{repo_name:.+}/_metadata").HandlerFunc(a.handlePutRepositoryMetadata)
 
 	r.Methods("GET").Path("/keppel/v1/peers").HandlerFunc(a.handleGetPeers)
 
@@ -134,6 +148,46 @@ func repoScopeFromRequest(r *http.Request, perm keppel.Permission) auth.ScopeSet
 	})
 }
 
+// Returns which repositories in the given account the user may pull from. If
+// the user may pull from all of them, `all` is true and `repoNames` is empty.
+func (a *API) findPullableRepositories(r *http.Request, authz *auth.Authorization, account keppel.Account) (all bool, repoNames []string, err error) {
+	if authz.UserIdentity.HasPermission(keppel.CanPullFromAccount, account.AuthTenantID) {
+		return true, nil, nil
+	}
+
+	//otherwise, pull access can only come from RBAC policies, which apply to
+	//individual repositories
+	var allRepoNames []string
+	_, err = a.db.Select(&allRepoNames, `SELECT name FROM repos WHERE account_name = $1 ORDER BY name`, account.Name)
+	if err != nil || len(allRepoNames) == 0 {
+		return false, nil, err
+	}
+	scopes := make([]auth.Scope, len(allRepoNames))
+	for idx, repoName := range allRepoNames {
+		scopes[idx] = auth.Scope{
+			ResourceType: "repository",
+			ResourceName: fmt.Sprintf("%s/%s", account.Name, repoName),
+			Actions:      []string{string(keppel.CanPullFromAccount)},
+		}
+	}
+	pullAuthz, rerr := auth.IncomingRequest{
+		HTTPRequest:          r,
+		Scopes:               auth.NewScopeSet(scopes...),
+		CorrectlyReturn403:   true,
+		PartialAccessAllowed: true,
+	}.Authorize(a.cfg, a.authDriver, a.db)
+	if rerr != nil {
+		//this should not happen since the same request was already authorized for the account
+		return false, nil, rerr
+	}
+	for idx, scope := range scopes {
+		if pullAuthz.ScopeSet.Contains(scope) {
+			repoNames = append(repoNames, allRepoNames[idx])
+		}
+	}
+	return false, repoNames, nil
+}
+
 func (a *API) authenticateRequest(w http.ResponseWriter, r *http.Request, ss auth.ScopeSet) *auth.Authorization {
 	authz, rerr := auth.IncomingRequest{
 		HTTPRequest:          r,
@@ -163,7 +217,7 @@ func (a *API) findAccountFromRequest(w http.ResponseWriter, r *http.Request) *ke
 
 func (a *API) findRepositoryFromRequest(w http.ResponseWriter, r *http.Request, account keppel.Account) *keppel.Repository {
 	repoName := mux.Vars(r)["repo_name"]
-	if !isValidRepoName(repoName) {
+	if !keppel.IsRepoName(repoName) {
 		http.Error(w, "not found", http.StatusNotFound)
 		return nil
 	}
@@ -179,18 +233,6 @@ func (a *API) findRepositoryFromRequest(w http.ResponseWriter, r *http.Request,
 	return repo
 }
 
-func isValidRepoName(name string) bool {
-	if name == "" {
-		return false
-	}
-	for _, pathComponent := range strings.Split(name, `/`) {
-		if !keppel.RepoPathComponentRx.MatchString(pathComponent) {
-			return false
-		}
-	}
-	return true
-}
-
 type paginatedQuery struct {
 	SQL         string
 	MarkerField string
@@ -220,6 +262,6 @@ func (q paginatedQuery) Prepare() (modifiedSQLQuery string, modifiedBindValues [
 		query = strings.Replace(query, `$CONDITION`, `TRUE`, 1)
 		return query, q.BindValues, limit, nil
 	}
-	query = strings.Replace(query, `$CONDITION`, q.MarkerField+` > $2`, 1)
+	query = strings.Replace(query, `$CONDITION`, fmt.Sprintf(`%s > $%d`, q.MarkerField, len(q.BindValues)+1), 1)
 	return query, append(q.BindValues, marker), limit, nil
 }
@@ -87,3 +87,61 @@ func TestAlternativeAuthSchemes(t *testing.T) {
 		ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
 	}.Check(t, h)
 }
+
+func TestCORSPolicy(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithCORSPolicy(keppel.CORSPolicy{
+			AllowedOrigins: []string{"https://ui.example.org"},
+			AllowedMethods: []string{"GET", "PUT"},
+			AllowedHeaders: []string{"Authorization"},
+		}),
+	)
+	h := s.Handler
+
+	//preflight request from the configured origin
+	assert.HTTPRequest{
+		Method: "OPTIONS",
+		Path:   "/keppel/v1/accounts/test1",
+		Header: map[string]string{
+			"Origin":                         "https://ui.example.org",
+			"Access-Control-Request-Method":  "PUT",
+			"Access-Control-Request-Headers": "Authorization",
+		},
+		ExpectStatus: http.StatusNoContent,
+		ExpectHeader: map[string]string{
+			"Access-Control-Allow-Origin":  "https://ui.example.org",
+			"Access-Control-Allow-Methods": "PUT",
+			"Access-Control-Allow-Headers": "Authorization",
+		},
+	}.Check(t, h)
+
+	//actual request from the configured origin
+	assert.HTTPRequest{
+		Method: "GET",
+		Path:   "/keppel/v1/accounts/test1",
+		Header: map[string]string{
+			"Origin":       "https://ui.example.org",
+			"X-Test-Perms": "view:tenant1",
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: map[string]string{
+			"Access-Control-Allow-Origin": "https://ui.example.org",
+		},
+	}.Check(t, h)
+
+	//requests from other origins do not get CORS headers
+	assert.HTTPRequest{
+		Method: "GET",
+		Path:   "/keppel/v1/accounts/test1",
+		Header: map[string]string{
+			"Origin":       "https://evil.example.com",
+			"X-Test-Perms": "view:tenant1",
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: map[string]string{
+			"Access-Control-Allow-Origin": "",
+		},
+	}.Check(t, h)
+}
@@ -0,0 +1,122 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// BlobExistence is how a single result of the batched blob existence check
+// appears in the API.
+type BlobExistence struct {
+	Digest    string `json:"digest"`
+	Exists    bool   `json:"exists"`
+	SizeBytes uint64 `json:"size_bytes,omitempty"`
+}
+
+// maxDigestsPerBlobCheck limits the size of the request body of POST .../_blobs/_check.
+const maxDigestsPerBlobCheck = 1000
+
+// This matches the behavior of HEAD /v2/:account/:repo/blobs/:digest: A blob
+// exists if it is mounted in the repository, and unbacked blobs only count in
+// replica accounts (where they can be replicated on first use).
+var existingBlobsQuery = sqlext.SimplifyWhitespace(`
+	SELECT b.digest, b.size_bytes
+	  FROM blobs b
+	  JOIN blob_mounts bm ON b.id = bm.blob_id
+	 WHERE b.account_name = $1 AND bm.repo_id = $2 AND b.digest = ANY($3::text[])
+	   AND (b.storage_id != '' OR $4)
+`)
+
+func (a *API) handleCheckBlobs(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_blobs/_check")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//parse request
+	var req struct {
+		Digests []string `json:"digests"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Digests) > maxDigestsPerBlobCheck {
+		msg := fmt.Sprintf("too many digests (at most %d are allowed per request)", maxDigestsPerBlobCheck)
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	for _, digestStr := range req.Digests {
+		_, err := digest.Parse(digestStr)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid digest %q: %s", digestStr, err.Error()), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	//since all digests are validated, they can be rendered into an array
+	//literal without any quoting
+	sizeByDigest := make(map[string]uint64, len(req.Digests))
+	isReplica := account.UpstreamPeerHostName != "" || account.ExternalPeerURL != ""
+	digestArray := "{" + strings.Join(req.Digests, ",") + "}"
+	err = sqlext.ForeachRow(a.db, existingBlobsQuery, []interface{}{account.Name, repo.ID, digestArray, isReplica}, func(rows *sql.Rows) error {
+		var (
+			digestStr string
+			sizeBytes uint64
+		)
+		err := rows.Scan(&digestStr, &sizeBytes)
+		sizeByDigest[digestStr] = sizeBytes
+		return err
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//report results in the same order as the request
+	result := make([]BlobExistence, len(req.Digests))
+	for idx, digestStr := range req.Digests {
+		sizeBytes, exists := sizeByDigest[digestStr]
+		result[idx] = BlobExistence{Digest: digestStr, Exists: exists, SizeBytes: sizeBytes}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"blobs": result})
+}
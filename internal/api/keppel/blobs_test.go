@@ -0,0 +1,124 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package keppelv1_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestCheckBlobsAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"})
+	repo1 := keppel.Repository{Name: "repo1", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo1)
+	repo2 := keppel.Repository{Name: "repo2", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo2)
+
+	//blob 1 is in repo1, blob 2 is only in repo2, blob 3 is in repo1 but not
+	//backed by storage (which should not happen outside of replica accounts, so
+	//it does not count), blob 4 does not exist at all
+	for idx, repo := range []keppel.Repository{repo1, repo2, repo1} {
+		blob := keppel.Blob{
+			AccountName: "test1",
+			Digest:      deterministicDummyDigest(idx + 1),
+			SizeBytes:   uint64(1000 * (idx + 1)),
+			StorageID:   s.SIDGenerator.Next(),
+			PushedAt:    time.Unix(1000, 0),
+			ValidatedAt: time.Unix(1000, 0),
+		}
+		if idx == 2 {
+			blob.StorageID = ""
+		}
+		mustInsert(t, s.DB, &blob)
+		mustDo(t, keppel.MountBlobIntoRepo(s.DB, blob, repo))
+	}
+
+	path := "/keppel/v1/accounts/test1/repositories/repo1/_blobs/_check"
+	allDigests := []string{
+		deterministicDummyDigest(4),
+		deterministicDummyDigest(3),
+		deterministicDummyDigest(2),
+		deterministicDummyDigest(1),
+	}
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		Body:         assert.JSONObject{"digests": allDigests},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo3/_blobs/_check",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": allDigests},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": []string{deterministicDummyDigest(1), "sha256:nothex"}},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("invalid digest \"sha256:nothex\": invalid checksum digest length\n"),
+	}.Check(t, h)
+
+	//mixed list: results are in the same order as the request
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         path,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": allDigests},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"blobs": []assert.JSONObject{
+				{"digest": deterministicDummyDigest(4), "exists": false},
+				{"digest": deterministicDummyDigest(3), "exists": false},
+				{"digest": deterministicDummyDigest(2), "exists": false},
+				{"digest": deterministicDummyDigest(1), "exists": true, "size_bytes": 1000},
+			},
+		},
+	}.Check(t, h)
+
+	//in repo2, only blob 2 exists
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo2/_blobs/_check",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         assert.JSONObject{"digests": allDigests[1:3]},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"blobs": []assert.JSONObject{
+				{"digest": deterministicDummyDigest(3), "exists": false},
+				{"digest": deterministicDummyDigest(2), "exists": true, "size_bytes": 2000},
+			},
+		},
+	}.Check(t, h)
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net/http"
 	"sort"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/opencontainers/go-digest"
@@ -61,7 +62,7 @@ type Tag struct {
 var manifestGetQuery = sqlext.SimplifyWhitespace(`
 	SELECT *
 	  FROM manifests
-	 WHERE repo_id = $1 AND $CONDITION
+	 WHERE repo_id = $1 AND deleted_at IS NULL AND $CONDITION
 	 ORDER BY digest ASC
 	 LIMIT $LIMIT
 `)
@@ -201,6 +202,91 @@ func (a *API) handleGetManifests(w http.ResponseWriter, r *http.Request) {
 	respondwith.JSON(w, http.StatusOK, result)
 }
 
+// VulnerabilityStatusExport represents a manifest in the response of the
+// account-wide vulnerability status export.
+type VulnerabilityStatusExport struct {
+	RepositoryName      string                    `json:"repository"`
+	Digest              string                    `json:"digest"`
+	Tags                []string                  `json:"tags,omitempty"`
+	VulnerabilityStatus clair.VulnerabilityStatus `json:"vulnerability_status"`
+}
+
+// Tag names cannot contain commas, so we can aggregate them into one column.
+// The marker for pagination is "<repo>@<digest>", which uniquely identifies a
+// manifest within the account.
+var vulnStatusExportQuery = sqlext.SimplifyWhitespace(`
+	SELECT r.name, m.digest, vi.status, COALESCE(STRING_AGG(t.name, ',' ORDER BY t.name), '')
+	  FROM manifests m
+	  JOIN repos r ON r.id = m.repo_id
+	  JOIN vuln_info vi ON vi.repo_id = m.repo_id AND vi.digest = m.digest
+	  LEFT OUTER JOIN tags t ON t.repo_id = m.repo_id AND t.digest = m.digest
+	 WHERE r.account_name = $1 AND ($2 OR r.name = ANY($3::text[])) AND m.deleted_at IS NULL AND $CONDITION
+	 GROUP BY r.name, m.digest, vi.status
+	 ORDER BY (r.name || '@' || m.digest) ASC
+	 LIMIT $LIMIT
+`)
+
+func (a *API) handleGetVulnerabilityStatuses(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/vulnerability_statuses")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanViewAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+
+	//like GET .../_manifests, this reveals the contents of repositories, so it
+	//only covers the repositories that the user may pull from
+	canPullAll, pullableRepoNames, err := a.findPullableRepositories(r, authz, *account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	//(repo names do not contain any characters that need to be quoted in an array literal)
+	repoNameArray := "{" + strings.Join(pullableRepoNames, ",") + "}"
+
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         vulnStatusExportQuery,
+		MarkerField: "(r.name || '@' || m.digest)",
+		Options:     r.URL.Query(),
+		BindValues:  []interface{}{account.Name, canPullAll, repoNameArray},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result struct {
+		Manifests   []VulnerabilityStatusExport `json:"manifests"`
+		IsTruncated bool                        `json:"truncated,omitempty"`
+	}
+	err = sqlext.ForeachRow(a.db, query, bindValues, func(rows *sql.Rows) error {
+		var (
+			entry    VulnerabilityStatusExport
+			tagNames string
+		)
+		err := rows.Scan(&entry.RepositoryName, &entry.Digest, &entry.VulnerabilityStatus, &tagNames)
+		if tagNames != "" {
+			entry.Tags = strings.Split(tagNames, ",")
+		}
+		result.Manifests = append(result.Manifests, entry)
+		return err
+	})
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	if result.Manifests == nil {
+		result.Manifests = []VulnerabilityStatusExport{}
+	}
+	if uint64(len(result.Manifests)) > limit {
+		result.Manifests = result.Manifests[0:limit]
+		result.IsTruncated = true
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
 func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanDeleteFromAccount))
@@ -236,6 +322,75 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (a *API) handleRestoreManifest(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/restore")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanDeleteFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	//this is a no-op for manifests that are not soft-deleted; manifests that
+	//were already purged cannot be restored anymore
+	err = a.processor().RestoreManifest(*account, *repo, parsedDigest.String(), keppel.AuditContext{
+		UserIdentity: authz.UserIdentity,
+		Request:      r,
+	})
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) handleRevalidateManifest(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/revalidate")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	err = keppel.ClearManifestValidationError(a.db, repo.ID, parsedDigest.String())
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such manifest", http.StatusNotFound)
+		return
+	}
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (a *API) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tags/:name")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanDeleteFromAccount))
@@ -267,8 +422,28 @@ func (a *API) handleDeleteTag(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Request) {
-	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/vulnerability_report")
+// TagHistoryEntry represents an entry in the tag history in the API.
+type TagHistoryEntry struct {
+	ID        int64  `json:"id"`
+	TagName   string `json:"tag"`
+	OldDigest string `json:"old_digest"`
+	NewDigest string `json:"new_digest"`
+	MovedAt   int64  `json:"moved_at"`
+	MovedBy   string `json:"moved_by,omitempty"`
+}
+
+// This query goes by account and repo name instead of repo ID since the tag
+// history outlives the repository.
+var tagHistoryGetQuery = sqlext.SimplifyWhitespace(`
+	SELECT *
+	  FROM tag_history
+	 WHERE account_name = $1 AND repo_name = $2 AND ($3 = '' OR tag_name = $3) AND $CONDITION
+	 ORDER BY id ASC
+	 LIMIT $LIMIT
+`)
+
+func (a *API) handleGetTagHistory(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_tag_history")
 	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
 	if authz == nil {
 		return
@@ -277,26 +452,94 @@ func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Reques
 	if account == nil {
 		return
 	}
+	//NOTE: The repository does not need to exist anymore.
+	repoName := mux.Vars(r)["repo_name"]
+	if !keppel.IsRepoName(repoName) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	query, bindValues, limit, err := paginatedQuery{
+		SQL:         tagHistoryGetQuery,
+		MarkerField: "id",
+		Options:     r.URL.Query(),
+		BindValues:  []interface{}{account.Name, repoName, r.URL.Query().Get("tag")},
+	}.Prepare()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dbEntries []keppel.TagHistoryEntry
+	_, err = a.db.Select(&dbEntries, query, bindValues...)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	var result struct {
+		Entries     []TagHistoryEntry `json:"tag_history"`
+		IsTruncated bool              `json:"truncated,omitempty"`
+	}
+	result.Entries = make([]TagHistoryEntry, 0, len(dbEntries))
+	for _, dbEntry := range dbEntries {
+		if uint64(len(result.Entries)) >= limit {
+			result.IsTruncated = true
+			break
+		}
+		result.Entries = append(result.Entries, TagHistoryEntry{
+			ID:        dbEntry.ID,
+			TagName:   dbEntry.TagName,
+			OldDigest: dbEntry.OldDigest,
+			NewDigest: dbEntry.NewDigest,
+			MovedAt:   dbEntry.MovedAt.Unix(),
+			MovedBy:   dbEntry.MovedBy,
+		})
+	}
+	respondwith.JSON(w, http.StatusOK, result)
+}
+
+// Common preamble for the read-only endpoints below the path of a single
+// manifest: checks pull permission and finds the repo and manifest in
+// question. If nil is returned for the manifest, an error response has
+// already been written.
+func (a *API) findManifestFromRequest(w http.ResponseWriter, r *http.Request) (*keppel.Repository, *keppel.Manifest) {
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return nil, nil
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return nil, nil
+	}
 	repo := a.findRepositoryFromRequest(w, r, *account)
 	if repo == nil {
-		return
+		return nil, nil
 	}
 	parsedDigest, err := digest.Parse(mux.Vars(r)["digest"])
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
-		return
+		return nil, nil
 	}
 
 	manifest, err := keppel.FindManifest(a.db, *repo, parsedDigest.String())
 	if err == sql.ErrNoRows {
 		http.Error(w, "not found", http.StatusNotFound)
-		return
+		return nil, nil
 	}
 	if respondwith.ErrorText(w, err) {
+		return nil, nil
+	}
+	return repo, manifest
+}
+
+func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/vulnerability_report")
+	repo, manifest := a.findManifestFromRequest(w, r)
+	if manifest == nil {
 		return
 	}
 
-	vulnerability, err := keppel.GetVulnerabilityInfo(a.db, repo.ID, parsedDigest.String())
+	vulnerability, err := keppel.GetVulnerabilityInfo(a.db, repo.ID, manifest.Digest)
 	if err == sql.ErrNoRows {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -327,3 +570,114 @@ func (a *API) handleGetVulnerabilityReport(w http.ResponseWriter, r *http.Reques
 	}
 	respondwith.JSON(w, http.StatusOK, clairReport)
 }
+
+// ReplicationStatus represents the replication progress of a manifest in the API.
+type ReplicationStatus struct {
+	Blobs     ReplicationProgress `json:"blobs"`
+	SizeBytes ReplicationProgress `json:"size_bytes"`
+}
+
+// ReplicationProgress appears in type ReplicationStatus.
+type ReplicationProgress struct {
+	Total      uint64 `json:"total"`
+	Replicated uint64 `json:"replicated"`
+	Pending    uint64 `json:"pending"`
+}
+
+// Blobs that have not been replicated yet exist in the DB without a storage ID.
+var replicationStatusQuery = sqlext.SimplifyWhitespace(`
+	SELECT COUNT(*), COALESCE(SUM(b.size_bytes), 0),
+	       COUNT(*) FILTER (WHERE b.storage_id != ''), COALESCE(SUM(b.size_bytes) FILTER (WHERE b.storage_id != ''), 0)
+	  FROM manifest_blob_refs r
+	  JOIN blobs b ON b.id = r.blob_id
+	 WHERE r.repo_id = $1 AND r.digest = $2
+`)
+
+func (a *API) handleGetReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/replication_status")
+	repo, manifest := a.findManifestFromRequest(w, r)
+	if manifest == nil {
+		return
+	}
+
+	var status ReplicationStatus
+	err := a.db.QueryRow(replicationStatusQuery, repo.ID, manifest.Digest).Scan(
+		&status.Blobs.Total, &status.SizeBytes.Total,
+		&status.Blobs.Replicated, &status.SizeBytes.Replicated,
+	)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	status.Blobs.Pending = status.Blobs.Total - status.Blobs.Replicated
+	status.SizeBytes.Pending = status.SizeBytes.Total - status.SizeBytes.Replicated
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"replication_status": status})
+}
+
+var tagsForDigestQuery = sqlext.SimplifyWhitespace(`
+	SELECT * FROM tags WHERE repo_id = $1 AND digest = $2 ORDER BY name
+`)
+
+func (a *API) handleGetManifestTags(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/tags")
+	repo, manifest := a.findManifestFromRequest(w, r)
+	if manifest == nil {
+		return
+	}
+
+	var dbTags []keppel.Tag
+	_, err := a.db.Select(&dbTags, tagsForDigestQuery, repo.ID, manifest.Digest)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	tags := make([]Tag, len(dbTags))
+	for idx, dbTag := range dbTags {
+		tags[idx] = Tag{
+			Name:         dbTag.Name,
+			PushedAt:     dbTag.PushedAt.Unix(),
+			LastPulledAt: keppel.MaybeTimeToUnix(dbTag.LastPulledAt),
+		}
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+}
+
+// ManifestPlatform is how a single entry of a list manifest's platform index
+// appears in the API.
+type ManifestPlatform struct {
+	Digest       string `json:"digest"`
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+var platformsForDigestQuery = sqlext.SimplifyWhitespace(`
+	SELECT child_digest, os, architecture, variant FROM manifest_platforms
+	 WHERE repo_id = $1 AND digest = $2
+	   AND ($3 = '' OR os = $3) AND ($4 = '' OR architecture = $4) AND ($5 = '' OR variant = $5)
+	 ORDER BY os, architecture, variant, child_digest
+`)
+
+func (a *API) handleGetManifestPlatforms(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_manifests/:digest/platforms")
+	repo, manifest := a.findManifestFromRequest(w, r)
+	if manifest == nil {
+		return
+	}
+
+	//the platform index is filled when list manifests are pushed, so this is a
+	//cheap lookup instead of having to parse the manifest contents again
+	query := r.URL.Query()
+	platforms := []ManifestPlatform{}
+	err := sqlext.ForeachRow(a.db, platformsForDigestQuery,
+		[]interface{}{repo.ID, manifest.Digest, query.Get("os"), query.Get("architecture"), query.Get("variant")},
+		func(rows *sql.Rows) error {
+			var p ManifestPlatform
+			err := rows.Scan(&p.Digest, &p.OS, &p.Architecture, &p.Variant)
+			platforms = append(platforms, p)
+			return err
+		},
+	)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{"platforms": platforms})
+}
@@ -19,6 +19,7 @@
 package keppelv1_test
 
 import (
+	"fmt"
 	"net/http"
 	"sort"
 	"strings"
@@ -428,6 +429,629 @@ func TestManifestsAPI(t *testing.T) {
 	})
 }
 
+func TestVulnerabilityStatusExportAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//setup two test accounts with some repos (`repo2-1` only exists to validate
+	//that we don't accidentally list manifests from there)
+	mustInsert(t, s.DB, &keppel.Account{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"})
+	mustInsert(t, s.DB, &keppel.Account{Name: "test2", AuthTenantID: "tenant2", GCPoliciesJSON: "[]"})
+	repos := []*keppel.Repository{
+		{Name: "repo1-1", AccountName: "test1"},
+		{Name: "repo1-2", AccountName: "test1"},
+		{Name: "repo2-1", AccountName: "test2"},
+	}
+	for _, repo := range repos {
+		mustInsert(t, s.DB, repo)
+	}
+
+	//test empty GET
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/vulnerability_statuses",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//insert some dummy manifests into each repo, and tag the first one
+	var renderedManifests []assert.JSONObject
+	for repoID := 1; repoID <= 3; repoID++ {
+		for idx := 1; idx <= 3; idx++ {
+			digest := deterministicDummyDigest(repoID*10 + idx)
+			pushedAt := time.Unix(int64(1000*(repoID*10+idx)), 0)
+			mustInsert(t, s.DB, &keppel.Manifest{
+				RepositoryID: int64(repoID),
+				Digest:       digest,
+				MediaType:    schema2.MediaTypeManifest,
+				SizeBytes:    1000,
+				PushedAt:     pushedAt,
+				ValidatedAt:  pushedAt,
+			})
+			mustInsert(t, s.DB, &keppel.VulnerabilityInfo{
+				RepositoryID: int64(repoID),
+				Digest:       digest,
+				Status:       deterministicDummyVulnStatus(repoID*10 + idx),
+				NextCheckAt:  time.Unix(0, 0),
+			})
+
+			rendered := assert.JSONObject{
+				"repository":           repos[repoID-1].Name,
+				"digest":               digest,
+				"vulnerability_status": string(deterministicDummyVulnStatus(repoID*10 + idx)),
+			}
+			if idx == 1 {
+				for _, tagName := range []string{"latest", "first"} {
+					mustInsert(t, s.DB, &keppel.Tag{
+						RepositoryID: int64(repoID),
+						Name:         tagName,
+						Digest:       digest,
+						PushedAt:     pushedAt,
+					})
+				}
+				rendered["tags"] = []string{"first", "latest"}
+			}
+			if repoID != 3 {
+				renderedManifests = append(renderedManifests, rendered)
+			}
+		}
+	}
+	sort.Slice(renderedManifests, func(i, j int) bool {
+		lhs := renderedManifests[i]["repository"].(string) + "@" + renderedManifests[i]["digest"].(string)
+		rhs := renderedManifests[j]["repository"].(string) + "@" + renderedManifests[j]["digest"].(string)
+		return lhs < rhs
+	})
+
+	//test GET without pagination
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/vulnerability_statuses",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": renderedManifests},
+	}.Check(t, h)
+
+	//test GET with pagination
+	for offset := 0; offset < len(renderedManifests); offset += 4 {
+		path := "/keppel/v1/accounts/test1/vulnerability_statuses?limit=4"
+		if offset > 0 {
+			previous := renderedManifests[offset-1]
+			path += fmt.Sprintf("&marker=%s@%s", previous["repository"], previous["digest"])
+		}
+		end := offset + 4
+		expectedBody := assert.JSONObject{}
+		if end < len(renderedManifests) {
+			expectedBody["truncated"] = true
+		} else {
+			end = len(renderedManifests)
+		}
+		expectedBody["manifests"] = renderedManifests[offset:end]
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         path,
+			Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   expectedBody,
+		}.Check(t, h)
+	}
+
+	//without pull permission, manifests are only listed for repositories that
+	//an RBAC policy allows pulling from
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/vulnerability_statuses",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": []assert.JSONObject{}},
+	}.Check(t, h)
+	mustInsert(t, s.DB, &keppel.RBACPolicy{AccountName: "test1", RepositoryPattern: "repo1-2", CanPullAnonymously: true})
+	var repo12Manifests []assert.JSONObject
+	for _, m := range renderedManifests {
+		if m["repository"] == "repo1-2" {
+			repo12Manifests = append(repo12Manifests, m)
+		}
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/vulnerability_statuses",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"manifests": repo12Manifests},
+	}.Check(t, h)
+
+	//test GET failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/vulnerability_statuses",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for keppel_account:test1:view\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/vulnerability_statuses?limit=foo",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   assert.StringData("strconv.ParseUint: parsing \"foo\": invalid syntax\n"),
+	}.Check(t, h)
+}
+
 func p2time(x time.Time) *time.Time {
 	return &x
 }
+
+func TestReplicationStatusAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]", UpstreamPeerHostName: "registry-secondary.example.org"})
+	repo := keppel.Repository{Name: "repo1", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo)
+
+	//setup a manifest that was replicated, but only some of its blobs were
+	//pulled yet (the other blobs are known without being backed by storage)
+	manifestDigest := deterministicDummyDigest(1)
+	mustInsert(t, s.DB, &keppel.Manifest{
+		RepositoryID: repo.ID,
+		Digest:       manifestDigest,
+		MediaType:    schema2.MediaTypeManifest,
+		SizeBytes:    1000,
+		PushedAt:     time.Unix(1000, 0),
+		ValidatedAt:  time.Unix(1000, 0),
+	})
+	for idx := 1; idx <= 3; idx++ {
+		blob := keppel.Blob{
+			AccountName: "test1",
+			Digest:      deterministicDummyDigest(100 + idx),
+			SizeBytes:   uint64(1000 * idx),
+			PushedAt:    time.Unix(1000, 0),
+			ValidatedAt: time.Unix(1000, 0),
+		}
+		if idx == 1 {
+			blob.StorageID = "storage-id-1"
+		}
+		mustInsert(t, s.DB, &blob)
+		err := keppel.MountBlobIntoRepo(s.DB, blob, repo)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = s.DB.Exec(
+			`INSERT INTO manifest_blob_refs (repo_id, digest, blob_id) VALUES ($1, $2, $3)`,
+			repo.ID, manifestDigest, blob.ID,
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + manifestDigest + "/replication_status",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(2) + "/replication_status",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+
+	//test half-replicated manifest
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + manifestDigest + "/replication_status",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"replication_status": assert.JSONObject{
+				"blobs":      assert.JSONObject{"total": 3, "replicated": 1, "pending": 2},
+				"size_bytes": assert.JSONObject{"total": 6000, "replicated": 1000, "pending": 5000},
+			},
+		},
+	}.Check(t, h)
+
+	//once the remaining blobs are replicated, nothing is pending anymore
+	_, err := s.DB.Exec(`UPDATE blobs SET storage_id = 'storage-id-' || id WHERE storage_id = ''`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + manifestDigest + "/replication_status",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"replication_status": assert.JSONObject{
+				"blobs":      assert.JSONObject{"total": 3, "replicated": 3, "pending": 0},
+				"size_bytes": assert.JSONObject{"total": 6000, "replicated": 6000, "pending": 0},
+			},
+		},
+	}.Check(t, h)
+}
+
+func TestManifestTagsAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"})
+	repo := keppel.Repository{Name: "repo1", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo)
+
+	//setup two manifests, one of which is referenced by two tags
+	for idx := 1; idx <= 2; idx++ {
+		mustInsert(t, s.DB, &keppel.Manifest{
+			RepositoryID: repo.ID,
+			Digest:       deterministicDummyDigest(idx),
+			MediaType:    schema2.MediaTypeManifest,
+			SizeBytes:    1000,
+			PushedAt:     time.Unix(1000, 0),
+			ValidatedAt:  time.Unix(1000, 0),
+		})
+	}
+	lastPulledAt := time.Unix(3000, 0)
+	mustInsert(t, s.DB, &keppel.Tag{RepositoryID: repo.ID, Name: "stable", Digest: deterministicDummyDigest(1), PushedAt: time.Unix(2000, 0)})
+	mustInsert(t, s.DB, &keppel.Tag{RepositoryID: repo.ID, Name: "latest", Digest: deterministicDummyDigest(1), PushedAt: time.Unix(2100, 0), LastPulledAt: &lastPulledAt})
+	mustInsert(t, s.DB, &keppel.Tag{RepositoryID: repo.ID, Name: "other", Digest: deterministicDummyDigest(2), PushedAt: time.Unix(2200, 0)})
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(1) + "/tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(3) + "/tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+
+	//both tags pointing to the first manifest are returned (sorted by name)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(1) + "/tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"tags": []assert.JSONObject{
+				{"name": "latest", "pushed_at": 2100, "last_pulled_at": 3000},
+				{"name": "stable", "pushed_at": 2000, "last_pulled_at": nil},
+			},
+		},
+	}.Check(t, h)
+
+	//manifests without tags yield an empty list
+	_, err := s.DB.Exec(`DELETE FROM tags WHERE name = $1`, "other")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(2) + "/tags",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tags": []assert.JSONObject{}},
+	}.Check(t, h)
+}
+
+func TestManifestPlatformsAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{Name: "repo1", AccountName: "test1"}),
+	)
+	h := s.Handler
+	repoRef := keppel.Repository{Name: "repo1", AccountName: "test1"}
+
+	//push a multi-arch image (the list assigns the platforms linux/amd64,
+	//linux/arm and linux/arm64 to the images in this order)
+	images := make([]test.Image, 3)
+	for idx := range images {
+		images[idx] = test.GenerateImage(test.GenerateExampleLayer(int64(idx + 1)))
+	}
+	imageList := test.GenerateImageList(images...)
+	imageList.MustUpload(t, s, repoRef, "latest")
+
+	listPath := "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + imageList.Manifest.Digest.String() + "/platforms"
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         listPath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(1) + "/platforms",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+
+	//the platform index was stored when the list manifest was pushed
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         listPath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"platforms": []assert.JSONObject{
+				{"digest": images[0].Manifest.Digest.String(), "os": "linux", "architecture": "amd64"},
+				{"digest": images[1].Manifest.Digest.String(), "os": "linux", "architecture": "arm"},
+				{"digest": images[2].Manifest.Digest.String(), "os": "linux", "architecture": "arm64"},
+			},
+		},
+	}.Check(t, h)
+
+	//filtering by platform answers "does this image have a linux/arm64 variant?"
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         listPath + "?os=linux&architecture=arm64",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"platforms": []assert.JSONObject{
+				{"digest": images[2].Manifest.Digest.String(), "os": "linux", "architecture": "arm64"},
+			},
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         listPath + "?os=windows",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"platforms": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//image manifests do not have a platform index
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + images[0].Manifest.Digest.String() + "/platforms",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"platforms": []assert.JSONObject{}},
+	}.Check(t, h)
+}
+
+func TestRestoreManifestAPI(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithKeppelAPI,
+		test.WithQuotas,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithRepo(keppel.Repository{Name: "repo1", AccountName: "test1"}),
+	)
+	h := s.Handler
+	repoRef := keppel.Repository{Name: "repo1", AccountName: "test1"}
+
+	//push a multi-arch image without tag, then tombstone the list and its
+	//submanifests like the manifest sync would
+	images := make([]test.Image, 2)
+	for idx := range images {
+		images[idx] = test.GenerateImage(test.GenerateExampleLayer(int64(idx + 1)))
+	}
+	imageList := test.GenerateImageList(images...)
+	imageList.MustUpload(t, s, repoRef, "")
+	mustExec(t, s.DB, `UPDATE manifests SET deleted_at = $1`, s.Clock.Now())
+	s.Auditor.IgnoreEventsUntilNow()
+
+	token := s.GetToken(t, "repository:test1/repo1:pull")
+	expectPullable := func(manifestDigest string, contents []byte) {
+		t.Helper()
+		if contents == nil {
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/repo1/manifests/" + manifestDigest,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusNotFound,
+			}.Check(t, h)
+		} else {
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/repo1/manifests/" + manifestDigest,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusOK,
+				ExpectBody:   assert.ByteData(contents),
+			}.Check(t, h)
+		}
+	}
+	listDigest := imageList.Manifest.Digest.String()
+	expectPullable(listDigest, nil)
+	expectPullable(images[0].Manifest.Digest.String(), nil)
+
+	//test failure cases
+	restorePath := "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + listDigest + "/restore"
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         restorePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(1) + "/restore",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such manifest\n"),
+	}.Check(t, h)
+
+	//restoring the list also restores its submanifests
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         restorePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	expectPullable(listDigest, imageList.Manifest.Contents)
+	for _, image := range images {
+		expectPullable(image.Manifest.Digest.String(), image.Manifest.Contents)
+	}
+
+	s.Auditor.ExpectEvents(t, cadf.Event{
+		RequestPath: restorePath,
+		Action:      cadf.UpdateAction,
+		Outcome:     "success",
+		Reason:      test.CADFReasonOK,
+		Target: cadf.Resource{
+			TypeURI:   "docker-registry/account/repository/manifest",
+			Name:      "test1/repo1@" + listDigest,
+			ID:        listDigest,
+			ProjectID: "tenant1",
+		},
+	})
+
+	//restoring a manifest that is not deleted is a no-op
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         restorePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,delete:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	s.Auditor.ExpectEvents(t /*, nothing */)
+}
+
+func TestRevalidateManifestAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"})
+	repo := keppel.Repository{Name: "repo1", AccountName: "test1"}
+	mustInsert(t, s.DB, &repo)
+	mustInsert(t, s.DB, &keppel.Manifest{
+		RepositoryID:           repo.ID,
+		Digest:                 deterministicDummyDigest(1),
+		MediaType:              schema2.MediaTypeManifest,
+		SizeBytes:              1000,
+		PushedAt:               time.Unix(1000, 0),
+		ValidatedAt:            time.Unix(2000, 0),
+		ValidationErrorMessage: "manifest blob unknown to registry",
+	})
+
+	//test failure cases
+	revalidatePath := "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(1) + "/revalidate"
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         revalidatePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1/_manifests/" + deterministicDummyDigest(2) + "/revalidate",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody:   assert.StringData("no such manifest\n"),
+	}.Check(t, h)
+
+	//success case clears the validation error and schedules the manifest for revalidation
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         revalidatePath,
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		ExpectStatus: http.StatusNoContent,
+	}.Check(t, h)
+	manifest, err := keppel.FindManifest(s.DB, repo, deterministicDummyDigest(1))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "validation_error_message", manifest.ValidationErrorMessage, "")
+	assert.DeepEqual(t, "validated_at", manifest.ValidatedAt.Unix(), int64(0))
+}
+
+func TestTagHistoryAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{Name: "test1", AuthTenantID: "tenant1", GCPoliciesJSON: "[]"})
+	mustInsert(t, s.DB, &keppel.Repository{Name: "repo1-1", AccountName: "test1"})
+
+	//the tag history is not tied to the repository, so entries for a deleted
+	//repository (with ID 2 in this case) are still reported
+	var renderedEntries []assert.JSONObject
+	for idx := 1; idx <= 4; idx++ {
+		tagName := "latest"
+		if idx%2 == 0 {
+			tagName = "stable"
+		}
+		mustInsert(t, s.DB, &keppel.TagHistoryEntry{
+			RepositoryID:   2,
+			TagName:        tagName,
+			OldDigest:      deterministicDummyDigest(idx),
+			NewDigest:      deterministicDummyDigest(idx + 1),
+			MovedAt:        time.Unix(int64(1000*idx), 0),
+			MovedBy:        "someone",
+			AccountName:    "test1",
+			RepositoryName: "deleted-repo",
+		})
+		renderedEntries = append(renderedEntries, assert.JSONObject{
+			"id":         idx,
+			"tag":        tagName,
+			"old_digest": deterministicDummyDigest(idx),
+			"new_digest": deterministicDummyDigest(idx + 1),
+			"moved_at":   1000 * idx,
+			"moved_by":   "someone",
+		})
+	}
+
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/deleted-repo/_tag_history",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tag_history": renderedEntries},
+	}.Check(t, h)
+
+	//test filtering by tag name
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/deleted-repo/_tag_history?tag=stable",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tag_history": []assert.JSONObject{renderedEntries[1], renderedEntries[3]}},
+	}.Check(t, h)
+
+	//test pagination
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/deleted-repo/_tag_history?limit=3",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tag_history": renderedEntries[0:3], "truncated": true},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/deleted-repo/_tag_history?limit=3&marker=3",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tag_history": renderedEntries[3:]},
+	}.Check(t, h)
+
+	//other repos have no history
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/repo1-1/_tag_history",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"tag_history": []assert.JSONObject{}},
+	}.Check(t, h)
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/deleted-repo/_tag_history",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test1/deleted-repo:pull\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test2/repositories/deleted-repo/_tag_history",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody:   assert.StringData("no permission for repository:test2/deleted-repo:pull\n"),
+	}.Check(t, h)
+}
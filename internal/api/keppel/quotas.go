@@ -43,6 +43,17 @@ type quotaResponse struct {
 	Manifests quotaAndUsage `json:"manifests"`
 }
 
+type accountUsage struct {
+	Repositories  uint64 `json:"repositories"`
+	Manifests     uint64 `json:"manifests"`
+	BlobSizeBytes uint64 `json:"blob_size_bytes"`
+}
+
+type accountUsageResponse struct {
+	Usage  accountUsage  `json:"usage"`
+	Quotas quotaResponse `json:"quotas"`
+}
+
 type justQuota struct {
 	Quota uint64 `json:"quota"`
 }
@@ -59,13 +70,10 @@ func (a *API) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	quotas, err := keppel.FindQuotas(a.db, authTenantID)
+	quotas, err := keppel.FindQuotasOrDefault(a.db, authTenantID)
 	if respondwith.ErrorText(w, err) {
 		return
 	}
-	if quotas == nil {
-		quotas = keppel.DefaultQuotas(authTenantID)
-	}
 
 	manifestCount, err := quotas.GetManifestUsage(a.db)
 	if respondwith.ErrorText(w, err) {
@@ -80,6 +88,48 @@ func (a *API) handleGetQuotas(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (a *API) handleGetAccountUsage(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/usage")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanViewAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+
+	usage, err := keppel.GetAccountUsage(a.db, *account)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	//the manifest quota is shared between all accounts of the auth tenant, so we
+	//report it in the same way as the manifest push does when enforcing it
+	quotas, err := keppel.FindQuotasOrDefault(a.db, account.AuthTenantID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	manifestCount, err := quotas.GetManifestUsage(a.db)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, accountUsageResponse{
+		Usage: accountUsage{
+			Repositories:  usage.RepositoryCount,
+			Manifests:     usage.ManifestCount,
+			BlobSizeBytes: usage.BlobSizeBytes,
+		},
+		Quotas: quotaResponse{
+			Manifests: quotaAndUsage{
+				Quota: quotas.ManifestCount,
+				Usage: manifestCount,
+			},
+		},
+	})
+}
+
 func (a *API) handlePutQuotas(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/keppel/v1/quotas/:auth_tenant_id")
 	authTenantID := mux.Vars(r)["auth_tenant_id"]
@@ -19,6 +19,7 @@
 package keppelv1_test
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
 	"time"
@@ -186,3 +187,131 @@ func TestQuotasAPI(t *testing.T) {
 
 	//TODO audit events
 }
+
+func TestAccountUsageAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//two accounts in the same auth tenant share the manifest quota
+	for _, accountName := range []string{"test1", "test2"} {
+		mustInsert(t, s.DB, &keppel.Account{
+			Name:           accountName,
+			AuthTenantID:   "tenant1",
+			GCPoliciesJSON: "[]",
+		})
+	}
+	mustInsert(t, s.DB, &keppel.Quotas{AuthTenantID: "tenant1", ManifestCount: 100})
+
+	//empty account reports zero usage
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/usage",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"usage": assert.JSONObject{
+				"repositories":    0,
+				"manifests":       0,
+				"blob_size_bytes": 0,
+			},
+			"quotas": assert.JSONObject{
+				"manifests": assert.JSONObject{"quota": 100, "usage": 0},
+			},
+		},
+	}.Check(t, h)
+
+	//seed some data: test1 gets two repos with 3 manifests and 2 blobs, test2
+	//gets one repo with 4 manifests and 1 blob
+	mustInsert(t, s.DB, &keppel.Repository{Name: "repo1", AccountName: "test1"}) //ID = 1
+	mustInsert(t, s.DB, &keppel.Repository{Name: "repo2", AccountName: "test1"}) //ID = 2
+	mustInsert(t, s.DB, &keppel.Repository{Name: "repo1", AccountName: "test2"}) //ID = 3
+	for idx, repoID := range []int64{1, 1, 2, 3, 3, 3, 3} {
+		pushedAt := time.Unix(int64(10000+10*idx), 0)
+		mustInsert(t, s.DB, &keppel.Manifest{
+			RepositoryID: repoID,
+			Digest:       deterministicDummyDigest(idx),
+			SizeBytes:    1000,
+			PushedAt:     pushedAt,
+			ValidatedAt:  pushedAt,
+		})
+	}
+	for idx, accountName := range []string{"test1", "test1", "test2"} {
+		mustInsert(t, s.DB, &keppel.Blob{
+			AccountName: accountName,
+			Digest:      deterministicDummyDigest(100 + idx),
+			SizeBytes:   uint64(2000 * (idx + 1)),
+			StorageID:   fmt.Sprintf("storage-id-%d", idx),
+			PushedAt:    time.Unix(20000, 0),
+			ValidatedAt: time.Unix(20000, 0),
+		})
+	}
+
+	//usage is reported per account, but the manifest quota covers the whole auth tenant
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/usage",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"usage": assert.JSONObject{
+				"repositories":    2,
+				"manifests":       3,
+				"blob_size_bytes": 6000,
+			},
+			"quotas": assert.JSONObject{
+				"manifests": assert.JSONObject{"quota": 100, "usage": 7},
+			},
+		},
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test2/usage",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"usage": assert.JSONObject{
+				"repositories":    1,
+				"manifests":       4,
+				"blob_size_bytes": 6000,
+			},
+			"quotas": assert.JSONObject{
+				"manifests": assert.JSONObject{"quota": 100, "usage": 7},
+			},
+		},
+	}.Check(t, h)
+
+	//soft-deleted manifests (as left behind by the manifest sync on replicas)
+	//do not count towards usage or quota
+	mustExec(t, s.DB, `UPDATE manifests SET deleted_at = $1 WHERE repo_id = 3 AND digest = $2`,
+		time.Unix(30000, 0), deterministicDummyDigest(3))
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test2/usage",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"usage": assert.JSONObject{
+				"repositories":    1,
+				"manifests":       3,
+				"blob_size_bytes": 6000,
+			},
+			"quotas": assert.JSONObject{
+				"manifests": assert.JSONObject{"quota": 100, "usage": 6},
+			},
+		},
+	}.Check(t, h)
+
+	//error cases
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/usage",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant2"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test3/usage",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+}
@@ -20,6 +20,9 @@ package keppelv1
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -37,6 +40,13 @@ type Repository struct {
 	TagCount      uint64 `json:"tag_count"`
 	SizeBytes     uint64 `json:"size_bytes,omitempty"`
 	PushedAt      int64  `json:"pushed_at,omitempty"`
+	Description   string `json:"description,omitempty"`
+}
+
+// RepositoryMetadata represents the user-supplied metadata of a repository in the API.
+type RepositoryMetadata struct {
+	Description string            `json:"description"`
+	Metadata    map[string]string `json:"metadata"`
 }
 
 var repositoryGetQuery = sqlext.SimplifyWhitespace(`
@@ -50,6 +60,7 @@ var repositoryGetQuery = sqlext.SimplifyWhitespace(`
 		manifest_stats AS (
 			SELECT repo_id, COUNT(*) AS count, MAX(pushed_at) AS pushed_at
 			  FROM manifests
+			 WHERE deleted_at IS NULL
 			 GROUP BY repo_id
 		),
 		tag_stats AS (
@@ -60,11 +71,13 @@ var repositoryGetQuery = sqlext.SimplifyWhitespace(`
 	SELECT r.name,
 	       bs.size_bytes,
 	       ms.count, ms.pushed_at,
-	       ts.count, ts.pushed_at
+	       ts.count, ts.pushed_at,
+	       rm.description
 	  FROM repos r
 	  LEFT OUTER JOIN blob_stats     bs ON r.id = bs.repo_id
 	  LEFT OUTER JOIN manifest_stats ms ON r.id = ms.repo_id
 	  LEFT OUTER JOIN tag_stats      ts ON r.id = ts.repo_id
+	  LEFT OUTER JOIN repo_metadata  rm ON r.id = rm.repo_id
 	 WHERE r.account_name = $1 AND $CONDITION
 	 ORDER BY name ASC
 	 LIMIT $LIMIT
@@ -104,12 +117,14 @@ func (a *API) handleGetRepositories(w http.ResponseWriter, r *http.Request) {
 			maxManifestPushedAt *time.Time
 			tagCount            *uint64
 			maxTagPushedAt      *time.Time
+			description         *string
 		)
 		err := rows.Scan(
 			&name,
 			&sizeBytes,
 			&manifestCount, &maxManifestPushedAt,
 			&tagCount, &maxTagPushedAt,
+			&description,
 		)
 		if err == nil {
 			result.Repos = append(result.Repos, Repository{
@@ -119,6 +134,9 @@ func (a *API) handleGetRepositories(w http.ResponseWriter, r *http.Request) {
 				SizeBytes:     unpackUint64OrZero(sizeBytes),
 				PushedAt:      maxTimeToUnix(maxTagPushedAt, maxManifestPushedAt),
 			})
+			if description != nil {
+				result.Repos[len(result.Repos)-1].Description = *description
+			}
 		}
 		return err
 	})
@@ -179,9 +197,11 @@ func (a *API) handleDeleteRepository(w http.ResponseWriter, r *http.Request) {
 	}
 	defer sqlext.RollbackUnlessCommitted(tx)
 
-	//deleting a repo is only allowed if there is nothing in it
+	//deleting a repo is only allowed if there is nothing in it (soft-deleted
+	//manifests do not count since they are invisible to the user; they are
+	//removed together with the repo)
 	manifestCount, err := tx.SelectInt(
-		`SELECT COUNT(*) FROM manifests WHERE repo_id = $1`,
+		`SELECT COUNT(*) FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`,
 		repo.ID,
 	)
 	if respondwith.ErrorText(w, err) {
@@ -216,3 +236,179 @@ func (a *API) handleDeleteRepository(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// The metadata of a repository is not meant to be a general-purpose data
+// store, so we limit how large it can get.
+const maxRepositoryMetadataBytes = 64 << 10
+
+func (a *API) handleGetRepositoryMetadata(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_metadata")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPullFromAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	dbMeta, err := keppel.FindRepositoryMetadata(a.db, *repo)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	meta, err := renderRepositoryMetadata(dbMeta)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, meta)
+}
+
+func (a *API) handlePutRepositoryMetadata(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_metadata")
+	authz := a.authenticateRequest(w, r, repoScopeFromRequest(r, keppel.CanPushToAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//parse request
+	var req RepositoryMetadata
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRepositoryMetadataBytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		msg := fmt.Sprintf("request body may not be larger than %d bytes", maxRepositoryMetadataBytes)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "request body is not valid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for key := range req.Metadata {
+		if key == "" {
+			http.Error(w, "metadata keys may not be empty", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	dbMeta := keppel.RepositoryMetadata{
+		RepositoryID: repo.ID,
+		Description:  req.Description,
+	}
+	if len(req.Metadata) > 0 {
+		metadataJSON, _ := json.Marshal(req.Metadata) //nolint:errcheck
+		dbMeta.MetadataJSON = string(metadataJSON)
+	}
+
+	tx, err := a.db.Begin()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	defer sqlext.RollbackUnlessCommitted(tx)
+
+	//empty metadata is stored by not having a record at all
+	_, err = tx.Exec(`DELETE FROM repo_metadata WHERE repo_id = $1`, repo.ID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	if dbMeta.Description != "" || dbMeta.MetadataJSON != "" {
+		err = tx.Insert(&dbMeta)
+		if respondwith.ErrorText(w, err) {
+			return
+		}
+	}
+	err = tx.Commit()
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+
+	meta, err := renderRepositoryMetadata(&dbMeta)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	respondwith.JSON(w, http.StatusOK, meta)
+}
+
+func renderRepositoryMetadata(dbMeta *keppel.RepositoryMetadata) (RepositoryMetadata, error) {
+	result := RepositoryMetadata{Metadata: make(map[string]string)}
+	if dbMeta == nil {
+		return result, nil
+	}
+	result.Description = dbMeta.Description
+	if dbMeta.MetadataJSON != "" {
+		err := json.Unmarshal([]byte(dbMeta.MetadataJSON), &result.Metadata)
+		if err != nil {
+			return RepositoryMetadata{}, fmt.Errorf("malformed metadata JSON: %q", dbMeta.MetadataJSON)
+		}
+	}
+	return result, nil
+}
+
+func (a *API) handlePostRepositorySync(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/repositories/:repo/_sync")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanChangeAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findReplicaAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+	repo := a.findRepositoryFromRequest(w, r, *account)
+	if repo == nil {
+		return
+	}
+
+	//the janitor prefers repos that were never synced, so the sync will happen
+	//on the next tick of SyncManifestsInNextRepo
+	_, err := a.db.Exec(`UPDATE repos SET next_manifest_sync_at = NULL WHERE id = $1`, repo.ID)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *API) handlePostAccountSync(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/keppel/v1/accounts/:account/_sync")
+	authz := a.authenticateRequest(w, r, accountScopeFromRequest(r, keppel.CanChangeAccount))
+	if authz == nil {
+		return
+	}
+	account := a.findReplicaAccountFromRequest(w, r)
+	if account == nil {
+		return
+	}
+
+	_, err := a.db.Exec(`UPDATE repos SET next_manifest_sync_at = NULL WHERE account_name = $1`, account.Name)
+	if respondwith.ErrorText(w, err) {
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Like findAccountFromRequest, but only accepts replica accounts, since only
+// those have their manifests synced from upstream.
+func (a *API) findReplicaAccountFromRequest(w http.ResponseWriter, r *http.Request) *keppel.Account {
+	account := a.findAccountFromRequest(w, r)
+	if account == nil {
+		return nil
+	}
+	if account.UpstreamPeerHostName == "" && account.ExternalPeerURL == "" {
+		http.Error(w, "cannot sync an account that is not a replica", http.StatusConflict)
+		return nil
+	}
+	return account
+}
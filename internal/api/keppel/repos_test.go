@@ -23,6 +23,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
@@ -269,3 +270,172 @@ func TestReposAPI(t *testing.T) {
 		ExpectBody:   assert.StringData("cannot delete repository while there are still manifests in it\n"),
 	}.Check(t, h)
 }
+
+func TestRepositorySyncAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//setup a replica account and a primary account with some repos that were synced recently
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:                 "test1",
+		AuthTenantID:         "tenant1",
+		GCPoliciesJSON:       "[]",
+		UpstreamPeerHostName: "registry-secondary.example.org",
+	})
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "test2",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	})
+	nextSyncAt := time.Unix(3600, 0)
+	for _, repo := range []keppel.Repository{
+		{AccountName: "test1", Name: "foo"},
+		{AccountName: "test1", Name: "bar"},
+		{AccountName: "test2", Name: "foo"},
+	} {
+		repo.NextManifestSyncAt = &nextSyncAt
+		mustInsert(t, s.DB, &repo)
+	}
+
+	//test failure cases
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_sync",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_sync",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test2/repositories/foo/_sync",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusConflict,
+		ExpectBody:   assert.StringData("cannot sync an account that is not a replica\n"),
+	}.Check(t, h)
+
+	//syncing a single repo makes it immediately eligible for SyncManifestsInNextRepo
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_sync",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`UPDATE repos SET next_manifest_sync_at = NULL WHERE id = 1 AND account_name = 'test1' AND name = 'foo';`)
+
+	//syncing the account does the same for all its repos
+	assert.HTTPRequest{
+		Method:       "POST",
+		Path:         "/keppel/v1/accounts/test1/_sync",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,change:tenant1"},
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`UPDATE repos SET next_manifest_sync_at = NULL WHERE id = 2 AND account_name = 'test1' AND name = 'bar';`)
+}
+
+func TestRepositoryMetadataAPI(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	mustInsert(t, s.DB, &keppel.Account{
+		Name:           "test1",
+		AuthTenantID:   "tenant1",
+		GCPoliciesJSON: "[]",
+	})
+	mustInsert(t, s.DB, &keppel.Repository{AccountName: "test1", Name: "foo"})
+	mustInsert(t, s.DB, &keppel.Repository{AccountName: "test1", Name: "bar"})
+
+	//without any metadata set, an empty result is returned
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"description": "", "metadata": assert.JSONObject{}},
+	}.Check(t, h)
+
+	//test failure cases
+	reqBody := assert.JSONObject{
+		"description": "A very useful image.",
+		"metadata":    assert.JSONObject{"owner": "team-foo", "docs": "https://example.org/foo"},
+	}
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		Body:         reqBody,
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/doesnotexist/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         reqBody,
+		ExpectStatus: http.StatusNotFound,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"metadata": assert.JSONObject{"": "foo"}},
+		ExpectStatus: http.StatusUnprocessableEntity,
+		ExpectBody:   assert.StringData("metadata keys may not be empty\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"description": strings.Repeat("a", 64<<10)},
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectBody:   assert.StringData("request body may not be larger than 65536 bytes\n"),
+	}.Check(t, h)
+
+	//set metadata and read it back
+	tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         reqBody,
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   reqBody,
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`INSERT INTO repo_metadata (repo_id, description, metadata_json) VALUES (1, 'A very useful image.', '{"docs":"https://example.org/foo","owner":"team-foo"}');`)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,pull:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   reqBody,
+	}.Check(t, h)
+
+	//the description also shows up in the repository listing
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test1/repositories",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1"},
+		ExpectStatus: http.StatusOK,
+		ExpectBody: assert.JSONObject{
+			"repositories": []assert.JSONObject{
+				{"name": "bar", "manifest_count": 0, "tag_count": 0},
+				{"name": "foo", "manifest_count": 0, "tag_count": 0, "description": "A very useful image."},
+			},
+		},
+	}.Check(t, h)
+
+	//setting empty metadata removes the record
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         "/keppel/v1/accounts/test1/repositories/foo/_metadata",
+		Header:       map[string]string{"X-Test-Perms": "view:tenant1,push:tenant1"},
+		Body:         assert.JSONObject{"description": ""},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.JSONObject{"description": "", "metadata": assert.JSONObject{}},
+	}.Check(t, h)
+	tr.DBChanges().AssertEqual(`DELETE FROM repo_metadata WHERE repo_id = 1;`)
+}
@@ -20,6 +20,8 @@ package api
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/sapcc/keppel/internal/keppel"
 )
 
 var (
@@ -71,6 +73,30 @@ var (
 		},
 		[]string{"account", "auth_tenant_id", "method"},
 	)
+	//RepoPullsCounter is a prometheus.CounterVec.
+	RepoPullsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_repo_pulls",
+			Help: "Counts manifests and blobs that are pulled from Keppel, per repository.",
+		},
+		[]string{"account", "repo", "type"},
+	)
+	//RepoPushesCounter is a prometheus.CounterVec.
+	RepoPushesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_repo_pushes",
+			Help: "Counts manifests and blobs that are pushed into Keppel, per repository.",
+		},
+		[]string{"account", "repo", "type"},
+	)
+	//StorageDigestMismatchCounter is a prometheus.CounterVec.
+	StorageDigestMismatchCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_storage_digest_mismatches",
+			Help: "Counts manifests and blobs whose contents did not match their digest when they were served to a client (only on sampled requests, see KEPPEL_VERIFY_ON_READ_SAMPLE_RATE).",
+		},
+		[]string{"account", "type"},
+	)
 	//UploadsAbortedCounter is a prometheus.CounterVec.
 	UploadsAbortedCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -88,5 +114,19 @@ func init() {
 	prometheus.MustRegister(BlobsPushedCounter)
 	prometheus.MustRegister(ManifestsPulledCounter)
 	prometheus.MustRegister(ManifestsPushedCounter)
+	prometheus.MustRegister(RepoPullsCounter)
+	prometheus.MustRegister(RepoPushesCounter)
+	prometheus.MustRegister(StorageDigestMismatchCounter)
 	prometheus.MustRegister(UploadsAbortedCounter)
 }
+
+// RepoLabels returns the labels for RepoPullsCounter and RepoPushesCounter.
+// The objectType is either "manifest" or "blob". If the configuration
+// disables repo labels, the "repo" label is left empty.
+func RepoLabels(cfg keppel.Configuration, repo keppel.Repository, objectType string) prometheus.Labels {
+	repoName := repo.Name
+	if cfg.DisableRepoMetricLabels {
+		repoName = ""
+	}
+	return prometheus.Labels{"account": repo.AccountName, "repo": repoName, "type": objectType}
+}
@@ -48,14 +48,21 @@ func (a *API) handleDelegatedPullManifest(w http.ResponseWriter, r *http.Request
 
 	vars := mux.Vars(r)
 	rc := client.RepoClient{
-		Scheme:   "https",
-		Host:     vars["hostname"],
-		RepoName: vars["repo"],
-		UserName: r.Header.Get("X-Keppel-Delegated-Pull-Username"), //may be empty
-		Password: r.Header.Get("X-Keppel-Delegated-Pull-Password"), //may be empty
+		Scheme:     "https",
+		Host:       vars["hostname"],
+		RepoName:   vars["repo"],
+		UserName:   r.Header.Get("X-Keppel-Delegated-Pull-Username"), //may be empty
+		Password:   r.Header.Get("X-Keppel-Delegated-Pull-Password"), //may be empty
+		RateLimits: a.cfg.UpstreamRateLimits,
+	}
+	var (
+		manifestBytes     []byte
+		manifestMediaType string
+	)
+	ref, err := keppel.ParseManifestReference(vars["reference"])
+	if err == nil {
+		manifestBytes, manifestMediaType, err = rc.DownloadManifest(ref, &opts)
 	}
-	ref := keppel.ParseManifestReference(vars["reference"])
-	manifestBytes, manifestMediaType, err := rc.DownloadManifest(ref, &opts)
 	switch err := err.(type) {
 	case nil:
 		break
@@ -0,0 +1,40 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package peerv1
+
+import (
+	"net/http"
+
+	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/respondwith"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// Implementation for the GET /peer/v1/info endpoint.
+func (a *API) handleGetInfo(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/peer/v1/info")
+	peer := a.authenticateRequest(w, r)
+	if peer == nil {
+		return
+	}
+
+	respondwith.JSON(w, http.StatusOK, keppel.OurPeerInfo())
+}
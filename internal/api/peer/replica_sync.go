@@ -147,7 +147,7 @@ func (a *API) handleSyncReplica(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var manifests []keppel.ManifestForSync
-	query = `SELECT digest FROM manifests WHERE repo_id = $1`
+	query = `SELECT digest FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`
 	err = sqlext.ForeachRow(a.db, query, []interface{}{repo.ID}, func(rows *sql.Rows) error {
 		var digest string
 		err = rows.Scan(&digest)
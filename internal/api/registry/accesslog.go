@@ -0,0 +1,149 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// accessLogEntry is the structure of the JSON lines written by the access log.
+//
+// The Authorization header (or any other request header) is deliberately not
+// included to avoid leaking credentials into logs.
+type accessLogEntry struct {
+	Method       string  `json:"method"`
+	Path         string  `json:"path"`
+	AccountName  string  `json:"account,omitempty"`
+	RepoName     string  `json:"repo,omitempty"`
+	Status       int     `json:"status"`
+	BytesWritten uint64  `json:"bytes"`
+	LatencySecs  float64 `json:"latency_secs"`
+	AuthSubject  string  `json:"auth_subject,omitempty"`
+	UserAgent    string  `json:"user_agent,omitempty"`
+}
+
+type accessLogContextKey struct{}
+
+// EnableAccessLog makes this API write a JSON line for each request into the
+// given writer.
+func (a *API) EnableAccessLog(w io.Writer) *API {
+	a.accessLog = &accessLogger{w: w}
+	return a
+}
+
+type accessLogger struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+// withAccessLog wraps a handler such that an access log line is written after
+// it completes, if the access log is enabled.
+func (a *API) withAccessLog(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.accessLog == nil {
+			handler(w, r)
+			return
+		}
+
+		startedAt := a.timeNow()
+		entry := &accessLogEntry{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			UserAgent: r.Header.Get("User-Agent"),
+		}
+		rw := &accessLogResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(rw, r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, entry)))
+
+		entry.Status = rw.status
+		entry.BytesWritten = rw.bytesWritten
+		entry.LatencySecs = a.timeNow().Sub(startedAt).Seconds()
+		a.accessLog.write(*entry)
+	}
+}
+
+func (l *accessLogger) write(entry accessLogEntry) {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		logg.Error("cannot serialize access log entry: %s", err.Error())
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err = l.w.Write(append(buf, '\n'))
+	if err != nil {
+		logg.Error("cannot write access log entry: %s", err.Error())
+	}
+}
+
+// recordAccessLogAuthorization is called by checkAccountAccess() to put the
+// results of the authorization check into the access log entry (if any).
+func recordAccessLogAuthorization(r *http.Request, account *keppel.Account, repo *keppel.Repository, authz *auth.Authorization) {
+	entry, ok := r.Context().Value(accessLogContextKey{}).(*accessLogEntry)
+	if !ok {
+		return
+	}
+	if authz != nil && authz.UserIdentity != nil {
+		entry.AuthSubject = authz.UserIdentity.UserName()
+	}
+	if account != nil {
+		entry.AccountName = account.Name
+	}
+	if repo != nil {
+		entry.RepoName = repo.Name
+	}
+}
+
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status       int
+	bytesWritten uint64
+	wroteHeader  bool
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(buf []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(buf)
+	w.bytesWritten += uint64(n)
+	return n, err
+}
+
+// Flush implements the http.Flusher interface, if the wrapped writer supports it.
+func (w *accessLogResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
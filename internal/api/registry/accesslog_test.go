@@ -0,0 +1,90 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/httpapi"
+
+	registryv2 "github.com/sapcc/keppel/internal/api/registry"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestAccessLog(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, *s.Repos[0], "latest")
+
+	//setup a separate Registry API with access logging enabled
+	var buf bytes.Buffer
+	h := httpapi.Compose(
+		httpapi.WithoutLogging(),
+		registryv2.NewAPI(s.Config, s.AD, s.FD, s.SD, s.ICD, s.DB, s.Auditor, nil).
+			OverrideTimeNow(s.Clock.Now).
+			EnableAccessLog(&buf),
+	)
+
+	token := s.GetToken(t, "repository:test1/foo:pull")
+	assert.HTTPRequest{
+		Method: "GET",
+		Path:   "/v2/test1/foo/manifests/latest",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"User-Agent":    "containerd/1.6",
+		},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.ByteData(image.Manifest.Contents),
+	}.Check(t, h)
+
+	//exactly one line must have been logged for the pull
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.DeepEqual(t, "number of access log lines", len(lines), 1)
+	var entry map[string]any
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "access log entry", entry, map[string]any{
+		"method":       "GET",
+		"path":         "/v2/test1/foo/manifests/latest",
+		"account":      "test1",
+		"repo":         "foo",
+		"status":       float64(http.StatusOK),
+		"bytes":        float64(len(image.Manifest.Contents)),
+		"latency_secs": float64(0),
+		"auth_subject": "correctusername",
+		"user_agent":   "containerd/1.6",
+	})
+
+	//the token must not leak into the log
+	if strings.Contains(buf.String(), token) {
+		t.Error("access log contains the bearer token")
+	}
+}
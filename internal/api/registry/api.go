@@ -21,15 +21,22 @@ package registryv2
 import (
 	"database/sql"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
 	"strconv"
 	"time"
 
+	"github.com/go-redis/redis_rate/v10"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/httpapi"
+	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/respondwith"
+	"go.opentelemetry.io/otel/propagation"
 
+	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/auth"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/processor"
@@ -45,6 +52,8 @@ type API struct {
 	db      *keppel.DB
 	auditor keppel.Auditor
 	rle     *keppel.RateLimitEngine //may be nil
+	//only set if EnableAccessLog() was called
+	accessLog *accessLogger
 	//non-pure functions that can be replaced by deterministic doubles for unit tests
 	timeNow           func() time.Time
 	generateStorageID func() string
@@ -52,7 +61,7 @@ type API struct {
 
 // NewAPI constructs a new API instance.
 func NewAPI(cfg keppel.Configuration, ad keppel.AuthDriver, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor, rle *keppel.RateLimitEngine) *API {
-	return &API{cfg, ad, fd, sd, icd, db, auditor, rle, time.Now, keppel.GenerateStorageID}
+	return &API{cfg, ad, fd, sd, icd, db, auditor, rle, nil, time.Now, keppel.GenerateStorageID}
 }
 
 // OverrideTimeNow replaces time.Now with a test double.
@@ -69,8 +78,9 @@ func (a *API) OverrideGenerateStorageID(generateStorageID func() string) *API {
 
 // AddTo implements the api.API interface.
 func (a *API) AddTo(r *mux.Router) {
-	r.Methods("GET").Path("/v2/").HandlerFunc(a.handleToplevel)
-	r.Methods("GET").Path("/v2/_catalog").HandlerFunc(a.handleGetCatalog)
+	r.Methods("GET").Path("/v2/").HandlerFunc(a.instrument(a.handleToplevel))
+	r.Methods("GET").Path("/v2/_catalog").HandlerFunc(a.instrument(a.handleGetCatalog))
+	r.Methods("GET").Path("/v2/{account:[a-z0-9-]{1,48}}/_catalog").HandlerFunc(a.instrument(a.handleGetAccountCatalog))
 
 	//NOTE: We used to match account name and repository name separately here,
 	//but that is not possible anymore since domain-remapped APIs do not have the
@@ -78,48 +88,135 @@ func (a *API) AddTo(r *mux.Router) {
 	//checkAccountAccess().
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/blobs/{digest}").
-		HandlerFunc(a.handleDeleteBlob)
+		HandlerFunc(a.instrument(a.handleDeleteBlob))
 	r.Methods("GET", "HEAD").
 		Path("/v2/{repository:.+}/blobs/{digest}").
-		HandlerFunc(a.handleGetOrHeadBlob)
+		HandlerFunc(a.instrument(a.handleGetOrHeadBlob))
 	r.Methods("POST").
 		Path("/v2/{repository:.+}/blobs/uploads/").
-		HandlerFunc(a.handleStartBlobUpload)
+		HandlerFunc(a.instrument(a.limitRequestBody(keppel.ErrSizeInvalid, a.handleStartBlobUpload)))
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleDeleteBlobUpload)
+		HandlerFunc(a.instrument(a.handleDeleteBlobUpload))
 	r.Methods("GET").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleGetBlobUpload)
+		HandlerFunc(a.instrument(a.handleGetBlobUpload))
 	r.Methods("PATCH").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleContinueBlobUpload)
+		HandlerFunc(a.instrument(a.limitRequestBody(keppel.ErrSizeInvalid, a.handleContinueBlobUpload)))
 	r.Methods("PUT").
 		Path("/v2/{repository:.+}/blobs/uploads/{uuid}").
-		HandlerFunc(a.handleFinishBlobUpload)
+		HandlerFunc(a.instrument(a.limitRequestBody(keppel.ErrSizeInvalid, a.handleFinishBlobUpload)))
 	r.Methods("DELETE").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handleDeleteManifest)
+		HandlerFunc(a.instrument(a.handleDeleteManifest))
 	r.Methods("GET", "HEAD").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handleGetOrHeadManifest)
+		HandlerFunc(a.instrument(a.handleGetOrHeadManifest))
 	r.Methods("PUT").
 		Path("/v2/{repository:.+}/manifests/{reference}").
-		HandlerFunc(a.handlePutManifest)
+		HandlerFunc(a.instrument(a.limitRequestBody(keppel.ErrManifestInvalid, a.handlePutManifest)))
 	r.Methods("GET").
 		Path("/v2/{repository:.+}/tags/list").
-		HandlerFunc(a.handleListTags)
+		HandlerFunc(a.instrument(a.handleListTags))
 }
 
-func (a *API) processor() *processor.Processor {
-	return processor.New(a.cfg, a.db, a.sd, a.icd, a.auditor).OverrideTimeNow(a.timeNow).OverrideGenerateStorageID(a.generateStorageID)
+// instrument wraps a handler with the access log and a tracing span that
+// covers the whole request, and sets the version header on its responses.
+// If the client sent a trace context, the span joins the client's trace.
+func (a *API) instrument(handler http.HandlerFunc) http.HandlerFunc {
+	handler = a.withAccessLog(withVersionHeader(handler))
+	return func(w http.ResponseWriter, r *http.Request) {
+		spanName := "registry " + r.Method
+		pathTemplate, err := mux.CurrentRoute(r).GetPathTemplate()
+		if err == nil {
+			spanName += " " + pathTemplate
+		}
+		ctx := keppel.TracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := a.cfg.Tracing().StartSpan(ctx, spanName)
+		rw := &accessLogResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(rw, r.WithContext(ctx))
+
+		//client errors are not errors of ours, but server errors are
+		if rw.status >= 500 {
+			span.End(fmt.Errorf("request failed with status %d", rw.status))
+		} else {
+			span.End(nil)
+		}
+	}
+}
+
+// withVersionHeader wraps a handler to set the Docker-Distribution-Api-Version
+// header. This must be set on all responses, including error responses (esp.
+// 401), since clients use it to detect that they are talking to a Registry v2 API.
+func withVersionHeader(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+		handler(w, r)
+	}
+}
+
+// limitRequestBody wraps a handler that reads the request body, and rejects
+// the request with the given error code when the request body is larger than
+// allowed by the configuration (see keppel.Configuration.MaxRequestBodySizeBytes).
+func (a *API) limitRequestBody(code keppel.RegistryV2ErrorCode, handler http.HandlerFunc) http.HandlerFunc {
+	limit := a.cfg.MaxRequestBodySizeBytes
+	if limit == 0 {
+		return handler
+	}
+	makeError := func() *keppel.RegistryV2Error {
+		return code.With("request body may not be larger than %d bytes", limit).WithStatus(http.StatusRequestEntityTooLarge)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		//if the client announces an oversized body, reject it without reading anything
+		if r.ContentLength > 0 && uint64(r.ContentLength) > limit {
+			makeError().WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+		//otherwise (esp. for chunked transfer encoding) stop reading once the limit is exceeded
+		r.Body = &limitedRequestBody{r.Body, limit, makeError}
+		handler(w, r)
+	}
+}
+
+// limitedRequestBody is an io.ReadCloser that yields an error instead of
+// reading more than the given number of bytes from the wrapped reader.
+type limitedRequestBody struct {
+	io.ReadCloser
+	bytesLeft uint64
+	makeError func() *keppel.RegistryV2Error
+}
+
+// Read implements the io.Reader interface.
+func (b *limitedRequestBody) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if b.bytesLeft == 0 {
+		//check whether the body continues beyond the limit
+		n, err := b.ReadCloser.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, b.makeError()
+		}
+		return 0, err
+	}
+
+	if uint64(len(buf)) > b.bytesLeft {
+		buf = buf[:b.bytesLeft]
+	}
+	n, err := b.ReadCloser.Read(buf)
+	b.bytesLeft -= uint64(n)
+	return n, err
+}
+
+func (a *API) processor(r *http.Request) *processor.Processor {
+	return processor.New(a.cfg, a.db, a.sd, a.icd, a.auditor).OverrideTimeNow(a.timeNow).OverrideGenerateStorageID(a.generateStorageID).WithContext(r.Context())
 }
 
 // This implements the GET /v2/ endpoint.
 func (a *API) handleToplevel(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/v2/")
-	//must be set even for 401 responses!
-	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
 
 	_, rerr := auth.IncomingRequest{
 		HTTPRequest:           r,
@@ -197,15 +294,12 @@ func (info anycastRequestInfo) AsPrometheusLabels() prometheus.Labels {
 // and the account exists elsewhere, the `anycastHandler` is invoked if given
 // instead of giving a 404 response.
 func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strategy repoAccessStrategy, anycastHandler func(http.ResponseWriter, *http.Request, anycastRequestInfo)) (*keppel.Account, *keppel.Repository, *auth.Authorization) {
-	//must be set even for 401 responses!
-	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
-
 	//check that repo name is wellformed
 	scope := auth.Scope{
 		ResourceType: "repository",
 		ResourceName: mux.Vars(r)["repository"],
 	}
-	if !keppel.RepoNameWithLeadingSlashRx.MatchString("/" + scope.ResourceName) {
+	if !keppel.IsRepoName(scope.ResourceName) {
 		keppel.ErrNameInvalid.With("invalid repository name").WriteAsRegistryV2ResponseTo(w, r)
 		return nil, nil, nil
 	}
@@ -230,6 +324,7 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 		rerr.WriteAsRegistryV2ResponseTo(w, r)
 		return nil, nil, nil
 	}
+	recordAccessLogAuthorization(r, nil, nil, authz)
 
 	//we need to know the account to select the registry instance for this request
 	repoScope := scope.ParseRepositoryScope(authz.Audience)
@@ -298,6 +393,7 @@ func (a *API) checkAccountAccess(w http.ResponseWriter, r *http.Request, strateg
 		return nil, nil, nil
 	}
 
+	recordAccessLogAuthorization(r, account, repo, authz)
 	return account, repo, authz
 }
 
@@ -319,14 +415,32 @@ func (a *API) checkRateLimit(w http.ResponseWriter, r *http.Request, account kep
 		return false
 	}
 	if !allowed {
-		retryAfterStr := strconv.FormatUint(uint64(result.RetryAfter/time.Second), 10)
-		respondWithError(w, r, keppel.ErrTooManyRequests.With("").WithHeader("Retry-After", retryAfterStr))
+		respondWithTooManyRequests(w, r, result)
 		return false
 	}
 
+	//anonymous users are additionally limited per IP, to deter abuse of public
+	//pulls (the anycast byte limit is not a request count, so it does not count
+	//as another request here)
+	if authz.UserIdentity.UserType() == keppel.AnonymousUser && action != keppel.AnycastBlobBytePullAction {
+		allowed, result, err := a.rle.RateLimitAllowsAnonymous(account, a.cfg.RequesterIP(r))
+		if respondWithError(w, r, err) {
+			return false
+		}
+		if !allowed {
+			respondWithTooManyRequests(w, r, result)
+			return false
+		}
+	}
+
 	return true
 }
 
+func respondWithTooManyRequests(w http.ResponseWriter, r *http.Request, result *redis_rate.Result) {
+	retryAfterStr := strconv.FormatUint(uint64(result.RetryAfter/time.Second), 10)
+	respondWithError(w, r, keppel.ErrTooManyRequests.With("").WithHeader("Retry-After", retryAfterStr))
+}
+
 // Returns the repository name as it appears in URL paths for this API.
 func getRepoNameForURLPath(repo keppel.Repository, authz *auth.Authorization) string {
 	//on the regular API, the URL path includes the account name
@@ -336,3 +450,20 @@ func getRepoNameForURLPath(repo keppel.Repository, authz *auth.Authorization) st
 	//on domain-remapped APIs, the URL path contains only the bare repository name
 	return repo.Name
 }
+
+// Returns whether the contents served for this request shall be checked
+// against their digest (see keppel.Configuration.VerifyOnReadSampleRate).
+func (a *API) shouldVerifyOnRead() bool {
+	sampleRate := a.cfg.VerifyOnReadSampleRate
+	return sampleRate >= 1 || (sampleRate > 0 && rand.Float64() < sampleRate) //nolint:gosec // no need for crypto/rand here
+}
+
+// Reports that contents read from the DB or from storage do not match their
+// digest. This indicates corruption in the storage, so we cannot do anything
+// about it except for alerting the operator.
+func reportDigestMismatchOnRead(account keppel.Account, repo keppel.Repository, objectType string, expectedDigest, actualDigest digest.Digest) {
+	logg.Error("%s %s in repo %s is corrupted: served contents have digest %s",
+		objectType, expectedDigest, repo.FullName(), actualDigest)
+	labels := prometheus.Labels{"account": account.Name, "type": objectType}
+	api.StorageDigestMismatchCounter.With(labels).Inc()
+}
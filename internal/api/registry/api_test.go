@@ -19,7 +19,12 @@
 package registryv2_test
 
 import (
+	"bytes"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/sapcc/go-bits/assert"
@@ -63,6 +68,40 @@ func TestVersionCheckEndpoint(t *testing.T) {
 	})
 }
 
+func TestInvalidRepoName(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		invalidRepoNames := []string{
+			"test1/Foo",
+			"test1/foo-",
+			"test1/" + strings.Repeat("a", keppel.MaxRepoNameLength),
+		}
+		for _, repoName := range invalidRepoNames {
+			assert.HTTPRequest{
+				Method:       "POST",
+				Path:         "/v2/" + repoName + "/blobs/uploads/",
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusBadRequest,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrNameInvalid),
+			}.Check(t, h)
+		}
+
+		//nested repo names are fine (this only checks that we get past the name
+		//validation; the token is not valid for this repo)
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         "/v2/test1/foo/bar/blobs/uploads/",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDenied),
+		}.Check(t, h)
+	})
+}
+
 func TestKeppelAPIAuth(t *testing.T) {
 	//All the other tests use the conventional auth method using bearer tokens.
 	//This test provides test coverage for authenticating with the same
@@ -158,3 +197,73 @@ func TestKeppelAPIAuth(t *testing.T) {
 		}.Check(t, h)
 	})
 }
+
+// countingReader is an io.Reader that counts how many bytes were read from it.
+type countingReader struct {
+	Reader    io.Reader
+	BytesRead int
+}
+
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	r.BytesRead += n
+	return n, err
+}
+
+func TestRequestBodySizeLimit(t *testing.T) {
+	const limit = 2 << 20 // 2 MiB
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+		test.WithMaxRequestBodySize(limit),
+	)
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+	//images below the limit can be pushed as usual
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+
+	oversizedBlob := test.GenerateExampleLayerSize(2, 3)
+	sendRequest := func(method, path string, withContentLength bool) (*httptest.ResponseRecorder, *countingReader) {
+		t.Helper()
+		body := &countingReader{Reader: bytes.NewReader(oversizedBlob.Contents)}
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if withContentLength {
+			req.ContentLength = int64(len(oversizedBlob.Contents))
+			req.Header.Set("Content-Length", strconv.Itoa(len(oversizedBlob.Contents)))
+		} else {
+			req.ContentLength = -1
+		}
+		rec := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rec, req)
+		return rec, body
+	}
+	expectRejection := func(rec *httptest.ResponseRecorder, code keppel.RegistryV2ErrorCode) {
+		t.Helper()
+		assert.DeepEqual(t, "status code", rec.Code, http.StatusRequestEntityTooLarge)
+		assert.DeepEqual(t, "version header", rec.Header().Get(test.VersionHeaderKey), test.VersionHeaderValue)
+		assert.DeepEqual(t, "response body", strings.Contains(rec.Body.String(), string(code)), true)
+	}
+
+	//when the request announces an oversized body, it is rejected without reading anything
+	rec, body := sendRequest("POST", "/v2/test1/foo/blobs/uploads/?digest="+oversizedBlob.Digest.String(), true)
+	expectRejection(rec, keppel.ErrSizeInvalid)
+	assert.DeepEqual(t, "bytes read from monolithic upload", body.BytesRead, 0)
+
+	rec, body = sendRequest("PUT", "/v2/test1/foo/manifests/oversized", true)
+	expectRejection(rec, keppel.ErrManifestInvalid)
+	assert.DeepEqual(t, "bytes read from manifest upload", body.BytesRead, 0)
+
+	//when the body size is not known in advance, reading stops right after the limit
+	req := httptest.NewRequest("POST", "/v2/test1/foo/blobs/uploads/", http.NoBody)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+	s.Handler.ServeHTTP(rec, req)
+	assert.DeepEqual(t, "status code for starting upload", rec.Code, http.StatusAccepted)
+	rec, body = sendRequest("PATCH", rec.Header().Get("Location"), false)
+	expectRejection(rec, keppel.ErrSizeInvalid)
+	if body.BytesRead > limit+1 {
+		t.Errorf("expected at most %d bytes to be read from chunked upload, but %d bytes were read", limit+1, body.BytesRead)
+	}
+}
@@ -21,9 +21,11 @@ package registryv2
 import (
 	"database/sql"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/opencontainers/go-digest"
@@ -86,7 +88,7 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//...and answer GET requests by replicating the blob contents
-		responseWasWritten, err := a.processor().ReplicateBlob(*blob, *account, *repo, w)
+		responseWasWritten, err := a.processor(r).ReplicateBlob(*blob, *account, *repo, w)
 
 		if err != nil {
 			if responseWasWritten {
@@ -110,13 +112,30 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//if the client only asked for a part of the blob, only that part counts
+	//towards rate limits and pull metrics (this also applies when redirecting
+	//to a storage URL since the client sends the Range header there as well)
+	var (
+		requestedRange *byteRange
+		rangeErr       error
+	)
+	pulledBytes := blob.SizeBytes
+	if r.Method == http.MethodGet && r.Header.Get("Range") != "" {
+		requestedRange, rangeErr = parseRangeHeader(r.Header.Get("Range"), blob.SizeBytes)
+		if rangeErr != nil {
+			pulledBytes = 0
+		} else if requestedRange != nil {
+			pulledBytes = requestedRange.Length
+		}
+	}
+
 	//if a peer reverse-proxied to us to fulfill an anycast request, enforce the anycast rate limits
 	isAnycast := r.Header.Get("X-Keppel-Forwarded-By") != ""
 	if isAnycast {
 		//AnycastBlobBytePullAction is only relevant for GET requests since it
 		//limits the size of the response body (which is empty for HEAD)
 		if r.Method == http.MethodGet {
-			if !a.checkRateLimit(w, r, *account, authz, keppel.AnycastBlobBytePullAction, blob.SizeBytes) {
+			if !a.checkRateLimit(w, r, *account, authz, keppel.AnycastBlobBytePullAction, pulledBytes) {
 				return
 			}
 		}
@@ -131,7 +150,8 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 			l["method"] = "registry-api+anycast"
 		}
 		api.BlobsPulledCounter.With(l).Inc()
-		api.BlobBytesPulledCounter.With(l).Add(float64(blob.SizeBytes))
+		api.BlobBytesPulledCounter.With(l).Add(float64(pulledBytes))
+		api.RepoPullsCounter.With(api.RepoLabels(a.cfg, *repo, "blob")).Inc()
 	}
 
 	//prefer redirecting the client to a storage URL if the storage driver can give us one
@@ -155,21 +175,124 @@ func (a *API) handleGetOrHeadBlob(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//return the blob contents to the client directly (TODO: support range requests)
+	//if the client only asked for a part of the blob, only send that part
+	if rangeErr != nil {
+		keppel.ErrSizeInvalid.With(rangeErr.Error()).
+			WithHeader("Content-Range", fmt.Sprintf("bytes */%d", blob.SizeBytes)).
+			WithStatus(http.StatusRequestedRangeNotSatisfiable).
+			WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+	if requestedRange != nil {
+		a.sendBlobRange(w, r, *account, *blob, *requestedRange)
+		return
+	}
+
+	//return the blob contents to the client directly
 	reader, lengthBytes, err := a.sd.ReadBlob(*account, blob.StorageID)
 	if respondWithError(w, r, err) {
 		return
 	}
 	defer reader.Close()
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", strconv.FormatUint(lengthBytes, 10))
 	w.Header().Set("Content-Type", blob.SafeMediaType())
 	w.Header().Set("Docker-Content-Digest", blob.Digest)
 	w.WriteHeader(http.StatusOK)
 	if r.Method != http.MethodHead {
-		_, err = io.Copy(w, reader)
+		//if requested, verify the blob contents while sending them
+		var (
+			src      io.Reader = reader
+			digester digest.Digester
+		)
+		if a.shouldVerifyOnRead() {
+			digester = blobDigest.Algorithm().Digester()
+			src = io.TeeReader(reader, digester.Hash())
+		}
+
+		_, err = io.Copy(w, src)
 		if err != nil {
 			logg.Error("unexpected error from io.Copy() while sending blob to client: %s", err.Error())
+		} else if digester != nil && digester.Digest() != blobDigest {
+			reportDigestMismatchOnRead(*account, *repo, "blob", blobDigest, digester.Digest())
+		}
+	}
+}
+
+// byteRange is a contiguous range of bytes within a blob, as requested by a
+// Range header.
+type byteRange struct {
+	Offset uint64
+	Length uint64
+}
+
+// parseRangeHeader parses the value of a Range header for a blob with the
+// given size. We only support single ranges. For anything else (e.g. multiple
+// ranges, or units other than bytes), nil is returned to indicate that the
+// whole blob shall be sent, as allowed by RFC 9110, section 14.2. An error is
+// returned if the requested range cannot be satisfied.
+func parseRangeHeader(header string, sizeBytes uint64) (*byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	firstStr, lastStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	//suffix range (e.g. "bytes=-500" means "the last 500 bytes")
+	if firstStr == "" {
+		suffixLength, err := strconv.ParseUint(lastStr, 10, 64)
+		if err != nil {
+			return nil, nil
+		}
+		if suffixLength == 0 || sizeBytes == 0 {
+			return nil, fmt.Errorf("range %q is not satisfiable for a blob of %d bytes", header, sizeBytes)
+		}
+		if suffixLength > sizeBytes {
+			suffixLength = sizeBytes
+		}
+		return &byteRange{Offset: sizeBytes - suffixLength, Length: suffixLength}, nil
+	}
+
+	first, err := strconv.ParseUint(firstStr, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	last := sizeBytes - 1
+	if lastStr != "" {
+		last, err = strconv.ParseUint(lastStr, 10, 64)
+		if err != nil || last < first {
+			return nil, nil
 		}
+		if last >= sizeBytes {
+			last = sizeBytes - 1
+		}
+	}
+	if first >= sizeBytes {
+		return nil, fmt.Errorf("range %q is not satisfiable for a blob of %d bytes", header, sizeBytes)
+	}
+	return &byteRange{Offset: first, Length: last - first + 1}, nil
+}
+
+// sendBlobRange answers a GET request for a part of a blob with 206 Partial Content.
+// Since only a part of the blob is read, the blob contents cannot be verified here.
+func (a *API) sendBlobRange(w http.ResponseWriter, r *http.Request, account keppel.Account, blob keppel.Blob, br byteRange) {
+	reader, err := keppel.ReadBlobRange(a.sd, account, blob.StorageID, br.Offset, br.Length)
+	if respondWithError(w, r, err) {
+		return
+	}
+	defer reader.Close()
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatUint(br.Length, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", br.Offset, br.Offset+br.Length-1, blob.SizeBytes))
+	w.Header().Set("Content-Type", blob.SafeMediaType())
+	w.Header().Set("Docker-Content-Digest", blob.Digest)
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		logg.Error("unexpected error from io.Copy() while sending blob range to client: %s", err.Error())
 	}
 }
 
@@ -491,6 +491,141 @@ func TestBlobStreamedAndChunkedUpload(t *testing.T) {
 	}
 }
 
+func TestBlobUploadMismatchIsDiscarded(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+		blob := test.NewBytes([]byte("just some random data"))
+
+		expectNothingCommitted := func() {
+			t.Helper()
+			assert.DeepEqual(t, "blob count in storage", s.SD.BlobCount(), 0)
+			for _, table := range []string{"blobs", "uploads"} {
+				count, err := s.DB.SelectInt("SELECT COUNT(*) FROM " + table)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				assert.DeepEqual(t, "row count in "+table, count, int64(0))
+			}
+		}
+
+		//monolithic upload: size mismatch
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents) + 10),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrSizeInvalid),
+		}.Check(t, h)
+		expectNothingCommitted()
+
+		//monolithic upload: digest mismatch
+		assert.HTTPRequest{
+			Method: "POST",
+			Path:   "/v2/test1/foo/blobs/uploads/?digest=sha256:" + sha256Of([]byte("something else")),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, h)
+		expectNothingCommitted()
+
+		//chunked upload: digest mismatch on PUT
+		resp, _ := assert.HTTPRequest{
+			Method: "PATCH",
+			Path:   getBlobUploadURL(t, h, token, "test1/foo"),
+			Header: map[string]string{
+				"Authorization":  "Bearer " + token,
+				"Content-Length": strconv.Itoa(len(blob.Contents)),
+				"Content-Range":  fmt.Sprintf("0-%d", len(blob.Contents)-1),
+				"Content-Type":   "application/octet-stream",
+			},
+			Body:         assert.ByteData(blob.Contents),
+			ExpectStatus: http.StatusAccepted,
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method:       "PUT",
+			Path:         keppel.AppendQuery(resp.Header.Get("Location"), url.Values{"digest": {"sha256:" + sha256Of([]byte("something else"))}}),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, h)
+		expectNothingCommitted()
+	})
+}
+
+func TestBlobUploadWithVerifyOnWrite(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+		test.WithVerifyOnWrite,
+	)
+	h := s.Handler
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+	blob := test.NewBytes([]byte("just some random data"))
+
+	//simulate corruption on the way into the storage: the digest is correct
+	//while the upload is streamed through Keppel, but the blob contents that
+	//end up in the storage differ
+	s.SD.CorruptFinalizedBlobs = true
+
+	//monolithic upload
+	assert.HTTPRequest{
+		Method: "POST",
+		Path:   "/v2/test1/foo/blobs/uploads/?digest=" + blob.Digest.String(),
+		Header: map[string]string{
+			"Authorization":  "Bearer " + token,
+			"Content-Length": strconv.Itoa(len(blob.Contents)),
+			"Content-Type":   "application/octet-stream",
+		},
+		Body:         assert.ByteData(blob.Contents),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+	}.Check(t, h)
+	expectStorageEmpty(t, s.SD, s.DB)
+
+	//chunked upload
+	resp, _ := assert.HTTPRequest{
+		Method: "PATCH",
+		Path:   getBlobUploadURL(t, h, token, "test1/foo"),
+		Header: map[string]string{
+			"Authorization":  "Bearer " + token,
+			"Content-Length": strconv.Itoa(len(blob.Contents)),
+			"Content-Range":  fmt.Sprintf("0-%d", len(blob.Contents)-1),
+			"Content-Type":   "application/octet-stream",
+		},
+		Body:         assert.ByteData(blob.Contents),
+		ExpectStatus: http.StatusAccepted,
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "PUT",
+		Path:         keppel.AppendQuery(resp.Header.Get("Location"), url.Values{"digest": {blob.Digest.String()}}),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+	}.Check(t, h)
+	expectStorageEmpty(t, s.SD, s.DB)
+
+	//when the blob arrives in the storage intact, the upload succeeds as usual
+	s.SD.CorruptFinalizedBlobs = false
+	blob.MustUpload(t, s, fooRepoRef)
+	expectBlobExists(t, h, token, "test1/foo", blob, nil)
+}
+
 func TestGetBlobUpload(t *testing.T) {
 	testWithPrimary(t, nil, func(s test.Setup) {
 		h := s.Handler
@@ -688,6 +823,71 @@ func TestDeleteBlobUpload(t *testing.T) {
 	})
 }
 
+func TestGetBlobRange(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		blob := test.NewBytes([]byte("just some random data"))
+		blob.MustUpload(t, s, fooRepoRef)
+
+		testCases := []struct {
+			Range         string
+			ExpectedRange string
+			ExpectedBody  string
+		}{
+			{"bytes=5-8", "bytes 5-8/21", "some"},
+			{"bytes=17-", "bytes 17-20/21", "data"},
+			{"bytes=17-100", "bytes 17-20/21", "data"},
+			{"bytes=-11", "bytes 10-20/21", "random data"},
+			{"bytes=-100", "bytes 0-20/21", "just some random data"},
+		}
+		for _, tc := range testCases {
+			//only the requested range counts as pulled
+			pulledBytesBefore := getPulledBlobBytesCounterValue(t, "test1")
+			assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/blobs/" + blob.Digest.String(),
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Range":         tc.Range,
+				},
+				ExpectStatus: http.StatusPartialContent,
+				ExpectHeader: map[string]string{
+					test.VersionHeaderKey:   test.VersionHeaderValue,
+					"Content-Length":        strconv.Itoa(len(tc.ExpectedBody)),
+					"Content-Range":         tc.ExpectedRange,
+					"Docker-Content-Digest": blob.Digest.String(),
+				},
+				ExpectBody: assert.StringData(tc.ExpectedBody),
+			}.Check(t, h)
+			pulledBytes := getPulledBlobBytesCounterValue(t, "test1") - pulledBytesBefore
+			assert.DeepEqual(t, "pulled bytes for "+tc.Range, pulledBytes, float64(len(tc.ExpectedBody)))
+		}
+
+		//unsupported or malformed ranges are ignored and the whole blob is sent
+		for _, rangeStr := range []string{"bytes=0-3,5-8", "bytes=8-5", "items=0-3", "bytes=foo"} {
+			expectBlobExists(t, h, token, "test1/foo", blob, map[string]string{"Range": rangeStr})
+		}
+
+		//test failure case: range beyond the end of the blob
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/blobs/" + blob.Digest.String(),
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Range":         "bytes=21-",
+			},
+			ExpectStatus: http.StatusRequestedRangeNotSatisfiable,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"Content-Range":       "bytes */21",
+			},
+			ExpectBody: test.ErrorCode(keppel.ErrSizeInvalid),
+		}.Check(t, h)
+	})
+}
+
 func TestDeleteBlob(t *testing.T) {
 	testWithPrimary(t, nil, func(s test.Setup) {
 		h := s.Handler
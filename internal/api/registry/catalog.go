@@ -27,20 +27,51 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/gorilla/mux"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/respondwith"
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
 )
 
 const maxLimit = 100
 
+// parseLimit parses the "n" query parameter that is used for pagination by
+// the catalog and tag listing endpoints. If the value is invalid, an error
+// response is written and false is returned.
+func parseLimit(w http.ResponseWriter, query url.Values) (uint64, bool) {
+	limitStr := query.Get("n")
+	if limitStr == "" {
+		return maxLimit, true
+	}
+	limit, err := strconv.ParseUint(limitStr, 10, 64)
+	if err != nil {
+		http.Error(w, `invalid value for "n": `+err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	if limit == 0 {
+		http.Error(w, `invalid value for "n": must not be 0`, http.StatusBadRequest)
+		return 0, false
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return limit, true
+}
+
 // This implements the GET /v2/_catalog endpoint.
 func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/v2/_catalog")
-	//must be set even for 401 responses!
-	w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
+
+	//some operators consider the global catalog an information leak, so it can
+	//be turned off (we report 404 for this since that's what clients expect
+	//from registries that do not implement this endpoint at all)
+	if a.cfg.DisableCatalog {
+		keppel.ErrUnsupported.With("catalog endpoint is disabled on this registry").WithStatus(http.StatusNotFound).WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
 
 	authz, rerr := auth.IncomingRequest{
 		HTTPRequest:           r,
@@ -55,25 +86,9 @@ func (a *API) handleGetCatalog(w http.ResponseWriter, r *http.Request) {
 
 	//parse query: limit (parameter "n")
 	query := r.URL.Query()
-	var (
-		limit uint64
-		err   error
-	)
-	if limitStr := query.Get("n"); limitStr != "" {
-		limit, err = strconv.ParseUint(limitStr, 10, 64)
-		if err != nil {
-			http.Error(w, `invalid value for "n": `+err.Error(), http.StatusBadRequest)
-			return
-		}
-		if limit == 0 {
-			http.Error(w, `invalid value for "n": must not be 0`, http.StatusBadRequest)
-			return
-		}
-	} else {
-		limit = maxLimit
-	}
-	if limit > maxLimit {
-		limit = maxLimit
+	limit, ok := parseLimit(w, query)
+	if !ok {
+		return
 	}
 
 	//on domain-remapped APIs, do not include the account name in the repository
@@ -165,3 +180,90 @@ func (a *API) getCatalogForAccount(accountName string, includeAccountName bool)
 	)
 	return result, err
 }
+
+var accountCatalogQuery = sqlext.SimplifyWhitespace(`
+	SELECT name FROM repos
+	 WHERE account_name = $1 AND (name > $2 OR $2 = '')
+	 ORDER BY name ASC LIMIT $3
+`)
+
+// This implements the GET /v2/:account/_catalog endpoint.
+func (a *API) handleGetAccountCatalog(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/v2/:account/_catalog")
+
+	authz, rerr := auth.IncomingRequest{
+		HTTPRequest:           r,
+		Scopes:                auth.NewScopeSet(auth.CatalogEndpointScope),
+		AllowsAnycast:         false,
+		AllowsDomainRemapping: false,
+	}.Authorize(a.cfg, a.ad, a.db)
+	if rerr != nil {
+		rerr.WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+
+	//the account must be visible to the user (we do not distinguish between
+	//"does not exist" and "not visible" to avoid leaking account names)
+	accountName := mux.Vars(r)["account"]
+	isVisible := false
+	for _, name := range authz.ScopeSet.AccountsWithCatalogAccess("") {
+		if name == accountName {
+			isVisible = true
+			break
+		}
+	}
+	if !isVisible {
+		keppel.ErrNameUnknown.With("account not found").WriteAsRegistryV2ResponseTo(w, r)
+		return
+	}
+
+	//parse query: limit (parameter "n")
+	query := r.URL.Query()
+	limit, ok := parseLimit(w, query)
+	if !ok {
+		return
+	}
+
+	//parse query: marker (parameter "last"); like in the result list, this is
+	//a full repository name including the account name
+	marker := query.Get("last")
+	if marker != "" {
+		var found bool
+		marker, found = strings.CutPrefix(marker, accountName+"/")
+		if !found {
+			http.Error(w, fmt.Sprintf(`invalid value for "last": must start with "%s/"`, accountName), http.StatusBadRequest)
+			return
+		}
+	}
+
+	//list repos (we request one more than `limit` to see if we need to paginate)
+	repoNames := []string{}
+	err := sqlext.ForeachRow(a.db, accountCatalogQuery, []interface{}{accountName, marker, limit + 1}, func(rows *sql.Rows) error {
+		var name string
+		err := rows.Scan(&name)
+		if err == nil {
+			repoNames = append(repoNames, fmt.Sprintf("%s/%s", accountName, name))
+		}
+		return err
+	})
+	if respondWithError(w, r, err) {
+		return
+	}
+
+	//do we need to paginate?
+	if uint64(len(repoNames)) > limit {
+		repoNames = repoNames[0:limit]
+		linkQuery := url.Values{}
+		linkQuery.Set("n", strconv.FormatUint(limit, 10))
+		linkQuery.Set("last", repoNames[len(repoNames)-1])
+		linkURL := url.URL{
+			Path:     fmt.Sprintf("/v2/%s/_catalog", accountName),
+			RawQuery: linkQuery.Encode(),
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, linkURL.String()))
+	}
+
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{
+		"repositories": repoNames,
+	})
+}
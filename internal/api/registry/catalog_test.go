@@ -19,6 +19,7 @@
 package registryv2_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -59,10 +60,157 @@ func TestCatalogEndpoint(t *testing.T) {
 	testEmptyCatalog(t, s)
 	testNonEmptyCatalog(t, s)
 	testDomainRemappedCatalog(t, s)
+	testAccountCatalog(t, s)
 	testAuthErrorsForCatalog(t, s)
 	testNoCatalogOnAnycast(t, s)
 }
 
+func TestCatalogEndpointDisabled(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithoutCatalog,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithRepo(keppel.Repository{Name: "foo", AccountName: "test1"}),
+	)
+	h := s.Handler
+	token := s.GetToken(t, "registry:catalog:*", "keppel_account:test1:view")
+
+	//the global catalog is not available...
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusNotFound,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrUnsupported),
+	}.Check(t, h)
+
+	//...but listing repos in a single account still works
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/_catalog",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.JSONObject{"repositories": []string{"test1/foo"}},
+	}.Check(t, h)
+}
+
+func TestCatalogEndpointScoping(t *testing.T) {
+	s := test.NewSetup(t, test.WithKeppelAPI)
+	h := s.Handler
+
+	//set up four accounts in two different auth tenants, each with two repos
+	for idx := 1; idx <= 4; idx++ {
+		accountName := fmt.Sprintf("test%d", idx)
+		err := s.DB.Insert(&keppel.Account{
+			Name:           accountName,
+			AuthTenantID:   fmt.Sprintf("tenant%d", idx%2),
+			GCPoliciesJSON: "[]",
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, repoName := range []string{"foo", "bar"} {
+			err := s.DB.Insert(&keppel.Repository{Name: repoName, AccountName: accountName})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+
+	//test4 is entirely public; test3 only has a single public repo, so it does
+	//not count as public for the purposes of the catalog
+	for _, policy := range []keppel.RBACPolicy{
+		{AccountName: "test3", RepositoryPattern: "foo", CanPullAnonymously: true},
+		{AccountName: "test4", CanPullAnonymously: true},
+	} {
+		err := s.DB.Insert(&policy)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//helper function for obtaining a token through the regular auth workflow
+	//(test.Setup.GetToken() bypasses the scope filtering that we want to test)
+	getToken := func(hdr map[string]string) string {
+		_, tokenBodyBytes := assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/keppel/v1/auth?service=registry.example.org&scope=registry:catalog:*",
+			Header:       test.AddHeadersForCorrectAuthChallenge(hdr),
+			ExpectStatus: http.StatusOK,
+		}.Check(t, h)
+		var tokenBodyData struct {
+			Token string `json:"token"`
+		}
+		err := json.Unmarshal(tokenBodyBytes, &tokenBodyData)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return tokenBodyData.Token
+	}
+
+	//a user who can view the accounts in "tenant1" sees the repos of test1 and
+	//test3, plus those of the public account test4
+	token := getToken(map[string]string{"X-Test-Perms": "view:tenant1"})
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody: assert.JSONObject{"repositories": []string{
+			"test1/bar", "test1/foo",
+			"test3/bar", "test3/foo",
+			"test4/bar", "test4/foo",
+		}},
+	}.Check(t, h)
+
+	//pagination skips over accounts that are not visible
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog?n=2&last=test1/foo",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: map[string]string{
+			test.VersionHeaderKey: test.VersionHeaderValue,
+			"Link":                `</v2/_catalog?last=test3%2Ffoo&n=2>; rel="next"`,
+		},
+		ExpectBody: assert.JSONObject{"repositories": []string{"test3/bar", "test3/foo"}},
+	}.Check(t, h)
+
+	//an anonymous user only sees the public account
+	anonToken := getToken(nil)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog",
+		Header:       map[string]string{"Authorization": "Bearer " + anonToken},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.JSONObject{"repositories": []string{"test4/bar", "test4/foo"}},
+	}.Check(t, h)
+
+	//...but that token does not grant any access to the public account beyond
+	//listing its repos (in particular, it cannot be used to read the account
+	//configuration on the Keppel API)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/keppel/v1/accounts/test4",
+		Header:       map[string]string{"Authorization": "Bearer " + anonToken},
+		ExpectStatus: http.StatusForbidden,
+	}.Check(t, h)
+
+	//anonymous users without a token still get the auth challenge, otherwise
+	//clients would never know to ask for credentials
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/_catalog",
+		Header:       test.AddHeadersForCorrectAuthChallenge(nil),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrUnauthorized),
+	}.Check(t, h)
+}
+
 func testEmptyCatalog(t *testing.T, s test.Setup) {
 	//token without any account-level permissions is able to call the endpoint,
 	//but cannot list repos in any account, so the list is empty
@@ -217,6 +365,104 @@ func testDomainRemappedCatalog(t *testing.T, s test.Setup) {
 	}.Check(t, h)
 }
 
+func testAccountCatalog(t *testing.T, s test.Setup) {
+	h := s.Handler
+	token := s.GetToken(t,
+		"registry:catalog:*",
+		"keppel_account:test1:view",
+		"keppel_account:test2:view",
+	)
+
+	//add some more repos to test2 to get a more interesting pagination behavior
+	for _, repoName := range []string{"alpha", "zeta", "foo/nested"} {
+		err := s.DB.Insert(&keppel.Repository{Name: repoName, AccountName: "test2"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	allRepos := []string{
+		"test2/alpha",
+		"test2/bar",
+		"test2/foo",
+		"test2/foo/nested",
+		"test2/qux",
+		"test2/zeta",
+	}
+
+	//test unpaginated: only repos from the requested account are shown, in sorted order
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test2/_catalog",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.JSONObject{"repositories": allRepos},
+	}.Check(t, h)
+
+	//test paginated: follow the cursor through the entire list
+	for length := 1; length <= len(allRepos)+1; length++ {
+		for offset := 0; offset < len(allRepos); offset += length {
+			expectedPage := allRepos[offset:]
+			expectedHeaders := map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"Content-Type":        "application/json",
+			}
+
+			if len(expectedPage) > length {
+				expectedPage = expectedPage[:length]
+				lastRepoName := expectedPage[len(expectedPage)-1]
+				expectedHeaders["Link"] = fmt.Sprintf(`</v2/test2/_catalog?last=%s&n=%d>; rel="next"`,
+					strings.Replace(lastRepoName, "/", "%2F", -1), length,
+				)
+			}
+
+			path := fmt.Sprintf(`/v2/test2/_catalog?n=%d`, length)
+			if offset > 0 {
+				path += `&last=` + allRepos[offset-1]
+			}
+
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         path,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: expectedHeaders,
+				ExpectBody:   assert.JSONObject{"repositories": expectedPage},
+			}.Check(t, h)
+		}
+	}
+
+	//test error cases for pagination query params
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test2/_catalog?n=0",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.StringData("invalid value for \"n\": must not be 0\n"),
+	}.Check(t, h)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test2/_catalog?last=test1/foo",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   assert.StringData("invalid value for \"last\": must start with \"test2/\"\n"),
+	}.Check(t, h)
+
+	//accounts that are not visible to the user look the same as accounts that do not exist
+	for _, accountName := range []string{"test3", "test4"} {
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/" + accountName + "/_catalog",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusNotFound,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrNameUnknown),
+		}.Check(t, h)
+	}
+}
+
 func testAuthErrorsForCatalog(t *testing.T, s test.Setup) {
 	//without token, expect auth challenge
 	h := s.Handler
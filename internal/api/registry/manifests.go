@@ -33,6 +33,7 @@ import (
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/logg"
 	accept "github.com/timewasted/go-accept-headers"
+	"golang.org/x/exp/slices"
 
 	"github.com/sapcc/keppel/internal/api"
 	"github.com/sapcc/keppel/internal/auth"
@@ -51,8 +52,11 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reference := keppel.ParseManifestReference(mux.Vars(r)["reference"])
-	dbManifest, err := a.findManifestInDB(*repo, reference)
+	reference, err := keppel.ParseManifestReference(mux.Vars(r)["reference"])
+	if respondWithError(w, r, err) {
+		return
+	}
+	dbManifest, err := a.processor(r).FindManifest(*repo, reference)
 	var manifestBytes []byte
 
 	if err != sql.ErrNoRows {
@@ -63,10 +67,28 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 
 	if err == sql.ErrNoRows {
 		//if the manifest does not exist there, we may have the option of replicating
-		//from upstream (as an exception, other Keppels replicating from us always
-		//see the true 404 to properly replicate the non-existence of the manifest
-		//from this account into the replica account)
-		if (account.UpstreamPeerHostName != "" || account.ExternalPeerURL != "") && !account.InMaintenance && authz.UserIdentity.UserType() != keppel.PeerUser {
+		//from upstream (as an exception, other Keppels replicating from us see the
+		//true 404 to properly replicate the non-existence of the manifest from this
+		//account into the replica account, unless they are replicating on behalf of
+		//a client and this account is itself a replica of another peer)
+		canReplicate := account.UpstreamPeerHostName != "" || account.ExternalPeerURL != ""
+		if authz.UserIdentity.UserType() == keppel.PeerUser {
+			chain := processor.ParseReplicationChain(r.Header)
+			canReplicate = account.UpstreamPeerHostName != "" && len(chain) > 0
+			if canReplicate && slices.Contains(chain, a.cfg.APIPublicHostname) {
+				msg := fmt.Sprintf("replication cycle detected: %s -> %s", strings.Join(chain, " -> "), a.cfg.APIPublicHostname)
+				keppel.ErrDenied.With(msg).WithStatus(http.StatusConflict).WriteAsRegistryV2ResponseTo(w, r)
+				return
+			}
+		}
+		if canReplicate && !account.InMaintenance {
+			//the account may be configured to only replicate some of its repos
+			if !account.ReplicatesRepository(repo.Name) {
+				msg := fmt.Sprintf("image does not exist here, and repository %s is excluded from replication", repo.FullName())
+				keppel.ErrDenied.With(msg).WithStatus(http.StatusForbidden).WriteAsRegistryV2ResponseTo(w, r)
+				return
+			}
+
 			//when replicating from external, only authenticated users can trigger the replication
 			if account.ExternalPeerURL != "" && authz.UserIdentity.UserType() != keppel.RegularUser {
 				if !authz.ScopeSet.Contains(auth.Scope{
@@ -79,7 +101,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 
-			dbManifest, manifestBytes, err = a.processor().ReplicateManifest(*account, *repo, reference, keppel.AuditContext{
+			dbManifest, manifestBytes, err = a.processor(r).ReplicateManifest(*account, *repo, reference, keppel.AuditContext{
 				UserIdentity: authz.UserIdentity,
 				Request:      r,
 			})
@@ -93,19 +115,30 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 	} else {
 		//if manifest was found in our DB, fetch the contents from the DB (or fall
 		//back to the storage if the DB entry is not there for some reason)
-		manifestBytes, err = a.getManifestContentFromDB(repo.ID, dbManifest.Digest)
-		if err != nil {
-			if err != sql.ErrNoRows {
-				logg.Info("could not read manifest %s@%s from DB (falling back to read from storage): %s",
-					repo.FullName(), dbManifest.Digest, err.Error())
-			}
-			manifestBytes, err = a.sd.ReadManifest(*account, repo.Name, dbManifest.Digest)
-			if respondWithError(w, r, err) {
-				return
+		manifestBytes, err = a.processor(r).ReadManifestContents(*account, *repo, dbManifest.Digest)
+		if respondWithError(w, r, err) {
+			return
+		}
+		if a.shouldVerifyOnRead() {
+			expectedDigest := digest.Digest(dbManifest.Digest)
+			actualDigest := expectedDigest.Algorithm().FromBytes(manifestBytes)
+			if actualDigest != expectedDigest {
+				reportDigestMismatchOnRead(*account, *repo, "manifest", expectedDigest, actualDigest)
 			}
 		}
 	}
 
+	//if the client pulls a list manifest by tag without declaring what it can
+	//accept, the account may be configured to serve the submanifest for a
+	//default platform instead (for clients that cannot handle list manifests)
+	taggedDigest := dbManifest.Digest
+	if reference.IsTag() && r.Header.Get("Accept") == "" {
+		dbManifest, manifestBytes, err = a.resolveDefaultPlatform(r, *account, *repo, dbManifest, manifestBytes)
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
+
 	//verify Accept header, if any
 	if r.Header.Get("Accept") != "" {
 		//Most user agents provide a single Accept header with comma-separated
@@ -115,7 +148,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		//
 		//See also: <https://github.com/moby/moby/blob/5e9ecffb4fe966c19b606dc7ccee921de2e8ba31/plugin/fetch_linux.go#L82-L92>
 		acceptHeader := strings.Join(r.Header["Accept"], ", ")
-		acceptRules := accept.Parse(acceptHeader)
+		acceptRules := parseAcceptHeader(acceptHeader)
 
 		//does the Accept header cover the manifest itself?
 		negotiatedMediaType, err := acceptRules.Negotiate(
@@ -145,6 +178,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 					url := fmt.Sprintf("/v2/%s/manifests/%s", getRepoNameForURLPath(*repo, authz), subManifestDesc.Digest.String())
 					w.Header().Set("Docker-Content-Digest", subManifestDesc.Digest.String())
 					w.Header().Set("Location", url)
+					w.Header().Set("Vary", "Accept")
 					w.WriteHeader(http.StatusTemporaryRedirect)
 					return
 				}
@@ -169,10 +203,42 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	//write response
-	w.Header().Set("Content-Length", strconv.FormatUint(uint64(len(manifestBytes)), 10))
+	//the account may block pulls of images with severe vulnerabilities (peers
+	//are exempt since replication must not be impeded by this, and account
+	//admins can explicitly request the "override_pull_block" scope for
+	//break-glass access)
+	if vulnerability != nil && !account.CanPullManifestWithStatus(vulnerability.Status) && authz.UserIdentity.UserType() != keppel.PeerUser {
+		if !authz.ScopeSet.Contains(auth.Scope{
+			ResourceType: "repository",
+			ResourceName: repo.FullName(),
+			Actions:      []string{"override_pull_block"},
+		}) {
+			msg := fmt.Sprintf("manifest %s has vulnerability status %s, but this account blocks pulls of manifests with vulnerability status above %s",
+				dbManifest.Digest, vulnerability.Status, account.BlockPullAboveSeverity)
+			keppel.ErrDenied.With(msg).WithStatus(http.StatusForbidden).WriteAsRegistryV2ResponseTo(w, r)
+			return
+		}
+	}
+
+	//the admission policy may also restrict pulls (peers are exempt for the
+	//same reason as above)
+	if authz.UserIdentity.UserType() != keppel.PeerUser {
+		err := a.processor(r).AdmitManifestPull(*account, *repo, *dbManifest, manifestBytes)
+		if respondWithError(w, r, err) {
+			return
+		}
+	}
+
+	//write response (if the client already has this exact manifest, it only
+	//gets a 304 without body)
+	notModified := ifNoneMatchCoversDigest(r.Header.Values("If-None-Match"), dbManifest.Digest)
+	if !notModified {
+		w.Header().Set("Content-Length", strconv.FormatUint(uint64(len(manifestBytes)), 10))
+	}
+	w.Header().Set("Vary", "Accept")
 	w.Header().Set("Content-Type", dbManifest.MediaType)
 	w.Header().Set("Docker-Content-Digest", dbManifest.Digest)
+	w.Header().Set("ETag", `"`+dbManifest.Digest+`"`)
 	if vulnerability != nil {
 		w.Header().Set("X-Keppel-Vulnerability-Status", string(vulnerability.Status))
 	}
@@ -182,15 +248,20 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 	if dbManifest.MaxLayerCreatedAt != nil {
 		w.Header().Set("X-Keppel-Max-Layer-Created-At", timeToString(*dbManifest.MaxLayerCreatedAt))
 	}
-	w.WriteHeader(http.StatusOK)
-	if r.Method != http.MethodHead {
-		w.Write(manifestBytes)
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	} else {
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(manifestBytes)
+		}
 	}
 
-	//count the pull
+	//count the pull (this includes 304 responses: the client is still using the manifest)
 	if r.Method == http.MethodGet && r.Header.Get("X-Keppel-No-Count-Towards-Last-Pulled") != "1" {
 		l := prometheus.Labels{"account": account.Name, "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 		api.ManifestsPulledCounter.With(l).Inc()
+		api.RepoPullsCounter.With(api.RepoLabels(a.cfg, *repo, "manifest")).Inc()
 
 		//update manifests.last_pulled_at
 		_, err := a.db.Exec(
@@ -208,7 +279,7 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 		if reference.IsTag() {
 			_, err := a.db.Exec(
 				`UPDATE tags SET last_pulled_at = $1 WHERE repo_id = $2 AND digest = $3 AND name = $4`,
-				a.timeNow(), dbManifest.RepositoryID, dbManifest.Digest, reference.Tag,
+				a.timeNow(), dbManifest.RepositoryID, taggedDigest, reference.Tag,
 			)
 			if err != nil {
 				logg.Error(
@@ -220,41 +291,66 @@ func (a *API) handleGetOrHeadManifest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (a *API) findManifestInDB(repo keppel.Repository, reference keppel.ManifestReference) (*keppel.Manifest, error) {
-	//resolve tag into digest if necessary
-	refDigest := reference.Digest
-	if reference.IsTag() {
-		digestStr, err := a.db.SelectStr(
-			`SELECT digest FROM tags WHERE repo_id = $1 AND name = $2`,
-			repo.ID, reference.Tag,
-		)
-		if err != nil {
-			return nil, err
-		}
-		if digestStr == "" {
-			return nil, sql.ErrNoRows
-		}
-		refDigest, err = digest.Parse(digestStr)
-		if err != nil {
-			return nil, err
+// Checks whether the given If-None-Match headers contain an entity tag that
+// matches the given manifest digest. Weak and strong entity tags are treated
+// alike, since a manifest's digest identifies its exact contents either way.
+func ifNoneMatchCoversDigest(headers []string, manifestDigest string) bool {
+	for _, header := range headers {
+		for _, etag := range strings.Split(header, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == "*" {
+				return true
+			}
+			etag = strings.TrimPrefix(etag, "W/")
+			if strings.Trim(etag, `"`) == manifestDigest {
+				return true
+			}
 		}
 	}
+	return false
+}
 
-	var dbManifest keppel.Manifest
-	err := a.db.SelectOne(&dbManifest,
-		`SELECT * FROM manifests WHERE repo_id = $1 AND digest = $2`,
-		repo.ID, refDigest.String(),
-	)
-	return &dbManifest, err
+// Parses an Accept header. In contrast to accept.Parse(), media ranges with
+// "q=0" are discarded since RFC 9110 defines them as "not acceptable".
+func parseAcceptHeader(header string) accept.AcceptSlice {
+	var result accept.AcceptSlice
+	for _, rule := range accept.Parse(header) {
+		if rule.Q > 0 {
+			result = append(result, rule)
+		}
+	}
+	return result
 }
 
-func (a *API) getManifestContentFromDB(repoID int64, digestStr string) ([]byte, error) {
-	var result []byte
-	err := a.db.SelectOne(&result,
-		`SELECT content FROM manifest_contents WHERE repo_id = $1 AND digest = $2`,
-		repoID, digestStr,
-	)
-	return result, err
+// If the account has a default platform configured and the given manifest is
+// a list manifest, returns the submanifest for that platform. Otherwise, the
+// given manifest is returned unchanged.
+func (a *API) resolveDefaultPlatform(r *http.Request, account keppel.Account, repo keppel.Repository, dbManifest *keppel.Manifest, manifestBytes []byte) (*keppel.Manifest, []byte, error) {
+	defaultPlatform, err := account.ParseDefaultPlatform()
+	if err != nil || defaultPlatform == nil {
+		return dbManifest, manifestBytes, err
+	}
+
+	manifestParsed, _, err := keppel.ParseManifest(dbManifest.MediaType, manifestBytes)
+	if err != nil {
+		return nil, nil, keppel.ErrManifestInvalid.With(err.Error())
+	}
+	subManifestDescs := manifestParsed.ManifestReferences(keppel.PlatformFilter{*defaultPlatform})
+	if len(subManifestDescs) == 0 {
+		//not a list manifest, or no submanifest for the default platform -> serve the manifest itself
+		return dbManifest, manifestBytes, nil
+	}
+
+	subManifest, err := a.processor(r).GetManifest(account, repo, keppel.ManifestReference{Digest: subManifestDescs[0].Digest})
+	if err == sql.ErrNoRows {
+		//the submanifest is not stored locally (e.g. because a replica's
+		//platform_filter excluded it) -> serve the manifest itself
+		return dbManifest, manifestBytes, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &subManifest.Manifest, subManifest.Contents, nil
 }
 
 func (a *API) handleGetOrHeadManifestAnycast(w http.ResponseWriter, r *http.Request, info anycastRequestInfo) {
@@ -274,16 +370,18 @@ func (a *API) handleDeleteManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//delete tag or manifest from the database
-	ref := keppel.ParseManifestReference(mux.Vars(r)["reference"])
+	ref, err := keppel.ParseManifestReference(mux.Vars(r)["reference"])
+	if respondWithError(w, r, err) {
+		return
+	}
 	actx := keppel.AuditContext{
 		UserIdentity: authz.UserIdentity,
 		Request:      r,
 	}
-	var err error
 	if ref.IsTag() {
-		err = a.processor().DeleteTag(*account, *repo, ref.Tag, actx)
+		err = a.processor(r).DeleteTag(*account, *repo, ref.Tag, actx)
 	} else {
-		err = a.processor().DeleteManifest(*account, *repo, ref.Digest.String(), actx)
+		err = a.processor(r).DeleteManifest(*account, *repo, ref.Digest.String(), actx)
 	}
 	if err == sql.ErrNoRows {
 		keppel.ErrManifestUnknown.With("no such manifest").WriteAsRegistryV2ResponseTo(w, r)
@@ -336,12 +434,19 @@ func (a *API) handlePutManifest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//validate and store manifest
-	ref := keppel.ParseManifestReference(mux.Vars(r)["reference"])
-	manifest, err := a.processor().ValidateAndStoreManifest(*account, *repo, processor.IncomingManifest{
+	ref, err := keppel.ParseManifestReference(mux.Vars(r)["reference"])
+	if respondWithError(w, r, err) {
+		return
+	}
+	manifest, err := a.processor(r).ValidateAndStoreManifest(*account, *repo, processor.IncomingManifest{
 		Reference: ref,
 		MediaType: r.Header.Get("Content-Type"),
 		Contents:  manifestBytes,
 		PushedAt:  a.timeNow(),
+		//as per OCI Distribution Spec v1.1, further tags can be given as `?tag=...`
+		//(even when pushing by digest, in which case the push is validated like
+		//a push by tag, e.g. with regards to RequiredLabels and admission policies)
+		AdditionalTags: r.URL.Query()["tag"],
 	}, keppel.AuditContext{
 		UserIdentity: authz.UserIdentity,
 		Request:      r,
@@ -353,6 +458,7 @@ func (a *API) handlePutManifest(w http.ResponseWriter, r *http.Request) {
 	//count the push
 	l := prometheus.Labels{"account": account.Name, "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 	api.ManifestsPushedCounter.With(l).Inc()
+	api.RepoPushesCounter.With(api.RepoLabels(a.cfg, *repo, "manifest")).Inc()
 
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set("Docker-Content-Digest", manifest.Digest)
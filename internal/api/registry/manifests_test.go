@@ -20,13 +20,16 @@ package registryv2_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
@@ -192,7 +195,7 @@ func TestImageManifestLifecycle(t *testing.T) {
 
 			//PUT failure case: cannot upload manifest without Content-Type, or with
 			//a faulty Content-Type (defense against attacks like CVE-2021-41190)
-			for _, wrongMediaType := range []string{"", manifestlist.MediaTypeManifestList} {
+			for _, wrongMediaType := range []string{"", manifestlist.MediaTypeManifestList, imagespec.MediaTypeImageManifest} {
 				assert.HTTPRequest{
 					Method: "PUT",
 					Path:   "/v2/test1/foo/manifests/" + ref,
@@ -505,6 +508,246 @@ func TestImageListManifestLifecycle(t *testing.T) {
 	})
 }
 
+func TestImageListManifestDefaultPlatform(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image1.MustUpload(t, s, fooRepoRef, "")
+		image2.MustUpload(t, s, fooRepoRef, "")
+		list := test.GenerateImageList(image1, image2) //image2 is linux/arm
+		list.MustUpload(t, s, fooRepoRef, "list")
+
+		//by default, the list manifest is returned when there is no Accept header
+		expectManifestExists(t, h, token, "test1/foo", list.Manifest, "list", nil)
+
+		//with a default platform configured, pulling the list by tag without
+		//Accept header returns the submanifest for that platform instead
+		_, err := s.DB.Exec(`UPDATE accounts SET default_platform_json = $1`, `{"os":"linux","architecture":"arm"}`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/list",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Content-Type":          image2.Manifest.MediaType,
+				"Docker-Content-Digest": image2.Manifest.Digest.String(),
+			},
+			ExpectBody: assert.ByteData(image2.Manifest.Contents),
+		}.Check(t, h)
+
+		//pulling by digest, or with an Accept header that covers the list, still returns the list
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + list.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(list.Manifest.Contents),
+		}.Check(t, h)
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/list",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        list.Manifest.MediaType,
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(list.Manifest.Contents),
+		}.Check(t, h)
+	})
+}
+
+func TestManifestAcceptNegotiation(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image1.MustUpload(t, s, fooRepoRef, "image")
+		image2.MustUpload(t, s, fooRepoRef, "")
+		list := test.GenerateImageList(image1, image2)
+		list.MustUpload(t, s, fooRepoRef, "list")
+
+		//wildcards and q-values that still cover the manifest type are acceptable
+		for _, acceptHeader := range []string{
+			"*/*",
+			"application/*",
+			"text/plain, " + schema2.MediaTypeManifest + ";q=0.5",
+		} {
+			assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/manifests/image",
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Accept":        acceptHeader,
+				},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: map[string]string{
+					test.VersionHeaderKey:   test.VersionHeaderValue,
+					"Content-Type":          image1.Manifest.MediaType,
+					"Docker-Content-Digest": image1.Manifest.Digest.String(),
+					"Vary":                  "Accept",
+				},
+				ExpectBody: assert.ByteData(image1.Manifest.Contents),
+			}.Check(t, h)
+		}
+
+		//media ranges with q=0 are explicitly not acceptable
+		for _, acceptHeader := range []string{
+			schema2.MediaTypeManifest + ";q=0",
+			"application/*;q=0, text/plain",
+		} {
+			assert.HTTPRequest{
+				Method: "GET",
+				Path:   "/v2/test1/foo/manifests/image",
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Accept":        acceptHeader,
+				},
+				ExpectStatus: http.StatusNotAcceptable,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+			}.Check(t, h)
+		}
+
+		//when the list itself is not acceptable, but its submanifests are, the
+		//client is redirected into the submanifest
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/list",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Accept":        list.Manifest.MediaType + ";q=0, " + schema2.MediaTypeManifest,
+			},
+			ExpectStatus: http.StatusTemporaryRedirect,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey:   test.VersionHeaderValue,
+				"Docker-Content-Digest": image1.Manifest.Digest.String(),
+				"Location":              "/v2/test1/foo/manifests/" + image1.Manifest.Digest.String(),
+				"Vary":                  "Accept",
+			},
+		}.Check(t, h)
+	})
+}
+
+func TestManifestIfNoneMatch(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		etag := `"` + image.Manifest.Digest.String() + `"`
+
+		//the ETag is the manifest digest
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/latest",
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{
+				test.VersionHeaderKey: test.VersionHeaderValue,
+				"ETag":                etag,
+			},
+			ExpectBody: assert.ByteData(image.Manifest.Contents),
+		}.Check(t, h)
+
+		//a matching If-None-Match yields 304 without body
+		for _, ifNoneMatch := range []string{etag, `"sha256:other", ` + etag, "W/" + etag, "*"} {
+			for _, method := range []string{"GET", "HEAD"} {
+				assert.HTTPRequest{
+					Method: method,
+					Path:   "/v2/test1/foo/manifests/latest",
+					Header: map[string]string{
+						"Authorization": "Bearer " + token,
+						"If-None-Match": ifNoneMatch,
+					},
+					ExpectStatus: http.StatusNotModified,
+					ExpectHeader: map[string]string{
+						test.VersionHeaderKey:   test.VersionHeaderValue,
+						"Docker-Content-Digest": image.Manifest.Digest.String(),
+						"ETag":                  etag,
+					},
+					ExpectBody: assert.StringData(""),
+				}.Check(t, h)
+			}
+		}
+
+		//a mismatching If-None-Match yields the full manifest
+		assert.HTTPRequest{
+			Method: "GET",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"If-None-Match": `"sha256:other"`,
+			},
+			ExpectStatus: http.StatusOK,
+			ExpectHeader: map[string]string{"ETag": etag},
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, h)
+	})
+}
+
+func TestBlockPullAboveSeverity(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+		overrideToken := s.GetToken(t, "repository:test1/foo:pull,override_pull_block")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s, fooRepoRef, "latest")
+		_, err := s.DB.Exec(`UPDATE vuln_info SET status = $1`, clair.HighSeverity)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		//without a threshold, pulls are always allowed
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+
+		//a threshold at or above the vulnerability status does not block the pull
+		for _, severity := range []clair.VulnerabilityStatus{clair.HighSeverity, clair.CriticalSeverity} {
+			_, err = s.DB.Exec(`UPDATE accounts SET block_pull_above_severity = $1`, severity)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+		}
+
+		//a threshold below the vulnerability status blocks the pull
+		_, err = s.DB.Exec(`UPDATE accounts SET block_pull_above_severity = $1`, clair.MediumSeverity)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, ref := range []string{"latest", image.Manifest.Digest.String()} {
+			assert.HTTPRequest{
+				Method:       "HEAD",
+				Path:         "/v2/test1/foo/manifests/" + ref,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusForbidden,
+				ExpectHeader: test.VersionHeader,
+			}.Check(t, h)
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/manifests/" + ref,
+				Header:       map[string]string{"Authorization": "Bearer " + token},
+				ExpectStatus: http.StatusForbidden,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   test.ErrorCode(keppel.ErrDenied),
+			}.Check(t, h)
+		}
+
+		//...unless the break-glass scope is present in the token
+		expectManifestExists(t, h, overrideToken, "test1/foo", image.Manifest, "latest", nil)
+	})
+}
+
 func TestManifestQuotaExceeded(t *testing.T) {
 	testWithPrimary(t, nil, func(s test.Setup) {
 		h := s.Handler
@@ -646,6 +889,158 @@ func TestManifestRequiredLabels(t *testing.T) {
 	})
 }
 
+func TestManifestRequiredLabelsForLists(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		//only the primary platform carries the required label
+		labeledImage := test.GenerateImageWithCustomConfig(func(cfg map[string]interface{}) {
+			cfg["config"].(map[string]interface{})["Labels"] = map[string]string{"foo": "is there"}
+		}, test.GenerateExampleLayer(1))
+		unlabeledImage := test.GenerateImage(test.GenerateExampleLayer(2))
+
+		setPolicy := func(policy keppel.RequiredLabelsListPolicy) {
+			t.Helper()
+			_, err := s.DB.Exec(
+				`UPDATE accounts SET required_labels = $1, required_labels_list_policy = $2 WHERE name = $3`,
+				"foo", string(policy), "test1",
+			)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		expectPush := func(ref string, manifest test.Bytes, expectedStatus int, expectedBody assert.HTTPResponseBody) {
+			t.Helper()
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + ref,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  manifest.MediaType,
+				},
+				Body:         assert.ByteData(manifest.Contents),
+				ExpectStatus: expectedStatus,
+				ExpectBody:   expectedBody,
+			}.Check(t, h)
+		}
+
+		//with a list policy, image manifests pushed by tag are still checked on their own...
+		setPolicy(keppel.RequiredLabelsOnAllPlatforms)
+		for _, blob := range append(unlabeledImage.Layers, unlabeledImage.Config) {
+			blob.MustUpload(t, s, fooRepoRef)
+		}
+		expectPush("latest", unlabeledImage.Manifest, http.StatusBadRequest, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "missing required labels: foo",
+		})
+
+		//...but image manifests pushed by digest are not
+		labeledImage.MustUpload(t, s, fooRepoRef, "")
+		unlabeledImage.MustUpload(t, s, fooRepoRef, "")
+
+		//once such an image manifest gets tagged, it is checked on its own again
+		expectPush("unlabeled", unlabeledImage.Manifest, http.StatusBadRequest, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "missing required labels: foo",
+		})
+		//this also applies when the tag is given as `?tag=` on a push by digest
+		expectPush(unlabeledImage.Manifest.Digest.String()+"?tag=unlabeled", unlabeledImage.Manifest, http.StatusBadRequest, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "missing required labels: foo",
+		})
+
+		//with "all_platforms", the list is rejected because one platform lacks the label
+		list := test.GenerateImageList(labeledImage, unlabeledImage)
+		expectPush("list", list.Manifest, http.StatusBadRequest, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "missing required labels on submanifest " + unlabeledImage.Manifest.Digest.String() + ": foo",
+		})
+
+		//with "any_platform", the list is accepted because the primary platform has the label
+		setPolicy(keppel.RequiredLabelsOnAnyPlatform)
+		expectPush("list", list.Manifest, http.StatusCreated, nil)
+
+		//but not if none of the platforms has the label
+		otherList := test.GenerateImageList(unlabeledImage)
+		expectPush("otherlist", otherList.Manifest, http.StatusBadRequest, test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "no submanifest has all required labels: foo",
+		})
+
+		//with "all_platforms", a list where all platforms have the label is accepted
+		setPolicy(keppel.RequiredLabelsOnAllPlatforms)
+		labeledList := test.GenerateImageList(labeledImage)
+		expectPush("labeledlist", labeledList.Manifest, http.StatusCreated, nil)
+	})
+}
+
+func TestManifestRequiredLabelsFromAnnotations(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		image := test.GenerateImageWithCustomConfig(func(cfg map[string]interface{}) {
+			cfg["config"].(map[string]interface{})["Labels"] = map[string]string{"foo": "from label"}
+		}, test.GenerateExampleLayer(1))
+		image.Config.MustUpload(t, s, fooRepoRef)
+		image.Layers[0].MustUpload(t, s, fooRepoRef)
+
+		//build an OCI manifest for this image that carries additional metadata in its annotations
+		manifestBytes, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     imagespec.MediaTypeImageManifest,
+			"config": map[string]interface{}{
+				"mediaType": imagespec.MediaTypeImageConfig,
+				"size":      len(image.Config.Contents),
+				"digest":    image.Config.Digest,
+			},
+			"layers": []map[string]interface{}{{
+				"mediaType": imagespec.MediaTypeImageLayerGzip,
+				"size":      len(image.Layers[0].Contents),
+				"digest":    image.Layers[0].Digest,
+			}},
+			"annotations": map[string]string{
+				"foo":                               "from annotation",
+				"org.opencontainers.image.source":   "https://example.org/foo.git",
+				"org.opencontainers.image.revision": "deadbeef",
+			},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		manifestDigest := digest.Canonical.FromBytes(manifestBytes)
+
+		//the required label "org.opencontainers.image.source" is only present as an annotation
+		_, err = s.DB.Exec(
+			`UPDATE accounts SET required_labels = $1 WHERE name = $2`,
+			"foo,org.opencontainers.image.source", "test1",
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  imagespec.MediaTypeImageManifest,
+			},
+			Body:         assert.ByteData(manifestBytes),
+			ExpectStatus: http.StatusCreated,
+			ExpectHeader: test.VersionHeader,
+		}.Check(t, h)
+
+		//annotations are reported alongside labels, but labels take precedence by default
+		expectLabelsJSONOnManifest(t, s.DB, manifestDigest, map[string]string{
+			"foo":                               "from label",
+			"org.opencontainers.image.source":   "https://example.org/foo.git",
+			"org.opencontainers.image.revision": "deadbeef",
+		})
+	})
+}
+
 func expectLabelsJSONOnManifest(t *testing.T, db *keppel.DB, manifestDigest digest.Digest, expected map[string]string) {
 	t.Helper()
 	labelsJSONStr, err := db.SelectStr(`SELECT labels_json FROM manifests WHERE digest = $1`, manifestDigest.String())
@@ -688,6 +1083,136 @@ func TestImageManifestWrongBlobSize(t *testing.T) {
 	})
 }
 
+func TestImageManifestInvalidTagName(t *testing.T) {
+	testWithPrimary(t, nil, func(s test.Setup) {
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.Layers[0].MustUpload(t, s, fooRepoRef)
+		image.Config.MustUpload(t, s, fooRepoRef)
+
+		invalidTagNames := []string{
+			strings.Repeat("a", 129),
+			".leading-dot",
+			"-leading-dash",
+			"illegal!char",
+		}
+		for _, tagName := range invalidTagNames {
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tagName,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: http.StatusBadRequest,
+				ExpectBody:   test.ErrorCode(keppel.ErrTagInvalid),
+			}.Check(t, h)
+		}
+
+		validTagNames := []string{
+			"latest",
+			"v1.2.3-rc.1",
+			"_underscore",
+			strings.Repeat("a", 128),
+		}
+		for _, tagName := range validTagNames {
+			assert.HTTPRequest{
+				Method: "PUT",
+				Path:   "/v2/test1/foo/manifests/" + tagName,
+				Header: map[string]string{
+					"Authorization": "Bearer " + token,
+					"Content-Type":  image.Manifest.MediaType,
+				},
+				Body:         assert.ByteData(image.Manifest.Contents),
+				ExpectStatus: http.StatusCreated,
+			}.Check(t, h)
+		}
+	})
+}
+
+func TestManifestPushWithMultipleTags(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+	)
+	h := s.Handler
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.Layers[0].MustUpload(t, s, fooRepoRef)
+	image.Config.MustUpload(t, s, fooRepoRef)
+
+	expectTags := func(expected map[string]string) {
+		t.Helper()
+		actual := make(map[string]string)
+		var tags []keppel.Tag
+		_, err := s.DB.Select(&tags, `SELECT * FROM tags`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, tag := range tags {
+			actual[tag.Name] = tag.Digest
+		}
+		assert.DeepEqual(t, "tags", actual, expected)
+	}
+
+	//if any of the tags is invalid, nothing is stored
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/v1.2.3?tag=v1.2&tag=illegal!char",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  image.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(image.Manifest.Contents),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody:   test.ErrorCode(keppel.ErrTagInvalid),
+	}.Check(t, h)
+	expectTags(map[string]string{})
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manifest count", count, int64(0))
+
+	//a single push can set multiple tags at once
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/v1.2.3?tag=v1.2&tag=latest",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  image.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(image.Manifest.Contents),
+		ExpectStatus: http.StatusCreated,
+		ExpectHeader: map[string]string{
+			test.VersionHeaderKey:   test.VersionHeaderValue,
+			"Docker-Content-Digest": image.Manifest.Digest.String(),
+		},
+	}.Check(t, h)
+	digestStr := image.Manifest.Digest.String()
+	expectTags(map[string]string{"v1.2.3": digestStr, "v1.2": digestStr, "latest": digestStr})
+	for _, tagName := range []string{"v1.2.3", "v1.2", "latest"} {
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, tagName, nil)
+	}
+
+	//this also works when pushing by digest (as in OCI Distribution Spec v1.1)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/" + digestStr + "?tag=stable&tag=latest",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  image.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(image.Manifest.Contents),
+		ExpectStatus: http.StatusCreated,
+	}.Check(t, h)
+	expectTags(map[string]string{"v1.2.3": digestStr, "v1.2": digestStr, "latest": digestStr, "stable": digestStr})
+}
+
 func TestImageManifestCmdEntrypointAsString(t *testing.T) {
 	testWithPrimary(t, nil, func(s test.Setup) {
 		j := tasks.NewJanitor(s.Config, s.FD, s.SD, s.ICD, s.DB, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
@@ -706,3 +1231,245 @@ func TestImageManifestCmdEntrypointAsString(t *testing.T) {
 		}
 	})
 }
+
+func TestManifestMaxLayers(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+		test.WithMaxLayersPerManifest(2),
+	)
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+	//an image with exactly as many layers as allowed can be pushed
+	image := test.GenerateImage(test.GenerateExampleLayer(1), test.GenerateExampleLayer(2))
+	image.MustUpload(t, s, fooRepoRef, "latest")
+
+	//one layer more than allowed is rejected
+	oversizedImage := test.GenerateImage(test.GenerateExampleLayer(1), test.GenerateExampleLayer(2), test.GenerateExampleLayer(3))
+	oversizedImage.Layers[2].MustUpload(t, s, fooRepoRef)
+	oversizedImage.Config.MustUpload(t, s, fooRepoRef)
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/oversized",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  oversizedImage.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(oversizedImage.Manifest.Contents),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: test.ErrorCodeWithMessage{
+			Code:    keppel.ErrManifestInvalid,
+			Message: "manifest has 3 layers, but at most 2 are allowed",
+		},
+	}.Check(t, s.Handler)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/foo/manifests/" + oversizedImage.Manifest.Digest.String(),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusNotFound,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+	}.Check(t, s.Handler)
+
+	//list manifests do not have layers of their own and are therefore not affected
+	imageList := test.GenerateImageList(image, test.GenerateImage(test.GenerateExampleLayer(4)))
+	imageList.MustUpload(t, s, fooRepoRef, "list")
+}
+
+// An AdmissionPolicy that only admits image manifests with a signature label.
+type signatureRequiredPolicy struct{}
+
+func (signatureRequiredPolicy) PluginTypeID() string { return "signature-required" }
+func (signatureRequiredPolicy) Init() error          { return nil }
+
+func (signatureRequiredPolicy) AdmitManifest(req keppel.AdmissionRequest) error {
+	if req.Parsed.FindImageConfigBlob() == nil {
+		return nil //list manifests are admitted based on their submanifests
+	}
+	if req.Labels["org.example.signature"] == "" {
+		return fmt.Errorf("%s in %s is not signed", req.Manifest.Digest, req.Repository.FullName())
+	}
+	return nil
+}
+
+func (signatureRequiredPolicy) TagsRequiredForAdmission(keppel.Account, string, keppel.ParsedManifest) []string {
+	return nil
+}
+
+func TestManifestAdmissionPolicy(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+		test.WithAdmissionPolicy(signatureRequiredPolicy{}),
+	)
+	token := s.GetToken(t, "repository:test1/foo:pull,push")
+
+	//signed images are admitted
+	signedImage := test.GenerateImageWithCustomConfig(func(cfg map[string]interface{}) {
+		cfg["config"].(map[string]interface{})["Labels"] = map[string]string{"org.example.signature": "c2lnbmVk"}
+	}, test.GenerateExampleLayer(1))
+	signedImage.MustUpload(t, s, fooRepoRef, "signed")
+
+	//unsigned images are rejected before anything is stored
+	unsignedImage := test.GenerateImage(test.GenerateExampleLayer(2))
+	for _, blob := range append(unsignedImage.Layers, unsignedImage.Config) {
+		blob.MustUpload(t, s, fooRepoRef)
+	}
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   "/v2/test1/foo/manifests/unsigned",
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  unsignedImage.Manifest.MediaType,
+		},
+		Body:         assert.ByteData(unsignedImage.Manifest.Contents),
+		ExpectStatus: http.StatusForbidden,
+		ExpectBody: test.ErrorCodeWithMessage{
+			Code:    keppel.ErrDenied,
+			Message: fmt.Sprintf("manifest rejected by admission policy: %s in test1/foo is not signed", unsignedImage.Manifest.Digest),
+		},
+	}.Check(t, s.Handler)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/foo/manifests/unsigned",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusNotFound,
+		ExpectHeader: test.VersionHeader,
+		ExpectBody:   test.ErrorCode(keppel.ErrManifestUnknown),
+	}.Check(t, s.Handler)
+
+	//lists are left to the policy as well (this one admits them)
+	test.GenerateImageList(signedImage).MustUpload(t, s, fooRepoRef, "list")
+}
+
+func TestManifestStrictMediaTypes(t *testing.T) {
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	expectPush := func(s test.Setup, mediaType string, expectedStatus int, expectedBody assert.HTTPResponseBody) {
+		t.Helper()
+		token := s.GetToken(t, "repository:test1/foo:pull,push")
+		assert.HTTPRequest{
+			Method: "PUT",
+			Path:   "/v2/test1/foo/manifests/latest",
+			Header: map[string]string{
+				"Authorization": "Bearer " + token,
+				"Content-Type":  mediaType,
+			},
+			Body:         assert.ByteData(image.Manifest.Contents),
+			ExpectStatus: expectedStatus,
+			ExpectBody:   expectedBody,
+		}.Check(t, s.Handler)
+	}
+
+	//in strict mode with the default set of media types, unknown media types are rejected...
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+		test.WithStrictManifestMediaTypes(),
+	)
+	for _, blob := range append(image.Layers, image.Config) {
+		blob.MustUpload(t, s, fooRepoRef)
+	}
+	expectPush(s, "application/vnd.example.unknown+json", http.StatusBadRequest, test.ErrorCodeWithMessage{
+		Code:    keppel.ErrManifestInvalid,
+		Message: `manifest media type "application/vnd.example.unknown+json" is not allowed`,
+	})
+	//...but the standard media types are accepted
+	expectPush(s, image.Manifest.MediaType, http.StatusCreated, nil)
+
+	//the set of allowed media types can be restricted further
+	s = test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+		test.WithStrictManifestMediaTypes(imagespec.MediaTypeImageManifest, imagespec.MediaTypeImageIndex),
+	)
+	for _, blob := range append(image.Layers, image.Config) {
+		blob.MustUpload(t, s, fooRepoRef)
+	}
+	expectPush(s, image.Manifest.MediaType, http.StatusBadRequest, test.ErrorCodeWithMessage{
+		Code:    keppel.ErrManifestInvalid,
+		Message: fmt.Sprintf("manifest media type %q is not allowed", schema2.MediaTypeManifest),
+	})
+}
+
+func TestTagHistory(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithQuotas,
+	)
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+		test.GenerateImage(test.GenerateExampleLayer(2)),
+	}
+
+	//creating a tag does not write a history entry
+	images[0].MustUpload(t, s, fooRepoRef, "latest")
+
+	//moving the tag writes a history entry each time...
+	s.Clock.StepBy(time.Hour)
+	images[1].MustUpload(t, s, fooRepoRef, "latest")
+	firstMoveAt := s.Clock.Now()
+	//...but pushing the same manifest into the same tag again does not
+	s.Clock.StepBy(time.Hour)
+	images[1].MustUpload(t, s, fooRepoRef, "latest")
+	s.Clock.StepBy(time.Hour)
+	images[0].MustUpload(t, s, fooRepoRef, "latest")
+	secondMoveAt := s.Clock.Now()
+
+	var entries []keppel.TagHistoryEntry
+	_, err := s.DB.Select(&entries, `SELECT * FROM tag_history ORDER BY id`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for idx := range entries {
+		//normalize time zone for comparison
+		entries[idx].MovedAt = entries[idx].MovedAt.UTC()
+	}
+	assert.DeepEqual(t, "tag history", entries, []keppel.TagHistoryEntry{
+		{
+			ID:             1,
+			RepositoryID:   1,
+			TagName:        "latest",
+			OldDigest:      images[0].Manifest.Digest.String(),
+			NewDigest:      images[1].Manifest.Digest.String(),
+			MovedAt:        firstMoveAt,
+			MovedBy:        "correctusername",
+			AccountName:    "test1",
+			RepositoryName: "foo",
+		},
+		{
+			ID:             2,
+			RepositoryID:   1,
+			TagName:        "latest",
+			OldDigest:      images[1].Manifest.Digest.String(),
+			NewDigest:      images[0].Manifest.Digest.String(),
+			MovedAt:        secondMoveAt,
+			MovedBy:        "correctusername",
+			AccountName:    "test1",
+			RepositoryName: "foo",
+		},
+	})
+
+	//the history cannot be tampered with...
+	for _, query := range []string{
+		`UPDATE tag_history SET new_digest = old_digest`,
+		`DELETE FROM tag_history`,
+	} {
+		_, err := s.DB.Exec(query)
+		if err == nil || !strings.Contains(err.Error(), "tag_history is append-only") {
+			t.Errorf("expected %q to be refused, but got err = %v", query, err)
+		}
+	}
+
+	//...and it survives the deletion of the repository
+	_, err = s.DB.Exec(`DELETE FROM repos WHERE account_name = $1 AND name = $2`, "test1", "foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM tag_history`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 2 {
+		t.Errorf("expected 2 tag history entries after repo deletion, but got %d", count)
+	}
+}
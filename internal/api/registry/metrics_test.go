@@ -0,0 +1,223 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package registryv2_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+// getRepoCounterValue reads the value of one series of the keppel_repo_pulls
+// or keppel_repo_pushes metrics.
+func getRepoCounterValue(t *testing.T, metricName, repoName, objectType string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, family := range families {
+		if family.GetName() != metricName {
+			continue
+		}
+	METRIC:
+		for _, metric := range family.GetMetric() {
+			expectedLabels := map[string]string{"account": "test1", "repo": repoName, "type": objectType}
+			for _, label := range metric.GetLabel() {
+				if expectedLabels[label.GetName()] != label.GetValue() {
+					continue METRIC
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+// getPulledBlobBytesCounterValue reads the value of the
+// keppel_pulled_blob_bytes metric for direct pulls from the given account.
+func getPulledBlobBytesCounterValue(t *testing.T, accountName string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, family := range families {
+		if family.GetName() != "keppel_pulled_blob_bytes" {
+			continue
+		}
+	METRIC:
+		for _, metric := range family.GetMetric() {
+			expectedLabels := map[string]string{"account": accountName, "auth_tenant_id": authTenantID, "method": "registry-api"}
+			for _, label := range metric.GetLabel() {
+				if expectedLabels[label.GetName()] != label.GetValue() {
+					continue METRIC
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestRepoTrafficCounters(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	repo := *s.Repos[0]
+
+	//counters are global, so we need to compare against the values before the test
+	counterValues := func() []float64 {
+		return []float64{
+			getRepoCounterValue(t, "keppel_repo_pushes", "foo", "blob"),
+			getRepoCounterValue(t, "keppel_repo_pushes", "foo", "manifest"),
+			getRepoCounterValue(t, "keppel_repo_pulls", "foo", "blob"),
+			getRepoCounterValue(t, "keppel_repo_pulls", "foo", "manifest"),
+		}
+	}
+	before := counterValues()
+	expectDelta := func(expectedDelta ...float64) {
+		t.Helper()
+		after := counterValues()
+		actualDelta := make([]float64, len(after))
+		for idx := range after {
+			actualDelta[idx] = after[idx] - before[idx]
+		}
+		assert.DeepEqual(t, "counter deltas (blob pushes, manifest pushes, blob pulls, manifest pulls)", actualDelta, expectedDelta)
+	}
+
+	//pushing an image pushes its layer and config blobs, and then the manifest
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repo, "latest")
+	expectDelta(2, 1, 0, 0)
+
+	//pulling counts each manifest and blob pulled
+	token := s.GetToken(t, "repository:test1/foo:pull")
+	expectManifestExists(t, s.Handler, token, "test1/foo", image.Manifest, "latest", nil)
+	expectBlobExists(t, s.Handler, token, "test1/foo", image.Layers[0], nil)
+	expectDelta(2, 1, 1, 1)
+}
+
+func getDigestMismatchCounterValue(t *testing.T, objectType string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, family := range families {
+		if family.GetName() != "keppel_storage_digest_mismatches" {
+			continue
+		}
+	METRIC:
+		for _, metric := range family.GetMetric() {
+			expectedLabels := map[string]string{"account": "test1", "type": objectType}
+			for _, label := range metric.GetLabel() {
+				if expectedLabels[label.GetName()] != label.GetValue() {
+					continue METRIC
+				}
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+		test.WithVerifyOnRead(1),
+	)
+	account := *s.Accounts[0]
+	repo := *s.Repos[0]
+	token := s.GetToken(t, "repository:test1/foo:pull")
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repo, "latest")
+
+	//counters are global, so we need to compare against the values before the test
+	manifestMismatchesBefore := getDigestMismatchCounterValue(t, "manifest")
+	blobMismatchesBefore := getDigestMismatchCounterValue(t, "blob")
+	expectMismatchDelta := func(expectedManifestDelta, expectedBlobDelta float64) {
+		t.Helper()
+		assert.DeepEqual(t, "manifest mismatch count",
+			getDigestMismatchCounterValue(t, "manifest")-manifestMismatchesBefore, expectedManifestDelta)
+		assert.DeepEqual(t, "blob mismatch count",
+			getDigestMismatchCounterValue(t, "blob")-blobMismatchesBefore, expectedBlobDelta)
+	}
+
+	//intact contents do not report any mismatches
+	expectManifestExists(t, s.Handler, token, "test1/foo", image.Manifest, "latest", nil)
+	expectBlobExists(t, s.Handler, token, "test1/foo", image.Layers[0], nil)
+	expectMismatchDelta(0, 0)
+
+	//corrupt the manifest and the layer blob by flipping their first byte
+	corrupt := func(contents []byte) []byte {
+		result := append([]byte(nil), contents...)
+		result[0] ^= 0xFF
+		return result
+	}
+	_, err := s.DB.Exec(`UPDATE manifest_contents SET content = $1 WHERE digest = $2`,
+		corrupt(image.Manifest.Contents), image.Manifest.Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	storageID, err := s.DB.SelectStr(`SELECT storage_id FROM blobs WHERE digest = $1`, image.Layers[0].Digest.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	corruptedLayer := corrupt(image.Layers[0].Contents)
+	corruptedLayerSize := uint64(len(corruptedLayer))
+	err = s.SD.DeleteBlob(account, storageID)
+	if err == nil {
+		err = s.SD.AppendToBlob(account, storageID, 1, &corruptedLayerSize, bytes.NewReader(corruptedLayer))
+	}
+	if err == nil {
+		err = s.SD.FinalizeBlob(account, storageID, 1)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//the corrupted contents are still served, but the mismatch is detected
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/foo/manifests/latest",
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.ByteData(corrupt(image.Manifest.Contents)),
+	}.Check(t, s.Handler)
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         "/v2/test1/foo/blobs/" + image.Layers[0].Digest.String(),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   assert.ByteData(corruptedLayer),
+	}.Check(t, s.Handler)
+	expectMismatchDelta(1, 1)
+}
@@ -205,3 +205,121 @@ func TestAnycastRateLimits(t *testing.T) {
 		})
 	})
 }
+
+func TestAnonymousRateLimits(t *testing.T) {
+	limit := redis_rate.Limit{Rate: 2, Period: time.Minute, Burst: 2}
+	rld := basic.RateLimitDriver{
+		Limits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			keppel.AnonymousRequestAction: limit,
+			//all other rate limits are set to "unlimited"
+		},
+	}
+	rle := &keppel.RateLimitEngine{Driver: rld, Client: nil}
+
+	testWithPrimary(t, rle, func(s test.Setup) {
+		sr := miniredis.RunT(t)
+		sr.SetTime(s.Clock.Now())
+		s.Clock.MiniRedis = sr
+		rle.Client = redis.NewClient(&redis.Options{Addr: sr.Addr()})
+
+		h := s.Handler
+		blob := test.NewBytes([]byte("the blob for our test case"))
+		blob.MustUpload(t, s, fooRepoRef)
+		_, err := s.DB.Exec(
+			`INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull) VALUES ('test1', 'foo', '', TRUE)`,
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		pullBlob := func(requesterIP, token string) assert.HTTPRequest {
+			req := assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/blobs/" + blob.Digest.String(),
+				Header:       map[string]string{"X-Forwarded-For": requesterIP},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   assert.ByteData(blob.Contents),
+			}
+			if token != "" {
+				req.Header["Authorization"] = "Bearer " + token
+			}
+			return req
+		}
+
+		//anonymous requests from the same IP can use up the burst budget...
+		for i := 0; i < limit.Burst; i++ {
+			pullBlob("198.51.100.1", "").Check(t, h)
+		}
+
+		//...but then they get rate-limited
+		failingReq := pullBlob("198.51.100.1", "")
+		failingReq.ExpectStatus = http.StatusTooManyRequests
+		failingReq.ExpectBody = test.ErrorCode(keppel.ErrTooManyRequests)
+		failingReq.Check(t, h)
+
+		//a client cannot reset its budget by sending its own X-Forwarded-For
+		//header, since only the entry appended by our trusted proxy counts
+		spoofedReq := pullBlob("198.51.100.2, 198.51.100.1", "")
+		spoofedReq.ExpectStatus = http.StatusTooManyRequests
+		spoofedReq.ExpectBody = test.ErrorCode(keppel.ErrTooManyRequests)
+		spoofedReq.Check(t, h)
+
+		//anonymous requests from other IPs are not affected
+		pullBlob("198.51.100.2", "").Check(t, h)
+
+		//authenticated requests from the same IP are not affected either
+		token := s.GetToken(t, "repository:test1/foo:pull")
+		pullBlob("198.51.100.1", token).Check(t, h)
+
+		//after the budget has recovered, anonymous requests are allowed again
+		s.Clock.StepBy(time.Minute)
+		pullBlob("198.51.100.1", "").Check(t, h)
+	}, test.WithTrustedProxies("192.0.2.1")) //this is the RemoteAddr of all test requests
+}
+
+func TestAnonymousRateLimitsIgnoreUntrustedForwardedFor(t *testing.T) {
+	limit := redis_rate.Limit{Rate: 2, Period: time.Minute, Burst: 2}
+	rld := basic.RateLimitDriver{
+		Limits: map[keppel.RateLimitedAction]redis_rate.Limit{
+			keppel.AnonymousRequestAction: limit,
+		},
+	}
+	rle := &keppel.RateLimitEngine{Driver: rld, Client: nil}
+
+	//without any trusted proxies, X-Forwarded-For is ignored entirely
+	testWithPrimary(t, rle, func(s test.Setup) {
+		sr := miniredis.RunT(t)
+		sr.SetTime(s.Clock.Now())
+		s.Clock.MiniRedis = sr
+		rle.Client = redis.NewClient(&redis.Options{Addr: sr.Addr()})
+
+		h := s.Handler
+		blob := test.NewBytes([]byte("the blob for our test case"))
+		blob.MustUpload(t, s, fooRepoRef)
+		_, err := s.DB.Exec(
+			`INSERT INTO rbac_policies (account_name, match_repository, match_username, can_anon_pull) VALUES ('test1', 'foo', '', TRUE)`,
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		//every request claims to come from a different IP, but they all come
+		//from the same RemoteAddr, so they share one budget
+		for i := 0; i <= limit.Burst; i++ {
+			req := assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/foo/blobs/" + blob.Digest.String(),
+				Header:       map[string]string{"X-Forwarded-For": "198.51.100." + strconv.Itoa(i+1)},
+				ExpectStatus: http.StatusOK,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody:   assert.ByteData(blob.Contents),
+			}
+			if i == limit.Burst {
+				req.ExpectStatus = http.StatusTooManyRequests
+				req.ExpectBody = test.ErrorCode(keppel.ErrTooManyRequests)
+			}
+			req.Check(t, h)
+		}
+	})
+}
@@ -20,10 +20,13 @@ package registryv2_test
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
@@ -470,6 +473,24 @@ func TestReplicationImageListWithPlatformFilter(t *testing.T) {
 					ExpectHeader: test.VersionHeader,
 					ExpectBody:   test.ErrorCode(keppel.ErrUnavailable),
 				}.Check(t, h2)
+
+				//if the default platform points to the unreplicated manifest, the
+				//list manifest is served instead of failing
+				_, err := s2.DB.Exec(`UPDATE accounts SET default_platform_json = $1`, `{"os":"linux","architecture":"arm"}`)
+				if err != nil {
+					t.Fatal(err.Error())
+				}
+				assert.HTTPRequest{
+					Method:       "GET",
+					Path:         "/v2/test1/foo/manifests/list",
+					Header:       map[string]string{"Authorization": "Bearer " + token},
+					ExpectStatus: http.StatusOK,
+					ExpectHeader: map[string]string{
+						test.VersionHeaderKey:   test.VersionHeaderValue,
+						"Docker-Content-Digest": list.Manifest.Digest.String(),
+					},
+					ExpectBody: assert.ByteData(list.Manifest.Contents),
+				}.Check(t, h2)
 			}
 		})
 	})
@@ -559,3 +580,195 @@ func TestReplicationFailingOverIntoPullDelegation(t *testing.T) {
 		})
 	})
 }
+
+func TestReplicationTimeoutOnSlowUpstream(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t,
+			test.WithAccount(keppel.Account{
+				Name:            "test1",
+				AuthTenantID:    authTenantID,
+				ExternalPeerURL: "registry-tertiary.example.org",
+			}),
+			test.WithQuotas,
+			test.WithReplicationTimeout(50*time.Millisecond),
+		)
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		//setup tertiary as an upstream that does not respond before the client gives up
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		tt.Handlers["registry-tertiary.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+				t.Error("replication did not time out")
+			}
+			w.Header().Set("Content-Type", image.Manifest.MediaType)
+			w.WriteHeader(http.StatusOK)
+			w.Write(image.Manifest.Contents)
+		})
+
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusServiceUnavailable,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody: test.ErrorCodeWithMessage{
+				Code: keppel.ErrUnavailable,
+				Message: fmt.Sprintf("upstream registry registry-tertiary.example.org did not deliver manifest %s of repository foo within 50ms",
+					image.Manifest.Digest.String()),
+			},
+		}.Check(t, s.Handler)
+	})
+}
+
+func TestReplicationPullThroughExternalRegistry(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t,
+			test.WithAccount(keppel.Account{
+				Name:            "test1",
+				AuthTenantID:    authTenantID,
+				ExternalPeerURL: "registry-tertiary.example.org/library",
+			}),
+			test.WithQuotas,
+		)
+		h := s.Handler
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		//setup tertiary as a stub upstream registry that serves one image
+		//anonymously and counts how often it was asked for something
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		upstreamContents := map[string]test.Bytes{
+			"/v2/library/foo/manifests/latest":                            image.Manifest,
+			"/v2/library/foo/manifests/" + image.Manifest.Digest.String(): image.Manifest,
+			"/v2/library/foo/blobs/" + image.Config.Digest.String():       image.Config,
+			"/v2/library/foo/blobs/" + image.Layers[0].Digest.String():    image.Layers[0],
+		}
+		var upstreamRequestCount atomic.Int32
+		tt.Handlers["registry-tertiary.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamRequestCount.Add(1)
+			content, exists := upstreamContents[r.URL.Path]
+			if !exists {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", content.MediaType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content.Contents)))
+			w.Header().Set("Docker-Content-Digest", content.Digest.String())
+			w.WriteHeader(http.StatusOK)
+			if r.Method != http.MethodHead {
+				w.Write(content.Contents)
+			}
+		})
+
+		//the first pull goes through to the upstream registry...
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+		expectBlobExists(t, h, token, "test1/foo", image.Config, nil)
+		expectBlobExists(t, h, token, "test1/foo", image.Layers[0], nil)
+		if upstreamRequestCount.Load() == 0 {
+			t.Error("expected the first pull to be served by the upstream registry, but upstream was never asked")
+		}
+
+		//...but subsequent pulls are served locally without asking upstream again
+		requestCountAfterFirstPull := upstreamRequestCount.Load()
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, image.Manifest.Digest.String(), nil)
+		expectBlobExists(t, h, token, "test1/foo", image.Config, nil)
+		expectBlobExists(t, h, token, "test1/foo", image.Layers[0], nil)
+		assert.DeepEqual(t, "upstream request count after second pull", upstreamRequestCount.Load(), requestCountAfterFirstPull)
+
+		//this also works when the upstream registry is not available at all anymore
+		tt.Handlers["registry-tertiary.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("unexpected upstream request: %s %s", r.Method, r.URL.Path)
+			http.Error(w, "upstream is down", http.StatusServiceUnavailable)
+		})
+		expectManifestExists(t, h, token, "test1/foo", image.Manifest, "latest", nil)
+		expectBlobExists(t, h, token, "test1/foo", image.Layers[0], nil)
+	})
+}
+
+func TestReplicationRejectsTamperedManifest(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		s := test.NewSetup(t,
+			test.WithAccount(keppel.Account{
+				Name:            "test1",
+				AuthTenantID:    authTenantID,
+				ExternalPeerURL: "registry-tertiary.example.org/library",
+			}),
+			test.WithQuotas,
+		)
+		token := s.GetToken(t, "repository:test1/foo:pull")
+
+		//setup tertiary as a compromised upstream registry that delivers a
+		//different manifest than the one requested
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		tamperedImage := test.GenerateImage(test.GenerateExampleLayer(2))
+		tt.Handlers["registry-tertiary.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/library/foo/manifests/"+image.Manifest.Digest.String() {
+				t.Errorf("unexpected upstream request: %s %s", r.Method, r.URL.Path)
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", tamperedImage.Manifest.MediaType)
+			w.WriteHeader(http.StatusOK)
+			w.Write(tamperedImage.Manifest.Contents)
+		})
+
+		//replication fails before anything referenced by the bogus manifest is replicated
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + image.Manifest.Digest.String(),
+			Header:       map[string]string{"Authorization": "Bearer " + token},
+			ExpectStatus: http.StatusBadRequest,
+			ExpectHeader: test.VersionHeader,
+			ExpectBody:   test.ErrorCode(keppel.ErrDigestInvalid),
+		}.Check(t, s.Handler)
+
+		for _, tableName := range []string{"manifests", "blobs"} {
+			count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM ` + tableName)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if count != 0 {
+				t.Errorf("expected no %s to be replicated, but found %d", tableName, count)
+			}
+		}
+	})
+}
+
+func TestReplicationWithRepositoryFilter(t *testing.T) {
+	testWithPrimary(t, nil, func(s1 test.Setup) {
+		//upload the same image into two repos on the primary account
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		s1.Clock.Step()
+		image.MustUpload(t, s1, fooRepoRef, "first")
+		image.MustUpload(t, s1, barRepoRef, "first")
+
+		testWithAllReplicaTypes(t, s1, func(strategy string, firstPass bool, s2 test.Setup) {
+			_, err := s2.DB.Exec(`UPDATE accounts SET replication_include_repos = $1, replication_exclude_repos = $2`, "f*,qux", "b*")
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			h2 := s2.Handler
+
+			//the included repo replicates as usual
+			fooToken := s2.GetToken(t, "repository:test1/foo:pull")
+			expectManifestExists(t, h2, fooToken, "test1/foo", image.Manifest, "first", nil)
+			expectBlobExists(t, h2, fooToken, "test1/foo", image.Layers[0], nil)
+
+			//the excluded repo does not replicate
+			barToken := s2.GetToken(t, "repository:test1/bar:pull")
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         "/v2/test1/bar/manifests/first",
+				Header:       map[string]string{"Authorization": "Bearer " + barToken},
+				ExpectStatus: http.StatusForbidden,
+				ExpectHeader: test.VersionHeader,
+				ExpectBody: test.ErrorCodeWithMessage{
+					Code:    keppel.ErrDenied,
+					Message: "image does not exist here, and repository test1/bar is excluded from replication",
+				},
+			}.Check(t, h2)
+		})
+	})
+}
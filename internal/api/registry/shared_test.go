@@ -44,16 +44,17 @@ var (
 // the auth tenant ID that all test accounts use
 const authTenantID = "test1authtenant"
 
-func testWithPrimary(t *testing.T, rle *keppel.RateLimitEngine, action func(test.Setup)) {
+func testWithPrimary(t *testing.T, rle *keppel.RateLimitEngine, action func(test.Setup), extraOpts ...test.SetupOption) {
 	test.WithRoundTripper(func(tt *test.RoundTripper) {
 		for _, withAnycast := range []bool{false, true} {
-			s := test.NewSetup(t,
+			opts := []test.SetupOption{
 				test.WithAnycast(withAnycast),
 				test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
 				test.WithQuotas,
 				test.WithPeerAPI,
 				test.WithRateLimitEngine(rle),
-			)
+			}
+			s := test.NewSetup(t, append(opts, extraOpts...)...)
 			currentlyWithAnycast = withAnycast
 
 			//run the tests for this scenario
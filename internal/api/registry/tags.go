@@ -45,25 +45,9 @@ func (a *API) handleListTags(w http.ResponseWriter, r *http.Request) {
 
 	//parse query: limit (parameter "n")
 	query := r.URL.Query()
-	var (
-		limit uint64
-		err   error
-	)
-	if limitStr := query.Get("n"); limitStr != "" {
-		limit, err = strconv.ParseUint(limitStr, 10, 64)
-		if err != nil {
-			http.Error(w, `invalid value for "n": `+err.Error(), http.StatusBadRequest)
-			return
-		}
-		if limit == 0 {
-			http.Error(w, `invalid value for "n": must not be 0`, http.StatusBadRequest)
-			return
-		}
-	} else {
-		limit = maxLimit
-	}
-	if limit > maxLimit {
-		limit = maxLimit
+	limit, ok := parseLimit(w, query)
+	if !ok {
+		return
 	}
 
 	//parse query: marker (parameter "last")
@@ -71,9 +55,9 @@ func (a *API) handleListTags(w http.ResponseWriter, r *http.Request) {
 
 	//list tags (we request one more than `limit` to see if we need to paginate)
 	tags := []string{}
-	err = sqlext.ForeachRow(a.db, tagsListQuery, []interface{}{repo.ID, marker, limit + 1}, func(rows *sql.Rows) error {
+	err := sqlext.ForeachRow(a.db, tagsListQuery, []interface{}{repo.ID, marker, limit + 1}, func(rows *sql.Rows) error {
 		var tagName string
-		err = rows.Scan(&tagName)
+		err := rows.Scan(&tagName)
 		if err == nil {
 			tags = append(tags, tagName)
 		}
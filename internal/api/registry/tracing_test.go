@@ -0,0 +1,129 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package registryv2_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestManifestPushIsTraced(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	for _, blob := range append(image.Layers, image.Config) {
+		blob.MustUpload(t, s, *s.Repos[0])
+	}
+
+	//only look at the spans from the manifest push
+	s.Spans.Reset()
+	image.MustUpload(t, s, *s.Repos[0], "latest")
+	spans := s.Spans.GetSpans()
+
+	var rootSpan *tracetest.SpanStub
+	spansByID := make(map[string]tracetest.SpanStub)
+	for idx, span := range spans {
+		spansByID[span.SpanContext.SpanID().String()] = span
+		if span.Name == "registry PUT /v2/{repository:.+}/manifests/{reference}" {
+			rootSpan = &spans[idx]
+		}
+	}
+	if rootSpan == nil {
+		t.Fatalf("no root span found for manifest push, got: %#v", spans)
+	}
+	assert.DeepEqual(t, "root span has parent", rootSpan.Parent.IsValid(), false)
+
+	//each layer of the request path shall appear in the same trace, and
+	//nested in the expected way
+	expectedParents := map[string]string{
+		"auth.Authorize":                     rootSpan.Name,
+		"processor.ValidateAndStoreManifest": rootSpan.Name,
+		"db.Transaction":                     "processor.ValidateAndStoreManifest",
+		"storage.WriteManifest":              "db.Transaction",
+	}
+	for name, parentName := range expectedParents {
+		found := false
+		for _, span := range spans {
+			if span.Name != name || spansByID[span.Parent.SpanID().String()].Name != parentName {
+				continue
+			}
+			found = true
+			assert.DeepEqual(t, "trace ID of span "+name, span.SpanContext.TraceID(), rootSpan.SpanContext.TraceID())
+			if span.Status.Code == codes.Error {
+				t.Errorf("expected span %q to succeed, but got error: %s", name, span.Status.Description)
+			}
+		}
+		if !found {
+			t.Errorf("no span %q with parent %q found for manifest push", name, parentName)
+		}
+	}
+}
+
+func TestIncomingTraceContextIsContinued(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, *s.Repos[0], "latest")
+
+	//when the client sends a trace context, the request span becomes part of
+	//the client's trace
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	s.Spans.Reset()
+	assert.HTTPRequest{
+		Method: "GET",
+		Path:   "/v2/test1/foo/manifests/latest",
+		Header: map[string]string{
+			"Authorization": "Bearer " + s.GetToken(t, "repository:test1/foo:pull"),
+			"Traceparent":   fmt.Sprintf("00-%s-%s-01", traceID, parentSpanID),
+		},
+		ExpectStatus: http.StatusOK,
+	}.Check(t, s.Handler)
+
+	var rootSpan *tracetest.SpanStub
+	spans := s.Spans.GetSpans()
+	for idx, span := range spans {
+		if span.Name == "registry GET /v2/{repository:.+}/manifests/{reference}" {
+			rootSpan = &spans[idx]
+		}
+	}
+	if rootSpan == nil {
+		t.Fatalf("no root span found for manifest pull, got: %#v", spans)
+	}
+	assert.DeepEqual(t, "trace ID", rootSpan.SpanContext.TraceID().String(), traceID)
+	assert.DeepEqual(t, "parent span ID", rootSpan.Parent.SpanID().String(), parentSpanID)
+	assert.DeepEqual(t, "parent is remote", rootSpan.Parent.IsRemote(), true)
+}
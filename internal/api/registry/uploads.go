@@ -86,13 +86,10 @@ func (a *API) handleStartBlobUpload(w http.ResponseWriter, r *http.Request) {
 	//This is not strictly necessary to enforce the manifest quota, but it's
 	//useful to avoid the accumulation of unreferenced blobs in the account's
 	//backing storage.
-	quotas, err := keppel.FindQuotas(a.db, account.AuthTenantID)
+	quotas, err := keppel.FindQuotasOrDefault(a.db, account.AuthTenantID)
 	if respondWithError(w, r, err) {
 		return
 	}
-	if quotas == nil {
-		quotas = keppel.DefaultQuotas(account.AuthTenantID)
-	}
 	manifestUsage, err := quotas.GetManifestUsage(a.db)
 	if respondWithError(w, r, err) {
 		return
@@ -152,7 +149,7 @@ func (a *API) performCrossRepositoryBlobMount(w http.ResponseWriter, r *http.Req
 		return
 	}
 	sourceRepoName := strings.TrimPrefix(sourceRepoFullName, account.Name+"/")
-	if !keppel.RepoNameWithLeadingSlashRx.MatchString("/" + sourceRepoName) {
+	if !keppel.IsRepoName(sourceRepoFullName) {
 		keppel.ErrNameInvalid.With("source repository is invalid").WriteAsRegistryV2ResponseTo(w, r)
 		return
 	}
@@ -211,7 +208,7 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		return false
 	}
 	sizeBytes, err := strconv.ParseUint(sizeBytesStr, 10, 64)
-	if sizeBytesStr == "" {
+	if err != nil {
 		//COVERAGE: unreachable in unit tests because net/http validates Content-Length header format before sending
 		keppel.ErrSizeInvalid.With("invalid Content-Length: "+err.Error()).WriteAsRegistryV2ResponseTo(w, r)
 		return false
@@ -224,7 +221,12 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		NumChunks: 0,
 	}
 	dw := digestWriter{Hash: sha256.New()}
-	err = a.processor().AppendToBlob(account, &upload, io.TeeReader(r.Body, &dw), &sizeBytes)
+	err = a.processor(r).AppendToBlob(account, &upload, io.TeeReader(r.Body, &dw), &sizeBytes)
+	if err == nil {
+		//validate digest and length before committing anything, so that broken
+		//uploads can be discarded without ever becoming a blob in the storage
+		err = dw.Validate(&sizeBytes, blobDigest)
+	}
 	if err == nil {
 		err = a.sd.FinalizeBlob(account, upload.StorageID, upload.NumChunks)
 	}
@@ -249,15 +251,9 @@ func (a *API) performMonolithicUpload(w http.ResponseWriter, r *http.Request, ac
 		}
 	}()
 
-	//validate digest and length
-	if dw.bytesWritten != sizeBytes {
-		keppel.ErrSizeInvalid.With("Content-Length was %d, but %d bytes were sent", sizeBytes, dw.bytesWritten).WriteAsRegistryV2ResponseTo(w, r)
-		return false
-	}
-
-	actualDigest := digest.NewDigest(digest.SHA256, dw.Hash)
-	if actualDigest != blobDigest {
-		keppel.ErrDigestInvalid.With("expected %s, but actual digest was %s", blobDigestStr, actualDigest.String()).WriteAsRegistryV2ResponseTo(w, r)
+	//if requested, check that the blob arrived in the storage intact
+	err = a.processor(r).VerifyWrittenBlob(account, upload.StorageID, blobDigest, upload.SizeBytes)
+	if respondWithError(w, r, err) {
 		return false
 	}
 
@@ -394,7 +390,7 @@ func (a *API) handleContinueBlobUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	//append request body to upload
-	digestState, err := a.streamIntoUpload(*account, upload, dw, r.Body, chunkSizeBytes)
+	digestState, err := a.streamIntoUpload(r, *account, upload, dw, r.Body, chunkSizeBytes)
 	if respondWithError(w, r, err) {
 		return
 	}
@@ -435,13 +431,30 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if contentLength > 0 {
-			_, err = a.streamIntoUpload(*account, upload, dw, r.Body, &contentLength)
+			_, err = a.streamIntoUpload(r, *account, upload, dw, r.Body, &contentLength)
 			if respondWithError(w, r, err) {
 				return
 			}
 		}
 	}
 
+	//validate the digest provided by the user before committing anything; if it
+	//does not match, the upload is unusable and can be discarded
+	blobDigest, err := parseUploadDigest(*upload, query.Get("digest"))
+	if err != nil {
+		countAbortedBlobUpload(*account)
+		err2 := a.sd.AbortBlobUpload(*account, upload.StorageID, upload.NumChunks)
+		if err2 != nil {
+			logg.Error("additional error encountered during AbortBlobUpload: " + err2.Error())
+		}
+		_, err2 = a.db.Delete(upload)
+		if err2 != nil {
+			logg.Error("additional error encountered while deleting Upload from DB: " + err2.Error())
+		}
+		respondWithError(w, r, err)
+		return
+	}
+
 	//convert the Upload into a Blob in both the storage backend and the DB
 	//
 	//NOTE 1: This is written a bit funny to avoid duplicating error handling
@@ -451,9 +464,12 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 	//storage that the DB does not know about, but the storage sweep can clean
 	//that up later.
 	var blob *keppel.Blob
-	err := a.sd.FinalizeBlob(*account, upload.StorageID, upload.NumChunks)
+	err = a.sd.FinalizeBlob(*account, upload.StorageID, upload.NumChunks)
+	if err == nil {
+		err = a.processor(r).VerifyWrittenBlob(*account, upload.StorageID, blobDigest, upload.SizeBytes)
+	}
 	if err == nil {
-		blob, err = a.createBlobFromUpload(*account, *repo, *upload, query.Get("digest"))
+		blob, err = a.createBlobFromUpload(*account, *repo, *upload, blobDigest)
 	}
 
 	//if an error occurred anywhere during this last sequence of steps, do our best to clean up the mess we left behind
@@ -474,6 +490,7 @@ func (a *API) handleFinishBlobUpload(w http.ResponseWriter, r *http.Request) {
 	l := prometheus.Labels{"account": account.Name, "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 	api.BlobsPushedCounter.With(l).Inc()
 	api.BlobBytesPushedCounter.With(l).Add(float64(blob.SizeBytes))
+	api.RepoPushesCounter.With(api.RepoLabels(a.cfg, *repo, "blob")).Inc()
 
 	w.Header().Set("Content-Length", "0")
 	w.Header().Set("Content-Range", makeRangeHeader(blob.SizeBytes))
@@ -596,7 +613,7 @@ func (a *API) parseContentRange(upload *keppel.Upload, hdr http.Header) (uint64,
 	return length, nil
 }
 
-func (a *API) streamIntoUpload(account keppel.Account, upload *keppel.Upload, dw *digestWriter, chunk io.Reader, chunkSizeBytes *uint64) (digestState string, returnErr error) {
+func (a *API) streamIntoUpload(r *http.Request, account keppel.Account, upload *keppel.Upload, dw *digestWriter, chunk io.Reader, chunkSizeBytes *uint64) (digestState string, returnErr error) {
 	//if anything happens during this operation, we likely have produced an
 	//inconsistent state between DB, storage backend and our internal book
 	//keeping (esp. the digestState in dw.Hash), so we will have to abort the
@@ -618,7 +635,7 @@ func (a *API) streamIntoUpload(account keppel.Account, upload *keppel.Upload, dw
 
 	//stream data from request body into storage
 	sizeBytesBefore := upload.SizeBytes
-	err := a.processor().AppendToBlob(account, upload, io.TeeReader(chunk, dw), chunkSizeBytes)
+	err := a.processor(r).AppendToBlob(account, upload, io.TeeReader(chunk, dw), chunkSizeBytes)
 	if err != nil {
 		return "", err
 	}
@@ -651,19 +668,23 @@ func (a *API) streamIntoUpload(account keppel.Account, upload *keppel.Upload, dw
 	return base64.URLEncoding.EncodeToString(digestStateBytes), nil
 }
 
-func (a *API) createBlobFromUpload(account keppel.Account, repo keppel.Repository, upload keppel.Upload, blobDigestStr string) (blob *keppel.Blob, returnErr error) {
-	//validate the digest provided by the user
+// Parses the digest provided by the user when finishing an upload, and checks
+// that it matches the uploaded content.
+func parseUploadDigest(upload keppel.Upload, blobDigestStr string) (digest.Digest, error) {
 	if blobDigestStr == "" {
-		return nil, keppel.ErrDigestInvalid.With("missing digest")
+		return "", keppel.ErrDigestInvalid.With("missing digest")
 	}
 	blobDigest, err := digest.Parse(blobDigestStr)
 	if err != nil {
-		return nil, keppel.ErrDigestInvalid.With(err.Error())
+		return "", keppel.ErrDigestInvalid.With(err.Error())
 	}
 	if blobDigest.String() != upload.Digest {
-		return nil, keppel.ErrDigestInvalid.With("")
+		return "", keppel.ErrDigestInvalid.With("expected %s, but actual digest was %s", blobDigest.String(), upload.Digest)
 	}
+	return blobDigest, nil
+}
 
+func (a *API) createBlobFromUpload(account keppel.Account, repo keppel.Repository, upload keppel.Upload, blobDigest digest.Digest) (blob *keppel.Blob, returnErr error) {
 	//prepare database changes
 	tx, err := a.db.Begin()
 	if err != nil {
@@ -742,6 +763,19 @@ func (w *digestWriter) Write(buf []byte) (n int, err error) {
 	return n, err
 }
 
+// Validate checks that the data written into this digestWriter matches the
+// expected length (if known) and digest.
+func (w *digestWriter) Validate(expectedSizeBytes *uint64, expectedDigest digest.Digest) error {
+	if expectedSizeBytes != nil && w.bytesWritten != *expectedSizeBytes {
+		return keppel.ErrSizeInvalid.With("Content-Length was %d, but %d bytes were sent", *expectedSizeBytes, w.bytesWritten)
+	}
+	actualDigest := digest.NewDigest(digest.SHA256, w.Hash)
+	if actualDigest != expectedDigest {
+		return keppel.ErrDigestInvalid.With("expected %s, but actual digest was %s", expectedDigest.String(), actualDigest.String())
+	}
+	return nil
+}
+
 func countAbortedBlobUpload(account keppel.Account) {
 	l := prometheus.Labels{"account": account.Name, "auth_tenant_id": account.AuthTenantID, "method": "registry-api"}
 	api.UploadsAbortedCounter.With(l).Inc()
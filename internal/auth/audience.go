@@ -20,7 +20,6 @@
 package auth
 
 import (
-	"crypto"
 	"fmt"
 	"strings"
 
@@ -108,7 +107,7 @@ func (a Audience) MapPeerHostname(peerHostname string) string {
 // service. Index [0] contains the key that shall be used for new tokens, but
 // all keys are acceptable in existing tokens (to support seamless key
 // rotation).
-func (a Audience) IssuerKeys(cfg keppel.Configuration) []crypto.PrivateKey {
+func (a Audience) IssuerKeys(cfg keppel.Configuration) []keppel.IssuerKey {
 	if a.IsAnycast {
 		return cfg.AnycastJWTIssuerKeys
 	}
@@ -40,14 +40,17 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 		filtered := *scope
 		switch scope.ResourceType {
 		case "registry":
-			filtered.Actions, err = filterRegistryActions(uid, audience, db, scope, &additional)
+			ip := httpext.GetRequesterIPFor(ir.HTTPRequest)
+			isTokenIssuance := ir.AudienceForTokenIssuance != nil
+			filtered.Actions, err = filterRegistryActions(ip, isTokenIssuance, uid, audience, db, scope, &additional)
 			if err != nil {
 				return nil, err
 			}
 
 		case "repository":
 			ip := httpext.GetRequesterIPFor(ir.HTTPRequest)
-			filtered.Actions, err = filterRepoActions(ip, *scope, uid, audience, db)
+			isTokenIssuance := ir.AudienceForTokenIssuance != nil
+			filtered.Actions, err = filterRepoActions(ip, isTokenIssuance, *scope, uid, audience, db)
 			if err != nil {
 				return nil, err
 			}
@@ -88,7 +91,7 @@ func filterAuthorized(ir IncomingRequest, uid keppel.UserIdentity, audience Audi
 	return append(result, additional...), nil
 }
 
-func addCatalogAccess(ss *ScopeSet, uid keppel.UserIdentity, audience Audience, db *keppel.DB) error {
+func addCatalogAccess(ss *ScopeSet, ip string, uid keppel.UserIdentity, audience Audience, db *keppel.DB) error {
 	var accounts []keppel.Account
 	if audience.AccountName == "" {
 		//on the standard API, all accounts are potentially accessible
@@ -107,20 +110,57 @@ func addCatalogAccess(ss *ScopeSet, uid keppel.UserIdentity, audience Audience,
 		}
 	}
 
+	isPublicAccount, err := findPublicAccounts(db, ip)
+	if err != nil {
+		return err
+	}
+
 	for _, account := range accounts {
-		if uid.HasPermission(keppel.CanViewAccount, account.AuthTenantID) {
+		switch {
+		case uid.HasPermission(keppel.CanViewAccount, account.AuthTenantID):
 			ss.Add(Scope{
 				ResourceType: "keppel_account",
 				ResourceName: account.Name,
 				Actions:      []string{"view"},
 			})
+		case isPublicAccount[account.Name]:
+			//do not grant "view" here: that would also give access to the account
+			//configuration etc. on the Keppel API
+			ss.Add(Scope{
+				ResourceType: "keppel_account",
+				ResourceName: account.Name,
+				Actions:      []string{"catalog"},
+			})
 		}
 	}
 
 	return nil
 }
 
-func filterRegistryActions(uid keppel.UserIdentity, audience Audience, db *keppel.DB, scope *Scope, additional *ScopeSet) ([]string, error) {
+// Returns the names of all accounts whose entire contents can be pulled
+// anonymously by a client with the given IP. Listing the repos in those
+// accounts does not reveal anything that the client could not also find out
+// by just pulling, so these accounts are shown in the catalog to everyone.
+func findPublicAccounts(db *keppel.DB, ip string) (map[string]bool, error) {
+	var policies []keppel.RBACPolicy
+	_, err := db.Select(&policies, "SELECT * FROM rbac_policies WHERE can_anon_pull AND match_repository = ''")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool)
+	for _, policy := range policies {
+		//policies with repository patterns were already excluded by the query,
+		//and anonymous pull policies never have user name patterns, so this only
+		//checks the CIDR restriction
+		if policy.Matches(ip, "", "") {
+			result[policy.AccountName] = true
+		}
+	}
+	return result, nil
+}
+
+func filterRegistryActions(ip string, isTokenIssuance bool, uid keppel.UserIdentity, audience Audience, db *keppel.DB, scope *Scope, additional *ScopeSet) ([]string, error) {
 	var filtered []string
 
 	if audience.IsAnycast {
@@ -129,21 +169,20 @@ func filterRegistryActions(uid keppel.UserIdentity, audience Audience, db *keppe
 		return nil, nil
 	}
 
-	if uid.UserType() == keppel.AnonymousUser {
-		//we don't allow catalog access to anonymous users:
-		//
-		//1. if we did, nobody would ever be presented with the auth challenge
-		//and thus all clients would assume that they get the same result
-		//without auth (which is very much not true)
+	if uid.UserType() == keppel.AnonymousUser && !isTokenIssuance {
+		//we don't allow catalog access to anonymous users that did not go
+		//through the token workflow: if we did, nobody would ever be presented
+		//with the auth challenge and thus all clients would assume that they get
+		//the same result without auth (which is very much not true)
 		//
-		//2. anon users do not get any keppel_account:*:view permissions, so it
-		//does not help them to get access to the catalog endpoint anyway
+		//anonymous users that explicitly ask for a token do get catalog access,
+		//but only see accounts that are public (see findPublicAccounts)
 		return nil, nil
 	}
 
 	if scope.Contains(CatalogEndpointScope) {
 		filtered = CatalogEndpointScope.Actions
-		err := addCatalogAccess(additional, uid, audience, db)
+		err := addCatalogAccess(additional, ip, uid, audience, db)
 		if err != nil {
 			return nil, err
 		}
@@ -152,7 +191,7 @@ func filterRegistryActions(uid keppel.UserIdentity, audience Audience, db *keppe
 	return filtered, nil
 }
 
-func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience Audience, db *keppel.DB) ([]string, error) {
+func filterRepoActions(ip string, isTokenIssuance bool, scope Scope, uid keppel.UserIdentity, audience Audience, db *keppel.DB) ([]string, error) {
 	repoScope := scope.ParseRepositoryScope(audience)
 	if repoScope.RepositoryName == "" {
 		//this happens when we are not on a domain-remapped API and thus expect a
@@ -173,6 +212,9 @@ func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience
 		"pull":   uid.HasPermission(keppel.CanPullFromAccount, account.AuthTenantID),
 		"push":   uid.HasPermission(keppel.CanPushToAccount, account.AuthTenantID),
 		"delete": uid.HasPermission(keppel.CanDeleteFromAccount, account.AuthTenantID),
+		//break-glass access to images that are blocked because of their
+		//vulnerability status; this is only given out when explicitly requested
+		"override_pull_block": uid.HasPermission(keppel.CanChangeAccount, account.AuthTenantID),
 	}
 
 	var policies []keppel.RBACPolicy
@@ -205,6 +247,13 @@ func filterRepoActions(ip string, scope Scope, uid keppel.UserIdentity, audience
 		}
 	}
 
+	if isTokenIssuance && account.DenyDeleteViaToken {
+		//the account wants deletions to only happen through the Keppel API with
+		//the auth driver's own authentication, never through tokens; this
+		//overrides all permissions and RBAC policies
+		isAllowedAction["delete"] = false
+	}
+
 	var result []string
 	for _, action := range scope.Actions {
 		if isAllowedAction[action] {
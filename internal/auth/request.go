@@ -60,6 +60,13 @@ type IncomingRequest struct {
 // Authorize checks if the given incoming request has a proper Authorization.
 // If an error is returned, the given `errHeaders` must be added to the HTTP response.
 func (ir IncomingRequest) Authorize(cfg keppel.Configuration, ad keppel.AuthDriver, db *keppel.DB) (*Authorization, *keppel.RegistryV2Error) {
+	_, span := cfg.Tracing().StartSpan(ir.HTTPRequest.Context(), "auth.Authorize")
+	authz, rerr := ir.authorize(cfg, ad, db)
+	span.End(safelyReturnRegistryError(rerr))
+	return authz, rerr
+}
+
+func (ir IncomingRequest) authorize(cfg keppel.Configuration, ad keppel.AuthDriver, db *keppel.DB) (*Authorization, *keppel.RegistryV2Error) {
 	r := ir.HTTPRequest
 
 	//find audience
@@ -113,6 +113,27 @@ func (s Scope) String() string {
 	}, ":")
 }
 
+// IsMeaningfulFor returns whether this scope refers to an API that can be
+// reached through the given audience. Scopes for which this returns false
+// will never be honored on that audience's APIs, so there is no point in
+// putting them into tokens for that audience.
+func (s Scope) IsMeaningfulFor(audience Audience) bool {
+	switch s.ResourceType {
+	case "repository":
+		//pulls are the only thing that can be done on the anycast API
+		return true
+	case "registry", "keppel_api", "keppel_account":
+		//the catalog endpoint, the Keppel API and the peer API are not anycastable
+		return !audience.IsAnycast
+	case "keppel_auth_tenant":
+		//this type of scope is only used by the Keppel API, which does not allow
+		//domain-remapping either
+		return !audience.IsAnycast && audience.AccountName == ""
+	default:
+		return false
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // predefined scopes
 
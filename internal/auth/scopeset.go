@@ -19,6 +19,11 @@
 
 package auth
 
+import (
+	"fmt"
+	"strings"
+)
+
 // ScopeSet is a set of scopes.
 type ScopeSet []*Scope
 
@@ -67,6 +72,19 @@ func mergeAndDedupActions(lhs, rhs []string) (result []string) {
 	return
 }
 
+// ConstrainedTo returns a copy of this ScopeSet that only contains those
+// scopes that are meaningful for the given audience (see
+// Scope.IsMeaningfulFor).
+func (ss ScopeSet) ConstrainedTo(audience Audience) ScopeSet {
+	var result ScopeSet
+	for _, s := range ss {
+		if s.IsMeaningfulFor(audience) {
+			result.Add(*s)
+		}
+	}
+	return result
+}
+
 // Flatten returns the scope set as a plain list of scopes.
 func (ss ScopeSet) Flatten() []Scope {
 	if len(ss) == 0 {
@@ -79,6 +97,25 @@ func (ss ScopeSet) Flatten() []Scope {
 	return result
 }
 
+// Describe returns a human-readable summary of this scope set for use in
+// audit logs and UIs, e.g. "pull+push on test1/foo, pull on test1/bar".
+func (ss ScopeSet) Describe() string {
+	if len(ss) == 0 {
+		return "no access"
+	}
+	parts := make([]string, len(ss))
+	for idx, s := range ss {
+		//repository scopes are the most common ones, so they get a more concise
+		//description than the others
+		resource := s.ResourceType + ":" + s.ResourceName
+		if s.ResourceType == "repository" {
+			resource = s.ResourceName
+		}
+		parts[idx] = fmt.Sprintf("%s on %s", strings.Join(s.Actions, "+"), resource)
+	}
+	return strings.Join(parts, ", ")
+}
+
 // AccountsWithCatalogAccess returns the names of all accounts whose contents
 // can be listed with the access level in this ScopeSet. If `markerAccountName`
 // is not empty, only accounts with `name > markerAccountName` will be returned.
@@ -87,7 +124,7 @@ func (ss ScopeSet) Flatten() []Scope {
 func (ss ScopeSet) AccountsWithCatalogAccess(markerAccountName string) []string {
 	var result []string
 	for _, scope := range ss {
-		accountName, ok := isKeppelAccountViewScope(*scope)
+		accountName, ok := isKeppelAccountCatalogScope(*scope)
 		if !ok {
 			continue
 		}
@@ -99,12 +136,15 @@ func (ss ScopeSet) AccountsWithCatalogAccess(markerAccountName string) []string
 	return result
 }
 
-func isKeppelAccountViewScope(s Scope) (string, bool) {
+// Users who can view an account can also list its repos. Public accounts are
+// listed to everyone, but only with the "catalog" action, which grants no
+// further access (in particular not to the Keppel API).
+func isKeppelAccountCatalogScope(s Scope) (string, bool) {
 	if s.ResourceType != "keppel_account" {
 		return "", false
 	}
 	for _, action := range s.Actions {
-		if action == "view" {
+		if action == "view" || action == "catalog" {
 			return s.ResourceName, true
 		}
 	}
@@ -0,0 +1,64 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestScopeSetDescribe(t *testing.T) {
+	repoScope := func(name string, actions ...string) Scope {
+		return Scope{ResourceType: "repository", ResourceName: name, Actions: actions}
+	}
+
+	testCases := []struct {
+		ScopeSet ScopeSet
+		Expected string
+	}{
+		{nil, "no access"},
+		{NewScopeSet(repoScope("test1/foo", "pull")), "pull on test1/foo"},
+		{
+			NewScopeSet(repoScope("test1/foo", "pull", "push"), repoScope("test1/bar", "pull")),
+			"pull+push on test1/foo, pull on test1/bar",
+		},
+		//scopes for the same resource are merged by NewScopeSet
+		{
+			NewScopeSet(repoScope("test1/foo", "pull"), repoScope("test1/foo", "push", "delete"), repoScope("test2/foo", "pull")),
+			"pull+push+delete on test1/foo, pull on test2/foo",
+		},
+		//scopes without actions are not included by NewScopeSet
+		{NewScopeSet(repoScope("test1/foo")), "no access"},
+		//non-repository scopes are described with their resource type
+		{
+			NewScopeSet(
+				CatalogEndpointScope,
+				Scope{ResourceType: "keppel_account", ResourceName: "test1", Actions: []string{"view", "change"}},
+				InfoAPIScope,
+			),
+			"* on registry:catalog, view+change on keppel_account:test1, access on keppel_api:info",
+		},
+	}
+
+	for _, tc := range testCases {
+		assert.DeepEqual(t, "ScopeSet.Describe()", tc.ScopeSet.Describe(), tc.Expected)
+	}
+}
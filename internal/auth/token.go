@@ -22,6 +22,7 @@ package auth
 import (
 	"crypto"
 	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/hex"
 	"encoding/json"
@@ -48,6 +49,11 @@ type tokenClaims struct {
 }
 
 func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audience, tokenStr string) (*Authorization, *keppel.RegistryV2Error) {
+	authz, _, rerr := parseTokenWithClaims(cfg, ad, audience, tokenStr)
+	return authz, rerr
+}
+
+func parseTokenWithClaims(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audience, tokenStr string) (*Authorization, *tokenClaims, *keppel.RegistryV2Error) {
 	//this function is used by jwt.ParseWithClaims() to select which public key to use for validation
 	keyFunc := func(t *jwt.Token) (interface{}, error) {
 		//check the token header to see which key we used for signing
@@ -55,13 +61,13 @@ func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audienc
 		for _, ourIssuerKey := range ourIssuerKeys {
 			if t.Header["jwk"] == serializePublicKey(ourIssuerKey) {
 				//check that the signing method matches what we generate
-				ourSigningMethod := chooseSigningMethod(ourIssuerKey)
+				ourSigningMethod := chooseSigningMethod(ourIssuerKey.Public())
 				if !equalSigningMethods(ourSigningMethod, t.Method) {
 					return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
 				}
 
 				//jwt.Parse needs the public key to validate the token
-				return derivePublicKey(ourIssuerKey), nil
+				return ourIssuerKey.Public(), nil
 			}
 		}
 
@@ -85,23 +91,69 @@ func parseToken(cfg keppel.Configuration, ad keppel.AuthDriver, audience Audienc
 	claims.Embedded.AuthDriver = ad
 	token, err := jwt.ParseWithClaims(tokenStr, &claims, keyFunc, parserOpts...)
 	if err != nil {
-		return nil, keppel.ErrUnauthorized.With(err.Error())
+		return nil, nil, keppel.ErrUnauthorized.With(err.Error())
 	}
 	if !token.Valid {
 		//NOTE: This branch is defense in depth. As of the time of this writing,
 		//token.Valid == false if and only if err != nil.
-		return nil, keppel.ErrUnauthorized.With("token invalid")
+		return nil, nil, keppel.ErrUnauthorized.With("token invalid")
 	}
 
 	var ss ScopeSet
 	for _, scope := range claims.Access {
-		ss.Add(scope)
+		if scope.IsMeaningfulFor(audience) {
+			ss.Add(scope)
+		}
 	}
 	return &Authorization{
 		UserIdentity: claims.Embedded.UserIdentity,
 		ScopeSet:     ss,
 		Audience:     audience,
-	}, nil
+	}, &claims, nil
+}
+
+// TokenIntrospection contains the result of IntrospectToken().
+type TokenIntrospection struct {
+	Authorization *Authorization
+	Subject       string
+	Issuer        string
+	ExpiresAt     time.Time
+	IssuedAt      time.Time
+}
+
+// IntrospectToken validates a token that was issued by this Keppel (or, for
+// anycast tokens, by one of its peers) in the same way as if it had been
+// presented as a Bearer token on the token's own audience. This is used by the
+// token introspection endpoint, so the audience is taken from the token itself.
+func IntrospectToken(cfg keppel.Configuration, ad keppel.AuthDriver, tokenStr string) (*TokenIntrospection, *keppel.RegistryV2Error) {
+	//find the audience without verifying the token (verification happens in
+	//parseTokenWithClaims() below, which also checks that the audience matches)
+	var unverifiedClaims jwt.RegisteredClaims
+	_, _, err := jwt.NewParser().ParseUnverified(tokenStr, &unverifiedClaims)
+	if err != nil {
+		return nil, keppel.ErrUnauthorized.With(err.Error())
+	}
+	if len(unverifiedClaims.Audience) != 1 {
+		return nil, keppel.ErrUnauthorized.With("token must have exactly one audience")
+	}
+	audience := IdentifyAudience(unverifiedClaims.Audience[0], cfg)
+
+	authz, claims, rerr := parseTokenWithClaims(cfg, ad, audience, tokenStr)
+	if rerr != nil {
+		return nil, rerr
+	}
+	result := &TokenIntrospection{
+		Authorization: authz,
+		Subject:       claims.Subject,
+		Issuer:        claims.Issuer,
+	}
+	if claims.ExpiresAt != nil {
+		result.ExpiresAt = claims.ExpiresAt.Time
+	}
+	if claims.IssuedAt != nil {
+		result.IssuedAt = claims.IssuedAt.Time
+	}
+	return result, nil
 }
 
 // TokenResponse is the format expected by Docker in an auth response. The Token
@@ -124,7 +176,7 @@ func (a Authorization) IssueToken(cfg keppel.Configuration) (*TokenResponse, err
 		return nil, errors.New("no issuer keys configured for this audience")
 	}
 	issuerKey := issuerKeys[0]
-	method := chooseSigningMethod(issuerKey)
+	method := chooseSigningMethod(issuerKey.Public())
 
 	//fill the "issuer" field with a dummy audience that has anycast forced to
 	//false to reveal the identity of the Keppel API that issued the token
@@ -135,18 +187,19 @@ func (a Authorization) IssueToken(cfg keppel.Configuration) (*TokenResponse, err
 		return nil, err
 	}
 	publicHost := a.Audience.Hostname(cfg)
-	token := jwt.NewWithClaims(method, tokenClaims{
+	token := jwt.NewWithClaims(signerSigningMethod{method}, tokenClaims{
 		RegisteredClaims: jwt.RegisteredClaims{
 			ID:        uuidV4.String(),
 			Audience:  jwt.ClaimStrings{publicHost},
 			Issuer:    "keppel-api@" + issuer.Hostname(cfg),
-			Subject:   a.UserIdentity.UserName(),
+			Subject:   cfg.TokenSubjectSource.SubjectOf(a.UserIdentity),
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			NotBefore: jwt.NewNumericDate(now),
 			IssuedAt:  jwt.NewNumericDate(now),
 		},
-		//access permissions granted to this token
-		Access:   a.ScopeSet.Flatten(),
+		//access permissions granted to this token (scopes that cannot be used on
+		//the token's audience are dropped to avoid bloating the token)
+		Access:   a.ScopeSet.ConstrainedTo(a.Audience).Flatten(),
 		Embedded: embeddedUserIdentity{UserIdentity: a.UserIdentity},
 	})
 	//we need to remember which key we used for this token, to choose the right
@@ -161,38 +214,57 @@ func (a Authorization) IssueToken(cfg keppel.Configuration) (*TokenResponse, err
 	}, err
 }
 
-func chooseSigningMethod(key crypto.PrivateKey) jwt.SigningMethod {
-	switch key.(type) {
-	case ed25519.PrivateKey:
+func chooseSigningMethod(pubkey crypto.PublicKey) jwt.SigningMethod {
+	switch pubkey.(type) {
+	case ed25519.PublicKey:
 		return jwt.SigningMethodEdDSA
-	case *rsa.PrivateKey:
+	case *rsa.PublicKey:
 		return jwt.SigningMethodRS256
 	default:
-		panic(fmt.Sprintf("do not know which JWT method to use for issuerKey.type = %T", key))
+		panic(fmt.Sprintf("do not know which JWT method to use for issuerKey.Public().type = %T", pubkey))
 	}
 }
 
-func derivePublicKey(key crypto.PrivateKey) crypto.PublicKey {
-	switch key := key.(type) {
-	case ed25519.PrivateKey:
-		return key.Public()
-	case *rsa.PrivateKey:
-		return key.Public()
+func serializePublicKey(key keppel.IssuerKey) string {
+	switch pubkey := key.Public().(type) {
+	case ed25519.PublicKey:
+		return hex.EncodeToString([]byte(pubkey))
+	case *rsa.PublicKey:
+		return fmt.Sprintf("%x:%s", pubkey.E, pubkey.N.Text(16))
 	default:
-		panic(fmt.Sprintf("do not know which JWT method to use for issuerKey.type = %T", key))
+		panic(fmt.Sprintf("do not know how to serialize issuerKey.Public().type = %T", pubkey))
 	}
 }
 
-func serializePublicKey(key crypto.PrivateKey) string {
-	switch key := key.(type) {
-	case ed25519.PrivateKey:
-		pubkey := key.Public().(ed25519.PublicKey) //nolint:errcheck
-		return hex.EncodeToString([]byte(pubkey))
-	case *rsa.PrivateKey:
-		pubkey := key.Public().(*rsa.PublicKey) //nolint:errcheck
-		return fmt.Sprintf("%x:%s", pubkey.E, pubkey.N.Text(16))
+// signerSigningMethod wraps one of the signing methods returned by
+// chooseSigningMethod(). Verification is delegated to the wrapped method, but
+// signing goes through the crypto.Signer interface of the issuer key, because
+// jwt.SigningMethodRSA insists on getting an *rsa.PrivateKey, which is not
+// available when the key is held by a KMS or HSM.
+type signerSigningMethod struct {
+	jwt.SigningMethod
+}
+
+// Sign implements the jwt.SigningMethod interface.
+func (m signerSigningMethod) Sign(signingString string, key interface{}) ([]byte, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("cannot sign with key of type %T", key)
+	}
+
+	switch method := m.SigningMethod.(type) {
+	case *jwt.SigningMethodEd25519:
+		//ed25519 signs the whole message, as indicated by crypto.Hash(0)
+		return signer.Sign(rand.Reader, []byte(signingString), crypto.Hash(0))
+	case *jwt.SigningMethodRSA:
+		if !method.Hash.Available() {
+			return nil, jwt.ErrHashUnavailable
+		}
+		hasher := method.Hash.New()
+		hasher.Write([]byte(signingString))
+		return signer.Sign(rand.Reader, hasher.Sum(nil), method.Hash)
 	default:
-		panic(fmt.Sprintf("do not know which JWT method to use for issuerKey.type = %T", key))
+		return nil, fmt.Errorf("do not know how to sign with signing method of type %T", m.SigningMethod)
 	}
 }
 
@@ -0,0 +1,225 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sapcc/go-bits/assert"
+	"github.com/sapcc/go-bits/audittools"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// mockSigner is a keppel.IssuerKey that does not expose its private key, like
+// a key held by a KMS or HSM would.
+type mockSigner struct {
+	inner     crypto.Signer
+	callCount int
+}
+
+func (s *mockSigner) Public() crypto.PublicKey {
+	return s.inner.Public()
+}
+
+func (s *mockSigner) Sign(r io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.callCount++
+	return s.inner.Sign(r, digest, opts)
+}
+
+func TestIssueTokenWithOpaqueSigner(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Key    crypto.Signer
+		Method jwt.SigningMethod
+	}{
+		{ed25519Key, jwt.SigningMethodEdDSA},
+		{rsaKey, jwt.SigningMethodRS256},
+	}
+
+	for _, tc := range testCases {
+		signer := &mockSigner{inner: tc.Key}
+		cfg := keppel.Configuration{
+			APIPublicHostname: "registry.example.org",
+			JWTIssuerKeys:     []keppel.IssuerKey{signer},
+		}
+		a := Authorization{
+			UserIdentity: AnonymousUserIdentity,
+			ScopeSet:     NewScopeSet(InfoAPIScope),
+		}
+
+		tokenResp, err := a.IssueToken(cfg)
+		if err != nil {
+			t.Fatalf("could not issue token with %T: %s", tc.Key, err.Error())
+		}
+		assert.DeepEqual(t, "signer call count", signer.callCount, 1)
+
+		//the token must be verifiable with the public key of the signer alone
+		token, err := jwt.Parse(tokenResp.Token,
+			func(t *jwt.Token) (interface{}, error) { return tc.Key.Public(), nil },
+			jwt.WithValidMethods([]string{tc.Method.Alg()}),
+			jwt.WithAudience("registry.example.org"),
+			jwt.WithIssuer("keppel-api@registry.example.org"),
+		)
+		if err != nil {
+			t.Fatalf("could not verify token signed with %T: %s", tc.Key, err.Error())
+		}
+		assert.DeepEqual(t, "token validity", token.Valid, true)
+		assert.DeepEqual(t, "token key ID", token.Header["jwk"], serializePublicKey(signer))
+	}
+}
+
+func TestIssueAnycastTokenDropsLocalOnlyScopes(t *testing.T) {
+	_, localKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, anycastKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cfg := keppel.Configuration{
+		APIPublicHostname:        "registry.example.org",
+		AnycastAPIPublicHostname: "registry-global.example.org",
+		JWTIssuerKeys:            []keppel.IssuerKey{localKey},
+		AnycastJWTIssuerKeys:     []keppel.IssuerKey{anycastKey},
+	}
+
+	repoScope := Scope{ResourceType: "repository", ResourceName: "test1/foo", Actions: []string{"pull"}}
+	ss := NewScopeSet(
+		repoScope,
+		CatalogEndpointScope,
+		InfoAPIScope,
+		PeerAPIScope,
+		Scope{ResourceType: "keppel_account", ResourceName: "test1", Actions: []string{"view"}},
+		Scope{ResourceType: "keppel_auth_tenant", ResourceName: "tenant1", Actions: []string{"view"}},
+	)
+
+	testCases := []struct {
+		Audience       Audience
+		Key            crypto.Signer
+		ExpectedAccess []Scope
+	}{
+		{Audience{IsAnycast: false}, localKey, ss.Flatten()},
+		{Audience{IsAnycast: true}, anycastKey, []Scope{repoScope}},
+	}
+
+	for _, tc := range testCases {
+		a := Authorization{
+			UserIdentity: AnonymousUserIdentity,
+			ScopeSet:     ss,
+			Audience:     tc.Audience,
+		}
+		tokenResp, err := a.IssueToken(cfg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		//only decode the access list, since the embedded user identity can only be
+		//decoded with an AuthDriver
+		var claims struct {
+			jwt.RegisteredClaims
+			Access []Scope `json:"access"`
+		}
+		_, err = jwt.ParseWithClaims(tokenResp.Token, &claims,
+			func(t *jwt.Token) (interface{}, error) { return tc.Key.Public(), nil },
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		desc := fmt.Sprintf("scopes in token for audience %#v", tc.Audience)
+		assert.DeepEqual(t, desc, claims.Access, tc.ExpectedAccess)
+	}
+}
+
+// mockUserIdentity is a keppel.UserIdentity that knows all the
+// attributes that can be selected by keppel.TokenSubjectSource.
+type mockUserIdentity struct {
+	keppel.UserIdentity
+}
+
+func (mockUserIdentity) UserName() string              { return "johndoe@example-domain" }
+func (mockUserIdentity) UserInfo() audittools.UserInfo { return mockUserInfo{} }
+
+type mockUserInfo struct {
+	audittools.UserInfo
+}
+
+func (mockUserInfo) UserUUID() string { return "uuid-for-johndoe" }
+
+func TestTokenSubjectSource(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Source          keppel.TokenSubjectSource
+		UserIdentity    keppel.UserIdentity
+		ExpectedSubject string
+	}{
+		{"", mockUserIdentity{AnonymousUserIdentity}, "johndoe@example-domain"},
+		{keppel.TokenSubjectFromUserName, mockUserIdentity{AnonymousUserIdentity}, "johndoe@example-domain"},
+		{keppel.TokenSubjectFromUserID, mockUserIdentity{AnonymousUserIdentity}, "uuid-for-johndoe"},
+		//when the selected attribute is not known, the username is used instead
+		{keppel.TokenSubjectFromUserID, AnonymousUserIdentity, ""},
+	}
+
+	for _, tc := range testCases {
+		cfg := keppel.Configuration{
+			APIPublicHostname:  "registry.example.org",
+			JWTIssuerKeys:      []keppel.IssuerKey{key},
+			TokenSubjectSource: tc.Source,
+		}
+		a := Authorization{
+			UserIdentity: tc.UserIdentity,
+			ScopeSet:     NewScopeSet(InfoAPIScope),
+		}
+		tokenResp, err := a.IssueToken(cfg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var claims jwt.RegisteredClaims
+		_, err = jwt.ParseWithClaims(tokenResp.Token, &claims,
+			func(t *jwt.Token) (interface{}, error) { return key.Public(), nil },
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		desc := fmt.Sprintf("sub claim for TokenSubjectSource %q and %T", tc.Source, tc.UserIdentity)
+		assert.DeepEqual(t, desc, claims.Subject, tc.ExpectedSubject)
+	}
+}
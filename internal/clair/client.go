@@ -20,6 +20,7 @@
 package clair
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,6 +30,7 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 // Client is a client for accessing the Clair vulnerability scanning service.
@@ -40,6 +42,9 @@ type Client struct {
 	//isEmptyManifest tracks when we did not submit a manifest because it does
 	//not contain any actual layers.
 	isEmptyManifest map[string]bool
+	//StartSpan, if not nil, is called to start a tracing span for each request
+	//to Clair. The returned callback ends the span with the request's result.
+	StartSpan func(ctx context.Context, name string) (context.Context, func(error))
 }
 
 func (c *Client) requestURL(pathElements ...string) string {
@@ -49,6 +54,19 @@ func (c *Client) requestURL(pathElements ...string) string {
 }
 
 func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
+	_, err := c.doRequestReturningHeaders(req, respBody)
+	return err
+}
+
+func (c *Client) doRequestReturningHeaders(req *http.Request, respBody interface{}) (respHeaders http.Header, returnErr error) {
+	if c.StartSpan != nil {
+		ctx, endSpan := c.StartSpan(req.Context(), "clair.Request")
+		req = req.WithContext(ctx)
+		defer func() { endSpan(returnErr) }()
+	}
+	//if we are tracing, allow Clair to continue our trace
+	propagation.TraceContext{}.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
 	//add auth token to request
 	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
@@ -60,7 +78,7 @@ func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
 	})
 	tokenStr, err := token.SignedString(c.PresharedKey)
 	if err != nil {
-		return fmt.Errorf("cannot issue token for %s %s: %w", req.Method, req.URL.String(), err)
+		return nil, fmt.Errorf("cannot issue token for %s %s: %w", req.Method, req.URL.String(), err)
 	}
 	req.Header.Set("Authorization", "Bearer "+tokenStr)
 
@@ -73,7 +91,7 @@ func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
 	//run request
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("cannot %s %s: %w", req.Method, req.URL.String(), err)
+		return nil, fmt.Errorf("cannot %s %s: %w", req.Method, req.URL.String(), err)
 	}
 	respBodyBytes, err := io.ReadAll(resp.Body)
 	if err == nil {
@@ -82,23 +100,23 @@ func (c *Client) doRequest(req *http.Request, respBody interface{}) error {
 		resp.Body.Close()
 	}
 	if err != nil {
-		return fmt.Errorf("cannot %s %s: %w", req.Method, req.URL.String(), err)
+		return nil, fmt.Errorf("cannot %s %s: %w", req.Method, req.URL.String(), err)
 	}
 
 	//expect 2xx response
 	if resp.StatusCode >= 299 {
-		return fmt.Errorf("cannot %s %s: got %d response: %q", req.Method, req.URL.String(), resp.StatusCode, string(respBodyBytes))
+		return nil, fmt.Errorf("cannot %s %s: got %d response: %q", req.Method, req.URL.String(), resp.StatusCode, string(respBodyBytes))
 	}
 
 	if resp.StatusCode == http.StatusNoContent {
-		return nil
+		return resp.Header, nil
 	}
 
 	err = json.Unmarshal(respBodyBytes, &respBody)
 	if err != nil {
-		return fmt.Errorf("cannot %s %s: cannot decode response body: %w", req.Method, req.URL.String(), err)
+		return nil, fmt.Errorf("cannot %s %s: cannot decode response body: %w", req.Method, req.URL.String(), err)
 	}
-	return nil
+	return resp.Header, nil
 }
 
 // SendRequest sends an arbitrary request without request body or special
@@ -0,0 +1,50 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package clair
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// GetMatcherVersion returns an opaque string that identifies the state of
+// Clair's vulnerability database. This string changes whenever Clair's
+// updaters have fetched new vulnerability data, at which point previously
+// retrieved vulnerability reports may be outdated. An empty string is returned
+// if Clair does not report a version.
+func (c *Client) GetMatcherVersion(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodGet,
+		c.requestURL("matcher", "api", "v1", "internal", "update_operation")+"?latest=true",
+		http.NoBody,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	//we are only interested in the ETag, which identifies the latest update operation
+	var updateOperations json.RawMessage
+	respHeaders, err := c.doRequestReturningHeaders(req, &updateOperations)
+	if err != nil {
+		return "", err
+	}
+	return respHeaders.Get("Etag"), nil
+}
@@ -19,6 +19,11 @@
 
 package clair
 
+import (
+	"fmt"
+	"strings"
+)
+
 // VulnerabilityStatus enumerates the possible values for a manifest's vulnerability status.
 type VulnerabilityStatus string
 
@@ -61,10 +66,43 @@ var sevMap = map[VulnerabilityStatus]uint{
 	Defcon1Severity:                8,
 }
 
+// Level returns a numeric representation of the severity indicated by this
+// VulnerabilityStatus. Higher levels indicate more severe vulnerabilities,
+// starting at 1 for CleanSeverity (followed by UnknownSeverity, then
+// NegligibleSeverity and so on). Statuses that do not indicate a severity
+// (Error, Pending and Unsupported) as well as unknown strings have level 0.
+//
+// These values are stable and may be used for comparisons, but should not be
+// persisted.
+func (s VulnerabilityStatus) Level() uint {
+	return sevMap[s]
+}
+
+// ParseSeverity parses a VulnerabilityStatus that indicates a severity (i.e.
+// anything from CleanSeverity up to Defcon1Severity) from its string
+// representation. Matching is case-insensitive, so that operators can write
+// "high" instead of "High" in configuration values. The returned value is
+// always in the canonical spelling.
+func ParseSeverity(input string) (VulnerabilityStatus, error) {
+	for s := range sevMap {
+		if s.HasReport() && strings.EqualFold(string(s), input) {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("unknown vulnerability severity: %q", input)
+}
+
 // HasReport checks whether a manifest with this VulnerabilityStatus has a
 // vulnerability report available.
 func (s VulnerabilityStatus) HasReport() bool {
-	return sevMap[s] > 0
+	return s.Level() > 0
+}
+
+// IsWorseThan checks whether this VulnerabilityStatus indicates a higher
+// severity than the other one. Statuses without a vulnerability report (i.e.
+// Error, Pending and Unsupported) are never worse or better than anything.
+func (s VulnerabilityStatus) IsWorseThan(other VulnerabilityStatus) bool {
+	return s.HasReport() && other.HasReport() && s.Level() > other.Level()
 }
 
 // MergeVulnerabilityStatuses combines multiple VulnerabilityStatus values into one.
@@ -77,9 +115,9 @@ func MergeVulnerabilityStatuses(sevs ...VulnerabilityStatus) VulnerabilityStatus
 	hasSpecialSeverity := make(map[VulnerabilityStatus]bool)
 	result := CleanSeverity
 	for _, s := range sevs {
-		if sevMap[s] == 0 {
+		if !s.HasReport() {
 			hasSpecialSeverity[s] = true
-		} else if sevMap[s] > sevMap[result] {
+		} else if s.IsWorseThan(result) {
 			result = s
 		}
 	}
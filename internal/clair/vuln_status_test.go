@@ -49,3 +49,91 @@ func TestMergeVulnerabilityStatuses(t *testing.T) {
 	expect(LowSeverity, MergeVulnerabilityStatuses(LowSeverity, LowSeverity))
 	expect(HighSeverity, MergeVulnerabilityStatuses(LowSeverity, HighSeverity))
 }
+
+func TestVulnerabilityStatusIsWorseThan(t *testing.T) {
+	expect := func(s, other VulnerabilityStatus, expected bool) {
+		t.Helper()
+		if s.IsWorseThan(other) != expected {
+			t.Errorf("expected %s.IsWorseThan(%s) = %t, but got %t", s, other, expected, !expected)
+		}
+	}
+	expect(HighSeverity, CleanSeverity, true)
+	expect(CriticalSeverity, LowSeverity, true)
+	expect(UnknownSeverity, CleanSeverity, true)
+	expect(CleanSeverity, HighSeverity, false)
+	expect(HighSeverity, HighSeverity, false)
+
+	//special statuses are not comparable
+	expect(HighSeverity, PendingVulnerabilityStatus, false)
+	expect(HighSeverity, ErrorVulnerabilityStatus, false)
+	expect(HighSeverity, UnsupportedVulnerabilityStatus, false)
+	expect(ErrorVulnerabilityStatus, CleanSeverity, false)
+}
+
+func TestVulnerabilityStatusOrdering(t *testing.T) {
+	//this is the full ordering of severities, from least to most severe
+	ordered := []VulnerabilityStatus{
+		CleanSeverity,
+		UnknownSeverity,
+		NegligibleSeverity,
+		LowSeverity,
+		MediumSeverity,
+		HighSeverity,
+		CriticalSeverity,
+		Defcon1Severity,
+	}
+	for idx, s := range ordered {
+		if s.Level() != uint(idx+1) {
+			t.Errorf("expected %s to have level %d, but got %d", s, idx+1, s.Level())
+		}
+		for otherIdx, other := range ordered {
+			if s.IsWorseThan(other) != (idx > otherIdx) {
+				t.Errorf("expected %s.IsWorseThan(%s) = %t", s, other, idx > otherIdx)
+			}
+		}
+	}
+
+	//statuses without a severity are not part of the ordering
+	for _, s := range []VulnerabilityStatus{ErrorVulnerabilityStatus, PendingVulnerabilityStatus, UnsupportedVulnerabilityStatus, "Bogus"} {
+		if s.Level() != 0 {
+			t.Errorf("expected %s to have level 0, but got %d", s, s.Level())
+		}
+		for _, other := range ordered {
+			if s.IsWorseThan(other) || other.IsWorseThan(s) {
+				t.Errorf("expected %s and %s to be incomparable", s, other)
+			}
+		}
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	testCases := map[string]VulnerabilityStatus{
+		"Clean":      CleanSeverity,
+		"Unknown":    UnknownSeverity,
+		"Negligible": NegligibleSeverity,
+		"Low":        LowSeverity,
+		"Medium":     MediumSeverity,
+		"High":       HighSeverity,
+		"Critical":   CriticalSeverity,
+		"Defcon1":    Defcon1Severity,
+		"high":       HighSeverity,
+		"CRITICAL":   CriticalSeverity,
+		"dEfCoN1":    Defcon1Severity,
+	}
+	for input, expected := range testCases {
+		actual, err := ParseSeverity(input)
+		if err != nil {
+			t.Errorf("unexpected error while parsing %q: %s", input, err.Error())
+		} else if actual != expected {
+			t.Errorf("expected %q to parse into %s, but got %s", input, expected, actual)
+		}
+	}
+
+	//statuses without a severity and unknown strings are rejected
+	for _, input := range []string{"", "Pending", "Error", "Unsupported", "Severe"} {
+		_, err := ParseSeverity(input)
+		if err == nil {
+			t.Errorf("expected error while parsing %q, but got none", input)
+		}
+	}
+}
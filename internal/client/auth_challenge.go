@@ -19,6 +19,7 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -90,9 +91,17 @@ func ParseAuthChallenge(hdr http.Header) (AuthChallenge, error) {
 	return c, nil
 }
 
-// GetToken obtains a token that satisfies this challenge.
-func (c AuthChallenge) GetToken(userName, password string) (string, error) {
-	req, err := http.NewRequest(http.MethodGet, c.Realm, http.NoBody)
+// Returns whether the response headers of an unauthenticated request to a
+// registry API contain a challenge for the "Basic" auth scheme.
+func isBasicAuthChallenge(hdr http.Header) bool {
+	input := strings.TrimSpace(hdr.Get("Www-Authenticate"))
+	return strings.HasPrefix(strings.ToLower(input), "basic")
+}
+
+// GetToken obtains a token that satisfies this challenge. The token request
+// is sent through the given HTTP client.
+func (c AuthChallenge) GetToken(ctx context.Context, httpClient *http.Client, userName, password string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Realm, http.NoBody)
 	if err != nil {
 		return "", err
 	}
@@ -104,7 +113,7 @@ func (c AuthChallenge) GetToken(userName, password string) (string, error) {
 	q.Set("scope", c.Scope)
 	req.URL.RawQuery = q.Encode()
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -19,10 +19,14 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/docker/distribution"
 	"github.com/opencontainers/go-digest"
@@ -30,29 +34,113 @@ import (
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
+// DownloadBlobOpts appears in func DownloadBlob.
+type DownloadBlobOpts struct {
+	//If non-zero, the download fails with keppel.ErrUnavailable when upstream
+	//does not send any data for this long. Since blobs can be very large, this
+	//does not limit the total duration of the download, only how long it may
+	//stall.
+	Timeout time.Duration
+}
+
 // DownloadBlob fetches a blob's contents from this repository. If an error is
 // returned, it's usually a *keppel.RegistryV2Error.
-func (c *RepoClient) DownloadBlob(blobDigest digest.Digest) (contents io.ReadCloser, sizeBytes uint64, returnErr error) {
+func (c *RepoClient) DownloadBlob(blobDigest digest.Digest, opts *DownloadBlobOpts) (contents io.ReadCloser, sizeBytes uint64, returnErr error) {
+	if opts == nil {
+		opts = &DownloadBlobOpts{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &blobDownload{
+		timeout: opts.Timeout,
+		cancel:  cancel,
+		describeTimeout: func() error {
+			return keppel.ErrUnavailable.With(
+				"upstream registry %s did not send any data for blob %s of repository %s within %s",
+				c.Host, blobDigest, c.RepoName, opts.Timeout,
+			)
+		},
+	}
+	if d.timeout > 0 {
+		d.timer = time.AfterFunc(d.timeout, func() {
+			d.timedOut.Store(true)
+			cancel()
+		})
+	}
+
 	resp, err := c.doRequest(repoRequest{
+		Context:      ctx,
 		Method:       "GET",
 		Path:         "blobs/" + blobDigest.String(),
 		ExpectStatus: http.StatusOK,
 	})
 	if err != nil {
-		return nil, 0, err
+		d.stop()
+		return nil, 0, d.translateError(err)
 	}
 	sizeBytes, err = strconv.ParseUint(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
+		d.stop()
 		resp.Body.Close()
 		return nil, 0, err
 	}
-	return resp.Body, sizeBytes, nil
+	d.body = resp.Body
+	return d, sizeBytes, nil
+}
+
+// The io.ReadCloser returned by DownloadBlob(). If a timeout is set, the
+// download is canceled once upstream stalls for longer than the timeout.
+type blobDownload struct {
+	body            io.ReadCloser
+	timeout         time.Duration
+	timer           *time.Timer //nil if there is no timeout
+	timedOut        atomic.Bool
+	cancel          context.CancelFunc
+	describeTimeout func() error
+}
+
+// Read implements the io.Reader interface.
+func (d *blobDownload) Read(buf []byte) (int, error) {
+	n, err := d.body.Read(buf)
+	if n > 0 && d.timer != nil {
+		//upstream is still delivering, so give it another full timeout period
+		d.timer.Reset(d.timeout)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = d.translateError(err)
+	}
+	return n, err
+}
+
+// Close implements the io.Closer interface.
+func (d *blobDownload) Close() error {
+	d.stop()
+	return d.body.Close()
+}
+
+func (d *blobDownload) stop() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel()
+}
+
+// Replaces the error resulting from a canceled request with a descriptive
+// error message if the cancellation was caused by our timeout.
+func (d *blobDownload) translateError(err error) error {
+	if d.timedOut.Load() {
+		return d.describeTimeout()
+	}
+	return err
 }
 
 // DownloadManifestOpts appears in func DownloadManifest.
 type DownloadManifestOpts struct {
 	DoNotCountTowardsLastPulled bool
 	ExtraHeaders                http.Header
+	//If non-zero, the download fails with keppel.ErrUnavailable when upstream
+	//does not deliver the full manifest within this time.
+	Timeout time.Duration
 }
 
 // DownloadManifest fetches a manifest from this repository. If an error is
@@ -73,14 +161,22 @@ func (c *RepoClient) DownloadManifest(reference keppel.ManifestReference, opts *
 		}
 	}
 
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
 	resp, err := c.doRequest(repoRequest{
+		Context:      ctx,
 		Method:       "GET",
 		Path:         "manifests/" + reference.String(),
 		Headers:      hdr,
 		ExpectStatus: http.StatusOK,
 	})
 	if err != nil {
-		return nil, "", err
+		return nil, "", c.describeTimeout(err, reference, opts.Timeout)
 	}
 
 	respBytes, err := io.ReadAll(resp.Body)
@@ -90,8 +186,20 @@ func (c *RepoClient) DownloadManifest(reference keppel.ManifestReference, opts *
 		resp.Body.Close()
 	}
 	if err != nil {
-		return nil, "", err
+		return nil, "", c.describeTimeout(err, reference, opts.Timeout)
 	}
 
 	return respBytes, resp.Header.Get("Content-Type"), nil
 }
+
+// Replaces a context timeout error with a descriptive error message that can
+// be shown to the client.
+func (c *RepoClient) describeTimeout(err error, reference keppel.ManifestReference, timeout time.Duration) error {
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return keppel.ErrUnavailable.With(
+		"upstream registry %s did not deliver manifest %s of repository %s within %s",
+		c.Host, reference, c.RepoName, timeout,
+	)
+}
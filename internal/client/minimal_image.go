@@ -16,9 +16,14 @@
 *
 ******************************************************************************/
 
-package healthmonitorcmd
+package client
 
-import "encoding/base64"
+import (
+	"encoding/base64"
+
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
 
 //This file contains a minimal complete Docker image (one blob with the image
 //configuration and one manifest) as generated by the Dockerfile:
@@ -60,3 +65,18 @@ func minimalImageLayer() []byte {
 	}
 	return buf
 }
+
+// UploadMinimalImage uploads a minimal complete image (one config blob, one
+// layer blob and one manifest) for testing purposes. On success, the
+// manifest's digest is returned.
+func (c *RepoClient) UploadMinimalImage(tagName string) (digest.Digest, error) {
+	_, err := c.UploadMonolithicBlob([]byte(minimalImageConfiguration))
+	if err != nil {
+		return "", err
+	}
+	_, err = c.UploadMonolithicBlob(minimalImageLayer())
+	if err != nil {
+		return "", err
+	}
+	return c.UploadManifest([]byte(minimalManifest), schema2.MediaTypeManifest, tagName)
+}
@@ -32,14 +32,15 @@ import (
 // Client can be used for API access to one of our peers (using our peering
 // credentials).
 type Client struct {
-	peer  keppel.Peer
-	token string
+	peer       keppel.Peer
+	httpClient *http.Client
+	token      string
 }
 
 // New obtains a token for API access to the given peer (using our peering
 // credentials), and wraps it into a Client instance.
 func New(cfg keppel.Configuration, peer keppel.Peer, scope auth.Scope) (Client, error) {
-	c := Client{peer, ""}
+	c := Client{peer, cfg.HTTPClientForPeers(), ""}
 	err := c.initToken(cfg, scope)
 	if err != nil {
 		return Client{}, fmt.Errorf("while trying to obtain a peer token for %s in scope %s: %w",
@@ -88,7 +89,7 @@ func (c Client) doRequest(method, url string, body io.Reader, headers map[string
 		req.Header.Set(k, v)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, 0, nil, fmt.Errorf("during %s %s: %w", method, url, err)
 	}
@@ -0,0 +1,129 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package peerclient
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestClientPresentsCertificateToPeer(t *testing.T) {
+	clientCert := generateSelfSignedCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	//this peer only answers if we present our client certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		if r.TLS.PeerCertificates[0].Subject.CommonName != "registry.example.org" {
+			http.Error(w, "unexpected client certificate", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"token":"sometoken"}`))
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	peer := keppel.Peer{
+		HostName:    strings.TrimPrefix(server.URL, "https://"),
+		OurPassword: "secret",
+	}
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(server.Certificate())
+
+	//with a client certificate, we get a token
+	cfg := keppel.Configuration{
+		APIPublicHostname: "registry.example.org",
+		PeerHTTPClient: keppel.NewPeerHTTPClient(&tls.Config{
+			Certificates: []tls.Certificate{clientCert},
+			RootCAs:      serverCAs,
+			MinVersion:   tls.VersionTLS12,
+		}),
+	}
+	c, err := New(cfg, peer, auth.PeerAPIScope)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if c.token != "sometoken" {
+		t.Errorf("expected token %q, but got %q", "sometoken", c.token)
+	}
+
+	//without a client certificate, the TLS handshake fails
+	cfg.PeerHTTPClient = keppel.NewPeerHTTPClient(&tls.Config{
+		RootCAs:    serverCAs,
+		MinVersion: tls.VersionTLS12,
+	})
+	_, err = New(cfg, peer, auth.PeerAPIScope)
+	if err == nil {
+		t.Error("expected peer token request without client certificate to fail, but it succeeded")
+	}
+}
+
+func generateSelfSignedCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "registry.example.org"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{certDER},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
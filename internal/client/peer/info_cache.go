@@ -0,0 +1,68 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package peerclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// How long a PeerInfo is cached before it is fetched again. Peers only change
+// their capabilities when they get upgraded, so this can be fairly long.
+const peerInfoCacheLifetime = 1 * time.Hour
+
+// InfoCache caches the results of GetPeerInfo(), so that the peer info does
+// not need to be fetched again for each replication job.
+type InfoCache struct {
+	mutex   sync.Mutex
+	entries map[string]infoCacheEntry //key = peer hostname
+}
+
+type infoCacheEntry struct {
+	Info      keppel.PeerInfo
+	ExpiresAt time.Time
+}
+
+// NewInfoCache creates an empty InfoCache.
+func NewInfoCache() *InfoCache {
+	return &InfoCache{entries: make(map[string]infoCacheEntry)}
+}
+
+// GetPeerInfo is like c.GetPeerInfo(), but returns a cached result if there is
+// one that has not expired yet.
+func (ic *InfoCache) GetPeerInfo(c Client, now time.Time) (keppel.PeerInfo, error) {
+	ic.mutex.Lock()
+	entry, exists := ic.entries[c.peer.HostName]
+	ic.mutex.Unlock()
+	if exists && entry.ExpiresAt.After(now) {
+		return entry.Info, nil
+	}
+
+	info, err := c.GetPeerInfo()
+	if err != nil {
+		return keppel.PeerInfo{}, err
+	}
+
+	ic.mutex.Lock()
+	ic.entries[c.peer.HostName] = infoCacheEntry{info, now.Add(peerInfoCacheLifetime)}
+	ic.mutex.Unlock()
+	return info, nil
+}
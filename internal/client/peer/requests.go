@@ -115,6 +115,32 @@ func (c Client) PerformReplicaSync(fullRepoName string, payload keppel.ReplicaSy
 	return &respPayload, nil
 }
 
+// GetPeerInfo asks the peer which version it runs and which replication
+// features it supports. If the peer does not have the peer info API yet (i.e.
+// 404 is returned), keppel.LegacyPeerInfo() is returned.
+func (c Client) GetPeerInfo() (keppel.PeerInfo, error) {
+	reqURL := c.buildRequestURL("peer/v1/info")
+
+	respBodyBytes, respStatusCode, _, err := c.doRequest(http.MethodGet, reqURL, http.NoBody, nil)
+	if err != nil {
+		return keppel.PeerInfo{}, err
+	}
+	if respStatusCode == http.StatusNotFound {
+		return keppel.LegacyPeerInfo(), nil
+	}
+	if respStatusCode != http.StatusOK {
+		return keppel.PeerInfo{}, fmt.Errorf("during GET %s: expected 200, got %d with response: %s",
+			reqURL, respStatusCode, string(respBodyBytes))
+	}
+
+	var info keppel.PeerInfo
+	err = json.Unmarshal(respBodyBytes, &info)
+	if err != nil {
+		return keppel.PeerInfo{}, fmt.Errorf("while parsing response for GET %s: %w", reqURL, err)
+	}
+	return info, nil
+}
+
 // Like yaml.UnmarshalStrict(), but for JSON.
 func jsonUnmarshalStrict(buf []byte, target any) error {
 	dec := json.NewDecoder(bytes.NewReader(buf))
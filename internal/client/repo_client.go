@@ -19,12 +19,15 @@
 package client
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sapcc/keppel/internal/keppel"
 )
@@ -39,11 +42,26 @@ type RepoClient struct {
 	UserName string
 	Password string
 
+	//optional; if nil, http.DefaultClient is used
+	HTTPClient *http.Client
+	//optional; if not nil, requests are delayed to stay within the rate limit,
+	//and 429 responses with a Retry-After header are retried
+	RateLimits *keppel.UpstreamRateLimits
+
 	//auth state
-	token string
+	token        string
+	useBasicAuth bool //set when the registry sends a Basic auth challenge instead of a Bearer one
+}
+
+func (c *RepoClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
 }
 
 type repoRequest struct {
+	Context      context.Context //optional; if nil, context.Background() is used
 	Method       string
 	Path         string
 	Headers      http.Header
@@ -52,18 +70,33 @@ type repoRequest struct {
 }
 
 func (c *RepoClient) sendRequest(r repoRequest, uri string) (*http.Response, *http.Request, error) {
-	req, err := http.NewRequest(r.Method, uri, r.Body)
+	req, err := http.NewRequestWithContext(r.Context, r.Method, uri, r.Body)
 	if err != nil {
 		return nil, nil, err
 	}
 	for k, v := range r.Headers {
 		req.Header[k] = v
 	}
-	if c.token != "" {
+	switch {
+	case c.token != "":
 		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.useBasicAuth:
+		req.Header.Set("Authorization", keppel.BuildBasicAuthHeader(c.UserName, c.Password))
 	}
-	resp, err := http.DefaultClient.Do(req)
+	if c.RateLimits != nil {
+		//if the caller's deadline expires while we are waiting for the rate
+		//limit, report this as a timeout, same as below
+		err := c.RateLimits.Wait(r.Context, c.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
+		if r.Context.Err() != nil {
+			//let the caller recognize timeouts and cancellations
+			return nil, nil, r.Context.Err()
+		}
 		return nil, nil, keppel.ErrUnavailable.With(err.Error())
 	}
 
@@ -74,6 +107,9 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 	if c.Scheme == "" {
 		c.Scheme = "https"
 	}
+	if r.Context == nil {
+		r.Context = context.Background()
+	}
 
 	uri := fmt.Sprintf("%s://%s/v2/%s/%s", c.Scheme, c.Host, c.RepoName, r.Path)
 
@@ -85,23 +121,39 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 
 	//if it's a 401, do the auth challenge...
 	if resp.StatusCode == http.StatusUnauthorized {
-		authChallenge, err := ParseAuthChallenge(resp.Header)
-		if err != nil {
-			return nil, fmt.Errorf("cannot parse auth challenge from 401 response to %s %s: %w", r.Method, uri, err)
+		resp.Body.Close()
+		if isBasicAuthChallenge(resp.Header) && c.UserName != "" {
+			//some registries (esp. self-hosted ones) do not issue tokens, but
+			//require us to send our credentials with each request
+			c.useBasicAuth = true
+		} else {
+			authChallenge, err := ParseAuthChallenge(resp.Header)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse auth challenge from 401 response to %s %s: %w", r.Method, uri, err)
+			}
+			c.token, err = authChallenge.GetToken(r.Context, c.httpClient(), c.UserName, c.Password)
+			if err != nil {
+				return nil, fmt.Errorf("authentication failed: %w", err)
+			}
 		}
-		c.token, err = authChallenge.GetToken(c.UserName, c.Password)
+
+		//...then resend the GET request with the token
+		resp, err = c.resendRequest(r, uri)
 		if err != nil {
-			return nil, fmt.Errorf("authentication failed: %w", err)
+			return nil, err
 		}
+	}
 
-		//...then resend the GET request with the token
-		if r.Body != nil {
-			_, err = r.Body.Seek(0, io.SeekStart)
-			if err != nil {
-				return nil, err
-			}
+	//if upstream asks us to slow down, wait as long as it tells us to and try again
+	for retries := 0; retries < maxRetriesOnTooManyRequests && resp.StatusCode == http.StatusTooManyRequests && c.RateLimits != nil; retries++ {
+		now := c.RateLimits.TimeNow()
+		retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		if !ok || retryAfter > maxRetryAfter {
+			break
 		}
-		resp, _, err = c.sendRequest(r, uri)
+		resp.Body.Close()
+		c.RateLimits.BlockUntil(c.Host, now.Add(retryAfter))
+		resp, err = c.resendRequest(r, uri)
 		if err != nil {
 			return nil, err
 		}
@@ -131,6 +183,45 @@ func (c *RepoClient) doRequest(r repoRequest) (*http.Response, error) {
 	return resp, nil
 }
 
+func (c *RepoClient) resendRequest(r repoRequest, uri string) (*http.Response, error) {
+	if r.Body != nil {
+		_, err := r.Body.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, _, err := c.sendRequest(r, uri)
+	return resp, err
+}
+
+const (
+	//How often a request is retried when upstream responds with 429 and a Retry-After header.
+	maxRetriesOnTooManyRequests = 3
+	//If upstream asks us to wait for longer than this, we give up immediately
+	//instead of blocking the caller for that long.
+	maxRetryAfter = 30 * time.Second
+)
+
+// Parses the value of a Retry-After header, which can either be a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if t.Before(now) {
+		return 0, true
+	}
+	return t.Sub(now), true
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 type unexpectedStatusCodeError struct {
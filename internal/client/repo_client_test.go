@@ -0,0 +1,159 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestReplicationFromRegistryWithBasicAuth(t *testing.T) {
+	manifestBytes := []byte(`{"schemaVersion":2}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userName, password, ok := r.BasicAuth()
+		if !ok || userName != "alice" || password != "swordfish" {
+			w.Header().Set("Www-Authenticate", `Basic realm="stub registry"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/library/alpine/manifests/latest" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Write(manifestBytes)
+	}))
+	defer server.Close()
+
+	c := RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(server.URL, "http://"),
+		RepoName: "library/alpine",
+		UserName: "alice",
+		Password: "swordfish",
+	}
+	contents, mediaType, err := c.DownloadManifest(keppel.ManifestReference{Tag: "latest"}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manifest contents", string(contents), string(manifestBytes))
+	assert.DeepEqual(t, "manifest media type", mediaType, "application/vnd.oci.image.manifest.v1+json")
+
+	//with wrong credentials, the download shall fail instead of looping
+	c = RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(server.URL, "http://"),
+		RepoName: "library/alpine",
+		UserName: "alice",
+		Password: "wrong",
+	}
+	_, _, err = c.DownloadManifest(keppel.ManifestReference{Tag: "latest"}, nil)
+	if err == nil {
+		t.Error("expected manifest download with wrong credentials to fail, but it succeeded")
+	}
+}
+
+func TestRetryAfterTooManyRequests(t *testing.T) {
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount == 1 {
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Write([]byte(`{"schemaVersion":2}`))
+	}))
+	defer server.Close()
+
+	now := time.Unix(10000, 0)
+	var totalSleep time.Duration
+	rateLimits := keppel.NewUpstreamRateLimits(1, 10).OverrideTimeNow(
+		func() time.Time { return now },
+		func(ctx context.Context, d time.Duration) error {
+			totalSleep += d
+			now = now.Add(d)
+			return nil
+		},
+	)
+
+	c := RepoClient{
+		Scheme:     "http",
+		Host:       strings.TrimPrefix(server.URL, "http://"),
+		RepoName:   "library/alpine",
+		RateLimits: rateLimits,
+	}
+	_, _, err := c.DownloadManifest(keppel.ManifestReference{Tag: "latest"}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "request count", requestCount, 2)
+	assert.DeepEqual(t, "time waited", totalSleep, 5*time.Second)
+}
+
+func TestDownloadBlobTimeoutOnStalledUpstream(t *testing.T) {
+	blobContents := []byte("first chunk of the blob")
+	stopServing := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//send the first part of the blob, then stall
+		w.Header().Set("Content-Length", strconv.Itoa(2*len(blobContents)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(blobContents)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-stopServing:
+		}
+	}))
+	defer server.Close()
+	defer close(stopServing)
+
+	c := RepoClient{
+		Scheme:   "http",
+		Host:     strings.TrimPrefix(server.URL, "http://"),
+		RepoName: "library/alpine",
+	}
+	blobDigest := digest.FromBytes(blobContents)
+	readCloser, sizeBytes, err := c.DownloadBlob(blobDigest, &DownloadBlobOpts{Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer readCloser.Close()
+	assert.DeepEqual(t, "blob size", sizeBytes, uint64(2*len(blobContents)))
+
+	//the first chunk is delivered, but then the download fails instead of hanging
+	_, err = io.ReadAll(readCloser)
+	expectedMessage := fmt.Sprintf("upstream registry %s did not send any data for blob %s of repository library/alpine within 50ms", c.Host, blobDigest)
+	if err == nil || err.Error() != expectedMessage {
+		t.Errorf("expected error %q, but got %v", expectedMessage, err)
+	}
+}
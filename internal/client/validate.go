@@ -142,7 +142,7 @@ func (c *RepoClient) doValidateBlobContents(blobDigest digest.Digest, level int,
 		session.Logger.LogBlob(blobDigest, level, returnErr, false)
 	}()
 
-	readCloser, _, err := c.DownloadBlob(blobDigest)
+	readCloser, _, err := c.DownloadBlob(blobDigest, nil)
 	if err != nil {
 		return err
 	}
@@ -40,15 +40,18 @@ type RateLimitDriver struct {
 type envVarSet struct {
 	RateLimit string
 	Burst     string
+	//if true, the action is not rate-limited when RateLimit is not set
+	Optional bool
 }
 
 var (
 	envVars = map[keppel.RateLimitedAction]envVarSet{
-		keppel.BlobPullAction:            {"KEPPEL_RATELIMIT_BLOB_PULLS", "KEPPEL_BURST_BLOB_PULLS"},
-		keppel.BlobPushAction:            {"KEPPEL_RATELIMIT_BLOB_PUSHES", "KEPPEL_BURST_BLOB_PUSHES"},
-		keppel.ManifestPullAction:        {"KEPPEL_RATELIMIT_MANIFEST_PULLS", "KEPPEL_BURST_MANIFEST_PULLS"},
-		keppel.ManifestPushAction:        {"KEPPEL_RATELIMIT_MANIFEST_PUSHES", "KEPPEL_BURST_MANIFEST_PUSHES"},
-		keppel.AnycastBlobBytePullAction: {"KEPPEL_RATELIMIT_ANYCAST_BLOB_PULL_BYTES", "KEPPEL_BURST_ANYCAST_BLOB_PULL_BYTES"},
+		keppel.BlobPullAction:            {"KEPPEL_RATELIMIT_BLOB_PULLS", "KEPPEL_BURST_BLOB_PULLS", false},
+		keppel.BlobPushAction:            {"KEPPEL_RATELIMIT_BLOB_PUSHES", "KEPPEL_BURST_BLOB_PUSHES", false},
+		keppel.ManifestPullAction:        {"KEPPEL_RATELIMIT_MANIFEST_PULLS", "KEPPEL_BURST_MANIFEST_PULLS", false},
+		keppel.ManifestPushAction:        {"KEPPEL_RATELIMIT_MANIFEST_PUSHES", "KEPPEL_BURST_MANIFEST_PUSHES", false},
+		keppel.AnycastBlobBytePullAction: {"KEPPEL_RATELIMIT_ANYCAST_BLOB_PULL_BYTES", "KEPPEL_BURST_ANYCAST_BLOB_PULL_BYTES", true},
+		keppel.AnonymousRequestAction:    {"KEPPEL_RATELIMIT_ANONYMOUS_REQUESTS", "KEPPEL_BURST_ANONYMOUS_REQUESTS", true},
 	}
 	valueRx           = regexp.MustCompile(`^\s*([0-9]+)\s*[Br]/([smh])\s*$`)
 	limitConstructors = map[string]func(int) redis_rate.Limit{
@@ -70,7 +73,7 @@ func (d RateLimitDriver) PluginTypeID() string { return "basic" }
 // Init implements the keppel.FederationDriver interface.
 func (d RateLimitDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) error {
 	for action, envVars := range envVars {
-		rate, err := parseRateLimit(envVars.RateLimit)
+		rate, err := parseRateLimit(envVars)
 		if err != nil {
 			return err
 		}
@@ -95,9 +98,10 @@ func (d RateLimitDriver) GetRateLimit(account keppel.Account, action keppel.Rate
 	return nil
 }
 
-func parseRateLimit(envVar string) (*redis_rate.Limit, error) {
+func parseRateLimit(envVars envVarSet) (*redis_rate.Limit, error) {
+	envVar := envVars.RateLimit
 	var valStr string
-	if strings.HasSuffix(envVar, "_BYTES") {
+	if envVars.Optional {
 		valStr = os.Getenv(envVar)
 		if valStr == "" {
 			return nil, nil
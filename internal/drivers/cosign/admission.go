@@ -0,0 +1,220 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+// Package cosign contains an admission policy that requires manifests to be
+// signed with cosign before they can be tagged or pulled.
+package cosign
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+const (
+	//SimpleSigningMediaType is the media type of the layers in a cosign signature manifest.
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	//SignatureAnnotation is the layer annotation containing the base64-encoded signature.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+type admissionPolicy struct {
+	PublicKey *ecdsa.PublicKey
+	//if empty, signatures are required in all accounts
+	AccountNames map[string]bool
+}
+
+func init() {
+	keppel.AdmissionPolicyRegistry.Add(func() keppel.AdmissionPolicy { return &admissionPolicy{} })
+}
+
+// PluginTypeID implements the keppel.AdmissionPolicy interface.
+func (p *admissionPolicy) PluginTypeID() string { return "cosign" }
+
+// Init implements the keppel.AdmissionPolicy interface.
+func (p *admissionPolicy) Init() error {
+	keyStr, err := osext.NeedGetenv("KEPPEL_COSIGN_PUBLIC_KEY")
+	if err != nil {
+		return err
+	}
+	p.PublicKey, err = parsePublicKey(keyStr)
+	if err != nil {
+		return fmt.Errorf("cannot parse KEPPEL_COSIGN_PUBLIC_KEY: %w", err)
+	}
+
+	p.AccountNames = make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("KEPPEL_COSIGN_ACCOUNTS"), ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			p.AccountNames[name] = true
+		}
+	}
+	return nil
+}
+
+// Like keppel.ParseIssuerKey, the key can be given either as PEM or as the
+// path to a PEM file.
+func parsePublicKey(in string) (*ecdsa.PublicKey, error) {
+	buf := []byte(in)
+	if !strings.HasPrefix(strings.TrimSpace(in), "-----BEGIN") {
+		var err error
+		buf, err = os.ReadFile(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ECDSA public key, but got %T", key)
+	}
+	return ecdsaKey, nil
+}
+
+// AdmitManifest implements the keppel.AdmissionPolicy interface.
+func (p *admissionPolicy) AdmitManifest(req keppel.AdmissionRequest) error {
+	if !p.appliesTo(req.Account) {
+		return nil
+	}
+	//cosign needs the manifest to exist before it can be signed, so pushes that
+	//do not create tags are always admitted; the signature is checked once a
+	//tag is pushed, and whenever the manifest is pulled
+	if req.Action == keppel.AdmitUntaggedPush {
+		return nil
+	}
+	//signatures themselves do not need to be signed
+	if isSignatureManifest(req.Parsed) {
+		return nil
+	}
+
+	err := p.verifySignature(req.Lookup, req.Manifest.Digest)
+	if err == nil || req.Action != keppel.AdmitPull {
+		return err
+	}
+
+	//`cosign sign` only signs a list manifest itself (unless --recursive is
+	//given), so clients pulling its submanifests by digest would be rejected;
+	//therefore, submanifests are also admitted on pull if a list manifest
+	//referencing them is signed
+	parentDigests, lookupErr := req.Lookup.ListParentManifests(req.Manifest.Digest)
+	if lookupErr != nil {
+		return lookupErr
+	}
+	for _, parentDigest := range parentDigests {
+		if p.verifySignature(req.Lookup, parentDigest) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// TagsRequiredForAdmission implements the keppel.AdmissionPolicy interface.
+func (p *admissionPolicy) TagsRequiredForAdmission(account keppel.Account, manifestDigest string, parsed keppel.ParsedManifest) []string {
+	if !p.appliesTo(account) || isSignatureManifest(parsed) {
+		return nil
+	}
+	return []string{signatureTagName(manifestDigest)}
+}
+
+func (p *admissionPolicy) appliesTo(account keppel.Account) bool {
+	return len(p.AccountNames) == 0 || p.AccountNames[account.Name]
+}
+
+// cosign stores the signature for manifest "sha256:abc" under the tag "sha256-abc.sig".
+func signatureTagName(manifestDigest string) string {
+	return strings.Replace(manifestDigest, ":", "-", 1) + ".sig"
+}
+
+func (p *admissionPolicy) verifySignature(lookup keppel.AdmissionLookup, manifestDigest string) error {
+	sigTagName := signatureTagName(manifestDigest)
+	contents, mediaType, err := lookup.FindManifestByTag(sigTagName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("no cosign signature found for %s (expected in tag %q)", manifestDigest, sigTagName)
+	}
+	if err != nil {
+		return err
+	}
+	sigManifest, _, err := keppel.ParseManifest(mediaType, contents)
+	if err != nil {
+		return fmt.Errorf("cannot parse cosign signature manifest in tag %q: %w", sigTagName, err)
+	}
+
+	for _, layer := range sigManifest.FindImageLayerBlobs() {
+		if layer.MediaType != SimpleSigningMediaType {
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[SignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+		payload, err := lookup.ReadBlob(layer.Digest)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(payload)
+		if ecdsa.VerifyASN1(p.PublicKey, hash[:], signature) && payloadCoversDigest(payload, manifestDigest) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid cosign signature found for %s", manifestDigest)
+}
+
+func isSignatureManifest(parsed keppel.ParsedManifest) bool {
+	layers := parsed.FindImageLayerBlobs()
+	for _, layer := range layers {
+		if layer.MediaType != SimpleSigningMediaType {
+			return false
+		}
+	}
+	return len(layers) > 0
+}
+
+// The signed payload is in the "simple signing" format, which names the
+// digest of the signed manifest.
+func payloadCoversDigest(payload []byte, manifestDigest string) bool {
+	var data struct {
+		Critical struct {
+			Image struct {
+				DockerManifestDigest string `json:"docker-manifest-digest"`
+			} `json:"image"`
+		} `json:"critical"`
+	}
+	err := json.Unmarshal(payload, &data)
+	return err == nil && data.Critical.Image.DockerManifestDigest == manifestDigest
+}
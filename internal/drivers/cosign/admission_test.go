@@ -0,0 +1,246 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package cosign_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/drivers/cosign"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestSignatureRequired(t *testing.T) {
+	key := generateKey(t)
+	policy := newPolicy(t, key)
+
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+		test.WithAccount(keppel.Account{Name: "test2", AuthTenantID: "tenant1"}),
+		test.WithQuotas,
+		test.WithAdmissionPolicy(policy),
+	)
+	repo := keppel.Repository{AccountName: "test1", Name: "foo"}
+
+	//pushing an unsigned image by tag into a signature-required account is rejected...
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	for _, blob := range append(image.Layers, image.Config) {
+		blob.MustUpload(t, s, repo)
+	}
+	expectTagPush(t, s, repo, "latest", image.Manifest, http.StatusForbidden, test.ErrorCodeWithMessage{
+		Code: keppel.ErrDenied,
+		Message: fmt.Sprintf(`manifest rejected by admission policy: no cosign signature found for %s (expected in tag "%s")`,
+			image.Manifest.Digest, signatureTagName(image.Manifest),
+		),
+	})
+
+	//giving the tag as `?tag=` on a push by digest does not change that
+	expectTagPush(t, s, repo, image.Manifest.Digest.String()+"?tag=latest", image.Manifest, http.StatusForbidden, test.ErrorCodeWithMessage{
+		Code: keppel.ErrDenied,
+		Message: fmt.Sprintf(`manifest rejected by admission policy: no cosign signature found for %s (expected in tag "%s")`,
+			image.Manifest.Digest, signatureTagName(image.Manifest),
+		),
+	})
+
+	//...but pushing it by digest works, so that it can be signed afterwards
+	image.MustUpload(t, s, repo, "")
+	pushSignature(t, s, repo, image.Manifest, key)
+	expectTagPush(t, s, repo, "latest", image.Manifest, http.StatusCreated, nil)
+
+	//signatures made with a different key are not accepted
+	otherImage := test.GenerateImage(test.GenerateExampleLayer(2))
+	otherImage.MustUpload(t, s, repo, "")
+	pushSignature(t, s, repo, otherImage.Manifest, generateKey(t))
+	expectTagPush(t, s, repo, "other", otherImage.Manifest, http.StatusForbidden, test.ErrorCodeWithMessage{
+		Code:    keppel.ErrDenied,
+		Message: fmt.Sprintf("manifest rejected by admission policy: no valid cosign signature found for %s", otherImage.Manifest.Digest),
+	})
+
+	//unsigned images that were pushed by digest cannot be pulled...
+	expectPull(t, s, repo, otherImage.Manifest.Digest.String(), http.StatusForbidden, test.ErrorCodeWithMessage{
+		Code:    keppel.ErrDenied,
+		Message: fmt.Sprintf("manifest pull rejected by admission policy: no valid cosign signature found for %s", otherImage.Manifest.Digest),
+	})
+	//...but signed images can, both by tag and by digest
+	expectPull(t, s, repo, "latest", http.StatusOK, nil)
+	expectPull(t, s, repo, image.Manifest.Digest.String(), http.StatusOK, nil)
+
+	//when only a list manifest is signed (as with `cosign sign` without
+	//`--recursive`), its submanifests can be pulled as well
+	list := test.GenerateImageList(test.GenerateImage(test.GenerateExampleLayer(3)))
+	list.MustUpload(t, s, repo, "")
+	pushSignature(t, s, repo, list.Manifest, key)
+	expectTagPush(t, s, repo, "list", list.Manifest, http.StatusCreated, nil)
+	expectPull(t, s, repo, "list", http.StatusOK, nil)
+	expectPull(t, s, repo, list.Images[0].Manifest.Digest.String(), http.StatusOK, nil)
+
+	//accounts that are not listed in KEPPEL_COSIGN_ACCOUNTS do not require signatures
+	otherRepo := keppel.Repository{AccountName: "test2", Name: "foo"}
+	otherImage.MustUpload(t, s, otherRepo, "latest")
+	expectPull(t, s, otherRepo, "latest", http.StatusOK, nil)
+}
+
+func TestSignatureReplication(t *testing.T) {
+	key := generateKey(t)
+	policy := newPolicy(t, key)
+
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		s1 := test.NewSetup(t,
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1"}),
+			test.WithQuotas,
+			test.WithPeerAPI,
+			test.WithAdmissionPolicy(policy),
+		)
+		repo := keppel.Repository{AccountName: "test1", Name: "foo"}
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, repo, "")
+		pushSignature(t, s1, repo, image.Manifest, key)
+		expectTagPush(t, s1, repo, "latest", image.Manifest, http.StatusCreated, nil)
+
+		s2 := test.NewSetup(t,
+			test.IsSecondaryTo(&s1),
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "tenant1", UpstreamPeerHostName: "registry.example.org"}),
+			test.WithQuotas,
+			test.WithPeerAPI,
+			test.WithAdmissionPolicy(policy),
+		)
+
+		//when the replica replicates the tag, it replicates the signature first,
+		//so that both the push into the replica and the pull are admitted
+		expectPull(t, s2, repo, "latest", http.StatusOK, nil)
+		expectPull(t, s2, repo, signatureTagName(image.Manifest), http.StatusOK, nil)
+	})
+}
+
+func newPolicy(t *testing.T, key *ecdsa.PrivateKey) keppel.AdmissionPolicy {
+	t.Helper()
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	mustDo(t, err)
+	t.Setenv("KEPPEL_COSIGN_PUBLIC_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyDER})))
+	t.Setenv("KEPPEL_COSIGN_ACCOUNTS", "test1")
+	policy, err := keppel.NewAdmissionPolicy("cosign")
+	mustDo(t, err)
+	return policy
+}
+
+func generateKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	mustDo(t, err)
+	return key
+}
+
+func signatureTagName(manifest test.Bytes) string {
+	return strings.Replace(manifest.Digest.String(), ":", "-", 1) + ".sig"
+}
+
+// Pushes a signature for the given manifest in the same way as `cosign sign` does.
+func pushSignature(t *testing.T, s test.Setup, repo keppel.Repository, manifest test.Bytes, key *ecdsa.PrivateKey) {
+	t.Helper()
+	payload := test.NewBytes(mustMarshalJSON(t, map[string]interface{}{
+		"critical": map[string]interface{}{
+			"identity": map[string]string{"docker-reference": "registry.example.org/" + repo.FullName()},
+			"image":    map[string]string{"docker-manifest-digest": manifest.Digest.String()},
+			"type":     "cosign container image signature",
+		},
+		"optional": nil,
+	}))
+	hash := sha256.Sum256(payload.Contents)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	mustDo(t, err)
+	config := test.NewBytes([]byte(`{"architecture":"","os":"","config":{},"rootfs":{"type":"layers","diff_ids":[]}}`))
+
+	sigManifest := test.NewBytes(mustMarshalJSON(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     imagespec.MediaTypeImageManifest,
+		"config": map[string]interface{}{
+			"mediaType": imagespec.MediaTypeImageConfig,
+			"size":      len(config.Contents),
+			"digest":    config.Digest.String(),
+		},
+		"layers": []map[string]interface{}{{
+			"mediaType":   cosign.SimpleSigningMediaType,
+			"size":        len(payload.Contents),
+			"digest":      payload.Digest.String(),
+			"annotations": map[string]string{cosign.SignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	}))
+	sigManifest.MediaType = imagespec.MediaTypeImageManifest
+
+	payload.MustUpload(t, s, repo)
+	config.MustUpload(t, s, repo)
+	expectTagPush(t, s, repo, signatureTagName(manifest), sigManifest, http.StatusCreated, nil)
+}
+
+func expectTagPush(t *testing.T, s test.Setup, repo keppel.Repository, tagName string, manifest test.Bytes, expectedStatus int, expectedBody assert.HTTPResponseBody) {
+	t.Helper()
+	token := s.GetToken(t, fmt.Sprintf("repository:%s:pull,push", repo.FullName()))
+	assert.HTTPRequest{
+		Method: "PUT",
+		Path:   fmt.Sprintf("/v2/%s/manifests/%s", repo.FullName(), tagName),
+		Header: map[string]string{
+			"Authorization": "Bearer " + token,
+			"Content-Type":  manifest.MediaType,
+		},
+		Body:         assert.ByteData(manifest.Contents),
+		ExpectStatus: expectedStatus,
+		ExpectBody:   expectedBody,
+	}.Check(t, s.Handler)
+}
+
+func expectPull(t *testing.T, s test.Setup, repo keppel.Repository, reference string, expectedStatus int, expectedBody assert.HTTPResponseBody) {
+	t.Helper()
+	token := s.GetToken(t, fmt.Sprintf("repository:%s:pull", repo.FullName()))
+	assert.HTTPRequest{
+		Method:       "GET",
+		Path:         fmt.Sprintf("/v2/%s/manifests/%s", repo.FullName(), reference),
+		Header:       map[string]string{"Authorization": "Bearer " + token},
+		ExpectStatus: expectedStatus,
+		ExpectBody:   expectedBody,
+	}.Check(t, s.Handler)
+}
+
+func mustMarshalJSON(t *testing.T, data interface{}) []byte {
+	t.Helper()
+	buf, err := json.Marshal(data)
+	mustDo(t, err)
+	return buf
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -19,12 +19,19 @@
 package filesystem
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sapcc/go-bits/osext"
 
@@ -38,15 +45,29 @@ func init() {
 // StorageDriver (driver ID "filesystem") is a keppel.StorageDriver that stores its contents in the local filesystem.
 type StorageDriver struct {
 	rootPath string
+	//if non-empty, blobs are served from below this URL by some external process
+	//which only accepts URLs that were signed with urlSecret
+	urlBase   string
+	urlSecret []byte
+	timeNow   func() time.Time
 }
 
 // PluginTypeID implements the keppel.StorageDriver interface.
 func (d *StorageDriver) PluginTypeID() string { return "filesystem" }
 
 // Init implements the keppel.StorageDriver interface.
-func (d *StorageDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) (err error) {
-	d.rootPath, err = filepath.Abs(osext.MustGetenv("KEPPEL_FILESYSTEM_PATH"))
-	return err
+func (d *StorageDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) error {
+	rootPath, err := filepath.Abs(osext.MustGetenv("KEPPEL_FILESYSTEM_PATH"))
+	if err != nil {
+		return err
+	}
+	d.rootPath = filepath.Join(rootPath, cfg.StoragePrefix)
+	d.urlBase = strings.TrimSuffix(osext.GetenvOrDefault("KEPPEL_FILESYSTEM_URL_BASE", ""), "/")
+	if d.urlBase != "" {
+		d.urlSecret = []byte(osext.MustGetenv("KEPPEL_FILESYSTEM_URL_SECRET"))
+	}
+	d.timeNow = time.Now
+	return nil
 }
 
 func (d *StorageDriver) getBlobBasePath(account keppel.Account) string {
@@ -82,14 +103,44 @@ func (d *StorageDriver) AppendToBlob(account keppel.Account, storageID string, c
 		return err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, chunk)
-	return err
+
+	//if the chunk cannot be written completely, cut it off again, so that a
+	//partially written chunk never becomes part of the blob
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	bytesWritten, err := io.Copy(f, chunk)
+	if err == nil && chunkLength != nil && uint64(bytesWritten) != *chunkLength {
+		err = keppel.ErrSizeInvalid.With("expected %d bytes, but got %d bytes", *chunkLength, bytesWritten)
+	}
+	if err != nil {
+		truncErr := f.Truncate(offset)
+		if truncErr != nil {
+			return fmt.Errorf("%w (additional error during cleanup: %s)", err, truncErr.Error())
+		}
+		return err
+	}
+	return nil
 }
 
 // FinalizeBlob implements the keppel.StorageDriver interface.
 func (d *StorageDriver) FinalizeBlob(account keppel.Account, storageID string, chunkCount uint32) error {
 	path := d.getBlobPath(account, storageID)
 	tmpPath := path + ".tmp"
+	f, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
 	return os.Rename(tmpPath, path)
 }
 
@@ -115,9 +166,44 @@ func (d *StorageDriver) ReadBlob(account keppel.Account, storageID string) (io.R
 	return f, uint64(stat.Size()), nil
 }
 
+// ReadBlobRange implements the keppel.BlobRangeReader interface.
+func (d *StorageDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	f, err := os.Open(d.getBlobPath(account, storageID))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, int64(offset), int64(length)), f}, nil
+}
+
 // URLForBlob implements the keppel.StorageDriver interface.
 func (d *StorageDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
-	return "", keppel.ErrCannotGenerateURL
+	return d.URLForBlobWithTTL(account, storageID, 20*time.Minute)
+}
+
+// URLForBlobWithTTL implements the keppel.ExpiringBlobURLGenerator interface.
+//
+// The URL carries its expiry time and an HMAC-SHA256 signature over the blob
+// path (relative to the URL base) and the expiry time, which the web server
+// serving the blobs must check before serving the blob.
+func (d *StorageDriver) URLForBlobWithTTL(account keppel.Account, storageID string, ttl time.Duration) (string, error) {
+	if d.urlBase == "" {
+		return "", keppel.ErrCannotGenerateURL
+	}
+	path := fmt.Sprintf("/%s/%s/blobs/%s",
+		url.PathEscape(account.AuthTenantID), url.PathEscape(account.Name), url.PathEscape(storageID),
+	)
+	expires := strconv.FormatInt(d.timeNow().Add(ttl).Unix(), 10)
+
+	mac := hmac.New(sha256.New, d.urlSecret)
+	mac.Write([]byte(path + "\n" + expires))
+	query := url.Values{
+		"expires":   {expires},
+		"signature": {hex.EncodeToString(mac.Sum(nil))},
+	}
+	return d.urlBase + path + "?" + query.Encode(), nil
 }
 
 // DeleteBlob implements the keppel.StorageDriver interface.
@@ -132,25 +218,70 @@ func (d *StorageDriver) ReadManifest(account keppel.Account, repoName, digest st
 	return os.ReadFile(path)
 }
 
+// ReadManifestStream implements the keppel.ManifestStreamer interface.
+func (d *StorageDriver) ReadManifestStream(account keppel.Account, repoName, digest string) (io.ReadCloser, error) {
+	path := d.getManifestPath(account, repoName, digest)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 // WriteManifest implements the keppel.StorageDriver interface.
 func (d *StorageDriver) WriteManifest(account keppel.Account, repoName, digest string, contents []byte) error {
 	path := d.getManifestPath(account, repoName, digest)
-	tmpPath := path + ".tmp"
-	err := os.MkdirAll(filepath.Dir(tmpPath), 0777)
+	err := os.MkdirAll(filepath.Dir(path), 0777)
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(tmpPath, contents, 0666)
+
+	//write into a unique temporary file first and only rename it into place once
+	//it is complete, so that concurrent writers do not interfere with each other
+	//and readers never see a partially written manifest
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	return os.Rename(tmpPath, path)
+	tmpPath := f.Name()
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644) //os.CreateTemp() uses 0600
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath) //nolint:errcheck //best-effort cleanup, the original error is more relevant
+		return err
+	}
+	return nil
 }
 
 // DeleteManifest implements the keppel.StorageDriver interface.
 func (d *StorageDriver) DeleteManifest(account keppel.Account, repoName, digest string) error {
 	path := d.getManifestPath(account, repoName, digest)
-	return os.Remove(path)
+	err := os.Remove(path)
+	if err != nil {
+		return err
+	}
+
+	//clean up directories of repos that do not have any manifests left (this
+	//stops at the first directory that is not empty)
+	basePath := d.getManifestBasePath(account)
+	for dirPath := filepath.Dir(path); dirPath != basePath && strings.HasPrefix(dirPath, basePath); dirPath = filepath.Dir(dirPath) {
+		if os.Remove(dirPath) != nil {
+			break
+		}
+	}
+	return nil
 }
 
 // ListStorageContents implements the keppel.StorageDriver interface.
@@ -193,52 +324,33 @@ func (d *StorageDriver) getBlobs(account keppel.Account) ([]keppel.StoredBlobInf
 
 func (d *StorageDriver) getManifests(account keppel.Account) ([]keppel.StoredManifestInfo, error) {
 	var manifests []keppel.StoredManifestInfo
-	directory, err := os.Open(d.getManifestBasePath(account))
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return []keppel.StoredManifestInfo{}, nil
-		}
-		return nil, err
-	}
-	defer directory.Close()
-	repos, err := directory.Readdirnames(-1)
-	if err != nil {
-		return nil, err
-	}
-	for _, repo := range repos {
-		repoManifests, err := d.getRepoManifests(account, repo)
+	basePath := d.getManifestBasePath(account)
+	err := filepath.WalkDir(basePath, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			return nil, err
+			if path != basePath && errors.Is(err, os.ErrNotExist) {
+				return nil //was deleted concurrently
+			}
+			return err
 		}
-		manifests = append(manifests, repoManifests...)
-	}
-	return manifests, nil
-}
-
-func (d *StorageDriver) getRepoManifests(account keppel.Account, repo string) ([]keppel.StoredManifestInfo, error) {
-	var manifests []keppel.StoredManifestInfo
-	directory, err := os.Open(filepath.Join(d.getManifestBasePath(account), repo))
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return []keppel.StoredManifestInfo{}, nil
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			return nil
 		}
-		return nil, err
-	}
-	defer directory.Close()
-	digests, err := directory.Readdirnames(-1)
-	if err != nil {
-		return nil, err
-	}
-	for _, digest := range digests {
-		if strings.HasSuffix(digest, ".tmp") {
-			continue
+		//repo names may contain slashes, so everything between the base path and
+		//the digest is the repo name
+		repoPath, err := filepath.Rel(basePath, filepath.Dir(path))
+		if err != nil {
+			return err
 		}
 		manifests = append(manifests, keppel.StoredManifestInfo{
-			RepoName: repo,
-			Digest:   digest,
+			RepoName: filepath.ToSlash(repoPath),
+			Digest:   entry.Name(),
 		})
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return []keppel.StoredManifestInfo{}, nil
 	}
-	return manifests, nil
+	return manifests, err
 }
 
 // CanSetupAccount implements the keppel.StorageDriver interface.
@@ -0,0 +1,261 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package filesystem
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func TestStoragePrefixIsolation(t *testing.T) {
+	//two drivers share the same root directory, but use different prefixes
+	t.Setenv("KEPPEL_FILESYSTEM_PATH", t.TempDir())
+	drivers := make([]*StorageDriver, 2)
+	for idx, prefix := range []string{"instance1", "instance2/nested"} {
+		drivers[idx] = &StorageDriver{}
+		err := drivers[idx].Init(nil, keppel.Configuration{StoragePrefix: prefix})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	//both drivers write a blob and a manifest with the same identifiers, but different contents
+	account := keppel.Account{Name: "test1", AuthTenantID: "tenant1"}
+	for idx, d := range drivers {
+		contents := strings.Repeat("x", idx+1)
+		mustDo(t, d.AppendToBlob(account, "storageid", 1, nil, strings.NewReader(contents)))
+		mustDo(t, d.FinalizeBlob(account, "storageid", 1))
+		mustDo(t, d.WriteManifest(account, "repo", "sha256:abc", []byte(contents)))
+	}
+
+	//each driver shall only see its own contents
+	for idx, d := range drivers {
+		expectedContents := strings.Repeat("x", idx+1)
+
+		reader, sizeBytes, err := d.ReadBlob(account, "storageid")
+		mustDo(t, err)
+		buf, err := io.ReadAll(reader)
+		mustDo(t, err)
+		mustDo(t, reader.Close())
+		assert.DeepEqual(t, "blob contents", string(buf), expectedContents)
+		assert.DeepEqual(t, "blob size", sizeBytes, uint64(len(expectedContents)))
+
+		reader, err = d.ReadBlobRange(account, "storageid", 1, uint64(idx))
+		mustDo(t, err)
+		buf, err = io.ReadAll(reader)
+		mustDo(t, err)
+		mustDo(t, reader.Close())
+		assert.DeepEqual(t, "blob range contents", string(buf), expectedContents[1:])
+
+		buf, err = d.ReadManifest(account, "repo", "sha256:abc")
+		mustDo(t, err)
+		assert.DeepEqual(t, "manifest contents", string(buf), expectedContents)
+
+		blobs, manifests, err := d.ListStorageContents(account)
+		mustDo(t, err)
+		assert.DeepEqual(t, "stored blobs", blobs, []keppel.StoredBlobInfo{{StorageID: "storageid"}})
+		assert.DeepEqual(t, "stored manifests", manifests, []keppel.StoredManifestInfo{{RepoName: "repo", Digest: "sha256:abc"}})
+	}
+
+	//deleting in one driver shall not affect the other
+	mustDo(t, drivers[0].DeleteBlob(account, "storageid"))
+	mustDo(t, drivers[0].DeleteManifest(account, "repo", "sha256:abc"))
+	mustDo(t, drivers[0].CleanupAccount(account))
+	blobs, manifests, err := drivers[1].ListStorageContents(account)
+	mustDo(t, err)
+	assert.DeepEqual(t, "stored blobs", len(blobs), 1)
+	assert.DeepEqual(t, "stored manifests", len(manifests), 1)
+}
+
+func TestRoundTrip(t *testing.T) {
+	rootPath := t.TempDir()
+	t.Setenv("KEPPEL_FILESYSTEM_PATH", rootPath)
+	d := &StorageDriver{}
+	mustDo(t, d.Init(nil, keppel.Configuration{}))
+	account := keppel.Account{Name: "test1", AuthTenantID: "tenant1"}
+
+	//upload a blob in multiple chunks
+	chunks := []string{"foo", "bar", "baz"}
+	for idx, chunk := range chunks {
+		chunkLength := uint64(len(chunk))
+		mustDo(t, d.AppendToBlob(account, "storageid", uint32(idx+1), &chunkLength, strings.NewReader(chunk)))
+	}
+	mustDo(t, d.FinalizeBlob(account, "storageid", uint32(len(chunks))))
+	expectBlobContents(t, d, account, "storageid", "foobarbaz")
+
+	//write manifests, including into a repo whose name contains slashes, and
+	//overwrite one of them
+	mustDo(t, d.WriteManifest(account, "repo", "sha256:abc", []byte("first")))
+	mustDo(t, d.WriteManifest(account, "nested/repo", "sha256:def", []byte("second")))
+	mustDo(t, d.WriteManifest(account, "repo", "sha256:abc", []byte("third")))
+	buf, err := d.ReadManifest(account, "repo", "sha256:abc")
+	mustDo(t, err)
+	assert.DeepEqual(t, "manifest contents", string(buf), "third")
+	reader, err := d.ReadManifestStream(account, "nested/repo", "sha256:def")
+	mustDo(t, err)
+	buf, err = io.ReadAll(reader)
+	mustDo(t, err)
+	mustDo(t, reader.Close())
+	assert.DeepEqual(t, "manifest contents", string(buf), "second")
+
+	//no temporary files shall be left behind
+	blobs, manifests, err := d.ListStorageContents(account)
+	mustDo(t, err)
+	assert.DeepEqual(t, "stored blobs", blobs, []keppel.StoredBlobInfo{{StorageID: "storageid"}})
+	assert.DeepEqual(t, "stored manifests", manifests, []keppel.StoredManifestInfo{
+		{RepoName: "nested/repo", Digest: "sha256:def"},
+		{RepoName: "repo", Digest: "sha256:abc"},
+	})
+	expectNoTemporaryFiles(t, rootPath)
+
+	//deleting everything also removes the repo directories, so that the account can be cleaned up
+	mustDo(t, d.DeleteBlob(account, "storageid"))
+	mustDo(t, d.DeleteManifest(account, "repo", "sha256:abc"))
+	mustDo(t, d.DeleteManifest(account, "nested/repo", "sha256:def"))
+	mustDo(t, d.CleanupAccount(account))
+	entries, err := os.ReadDir(d.getManifestBasePath(account))
+	mustDo(t, err)
+	assert.DeepEqual(t, "leftover manifest directories", len(entries), 0)
+
+	//deleting objects that do not exist is an error
+	if err := d.DeleteBlob(account, "storageid"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist when deleting missing blob, but got %v", err)
+	}
+	if err := d.DeleteManifest(account, "repo", "sha256:abc"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist when deleting missing manifest, but got %v", err)
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	t.Setenv("KEPPEL_FILESYSTEM_PATH", t.TempDir())
+	d := &StorageDriver{}
+	mustDo(t, d.Init(nil, keppel.Configuration{}))
+	account := keppel.Account{Name: "test1", AuthTenantID: "tenant1"}
+
+	mustDo(t, d.AppendToBlob(account, "storageid", 1, nil, strings.NewReader("foo")))
+
+	//a chunk that breaks off in the middle shall not leave any trace in the blob
+	err := d.AppendToBlob(account, "storageid", 2, nil, io.MultiReader(
+		strings.NewReader("partial"),
+		iotest.ErrReader(errors.New("connection reset")),
+	))
+	if err == nil || err.Error() != "connection reset" {
+		t.Errorf("expected chunk upload to fail with \"connection reset\", but got %v", err)
+	}
+
+	//same for a chunk that is shorter than announced
+	chunkLength := uint64(10)
+	err = d.AppendToBlob(account, "storageid", 2, &chunkLength, strings.NewReader("short"))
+	if rerr, ok := err.(*keppel.RegistryV2Error); !ok || rerr.Code != keppel.ErrSizeInvalid {
+		t.Errorf("expected chunk upload to fail with SIZE_INVALID, but got %v", err)
+	}
+
+	//the blob is not visible until it is finalized...
+	_, _, err = d.ReadBlob(account, "storageid")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist when reading unfinalized blob, but got %v", err)
+	}
+
+	//...and after that, it only contains the successfully written chunks
+	mustDo(t, d.AppendToBlob(account, "storageid", 2, nil, strings.NewReader("bar")))
+	mustDo(t, d.FinalizeBlob(account, "storageid", 2))
+	expectBlobContents(t, d, account, "storageid", "foobar")
+
+	//an aborted upload leaves nothing behind
+	mustDo(t, d.AppendToBlob(account, "otherid", 1, nil, strings.NewReader("foo")))
+	mustDo(t, d.AbortBlobUpload(account, "otherid", 1))
+	blobs, _, err := d.ListStorageContents(account)
+	mustDo(t, err)
+	assert.DeepEqual(t, "stored blobs", blobs, []keppel.StoredBlobInfo{{StorageID: "storageid"}})
+	expectNoTemporaryFiles(t, d.rootPath)
+}
+
+func TestURLForBlob(t *testing.T) {
+	t.Setenv("KEPPEL_FILESYSTEM_PATH", t.TempDir())
+	account := keppel.Account{Name: "test1", AuthTenantID: "tenant1"}
+
+	//without a configured URL base, clients have to be served by ReadBlob()
+	d := &StorageDriver{}
+	mustDo(t, d.Init(nil, keppel.Configuration{}))
+	_, err := d.URLForBlob(account, "storageid")
+	assert.DeepEqual(t, "URLForBlob error", err, keppel.ErrCannotGenerateURL)
+
+	//with a configured URL base, URLs are signed and expire after some time
+	t.Setenv("KEPPEL_FILESYSTEM_URL_BASE", "https://blobs.example.org/keppel/")
+	t.Setenv("KEPPEL_FILESYSTEM_URL_SECRET", "supersecret")
+	d = &StorageDriver{}
+	mustDo(t, d.Init(nil, keppel.Configuration{}))
+	d.timeNow = func() time.Time { return time.Unix(10000, 0) }
+	blobURL, err := d.URLForBlob(account, "storageid")
+	mustDo(t, err)
+
+	mac := hmac.New(sha256.New, []byte("supersecret"))
+	mac.Write([]byte("/tenant1/test1/blobs/storageid\n11200"))
+	expectedURL := "https://blobs.example.org/keppel/tenant1/test1/blobs/storageid?expires=11200&signature=" + hex.EncodeToString(mac.Sum(nil))
+	assert.DeepEqual(t, "blob URL", blobURL, expectedURL)
+
+	//the TTL can also be chosen by the caller
+	blobURL, err = d.URLForBlobWithTTL(account, "storageid", time.Hour)
+	mustDo(t, err)
+	if !strings.Contains(blobURL, "?expires=13600&") {
+		t.Errorf("expected blob URL to expire after one hour, but got %q", blobURL)
+	}
+}
+
+func expectBlobContents(t *testing.T, d *StorageDriver, account keppel.Account, storageID, expectedContents string) {
+	t.Helper()
+	reader, sizeBytes, err := d.ReadBlob(account, storageID)
+	mustDo(t, err)
+	buf, err := io.ReadAll(reader)
+	mustDo(t, err)
+	mustDo(t, reader.Close())
+	assert.DeepEqual(t, "blob contents", string(buf), expectedContents)
+	assert.DeepEqual(t, "blob size", sizeBytes, uint64(len(expectedContents)))
+}
+
+func expectNoTemporaryFiles(t *testing.T, rootPath string) {
+	t.Helper()
+	mustDo(t, filepath.WalkDir(rootPath, func(path string, entry os.DirEntry, err error) error {
+		if err == nil && strings.HasSuffix(path, ".tmp") {
+			t.Errorf("found leftover temporary file: %s", path)
+		}
+		return err
+	}))
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
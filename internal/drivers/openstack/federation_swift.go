@@ -39,6 +39,7 @@ import (
 	"github.com/majewsky/schwift/gopherschwift"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/osext"
+	"golang.org/x/exp/slices"
 
 	"github.com/sapcc/keppel/internal/keppel"
 )
@@ -241,10 +242,12 @@ func (fd *federationDriverSwift) claimReplicaAccount(account keppel.Account, sub
 			file.SubleaseTokenSecret = ""
 		}
 
-		//validate the primary account
-		err := fd.verifyAccountOwnership(*file, account.UpstreamPeerHostName)
-		if err != nil {
-			return err
+		//validate the upstream account (either the primary or another replica)
+		if !slices.Contains(file.ReplicaHostNames, account.UpstreamPeerHostName) {
+			err := fd.verifyAccountOwnership(*file, account.UpstreamPeerHostName)
+			if err != nil {
+				return err
+			}
 		}
 
 		//all good - add ourselves to the list of replicas
@@ -316,14 +319,18 @@ func (fd *federationDriverSwift) RecordExistingAccount(account keppel.Account, n
 	//it finds an inconsistency, so the operator can take care of fixing it.
 	return fd.modifyAccountFile(account.Name, func(file *accountFile, _ bool) error {
 		//check that the primary hostname is correct, or fill in if missing
+		//(replicas in a replication chain only know their immediate upstream,
+		//which is fine as long as that one is a known replica)
 		var expectedPrimaryHostName string
 		if account.UpstreamPeerHostName == "" {
 			expectedPrimaryHostName = fd.OwnHostName
 		} else {
 			expectedPrimaryHostName = account.UpstreamPeerHostName
 		}
-		switch file.PrimaryHostName {
-		case "", expectedPrimaryHostName:
+		switch {
+		case account.UpstreamPeerHostName != "" && slices.Contains(file.ReplicaHostNames, account.UpstreamPeerHostName):
+			//nothing to do
+		case file.PrimaryHostName == "" || file.PrimaryHostName == expectedPrimaryHostName:
 			file.PrimaryHostName = expectedPrimaryHostName
 		default:
 			return fmt.Errorf("expected primary for account %s to be hosted by %s, but is actually hosted by %q",
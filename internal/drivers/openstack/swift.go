@@ -21,6 +21,7 @@ package openstack
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
@@ -30,6 +31,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -49,6 +51,7 @@ type swiftContainerInfo struct {
 
 type swiftDriver struct {
 	mainAccount         *schwift.Account
+	objectNamePrefix    string //either empty or ends with a slash
 	containerInfos      map[string]*swiftContainerInfo
 	containerInfosMutex sync.RWMutex
 }
@@ -82,6 +85,9 @@ func (d *swiftDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) error
 		return err
 	}
 	d.containerInfos = make(map[string]*swiftContainerInfo)
+	if cfg.StoragePrefix != "" {
+		d.objectNamePrefix = cfg.StoragePrefix + "/"
+	}
 	return nil
 }
 
@@ -117,7 +123,11 @@ func (d *swiftDriver) getBackendConnection(account keppel.Account) (*schwift.Con
 		}
 		//nolint:errcheck //in case of error, False will be returned therefore no need to check.
 		writeRestricted, _ := strconv.ParseBool(hdr.Metadata().Get("Write-Restricted"))
-		if tempURLKey == "" || !writeRestricted {
+		prefixModeIsRecorded, err := checkStoragePrefixMode(hdr, d.objectNamePrefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot use Swift container %s: %w", account.SwiftContainerName(), err)
+		}
+		if tempURLKey == "" || !writeRestricted || !prefixModeIsRecorded {
 			hdr := schwift.NewContainerHeaders()
 			//generate tempurl key on first startup
 			if tempURLKey == "" {
@@ -132,6 +142,9 @@ func (d *swiftDriver) getBackendConnection(account keppel.Account) (*schwift.Con
 			if !writeRestricted {
 				hdr.Metadata().Set("Write-Restricted", "true")
 			}
+			if !prefixModeIsRecorded {
+				hdr.Metadata().Set(storagePrefixModeMetadataKey, storagePrefixMode(d.objectNamePrefix))
+			}
 			err = c.Create(hdr.ToOpts())
 			if err != nil {
 				return nil, nil, err
@@ -150,6 +163,41 @@ func (d *swiftDriver) getBackendConnection(account keppel.Account) (*schwift.Con
 	return c, info, nil
 }
 
+// The Swift container of a Keppel account may be shared by multiple Keppel
+// instances if they use different storage prefixes. But an instance without a
+// storage prefix cannot share the container with anyone: Its object names can
+// look exactly like those of a prefixed instance (e.g. the manifests of repo
+// "region1/foo" would collide with those of repo "foo" in an instance with
+// prefix "region1"), and its storage sweep would consider the objects of all
+// other instances as its own. Therefore, the container records in this
+// metadata field whether it is used with or without storage prefixes, and we
+// refuse to use it in the other mode.
+const storagePrefixModeMetadataKey = "Keppel-Storage-Prefix-Mode"
+
+func storagePrefixMode(objectNamePrefix string) string {
+	if objectNamePrefix == "" {
+		return "unprefixed"
+	}
+	return "prefixed"
+}
+
+// checkStoragePrefixMode returns an error if the container with the given
+// headers is in use by Keppel instances whose storage prefix mode is
+// incompatible with ours. If the container does not record a mode yet, false
+// is returned to indicate that we need to record ours.
+func checkStoragePrefixMode(hdr schwift.ContainerHeaders, objectNamePrefix string) (isRecorded bool, err error) {
+	recordedMode := hdr.Metadata().Get(storagePrefixModeMetadataKey)
+	if recordedMode == "" {
+		return false, nil
+	}
+	ourMode := storagePrefixMode(objectNamePrefix)
+	if recordedMode != ourMode {
+		return true, fmt.Errorf("container is used by Keppel instances in %s mode, but this instance is %s (KEPPEL_STORAGE_PREFIX must be set either on all or on none of the Keppel instances sharing a Swift account)",
+			recordedMode, ourMode)
+	}
+	return true, nil
+}
+
 func generateSecret() (string, error) {
 	var secretBytes [32]byte
 	if _, err := rand.Read(secretBytes[:]); err != nil {
@@ -158,17 +206,17 @@ func generateSecret() (string, error) {
 	return hex.EncodeToString(secretBytes[:]), nil
 }
 
-func blobObject(c *schwift.Container, storageID string) *schwift.Object {
-	return c.Object(fmt.Sprintf("_blobs/%s/%s/%s", storageID[0:2], storageID[2:4], storageID[4:]))
+func (d *swiftDriver) blobObject(c *schwift.Container, storageID string) *schwift.Object {
+	return c.Object(fmt.Sprintf("%s_blobs/%s/%s/%s", d.objectNamePrefix, storageID[0:2], storageID[2:4], storageID[4:]))
 }
 
-func chunkObject(c *schwift.Container, storageID string, chunkNumber uint32) *schwift.Object {
+func (d *swiftDriver) chunkObject(c *schwift.Container, storageID string, chunkNumber uint32) *schwift.Object {
 	//NOTE: uint32 numbers never have more than 10 digits
-	return c.Object(fmt.Sprintf("_chunks/%s/%s/%s/%010d", storageID[0:2], storageID[2:4], storageID[4:], chunkNumber))
+	return c.Object(fmt.Sprintf("%s_chunks/%s/%s/%s/%010d", d.objectNamePrefix, storageID[0:2], storageID[2:4], storageID[4:], chunkNumber))
 }
 
-func manifestObject(c *schwift.Container, repoName, digest string) *schwift.Object {
-	return c.Object(fmt.Sprintf("%s/_manifests/%s", repoName, digest))
+func (d *swiftDriver) manifestObject(c *schwift.Container, repoName, digest string) *schwift.Object {
+	return c.Object(fmt.Sprintf("%s%s/_manifests/%s", d.objectNamePrefix, repoName, digest))
 }
 
 // Like schwift.Object.Upload(), but does a HEAD request on the object
@@ -195,7 +243,7 @@ func (d *swiftDriver) AppendToBlob(account keppel.Account, storageID string, chu
 	if chunkLength != nil {
 		hdr.SizeBytes().Set(*chunkLength)
 	}
-	o := chunkObject(c, storageID, chunkNumber)
+	o := d.chunkObject(c, storageID, chunkNumber)
 	return uploadToObject(o, chunk, nil, hdr.ToOpts())
 }
 
@@ -205,7 +253,7 @@ func (d *swiftDriver) FinalizeBlob(account keppel.Account, storageID string, chu
 	if err != nil {
 		return err
 	}
-	lo, err := blobObject(c, storageID).AsNewLargeObject(
+	lo, err := d.blobObject(c, storageID).AsNewLargeObject(
 		schwift.SegmentingOptions{
 			Strategy:         schwift.StaticLargeObject,
 			SegmentContainer: c, //ignored since we AddSegment() manually
@@ -217,7 +265,7 @@ func (d *swiftDriver) FinalizeBlob(account keppel.Account, storageID string, chu
 	}
 
 	for chunkNumber := uint32(1); chunkNumber <= chunkCount; chunkNumber++ {
-		co := chunkObject(c, storageID, chunkNumber)
+		co := d.chunkObject(c, storageID, chunkNumber)
 		hdr, err := co.Headers()
 		if err != nil {
 			return err
@@ -245,14 +293,14 @@ func (d *swiftDriver) AbortBlobUpload(account keppel.Account, storageID string,
 	//we didn't construct the LargeObject yet, so we need to delete the segments individually
 	var firstError error
 	for chunkNumber := uint32(1); chunkNumber <= chunkCount; chunkNumber++ {
-		err := chunkObject(c, storageID, chunkNumber).Delete(nil, nil)
+		err := d.chunkObject(c, storageID, chunkNumber).Delete(nil, nil)
 		//keep going even when some segments cannot be deleted, to clean up as much as we can
 		if err != nil {
 			if firstError == nil {
 				firstError = err
 			} else {
 				logg.Error("encountered additional error while cleaning up segments of %s: %s",
-					chunkObject(c, storageID, chunkNumber).FullName(), err.Error(),
+					d.chunkObject(c, storageID, chunkNumber).FullName(), err.Error(),
 				)
 			}
 		}
@@ -263,28 +311,54 @@ func (d *swiftDriver) AbortBlobUpload(account keppel.Account, storageID string,
 
 // ReadBlob implements the keppel.StorageDriver interface.
 func (d *swiftDriver) ReadBlob(account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	return d.ReadBlobWithContext(context.Background(), account, storageID)
+}
+
+// ReadBlobWithContext implements the keppel.ContextReader interface.
+func (d *swiftDriver) ReadBlobWithContext(ctx context.Context, account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
 	c, _, err := d.getBackendConnection(account)
 	if err != nil {
 		return nil, 0, err
 	}
-	o := blobObject(c, storageID)
+	o := d.blobObject(c, storageID)
+	reader, err := o.Download(&schwift.RequestOptions{Context: ctx}).AsReadCloser()
+	if err != nil {
+		return nil, 0, err
+	}
+	//Download() has cached the object headers, so this does not cause another request
 	hdr, err := o.Headers()
 	if err != nil {
+		reader.Close()
 		return nil, 0, err
 	}
-	reader, err := o.Download(nil).AsReadCloser()
-	return reader, hdr.SizeBytes().Get(), err
+	return reader, hdr.SizeBytes().Get(), nil
+}
+
+// ReadBlobRange implements the keppel.BlobRangeReader interface.
+func (d *swiftDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	c, _, err := d.getBackendConnection(account)
+	if err != nil {
+		return nil, err
+	}
+	hdr := schwift.NewObjectHeaders()
+	hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	return d.blobObject(c, storageID).Download(hdr.ToOpts()).AsReadCloser()
 }
 
 // URLForBlob implements the keppel.StorageDriver interface.
 func (d *swiftDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
+	return d.URLForBlobWithTTL(account, storageID, 20*time.Minute)
+}
+
+// URLForBlobWithTTL implements the keppel.ExpiringBlobURLGenerator interface.
+func (d *swiftDriver) URLForBlobWithTTL(account keppel.Account, storageID string, ttl time.Duration) (string, error) {
 	c, info, err := d.getBackendConnection(account)
 	if err != nil {
 		return "", err
 	}
 
-	expiresAt := time.Now().Add(20 * time.Minute)
-	return blobObject(c, storageID).TempURL(info.TempURLKey, "GET", expiresAt)
+	expiresAt := time.Now().Add(ttl)
+	return d.blobObject(c, storageID).TempURL(info.TempURLKey, "GET", expiresAt)
 }
 
 // DeleteBlob implements the keppel.StorageDriver interface.
@@ -293,7 +367,7 @@ func (d *swiftDriver) DeleteBlob(account keppel.Account, storageID string) error
 	if err != nil {
 		return err
 	}
-	err = blobObject(c, storageID).Delete(&schwift.DeleteOptions{DeleteSegments: true}, nil)
+	err = d.blobObject(c, storageID).Delete(&schwift.DeleteOptions{DeleteSegments: true}, nil)
 	reportObjectErrorsIfAny("DeleteBlob", err)
 	return err
 }
@@ -316,17 +390,32 @@ func (d *swiftDriver) ReadManifest(account keppel.Account, repoName, digest stri
 	if err != nil {
 		return nil, err
 	}
-	o := manifestObject(c, repoName, digest)
+	o := d.manifestObject(c, repoName, digest)
 	return o.Download(nil).AsByteSlice()
 }
 
+// ReadManifestStream implements the keppel.ManifestStreamer interface.
+func (d *swiftDriver) ReadManifestStream(account keppel.Account, repoName, digest string) (io.ReadCloser, error) {
+	return d.ReadManifestStreamWithContext(context.Background(), account, repoName, digest)
+}
+
+// ReadManifestStreamWithContext implements the keppel.ContextReader interface.
+func (d *swiftDriver) ReadManifestStreamWithContext(ctx context.Context, account keppel.Account, repoName, digest string) (io.ReadCloser, error) {
+	c, _, err := d.getBackendConnection(account)
+	if err != nil {
+		return nil, err
+	}
+	o := d.manifestObject(c, repoName, digest)
+	return o.Download(&schwift.RequestOptions{Context: ctx}).AsReadCloser()
+}
+
 // WriteManifest implements the keppel.StorageDriver interface.
 func (d *swiftDriver) WriteManifest(account keppel.Account, repoName, digest string, contents []byte) error {
 	c, _, err := d.getBackendConnection(account)
 	if err != nil {
 		return err
 	}
-	o := manifestObject(c, repoName, digest)
+	o := d.manifestObject(c, repoName, digest)
 	return uploadToObject(o, bytes.NewReader(contents), nil, nil)
 }
 
@@ -336,7 +425,7 @@ func (d *swiftDriver) DeleteManifest(account keppel.Account, repoName, digest st
 	if err != nil {
 		return err
 	}
-	o := manifestObject(c, repoName, digest)
+	o := d.manifestObject(c, repoName, digest)
 	return o.Delete(nil, nil)
 }
 
@@ -360,13 +449,16 @@ func (d *swiftDriver) ListStorageContents(account keppel.Account) ([]keppel.Stor
 	chunkCounts := make(map[string]uint32) //key = storage ID, value = same semantics as keppel.StoredBlobInfo.ChunkCount
 	var manifests []keppel.StoredManifestInfo
 
-	err = c.Objects().Foreach(func(o *schwift.Object) error {
-		if match := blobObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
+	iter := c.Objects()
+	iter.Prefix = d.objectNamePrefix
+	err = iter.Foreach(func(o *schwift.Object) error {
+		name := strings.TrimPrefix(o.Name(), d.objectNamePrefix)
+		if match := blobObjectNameRx.FindStringSubmatch(name); match != nil {
 			storageID := match[1] + match[2] + match[3]
 			mergeChunkCount(chunkCounts, storageID, 0)
 			return nil
 		}
-		if match := chunkObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
+		if match := chunkObjectNameRx.FindStringSubmatch(name); match != nil {
 			storageID := match[1] + match[2] + match[3]
 			chunkNumber, err := strconv.ParseUint(match[4], 10, 32)
 			if err != nil {
@@ -375,7 +467,7 @@ func (d *swiftDriver) ListStorageContents(account keppel.Account) ([]keppel.Stor
 			mergeChunkCount(chunkCounts, storageID, uint32(chunkNumber))
 			return nil
 		}
-		if match := manifestObjectNameRx.FindStringSubmatch(o.Name()); match != nil {
+		if match := manifestObjectNameRx.FindStringSubmatch(name); match != nil {
 			manifests = append(manifests, keppel.StoredManifestInfo{
 				RepoName: match[1],
 				Digest:   match[2],
@@ -442,5 +534,11 @@ func (d *swiftDriver) CleanupAccount(account keppel.Account) error {
 	if err != nil {
 		return err
 	}
-	return c.Delete(nil)
+	err = c.Delete(nil)
+	if d.objectNamePrefix != "" && schwift.Is(err, http.StatusConflict) {
+		//the container is shared with other Keppel instances that use different
+		//storage prefixes, and they still have objects in it
+		return nil
+	}
+	return err
 }
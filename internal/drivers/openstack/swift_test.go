@@ -0,0 +1,67 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package openstack
+
+import (
+	"testing"
+
+	"github.com/majewsky/schwift"
+)
+
+func TestStoragePrefixModeCollision(t *testing.T) {
+	//simulates the sequence of checks that getBackendConnection() performs when
+	//multiple Keppel instances use the same container
+	hdr := schwift.NewContainerHeaders()
+	useContainer := func(objectNamePrefix string) error {
+		isRecorded, err := checkStoragePrefixMode(hdr, objectNamePrefix)
+		if err == nil && !isRecorded {
+			hdr.Metadata().Set(storagePrefixModeMetadataKey, storagePrefixMode(objectNamePrefix))
+		}
+		return err
+	}
+	expectSuccess := func(objectNamePrefix string) {
+		t.Helper()
+		if err := useContainer(objectNamePrefix); err != nil {
+			t.Errorf("expected container to be usable with prefix %q, but got: %s", objectNamePrefix, err.Error())
+		}
+	}
+	expectCollision := func(objectNamePrefix string) {
+		t.Helper()
+		if useContainer(objectNamePrefix) == nil {
+			t.Errorf("expected container to be refused with prefix %q, but it was accepted", objectNamePrefix)
+		}
+	}
+
+	//instances with different prefixes can share a container...
+	expectSuccess("region1/")
+	expectSuccess("region2/")
+	expectSuccess("region1/")
+	//...but an unprefixed instance cannot join them, since e.g. its repo
+	//"region1/foo" would store manifests in the same objects as repo "foo" of
+	//the instance with prefix "region1"
+	expectCollision("")
+
+	//conversely, once an unprefixed instance uses a container, prefixed
+	//instances cannot join
+	hdr = schwift.NewContainerHeaders()
+	expectSuccess("")
+	expectSuccess("")
+	expectCollision("region1/")
+}
@@ -129,8 +129,8 @@ func (d *federationDriver) claimReplicaAccount(account keppel.Account, subleaseT
 		return keppel.ClaimFailed, errors.New("invalid sublease token (or token was already used)")
 	}
 
-	//validate the primary account
-	err = d.validatePrimaryHostname(account, account.UpstreamPeerHostName)
+	//validate the upstream account
+	err = d.validateUpstreamHostname(account)
 	if err != nil {
 		return keppel.ClaimErrored, err
 	}
@@ -212,23 +212,34 @@ func (d *federationDriver) ForfeitAccountName(account keppel.Account) error {
 // RecordExistingAccount implements the keppel.FederationDriver interface.
 func (d *federationDriver) RecordExistingAccount(account keppel.Account, now time.Time) error {
 	//record this account in Redis using idempotent operations (SETNX for primary, SADD for replica)
-	var expectedPrimaryHostname string
 	if account.UpstreamPeerHostName == "" {
-		expectedPrimaryHostname = d.ownHostname
 		err := d.rc.SetNX(context.Background(), d.primaryKey(account.Name), d.ownHostname, 0).Err()
 		if err != nil {
 			return err
 		}
-	} else {
-		expectedPrimaryHostname = account.UpstreamPeerHostName
-		err := d.rc.SAdd(context.Background(), d.replicasKey(account.Name), d.ownHostname).Err()
-		if err != nil {
-			return err
-		}
+		//check our expectations against the Redis
+		return d.validatePrimaryHostname(account, d.ownHostname)
 	}
 
+	err := d.rc.SAdd(context.Background(), d.replicasKey(account.Name), d.ownHostname).Err()
+	if err != nil {
+		return err
+	}
 	//check our expectations against the Redis
-	return d.validatePrimaryHostname(account, expectedPrimaryHostname)
+	return d.validateUpstreamHostname(account)
+}
+
+// Replicas can replicate either from the primary account or from another
+// replica of it (forming a replication chain).
+func (d *federationDriver) validateUpstreamHostname(account keppel.Account) error {
+	isReplica, err := d.rc.SIsMember(context.Background(), d.replicasKey(account.Name), account.UpstreamPeerHostName).Result()
+	if err != nil {
+		return fmt.Errorf("could not find replicas for account %s: %s", account.Name, err.Error())
+	}
+	if isReplica {
+		return nil
+	}
+	return d.validatePrimaryHostname(account, account.UpstreamPeerHostName)
 }
 
 func (d *federationDriver) validatePrimaryHostname(account keppel.Account, expectedPrimaryHostname string) error {
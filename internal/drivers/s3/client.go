@@ -0,0 +1,575 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayloadHash = "UNSIGNED-PAYLOAD"
+	amzDateFormat       = "20060102T150405Z"
+)
+
+// client is a minimal client for the subset of the S3 API that the storage
+// driver needs. Requests are authenticated with AWS Signature Version 4.
+type client struct {
+	HTTPClient      *http.Client
+	Endpoint        *url.URL
+	Region          string
+	Bucket          string
+	ForcePathStyle  bool
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	TimeNow         func() time.Time
+}
+
+// Error is returned by the client when S3 responds with an error status.
+type Error struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+// Error implements the builtin/error interface.
+func (e Error) Error() string {
+	msg := fmt.Sprintf("%s %q failed with status %d", e.Method, e.Key, e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// IsRetryable implements the keppel.RetryableStorageError interface.
+func (e Error) IsRetryable() bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		//"RequestTimeout" is reported with status 400
+		return e.Code == "SlowDown" || e.Code == "RequestTimeout"
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// request construction and signing
+
+func (c *client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.Endpoint
+	if c.ForcePathStyle {
+		u.Path = "/" + c.Bucket
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+		u.Path = ""
+	}
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQueryString(query)
+	return &u
+}
+
+// uriEncode encodes a string as required by the SigV4 canonical request.
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '.', b == '_', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func isSignedHeader(name string) bool {
+	switch name {
+	case "content-md5", "content-type", "range":
+		return true
+	default:
+		return strings.HasPrefix(name, "x-amz-")
+	}
+}
+
+// canonicalRequest returns the canonical request and the list of signed
+// headers for the given request.
+func canonicalRequest(method string, u *url.URL, hdr http.Header, payloadHash string) (canonicalReq, signedHeaders string) {
+	headers := map[string]string{"host": u.Host}
+	for name, values := range hdr {
+		name = strings.ToLower(name)
+		if isSignedHeader(name) {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	canonicalURI := u.EscapedPath()
+	if canonicalURI == "" {
+		canonicalURI = "/"
+	}
+	canonicalReq = strings.Join([]string{
+		method,
+		canonicalURI,
+		canonicalQueryString(u.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	return canonicalReq, signedHeaders
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *client) credentialScope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), c.Region)
+}
+
+func (c *client) signature(now time.Time, canonicalReq string) string {
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(amzDateFormat),
+		c.credentialScope(now),
+		sha256Hex([]byte(canonicalReq)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// signRequest adds the headers for authenticating the given request.
+func (c *client) signRequest(req *http.Request, payloadHash string) {
+	now := c.TimeNow().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	canonicalReq, signedHeaders := canonicalRequest(req.Method, req.URL, req.Header, payloadHash)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, c.credentialScope(now), signedHeaders, c.signature(now, canonicalReq),
+	))
+}
+
+// PresignedURL returns a URL that allows anyone to perform a GET request on
+// the given object until the given TTL expires.
+func (c *client) PresignedURL(key string, ttl time.Duration) string {
+	now := c.TimeNow().UTC()
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {c.AccessKeyID + "/" + c.credentialScope(now)},
+		"X-Amz-Date":          {now.Format(amzDateFormat)},
+		"X-Amz-Expires":       {strconv.FormatInt(int64(ttl/time.Second), 10)},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	if c.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	u := c.objectURL(key, query)
+
+	canonicalReq, _ := canonicalRequest(http.MethodGet, u, nil, unsignedPayloadHash)
+	u.RawQuery += "&X-Amz-Signature=" + c.signature(now, canonicalReq)
+	return u.String()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// request execution
+
+type requestOpts struct {
+	//If nil, context.Background() is used.
+	Context context.Context
+	Query   url.Values
+	Header  http.Header
+	//If Body is nil, an empty payload is sent.
+	Body io.Reader
+	//Must be given if Body is not nil.
+	ContentLength int64
+	//If empty, the payload is not covered by the signature.
+	PayloadHash string
+}
+
+// do executes a request and checks that it returned a 2xx status. On success,
+// the caller is responsible for closing the response body.
+func (c *client) do(method, key string, opts requestOpts) (*http.Response, error) {
+	body := opts.Body
+	payloadHash := opts.PayloadHash
+	if body == nil {
+		body = http.NoBody
+		payloadHash = emptyPayloadHash
+	} else if payloadHash == "" {
+		payloadHash = unsignedPayloadHash
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, opts.Query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Body != nil {
+		req.ContentLength = opts.ContentLength
+	}
+	for name, values := range opts.Header {
+		req.Header[name] = values
+	}
+	c.signRequest(req, payloadHash)
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		respErr := Error{Method: method, Key: key, StatusCode: resp.StatusCode}
+		buf, err := io.ReadAll(resp.Body)
+		if err == nil && len(buf) > 0 {
+			xml.Unmarshal(buf, &respErr) //nolint:errcheck //the error message is best-effort only
+		}
+		return nil, respErr
+	}
+	return resp, nil
+}
+
+// doXML is like do, but decodes the XML response into `target`.
+func (c *client) doXML(method, key string, opts requestOpts, target any) error {
+	resp, err := c.do(method, key, opts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if target == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return xml.NewDecoder(resp.Body).Decode(target)
+}
+
+// doWithXMLBody is like doXML, but also sends an XML request body.
+func (c *client) doWithXMLBody(method, key string, opts requestOpts, payload, target any) error {
+	buf, err := xml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	opts.Body = bytes.NewReader(buf)
+	opts.ContentLength = int64(len(buf))
+	opts.PayloadHash = sha256Hex(buf)
+	return c.doXML(method, key, opts, target)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// operations on objects
+
+// GetObject returns a reader for the object contents, and the object size.
+// When `ctx` expires, the request is aborted, including the reading of the
+// contents.
+func (c *client) GetObject(ctx context.Context, key string) (io.ReadCloser, uint64, error) {
+	resp, err := c.do(http.MethodGet, key, requestOpts{Context: ctx})
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("GET %q did not report the object size", key)
+	}
+	return resp.Body, uint64(resp.ContentLength), nil
+}
+
+// metadataHeaderPrefix is the prefix of the HTTP headers that carry
+// user-defined object metadata.
+const metadataHeaderPrefix = "X-Amz-Meta-"
+
+// GetObjectWithMetadata reads the entire object contents into memory, and
+// returns them together with the user-defined object metadata (see
+// PutObject). This shall only be used for small objects.
+func (c *client) GetObjectWithMetadata(key string) ([]byte, map[string]string, error) {
+	resp, err := c.do(http.MethodGet, key, requestOpts{})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	contents, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := make(map[string]string)
+	for name := range resp.Header {
+		if strings.HasPrefix(name, metadataHeaderPrefix) {
+			metadata[strings.ToLower(strings.TrimPrefix(name, metadataHeaderPrefix))] = resp.Header.Get(name)
+		}
+	}
+	return contents, metadata, nil
+}
+
+// GetObjectRange returns a reader for `length` bytes of the object contents,
+// starting at `offset`.
+func (c *client) GetObjectRange(key string, offset, length uint64) (io.ReadCloser, error) {
+	hdr := make(http.Header)
+	hdr.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := c.do(http.MethodGet, key, requestOpts{Header: hdr})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// PutObject uploads an object in a single request. The metadata (which may be
+// nil) is stored alongside the object, and can be retrieved with
+// GetObjectWithMetadata.
+func (c *client) PutObject(key string, contents []byte, metadata map[string]string) error {
+	hdr := make(http.Header)
+	for name, value := range metadata {
+		hdr.Set(metadataHeaderPrefix+name, value)
+	}
+	return c.doXML(http.MethodPut, key, requestOpts{
+		Header:        hdr,
+		Body:          bytes.NewReader(contents),
+		ContentLength: int64(len(contents)),
+		PayloadHash:   sha256Hex(contents),
+	}, nil)
+}
+
+// DeleteObject deletes an object. Like in S3 itself, deleting an object that
+// does not exist is not an error.
+func (c *client) DeleteObject(key string) error {
+	return c.doXML(http.MethodDelete, key, requestOpts{}, nil)
+}
+
+type listObjectsResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListObjects returns the keys of all objects with the given prefix.
+func (c *client) ListObjects(prefix string) ([]string, error) {
+	var (
+		keys              []string
+		continuationToken string
+	)
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		var result listObjectsResult
+		err := c.doXML(http.MethodGet, "", requestOpts{Query: query}, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// operations on multipart uploads
+
+// CreateMultipartUpload starts a multipart upload and returns its upload ID.
+func (c *client) CreateMultipartUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := c.doXML(http.MethodPost, key, requestOpts{Query: url.Values{"uploads": {""}}}, &result)
+	return result.UploadID, err
+}
+
+// UploadPart uploads a single part of a multipart upload.
+func (c *client) UploadPart(key, uploadID string, partNumber uint32, contents io.Reader, sizeBytes uint64) error {
+	return c.doXML(http.MethodPut, key, requestOpts{
+		Query: url.Values{
+			"partNumber": {strconv.FormatUint(uint64(partNumber), 10)},
+			"uploadId":   {uploadID},
+		},
+		Body:          contents,
+		ContentLength: int64(sizeBytes),
+	}, nil)
+}
+
+type uploadedPart struct {
+	PartNumber uint32 `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// ListParts returns all parts that were uploaded into the given multipart upload.
+func (c *client) ListParts(key, uploadID string) ([]uploadedPart, error) {
+	var (
+		parts  []uploadedPart
+		marker string
+	)
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		var result struct {
+			Parts                []uploadedPart `xml:"Part"`
+			IsTruncated          bool           `xml:"IsTruncated"`
+			NextPartNumberMarker string         `xml:"NextPartNumberMarker"`
+		}
+		err := c.doXML(http.MethodGet, key, requestOpts{Query: query}, &result)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, result.Parts...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// CompleteMultipartUpload assembles the object from the given parts.
+func (c *client) CompleteMultipartUpload(key, uploadID string, parts []uploadedPart) error {
+	payload := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []uploadedPart `xml:"Part"`
+	}{Parts: parts}
+
+	//NOTE: S3 may report errors in a 200 response here, so we need to look at the response body
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	err := c.doWithXMLBody(http.MethodPost, key, requestOpts{Query: url.Values{"uploadId": {uploadID}}}, payload, &result)
+	if err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return Error{Method: http.MethodPost, Key: key, StatusCode: http.StatusOK, Code: result.Code, Message: result.Message}
+	}
+	return nil
+}
+
+// AbortMultipartUpload cancels a multipart upload and deletes all its parts.
+func (c *client) AbortMultipartUpload(key, uploadID string) error {
+	return c.doXML(http.MethodDelete, key, requestOpts{Query: url.Values{"uploadId": {uploadID}}}, nil)
+}
+
+type multipartUpload struct {
+	Key      string `xml:"Key"`
+	UploadID string `xml:"UploadId"`
+}
+
+// ListMultipartUploads returns all ongoing multipart uploads for objects with the given prefix.
+func (c *client) ListMultipartUploads(prefix string) ([]multipartUpload, error) {
+	var (
+		uploads                   []multipartUpload
+		keyMarker, uploadIDMarker string
+	)
+	for {
+		query := url.Values{"uploads": {""}, "prefix": {prefix}}
+		if keyMarker != "" {
+			query.Set("key-marker", keyMarker)
+			query.Set("upload-id-marker", uploadIDMarker)
+		}
+		var result struct {
+			Uploads            []multipartUpload `xml:"Upload"`
+			IsTruncated        bool              `xml:"IsTruncated"`
+			NextKeyMarker      string            `xml:"NextKeyMarker"`
+			NextUploadIDMarker string            `xml:"NextUploadIdMarker"`
+		}
+		err := c.doXML(http.MethodGet, "", requestOpts{Query: query}, &result)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, result.Uploads...)
+		if !result.IsTruncated {
+			return uploads, nil
+		}
+		keyMarker = result.NextKeyMarker
+		uploadIDMarker = result.NextUploadIDMarker
+	}
+}
@@ -0,0 +1,502 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/osext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+func init() {
+	keppel.StorageDriverRegistry.Add(func() keppel.StorageDriver { return &StorageDriver{} })
+}
+
+// StorageDriver (driver ID "s3") is a keppel.StorageDriver that stores its
+// contents in a bucket of an S3-compatible object storage.
+type StorageDriver struct {
+	client    *client
+	keyPrefix string //either empty or ends with a slash
+}
+
+// PluginTypeID implements the keppel.StorageDriver interface.
+func (d *StorageDriver) PluginTypeID() string { return "s3" }
+
+// Init implements the keppel.StorageDriver interface.
+func (d *StorageDriver) Init(ad keppel.AuthDriver, cfg keppel.Configuration) error {
+	bucket, err := osext.NeedGetenv("KEPPEL_S3_BUCKET")
+	if err != nil {
+		return err
+	}
+	region, err := osext.NeedGetenv("KEPPEL_S3_REGION")
+	if err != nil {
+		return err
+	}
+	accessKeyID, err := osext.NeedGetenv("KEPPEL_S3_ACCESS_KEY_ID")
+	if err != nil {
+		return err
+	}
+	secretAccessKey, err := osext.NeedGetenv("KEPPEL_S3_SECRET_ACCESS_KEY")
+	if err != nil {
+		return err
+	}
+	endpointStr := osext.GetenvOrDefault("KEPPEL_S3_ENDPOINT", fmt.Sprintf("https://s3.%s.amazonaws.com", region))
+	endpoint, err := url.Parse(endpointStr)
+	if err != nil {
+		return fmt.Errorf("malformed KEPPEL_S3_ENDPOINT: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return fmt.Errorf("malformed KEPPEL_S3_ENDPOINT: expected an URL like \"https://s3.example.com\", but got %q", endpointStr)
+	}
+
+	//There is no overall timeout since blob contents are streamed through
+	//these requests, but S3 must start responding within a reasonable time.
+	httpClient := keppel.NewHTTPClient(func(transport *http.Transport) {
+		transport.ResponseHeaderTimeout = 1 * time.Minute
+	})
+	d.client = &client{
+		HTTPClient:      httpClient,
+		Endpoint:        &url.URL{Scheme: endpoint.Scheme, Host: endpoint.Host},
+		Region:          region,
+		Bucket:          bucket,
+		ForcePathStyle:  osext.GetenvBool("KEPPEL_S3_FORCE_PATH_STYLE"),
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    os.Getenv("KEPPEL_S3_SESSION_TOKEN"),
+		TimeNow:         time.Now,
+	}
+	if cfg.StoragePrefix != "" {
+		d.keyPrefix = cfg.StoragePrefix + "/"
+	}
+	return nil
+}
+
+func (d *StorageDriver) accountPrefix(account keppel.Account) string {
+	return fmt.Sprintf("%s%s/%s/", d.keyPrefix, account.AuthTenantID, account.Name)
+}
+
+func (d *StorageDriver) blobKey(account keppel.Account, storageID string) string {
+	return d.accountPrefix(account) + "_blobs/" + storageID
+}
+
+func (d *StorageDriver) manifestKey(account keppel.Account, repoName, digest string) string {
+	return d.accountPrefix(account) + repoName + "/_manifests/" + digest
+}
+
+func (d *StorageDriver) uploadStateKey(account keppel.Account, storageID string) string {
+	return d.accountPrefix(account) + "_uploads/" + storageID
+}
+
+// S3 requires all parts of a multipart upload except for the last one to be
+// at least this large.
+const minPartSizeBytes = 5 << 20 // 5 MiB
+
+// S3 does not accept parts larger than maxPartSizeBytes, or more than
+// maxPartCount parts in one multipart upload. (These are variables instead of
+// constants only so that tests can lower them.)
+var (
+	maxPartSizeBytes uint64 = 5 << 30 // 5 GiB
+	maxPartCount     uint32 = 10000
+)
+
+// uploadState is persisted in a separate object while a blob upload is in
+// progress. Since the client may send chunks that are smaller than
+// minPartSizeBytes, chunks are not uploaded as parts directly. Instead,
+// incoming data is collected in the state object until enough has accumulated
+// to upload a part.
+type uploadState struct {
+	UploadID   string
+	ChunkCount uint32
+	PartCount  uint32
+	//data that was received, but not yet uploaded as a part
+	Pending []byte
+}
+
+func (d *StorageDriver) loadUploadState(account keppel.Account, storageID string) (*uploadState, error) {
+	contents, metadata, err := d.client.GetObjectWithMetadata(d.uploadStateKey(account, storageID))
+	if err != nil {
+		var s3err Error
+		if errors.As(err, &s3err) && s3err.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	chunkCount, err := strconv.ParseUint(metadata["chunk-count"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("malformed upload state for blob %s: %w", storageID, err)
+	}
+	partCount, err := strconv.ParseUint(metadata["part-count"], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("malformed upload state for blob %s: %w", storageID, err)
+	}
+	return &uploadState{
+		UploadID:   metadata["upload-id"],
+		ChunkCount: uint32(chunkCount),
+		PartCount:  uint32(partCount),
+		Pending:    contents,
+	}, nil
+}
+
+func (d *StorageDriver) saveUploadState(account keppel.Account, storageID string, state uploadState) error {
+	return d.client.PutObject(d.uploadStateKey(account, storageID), state.Pending, map[string]string{
+		"upload-id":   state.UploadID,
+		"chunk-count": strconv.FormatUint(uint64(state.ChunkCount), 10),
+		"part-count":  strconv.FormatUint(uint64(state.PartCount), 10),
+	})
+}
+
+// findUpload returns the ID of the multipart upload for the given blob, or ""
+// if there is none. This is only needed for uploads without an upload state
+// object, i.e. those that were started by older versions of this driver.
+func (d *StorageDriver) findUpload(key string) (string, error) {
+	uploads, err := d.client.ListMultipartUploads(key)
+	if err != nil {
+		return "", err
+	}
+	for _, upload := range uploads {
+		if upload.Key == key {
+			return upload.UploadID, nil
+		}
+	}
+	return "", nil
+}
+
+// AppendToBlob implements the keppel.StorageDriver interface.
+//
+// Chunks are collected in the upload state object until at least
+// minPartSizeBytes have accumulated, which are then uploaded as parts of a
+// multipart upload. Large chunks are split into multiple parts of at most
+// maxPartSizeBytes.
+func (d *StorageDriver) AppendToBlob(account keppel.Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	key := d.blobKey(account, storageID)
+	var state uploadState
+	if chunkNumber == 1 {
+		uploadID, err := d.client.CreateMultipartUpload(key)
+		if err != nil {
+			return err
+		}
+		state.UploadID = uploadID
+	} else {
+		loadedState, err := d.loadUploadState(account, storageID)
+		if err != nil {
+			return err
+		}
+		if loadedState == nil {
+			return fmt.Errorf("cannot append to blob %s: no multipart upload in progress", storageID)
+		}
+		if loadedState.ChunkCount+1 != chunkNumber {
+			return fmt.Errorf("cannot append to blob %s: expected chunk %d, but got chunk %d", storageID, loadedState.ChunkCount+1, chunkNumber)
+		}
+		state = *loadedState
+	}
+	state.ChunkCount = chunkNumber
+
+	//S3 needs to know the size of each part in advance, so chunks of unknown
+	//length need to be buffered first
+	if chunkLength == nil {
+		tmpFile, err := os.CreateTemp("", "keppel-s3-chunk-")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+		}()
+		sizeBytes, err := io.Copy(tmpFile, chunk)
+		if err != nil {
+			return err
+		}
+		_, err = tmpFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		chunk = tmpFile
+		tmpFileLength := uint64(sizeBytes)
+		chunkLength = &tmpFileLength
+	}
+
+	//upload as many parts as possible (each between minPartSizeBytes and
+	//maxPartSizeBytes), and hold back the remainder until the next chunk
+	remaining := uint64(len(state.Pending)) + *chunkLength
+	contents := io.MultiReader(bytes.NewReader(state.Pending), io.LimitReader(chunk, int64(*chunkLength)))
+	for remaining >= minPartSizeBytes {
+		partLength := remaining
+		if partLength > maxPartSizeBytes {
+			partLength = maxPartSizeBytes
+		}
+		if state.PartCount >= maxPartCount {
+			return fmt.Errorf("cannot append to blob %s: exceeds the maximum of %d parts per multipart upload", storageID, maxPartCount)
+		}
+		err := d.client.UploadPart(key, state.UploadID, state.PartCount+1, io.LimitReader(contents, int64(partLength)), partLength)
+		if err != nil {
+			return err
+		}
+		state.PartCount++
+		remaining -= partLength
+	}
+
+	//NOTE: since the remainder is smaller than minPartSizeBytes, reading it into memory is fine
+	pending, err := io.ReadAll(contents)
+	if err != nil {
+		return err
+	}
+	if uint64(len(pending)) != remaining {
+		return fmt.Errorf("cannot append to blob %s: expected %d more bytes, but got %d", storageID, remaining, len(pending))
+	}
+	state.Pending = pending
+	return d.saveUploadState(account, storageID, state)
+}
+
+// FinalizeBlob implements the keppel.StorageDriver interface.
+func (d *StorageDriver) FinalizeBlob(account keppel.Account, storageID string, chunkCount uint32) error {
+	key := d.blobKey(account, storageID)
+	state, err := d.loadUploadState(account, storageID)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("cannot finalize blob %s: no multipart upload in progress", storageID)
+	}
+	if state.ChunkCount != chunkCount {
+		return fmt.Errorf("cannot finalize blob %s: expected %d chunks, but found %d", storageID, chunkCount, state.ChunkCount)
+	}
+
+	//the last part may be smaller than minPartSizeBytes (and if the blob is
+	//very small, it may be the only part)
+	if len(state.Pending) > 0 || state.PartCount == 0 {
+		if state.PartCount >= maxPartCount {
+			return fmt.Errorf("cannot finalize blob %s: exceeds the maximum of %d parts per multipart upload", storageID, maxPartCount)
+		}
+		err := d.client.UploadPart(key, state.UploadID, state.PartCount+1, bytes.NewReader(state.Pending), uint64(len(state.Pending)))
+		if err != nil {
+			return err
+		}
+		state.PartCount++
+	}
+
+	parts, err := d.client.ListParts(key, state.UploadID)
+	if err != nil {
+		return err
+	}
+	if uint32(len(parts)) != state.PartCount {
+		return fmt.Errorf("cannot finalize blob %s: expected %d parts, but found %d", storageID, state.PartCount, len(parts))
+	}
+	err = d.client.CompleteMultipartUpload(key, state.UploadID, parts)
+	if err != nil {
+		return err
+	}
+	return d.client.DeleteObject(d.uploadStateKey(account, storageID))
+}
+
+// AbortBlobUpload implements the keppel.StorageDriver interface.
+func (d *StorageDriver) AbortBlobUpload(account keppel.Account, storageID string, chunkCount uint32) error {
+	key := d.blobKey(account, storageID)
+	state, err := d.loadUploadState(account, storageID)
+	if err != nil {
+		return err
+	}
+	var uploadID string
+	if state == nil {
+		uploadID, err = d.findUpload(key)
+		if err != nil {
+			return err
+		}
+	} else {
+		uploadID = state.UploadID
+	}
+
+	if uploadID != "" {
+		err = d.client.AbortMultipartUpload(key, uploadID)
+		if err != nil {
+			var s3err Error
+			if !errors.As(err, &s3err) || s3err.StatusCode != http.StatusNotFound {
+				return err
+			}
+		}
+	}
+	return d.client.DeleteObject(d.uploadStateKey(account, storageID))
+}
+
+// ReadBlob implements the keppel.StorageDriver interface.
+func (d *StorageDriver) ReadBlob(account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	return d.ReadBlobWithContext(context.Background(), account, storageID)
+}
+
+// ReadBlobWithContext implements the keppel.ContextReader interface.
+func (d *StorageDriver) ReadBlobWithContext(ctx context.Context, account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	return d.client.GetObject(ctx, d.blobKey(account, storageID))
+}
+
+// ReadBlobRange implements the keppel.BlobRangeReader interface.
+func (d *StorageDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	return d.client.GetObjectRange(d.blobKey(account, storageID), offset, length)
+}
+
+// URLForBlob implements the keppel.StorageDriver interface.
+func (d *StorageDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
+	return d.URLForBlobWithTTL(account, storageID, 20*time.Minute)
+}
+
+// URLForBlobWithTTL implements the keppel.ExpiringBlobURLGenerator interface.
+func (d *StorageDriver) URLForBlobWithTTL(account keppel.Account, storageID string, ttl time.Duration) (string, error) {
+	return d.client.PresignedURL(d.blobKey(account, storageID), ttl), nil
+}
+
+// DeleteBlob implements the keppel.StorageDriver interface.
+func (d *StorageDriver) DeleteBlob(account keppel.Account, storageID string) error {
+	return d.client.DeleteObject(d.blobKey(account, storageID))
+}
+
+// ReadManifest implements the keppel.StorageDriver interface.
+func (d *StorageDriver) ReadManifest(account keppel.Account, repoName, digest string) ([]byte, error) {
+	reader, err := d.ReadManifestStream(account, repoName, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// ReadManifestStream implements the keppel.ManifestStreamer interface.
+func (d *StorageDriver) ReadManifestStream(account keppel.Account, repoName, digest string) (io.ReadCloser, error) {
+	return d.ReadManifestStreamWithContext(context.Background(), account, repoName, digest)
+}
+
+// ReadManifestStreamWithContext implements the keppel.ContextReader interface.
+func (d *StorageDriver) ReadManifestStreamWithContext(ctx context.Context, account keppel.Account, repoName, digest string) (io.ReadCloser, error) {
+	reader, _, err := d.client.GetObject(ctx, d.manifestKey(account, repoName, digest))
+	return reader, err
+}
+
+// WriteManifest implements the keppel.StorageDriver interface.
+func (d *StorageDriver) WriteManifest(account keppel.Account, repoName, digest string, contents []byte) error {
+	return d.client.PutObject(d.manifestKey(account, repoName, digest), contents, nil)
+}
+
+// DeleteManifest implements the keppel.StorageDriver interface.
+func (d *StorageDriver) DeleteManifest(account keppel.Account, repoName, digest string) error {
+	return d.client.DeleteObject(d.manifestKey(account, repoName, digest))
+}
+
+var (
+	//These regexes are used to recover the storage ID of a blob, or the repo
+	//name and digest of a manifest from the object key. They're kinda the
+	//reverse of func blobKey() and func manifestKey().
+	blobKeyRx        = regexp.MustCompile(`^_blobs/([^/]+)$`)
+	uploadStateKeyRx = regexp.MustCompile(`^_uploads/([^/]+)$`)
+	manifestKeyRx    = regexp.MustCompile(`^(.+)/_manifests/([^/]+)$`)
+)
+
+// ListStorageContents implements the keppel.StorageDriver interface.
+func (d *StorageDriver) ListStorageContents(account keppel.Account) ([]keppel.StoredBlobInfo, []keppel.StoredManifestInfo, error) {
+	prefix := d.accountPrefix(account)
+	keys, err := d.client.ListObjects(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blobs := []keppel.StoredBlobInfo{}
+	manifests := []keppel.StoredManifestInfo{}
+	isListedBlob := make(map[string]bool)
+	var unfinishedStorageIDs []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if match := blobKeyRx.FindStringSubmatch(name); match != nil {
+			blobs = append(blobs, keppel.StoredBlobInfo{StorageID: match[1]})
+			isListedBlob[match[1]] = true
+			continue
+		}
+		if match := uploadStateKeyRx.FindStringSubmatch(name); match != nil {
+			unfinishedStorageIDs = append(unfinishedStorageIDs, match[1])
+			continue
+		}
+		if match := manifestKeyRx.FindStringSubmatch(name); match != nil {
+			manifests = append(manifests, keppel.StoredManifestInfo{
+				RepoName: match[1],
+				Digest:   match[2],
+			})
+			continue
+		}
+		return nil, nil, fmt.Errorf("encountered unexpected object while listing storage contents of account %s: %s", account.Name, key)
+	}
+
+	uploads, err := d.client.ListMultipartUploads(prefix + "_blobs/")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, upload := range uploads {
+		match := blobKeyRx.FindStringSubmatch(strings.TrimPrefix(upload.Key, prefix))
+		if match == nil {
+			return nil, nil, fmt.Errorf("encountered unexpected multipart upload while listing storage contents of account %s: %s", account.Name, upload.Key)
+		}
+		unfinishedStorageIDs = append(unfinishedStorageIDs, match[1])
+	}
+	for _, storageID := range unfinishedStorageIDs {
+		if !isListedBlob[storageID] {
+			blobs = append(blobs, keppel.StoredBlobInfo{
+				StorageID: storageID,
+				//AbortBlobUpload() does not care about the exact number of chunks
+				ChunkCount: 1,
+			})
+			isListedBlob[storageID] = true
+		}
+	}
+
+	return blobs, manifests, nil
+}
+
+// CanSetupAccount implements the keppel.StorageDriver interface.
+func (d *StorageDriver) CanSetupAccount(account keppel.Account) error {
+	return nil //this driver does not perform any preflight checks here
+}
+
+// CleanupAccount implements the keppel.StorageDriver interface.
+func (d *StorageDriver) CleanupAccount(account keppel.Account) error {
+	//double-check that cleanup order is right; when the account gets deleted,
+	//all blobs and manifests must have been deleted from it before
+	storedBlobs, storedManifests, err := d.ListStorageContents(account)
+	if len(storedBlobs) > 0 {
+		return fmt.Errorf(
+			"found undeleted blob during CleanupAccount: storageID = %q",
+			storedBlobs[0].StorageID,
+		)
+	}
+	if len(storedManifests) > 0 {
+		return fmt.Errorf(
+			"found undeleted manifest during CleanupAccount: %s@%s",
+			storedManifests[0].RepoName,
+			storedManifests[0].Digest,
+		)
+	}
+	return err
+}
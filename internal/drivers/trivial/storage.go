@@ -41,6 +41,9 @@ type StorageDriver struct {
 	manifests         map[string][]byte
 	AllowDummyURLs    bool
 	ForbidNewAccounts bool
+	//If true, FinalizeBlob() flips the first byte of the blob contents (for
+	//testing the verification of written blobs).
+	CorruptFinalizedBlobs bool
 }
 
 // PluginTypeID implements the keppel.StorageDriver interface.
@@ -105,6 +108,9 @@ func (d *StorageDriver) FinalizeBlob(account keppel.Account, storageID string, c
 		return errNoSuchBlob
 	}
 	d.blobChunkCounts[k] = 0 //mark as finalized
+	if d.CorruptFinalizedBlobs && len(d.blobs[k]) > 0 {
+		d.blobs[k][0] ^= 0xFF
+	}
 	return nil
 }
 
@@ -125,6 +131,18 @@ func (d *StorageDriver) ReadBlob(account keppel.Account, storageID string) (io.R
 	return io.NopCloser(bytes.NewReader(contents)), uint64(len(contents)), nil
 }
 
+// ReadBlobRange implements the keppel.BlobRangeReader interface.
+func (d *StorageDriver) ReadBlobRange(account keppel.Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	contents, exists := d.blobs[blobKey(account, storageID)]
+	if !exists {
+		return nil, errNoSuchBlob
+	}
+	if offset+length > uint64(len(contents)) {
+		return nil, fmt.Errorf("range %d+%d exceeds size of blob %s", offset, length, storageID)
+	}
+	return io.NopCloser(bytes.NewReader(contents[offset : offset+length])), nil
+}
+
 // URLForBlob implements the keppel.StorageDriver interface.
 func (d *StorageDriver) URLForBlob(account keppel.Account, storageID string) (string, error) {
 	if d.AllowDummyURLs {
@@ -0,0 +1,136 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"errors"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/pluggable"
+)
+
+// AdmissionAction appears in type AdmissionRequest.
+type AdmissionAction string
+
+const (
+	//AdmitUntaggedPush is a manifest push that does not create or move any
+	//tags, e.g. the push of a platform submanifest by digest.
+	AdmitUntaggedPush AdmissionAction = "untagged-push"
+	//AdmitTaggedPush is a manifest push that creates or moves at least one tag,
+	//either through the reference in the URL or through `?tag=` parameters.
+	AdmitTaggedPush AdmissionAction = "tagged-push"
+	//AdmitPull is a manifest pull by a regular user. (Pulls by peers are not
+	//checked since replication must not be impeded by admission policies.)
+	AdmitPull AdmissionAction = "pull"
+)
+
+// AdmissionRequest contains everything that an AdmissionPolicy can look at
+// when deciding whether a manifest push or pull shall be admitted.
+type AdmissionRequest struct {
+	Action     AdmissionAction
+	Account    Account
+	Repository Repository
+	//Manifest has all fields filled that can be derived from the manifest
+	//contents (esp. Digest, MediaType and SizeBytes).
+	Manifest Manifest
+	Parsed   ParsedManifest
+	//Labels are the labels that will be reported for this manifest. For image
+	//manifests, these come from the image configuration and annotations; for
+	//list manifests, these are the labels that all submanifests agree on.
+	Labels map[string]string
+	//Lookup can be used to inspect other objects in the same repository.
+	Lookup AdmissionLookup
+}
+
+// AdmissionLookup allows an AdmissionPolicy to inspect other objects in the
+// repository that a manifest is being pushed into, e.g. to find signatures
+// that were pushed alongside the manifest.
+type AdmissionLookup interface {
+	//FindManifestByTag returns the contents and media type of the manifest that
+	//the given tag points to. If there is no such tag, sql.ErrNoRows is returned.
+	FindManifestByTag(tagName string) (contents []byte, mediaType string, err error)
+	//ReadBlob returns the contents of the given blob. If the blob is not
+	//mounted in the repository, sql.ErrNoRows is returned.
+	ReadBlob(blobDigest digest.Digest) ([]byte, error)
+	//ListParentManifests returns the digests of all list manifests in the
+	//repository that reference the manifest with the given digest.
+	ListParentManifests(manifestDigest string) ([]string, error)
+}
+
+// AdmissionPolicy is a pluggable interface for custom rules that decide
+// whether a manifest may be pushed into or pulled from Keppel. For pushes, it
+// is called while the manifest push is being validated, after the manifest
+// has been parsed, but before it is stored. Since this happens within a DB
+// transaction, implementations must not block for extended periods of time.
+type AdmissionPolicy interface {
+	pluggable.Plugin
+	//Init is called before any other interface methods, and allows the plugin to
+	//perform first-time initialization.
+	Init() error
+
+	//AdmitManifest returns nil if the push or pull shall be admitted, or an
+	//error explaining why it is rejected. If the error is a *RegistryV2Error, it
+	//will be shown to the client as-is. Other errors will be shown as a DENIED error.
+	AdmitManifest(req AdmissionRequest) error
+	//TagsRequiredForAdmission returns the names of tags that AdmitManifest()
+	//will look at when admitting the given manifest. When a manifest is
+	//replicated into a replica account, these tags are replicated from
+	//upstream first (if they exist there), so that AdmitManifest() can find them.
+	TagsRequiredForAdmission(account Account, manifestDigest string, parsed ParsedManifest) []string
+}
+
+// AdmissionPolicyRegistry is a pluggable.Registry for AdmissionPolicy implementations.
+var AdmissionPolicyRegistry pluggable.Registry[AdmissionPolicy]
+
+// NewAdmissionPolicy creates a new AdmissionPolicy using one of the plugins
+// registered with AdmissionPolicyRegistry. If no plugin type ID is given, the
+// AllowAllAdmissionPolicy is used.
+func NewAdmissionPolicy(pluginTypeID string) (AdmissionPolicy, error) {
+	if pluginTypeID == "" {
+		return AllowAllAdmissionPolicy{}, nil
+	}
+	ap := AdmissionPolicyRegistry.Instantiate(pluginTypeID)
+	if ap == nil {
+		return nil, errors.New("no such admission policy: " + pluginTypeID)
+	}
+	return ap, ap.Init()
+}
+
+// AllowAllAdmissionPolicy is an AdmissionPolicy that admits every manifest.
+// This is the default when no admission policy is configured.
+type AllowAllAdmissionPolicy struct{}
+
+func init() {
+	AdmissionPolicyRegistry.Add(func() AdmissionPolicy { return AllowAllAdmissionPolicy{} })
+}
+
+// PluginTypeID implements the AdmissionPolicy interface.
+func (AllowAllAdmissionPolicy) PluginTypeID() string { return "allow-all" }
+
+// Init implements the AdmissionPolicy interface.
+func (AllowAllAdmissionPolicy) Init() error { return nil }
+
+// AdmitManifest implements the AdmissionPolicy interface.
+func (AllowAllAdmissionPolicy) AdmitManifest(req AdmissionRequest) error { return nil }
+
+// TagsRequiredForAdmission implements the AdmissionPolicy interface.
+func (AllowAllAdmissionPolicy) TagsRequiredForAdmission(Account, string, ParsedManifest) []string {
+	return nil
+}
@@ -83,6 +83,27 @@ type AuthDriver interface {
 	AuthenticateUserFromRequest(r *http.Request) (UserIdentity, *RegistryV2Error)
 }
 
+// AccountValidator is an optional interface that an AuthDriver can implement
+// to take part in the validation of accounts that are being created or updated.
+type AccountValidator interface {
+	//ValidateAccount is called with the name and tenant ID of an account that
+	//is about to be created or updated, after ValidateTenantID() has succeeded.
+	//It returns the normalized form of the tenant ID, which will be stored in
+	//the account. If the driver does not allow this account to exist in this
+	//tenant, an error explaining why shall be returned instead.
+	ValidateAccount(accountName, tenantID string) (normalizedTenantID string, err error)
+}
+
+// ValidateAccount calls AccountValidator.ValidateAccount() if the given
+// AuthDriver implements that interface. Otherwise, the tenant ID is accepted
+// unchanged.
+func ValidateAccount(ad AuthDriver, accountName, tenantID string) (string, error) {
+	if av, ok := ad.(AccountValidator); ok {
+		return av.ValidateAccount(accountName, tenantID)
+	}
+	return tenantID, nil
+}
+
 // AuthDriverRegistry is a pluggable.Registry for AuthDriver implementations.
 var AuthDriverRegistry pluggable.Registry[AuthDriver]
 
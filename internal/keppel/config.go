@@ -20,14 +20,21 @@
 package keppel
 
 import (
+	"context"
 	"crypto"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/redis/go-redis/v9"
@@ -45,18 +52,173 @@ type Configuration struct {
 	APIPublicHostname        string
 	AnycastAPIPublicHostname string
 	DatabaseURL              *url.URL
-	JWTIssuerKeys            []crypto.PrivateKey
-	AnycastJWTIssuerKeys     []crypto.PrivateKey
+	DatabasePool             DBPoolConfiguration
+	JWTIssuerKeys            []IssuerKey
+	AnycastJWTIssuerKeys     []IssuerKey
 	ClairClient              *clair.Client
+	//TokenSubjectSource selects what goes into the "sub" claim of issued tokens.
+	TokenSubjectSource TokenSubjectSource
+	//PeerHTTPClient is used for all requests to our peers. If nil,
+	//http.DefaultClient is used instead (see HTTPClientForPeers).
+	PeerHTTPClient *http.Client
+	//UpstreamRateLimits is used for all requests to upstream registries during
+	//replication. If nil, those requests are not rate-limited.
+	UpstreamRateLimits *UpstreamRateLimits
+	//If non-zero, manifest downloads from upstream registries during
+	//replication fail when they take longer than this, and blob downloads fail
+	//when they stall for longer than this.
+	ReplicationTimeout time.Duration
+	//If non-zero, manifests in replica accounts that were deleted in the
+	//upstream account are only soft-deleted by the manifest sync, and purged
+	//after this duration. Until then, they can be restored.
+	DeletedManifestRetention time.Duration
+	//ReplicationLimits limits how many blobs can be replicated into each
+	//account at once. If nil, concurrent replications are not limited, not
+	//even for accounts that configure their own limit.
+	ReplicationLimits *ReplicationLimits
+	//EventSink receives events like manifest pushes. If nil, events are
+	//discarded (see Events).
+	EventSink EventSink
+	//If true, manifest annotations take precedence over labels from the image
+	//configuration when both have the same key.
+	PreferAnnotationsOverLabels bool
+	//If true, the per-repository traffic metrics do not have a "repo" label.
+	//This guards against excessive metric cardinality in very large registries.
+	DisableRepoMetricLabels bool
+	//If true, the global catalog endpoint (GET /v2/_catalog) is disabled.
+	//Repositories can still be listed per account.
+	DisableCatalog bool
+	//May be nil, in which case tracing is disabled. Use Tracing() to access.
+	Tracer Tracer
+	//If not empty, storage drivers put all their objects below this path, so
+	//that multiple Keppel instances can share one storage backend.
+	StoragePrefix string
+	//How idempotent storage driver operations are retried when they fail with
+	//a transient error. The zero value disables retries.
+	StorageRetries StorageRetryPolicy
+	//Fraction (between 0 and 1) of manifest and blob pulls for which the digest
+	//of the served contents is recomputed to detect storage corruption. If 0,
+	//served contents are not verified.
+	VerifyOnReadSampleRate float64
+	//If true, blob contents are read back from the storage after each upload
+	//and checked against their digest before the blob is committed. This
+	//catches corruption on the way into the storage, at the cost of reading
+	//each uploaded blob once more.
+	VerifyOnWrite bool
+	//If non-zero, requests on the Registry API that upload manifests or blob
+	//contents are rejected when their body is larger than this.
+	MaxRequestBodySizeBytes uint64
+	//If non-zero, manifests with more image layers than this are rejected when
+	//they are pushed.
+	MaxLayersPerManifest uint64
+	//AdmissionPolicy decides whether manifest pushes are admitted. If nil, all
+	//pushes are admitted (see Admission).
+	AdmissionPolicy AdmissionPolicy
+	//If true, manifest pushes are rejected if their media type is not in
+	//AllowedManifestMediaTypes (or in DefaultManifestMediaTypes if that is
+	//empty), without attempting to parse the manifest.
+	StrictManifestMediaTypes  bool
+	AllowedManifestMediaTypes []string
+	//Which cross-origin requests are allowed by browsers. The zero value
+	//disables CORS.
+	CORS CORSPolicy
+	//If not empty, account webhooks may only point to these hosts (see
+	//CheckWebhookURL).
+	WebhookAllowedHosts []string
+	//Reverse proxies whose X-Forwarded-For headers are believed when
+	//determining the requester IP (see RequesterIP). If empty, the requester IP
+	//is always taken from the connection itself.
+	TrustedProxies []*net.IPNet
+}
+
+// StorageRetryPolicy configures how idempotent storage driver operations are
+// retried when they fail with a transient error (see IsRetryableStorageError).
+type StorageRetryPolicy struct {
+	//Total number of attempts per operation. Values below 2 disable retries.
+	MaxAttempts int
+	//Delay before the first retry. The delay doubles with each further retry,
+	//up to a maximum of 10 seconds.
+	InitialBackoff time.Duration
+}
+
+// CORSPolicy contains the configuration for CORS headers on all API responses.
+type CORSPolicy struct {
+	//If empty, CORS is disabled entirely. May contain "*" to allow all origins.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+// Events returns the EventSink that shall receive all emitted events.
+func (cfg Configuration) Events() EventSink {
+	if cfg.EventSink == nil {
+		return NoopEventSink{}
+	}
+	return cfg.EventSink
+}
+
+// Admission returns the AdmissionPolicy that shall be consulted for manifest pushes and pulls.
+func (cfg Configuration) Admission() AdmissionPolicy {
+	if cfg.AdmissionPolicy == nil {
+		return AllowAllAdmissionPolicy{}
+	}
+	return cfg.AdmissionPolicy
+}
+
+// IsManifestMediaTypeAllowed returns whether manifests with the given media
+// type may be pushed. This only takes effect if StrictManifestMediaTypes is set.
+func (cfg Configuration) IsManifestMediaTypeAllowed(mediaType string) bool {
+	allowed := cfg.AllowedManifestMediaTypes
+	if len(allowed) == 0 {
+		allowed = DefaultManifestMediaTypes
+	}
+	for _, t := range allowed {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracing returns the Tracer that shall be used to instrument requests.
+func (cfg Configuration) Tracing() Tracer {
+	if cfg.Tracer == nil {
+		return NoopTracer{}
+	}
+	return cfg.Tracer
+}
+
+// HTTPClientForPeers returns the HTTP client that shall be used for requests
+// to our peers.
+func (cfg Configuration) HTTPClientForPeers() *http.Client {
+	if cfg.PeerHTTPClient == nil {
+		return http.DefaultClient
+	}
+	return cfg.PeerHTTPClient
 }
 
 var (
 	looksLikePEMRx    = regexp.MustCompile(`^\s*-----\s*BEGIN`)
 	stripWhitespaceRx = regexp.MustCompile(`(?m)^\s*|\s*$`)
+	//each path element must start with an alphanumeric character, which rules
+	//out the special path elements "." and ".."
+	storagePrefixRx = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*(?:/[a-zA-Z0-9][a-zA-Z0-9._-]*)*$`)
 )
 
+// IssuerKey is the private key that Keppel uses to sign the tokens it issues.
+// Signing goes exclusively through the crypto.Signer interface, so the key
+// material does not need to be held in memory: An implementation may forward
+// the signing operation to a KMS or HSM. Only ed25519 and RSA keys are
+// supported, as determined by the type of Public().
+//
+// The default implementation is the in-memory private key that
+// ParseIssuerKey() reads from PEM or from a file.
+type IssuerKey interface {
+	crypto.Signer
+}
+
 // ParseIssuerKey parses the contents of the KEPPEL_ISSUER_KEY variable.
-func ParseIssuerKey(in string) (crypto.PrivateKey, error) {
+func ParseIssuerKey(in string) (IssuerKey, error) {
 	//if it looks like PEM, it's probably PEM; otherwise it's a filename
 	var buf []byte
 	if looksLikePEMRx.MatchString(in) {
@@ -77,7 +239,11 @@ func ParseIssuerKey(in string) (crypto.PrivateKey, error) {
 	//to ed25519
 	ed25519Key, err1 := jwt.ParseEdPrivateKeyFromPEM(buf)
 	if err1 == nil {
-		return ed25519Key, nil
+		signer, ok := ed25519Key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("ed25519 private key of type %T cannot be used for signing", ed25519Key)
+		}
+		return signer, nil
 	}
 	rsaKey, err2 := jwt.ParseRSAPrivateKeyFromPEM(buf)
 	if err2 == nil {
@@ -101,27 +267,33 @@ func ParseConfiguration() Configuration {
 		ConnectionOptions: os.Getenv("KEPPEL_DB_CONNECTION_OPTIONS"),
 		DatabaseName:      osext.GetenvOrDefault("KEPPEL_DB_NAME", "keppel"),
 	}))
+	cfg.DatabasePool = must.Return(ParseDBPoolConfiguration())
 
-	parseIssuerKeys := func(prefix string) []crypto.PrivateKey {
+	parseIssuerKeys := func(prefix string) []IssuerKey {
 		key, err := ParseIssuerKey(osext.MustGetenv(prefix + "_ISSUER_KEY"))
 		if err != nil {
 			logg.Fatal("failed to read %s_ISSUER_KEY: %s", prefix, err.Error())
 		}
 		prevKeyStr := os.Getenv(prefix + "_PREVIOUS_ISSUER_KEY")
 		if prevKeyStr == "" {
-			return []crypto.PrivateKey{key}
+			return []IssuerKey{key}
 		}
 		prevKey, err := ParseIssuerKey(prevKeyStr)
 		if err != nil {
 			logg.Fatal("failed to read %s_PREVIOUS_ISSUER_KEY: %s", prefix, err.Error())
 		}
-		return []crypto.PrivateKey{key, prevKey}
+		return []IssuerKey{key, prevKey}
 	}
 
 	cfg.JWTIssuerKeys = parseIssuerKeys("KEPPEL")
 	if cfg.AnycastAPIPublicHostname != "" {
 		cfg.AnycastJWTIssuerKeys = parseIssuerKeys("KEPPEL_ANYCAST")
 	}
+	tokenSubjectSource, err := ParseTokenSubjectSource(os.Getenv("KEPPEL_TOKEN_SUBJECT"))
+	if err != nil {
+		logg.Fatal("invalid value for KEPPEL_TOKEN_SUBJECT: " + err.Error())
+	}
+	cfg.TokenSubjectSource = tokenSubjectSource
 
 	clairURL := mayGetenvURL("KEPPEL_CLAIR_URL")
 	if clairURL != nil {
@@ -138,9 +310,165 @@ func ParseConfiguration() Configuration {
 		}
 	}
 
+	peerTLSConfig, err := ParsePeerTLSConfig(
+		os.Getenv("KEPPEL_PEER_CLIENT_CERT"),
+		os.Getenv("KEPPEL_PEER_CLIENT_KEY"),
+		os.Getenv("KEPPEL_PEER_CA_CERT"),
+	)
+	if err != nil {
+		logg.Fatal("failed to read peer TLS configuration: " + err.Error())
+	}
+	if peerTLSConfig != nil {
+		cfg.PeerHTTPClient = NewPeerHTTPClient(peerTLSConfig)
+	}
+
+	rateLimitStr := os.Getenv("KEPPEL_UPSTREAM_RATELIMIT")
+	if rateLimitStr != "" {
+		requestsPerSecond, err := strconv.ParseFloat(rateLimitStr, 64)
+		if err != nil || requestsPerSecond <= 0 {
+			logg.Fatal("invalid value for KEPPEL_UPSTREAM_RATELIMIT: %q", rateLimitStr)
+		}
+		burstStr := osext.GetenvOrDefault("KEPPEL_UPSTREAM_RATELIMIT_BURST", "1")
+		burst, err := strconv.ParseUint(burstStr, 10, 64)
+		if err != nil {
+			logg.Fatal("invalid value for KEPPEL_UPSTREAM_RATELIMIT_BURST: %q", burstStr)
+		}
+		cfg.UpstreamRateLimits = NewUpstreamRateLimits(requestsPerSecond, burst)
+	}
+
+	replicationTimeoutStr := osext.GetenvOrDefault("KEPPEL_REPLICATION_TIMEOUT", "1m")
+	cfg.ReplicationTimeout, err = time.ParseDuration(replicationTimeoutStr)
+	if err != nil || cfg.ReplicationTimeout < 0 {
+		logg.Fatal("invalid value for KEPPEL_REPLICATION_TIMEOUT: %q", replicationTimeoutStr)
+	}
+
+	if retentionStr := os.Getenv("KEPPEL_DELETED_MANIFEST_RETENTION"); retentionStr != "" {
+		cfg.DeletedManifestRetention, err = time.ParseDuration(retentionStr)
+		if err != nil || cfg.DeletedManifestRetention < 0 {
+			logg.Fatal("invalid value for KEPPEL_DELETED_MANIFEST_RETENTION: %q", retentionStr)
+		}
+	}
+
+	var defaultMaxConcurrentReplications uint64
+	replicationLimitStr := os.Getenv("KEPPEL_MAX_CONCURRENT_REPLICATIONS_PER_ACCOUNT")
+	if replicationLimitStr != "" {
+		defaultMaxConcurrentReplications, err = strconv.ParseUint(replicationLimitStr, 10, 64)
+		if err != nil || defaultMaxConcurrentReplications == 0 {
+			logg.Fatal("invalid value for KEPPEL_MAX_CONCURRENT_REPLICATIONS_PER_ACCOUNT: %q", replicationLimitStr)
+		}
+	}
+	cfg.ReplicationLimits = NewReplicationLimits(defaultMaxConcurrentReplications)
+
+	cfg.EventSink, err = ParseEventSinks(os.Getenv("KEPPEL_EVENT_SINKS"))
+	if err != nil {
+		logg.Fatal("invalid value for KEPPEL_EVENT_SINKS: " + err.Error())
+	}
+
+	cfg.PreferAnnotationsOverLabels = osext.GetenvBool("KEPPEL_PREFER_ANNOTATIONS_OVER_LABELS")
+	cfg.DisableRepoMetricLabels = osext.GetenvBool("KEPPEL_DISABLE_REPO_METRIC_LABELS")
+	cfg.DisableCatalog = osext.GetenvBool("KEPPEL_DISABLE_CATALOG")
+	cfg.StoragePrefix = os.Getenv("KEPPEL_STORAGE_PREFIX")
+	if cfg.StoragePrefix != "" && !storagePrefixRx.MatchString(cfg.StoragePrefix) {
+		logg.Fatal("malformed KEPPEL_STORAGE_PREFIX: %q", cfg.StoragePrefix)
+	}
+	retryAttemptsStr := osext.GetenvOrDefault("KEPPEL_STORAGE_RETRY_MAX_ATTEMPTS", "3")
+	cfg.StorageRetries.MaxAttempts, err = strconv.Atoi(retryAttemptsStr)
+	if err != nil || cfg.StorageRetries.MaxAttempts < 1 {
+		logg.Fatal("invalid value for KEPPEL_STORAGE_RETRY_MAX_ATTEMPTS: %q", retryAttemptsStr)
+	}
+	retryBackoffStr := osext.GetenvOrDefault("KEPPEL_STORAGE_RETRY_BACKOFF", "200ms")
+	cfg.StorageRetries.InitialBackoff, err = time.ParseDuration(retryBackoffStr)
+	if err != nil || cfg.StorageRetries.InitialBackoff < 0 {
+		logg.Fatal("invalid value for KEPPEL_STORAGE_RETRY_BACKOFF: %q", retryBackoffStr)
+	}
+	if maxBodySizeStr := os.Getenv("KEPPEL_MAX_REQUEST_BODY_SIZE"); maxBodySizeStr != "" {
+		cfg.MaxRequestBodySizeBytes, err = strconv.ParseUint(maxBodySizeStr, 10, 64)
+		if err != nil {
+			logg.Fatal("invalid value for KEPPEL_MAX_REQUEST_BODY_SIZE: " + err.Error())
+		}
+	}
+	if maxLayersStr := os.Getenv("KEPPEL_MAX_LAYERS_PER_MANIFEST"); maxLayersStr != "" {
+		cfg.MaxLayersPerManifest, err = strconv.ParseUint(maxLayersStr, 10, 64)
+		if err != nil {
+			logg.Fatal("invalid value for KEPPEL_MAX_LAYERS_PER_MANIFEST: " + err.Error())
+		}
+	}
+	if sampleRateStr := os.Getenv("KEPPEL_VERIFY_ON_READ_SAMPLE_RATE"); sampleRateStr != "" {
+		cfg.VerifyOnReadSampleRate, err = strconv.ParseFloat(sampleRateStr, 64)
+		if err == nil && (cfg.VerifyOnReadSampleRate < 0 || cfg.VerifyOnReadSampleRate > 1) {
+			err = errors.New("must be between 0 and 1")
+		}
+		if err != nil {
+			logg.Fatal("invalid value for KEPPEL_VERIFY_ON_READ_SAMPLE_RATE: " + err.Error())
+		}
+	}
+	cfg.VerifyOnWrite = osext.GetenvBool("KEPPEL_VERIFY_ON_WRITE")
+	cfg.StrictManifestMediaTypes = osext.GetenvBool("KEPPEL_STRICT_MANIFEST_MEDIA_TYPES")
+	cfg.AllowedManifestMediaTypes = getenvList("KEPPEL_ALLOWED_MANIFEST_MEDIA_TYPES", "")
+	cfg.CORS = CORSPolicy{
+		AllowedOrigins: getenvList("KEPPEL_API_CORS_ALLOWED_ORIGINS", ""),
+		AllowedMethods: getenvList("KEPPEL_API_CORS_ALLOWED_METHODS", "HEAD,GET,POST,PUT,DELETE"),
+		AllowedHeaders: getenvList("KEPPEL_API_CORS_ALLOWED_HEADERS", "Content-Type,User-Agent,Authorization,X-Auth-Token,X-Keppel-Sublease-Token"),
+	}
+	cfg.WebhookAllowedHosts = getenvList("KEPPEL_WEBHOOK_ALLOWED_HOSTS", "")
+	cfg.TrustedProxies, err = ParseTrustedProxies(getenvList("KEPPEL_API_TRUSTED_PROXIES", ""))
+	if err != nil {
+		logg.Fatal("invalid value for KEPPEL_API_TRUSTED_PROXIES: " + err.Error())
+	}
+	cfg.AdmissionPolicy, err = NewAdmissionPolicy(os.Getenv("KEPPEL_ADMISSION_POLICY"))
+	if err != nil {
+		logg.Fatal("cannot initialize admission policy: " + err.Error())
+	}
+	cfg.Tracer, err = ParseTracer(os.Getenv("KEPPEL_TRACING"))
+	if err != nil {
+		logg.Fatal("invalid tracing configuration: " + err.Error())
+	}
+	if cfg.ClairClient != nil {
+		tracer := cfg.Tracer
+		cfg.ClairClient.StartSpan = func(ctx context.Context, name string) (context.Context, func(error)) {
+			ctx, span := tracer.StartSpan(ctx, name)
+			return ctx, span.End
+		}
+	}
+
 	return cfg
 }
 
+// ParsePeerTLSConfig builds the TLS configuration for mutual authentication
+// with our peers from the contents of the KEPPEL_PEER_CLIENT_CERT,
+// KEPPEL_PEER_CLIENT_KEY and KEPPEL_PEER_CA_CERT variables. All arguments are
+// paths to PEM files. If neither client certificate nor CA are given, nil is
+// returned, and requests to peers will only be authenticated with tokens.
+func ParsePeerTLSConfig(certPath, keyPath, caPath string) (*tls.Config, error) {
+	if certPath == "" && keyPath == "" && caPath == "" {
+		return nil, nil
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, errors.New("KEPPEL_PEER_CLIENT_CERT and KEPPEL_PEER_CLIENT_KEY must be given together")
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caPath != "" {
+		buf, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no valid certificates found in %s", caPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
 func mayGetenvURL(key string) *url.URL {
 	val := os.Getenv(key)
 	if val == "" {
@@ -153,6 +481,19 @@ func mayGetenvURL(key string) *url.URL {
 	return parsed
 }
 
+// Reads a comma-separated list from the given environment variable, or from
+// the default value if the variable is empty.
+func getenvList(key, defaultValue string) []string {
+	var result []string
+	for _, val := range strings.Split(osext.GetenvOrDefault(key, defaultValue), ",") {
+		val = strings.TrimSpace(val)
+		if val != "" {
+			result = append(result, val)
+		}
+	}
+	return result
+}
+
 // GetRedisOptions returns a redis.Options by getting the required parameters
 // from environment variables:
 //
@@ -20,10 +20,16 @@
 package keppel
 
 import (
+	"errors"
+	"fmt"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/easypg"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
 )
 
 var sqlMigrations = map[string]string{
@@ -219,6 +225,165 @@ var sqlMigrations = map[string]string{
 		DROP TABLE rbac_policies;
 		DROP TABLE accounts;
 	`,
+	"032_add_accounts_default_platform_json.up.sql": `
+		ALTER TABLE accounts ADD COLUMN default_platform_json TEXT NOT NULL DEFAULT '';
+	`,
+	"032_add_accounts_default_platform_json.down.sql": `
+		ALTER TABLE accounts DROP COLUMN default_platform_json;
+	`,
+	"033_add_accounts_webhook.up.sql": `
+		ALTER TABLE accounts ADD COLUMN webhook_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE accounts ADD COLUMN webhook_secret TEXT NOT NULL DEFAULT '';
+	`,
+	"033_add_accounts_webhook.down.sql": `
+		ALTER TABLE accounts DROP COLUMN webhook_url;
+		ALTER TABLE accounts DROP COLUMN webhook_secret;
+	`,
+	"034_add_accounts_block_pull_above_severity.up.sql": `
+		ALTER TABLE accounts ADD COLUMN block_pull_above_severity TEXT NOT NULL DEFAULT '';
+	`,
+	"034_add_accounts_block_pull_above_severity.down.sql": `
+		ALTER TABLE accounts DROP COLUMN block_pull_above_severity;
+	`,
+	"035_add_accounts_deny_delete_via_token.up.sql": `
+		ALTER TABLE accounts ADD COLUMN deny_delete_via_token BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	"035_add_accounts_deny_delete_via_token.down.sql": `
+		ALTER TABLE accounts DROP COLUMN deny_delete_via_token;
+	`,
+	"036_add_accounts_external_peer_cache_ttl_secs.up.sql": `
+		ALTER TABLE accounts ADD COLUMN external_peer_cache_ttl_secs BIGINT NOT NULL DEFAULT 0;
+	`,
+	"036_add_accounts_external_peer_cache_ttl_secs.down.sql": `
+		ALTER TABLE accounts DROP COLUMN external_peer_cache_ttl_secs;
+	`,
+	"037_add_accounts_replication_repo_filters.up.sql": `
+		ALTER TABLE accounts
+			ADD COLUMN replication_include_repos TEXT NOT NULL DEFAULT '',
+			ADD COLUMN replication_exclude_repos TEXT NOT NULL DEFAULT '';
+	`,
+	"037_add_accounts_replication_repo_filters.down.sql": `
+		ALTER TABLE accounts
+			DROP COLUMN replication_include_repos,
+			DROP COLUMN replication_exclude_repos;
+	`,
+	"038_add_accounts_required_labels_list_policy.up.sql": `
+		ALTER TABLE accounts ADD COLUMN required_labels_list_policy TEXT NOT NULL DEFAULT '';
+	`,
+	"038_add_accounts_required_labels_list_policy.down.sql": `
+		ALTER TABLE accounts DROP COLUMN required_labels_list_policy;
+	`,
+	"039_add_repo_metadata.up.sql": `
+		CREATE TABLE repo_metadata (
+			repo_id       BIGINT NOT NULL PRIMARY KEY REFERENCES repos ON DELETE CASCADE,
+			description   TEXT   NOT NULL DEFAULT '',
+			metadata_json TEXT   NOT NULL DEFAULT ''
+		);
+	`,
+	"039_add_repo_metadata.down.sql": `
+		DROP TABLE repo_metadata;
+	`,
+	"040_add_manifest_platforms.up.sql": `
+		CREATE TABLE manifest_platforms (
+			repo_id      BIGINT NOT NULL,
+			digest       TEXT   NOT NULL,
+			child_digest TEXT   NOT NULL,
+			os           TEXT   NOT NULL,
+			architecture TEXT   NOT NULL,
+			variant      TEXT   NOT NULL DEFAULT '',
+			FOREIGN KEY (repo_id, digest) REFERENCES manifests ON DELETE CASCADE,
+			UNIQUE (repo_id, digest, child_digest)
+		);
+	`,
+	"040_add_manifest_platforms.down.sql": `
+		DROP TABLE manifest_platforms;
+	`,
+	"041_add_tag_history.up.sql": `
+		CREATE TABLE tag_history (
+			id         BIGSERIAL   NOT NULL PRIMARY KEY,
+			repo_id    BIGINT      NOT NULL REFERENCES repos ON DELETE CASCADE,
+			tag_name   TEXT        NOT NULL,
+			old_digest TEXT        NOT NULL,
+			new_digest TEXT        NOT NULL,
+			moved_at   TIMESTAMPTZ NOT NULL,
+			moved_by   TEXT        NOT NULL DEFAULT ''
+		);
+		CREATE INDEX tag_history_repo_id_tag_name_idx ON tag_history (repo_id, tag_name);
+	`,
+	"041_add_tag_history.down.sql": `
+		DROP TABLE tag_history;
+	`,
+	"042_add_manifests_deleted_at.up.sql": `
+		ALTER TABLE manifests ADD COLUMN deleted_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"042_add_manifests_deleted_at.down.sql": `
+		ALTER TABLE manifests DROP COLUMN deleted_at;
+	`,
+	"043_add_accounts_blob_replication_grace_period_secs.up.sql": `
+		ALTER TABLE accounts ADD COLUMN blob_replication_grace_period_secs BIGINT NOT NULL DEFAULT 0;
+	`,
+	"043_add_accounts_blob_replication_grace_period_secs.down.sql": `
+		ALTER TABLE accounts DROP COLUMN blob_replication_grace_period_secs;
+	`,
+	"044_add_repos_next_manifest_size_repair_at.up.sql": `
+		ALTER TABLE repos ADD COLUMN next_manifest_size_repair_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"044_add_repos_next_manifest_size_repair_at.down.sql": `
+		ALTER TABLE repos DROP COLUMN next_manifest_size_repair_at;
+	`,
+	"045_make_tag_history_append_only.up.sql": `
+		ALTER TABLE tag_history ADD COLUMN account_name TEXT NOT NULL DEFAULT '';
+		ALTER TABLE tag_history ADD COLUMN repo_name TEXT NOT NULL DEFAULT '';
+		UPDATE tag_history th SET account_name = r.account_name, repo_name = r.name FROM repos r WHERE r.id = th.repo_id;
+		ALTER TABLE tag_history DROP CONSTRAINT tag_history_repo_id_fkey;
+		CREATE INDEX tag_history_account_name_repo_name_idx ON tag_history (account_name, repo_name);
+		CREATE FUNCTION tag_history_refuse_changes() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'tag_history is append-only';
+		END;
+		$$ LANGUAGE plpgsql;
+		CREATE TRIGGER tag_history_append_only BEFORE UPDATE OR DELETE ON tag_history
+			FOR EACH ROW EXECUTE FUNCTION tag_history_refuse_changes();
+	`,
+	"045_make_tag_history_append_only.down.sql": `
+		DROP TRIGGER tag_history_append_only ON tag_history;
+		DROP FUNCTION tag_history_refuse_changes();
+		DROP INDEX tag_history_account_name_repo_name_idx;
+		DELETE FROM tag_history WHERE repo_id NOT IN (SELECT id FROM repos);
+		ALTER TABLE tag_history ADD FOREIGN KEY (repo_id) REFERENCES repos ON DELETE CASCADE;
+		ALTER TABLE tag_history DROP COLUMN account_name;
+		ALTER TABLE tag_history DROP COLUMN repo_name;
+	`,
+	"046_drop_repos_next_manifest_size_repair_at.up.sql": `
+		ALTER TABLE repos DROP COLUMN next_manifest_size_repair_at;
+	`,
+	"046_drop_repos_next_manifest_size_repair_at.down.sql": `
+		ALTER TABLE repos ADD COLUMN next_manifest_size_repair_at TIMESTAMPTZ DEFAULT NULL;
+	`,
+	"047_revalidate_list_manifests_without_platforms.up.sql": `
+		UPDATE manifests m SET validated_at = TO_TIMESTAMP(0)
+		 WHERE m.media_type IN ('application/vnd.docker.distribution.manifest.list.v2+json', 'application/vnd.oci.image.index.v1+json')
+		   AND NOT EXISTS (SELECT 1 FROM manifest_platforms mp WHERE mp.repo_id = m.repo_id AND mp.digest = m.digest);
+	`,
+	"047_revalidate_list_manifests_without_platforms.down.sql": `
+		-- nothing to undo: the validation would have happened eventually anyway
+	`,
+	"048_make_accounts_blob_replication_grace_period_secs_nullable.up.sql": `
+		ALTER TABLE accounts ALTER COLUMN blob_replication_grace_period_secs DROP NOT NULL;
+		ALTER TABLE accounts ALTER COLUMN blob_replication_grace_period_secs SET DEFAULT NULL;
+		UPDATE accounts SET blob_replication_grace_period_secs = NULL WHERE blob_replication_grace_period_secs = 0;
+	`,
+	"048_make_accounts_blob_replication_grace_period_secs_nullable.down.sql": `
+		UPDATE accounts SET blob_replication_grace_period_secs = 0 WHERE blob_replication_grace_period_secs IS NULL;
+		ALTER TABLE accounts ALTER COLUMN blob_replication_grace_period_secs SET DEFAULT 0;
+		ALTER TABLE accounts ALTER COLUMN blob_replication_grace_period_secs SET NOT NULL;
+	`,
+	"049_add_accounts_max_concurrent_replications.up.sql": `
+		ALTER TABLE accounts ADD COLUMN max_concurrent_replications BIGINT NOT NULL DEFAULT 0;
+	`,
+	"049_add_accounts_max_concurrent_replications.down.sql": `
+		ALTER TABLE accounts DROP COLUMN max_concurrent_replications;
+	`,
 }
 
 // DB adds convenience functions on top of gorp.DbMap.
@@ -234,8 +399,111 @@ func (db *DB) SelectBool(query string, args ...interface{}) (bool, error) {
 	return result, err
 }
 
+// DBPoolConfiguration contains the settings for the DB connection pool. The
+// fields have the same semantics as the respective setters on sql.DB.
+type DBPoolConfiguration struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DefaultDBPoolConfiguration returns the DBPoolConfiguration that is used
+// when the operator does not configure anything.
+func DefaultDBPoolConfiguration() DBPoolConfiguration {
+	return DBPoolConfiguration{
+		//ensure that this process does not starve other Keppel processes for DB connections
+		MaxOpenConns: 16,
+		//same as the default in database/sql
+		MaxIdleConns: 2,
+		//no limit
+		ConnMaxLifetime: 0,
+	}
+}
+
+// ParseDBPoolConfiguration reads the DBPoolConfiguration from the environment
+// variables KEPPEL_DB_MAX_OPEN_CONNS, KEPPEL_DB_MAX_IDLE_CONNS and
+// KEPPEL_DB_CONN_MAX_LIFETIME. Missing values are filled with defaults.
+func ParseDBPoolConfiguration() (DBPoolConfiguration, error) {
+	pc := DefaultDBPoolConfiguration()
+	parseInt := func(key string, target *int) error {
+		str := osext.GetenvOrDefault(key, "")
+		if str == "" {
+			return nil
+		}
+		val, err := strconv.Atoi(str)
+		if err != nil || val < 0 {
+			return fmt.Errorf("invalid value for %s: %q", key, str)
+		}
+		*target = val
+		return nil
+	}
+
+	err := parseInt("KEPPEL_DB_MAX_OPEN_CONNS", &pc.MaxOpenConns)
+	if err != nil {
+		return pc, err
+	}
+	err = parseInt("KEPPEL_DB_MAX_IDLE_CONNS", &pc.MaxIdleConns)
+	if err != nil {
+		return pc, err
+	}
+	if str := osext.GetenvOrDefault("KEPPEL_DB_CONN_MAX_LIFETIME", ""); str != "" {
+		pc.ConnMaxLifetime, err = time.ParseDuration(str)
+		if err != nil || pc.ConnMaxLifetime < 0 {
+			return pc, fmt.Errorf("invalid value for KEPPEL_DB_CONN_MAX_LIFETIME: %q", str)
+		}
+	}
+	return pc, nil
+}
+
+// dbPool is the subset of the interface of sql.DB that applyTo() uses.
+type dbPool interface {
+	SetMaxOpenConns(n int)
+	SetMaxIdleConns(n int)
+	SetConnMaxLifetime(d time.Duration)
+}
+
+func (pc DBPoolConfiguration) applyTo(db dbPool) {
+	db.SetMaxOpenConns(pc.MaxOpenConns)
+	db.SetMaxIdleConns(pc.MaxIdleConns)
+	db.SetConnMaxLifetime(pc.ConnMaxLifetime)
+}
+
+// IsSerializationFailure returns whether the given error is a serialization
+// failure (SQLSTATE 40001) or a detected deadlock (SQLSTATE 40P01). In both
+// cases, the transaction has been aborted by the database and can be retried.
+func IsSerializationFailure(err error) bool {
+	var sqlStateErr interface{ SQLState() string }
+	if !errors.As(err, &sqlStateErr) {
+		return false
+	}
+	switch sqlStateErr.SQLState() {
+	case "40001", "40P01":
+		return true
+	default:
+		return false
+	}
+}
+
+// RetryOnSerializationFailure runs the given action, which shall execute a
+// complete DB transaction. If the action fails because of a serialization
+// failure or deadlock (see IsSerializationFailure), it is retried until
+// `maxAttempts` attempts have been made.
+func RetryOnSerializationFailure(maxAttempts int, action func() error) error {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err = action()
+		if !IsSerializationFailure(err) {
+			return err
+		}
+		if attempt < maxAttempts {
+			logg.Info("retrying DB transaction (attempt %d of %d failed): %s", attempt, maxAttempts, err.Error())
+		}
+	}
+	return err
+}
+
 // InitDB connects to the Postgres database.
-func InitDB(dbURL *url.URL) (*DB, error) {
+func InitDB(dbURL *url.URL, pc DBPoolConfiguration) (*DB, error) {
 	db, err := easypg.Connect(easypg.Configuration{
 		PostgresURL: dbURL,
 		Migrations:  sqlMigrations,
@@ -243,8 +511,7 @@ func InitDB(dbURL *url.URL) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	//ensure that this process does not starve other Keppel processes for DB connections
-	db.SetMaxOpenConns(16)
+	pc.applyTo(db)
 
 	result := &DB{DbMap: gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}}
 	initModels(&result.DbMap)
@@ -0,0 +1,131 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+)
+
+// dbPoolRecorder is a dbPool that records the settings applied to it.
+type dbPoolRecorder struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func (r *dbPoolRecorder) SetMaxOpenConns(n int)              { r.MaxOpenConns = n }
+func (r *dbPoolRecorder) SetMaxIdleConns(n int)              { r.MaxIdleConns = n }
+func (r *dbPoolRecorder) SetConnMaxLifetime(d time.Duration) { r.ConnMaxLifetime = d }
+
+func TestDBPoolConfiguration(t *testing.T) {
+	//without configuration, defaults are applied
+	pc, err := ParseDBPoolConfiguration()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var r dbPoolRecorder
+	pc.applyTo(&r)
+	assert.DeepEqual(t, "applied pool settings", r, dbPoolRecorder{
+		MaxOpenConns:    16,
+		MaxIdleConns:    2,
+		ConnMaxLifetime: 0,
+	})
+
+	//configured values are applied
+	t.Setenv("KEPPEL_DB_MAX_OPEN_CONNS", "100")
+	t.Setenv("KEPPEL_DB_MAX_IDLE_CONNS", "25")
+	t.Setenv("KEPPEL_DB_CONN_MAX_LIFETIME", "30m")
+	pc, err = ParseDBPoolConfiguration()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r = dbPoolRecorder{}
+	pc.applyTo(&r)
+	assert.DeepEqual(t, "applied pool settings", r, dbPoolRecorder{
+		MaxOpenConns:    100,
+		MaxIdleConns:    25,
+		ConnMaxLifetime: 30 * time.Minute,
+	})
+
+	//invalid values are rejected
+	for key, value := range map[string]string{
+		"KEPPEL_DB_MAX_OPEN_CONNS":    "-1",
+		"KEPPEL_DB_MAX_IDLE_CONNS":    "lots",
+		"KEPPEL_DB_CONN_MAX_LIFETIME": "forever",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			_, err := ParseDBPoolConfiguration()
+			expected := "invalid value for " + key + ": \"" + value + "\""
+			if err == nil || err.Error() != expected {
+				t.Errorf("expected error %q, but got %v", expected, err)
+			}
+		})
+	}
+}
+
+// sqlStateError mimics the SQLState() method of *pq.Error.
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "pq: SQLSTATE " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func TestRetryOnSerializationFailure(t *testing.T) {
+	//a serialization failure on the first attempt is retried
+	attempts := 0
+	err := RetryOnSerializationFailure(3, func() error {
+		attempts++
+		if attempts == 1 {
+			return fmt.Errorf("while committing: %w", sqlStateError("40001"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected success, but got %s", err.Error())
+	}
+	assert.DeepEqual(t, "attempts", attempts, 2)
+
+	//deadlocks are retried as well, but only up to the limit
+	attempts = 0
+	err = RetryOnSerializationFailure(3, func() error {
+		attempts++
+		return sqlStateError("40P01")
+	})
+	if !IsSerializationFailure(err) {
+		t.Errorf("expected deadlock error, but got %v", err)
+	}
+	assert.DeepEqual(t, "attempts", attempts, 3)
+
+	//other errors are not retried
+	for _, expectedErr := range []error{errors.New("something else"), sqlStateError("23505")} {
+		attempts = 0
+		err = RetryOnSerializationFailure(3, func() error {
+			attempts++
+			return expectedErr
+		})
+		assert.DeepEqual(t, "error", err, expectedErr)
+		assert.DeepEqual(t, "attempts", attempts, 1)
+	}
+}
@@ -0,0 +1,158 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/clair"
+)
+
+// EventType identifies the type of an Event.
+type EventType string
+
+const (
+	// ManifestPushedEventType is the EventType of ManifestPushedEvent.
+	ManifestPushedEventType EventType = "manifest-pushed"
+	// ManifestDeletedEventType is the EventType of ManifestDeletedEvent.
+	ManifestDeletedEventType EventType = "manifest-deleted"
+	// VulnerabilityStatusChangedEventType is the EventType of VulnerabilityStatusChangedEvent.
+	VulnerabilityStatusChangedEventType EventType = "vulnerability-status-changed"
+)
+
+// Event is an event that Keppel emits into its EventSink. The concrete types
+// are ManifestPushedEvent, ManifestDeletedEvent and VulnerabilityStatusChangedEvent.
+type Event interface {
+	EventType() EventType
+}
+
+// ManifestPushedEvent is emitted when a manifest or tag is pushed.
+type ManifestPushedEvent struct {
+	Account    Account
+	Repository Repository
+	Digest     string
+	Tag        string //only if the manifest was pushed with a tag reference
+	PushedAt   time.Time
+}
+
+// ManifestDeletedEvent is emitted when a manifest or tag is deleted.
+type ManifestDeletedEvent struct {
+	Account    Account
+	Repository Repository
+	Digest     string
+	Tag        string //only if a single tag was deleted (the manifest itself remains)
+	DeletedAt  time.Time
+}
+
+// VulnerabilityStatusChangedEvent is emitted when the vulnerability status of
+// a manifest changes.
+type VulnerabilityStatusChangedEvent struct {
+	Account    Account
+	Repository Repository
+	Digest     string
+	OldStatus  clair.VulnerabilityStatus
+	NewStatus  clair.VulnerabilityStatus
+	ChangedAt  time.Time
+}
+
+// IsWorsening returns whether the new vulnerability status is more severe than
+// the old one, e.g. because a new CVE was published that affects a
+// previously clean image.
+func (e VulnerabilityStatusChangedEvent) IsWorsening() bool {
+	return e.NewStatus.IsWorseThan(e.OldStatus)
+}
+
+// EventType implements the Event interface.
+func (ManifestPushedEvent) EventType() EventType { return ManifestPushedEventType }
+
+// EventType implements the Event interface.
+func (ManifestDeletedEvent) EventType() EventType { return ManifestDeletedEventType }
+
+// EventType implements the Event interface.
+func (VulnerabilityStatusChangedEvent) EventType() EventType {
+	return VulnerabilityStatusChangedEventType
+}
+
+// EventSink receives events emitted by Keppel. Implementations must not block
+// for extended periods of time, since events are emitted synchronously from
+// within API requests and janitor tasks.
+type EventSink interface {
+	Emit(event Event)
+}
+
+// NoopEventSink is an EventSink that discards all events. This is the default
+// when no event sinks are configured.
+type NoopEventSink struct{}
+
+// Emit implements the EventSink interface.
+func (NoopEventSink) Emit(event Event) {}
+
+// LogEventSink is an EventSink that writes all events into the log.
+type LogEventSink struct{}
+
+// Emit implements the EventSink interface.
+func (LogEventSink) Emit(event Event) {
+	var fields string
+	switch e := event.(type) {
+	case ManifestPushedEvent:
+		fields = fmt.Sprintf("repo = %s, digest = %s, tag = %q", e.Repository.FullName(), e.Digest, e.Tag)
+	case ManifestDeletedEvent:
+		fields = fmt.Sprintf("repo = %s, digest = %s, tag = %q", e.Repository.FullName(), e.Digest, e.Tag)
+	case VulnerabilityStatusChangedEvent:
+		fields = fmt.Sprintf("repo = %s, digest = %s, status = %s -> %s", e.Repository.FullName(), e.Digest, e.OldStatus, e.NewStatus)
+	}
+	logg.Info("event %s: %s", event.EventType(), fields)
+}
+
+// MultiEventSink is an EventSink that forwards all events to each of the
+// contained EventSinks.
+type MultiEventSink []EventSink
+
+// Emit implements the EventSink interface.
+func (s MultiEventSink) Emit(event Event) {
+	for _, sink := range s {
+		sink.Emit(event)
+	}
+}
+
+// ParseEventSinks builds an EventSink from a comma-separated list of sink
+// names, as given in the KEPPEL_EVENT_SINKS environment variable. Currently,
+// only "log" is understood.
+func ParseEventSinks(spec string) (EventSink, error) {
+	var result MultiEventSink
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "log":
+			result = append(result, LogEventSink{})
+		default:
+			return nil, fmt.Errorf("unknown event sink: %q", name)
+		}
+	}
+	if len(result) == 0 {
+		return NoopEventSink{}, nil
+	}
+	return result, nil
+}
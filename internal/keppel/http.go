@@ -20,6 +20,8 @@
 package keppel
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net/http"
 
 	"github.com/sapcc/go-api-declarations/bininfo"
@@ -28,16 +30,77 @@ import (
 	"github.com/sapcc/go-bits/osext"
 )
 
-var wrap *httpext.WrappedTransport
+var (
+	wrap *httpext.WrappedTransport
+	//the User-Agent that SetupHTTPClient() injects into http.DefaultTransport,
+	//also used by the clients from NewHTTPClient()
+	userAgent string
+)
+
+// This is captured before SetupHTTPClient() replaces http.DefaultTransport
+// with a wrapper that cannot be cloned anymore.
+var defaultTransport = http.DefaultTransport.(*http.Transport) //nolint:errcheck // type is guaranteed by the standard library
 
 func SetupHTTPClient() {
 	wrap = httpext.WrapTransport(&http.DefaultTransport)
 	wrap.SetInsecureSkipVerify(osext.GetenvBool("KEPPEL_INSECURE")) //for debugging with mitmproxy etc. (DO NOT SET IN PRODUCTION)
-	wrap.SetOverrideUserAgent(bininfo.Component(), bininfo.VersionOr("rolling"))
+	setUserAgent()
 }
 
 func SetTaskName(taskName string) {
 	bininfo.SetTaskName(taskName)
-	wrap.SetOverrideUserAgent(bininfo.Component(), bininfo.VersionOr("rolling"))
+	setUserAgent()
 	logg.Info("starting %s %s", bininfo.Component(), bininfo.VersionOr("rolling"))
 }
+
+func setUserAgent() {
+	wrap.SetOverrideUserAgent(bininfo.Component(), bininfo.VersionOr("rolling"))
+	userAgent = fmt.Sprintf("%s/%s", bininfo.Component(), bininfo.VersionOr("rolling"))
+}
+
+// NewHTTPClient builds an HTTP client with a dedicated transport, for callers
+// that need to tweak transport settings (e.g. timeouts) that cannot be set on
+// the shared http.DefaultTransport. The transport starts from the defaults of
+// the standard library, is adjusted by the given callback, and then gets the
+// same global behaviors that SetupHTTPClient() installs into
+// http.DefaultTransport (KEPPEL_INSECURE and the User-Agent override).
+func NewHTTPClient(customize func(*http.Transport)) *http.Client {
+	transport := defaultTransport.Clone()
+	if customize != nil {
+		customize(transport)
+	}
+	if osext.GetenvBool("KEPPEL_INSECURE") {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{} //nolint:gosec // only used in HTTP client, where stdlib auto-chooses strong TLS versions
+		} else {
+			transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+		}
+		transport.TLSClientConfig.InsecureSkipVerify = true //for debugging with mitmproxy etc. (DO NOT SET IN PRODUCTION)
+	}
+	return &http.Client{Transport: userAgentRoundTripper{transport}}
+}
+
+// userAgentRoundTripper is the equivalent of the User-Agent override that
+// SetupHTTPClient() installs into http.DefaultTransport.
+type userAgentRoundTripper struct {
+	inner http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (rt userAgentRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	if userAgent != "" {
+		r.Header.Set("User-Agent", userAgent)
+	}
+	return rt.inner.RoundTrip(r)
+}
+
+// NewPeerHTTPClient builds an HTTP client that uses the given TLS
+// configuration for requests to our peers, e.g. to present a client
+// certificate. The result is intended for Configuration.PeerHTTPClient.
+// Like every client from NewHTTPClient(), it honors KEPPEL_INSECURE and sends
+// our User-Agent.
+func NewPeerHTTPClient(tlsConfig *tls.Config) *http.Client {
+	return NewHTTPClient(func(transport *http.Transport) {
+		transport.TLSClientConfig = tlsConfig
+	})
+}
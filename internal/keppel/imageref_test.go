@@ -60,7 +60,7 @@ func TestParseImageReferenceSuccess(t *testing.T) {
 			}
 
 			for _, reference := range references {
-				ref := ImageReference{hostName, repoName, ParseManifestReference(reference)}
+				ref := ImageReference{hostName, repoName, mustParseManifestReference(t, reference)}
 				parsedRef, interpretation, err := ParseImageReference(ref.String())
 				if err == nil {
 					if !assert.DeepEqual(t, "parse of %s", parsedRef, ref) {
@@ -81,8 +81,8 @@ func TestParseImageReferenceLabelDigestSuccess(t *testing.T) {
 	digest := "sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef"
 	// Check that the manifest reference :nonsense@digest is equal to @digest where :nonsense can be anything and is NOT checked.
 	// This mirrors the behaviour of the official docker client to maintain compatbility.
-	refActual := ImageReference{registry, repo, ParseManifestReference("nonsense@" + digest)}
-	refExpected := ImageReference{registry, repo, ParseManifestReference(digest)}
+	refActual := ImageReference{registry, repo, ManifestReference{Tag: "nonsense@" + digest}}
+	refExpected := ImageReference{registry, repo, mustParseManifestReference(t, digest)}
 
 	parsedRef, interpretation, err := ParseImageReference(refActual.String())
 	if err == nil {
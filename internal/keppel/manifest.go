@@ -20,9 +20,13 @@
 package keppel
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	//distribution.UnmarshalManifest() relies on the following packages
@@ -36,6 +40,17 @@ import (
 //anymore since it's legacy anyway and the implementation is a lot simpler
 //when we don't have to rewrite manifests between schema1 and schema2.
 
+// DefaultManifestMediaTypes is the set of manifest media types that are
+// accepted in strict mode (see Configuration.StrictManifestMediaTypes) unless
+// configured otherwise. These are exactly the types that ParseManifest()
+// understands.
+var DefaultManifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+}
+
 // ParsedManifest is an interface that can interrogate manifests about the blobs
 // and submanifests referenced therein.
 type ParsedManifest interface {
@@ -55,6 +70,9 @@ type ParsedManifest interface {
 	//asks for this manifest, but the Accept header does not match the manifest
 	//itself, the API will look for an acceptable alternate to serve instead.
 	AcceptableAlternates(pf PlatformFilter) []manifestlist.ManifestDescriptor
+	//Annotations returns the annotations on this manifest (only supported by
+	//OCI image manifests), or nil if there are none.
+	Annotations() map[string]string
 }
 
 // ParseManifest parses a manifest. It also returns a Descriptor describing the manifest itself.
@@ -75,6 +93,104 @@ func ParseManifest(mediaType string, contents []byte) (ParsedManifest, distribut
 	}
 }
 
+// CheckEmbeddedMediaType checks that the "mediaType" field in the given
+// manifest (if any) agrees with the media type declared by the client, e.g.
+// in the Content-Type header of a manifest push. Without this check, clients
+// could confuse the different manifest formats with each other.
+func CheckEmbeddedMediaType(declaredMediaType string, contents []byte) error {
+	var data struct {
+		MediaType string `json:"mediaType"`
+	}
+	err := json.Unmarshal(contents, &data)
+	if err != nil {
+		return err
+	}
+	if data.MediaType != "" && data.MediaType != declaredMediaType {
+		return fmt.Errorf("manifest was uploaded with media type %q, but its mediaType field says %q", declaredMediaType, data.MediaType)
+	}
+	return nil
+}
+
+// ParseManifestStream is like ParseManifest, but reads the manifest from the
+// given reader instead of requiring it to be buffered in memory entirely. The
+// digest and size in the returned Descriptor are computed while streaming.
+//
+// The structural validation performed by this function is less thorough than
+// that of ParseManifest, since the original manifest bytes are not available
+// for inspection after decoding.
+func ParseManifestStream(mediaType string, contents io.Reader) (ParsedManifest, distribution.Descriptor, error) {
+	digester := digest.SHA256.Digester()
+	counter := &byteCounter{}
+	dec := json.NewDecoder(io.TeeReader(contents, io.MultiWriter(digester.Hash(), counter)))
+
+	var (
+		result         ParsedManifest
+		mediaTypeField string
+		mediaTypeMatch bool
+	)
+	switch mediaType {
+	case schema2.MediaTypeManifest:
+		var m schema2.Manifest
+		err := dec.Decode(&m)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+		result = v2ManifestAdapter{&schema2.DeserializedManifest{Manifest: m}}
+		mediaTypeField = m.MediaType
+		mediaTypeMatch = m.MediaType == mediaType
+	case v1.MediaTypeImageManifest:
+		var m ocischema.Manifest
+		err := dec.Decode(&m)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+		result = ociManifestAdapter{&ocischema.DeserializedManifest{Manifest: m}}
+		mediaTypeField = m.MediaType
+		mediaTypeMatch = m.MediaType == "" || m.MediaType == mediaType
+	case manifestlist.MediaTypeManifestList, v1.MediaTypeImageIndex:
+		var m manifestlist.ManifestList
+		err := dec.Decode(&m)
+		if err != nil {
+			return nil, distribution.Descriptor{}, err
+		}
+		result = listManifestAdapter{&manifestlist.DeserializedManifestList{ManifestList: m}}
+		mediaTypeField = m.MediaType
+		mediaTypeMatch = m.MediaType == mediaType || (m.MediaType == "" && mediaType == v1.MediaTypeImageIndex)
+	default:
+		return nil, distribution.Descriptor{}, fmt.Errorf("unsupported manifest media type: %q", mediaType)
+	}
+
+	if !mediaTypeMatch {
+		return nil, distribution.Descriptor{}, fmt.Errorf("mediaType in manifest should be %q, not %q", mediaType, mediaTypeField)
+	}
+
+	//consume the rest of the input, so that the digest covers everything (only
+	//whitespace may follow the manifest itself)
+	_, err := dec.Token()
+	if err == nil {
+		return nil, distribution.Descriptor{}, errors.New("unexpected data after end of manifest")
+	}
+	if err != io.EOF {
+		return nil, distribution.Descriptor{}, err
+	}
+
+	return result, distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(counter.bytesCount),
+		Digest:    digester.Digest(),
+	}, nil
+}
+
+// byteCounter is an io.Writer that counts the bytes written into it.
+type byteCounter struct {
+	bytesCount uint64
+}
+
+func (c *byteCounter) Write(buf []byte) (int, error) {
+	c.bytesCount += uint64(len(buf))
+	return len(buf), nil
+}
+
 // v2ManifestAdapter provides the ParsedManifest interface for the contained type.
 type v2ManifestAdapter struct {
 	m *schema2.DeserializedManifest
@@ -100,6 +216,10 @@ func (a v2ManifestAdapter) AcceptableAlternates(pf PlatformFilter) []manifestlis
 	return nil
 }
 
+func (a v2ManifestAdapter) Annotations() map[string]string {
+	return nil
+}
+
 // ociManifestAdapter provides the ParsedManifest interface for the contained type.
 type ociManifestAdapter struct {
 	m *ocischema.DeserializedManifest
@@ -133,6 +253,10 @@ func (a ociManifestAdapter) AcceptableAlternates(pf PlatformFilter) []manifestli
 	return nil
 }
 
+func (a ociManifestAdapter) Annotations() map[string]string {
+	return a.m.Annotations
+}
+
 // listManifestAdapter provides the ParsedManifest interface for the contained type.
 type listManifestAdapter struct {
 	m *manifestlist.DeserializedManifestList
@@ -177,3 +301,7 @@ func (a listManifestAdapter) AcceptableAlternates(pf PlatformFilter) []manifestl
 	}
 	return result
 }
+
+func (a listManifestAdapter) Annotations() map[string]string {
+	return nil
+}
@@ -0,0 +1,139 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+package keppel
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestParseManifestStreamMatchesParseManifest(t *testing.T) {
+	configDigest := digest.FromString("config")
+	layerDigest := digest.FromString("layer")
+	imageDigest := digest.FromString("image")
+
+	imageManifest := func(mediaTypeField, configMediaType, layerMediaType string) string {
+		return fmt.Sprintf(`{
+			"schemaVersion": 2,%s
+			"config": {"mediaType": %q, "size": 6, "digest": %q},
+			"layers": [{"mediaType": %q, "size": 5, "digest": %q}]
+		}`, mediaTypeField, configMediaType, configDigest, layerMediaType, layerDigest)
+	}
+	listManifest := func(mediaTypeField string) string {
+		return fmt.Sprintf(`{
+			"schemaVersion": 2,%s
+			"manifests": [{"mediaType": %q, "size": 1234, "digest": %q, "platform": {"os": "linux", "architecture": "amd64"}}]
+		}`, mediaTypeField, schema2.MediaTypeManifest, imageDigest)
+	}
+
+	testCases := []struct {
+		MediaType string
+		Contents  string
+	}{
+		{schema2.MediaTypeManifest, imageManifest(fmt.Sprintf(`"mediaType": %q,`, schema2.MediaTypeManifest), schema2.MediaTypeImageConfig, schema2.MediaTypeLayer)},
+		{v1.MediaTypeImageManifest, imageManifest(fmt.Sprintf(`"mediaType": %q,`, v1.MediaTypeImageManifest), v1.MediaTypeImageConfig, v1.MediaTypeImageLayerGzip)},
+		{v1.MediaTypeImageManifest, imageManifest("", v1.MediaTypeImageConfig, v1.MediaTypeImageLayerGzip)},
+		{manifestlist.MediaTypeManifestList, listManifest(fmt.Sprintf(`"mediaType": %q,`, manifestlist.MediaTypeManifestList))},
+		{v1.MediaTypeImageIndex, listManifest(fmt.Sprintf(`"mediaType": %q,`, v1.MediaTypeImageIndex))},
+		{v1.MediaTypeImageIndex, listManifest("") + "\n"},
+	}
+
+	for idx, tc := range testCases {
+		contents := []byte(tc.Contents)
+		bufferedParsed, bufferedDesc, err := ParseManifest(tc.MediaType, contents)
+		if err != nil {
+			t.Fatalf("test case %d: ParseManifest failed: %s", idx, err.Error())
+		}
+		streamedParsed, streamedDesc, err := ParseManifestStream(tc.MediaType, bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("test case %d: ParseManifestStream failed: %s", idx, err.Error())
+		}
+
+		label := func(s string) string { return fmt.Sprintf("test case %d: %s", idx, s) }
+		assert.DeepEqual(t, label("descriptor"), streamedDesc, bufferedDesc)
+		assert.DeepEqual(t, label("config blob"), streamedParsed.FindImageConfigBlob(), bufferedParsed.FindImageConfigBlob())
+		assert.DeepEqual(t, label("layer blobs"), streamedParsed.FindImageLayerBlobs(), bufferedParsed.FindImageLayerBlobs())
+		assert.DeepEqual(t, label("blob references"), streamedParsed.BlobReferences(), bufferedParsed.BlobReferences())
+		assert.DeepEqual(t, label("manifest references"), streamedParsed.ManifestReferences(nil), bufferedParsed.ManifestReferences(nil))
+		assert.DeepEqual(t, label("acceptable alternates"), streamedParsed.AcceptableAlternates(nil), bufferedParsed.AcceptableAlternates(nil))
+	}
+
+	//inputs that are rejected by ParseManifest shall also be rejected by ParseManifestStream
+	invalidCases := []struct {
+		MediaType string
+		Contents  string
+	}{
+		{schema2.MediaTypeManifest, imageManifest("", schema2.MediaTypeImageConfig, schema2.MediaTypeLayer)},
+		{schema2.MediaTypeManifest, imageManifest(fmt.Sprintf(`"mediaType": %q,`, v1.MediaTypeImageManifest), schema2.MediaTypeImageConfig, schema2.MediaTypeLayer)},
+		{manifestlist.MediaTypeManifestList, listManifest(fmt.Sprintf(`"mediaType": %q,`, v1.MediaTypeImageIndex))},
+		{manifestlist.MediaTypeManifestList, listManifest(fmt.Sprintf(`"mediaType": %q,`, manifestlist.MediaTypeManifestList)) + "{}"},
+		{v1.MediaTypeImageIndex, `{"schemaVersion": 2, "mediaType": "application/json"}`},
+		{v1.MediaTypeImageManifest, `{"schemaVersion": 2`},
+	}
+	for idx, tc := range invalidCases {
+		_, _, err := ParseManifest(tc.MediaType, []byte(tc.Contents))
+		if err == nil {
+			t.Errorf("invalid case %d: expected ParseManifest to fail, but it succeeded", idx)
+		}
+		_, _, err = ParseManifestStream(tc.MediaType, bytes.NewReader([]byte(tc.Contents)))
+		if err == nil {
+			t.Errorf("invalid case %d: expected ParseManifestStream to fail, but it succeeded", idx)
+		}
+	}
+}
+
+func TestCheckEmbeddedMediaType(t *testing.T) {
+	testCases := []struct {
+		DeclaredMediaType string
+		Contents          string
+		ExpectedError     string
+	}{
+		//matching media types, or no embedded media type at all
+		{schema2.MediaTypeManifest, fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q}`, schema2.MediaTypeManifest), ""},
+		{v1.MediaTypeImageManifest, fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q}`, v1.MediaTypeImageManifest), ""},
+		{v1.MediaTypeImageIndex, `{"schemaVersion":2}`, ""},
+		//mismatching media types
+		{
+			v1.MediaTypeImageManifest, fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q}`, schema2.MediaTypeManifest),
+			fmt.Sprintf("manifest was uploaded with media type %q, but its mediaType field says %q", v1.MediaTypeImageManifest, schema2.MediaTypeManifest),
+		},
+		{
+			schema2.MediaTypeManifest, fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q}`, manifestlist.MediaTypeManifestList),
+			fmt.Sprintf("manifest was uploaded with media type %q, but its mediaType field says %q", schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList),
+		},
+		//malformed manifest
+		{schema2.MediaTypeManifest, `wtf`, "invalid character 'w' looking for beginning of value"},
+	}
+
+	for _, tc := range testCases {
+		err := CheckEmbeddedMediaType(tc.DeclaredMediaType, []byte(tc.Contents))
+		errMsg := ""
+		if err != nil {
+			errMsg = err.Error()
+		}
+		assert.DeepEqual(t, fmt.Sprintf("error for %s", tc.Contents), errMsg, tc.ExpectedError)
+	}
+}
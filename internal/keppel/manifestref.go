@@ -19,7 +19,11 @@
 
 package keppel
 
-import "github.com/opencontainers/go-digest"
+import (
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
 
 // ManifestReference is a reference to a manifest as encountered in a URL on the
 // Registry v2 API. Exactly one of the members will be non-empty.
@@ -28,15 +32,22 @@ type ManifestReference struct {
 	Tag    string
 }
 
-// ParseManifestReference parses a manifest reference. If `reference` parses as
-// a digest, it will be interpreted as a digest. Otherwise it will be
-// interpreted as a tag name.
-func ParseManifestReference(reference string) ManifestReference {
+// ParseManifestReference parses a manifest reference. The input must be either
+// a well-formed digest or a well-formed tag name. Otherwise, ErrDigestInvalid
+// or ErrTagInvalid is returned. (Since tag names cannot contain colons, inputs
+// with colons are assumed to be meant as digests.)
+func ParseManifestReference(reference string) (ManifestReference, error) {
 	parsedDigest, err := digest.Parse(reference)
 	if err == nil {
-		return ManifestReference{Digest: parsedDigest}
+		return ManifestReference{Digest: parsedDigest}, nil
+	}
+	if strings.Contains(reference, ":") {
+		return ManifestReference{}, ErrDigestInvalid.With("invalid digest %q: %s", reference, err.Error())
+	}
+	if !IsTagName(reference) {
+		return ManifestReference{}, ErrTagInvalid.With("invalid tag name: %q", reference)
 	}
-	return ManifestReference{Tag: reference}
+	return ManifestReference{Tag: reference}, nil
 }
 
 // String returns the original string representation of this reference.
@@ -0,0 +1,68 @@
+/*******************************************************************************
+*
+* Copyright 2020 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func mustParseManifestReference(t *testing.T, input string) ManifestReference {
+	t.Helper()
+	ref, err := ParseManifestReference(input)
+	if err != nil {
+		t.Fatalf("could not parse manifest reference %q: %s", input, err.Error())
+	}
+	return ref
+}
+
+func TestParseManifestReference(t *testing.T) {
+	//valid tag
+	ref := mustParseManifestReference(t, "v1.2.3-rc.1")
+	assert.DeepEqual(t, "parse of tag", ref, ManifestReference{Tag: "v1.2.3-rc.1"})
+
+	//valid digest
+	digestStr := "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	ref = mustParseManifestReference(t, digestStr)
+	assert.DeepEqual(t, "parse of digest", ref, ManifestReference{Digest: digest.Digest(digestStr)})
+
+	//inputs that are neither
+	invalidInputs := map[string]RegistryV2ErrorCode{
+		"sha256:abc":             ErrDigestInvalid,
+		"nonsense@" + digestStr:  ErrDigestInvalid,
+		"illegal!char":           ErrTagInvalid,
+		".leading-dot":           ErrTagInvalid,
+		"":                       ErrTagInvalid,
+		"foo/bar":                ErrTagInvalid,
+		strings.Repeat("a", 129): ErrTagInvalid,
+	}
+	for input, expectedErr := range invalidInputs {
+		_, err := ParseManifestReference(input)
+		rerr, ok := err.(*RegistryV2Error)
+		if !ok {
+			t.Errorf("expected RegistryV2Error for %q, but got %#v", input, err)
+			continue
+		}
+		assert.DeepEqual(t, "error code for "+input, rerr.Code, expectedErr)
+	}
+}
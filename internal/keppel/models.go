@@ -23,7 +23,9 @@ import (
 	"database/sql"
 	"fmt"
 	"net"
+	"path"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/go-gorp/gorp/v3"
@@ -45,14 +47,50 @@ type Account struct {
 	ExternalPeerURL      string `db:"external_peer_url"`
 	ExternalPeerUserName string `db:"external_peer_username"`
 	ExternalPeerPassword string `db:"external_peer_password"`
+	//ExternalPeerCacheTTLSecs is only set for "from_external_on_first_use"
+	//replication. If non-zero, cached manifests are re-validated against
+	//upstream and evicted when unused at this interval (see ExternalPeerCacheTTL()).
+	ExternalPeerCacheTTLSecs int64 `db:"external_peer_cache_ttl_secs"`
+	//ReplicationIncludeRepos and ReplicationExcludeRepos are comma-separated
+	//lists of glob patterns that restrict which repos get replicated (see
+	//ReplicatesRepository()). Both are empty to replicate all repos.
+	ReplicationIncludeRepos string `db:"replication_include_repos"`
+	ReplicationExcludeRepos string `db:"replication_exclude_repos"`
+	//BlobReplicationGracePeriodSecs is only relevant for replica accounts. If
+	//set (including to zero), it overrides the default grace period that the
+	//vulnerability check gives clients to finish replicating the blobs of a new
+	//manifest (see BlobReplicationGracePeriod()).
+	BlobReplicationGracePeriodSecs *int64 `db:"blob_replication_grace_period_secs"`
+	//MaxConcurrentReplications is only relevant for replica accounts. If
+	//non-zero, it overrides the default limit on how many blobs can be
+	//replicated into this account at once (see ReplicationLimits).
+	MaxConcurrentReplications uint64 `db:"max_concurrent_replications"`
 	//PlatformFilter restricts which submanifests get replicated when a list manifest is replicated.
 	PlatformFilter PlatformFilter `db:"platform_filter"`
+	//DefaultPlatformJSON contains a JSON string of a manifestlist.PlatformSpec,
+	//or the empty string. See ParseDefaultPlatform().
+	DefaultPlatformJSON string `db:"default_platform_json"`
 
 	//RequiredLabels is a comma-separated list of labels that must be present on
 	//all image manifests in this account.
 	RequiredLabels string `db:"required_labels"`
+	//RequiredLabelsListPolicy controls how RequiredLabels are enforced on
+	//multi-platform images. If empty, each image manifest is checked on its own.
+	RequiredLabelsListPolicy RequiredLabelsListPolicy `db:"required_labels_list_policy"`
 	//InMaintenance indicates whether the account is in maintenance mode (as defined in the API spec).
 	InMaintenance bool `db:"in_maintenance"`
+	//BlockPullAboveSeverity is set if pulls of manifests with a vulnerability
+	//status worse than this shall be rejected (see CanPullManifestWithStatus()).
+	BlockPullAboveSeverity clair.VulnerabilityStatus `db:"block_pull_above_severity"`
+	//DenyDeleteViaToken is set if auth tokens for this account shall never
+	//grant the "delete" action, regardless of the user's permissions.
+	DenyDeleteViaToken bool `db:"deny_delete_via_token"`
+
+	//WebhookURL is set if a webhook shall be notified of manifest pushes and
+	//deletions in this account. If WebhookSecret is also set, webhook payloads
+	//are signed with it (see SignWebhookPayload()).
+	WebhookURL    string `db:"webhook_url"`
+	WebhookSecret string `db:"webhook_secret"`
 
 	//MetadataJSON contains a JSON string of a map[string]string, or the empty string.
 	MetadataJSON string `db:"metadata_json"`
@@ -70,6 +108,89 @@ func (a Account) SwiftContainerName() string {
 	return "keppel-" + a.Name
 }
 
+// ExternalPeerCacheTTL returns the interval after which cached contents of
+// this external replica account are re-validated against upstream, or 0 if no
+// specific TTL is configured.
+func (a Account) ExternalPeerCacheTTL() time.Duration {
+	return time.Duration(a.ExternalPeerCacheTTLSecs) * time.Second
+}
+
+// DefaultBlobReplicationGracePeriod is used by BlobReplicationGracePeriod()
+// if the account does not configure a specific grace period.
+const DefaultBlobReplicationGracePeriod = 10 * time.Minute
+
+// BlobReplicationGracePeriod returns how long after a manifest was replicated
+// into this replica account the vulnerability check waits for the client to
+// finish replicating the manifest's blobs, before replicating them itself.
+func (a Account) BlobReplicationGracePeriod() time.Duration {
+	if a.BlobReplicationGracePeriodSecs == nil {
+		return DefaultBlobReplicationGracePeriod
+	}
+	return time.Duration(*a.BlobReplicationGracePeriodSecs) * time.Second
+}
+
+// ReplicatesRepository returns whether the repo with the given name (not
+// including the account name) may be replicated into this replica account.
+// If include patterns are configured, the repo name must match at least one
+// of them. The repo name must not match any of the exclude patterns.
+func (a Account) ReplicatesRepository(repoName string) bool {
+	if a.ReplicationIncludeRepos != "" && !matchesAnyGlob(repoName, a.ReplicationIncludeRepos) {
+		return false
+	}
+	return !matchesAnyGlob(repoName, a.ReplicationExcludeRepos)
+}
+
+func matchesAnyGlob(repoName, patternList string) bool {
+	if patternList == "" {
+		return false
+	}
+	for _, pattern := range strings.Split(patternList, ",") {
+		//patterns are validated by the API before they are stored, so errors cannot occur here
+		matches, _ := path.Match(pattern, repoName) //nolint:errcheck
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// CanPullManifestWithStatus returns whether manifests with the given
+// vulnerability status may be pulled from this account, according to its
+// BlockPullAboveSeverity setting.
+func (a Account) CanPullManifestWithStatus(status clair.VulnerabilityStatus) bool {
+	if a.BlockPullAboveSeverity == "" {
+		return true
+	}
+	return !status.IsWorseThan(a.BlockPullAboveSeverity)
+}
+
+// RequiredLabelsListPolicy is an enum of ways in which an account's
+// RequiredLabels can be enforced on list manifests.
+//
+// When a policy is set, image manifests that are pushed by digest (i.e.
+// without a tag, as is customary for the platform submanifests of
+// multi-platform images) are not checked on their own. Instead, the check is
+// performed when a list manifest referencing them is pushed. Image manifests
+// pushed with a tag are still checked on their own.
+type RequiredLabelsListPolicy string
+
+const (
+	//RequiredLabelsOnAllPlatforms requires all submanifests of a list manifest to carry the required labels.
+	RequiredLabelsOnAllPlatforms RequiredLabelsListPolicy = "all_platforms"
+	//RequiredLabelsOnAnyPlatform requires at least one submanifest of a list manifest to carry the required labels.
+	RequiredLabelsOnAnyPlatform RequiredLabelsListPolicy = "any_platform"
+)
+
+// IsValid returns whether this is one of the known policies, or the empty string.
+func (p RequiredLabelsListPolicy) IsValid() bool {
+	switch p {
+	case "", RequiredLabelsOnAllPlatforms, RequiredLabelsOnAnyPlatform:
+		return true
+	default:
+		return false
+	}
+}
+
 // FindAccount works similar to db.SelectOne(), but returns nil instead of
 // sql.ErrNoRows if no account exists with this name.
 func FindAccount(db gorp.SqlExecutor, name string) (*Account, error) {
@@ -253,8 +374,14 @@ type Repository struct {
 }
 
 // FindOrCreateRepository works similar to db.SelectOne(), but autovivifies a
-// Repository record when none exists yet.
+// Repository record when none exists yet. If the repository name is malformed,
+// ErrNameInvalid is returned.
 func FindOrCreateRepository(db gorp.SqlExecutor, name string, account Account) (*Repository, error) {
+	//catch malformed names early: some storage backends choke on them
+	if !IsRepoName(name) || !IsRepoName(account.Name+"/"+name) {
+		return nil, ErrNameInvalid.With("invalid repository name: %q", name)
+	}
+
 	var repo Repository
 	err := db.SelectOne(&repo,
 		"INSERT INTO repos (account_name, name) VALUES ($1, $2) ON CONFLICT DO NOTHING RETURNING *", account.Name, name)
@@ -307,6 +434,10 @@ type Manifest struct {
 	GCStatusJSON      string     `db:"gc_status_json"`
 	MinLayerCreatedAt *time.Time `db:"min_layer_created_at"`
 	MaxLayerCreatedAt *time.Time `db:"max_layer_created_at"`
+	//DeletedAt is set when this manifest was soft-deleted by the manifest sync
+	//(see Configuration.DeletedManifestRetention). Soft-deleted manifests are
+	//treated as nonexistent, but can be restored until they are purged.
+	DeletedAt *time.Time `db:"deleted_at"`
 }
 
 // FindManifest is a convenience wrapper around db.SelectOne(). If the
@@ -333,6 +464,33 @@ func FindManifestByRepositoryName(db gorp.SqlExecutor, repoName string, account
 	return &manifest, err
 }
 
+var clearManifestValidationErrorQuery = sqlext.SimplifyWhitespace(`
+	UPDATE manifests SET validation_error_message = '', validated_at = $1
+	 WHERE repo_id = $2 AND digest = $3
+`)
+
+// ClearManifestValidationError removes the validation error from the given
+// manifest and resets its `validated_at` timestamp, such that the manifest
+// will be picked up by the next run of the janitor's validation loop. This
+// backs the manifest revalidation endpoint of the Keppel API, for users who
+// have fixed the underlying cause of a validation error and do not want to
+// wait for the next regular revalidation. If the manifest in question does not
+// exist, sql.ErrNoRows is returned.
+func ClearManifestValidationError(db gorp.SqlExecutor, repoID int64, digestStr string) error {
+	result, err := db.Exec(clearManifestValidationErrorQuery, time.Unix(0, 0).UTC(), repoID, digestStr)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 // Tag contains a record from the `tags` table.
 type Tag struct {
 	RepositoryID int64      `db:"repo_id"`
@@ -342,6 +500,24 @@ type Tag struct {
 	LastPulledAt *time.Time `db:"last_pulled_at"`
 }
 
+// TagHistoryEntry contains a record from the `tag_history` table. A record is
+// written whenever an existing tag is moved to a different manifest.
+//
+// This table is append-only (a trigger refuses updates and deletions), and its
+// records are not tied to the lifetime of the repository, so that the trail of
+// tag moves survives the deletion of the repository or account.
+type TagHistoryEntry struct {
+	ID             int64     `db:"id"`
+	RepositoryID   int64     `db:"repo_id"`
+	TagName        string    `db:"tag_name"`
+	OldDigest      string    `db:"old_digest"`
+	NewDigest      string    `db:"new_digest"`
+	MovedAt        time.Time `db:"moved_at"`
+	MovedBy        string    `db:"moved_by"` //user name of the pusher, or empty if not known
+	AccountName    string    `db:"account_name"`
+	RepositoryName string    `db:"repo_name"`
+}
+
 // ManifestContent contains a record from the `manifest_contents` table.
 type ManifestContent struct {
 	RepositoryID int64  `db:"repo_id"`
@@ -351,6 +527,28 @@ type ManifestContent struct {
 
 ////////////////////////////////////////////////////////////////////////////////
 
+// RepositoryMetadata contains a record from the `repo_metadata` table.
+type RepositoryMetadata struct {
+	RepositoryID int64  `db:"repo_id"`
+	Description  string `db:"description"`
+	//MetadataJSON contains a JSON string of a map[string]string, or the empty string.
+	MetadataJSON string `db:"metadata_json"`
+}
+
+// FindRepositoryMetadata works similar to db.SelectOne(), but returns nil
+// instead of sql.ErrNoRows if no metadata was set for this repository.
+func FindRepositoryMetadata(db gorp.SqlExecutor, repo Repository) (*RepositoryMetadata, error) {
+	var meta RepositoryMetadata
+	err := db.SelectOne(&meta,
+		"SELECT * FROM repo_metadata WHERE repo_id = $1", repo.ID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &meta, err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
 // Quotas contains a record from the `quotas` table.
 type Quotas struct {
 	AuthTenantID  string `db:"auth_tenant_id"`
@@ -369,6 +567,19 @@ func FindQuotas(db gorp.SqlExecutor, authTenantID string) (*Quotas, error) {
 	return &quotas, err
 }
 
+// FindQuotasOrDefault works like FindQuotas, but returns DefaultQuotas()
+// instead of nil if no quota set exists for this auth tenant.
+func FindQuotasOrDefault(db gorp.SqlExecutor, authTenantID string) (*Quotas, error) {
+	quotas, err := FindQuotas(db, authTenantID)
+	if err != nil {
+		return nil, err
+	}
+	if quotas == nil {
+		quotas = DefaultQuotas(authTenantID)
+	}
+	return quotas, nil
+}
+
 // DefaultQuotas creates a new Quotas instance with the default quotas.
 func DefaultQuotas(authTenantID string) *Quotas {
 	//Right now, the default quota is always 0. The value of having this function
@@ -384,7 +595,7 @@ var manifestUsageQuery = sqlext.SimplifyWhitespace(`
 	  FROM manifests m
 	  JOIN repos r ON m.repo_id = r.id
 	  JOIN accounts a ON a.name = r.account_name
-	 WHERE a.auth_tenant_id = $1
+	 WHERE a.auth_tenant_id = $1 AND m.deleted_at IS NULL
 `)
 
 // GetManifestUsage returns how many manifests currently exist in repos in
@@ -394,6 +605,28 @@ func (q Quotas) GetManifestUsage(db gorp.SqlExecutor) (uint64, error) {
 	return uint64(manifestCount), err
 }
 
+// AccountUsage describes how many resources a single account uses. Unlike
+// Quotas, this is not bound to an auth tenant.
+type AccountUsage struct {
+	RepositoryCount uint64
+	ManifestCount   uint64
+	BlobSizeBytes   uint64
+}
+
+var accountUsageQuery = sqlext.SimplifyWhitespace(`
+	SELECT
+		(SELECT COUNT(*) FROM repos WHERE account_name = $1),
+		(SELECT COUNT(*) FROM manifests m JOIN repos r ON m.repo_id = r.id WHERE r.account_name = $1 AND m.deleted_at IS NULL),
+		(SELECT COALESCE(SUM(size_bytes), 0) FROM blobs WHERE account_name = $1)
+`)
+
+// GetAccountUsage returns how many resources the given account uses.
+func GetAccountUsage(db gorp.SqlExecutor, account Account) (AccountUsage, error) {
+	var u AccountUsage
+	err := db.QueryRow(accountUsageQuery, account.Name).Scan(&u.RepositoryCount, &u.ManifestCount, &u.BlobSizeBytes)
+	return u, err
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 
 // Peer contains a record from the `peers` table.
@@ -493,7 +726,9 @@ func initModels(db *gorp.DbMap) {
 	db.AddTableWithName(Repository{}, "repos").SetKeys(true, "id")
 	db.AddTableWithName(Manifest{}, "manifests").SetKeys(false, "repo_id", "digest")
 	db.AddTableWithName(Tag{}, "tags").SetKeys(false, "repo_id", "name")
+	db.AddTableWithName(TagHistoryEntry{}, "tag_history").SetKeys(true, "id")
 	db.AddTableWithName(ManifestContent{}, "manifest_contents").SetKeys(false, "repo_id", "digest")
+	db.AddTableWithName(RepositoryMetadata{}, "repo_metadata").SetKeys(false, "repo_id")
 	db.AddTableWithName(Quotas{}, "quotas").SetKeys(false, "auth_tenant_id")
 	db.AddTableWithName(Peer{}, "peers").SetKeys(false, "hostname")
 	db.AddTableWithName(PendingBlob{}, "pending_blobs").SetKeys(false, "account_name", "digest")
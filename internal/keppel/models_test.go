@@ -0,0 +1,76 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccountReplicatesRepository(t *testing.T) {
+	testCases := []struct {
+		Include  string
+		Exclude  string
+		RepoName string
+		Expected bool
+	}{
+		{"", "", "foo", true},
+		{"", "", "library/foo", true},
+		{"library/*", "", "library/foo", true},
+		{"library/*", "", "library/foo/bar", false},
+		{"library/*", "", "foo", false},
+		{"foo,library/*", "", "foo", true},
+		{"", "*-test", "foo-test", false},
+		{"", "*-test", "foo", true},
+		{"library/*", "library/secret*", "library/foo", true},
+		{"library/*", "library/secret*", "library/secret-stuff", false},
+	}
+
+	for _, tc := range testCases {
+		account := Account{ReplicationIncludeRepos: tc.Include, ReplicationExcludeRepos: tc.Exclude}
+		actual := account.ReplicatesRepository(tc.RepoName)
+		if actual != tc.Expected {
+			t.Errorf("expected ReplicatesRepository(%q) = %t with include = %q and exclude = %q, but got %t",
+				tc.RepoName, tc.Expected, tc.Include, tc.Exclude, actual)
+		}
+	}
+}
+
+func TestAccountBlobReplicationGracePeriod(t *testing.T) {
+	zero := int64(0)
+	halfHour := int64(1800)
+	testCases := []struct {
+		Secs     *int64
+		Expected time.Duration
+	}{
+		{nil, DefaultBlobReplicationGracePeriod},
+		//an explicit zero disables the grace period instead of selecting the default
+		{&zero, 0},
+		{&halfHour, 30 * time.Minute},
+	}
+
+	for _, tc := range testCases {
+		account := Account{BlobReplicationGracePeriodSecs: tc.Secs}
+		actual := account.BlobReplicationGracePeriod()
+		if actual != tc.Expected {
+			t.Errorf("expected BlobReplicationGracePeriod() = %s, but got %s", tc.Expected, actual)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import "github.com/sapcc/go-api-declarations/bininfo"
+
+// PeerCapabilityReplicaSync is advertised by peers that support the
+// sync-replica API endpoint.
+const PeerCapabilityReplicaSync = "replica-sync"
+
+// PeerInfo is the format for response bodies of the peer info API endpoint.
+// Peers use it to find out which replication features are supported by the
+// other side.
+//
+// (This type is declared in this package because it gets used in both
+// internal/api/peer and internal/client/peer.)
+type PeerInfo struct {
+	Version      string   `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// OurPeerInfo returns the PeerInfo describing this Keppel instance.
+func OurPeerInfo() PeerInfo {
+	return PeerInfo{
+		Version:      bininfo.VersionOr("rolling"),
+		Capabilities: []string{PeerCapabilityReplicaSync},
+	}
+}
+
+// LegacyPeerInfo returns the PeerInfo that we assume for peers that do not
+// have the peer info API endpoint yet. Those peers all support the
+// sync-replica API endpoint.
+func LegacyPeerInfo() PeerInfo {
+	return PeerInfo{
+		Version:      "unknown",
+		Capabilities: []string{PeerCapabilityReplicaSync},
+	}
+}
+
+// HasCapability returns whether the given capability is advertised in this
+// PeerInfo.
+func (i PeerInfo) HasCapability(capability string) bool {
+	for _, c := range i.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -24,6 +24,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
 
 	"github.com/docker/distribution/manifest/manifestlist"
 )
@@ -32,6 +33,28 @@ import (
 // which submanifests get replicated when a list manifest is replicated.
 type PlatformFilter []manifestlist.PlatformSpec
 
+// NewPlatformFilter builds a PlatformFilter that includes exactly the given
+// platforms. Each platform must be given as "os/arch" or "os/arch/variant",
+// e.g. "linux/amd64" or "linux/arm/v7".
+func NewPlatformFilter(platforms ...string) (PlatformFilter, error) {
+	result := make(PlatformFilter, 0, len(platforms))
+	for _, platform := range platforms {
+		fields := strings.Split(platform, "/")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf(`malformed platform %q (expected "os/arch" or "os/arch/variant")`, platform)
+		}
+		spec := manifestlist.PlatformSpec{OS: fields[0], Architecture: fields[1]}
+		if len(fields) == 3 {
+			if fields[2] == "" {
+				return nil, fmt.Errorf(`malformed platform %q (expected "os/arch" or "os/arch/variant")`, platform)
+			}
+			spec.Variant = fields[2]
+		}
+		result = append(result, spec)
+	}
+	return result, nil
+}
+
 // Scan implements the sql.Scanner interface.
 func (f *PlatformFilter) Scan(src interface{}) error {
 	in, ok := src.(string)
@@ -74,12 +97,58 @@ func (f PlatformFilter) Includes(platform manifestlist.PlatformSpec) bool {
 		return true
 	}
 
+	platform = normalizePlatform(platform)
 	for _, p := range f {
 		//NOTE: This check could be much more elaborate, e.g. consider only fields
 		//that are not empty in `p`.
-		if reflect.DeepEqual(p, platform) {
+		if reflect.DeepEqual(normalizePlatform(p), platform) {
 			return true
 		}
 	}
 	return false
 }
+
+// IsEqualTo checks whether both filters include the same platforms. Unlike
+// reflect.DeepEqual, this considers "linux/arm64" and "linux/arm64/v8" to be
+// the same platform (see normalizePlatform).
+func (f PlatformFilter) IsEqualTo(other PlatformFilter) bool {
+	if len(f) != len(other) {
+		return false
+	}
+	for idx := range f {
+		if !reflect.DeepEqual(normalizePlatform(f[idx]), normalizePlatform(other[idx])) {
+			return false
+		}
+	}
+	return true
+}
+
+// Some architectures have a default variant that may or may not be spelled
+// out, e.g. "linux/arm64" and "linux/arm64/v8" are the same platform. This
+// removes the variant if it is the default, so that both spellings compare
+// equal.
+func normalizePlatform(platform manifestlist.PlatformSpec) manifestlist.PlatformSpec {
+	switch {
+	case platform.Architecture == "arm64" && platform.Variant == "v8":
+		platform.Variant = ""
+	case platform.Architecture == "amd64" && platform.Variant == "v1":
+		platform.Variant = ""
+	}
+	return platform
+}
+
+// ParseDefaultPlatform parses the default platform for the given account. If
+// set, list manifests that are pulled by tag without an Accept header will be
+// resolved into the submanifest for this platform. Returns nil if no default
+// platform is configured.
+func (a Account) ParseDefaultPlatform() (*manifestlist.PlatformSpec, error) {
+	if a.DefaultPlatformJSON == "" {
+		return nil, nil
+	}
+	var platform manifestlist.PlatformSpec
+	err := json.Unmarshal([]byte(a.DefaultPlatformJSON), &platform)
+	if err != nil {
+		return nil, fmt.Errorf("cannot deserialize default platform: %w", err)
+	}
+	return &platform, nil
+}
@@ -0,0 +1,145 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+)
+
+func TestPlatformFilterWithExplicitPlatforms(t *testing.T) {
+	pf, err := NewPlatformFilter("linux/amd64", "linux/arm64")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//build a manifest list with 5 platforms
+	platforms := []manifestlist.PlatformSpec{
+		{OS: "linux", Architecture: "386"},
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "windows", Architecture: "amd64"},
+	}
+	var descs []manifestlist.ManifestDescriptor
+	for idx, platform := range platforms {
+		desc := manifestlist.ManifestDescriptor{Platform: platform}
+		desc.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+		desc.Digest = digest.FromBytes([]byte{byte(idx)})
+		desc.Size = 1000
+		descs = append(descs, desc)
+	}
+	list, err := manifestlist.FromDescriptors(descs)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, listBytes, err := list.Payload()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	parsed, _, err := ParseManifest(manifestlist.MediaTypeManifestList, listBytes)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//only the requested two platforms shall be returned
+	var actual []manifestlist.PlatformSpec
+	for _, desc := range parsed.ManifestReferences(pf) {
+		actual = append(actual, desc.Platform)
+	}
+	assert.DeepEqual(t, "platforms", actual, []manifestlist.PlatformSpec{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	})
+
+	//an empty filter still returns everything
+	assert.DeepEqual(t, "number of platforms without filter", len(parsed.ManifestReferences(nil)), 5)
+}
+
+func TestNewPlatformFilterErrors(t *testing.T) {
+	for _, input := range []string{"", "linux", "linux/", "/amd64", "linux/arm/", "linux/arm/v7/extra"} {
+		_, err := NewPlatformFilter(input)
+		if err == nil {
+			t.Errorf("expected NewPlatformFilter(%q) to fail, but it succeeded", input)
+		}
+	}
+
+	pf, err := NewPlatformFilter("linux/arm/v7")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "parsed filter", pf, PlatformFilter{{OS: "linux", Architecture: "arm", Variant: "v7"}})
+}
+
+func TestPlatformFilterNormalizesVariant(t *testing.T) {
+	pf, err := NewPlatformFilter("linux/arm64", "linux/amd64/v1", "linux/arm/v7")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Platform manifestlist.PlatformSpec
+		Expected bool
+	}{
+		//default variants match regardless of whether they are spelled out
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64"}, true},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"}, true},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64"}, true},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64", Variant: "v1"}, true},
+		//non-default variants still need to match exactly
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v7"}, true},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm", Variant: "v6"}, false},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "arm"}, false},
+		{manifestlist.PlatformSpec{OS: "linux", Architecture: "amd64", Variant: "v3"}, false},
+	}
+	for _, tc := range testCases {
+		assert.DeepEqual(t, fmt.Sprintf("Includes(%#v)", tc.Platform), pf.Includes(tc.Platform), tc.Expected)
+	}
+}
+
+func TestPlatformFilterIsEqualTo(t *testing.T) {
+	pf, err := NewPlatformFilter("linux/amd64", "linux/arm64")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		Other    []string
+		Expected bool
+	}{
+		{[]string{"linux/amd64", "linux/arm64"}, true},
+		//default variants are equal regardless of whether they are spelled out
+		{[]string{"linux/amd64/v1", "linux/arm64/v8"}, true},
+		{[]string{"linux/amd64", "linux/arm64/v7"}, false},
+		{[]string{"linux/amd64"}, false},
+		{nil, false},
+	}
+	for _, tc := range testCases {
+		other, err := NewPlatformFilter(tc.Other...)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		assert.DeepEqual(t, fmt.Sprintf("IsEqualTo(%v)", tc.Other), pf.IsEqualTo(other), tc.Expected)
+	}
+}
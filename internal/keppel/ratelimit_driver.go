@@ -46,6 +46,10 @@ const (
 	//pulled from other regions via anycast. The `amount` given to
 	//RateLimitAllows() shall be the blob size in bytes.
 	AnycastBlobBytePullAction RateLimitedAction = "pullblobbytesanycast"
+	//AnonymousRequestAction is a RateLimitedAction. It refers to any
+	//rate-limited request made by an anonymous user, and is counted per
+	//requester IP instead of per account (see RateLimitAllowsAnonymous()).
+	AnonymousRequestAction RateLimitedAction = "anonymousrequest"
 )
 
 // RateLimitDriver is a pluggable strategy that determines the rate limits of
@@ -89,6 +93,17 @@ type RateLimitEngine struct {
 // RateLimitAllows checks whether the given action on the given account is allowed by
 // the account's rate limit.
 func (e RateLimitEngine) RateLimitAllows(account Account, action RateLimitedAction, amount uint64) (bool, *redis_rate.Result, error) {
+	return e.rateLimitAllows(account, action, account.Name, amount)
+}
+
+// RateLimitAllowsAnonymous checks whether another request by an anonymous user
+// from the given IP address is allowed. Unlike with RateLimitAllows(), the
+// budget for this is shared between all accounts.
+func (e RateLimitEngine) RateLimitAllowsAnonymous(account Account, requesterIP string) (bool, *redis_rate.Result, error) {
+	return e.rateLimitAllows(account, AnonymousRequestAction, requesterIP, 1)
+}
+
+func (e RateLimitEngine) rateLimitAllows(account Account, action RateLimitedAction, keySuffix string, amount uint64) (bool, *redis_rate.Result, error) {
 	rateQuota := e.Driver.GetRateLimit(account, action)
 	if rateQuota == nil {
 		//no rate limit for this account and action
@@ -101,7 +116,7 @@ func (e RateLimitEngine) RateLimitAllows(account Account, action RateLimitedActi
 	}
 
 	limiter := redis_rate.NewLimiter(e.Client)
-	key := fmt.Sprintf("keppel-ratelimit-%s-%s", string(action), account.Name)
+	key := fmt.Sprintf("keppel-ratelimit-%s-%s", string(action), keySuffix)
 	result, err := limiter.AllowN(context.Background(), key, *rateQuota, int(amount))
 	if err != nil {
 		return false, &redis_rate.Result{}, err
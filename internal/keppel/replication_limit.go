@@ -0,0 +1,88 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"sync"
+)
+
+// ReplicationLimits holds one semaphore per account. It is used in the
+// replication codepath to limit how many blobs can be replicated into each
+// account at once, so that a popular new image being pulled by many clients
+// does not overwhelm the upstream registry or our own storage.
+//
+// The limit can be configured for each account individually (see
+// Account.MaxConcurrentReplications). Accounts without their own limit use
+// the default limit given to NewReplicationLimits().
+//
+// Replications that exceed the limit wait for a free slot rather than being
+// rejected.
+type ReplicationLimits struct {
+	defaultMaxConcurrent uint64
+	mutex                sync.Mutex
+	semaphores           map[string]chan struct{} //key = account name
+}
+
+// NewReplicationLimits creates a new ReplicationLimits instance that allows up
+// to `defaultMaxConcurrent` replications at once into each account that does
+// not configure its own limit. If `defaultMaxConcurrent` is zero, replications
+// into such accounts are not limited.
+func NewReplicationLimits(defaultMaxConcurrent uint64) *ReplicationLimits {
+	return &ReplicationLimits{
+		defaultMaxConcurrent: defaultMaxConcurrent,
+		semaphores:           make(map[string]chan struct{}),
+	}
+}
+
+// Acquire blocks until a replication into the given account is allowed by the
+// limit, or until the given context expires. On success, the caller must call
+// the returned function once the replication is done to free up its slot.
+func (l *ReplicationLimits) Acquire(ctx context.Context, account Account) (release func(), err error) {
+	maxConcurrent := account.MaxConcurrentReplications
+	if maxConcurrent == 0 {
+		maxConcurrent = l.defaultMaxConcurrent
+	}
+	if maxConcurrent == 0 {
+		return func() {}, nil
+	}
+
+	sem := l.getSemaphore(account.Name, maxConcurrent)
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *ReplicationLimits) getSemaphore(accountName string, maxConcurrent uint64) chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	//when the account's limit was changed, start over with a new semaphore
+	//(replications holding a slot in the old one release it there)
+	sem, exists := l.semaphores[accountName]
+	if !exists || uint64(cap(sem)) != maxConcurrent {
+		sem = make(chan struct{}, maxConcurrent)
+		l.semaphores[accountName] = sem
+	}
+	return sem
+}
@@ -0,0 +1,134 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplicationLimitsUnderBurst(t *testing.T) {
+	l := NewReplicationLimits(3)
+
+	var (
+		mutex       sync.Mutex
+		inFlight    int
+		maxInFlight int
+		wg          sync.WaitGroup
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.Acquire(context.Background(), Account{Name: "test1"})
+			if err != nil {
+				t.Error(err.Error())
+				return
+			}
+			defer release()
+
+			mutex.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond) //simulate a blob download
+
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight > 3 {
+		t.Errorf("expected at most 3 concurrent replications, but saw %d", maxInFlight)
+	}
+	if maxInFlight == 0 {
+		t.Error("expected replications to happen, but saw none")
+	}
+}
+
+func TestReplicationLimitsPerAccount(t *testing.T) {
+	l := NewReplicationLimits(1)
+	release, err := l.Acquire(context.Background(), Account{Name: "test1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//other accounts have their own semaphore
+	releaseOther, err := l.Acquire(context.Background(), Account{Name: "test2"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	releaseOther()
+
+	//waiting for a slot in a full account gives up when the context expires
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(ctx, Account{Name: "test1"})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, but got %v", err)
+	}
+
+	//once the slot is released, the next replication can proceed
+	release()
+	release, err = l.Acquire(context.Background(), Account{Name: "test1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	release()
+}
+
+func TestReplicationLimitsWithAccountOverride(t *testing.T) {
+	l := NewReplicationLimits(1)
+	account := Account{Name: "test1", MaxConcurrentReplications: 2}
+
+	//the account's own limit takes precedence over the default
+	release1, err := l.Acquire(context.Background(), account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	release2, err := l.Acquire(context.Background(), account)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.Acquire(ctx, account)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, but got %v", err)
+	}
+	release1()
+	release2()
+
+	//without a default, only accounts with their own limit are limited
+	l = NewReplicationLimits(0)
+	for i := 0; i < 5; i++ {
+		_, err := l.Acquire(context.Background(), Account{Name: "test2"})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses the list of reverse proxies whose
+// X-Forwarded-For headers shall be believed (see RequesterIP). Each entry can
+// be either a single IP address or a network in CIDR notation.
+func ParseTrustedProxies(entries []string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not a valid IP address", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid CIDR: %w", entry, err)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// RequesterIP returns the IP address of the client that sent this request.
+//
+// Unlike httpext.GetRequesterIPFor(), this does not blindly believe the
+// X-Forwarded-For header, since any client can set that header to an
+// arbitrary value. The header is only evaluated if the request was received
+// from one of the TrustedProxies. In that case, the header is read from right
+// to left (i.e. starting with the entry added by the nearest proxy), and the
+// first address that is not a trusted proxy itself is the requester IP.
+func (cfg Configuration) RequesterIP(r *http.Request) string {
+	result := stripPort(r.RemoteAddr)
+	if !cfg.isTrustedProxy(result) {
+		return result
+	}
+
+	var forwardedFor []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwardedFor = append(forwardedFor, strings.Split(value, ",")...)
+	}
+	for idx := len(forwardedFor) - 1; idx >= 0; idx-- {
+		entry := stripPort(strings.TrimSpace(forwardedFor[idx]))
+		if entry == "" {
+			continue
+		}
+		result = entry
+		if !cfg.isTrustedProxy(entry) {
+			break
+		}
+	}
+	return result
+}
+
+func (cfg Configuration) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range cfg.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func stripPort(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		return host
+	}
+	return address
+}
@@ -0,0 +1,73 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequesterIP(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	testCases := []struct {
+		RemoteAddr     string
+		ForwardedFor   string
+		TrustedProxies bool
+		Expected       string
+	}{
+		//without trusted proxies, X-Forwarded-For is ignored
+		{"203.0.113.5:1234", "", false, "203.0.113.5"},
+		{"203.0.113.5:1234", "198.51.100.1", false, "203.0.113.5"},
+		{"192.0.2.1:1234", "198.51.100.1", false, "192.0.2.1"},
+		//requests that do not come from a trusted proxy are not believed either
+		{"203.0.113.5:1234", "198.51.100.1", true, "203.0.113.5"},
+		//behind trusted proxies, the rightmost untrusted entry is used
+		{"192.0.2.1:1234", "198.51.100.1", true, "198.51.100.1"},
+		{"192.0.2.1:1234", "198.51.100.2, 198.51.100.1", true, "198.51.100.1"},
+		{"192.0.2.1:1234", "198.51.100.1, 10.1.2.3", true, "198.51.100.1"},
+		{"192.0.2.1:1234", "", true, "192.0.2.1"},
+	}
+
+	for _, tc := range testCases {
+		var cfg Configuration
+		if tc.TrustedProxies {
+			cfg.TrustedProxies = trustedProxies
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.RemoteAddr
+		if tc.ForwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.ForwardedFor)
+		}
+		actual := cfg.RequesterIP(r)
+		if actual != tc.Expected {
+			t.Errorf("expected RequesterIP(RemoteAddr = %q, X-Forwarded-For = %q) to be %q, but got %q",
+				tc.RemoteAddr, tc.ForwardedFor, tc.Expected, actual)
+		}
+	}
+
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	if err == nil {
+		t.Error("expected ParseTrustedProxies to reject a malformed entry")
+	}
+}
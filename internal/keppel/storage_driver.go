@@ -20,10 +20,13 @@
 package keppel
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"io"
+	"time"
 
 	"github.com/sapcc/go-bits/pluggable"
 )
@@ -93,6 +96,161 @@ type StorageDriver interface {
 	CleanupAccount(account Account) error
 }
 
+// ManifestStreamer is an optional interface that a StorageDriver can implement
+// to allow reading manifests without buffering their entire contents in memory.
+type ManifestStreamer interface {
+	ReadManifestStream(account Account, repoName, digest string) (io.ReadCloser, error)
+}
+
+// ReadManifestStream reads a manifest from the given StorageDriver. If the
+// StorageDriver implements the ManifestStreamer interface, the contents are
+// streamed. Otherwise, this falls back to ReadManifest().
+func ReadManifestStream(sd StorageDriver, account Account, repoName, digest string) (io.ReadCloser, error) {
+	if ms, ok := sd.(ManifestStreamer); ok {
+		return ms.ReadManifestStream(account, repoName, digest)
+	}
+	contents, err := sd.ReadManifest(account, repoName, digest)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// BlobRangeReader is an optional interface that a StorageDriver can implement
+// to allow reading only a part of a blob, e.g. for serving Range requests.
+// The caller guarantees that `offset + length` does not exceed the blob size.
+type BlobRangeReader interface {
+	ReadBlobRange(account Account, storageID string, offset, length uint64) (io.ReadCloser, error)
+}
+
+// ReadBlobRange reads `length` bytes starting at `offset` from the given blob.
+// If the StorageDriver implements the BlobRangeReader interface, only the
+// requested range is read from the storage. Otherwise, this falls back to
+// ReadBlob() and skips over the bytes before the requested range.
+func ReadBlobRange(sd StorageDriver, account Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	if brr, ok := sd.(BlobRangeReader); ok {
+		return brr.ReadBlobRange(account, storageID, offset, length)
+	}
+	contents, _, err := sd.ReadBlob(account, storageID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.CopyN(io.Discard, contents, int64(offset))
+	if err != nil {
+		contents.Close()
+		return nil, err
+	}
+	return limitedReadCloser{io.LimitReader(contents, int64(length)), contents}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// ExpiringBlobURLGenerator is an optional interface that a StorageDriver can
+// implement if the URLs generated by URLForBlob() expire. It allows the caller
+// to choose how long the URL shall stay valid, e.g. when the URL is handed to
+// a process that may take a long time before it gets around to using it.
+type ExpiringBlobURLGenerator interface {
+	URLForBlobWithTTL(account Account, storageID string, ttl time.Duration) (string, error)
+}
+
+// URLForBlobWithTTL generates a URL for the given blob using the given
+// StorageDriver. If the StorageDriver implements the ExpiringBlobURLGenerator
+// interface, the URL stays valid for at least the given TTL. Otherwise, this
+// falls back to URLForBlob().
+func URLForBlobWithTTL(sd StorageDriver, account Account, storageID string, ttl time.Duration) (string, error) {
+	if g, ok := sd.(ExpiringBlobURLGenerator); ok {
+		return g.URLForBlobWithTTL(account, storageID, ttl)
+	}
+	return sd.URLForBlob(account, storageID)
+}
+
+// ContextReader is an optional interface that a StorageDriver can implement
+// to allow aborting reads when the given context expires, e.g. because the
+// caller does not want to wait for a slow storage backend indefinitely. When
+// the context expires, the driver shall abort any pending requests and return
+// an error, both when opening the object and when reading its contents.
+type ContextReader interface {
+	ReadBlobWithContext(ctx context.Context, account Account, storageID string) (contents io.ReadCloser, sizeBytes uint64, err error)
+	ReadManifestStreamWithContext(ctx context.Context, account Account, repoName, digest string) (io.ReadCloser, error)
+}
+
+// ReadBlobWithContext reads a blob from the given StorageDriver. If the
+// StorageDriver implements the ContextReader interface, the read is aborted
+// when `ctx` expires. Otherwise, this falls back to ReadBlob(), and only the
+// reading of the contents is aborted when `ctx` expires.
+func ReadBlobWithContext(ctx context.Context, sd StorageDriver, account Account, storageID string) (io.ReadCloser, uint64, error) {
+	if cr, ok := sd.(ContextReader); ok {
+		return cr.ReadBlobWithContext(ctx, account, storageID)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+	contents, sizeBytes, err := sd.ReadBlob(account, storageID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contextReadCloser{ctx, contents}, sizeBytes, nil
+}
+
+// ReadManifestStreamWithContext is like ReadManifestStream(), but aborts the
+// read when `ctx` expires, in the same way as ReadBlobWithContext().
+func ReadManifestStreamWithContext(ctx context.Context, sd StorageDriver, account Account, repoName, digest string) (io.ReadCloser, error) {
+	if cr, ok := sd.(ContextReader); ok {
+		return cr.ReadManifestStreamWithContext(ctx, account, repoName, digest)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ReadManifestStream(sd, account, repoName, digest)
+	if err != nil {
+		return nil, err
+	}
+	return contextReadCloser{ctx, contents}, nil
+}
+
+// ReadManifestWithContext is like StorageDriver.ReadManifest(), but aborts
+// the read when `ctx` expires, in the same way as ReadBlobWithContext().
+func ReadManifestWithContext(ctx context.Context, sd StorageDriver, account Account, repoName, digest string) ([]byte, error) {
+	if _, ok := sd.(ContextReader); !ok {
+		//avoid the detour through ReadManifestStream() if it does not help us
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		return sd.ReadManifest(account, repoName, digest)
+	}
+	reader, err := ReadManifestStreamWithContext(ctx, sd, account, repoName, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// contextReadCloser is an io.ReadCloser that fails all reads once its context
+// has expired.
+type contextReadCloser struct {
+	ctx   context.Context
+	inner io.ReadCloser
+}
+
+func (r contextReadCloser) Read(buf []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return r.inner.Read(buf)
+}
+
+func (r contextReadCloser) Close() error {
+	return r.inner.Close()
+}
+
 // StoredBlobInfo is returned by StorageDriver.ListStorageContents().
 type StoredBlobInfo struct {
 	StorageID string
@@ -120,13 +278,33 @@ var ErrCannotGenerateURL = errors.New("URLForBlob() is not supported")
 var StorageDriverRegistry pluggable.Registry[StorageDriver]
 
 // NewStorageDriver creates a new StorageDriver using one of the factory functions
-// registered with RegisterStorageDriver().
+// registered with RegisterStorageDriver(). The result is wrapped with
+// InstrumentStorageDriver() and RetryStorageDriver().
 func NewStorageDriver(pluginTypeID string, ad AuthDriver, cfg Configuration) (StorageDriver, error) {
 	sd := StorageDriverRegistry.Instantiate(pluginTypeID)
 	if sd == nil {
 		return nil, errors.New("no such storage driver: " + pluginTypeID)
 	}
-	return sd, sd.Init(ad, cfg)
+	//retries happen outside of the instrumentation, so that each failed attempt shows up in the metrics
+	return RetryStorageDriver(InstrumentStorageDriver(sd), cfg.StorageRetries), sd.Init(ad, cfg)
+}
+
+// storageDriverDecorator is implemented by the StorageDriver wrappers in this
+// package, to support UnwrapStorageDriver().
+type storageDriverDecorator interface {
+	unwrapStorageDriver() StorageDriver
+}
+
+// UnwrapStorageDriver removes all decorators that NewStorageDriver() applies,
+// and returns the original StorageDriver implementation.
+func UnwrapStorageDriver(sd StorageDriver) StorageDriver {
+	for {
+		d, ok := sd.(storageDriverDecorator)
+		if !ok {
+			return sd
+		}
+		sd = d.unwrapStorageDriver()
+	}
 }
 
 // GenerateStorageID generates a new random storage ID for use with
@@ -0,0 +1,312 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	storageOperationDurationHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "keppel_storage_operation_duration_seconds",
+			Help:    "Duration of storage driver operations. For operations returning a reader, this is the time until the reader is returned.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"driver", "operation"},
+	)
+	storageOperationFailedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_failed_storage_operations",
+			Help: "Counts storage driver operations that returned an error (including errors while reading a returned reader).",
+		},
+		[]string{"driver", "operation"},
+	)
+	storageOperationBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "keppel_storage_operation_bytes",
+			Help: "Counts payload bytes written into or read from the storage driver.",
+		},
+		[]string{"driver", "operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storageOperationDurationHistogram)
+	prometheus.MustRegister(storageOperationFailedCounter)
+	prometheus.MustRegister(storageOperationBytesCounter)
+}
+
+// InstrumentStorageDriver wraps the given StorageDriver such that latency,
+// errors and transferred bytes of all its operations are recorded as
+// Prometheus metrics. NewStorageDriver() applies this automatically.
+func InstrumentStorageDriver(sd StorageDriver) StorageDriver {
+	if _, ok := sd.(instrumentedStorageDriver); ok {
+		return sd
+	}
+	return instrumentedStorageDriver{sd}
+}
+
+type instrumentedStorageDriver struct {
+	inner StorageDriver
+}
+
+func (d instrumentedStorageDriver) unwrapStorageDriver() StorageDriver {
+	return d.inner
+}
+
+func (d instrumentedStorageDriver) labels(operation string) prometheus.Labels {
+	return prometheus.Labels{"driver": d.inner.PluginTypeID(), "operation": operation}
+}
+
+func (d instrumentedStorageDriver) observe(operation string, startedAt time.Time, err error) {
+	labels := d.labels(operation)
+	storageOperationDurationHistogram.With(labels).Observe(time.Since(startedAt).Seconds())
+	if err != nil {
+		storageOperationFailedCounter.With(labels).Inc()
+	}
+}
+
+func (d instrumentedStorageDriver) countBytes(operation string, bytes int) {
+	storageOperationBytesCounter.With(d.labels(operation)).Add(float64(bytes))
+}
+
+// PluginTypeID implements the StorageDriver interface.
+func (d instrumentedStorageDriver) PluginTypeID() string {
+	return d.inner.PluginTypeID()
+}
+
+// Init implements the StorageDriver interface.
+func (d instrumentedStorageDriver) Init(ad AuthDriver, cfg Configuration) error {
+	return d.inner.Init(ad, cfg)
+}
+
+// AppendToBlob implements the StorageDriver interface.
+func (d instrumentedStorageDriver) AppendToBlob(account Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	startedAt := time.Now()
+	reader := &countingReader{Reader: chunk}
+	err := d.inner.AppendToBlob(account, storageID, chunkNumber, chunkLength, reader)
+	d.observe("AppendToBlob", startedAt, err)
+	d.countBytes("AppendToBlob", reader.BytesRead)
+	return err
+}
+
+// FinalizeBlob implements the StorageDriver interface.
+func (d instrumentedStorageDriver) FinalizeBlob(account Account, storageID string, chunkCount uint32) error {
+	startedAt := time.Now()
+	err := d.inner.FinalizeBlob(account, storageID, chunkCount)
+	d.observe("FinalizeBlob", startedAt, err)
+	return err
+}
+
+// AbortBlobUpload implements the StorageDriver interface.
+func (d instrumentedStorageDriver) AbortBlobUpload(account Account, storageID string, chunkCount uint32) error {
+	startedAt := time.Now()
+	err := d.inner.AbortBlobUpload(account, storageID, chunkCount)
+	d.observe("AbortBlobUpload", startedAt, err)
+	return err
+}
+
+// ReadBlob implements the StorageDriver interface.
+func (d instrumentedStorageDriver) ReadBlob(account Account, storageID string) (io.ReadCloser, uint64, error) {
+	startedAt := time.Now()
+	contents, sizeBytes, err := d.inner.ReadBlob(account, storageID)
+	d.observe("ReadBlob", startedAt, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.instrumentReader("ReadBlob", contents), sizeBytes, nil
+}
+
+// ReadBlobRange implements the BlobRangeReader interface.
+func (d instrumentedStorageDriver) ReadBlobRange(account Account, storageID string, offset, length uint64) (io.ReadCloser, error) {
+	startedAt := time.Now()
+	contents, err := ReadBlobRange(d.inner, account, storageID, offset, length)
+	d.observe("ReadBlob", startedAt, err)
+	if err != nil {
+		return nil, err
+	}
+	return d.instrumentReader("ReadBlob", contents), nil
+}
+
+// ReadBlobWithContext implements the ContextReader interface.
+func (d instrumentedStorageDriver) ReadBlobWithContext(ctx context.Context, account Account, storageID string) (io.ReadCloser, uint64, error) {
+	startedAt := time.Now()
+	contents, sizeBytes, err := ReadBlobWithContext(ctx, d.inner, account, storageID)
+	d.observe("ReadBlob", startedAt, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d.instrumentReader("ReadBlob", contents), sizeBytes, nil
+}
+
+// URLForBlob implements the StorageDriver interface.
+func (d instrumentedStorageDriver) URLForBlob(account Account, storageID string) (string, error) {
+	startedAt := time.Now()
+	url, err := d.inner.URLForBlob(account, storageID)
+	d.observe("URLForBlob", startedAt, ignoreErrCannotGenerateURL(err))
+	return url, err
+}
+
+// URLForBlobWithTTL implements the ExpiringBlobURLGenerator interface.
+func (d instrumentedStorageDriver) URLForBlobWithTTL(account Account, storageID string, ttl time.Duration) (string, error) {
+	startedAt := time.Now()
+	url, err := URLForBlobWithTTL(d.inner, account, storageID, ttl)
+	d.observe("URLForBlob", startedAt, ignoreErrCannotGenerateURL(err))
+	return url, err
+}
+
+// ignoreErrCannotGenerateURL is used because ErrCannotGenerateURL is an
+// expected result for drivers that do not support URLForBlob(), so it should
+// not show up as a failure in the metrics.
+func ignoreErrCannotGenerateURL(err error) error {
+	if errors.Is(err, ErrCannotGenerateURL) {
+		return nil
+	}
+	return err
+}
+
+// DeleteBlob implements the StorageDriver interface.
+func (d instrumentedStorageDriver) DeleteBlob(account Account, storageID string) error {
+	startedAt := time.Now()
+	err := d.inner.DeleteBlob(account, storageID)
+	d.observe("DeleteBlob", startedAt, err)
+	return err
+}
+
+// ReadManifest implements the StorageDriver interface.
+func (d instrumentedStorageDriver) ReadManifest(account Account, repoName, digest string) ([]byte, error) {
+	startedAt := time.Now()
+	contents, err := d.inner.ReadManifest(account, repoName, digest)
+	d.observe("ReadManifest", startedAt, err)
+	d.countBytes("ReadManifest", len(contents))
+	return contents, err
+}
+
+// ReadManifestStream implements the ManifestStreamer interface.
+func (d instrumentedStorageDriver) ReadManifestStream(account Account, repoName, digest string) (io.ReadCloser, error) {
+	startedAt := time.Now()
+	contents, err := ReadManifestStream(d.inner, account, repoName, digest)
+	d.observe("ReadManifest", startedAt, err)
+	if err != nil {
+		return nil, err
+	}
+	return d.instrumentReader("ReadManifest", contents), nil
+}
+
+// ReadManifestStreamWithContext implements the ContextReader interface.
+func (d instrumentedStorageDriver) ReadManifestStreamWithContext(ctx context.Context, account Account, repoName, digest string) (io.ReadCloser, error) {
+	startedAt := time.Now()
+	contents, err := ReadManifestStreamWithContext(ctx, d.inner, account, repoName, digest)
+	d.observe("ReadManifest", startedAt, err)
+	if err != nil {
+		return nil, err
+	}
+	return d.instrumentReader("ReadManifest", contents), nil
+}
+
+// WriteManifest implements the StorageDriver interface.
+func (d instrumentedStorageDriver) WriteManifest(account Account, repoName, digest string, contents []byte) error {
+	startedAt := time.Now()
+	err := d.inner.WriteManifest(account, repoName, digest, contents)
+	d.observe("WriteManifest", startedAt, err)
+	if err == nil {
+		d.countBytes("WriteManifest", len(contents))
+	}
+	return err
+}
+
+// DeleteManifest implements the StorageDriver interface.
+func (d instrumentedStorageDriver) DeleteManifest(account Account, repoName, digest string) error {
+	startedAt := time.Now()
+	err := d.inner.DeleteManifest(account, repoName, digest)
+	d.observe("DeleteManifest", startedAt, err)
+	return err
+}
+
+// ListStorageContents implements the StorageDriver interface.
+func (d instrumentedStorageDriver) ListStorageContents(account Account) ([]StoredBlobInfo, []StoredManifestInfo, error) {
+	startedAt := time.Now()
+	blobs, manifests, err := d.inner.ListStorageContents(account)
+	d.observe("ListStorageContents", startedAt, err)
+	return blobs, manifests, err
+}
+
+// CanSetupAccount implements the StorageDriver interface.
+func (d instrumentedStorageDriver) CanSetupAccount(account Account) error {
+	startedAt := time.Now()
+	err := d.inner.CanSetupAccount(account)
+	d.observe("CanSetupAccount", startedAt, err)
+	return err
+}
+
+// CleanupAccount implements the StorageDriver interface.
+func (d instrumentedStorageDriver) CleanupAccount(account Account) error {
+	startedAt := time.Now()
+	err := d.inner.CleanupAccount(account)
+	d.observe("CleanupAccount", startedAt, err)
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// helper types for counting bytes
+
+type countingReader struct {
+	io.Reader
+	BytesRead int
+}
+
+// Read implements the io.Reader interface.
+func (r *countingReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	r.BytesRead += n
+	return n, err
+}
+
+func (d instrumentedStorageDriver) instrumentReader(operation string, contents io.ReadCloser) io.ReadCloser {
+	return &instrumentedReadCloser{ReadCloser: contents, driver: d, operation: operation}
+}
+
+// instrumentedReadCloser counts bytes and errors while the caller reads the
+// contents returned by a storage driver.
+type instrumentedReadCloser struct {
+	io.ReadCloser
+	driver    instrumentedStorageDriver
+	operation string
+	failed    bool
+}
+
+// Read implements the io.Reader interface.
+func (r *instrumentedReadCloser) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	if n > 0 {
+		r.driver.countBytes(r.operation, n)
+	}
+	if err != nil && err != io.EOF && !r.failed {
+		r.failed = true
+		storageOperationFailedCounter.With(r.driver.labels(r.operation)).Inc()
+	}
+	return n, err
+}
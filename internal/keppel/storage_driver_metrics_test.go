@@ -0,0 +1,206 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInstrumentedStorageDriver(t *testing.T) {
+	inner := &noopStorageDriver{blobs: make(map[string][]byte)}
+	sd := InstrumentStorageDriver(inner)
+	if UnwrapStorageDriver(sd) != StorageDriver(inner) {
+		t.Error("UnwrapStorageDriver() did not return the original driver")
+	}
+	if InstrumentStorageDriver(sd) != sd {
+		t.Error("InstrumentStorageDriver() wrapped an already instrumented driver again")
+	}
+
+	//metrics are global, so we need to compare against the values before the test
+	type sample struct {
+		Operations float64
+		Failures   float64
+		Bytes      float64
+	}
+	getSample := func(operation string) sample {
+		return sample{
+			Operations: getStorageMetricValue(t, "keppel_storage_operation_duration_seconds", operation),
+			Failures:   getStorageMetricValue(t, "keppel_failed_storage_operations", operation),
+			Bytes:      getStorageMetricValue(t, "keppel_storage_operation_bytes", operation),
+		}
+	}
+	operations := []string{"AppendToBlob", "FinalizeBlob", "ReadBlob", "URLForBlob", "DeleteBlob"}
+	before := make(map[string]sample)
+	for _, op := range operations {
+		before[op] = getSample(op)
+	}
+	expectDelta := func(operation string, expected sample) {
+		t.Helper()
+		after := getSample(operation)
+		actual := sample{
+			Operations: after.Operations - before[operation].Operations,
+			Failures:   after.Failures - before[operation].Failures,
+			Bytes:      after.Bytes - before[operation].Bytes,
+		}
+		if actual != expected {
+			t.Errorf("expected %s metrics to change by %#v, but they changed by %#v", operation, expected, actual)
+		}
+	}
+
+	//do some successful and some failing operations
+	account := Account{Name: "test1"}
+	mustDo(t, sd.AppendToBlob(account, "storageid", 1, nil, strings.NewReader("foo")))
+	mustDo(t, sd.AppendToBlob(account, "storageid", 2, nil, strings.NewReader("barbaz")))
+	mustDo(t, sd.FinalizeBlob(account, "storageid", 2))
+	if sd.FinalizeBlob(account, "unknown", 1) == nil {
+		t.Error("expected FinalizeBlob to fail for unknown blob")
+	}
+	reader, _, err := sd.ReadBlob(account, "storageid")
+	mustDo(t, err)
+	buf, err := io.ReadAll(reader)
+	mustDo(t, err)
+	mustDo(t, reader.Close())
+	if string(buf) != "foobarbaz" {
+		t.Errorf("expected blob contents %q, but got %q", "foobarbaz", string(buf))
+	}
+	_, err = sd.URLForBlob(account, "storageid")
+	if err != ErrCannotGenerateURL {
+		t.Errorf("expected ErrCannotGenerateURL, but got %v", err)
+	}
+	mustDo(t, sd.DeleteBlob(account, "storageid"))
+
+	expectDelta("AppendToBlob", sample{Operations: 2, Failures: 0, Bytes: 9})
+	expectDelta("FinalizeBlob", sample{Operations: 2, Failures: 1, Bytes: 0})
+	expectDelta("ReadBlob", sample{Operations: 1, Failures: 0, Bytes: 9})
+	expectDelta("URLForBlob", sample{Operations: 1, Failures: 0, Bytes: 0}) //ErrCannotGenerateURL is not a failure
+	expectDelta("DeleteBlob", sample{Operations: 1, Failures: 0, Bytes: 0})
+}
+
+// getStorageMetricValue reads the value of one series of the storage driver
+// metrics. For histograms, the sample count is returned.
+func getStorageMetricValue(t *testing.T, metricName, operation string) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	mustDo(t, err)
+	for _, family := range families {
+		if family.GetName() != metricName {
+			continue
+		}
+	METRIC:
+		for _, metric := range family.GetMetric() {
+			expectedLabels := map[string]string{"driver": "noop", "operation": operation}
+			for _, label := range metric.GetLabel() {
+				if expectedLabels[label.GetName()] != label.GetValue() {
+					continue METRIC
+				}
+			}
+			if histogram := metric.GetHistogram(); histogram != nil {
+				return float64(histogram.GetSampleCount())
+			}
+			return metric.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func mustDo(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// noopStorageDriver is a minimal in-memory StorageDriver that only supports
+// blobs. (We cannot use the in-memory driver from package trivial here because
+// of import cycles.)
+type noopStorageDriver struct {
+	blobs map[string][]byte
+}
+
+var errNoopUnsupported = errors.New("not supported by noopStorageDriver")
+
+func (d *noopStorageDriver) PluginTypeID() string                 { return "noop" }
+func (d *noopStorageDriver) Init(AuthDriver, Configuration) error { return nil }
+
+func (d *noopStorageDriver) AppendToBlob(account Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	buf, err := io.ReadAll(chunk)
+	if err != nil {
+		return err
+	}
+	d.blobs[storageID+".tmp"] = append(d.blobs[storageID+".tmp"], buf...)
+	return nil
+}
+
+func (d *noopStorageDriver) FinalizeBlob(account Account, storageID string, chunkCount uint32) error {
+	contents, exists := d.blobs[storageID+".tmp"]
+	if !exists {
+		return errors.New("no such upload")
+	}
+	d.blobs[storageID] = contents
+	delete(d.blobs, storageID+".tmp")
+	return nil
+}
+
+func (d *noopStorageDriver) AbortBlobUpload(account Account, storageID string, chunkCount uint32) error {
+	delete(d.blobs, storageID+".tmp")
+	return nil
+}
+
+func (d *noopStorageDriver) ReadBlob(account Account, storageID string) (io.ReadCloser, uint64, error) {
+	contents, exists := d.blobs[storageID]
+	if !exists {
+		return nil, 0, errors.New("no such blob")
+	}
+	return io.NopCloser(bytes.NewReader(contents)), uint64(len(contents)), nil
+}
+
+func (d *noopStorageDriver) URLForBlob(account Account, storageID string) (string, error) {
+	return "", ErrCannotGenerateURL
+}
+
+func (d *noopStorageDriver) DeleteBlob(account Account, storageID string) error {
+	delete(d.blobs, storageID)
+	return nil
+}
+
+func (d *noopStorageDriver) ReadManifest(account Account, repoName, digest string) ([]byte, error) {
+	return nil, errNoopUnsupported
+}
+
+func (d *noopStorageDriver) WriteManifest(account Account, repoName, digest string, contents []byte) error {
+	return errNoopUnsupported
+}
+
+func (d *noopStorageDriver) DeleteManifest(account Account, repoName, digest string) error {
+	return errNoopUnsupported
+}
+
+func (d *noopStorageDriver) ListStorageContents(account Account) ([]StoredBlobInfo, []StoredManifestInfo, error) {
+	return nil, nil, errNoopUnsupported
+}
+
+func (d *noopStorageDriver) CanSetupAccount(account Account) error { return nil }
+func (d *noopStorageDriver) CleanupAccount(account Account) error  { return nil }
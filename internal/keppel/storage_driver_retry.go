@@ -0,0 +1,264 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/majewsky/schwift"
+	"github.com/sapcc/go-bits/logg"
+)
+
+// RetryableStorageError can be implemented by errors returned from a
+// StorageDriver to declare whether the failed operation may succeed when it
+// is retried (e.g. because the storage backend was throttling requests).
+type RetryableStorageError interface {
+	error
+	IsRetryable() bool
+}
+
+// IsRetryableStorageError returns whether the given error, as returned by a
+// StorageDriver, is transient, i.e. whether retrying the failed operation
+// may succeed.
+func IsRetryableStorageError(err error) bool {
+	if err == nil {
+		return false
+	}
+	//an expired context will not become valid again by retrying (this check
+	//needs to come first since context.DeadlineExceeded is a net.Error)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var rerr RetryableStorageError
+	if errors.As(err, &rerr) {
+		return rerr.IsRetryable()
+	}
+	var v2err *RegistryV2Error
+	if errors.As(err, &v2err) {
+		return v2err.Code == ErrTooManyRequests
+	}
+	//Swift reports throttling and server-side trouble through status codes
+	var serr schwift.UnexpectedStatusCodeError
+	if errors.As(err, &serr) && serr.ActualResponse != nil {
+		code := serr.ActualResponse.StatusCode
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryStorageDriver wraps the given StorageDriver such that idempotent
+// operations are retried with exponential backoff when they fail with a
+// retryable error (see IsRetryableStorageError). Operations that are not
+// idempotent, or that consume a reader provided by the caller, are never
+// retried. If the policy does not allow for retries, the StorageDriver is
+// returned unchanged. NewStorageDriver() applies this automatically.
+func RetryStorageDriver(sd StorageDriver, policy StorageRetryPolicy) StorageDriver {
+	if policy.MaxAttempts < 2 {
+		return sd
+	}
+	return retryingStorageDriver{sd, policy, sleepWithContext}
+}
+
+// The delay between retries doubles after each attempt, but never grows
+// beyond this value.
+const maxStorageRetryBackoff = 10 * time.Second
+
+type retryingStorageDriver struct {
+	inner  StorageDriver
+	policy StorageRetryPolicy
+	sleep  func(context.Context, time.Duration) error //can be replaced in unit tests
+}
+
+func (d retryingStorageDriver) unwrapStorageDriver() StorageDriver {
+	return d.inner
+}
+
+func (d retryingStorageDriver) retry(ctx context.Context, operation string, action func() error) error {
+	backoff := d.policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := action()
+		if attempt >= d.policy.MaxAttempts || !IsRetryableStorageError(err) {
+			return err
+		}
+		logg.Info("retrying storage operation %s (attempt %d of %d failed): %s", operation, attempt, d.policy.MaxAttempts, err.Error())
+		//if the caller gives up while we wait, report the last actual error
+		if d.sleep(ctx, backoff) != nil {
+			return err
+		}
+		backoff *= 2
+		if backoff > maxStorageRetryBackoff {
+			backoff = maxStorageRetryBackoff
+		}
+	}
+}
+
+// PluginTypeID implements the StorageDriver interface.
+func (d retryingStorageDriver) PluginTypeID() string {
+	return d.inner.PluginTypeID()
+}
+
+// Init implements the StorageDriver interface.
+func (d retryingStorageDriver) Init(ad AuthDriver, cfg Configuration) error {
+	return d.inner.Init(ad, cfg)
+}
+
+// AppendToBlob implements the StorageDriver interface.
+func (d retryingStorageDriver) AppendToBlob(account Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	//not retried: the chunk reader cannot be rewound
+	return d.inner.AppendToBlob(account, storageID, chunkNumber, chunkLength, chunk)
+}
+
+// FinalizeBlob implements the StorageDriver interface.
+func (d retryingStorageDriver) FinalizeBlob(account Account, storageID string, chunkCount uint32) error {
+	//not retried: may not be idempotent, depending on the driver
+	return d.inner.FinalizeBlob(account, storageID, chunkCount)
+}
+
+// AbortBlobUpload implements the StorageDriver interface.
+func (d retryingStorageDriver) AbortBlobUpload(account Account, storageID string, chunkCount uint32) error {
+	//not retried: a retry after a partially successful attempt would fail on the already deleted parts
+	return d.inner.AbortBlobUpload(account, storageID, chunkCount)
+}
+
+// ReadBlob implements the StorageDriver interface.
+func (d retryingStorageDriver) ReadBlob(account Account, storageID string) (contents io.ReadCloser, sizeBytes uint64, err error) {
+	//NOTE: Only opening the blob is retried. Errors while reading the contents
+	//are reported to the caller.
+	err = d.retry(context.Background(), "ReadBlob", func() (err error) {
+		contents, sizeBytes, err = d.inner.ReadBlob(account, storageID)
+		return err
+	})
+	return contents, sizeBytes, err
+}
+
+// ReadBlobRange implements the BlobRangeReader interface.
+func (d retryingStorageDriver) ReadBlobRange(account Account, storageID string, offset, length uint64) (contents io.ReadCloser, err error) {
+	err = d.retry(context.Background(), "ReadBlob", func() (err error) {
+		contents, err = ReadBlobRange(d.inner, account, storageID, offset, length)
+		return err
+	})
+	return contents, err
+}
+
+// ReadBlobWithContext implements the ContextReader interface.
+func (d retryingStorageDriver) ReadBlobWithContext(ctx context.Context, account Account, storageID string) (contents io.ReadCloser, sizeBytes uint64, err error) {
+	err = d.retry(ctx, "ReadBlob", func() (err error) {
+		contents, sizeBytes, err = ReadBlobWithContext(ctx, d.inner, account, storageID)
+		return err
+	})
+	return contents, sizeBytes, err
+}
+
+// URLForBlob implements the StorageDriver interface.
+func (d retryingStorageDriver) URLForBlob(account Account, storageID string) (url string, err error) {
+	err = d.retry(context.Background(), "URLForBlob", func() (err error) {
+		url, err = d.inner.URLForBlob(account, storageID)
+		return err
+	})
+	return url, err
+}
+
+// URLForBlobWithTTL implements the ExpiringBlobURLGenerator interface.
+func (d retryingStorageDriver) URLForBlobWithTTL(account Account, storageID string, ttl time.Duration) (url string, err error) {
+	err = d.retry(context.Background(), "URLForBlob", func() (err error) {
+		url, err = URLForBlobWithTTL(d.inner, account, storageID, ttl)
+		return err
+	})
+	return url, err
+}
+
+// DeleteBlob implements the StorageDriver interface.
+func (d retryingStorageDriver) DeleteBlob(account Account, storageID string) error {
+	//not retried: a retry after a successful attempt whose response got lost would report "not found"
+	return d.inner.DeleteBlob(account, storageID)
+}
+
+// ReadManifest implements the StorageDriver interface.
+func (d retryingStorageDriver) ReadManifest(account Account, repoName, digest string) (contents []byte, err error) {
+	err = d.retry(context.Background(), "ReadManifest", func() (err error) {
+		contents, err = d.inner.ReadManifest(account, repoName, digest)
+		return err
+	})
+	return contents, err
+}
+
+// ReadManifestStream implements the ManifestStreamer interface.
+func (d retryingStorageDriver) ReadManifestStream(account Account, repoName, digest string) (contents io.ReadCloser, err error) {
+	err = d.retry(context.Background(), "ReadManifest", func() (err error) {
+		contents, err = ReadManifestStream(d.inner, account, repoName, digest)
+		return err
+	})
+	return contents, err
+}
+
+// ReadManifestStreamWithContext implements the ContextReader interface.
+func (d retryingStorageDriver) ReadManifestStreamWithContext(ctx context.Context, account Account, repoName, digest string) (contents io.ReadCloser, err error) {
+	err = d.retry(ctx, "ReadManifest", func() (err error) {
+		contents, err = ReadManifestStreamWithContext(ctx, d.inner, account, repoName, digest)
+		return err
+	})
+	return contents, err
+}
+
+// WriteManifest implements the StorageDriver interface.
+func (d retryingStorageDriver) WriteManifest(account Account, repoName, digest string, contents []byte) error {
+	return d.retry(context.Background(), "WriteManifest", func() error {
+		return d.inner.WriteManifest(account, repoName, digest, contents)
+	})
+}
+
+// DeleteManifest implements the StorageDriver interface.
+func (d retryingStorageDriver) DeleteManifest(account Account, repoName, digest string) error {
+	//not retried: same reason as for DeleteBlob
+	return d.inner.DeleteManifest(account, repoName, digest)
+}
+
+// ListStorageContents implements the StorageDriver interface.
+func (d retryingStorageDriver) ListStorageContents(account Account) (blobs []StoredBlobInfo, manifests []StoredManifestInfo, err error) {
+	err = d.retry(context.Background(), "ListStorageContents", func() (err error) {
+		blobs, manifests, err = d.inner.ListStorageContents(account)
+		return err
+	})
+	return blobs, manifests, err
+}
+
+// CanSetupAccount implements the StorageDriver interface.
+func (d retryingStorageDriver) CanSetupAccount(account Account) error {
+	return d.retry(context.Background(), "CanSetupAccount", func() error {
+		return d.inner.CanSetupAccount(account)
+	})
+}
+
+// CleanupAccount implements the StorageDriver interface.
+func (d retryingStorageDriver) CleanupAccount(account Account) error {
+	//not retried: cleanup may have side effects, depending on the driver
+	return d.inner.CleanupAccount(account)
+}
@@ -0,0 +1,206 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/majewsky/schwift"
+)
+
+func TestIsRetryableStorageError(t *testing.T) {
+	testCases := []struct {
+		Error       error
+		IsRetryable bool
+	}{
+		{nil, false},
+		{errors.New("no such blob"), false},
+		{ErrCannotGenerateURL, false},
+		{ErrSizeInvalid.With("too short"), false},
+		{ErrTooManyRequests.With(""), true},
+		{fmt.Errorf("while reading blob: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{timeoutError{}, true},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("while reading blob: %w", context.Canceled), false},
+		{customRetryableError{false}, false},
+		{fmt.Errorf("wrapped: %w", customRetryableError{true}), true},
+		{swiftError(http.StatusNotFound), false},
+		{swiftError(http.StatusTooManyRequests), true},
+		{fmt.Errorf("wrapped: %w", swiftError(http.StatusServiceUnavailable)), true},
+	}
+	for _, tc := range testCases {
+		if IsRetryableStorageError(tc.Error) != tc.IsRetryable {
+			t.Errorf("expected IsRetryableStorageError(%v) = %t, but got %t", tc.Error, tc.IsRetryable, !tc.IsRetryable)
+		}
+	}
+}
+
+func TestRetryingStorageDriver(t *testing.T) {
+	//without retries, the driver is not wrapped at all
+	inner := &flakyStorageDriver{noopStorageDriver: &noopStorageDriver{blobs: make(map[string][]byte)}}
+	if RetryStorageDriver(inner, StorageRetryPolicy{MaxAttempts: 1}) != StorageDriver(inner) {
+		t.Error("expected RetryStorageDriver() to not wrap the driver when retries are disabled")
+	}
+
+	var (
+		sleeps        []time.Duration
+		cancelOnSleep func()
+	)
+	sd := RetryStorageDriver(inner, StorageRetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond})
+	rsd := sd.(retryingStorageDriver) //nolint:errcheck
+	rsd.sleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		if cancelOnSleep != nil {
+			cancelOnSleep()
+		}
+		return ctx.Err()
+	}
+	sd = rsd
+	if UnwrapStorageDriver(InstrumentStorageDriver(sd)) != StorageDriver(inner) {
+		t.Error("UnwrapStorageDriver() did not return the original driver")
+	}
+
+	account := Account{Name: "test1"}
+	mustDo(t, inner.AppendToBlob(account, "storageid", 1, nil, strings.NewReader("foo")))
+	mustDo(t, inner.FinalizeBlob(account, "storageid", 1))
+	inner.calls = 0
+
+	expect := func(err error, expectedError string, expectedCalls int, expectedSleeps ...time.Duration) {
+		t.Helper()
+		actualError := ""
+		if err != nil {
+			actualError = err.Error()
+		}
+		if actualError != expectedError {
+			t.Errorf("expected error %q, but got %q", expectedError, actualError)
+		}
+		if inner.calls != expectedCalls {
+			t.Errorf("expected %d calls, but got %d", expectedCalls, inner.calls)
+		}
+		if fmt.Sprint(sleeps) != fmt.Sprint(expectedSleeps) {
+			t.Errorf("expected sleeps %v, but got %v", expectedSleeps, sleeps)
+		}
+		inner.calls = 0
+		sleeps = nil
+	}
+
+	//transient errors are retried until the operation succeeds...
+	inner.failures = []error{ErrTooManyRequests.With(""), syscall.ECONNRESET}
+	reader, _, err := sd.ReadBlob(account, "storageid")
+	expect(err, "", 3, 100*time.Millisecond, 200*time.Millisecond)
+	buf, err := io.ReadAll(reader)
+	mustDo(t, err)
+	if string(buf) != "foo" {
+		t.Errorf("expected blob contents %q, but got %q", "foo", string(buf))
+	}
+
+	//...but only within the retry budget
+	inner.failures = []error{syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET}
+	_, _, err = sd.ReadBlob(account, "storageid")
+	expect(err, "connection reset by peer", 3, 100*time.Millisecond, 200*time.Millisecond)
+
+	//fatal errors are not retried
+	inner.failures = []error{errors.New("permission denied")}
+	_, _, err = sd.ReadBlob(account, "storageid")
+	expect(err, "permission denied", 1)
+
+	//non-idempotent operations are not retried
+	inner.failures = []error{syscall.ECONNRESET}
+	err = sd.AppendToBlob(account, "otherid", 1, nil, strings.NewReader("bar"))
+	expect(err, "connection reset by peer", 1)
+
+	//when the caller gives up while waiting for the next attempt, the last error is reported
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelOnSleep = cancel
+	inner.failures = []error{syscall.ECONNRESET, syscall.ECONNRESET}
+	_, _, err = sd.(ContextReader).ReadBlobWithContext(ctx, account, "storageid")
+	expect(err, "connection reset by peer", 1, 100*time.Millisecond)
+	cancelOnSleep = nil
+
+	//the backoff is capped
+	rsd.policy = StorageRetryPolicy{MaxAttempts: 5, InitialBackoff: 4 * time.Second}
+	sd = rsd
+	inner.failures = []error{syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET, syscall.ECONNRESET}
+	_, _, err = sd.ReadBlob(account, "storageid")
+	expect(err, "", 5, 4*time.Second, 8*time.Second, maxStorageRetryBackoff, maxStorageRetryBackoff)
+}
+
+// flakyStorageDriver fails with the errors from `failures` (in order) before
+// forwarding to the noopStorageDriver.
+type flakyStorageDriver struct {
+	*noopStorageDriver
+	failures []error
+	calls    int
+}
+
+func (d *flakyStorageDriver) nextFailure() error {
+	d.calls++
+	if len(d.failures) == 0 {
+		return nil
+	}
+	err := d.failures[0]
+	d.failures = d.failures[1:]
+	return err
+}
+
+func (d *flakyStorageDriver) AppendToBlob(account Account, storageID string, chunkNumber uint32, chunkLength *uint64, chunk io.Reader) error {
+	if err := d.nextFailure(); err != nil {
+		return err
+	}
+	return d.noopStorageDriver.AppendToBlob(account, storageID, chunkNumber, chunkLength, chunk)
+}
+
+func (d *flakyStorageDriver) ReadBlob(account Account, storageID string) (io.ReadCloser, uint64, error) {
+	if err := d.nextFailure(); err != nil {
+		return nil, 0, err
+	}
+	return d.noopStorageDriver.ReadBlob(account, storageID)
+}
+
+func swiftError(statusCode int) error {
+	return schwift.UnexpectedStatusCodeError{
+		ExpectedStatusCodes: []int{http.StatusOK},
+		ActualResponse:      &http.Response{StatusCode: statusCode},
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type customRetryableError struct {
+	retryable bool
+}
+
+func (e customRetryableError) Error() string {
+	return fmt.Sprintf("custom error (retryable = %t)", e.retryable)
+}
+func (e customRetryableError) IsRetryable() bool { return e.retryable }
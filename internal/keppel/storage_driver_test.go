@@ -0,0 +1,89 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadBlobRangeFallback(t *testing.T) {
+	//noopStorageDriver does not implement BlobRangeReader, so this exercises the fallback
+	sd := &noopStorageDriver{blobs: map[string][]byte{"storageid": []byte("just some random data")}}
+	account := Account{Name: "test1"}
+
+	testCases := []struct {
+		Offset, Length uint64
+		Expected       string
+	}{
+		{0, 4, "just"},
+		{5, 4, "some"},
+		{17, 4, "data"},
+		{0, 21, "just some random data"},
+	}
+	for _, tc := range testCases {
+		reader, err := ReadBlobRange(sd, account, "storageid", tc.Offset, tc.Length)
+		mustDo(t, err)
+		buf, err := io.ReadAll(reader)
+		mustDo(t, err)
+		mustDo(t, reader.Close())
+		if string(buf) != tc.Expected {
+			t.Errorf("expected range %d+%d to be %q, but got %q", tc.Offset, tc.Length, tc.Expected, string(buf))
+		}
+	}
+
+	_, err := ReadBlobRange(sd, account, "unknown", 0, 4)
+	if err == nil {
+		t.Error("expected ReadBlobRange to fail for unknown blob")
+	}
+}
+
+func TestReadBlobWithContextFallback(t *testing.T) {
+	//noopStorageDriver does not implement ContextReader, so this exercises the fallback
+	sd := &noopStorageDriver{blobs: map[string][]byte{"storageid": []byte("just some random data")}}
+	account := Account{Name: "test1"}
+
+	//while the context is alive, reads work as usual
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, _, err := ReadBlobWithContext(ctx, sd, account, "storageid")
+	mustDo(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	mustDo(t, err)
+	if string(buf) != "just" {
+		t.Errorf("expected to read %q, but got %q", "just", string(buf))
+	}
+
+	//once the context has expired, further reads fail...
+	cancel()
+	_, err = reader.Read(buf)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected read to fail with %q, but got %v", context.Canceled.Error(), err)
+	}
+	mustDo(t, reader.Close())
+
+	//...and so does opening the blob
+	_, _, err = ReadBlobWithContext(ctx, sd, account, "storageid")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected ReadBlobWithContext to fail with %q, but got %v", context.Canceled.Error(), err)
+	}
+}
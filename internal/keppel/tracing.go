@@ -0,0 +1,205 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sapcc/go-api-declarations/bininfo"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/osext"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer creates spans that describe which parts of Keppel a request went
+// through, and how long each part took. This is a thin layer over an
+// OpenTelemetry TracerProvider that ends spans with the result of the
+// operation that they describe.
+type Tracer interface {
+	//StartSpan starts a new span. If `ctx` contains a span, the new span is a
+	//child of that span. The returned context contains the new span and shall
+	//be passed to all operations that are part of this span.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+	//Shutdown exports all spans that have ended, but were not exported yet.
+	//No spans shall be started afterwards.
+	Shutdown(ctx context.Context) error
+}
+
+// Span is a single operation within a trace, as returned by Tracer.StartSpan().
+type Span interface {
+	//End finishes the span. The error shall be the result of the operation
+	//described by the span (nil on success).
+	End(err error)
+}
+
+// NoopTracer is a Tracer that does not record anything.
+type NoopTracer struct{}
+
+// StartSpan implements the Tracer interface.
+func (NoopTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+// Shutdown implements the Tracer interface.
+func (NoopTracer) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(err error) {}
+
+// TracePropagator reads and writes the W3C Trace Context headers
+// (`traceparent` and `tracestate`) that connect spans across process
+// boundaries.
+var TracePropagator = propagation.TraceContext{}
+
+// NewTracer builds a Tracer that records spans with the given
+// TracerProvider, usually one from the OpenTelemetry SDK. Shutdown() is
+// forwarded to the provider.
+func NewTracer(provider *sdktrace.TracerProvider) Tracer {
+	return otelTracer{provider, provider.Tracer("github.com/sapcc/keppel")}
+}
+
+type otelTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// StartSpan implements the Tracer interface.
+func (t otelTracer) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span}
+}
+
+// Shutdown implements the Tracer interface.
+func (t otelTracer) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) End(err error) {
+	if err == nil {
+		s.span.SetStatus(codes.Ok, "")
+	} else {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// exporters
+
+// logSpanExporter writes each finished span into the debug log.
+type logSpanExporter struct{}
+
+// ExportSpans implements the sdktrace.SpanExporter interface.
+func (logSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	for _, s := range spans {
+		result := "ok"
+		if s.Status().Code == codes.Error {
+			result = "error: " + s.Status().Description
+		}
+		parentSpanID := ""
+		if s.Parent().IsValid() {
+			parentSpanID = s.Parent().SpanID().String()
+		}
+		logg.Debug("TRACE: trace=%s span=%s parent=%s name=%q duration=%s result=%s",
+			s.SpanContext().TraceID(), s.SpanContext().SpanID(), parentSpanID, s.Name(), s.EndTime().Sub(s.StartTime()), result)
+	}
+	return nil
+}
+
+// Shutdown implements the sdktrace.SpanExporter interface.
+func (logSpanExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// ParseTracer builds a Tracer from the given value of the KEPPEL_TRACING
+// environment variable. The other relevant environment variables are read
+// as needed.
+func ParseTracer(spec string) (Tracer, error) {
+	var exporter sdktrace.SpanExporter
+	switch spec {
+	case "":
+		return NoopTracer{}, nil
+	case "log":
+		exporter = logSpanExporter{}
+	case "otlp":
+		endpoint, err := osext.NeedGetenv("KEPPEL_TRACING_OTLP_ENDPOINT")
+		if err != nil {
+			return nil, err
+		}
+		endpointURL, err := url.Parse(endpoint)
+		if err == nil && (endpointURL.Scheme != "http" && endpointURL.Scheme != "https" || endpointURL.Host == "") {
+			err = fmt.Errorf("expected http:// or https:// URL, but got %q", endpoint)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed KEPPEL_TRACING_OTLP_ENDPOINT: %w", err)
+		}
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(endpointURL.Host),
+			otlptracehttp.WithURLPath(endpointURL.Path),
+			otlptracehttp.WithTimeout(10 * time.Second),
+		}
+		if endpointURL.Scheme == "http" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("cannot initialize OTLP exporter: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown tracer: %q", spec)
+	}
+
+	samplingRate := 1.0
+	samplingRateStr := os.Getenv("KEPPEL_TRACING_SAMPLING_RATE")
+	if samplingRateStr != "" {
+		var err error
+		samplingRate, err = strconv.ParseFloat(samplingRateStr, 64)
+		if err != nil || samplingRate < 0 || samplingRate > 1 {
+			return nil, fmt.Errorf("KEPPEL_TRACING_SAMPLING_RATE must be a number between 0 and 1, but got %q", samplingRateStr)
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		//when the caller sent a sampled trace context, we join their trace
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(samplingRate))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", bininfo.Component()))),
+	)
+	return NewTracer(provider), nil
+}
@@ -0,0 +1,153 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// UpstreamRateLimits holds one token-bucket rate limiter per upstream registry.
+// It is used in the replication codepath to avoid tripping the rate limits of
+// the upstream registry when many images are replicated on first use at once.
+//
+// Requests that exceed the rate limit are delayed rather than rejected.
+type UpstreamRateLimits struct {
+	requestsPerSecond float64
+	burst             float64
+	mutex             sync.Mutex
+	buckets           map[string]*upstreamBucket //key = upstream hostname
+
+	//non-pure functions that can be replaced by deterministic doubles for unit tests
+	timeNow func() time.Time
+	sleep   func(context.Context, time.Duration) error
+}
+
+type upstreamBucket struct {
+	Tokens       float64
+	LastRefillAt time.Time
+	BlockedUntil time.Time //set when the upstream asks us to back off via Retry-After
+}
+
+// NewUpstreamRateLimits creates a new UpstreamRateLimits instance. Each
+// upstream registry can receive up to `burst` requests immediately, and then
+// `requestsPerSecond` requests per second.
+func NewUpstreamRateLimits(requestsPerSecond float64, burst uint64) *UpstreamRateLimits {
+	if burst == 0 {
+		burst = 1
+	}
+	return &UpstreamRateLimits{
+		requestsPerSecond: requestsPerSecond,
+		burst:             float64(burst),
+		buckets:           make(map[string]*upstreamBucket),
+		timeNow:           time.Now,
+		sleep:             sleepWithContext,
+	}
+}
+
+// OverrideTimeNow replaces time.Now and the sleep function with test doubles.
+// The sleep function must return the context's error if the context expires
+// before the given duration has passed.
+func (l *UpstreamRateLimits) OverrideTimeNow(timeNow func() time.Time, sleep func(context.Context, time.Duration) error) *UpstreamRateLimits {
+	l.timeNow = timeNow
+	l.sleep = sleep
+	return l
+}
+
+// Wait blocks until a request to the given upstream registry is allowed by the
+// rate limit. If the context expires before that, the context's error is
+// returned and the request shall not be sent.
+func (l *UpstreamRateLimits) Wait(ctx context.Context, hostName string) error {
+	delay := l.reserve(hostName)
+	if delay > 0 {
+		return l.sleep(ctx, delay)
+	}
+	return ctx.Err()
+}
+
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns how long the caller needs to wait before it can send its request.
+// The token for this request is consumed immediately, so that concurrent
+// callers queue up behind each other.
+func (l *UpstreamRateLimits) reserve(hostName string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.timeNow()
+	b := l.getBucket(hostName, now)
+
+	//refill bucket
+	b.Tokens += now.Sub(b.LastRefillAt).Seconds() * l.requestsPerSecond
+	if b.Tokens > l.burst {
+		b.Tokens = l.burst
+	}
+	b.LastRefillAt = now
+
+	//consume one token (if this makes the balance negative, the caller needs to
+	//wait until the balance has been refilled)
+	b.Tokens--
+	var delay time.Duration
+	if b.Tokens < 0 {
+		delay = time.Duration(-b.Tokens / l.requestsPerSecond * float64(time.Second))
+	}
+	if blockDelay := b.BlockedUntil.Sub(now); blockDelay > delay {
+		delay = blockDelay
+	}
+	return delay
+}
+
+// BlockUntil records that the given upstream registry asked us (e.g. through
+// a Retry-After header) to not send any further requests until the given time.
+// Subsequent Wait() calls for this upstream will be delayed accordingly.
+func (l *UpstreamRateLimits) BlockUntil(hostName string, until time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b := l.getBucket(hostName, l.timeNow())
+	if until.After(b.BlockedUntil) {
+		b.BlockedUntil = until
+	}
+}
+
+// TimeNow returns the current time, as seen by this UpstreamRateLimits
+// instance.
+func (l *UpstreamRateLimits) TimeNow() time.Time {
+	return l.timeNow()
+}
+
+func (l *UpstreamRateLimits) getBucket(hostName string, now time.Time) *upstreamBucket {
+	b, exists := l.buckets[hostName]
+	if !exists {
+		b = &upstreamBucket{Tokens: l.burst, LastRefillAt: now}
+		l.buckets[hostName] = b
+	}
+	return b
+}
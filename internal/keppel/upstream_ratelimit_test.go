@@ -0,0 +1,97 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpstreamRateLimitsDelayRequests(t *testing.T) {
+	//fake clock that only advances while sleeping
+	now := time.Unix(10000, 0)
+	var totalSleep time.Duration
+	l := NewUpstreamRateLimits(2, 3).OverrideTimeNow(
+		func() time.Time { return now },
+		func(ctx context.Context, d time.Duration) error {
+			totalSleep += d
+			now = now.Add(d)
+			return nil
+		},
+	)
+
+	//the first 3 requests are covered by the burst
+	for i := 0; i < 3; i++ {
+		mustWait(t, l, "registry.example.org")
+	}
+	if totalSleep != 0 {
+		t.Errorf("expected burst requests to not be delayed, but slept for %s", totalSleep)
+	}
+
+	//further requests are delayed according to the rate (2 per second), but never fail
+	for i := 0; i < 4; i++ {
+		mustWait(t, l, "registry.example.org")
+	}
+	if totalSleep != 2*time.Second {
+		t.Errorf("expected requests beyond burst to be delayed by 2s in total, but slept for %s", totalSleep)
+	}
+
+	//other upstreams have their own bucket
+	totalSleep = 0
+	mustWait(t, l, "other-registry.example.org")
+	if totalSleep != 0 {
+		t.Errorf("expected request to different upstream to not be delayed, but slept for %s", totalSleep)
+	}
+
+	//when upstream asks us to back off, requests are delayed accordingly
+	now = now.Add(time.Hour) //refill all buckets
+	l.BlockUntil("registry.example.org", now.Add(10*time.Second))
+	mustWait(t, l, "registry.example.org")
+	if totalSleep != 10*time.Second {
+		t.Errorf("expected request to be delayed by Retry-After, but slept for %s", totalSleep)
+	}
+}
+
+func TestUpstreamRateLimitsRespectContext(t *testing.T) {
+	l := NewUpstreamRateLimits(0.1, 1)
+	mustWait(t, l, "registry.example.org")
+
+	//the next request would have to wait for 10 seconds, but the caller gives up way earlier
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	startedAt := time.Now()
+	err := l.Wait(ctx, "registry.example.org")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected Wait() to fail with context.DeadlineExceeded, but got %v", err)
+	}
+	if waited := time.Since(startedAt); waited > 5*time.Second {
+		t.Errorf("expected Wait() to return when the context expires, but it blocked for %s", waited)
+	}
+}
+
+func mustWait(t *testing.T, l *UpstreamRateLimits, hostName string) {
+	t.Helper()
+	err := l.Wait(context.Background(), hostName)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
@@ -93,6 +93,44 @@ func DeserializeUserIdentity(typeID string, payload []byte, ad AuthDriver) (User
 	return uid, err
 }
 
+// TokenSubjectSource is an enum that selects which attribute of a UserIdentity
+// is put into the "sub" claim of tokens issued by Keppel.
+type TokenSubjectSource string
+
+const (
+	//TokenSubjectFromUserName selects UserIdentity.UserName(). This is the
+	//default, and is also selected by the empty string.
+	TokenSubjectFromUserName TokenSubjectSource = "username"
+	//TokenSubjectFromUserID selects the user ID from UserIdentity.UserInfo().
+	TokenSubjectFromUserID TokenSubjectSource = "id"
+)
+
+// ParseTokenSubjectSource parses the contents of the KEPPEL_TOKEN_SUBJECT variable.
+func ParseTokenSubjectSource(in string) (TokenSubjectSource, error) {
+	switch s := TokenSubjectSource(in); s {
+	case "", TokenSubjectFromUserName:
+		return TokenSubjectFromUserName, nil
+	case TokenSubjectFromUserID:
+		return s, nil
+	default:
+		return "", fmt.Errorf(`expected either "username" or "id", but got %q`, in)
+	}
+}
+
+// SubjectOf returns the value for the "sub" claim of a token issued to the
+// given user. If the selected attribute is not known for this user (e.g. for
+// anonymous and peer users, which do not have a UserInfo), the user name is
+// used instead.
+func (s TokenSubjectSource) SubjectOf(uid UserIdentity) string {
+	if s == TokenSubjectFromUserID {
+		userInfo := uid.UserInfo()
+		if userInfo != nil && userInfo.UserUUID() != "" {
+			return userInfo.UserUUID()
+		}
+	}
+	return uid.UserName()
+}
+
 type compressedPayload struct {
 	Contents []byte `json:"gzip"`
 }
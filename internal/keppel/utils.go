@@ -49,7 +49,29 @@ var (
 // - /library/alpine:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef
 // - /library/alpine@sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef
 // - /library/alpine:nonsense@sha256:e9707504ad0d4c119036b6d41ace4a33596139d3feb9ccb6617813ce48c3eeef
-var ImageReferenceRx = regexp.MustCompile(`^(` + RepoNameWithLeadingSlash + `)(?::([a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}))?(?:@(sha256:[a-z0-9]{64}))?$`)
+var ImageReferenceRx = regexp.MustCompile(`^(` + RepoNameWithLeadingSlash + `)(?::(` + TagNameRx + `))?(?:@(sha256:[a-z0-9]{64}))?$`)
+
+// TagNameRx is the grammar for tag names from the OCI Distribution Spec.
+var TagNameRx = `[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}`
+
+var tagNameRx = regexp.MustCompile(`^` + TagNameRx + `$`)
+
+// IsTagName returns whether the given string is a well-formed tag name.
+func IsTagName(input string) bool {
+	return tagNameRx.MatchString(input)
+}
+
+// MaxRepoNameLength is the maximum length of a full repository name
+// (including the account name), following the reference implementation of the
+// OCI Distribution Spec.
+const MaxRepoNameLength = 255
+
+// IsRepoName returns whether the given string is a well-formed repository
+// name. This can be used both for full repository names (including the account
+// name) and for repository names within an account.
+func IsRepoName(input string) bool {
+	return len(input) <= MaxRepoNameLength && RepoPathRx.MatchString(input)
+}
 
 // IsAccountName returns whether the given string is a well-formed account name.
 // This does not check whether the account actually exists in the DB.
@@ -0,0 +1,94 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsTagName(t *testing.T) {
+	validNames := []string{
+		"latest",
+		"v1.2.3",
+		"1.0.0-rc.1",
+		"_underscore",
+		"UPPER_case-mixed.123",
+		strings.Repeat("a", 128),
+	}
+	for _, name := range validNames {
+		if !IsTagName(name) {
+			t.Errorf("expected %q to be a valid tag name, but it was rejected", name)
+		}
+	}
+
+	invalidNames := []string{
+		"",
+		strings.Repeat("a", 129),
+		".leading-dot",
+		"-leading-dash",
+		"with space",
+		"with/slash",
+		"with:colon",
+		"with@at",
+		"ünicode",
+	}
+	for _, name := range invalidNames {
+		if IsTagName(name) {
+			t.Errorf("expected %q to be an invalid tag name, but it was accepted", name)
+		}
+	}
+}
+
+func TestIsRepoName(t *testing.T) {
+	validNames := []string{
+		"foo",
+		"library/alpine",
+		"deeply/nested/repo-name/with_separators.and.dots",
+		"a0/b1/c2",
+		strings.Repeat("a", MaxRepoNameLength),
+	}
+	for _, name := range validNames {
+		if !IsRepoName(name) {
+			t.Errorf("expected %q to be a valid repository name, but it was rejected", name)
+		}
+	}
+
+	invalidNames := []string{
+		"",
+		"Uppercase",
+		"library/Alpine",
+		"double//slash",
+		"trailing/slash/",
+		"/leading/slash",
+		"with space",
+		"with:colon",
+		"-leading-dash",
+		"trailing-dash-",
+		"double--dash",
+		"dot/../dot",
+		strings.Repeat("a", MaxRepoNameLength+1),
+	}
+	for _, name := range invalidNames {
+		if IsRepoName(name) {
+			t.Errorf("expected %q to be an invalid repository name, but it was accepted", name)
+		}
+	}
+}
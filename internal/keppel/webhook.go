@@ -0,0 +1,104 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/exp/slices"
+)
+
+// WebhookSignatureHeader is the HTTP header that carries the signature of a
+// webhook payload when the account has a webhook secret configured.
+const WebhookSignatureHeader = "X-Keppel-Signature"
+
+// WebhookAction appears in type WebhookEvent.
+type WebhookAction string
+
+const (
+	// WebhookActionPush is the action for manifests or tags being pushed.
+	WebhookActionPush WebhookAction = "push"
+	// WebhookActionDelete is the action for manifests or tags being deleted.
+	WebhookActionDelete WebhookAction = "delete"
+)
+
+// WebhookEvent is the payload that is sent to an account's webhook.
+type WebhookEvent struct {
+	Action     WebhookAction `json:"action"`
+	Account    string        `json:"account"`
+	Repository string        `json:"repository"`
+	Digest     string        `json:"digest"`
+	Tag        string        `json:"tag,omitempty"`
+	//Timestamp is in UNIX format, like all other timestamps in the Keppel API.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// SignWebhookPayload computes the value for the WebhookSignatureHeader. It
+// contains the hex-encoded HMAC-SHA256 of the payload, keyed with the
+// account's webhook secret.
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckWebhookURL returns an error if webhook notifications must not be sent
+// to the given URL. If allowedHosts is not empty, the URL must point to one of
+// those hosts. Otherwise, any host is accepted except for those that are
+// obviously internal (see IsForbiddenWebhookAddress). Since hostnames can
+// resolve to internal addresses, webhook deliveries must additionally check
+// the address that they actually connect to.
+func CheckWebhookURL(u *url.URL, allowedHosts []string) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("scheme must be http or https")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("host is missing")
+	}
+	if len(allowedHosts) > 0 {
+		if !slices.Contains(allowedHosts, host) {
+			return fmt.Errorf("host %q is not allowed", host)
+		}
+		return nil
+	}
+	if host == "localhost" {
+		return fmt.Errorf("host %q is not allowed", host)
+	}
+	if ip := net.ParseIP(host); ip != nil && IsForbiddenWebhookAddress(ip) {
+		return fmt.Errorf("host %q is not allowed", host)
+	}
+	return nil
+}
+
+// IsForbiddenWebhookAddress returns whether webhook deliveries must not
+// connect to this IP address. This covers loopback, link-local and private
+// addresses, which usually belong to services (like cloud metadata APIs or
+// other internal services) that shall not be reachable for users of Keppel.
+func IsForbiddenWebhookAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsUnspecified() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
@@ -0,0 +1,69 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package keppel
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCheckWebhookURL(t *testing.T) {
+	testCases := []struct {
+		URL          string
+		AllowedHosts []string
+		IsAllowed    bool
+	}{
+		{"https://webhook.example.org/notify", nil, true},
+		{"http://192.0.2.1:8080/", nil, true},
+		{"ftp://webhook.example.org/", nil, false},
+		{"https:///path-only", nil, false},
+		{"http://localhost:8080/", nil, false},
+		{"http://127.0.0.1/", nil, false},
+		{"http://[::1]/", nil, false},
+		{"http://169.254.169.254/latest/meta-data/", nil, false},
+		{"http://[fe80::1]/", nil, false},
+		{"http://0.0.0.0/", nil, false},
+		{"http://10.1.2.3/", nil, false},
+		{"http://172.16.0.1/", nil, false},
+		{"http://172.31.255.254/", nil, false},
+		{"http://172.32.0.1/", nil, true},
+		{"http://192.168.1.1/", nil, false},
+		{"http://[fc00::1]/", nil, false},
+		{"http://[fd12:3456::1]/", nil, false},
+		//with an allowlist, only the listed hosts are allowed (even if they are internal)
+		{"https://webhook.example.org/", []string{"webhook.example.org"}, true},
+		{"https://other.example.org/", []string{"webhook.example.org"}, false},
+		{"http://127.0.0.1:8080/", []string{"127.0.0.1"}, true},
+	}
+
+	for _, tc := range testCases {
+		u, err := url.Parse(tc.URL)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = CheckWebhookURL(u, tc.AllowedHosts)
+		if tc.IsAllowed && err != nil {
+			t.Errorf("expected %q to be allowed with %v, but got: %s", tc.URL, tc.AllowedHosts, err.Error())
+		}
+		if !tc.IsAllowed && err == nil {
+			t.Errorf("expected %q to be rejected with %v, but it was allowed", tc.URL, tc.AllowedHosts)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// AdmitManifestPull asks the admission policy whether the given manifest may
+// be pulled by a regular user.
+func (p *Processor) AdmitManifestPull(account keppel.Account, repo keppel.Repository, manifest keppel.Manifest, manifestBytes []byte) error {
+	manifestParsed, _, err := keppel.ParseManifest(manifest.MediaType, manifestBytes)
+	if err != nil {
+		return keppel.ErrManifestInvalid.With(err.Error())
+	}
+	var labels map[string]string
+	if manifest.LabelsJSON != "" {
+		err := json.Unmarshal([]byte(manifest.LabelsJSON), &labels)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = p.cfg.Admission().AdmitManifest(keppel.AdmissionRequest{
+		Action:     keppel.AdmitPull,
+		Account:    account,
+		Repository: repo,
+		Manifest:   manifest,
+		Parsed:     manifestParsed,
+		Labels:     labels,
+		Lookup:     admissionLookup{p.db, p.sd, account, repo},
+	})
+	return wrapAdmissionError(err, "manifest pull rejected by admission policy")
+}
+
+func wrapAdmissionError(err error, prefix string) error {
+	if err == nil {
+		return nil
+	}
+	var rerr *keppel.RegistryV2Error
+	if errors.As(err, &rerr) {
+		return rerr
+	}
+	return keppel.ErrDenied.With("%s: %s", prefix, err.Error()).WithStatus(http.StatusForbidden)
+}
+
+// Implementation of keppel.AdmissionLookup. For pushes, this operates within
+// the transaction in which the manifest push is validated.
+type admissionLookup struct {
+	db      gorp.SqlExecutor
+	sd      keppel.StorageDriver
+	account keppel.Account
+	repo    keppel.Repository
+}
+
+// FindManifestByTag implements the keppel.AdmissionLookup interface.
+func (l admissionLookup) FindManifestByTag(tagName string) (contents []byte, mediaType string, err error) {
+	var manifest keppel.Manifest
+	err = l.db.SelectOne(&manifest,
+		`SELECT m.* FROM manifests m JOIN tags t ON t.repo_id = m.repo_id AND t.digest = m.digest WHERE t.repo_id = $1 AND t.name = $2 AND m.deleted_at IS NULL`,
+		l.repo.ID, tagName,
+	)
+	if err != nil {
+		return nil, "", err
+	}
+	contents, err = l.sd.ReadManifest(l.account, l.repo.Name, manifest.Digest)
+	return contents, manifest.MediaType, err
+}
+
+// ReadBlob implements the keppel.AdmissionLookup interface.
+func (l admissionLookup) ReadBlob(blobDigest digest.Digest) ([]byte, error) {
+	blob, err := keppel.FindBlobByRepository(l.db, blobDigest, l.repo)
+	if err != nil {
+		return nil, err
+	}
+	reader, _, err := l.sd.ReadBlob(l.account, blob.StorageID)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// ListParentManifests implements the keppel.AdmissionLookup interface.
+func (l admissionLookup) ListParentManifests(manifestDigest string) (result []string, err error) {
+	_, err = l.db.Select(&result,
+		`SELECT parent_digest FROM manifest_manifest_refs WHERE repo_id = $1 AND child_digest = $2`,
+		l.repo.ID, manifestDigest,
+	)
+	return result, err
+}
@@ -33,8 +33,10 @@ import (
 	"github.com/opencontainers/go-digest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/api"
+	"github.com/sapcc/keppel/internal/client"
 	"github.com/sapcc/keppel/internal/keppel"
 )
 
@@ -81,6 +83,36 @@ func (p *Processor) ValidateExistingBlob(account keppel.Account, blob keppel.Blo
 	return nil
 }
 
+// VerifyWrittenBlob is called after a blob upload has been finalized in the
+// storage. If enabled by keppel.Configuration.VerifyOnWrite, the blob contents
+// are read back from the storage and compared against the expected digest and
+// size. On mismatch, ErrDigestInvalid or ErrSizeInvalid is returned, and the
+// caller is expected to delete the blob from the storage again.
+func (p *Processor) VerifyWrittenBlob(account keppel.Account, storageID string, blobDigest digest.Digest, sizeBytes uint64) error {
+	if !p.cfg.VerifyOnWrite {
+		return nil
+	}
+
+	readCloser, _, err := p.sd.ReadBlob(account, storageID)
+	if err != nil {
+		return err
+	}
+	defer readCloser.Close()
+
+	bcw := &byteCountingWriter{}
+	actualDigest, err := blobDigest.Algorithm().FromReader(io.TeeReader(readCloser, bcw))
+	if err != nil {
+		return err
+	}
+	if actualDigest != blobDigest {
+		return keppel.ErrDigestInvalid.With("blob contents in storage do not match: expected digest %s, but got %s", blobDigest, actualDigest)
+	}
+	if uint64(bcw.bytesWritten) != sizeBytes {
+		return keppel.ErrSizeInvalid.With("blob contents in storage do not match: expected %d bytes, but got %d bytes", sizeBytes, bcw.bytesWritten)
+	}
+	return nil
+}
+
 // An io.Writer that just counts how many bytes were written into it.
 type byteCountingWriter struct {
 	bytesWritten int
@@ -125,6 +157,8 @@ var (
 )
 
 // ReplicateBlob replicates the given blob from its account's upstream registry.
+// If the blob has been replicated concurrently in the meantime, it is not
+// downloaded again (but still copied into the ResponseWriter, see below).
 //
 // If a ResponseWriter is given, the response to the GET request to the upstream
 // registry is also copied into it as the blob contents are being streamed into
@@ -165,12 +199,39 @@ func (p *Processor) ReplicateBlob(blob keppel.Blob, account keppel.Account, repo
 		}
 	}()
 
+	//the blob may have been replicated by someone else between when our caller
+	//looked at it and when we created the PendingBlob entry above; in this
+	//case, there is nothing left to download
+	currentBlob, err := keppel.FindBlobByAccountName(p.db, digest.Digest(blob.Digest), account)
+	if err != nil {
+		return false, err
+	}
+	if currentBlob.StorageID != "" {
+		if w == nil {
+			return false, nil
+		}
+		return p.serveReplicatedBlob(*currentBlob, account, w)
+	}
+
+	//wait until the account has capacity for another replication (this only
+	//happens after the deduplication above, so that concurrent pulls of the
+	//same blob do not occupy more than one slot)
+	if p.cfg.ReplicationLimits != nil {
+		release, err := p.cfg.ReplicationLimits.Acquire(p.ctx, account)
+		if err != nil {
+			return false, err
+		}
+		defer release()
+	}
+
 	//query upstream for the blob
-	client, err := p.getRepoClientForUpstream(account, repo)
+	c, err := p.getRepoClientForUpstream(account, repo)
 	if err != nil {
 		return false, err
 	}
-	blobReadCloser, blobLengthBytes, err := client.DownloadBlob(digest.Digest(blob.Digest))
+	blobReadCloser, blobLengthBytes, err := c.DownloadBlob(digest.Digest(blob.Digest), &client.DownloadBlobOpts{
+		Timeout: p.cfg.ReplicationTimeout,
+	})
 	if err != nil {
 		return false, err
 	}
@@ -197,6 +258,23 @@ func (p *Processor) ReplicateBlob(blob keppel.Blob, account keppel.Account, repo
 	return true, nil
 }
 
+// Serves a blob that was replicated concurrently from our local storage, in
+// the same way as ReplicateBlob() serves a blob that it replicates.
+func (p *Processor) serveReplicatedBlob(blob keppel.Blob, account keppel.Account, w http.ResponseWriter) (responseWasWritten bool, returnErr error) {
+	blobReadCloser, blobLengthBytes, err := p.sd.ReadBlob(account, blob.StorageID)
+	if err != nil {
+		return false, err
+	}
+	defer blobReadCloser.Close()
+
+	w.Header().Set("Content-Type", blob.SafeMediaType())
+	w.Header().Set("Docker-Content-Digest", blob.Digest)
+	w.Header().Set("Content-Length", strconv.FormatUint(blobLengthBytes, 10))
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, blobReadCloser)
+	return true, err
+}
+
 func (p *Processor) uploadBlobToLocal(blob keppel.Blob, account keppel.Account, blobReader io.Reader, blobLengthBytes uint64) (returnErr error) {
 	defer func() {
 		//if blob upload fails, count an aborted upload
@@ -242,6 +320,15 @@ func (p *Processor) uploadBlobToLocal(blob keppel.Blob, account keppel.Account,
 		}
 	}()
 
+	blobDigest, err := digest.Parse(blob.Digest)
+	if err != nil {
+		return fmt.Errorf("cannot parse blob digest: %s", err.Error())
+	}
+	err = p.VerifyWrittenBlob(account, upload.StorageID, blobDigest, upload.SizeBytes)
+	if err != nil {
+		return err
+	}
+
 	//write blob metadata to DB
 	blob.StorageID = upload.StorageID
 	blob.PushedAt = p.timeNow()
@@ -264,7 +351,9 @@ func (p *Processor) AppendToBlob(account keppel.Account, upload *keppel.Upload,
 		return foreachChunkWithKnownSize(contents, *lengthBytes, func(chunk io.Reader, chunkLengthBytes uint64) error {
 			upload.NumChunks++
 			upload.SizeBytes += chunkLengthBytes
-			return p.sd.AppendToBlob(account, upload.StorageID, upload.NumChunks, &chunkLengthBytes, chunk)
+			return p.traced("storage.AppendToBlob", func(p *Processor) error {
+				return p.sd.AppendToBlob(account, upload.StorageID, upload.NumChunks, &chunkLengthBytes, chunk)
+			})
 		})
 	}
 
@@ -272,7 +361,9 @@ func (p *Processor) AppendToBlob(account keppel.Account, upload *keppel.Upload,
 	ctr := chunkingTrackingReader{wrapped: contents}
 	err := foreachChunkWithUnknownSize(&ctr, func(chunk io.Reader) error {
 		upload.NumChunks++
-		return p.sd.AppendToBlob(account, upload.StorageID, upload.NumChunks, nil, chunk)
+		return p.traced("storage.AppendToBlob", func(p *Processor) error {
+			return p.sd.AppendToBlob(account, upload.StorageID, upload.NumChunks, nil, chunk)
+		})
 	})
 	upload.SizeBytes += ctr.bytesRead
 	return err
@@ -359,3 +450,73 @@ func (r *chunkingTrackingReader) IsEOF() bool {
 	return false
 	//NOTE: Non-EOF errors are discarded here, but the next Read() should surface them.
 }
+
+// BlobReferenceCount is returned by CountBlobReferences().
+type BlobReferenceCount struct {
+	Blob keppel.Blob
+	//how many manifests (across all repos of the account) reference this blob
+	ManifestCount uint64
+	//whether this blob can be garbage-collected (no references, and not pushed or pending recently)
+	IsGCCandidate bool
+}
+
+var countBlobReferencesQuery = sqlext.SimplifyWhitespace(`
+	SELECT r.blob_id, COUNT(*) FROM manifest_blob_refs r
+	JOIN blobs b ON b.id = r.blob_id
+		WHERE b.account_name = $1
+	GROUP BY r.blob_id
+`)
+
+var pendingBlobDigestsQuery = sqlext.SimplifyWhitespace(`
+	SELECT digest FROM pending_blobs WHERE account_name = $1
+`)
+
+// CountBlobReferences computes, for each blob in the given account, how many
+// manifests reference it. Blobs without any references are flagged as
+// candidates for garbage collection, unless they were pushed within the given
+// grace period (because a manifest referencing them is probably about to be
+// pushed) or are currently being replicated.
+func (p *Processor) CountBlobReferences(account keppel.Account, gracePeriod time.Duration) ([]BlobReferenceCount, error) {
+	var blobs []keppel.Blob
+	_, err := p.db.Select(&blobs, `SELECT * FROM blobs WHERE account_name = $1 ORDER BY id`, account.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	refCounts := make(map[int64]uint64)
+	err = sqlext.ForeachRow(p.db, countBlobReferencesQuery, []any{account.Name}, func(rows *sql.Rows) error {
+		var (
+			blobID int64
+			count  uint64
+		)
+		err := rows.Scan(&blobID, &count)
+		refCounts[blobID] = count
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	isPending := make(map[string]bool)
+	err = sqlext.ForeachRow(p.db, pendingBlobDigestsQuery, []any{account.Name}, func(rows *sql.Rows) error {
+		var digest string
+		err := rows.Scan(&digest)
+		isPending[digest] = true
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	gracePeriodStart := p.timeNow().Add(-gracePeriod)
+	result := make([]BlobReferenceCount, len(blobs))
+	for idx, blob := range blobs {
+		count := refCounts[blob.ID]
+		result[idx] = BlobReferenceCount{
+			Blob:          blob,
+			ManifestCount: count,
+			IsGCCandidate: count == 0 && blob.PushedAt.Before(gracePeriodStart) && !isPending[blob.Digest],
+		}
+	}
+	return result, nil
+}
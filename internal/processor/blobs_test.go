@@ -0,0 +1,102 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor_test
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestCountBlobReferences(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	repo := *s.Repos[0]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor).OverrideTimeNow(s.Clock.Now)
+	actx := keppel.AuditContext{UserIdentity: auth.AnonymousUserIdentity}
+	gracePeriod := 10 * time.Minute
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repo, "")
+
+	//returns a map of blob digest -> ref count, and a list of GC candidates
+	countRefs := func() (map[string]uint64, []string) {
+		t.Helper()
+		counts, err := p.CountBlobReferences(account, gracePeriod)
+		if err != nil {
+			t.Fatalf("CountBlobReferences failed: %s", err.Error())
+		}
+		refCounts := make(map[string]uint64)
+		var candidates []string
+		for _, c := range counts {
+			refCounts[c.Blob.Digest] = c.ManifestCount
+			if c.IsGCCandidate {
+				candidates = append(candidates, c.Blob.Digest)
+			}
+		}
+		sort.Strings(candidates)
+		return refCounts, candidates
+	}
+
+	//while the manifest exists, all its blobs are referenced
+	expectedRefCounts := map[string]uint64{
+		image.Config.Digest.String():    1,
+		image.Layers[0].Digest.String(): 1,
+	}
+	refCounts, candidates := countRefs()
+	assert.DeepEqual(t, "ref counts", refCounts, expectedRefCounts)
+	assert.DeepEqual(t, "GC candidates", candidates, []string(nil))
+
+	//after deleting the last referencing manifest, the blobs are unreferenced,
+	//but they are still covered by the grace period
+	err := p.DeleteManifest(account, repo, image.Manifest.Digest.String(), actx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expectedRefCounts = map[string]uint64{
+		image.Config.Digest.String():    0,
+		image.Layers[0].Digest.String(): 0,
+	}
+	refCounts, candidates = countRefs()
+	assert.DeepEqual(t, "ref counts", refCounts, expectedRefCounts)
+	assert.DeepEqual(t, "GC candidates", candidates, []string(nil))
+
+	//after the grace period, they become GC candidates; a freshly pushed blob
+	//is not a candidate yet even though it is not referenced either
+	s.Clock.StepBy(gracePeriod + time.Second)
+	freshBlob := test.GenerateExampleLayer(2)
+	freshBlob.MustUpload(t, s, repo)
+	expectedRefCounts[freshBlob.Digest.String()] = 0
+	refCounts, candidates = countRefs()
+	assert.DeepEqual(t, "ref counts", refCounts, expectedRefCounts)
+	expectedCandidates := []string{image.Config.Digest.String(), image.Layers[0].Digest.String()}
+	sort.Strings(expectedCandidates)
+	assert.DeepEqual(t, "GC candidates", candidates, expectedCandidates)
+}
@@ -0,0 +1,78 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package processor
+
+import (
+	"sync"
+)
+
+// maxManifestConfigCacheEntries bounds the memory usage of manifestConfigCache.
+// Config blobs are usually a few KiB in size, and we only keep a small part of
+// them, so this is very conservative.
+const maxManifestConfigCacheEntries = 1024
+
+// manifestConfigCache holds the results of parseManifestConfig(), keyed by the
+// digest of the config blob. Since blobs are content-addressed, entries never
+// go stale; but callers must still ensure that the blob exists in the
+// respective account before consulting the cache.
+//
+// This is a package-level variable because Processor instances are usually
+// short-lived.
+var manifestConfigCache = &configInfoCache{entries: make(map[string]manifestConfigInfo)}
+
+type configInfoCache struct {
+	mutex   sync.RWMutex
+	entries map[string]manifestConfigInfo
+}
+
+func (c *configInfoCache) Get(digest string) (manifestConfigInfo, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	info, exists := c.entries[digest]
+	return info, exists
+}
+
+func (c *configInfoCache) Put(digest string, info manifestConfigInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	//when the cache is full, evict an arbitrary entry (this is not as good as
+	//LRU, but way simpler, and the working set is usually much smaller anyway)
+	if len(c.entries) >= maxManifestConfigCacheEntries {
+		for d := range c.entries {
+			delete(c.entries, d)
+			break
+		}
+	}
+	c.entries[digest] = info
+}
+
+func (c *configInfoCache) Delete(digest string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, digest)
+}
+
+// ForgetManifestConfig removes the parsed contents of the config blob with the
+// given digest from the in-memory cache. This should be called when a blob is
+// deleted.
+func ForgetManifestConfig(digest string) {
+	manifestConfigCache.Delete(digest)
+}
@@ -0,0 +1,28 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package processor
+
+// ResetManifestConfigCache empties the package-global manifestConfigCache, so
+// that a test does not depend on cache entries left behind by other tests.
+func ResetManifestConfigCache() {
+	manifestConfigCache.mutex.Lock()
+	defer manifestConfigCache.mutex.Unlock()
+	manifestConfigCache.entries = make(map[string]manifestConfigInfo)
+}
@@ -0,0 +1,90 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+// readCountingStorageDriver wraps a keppel.StorageDriver and counts calls to ReadBlob().
+type readCountingStorageDriver struct {
+	keppel.StorageDriver
+	readBlobCount int
+}
+
+func (d *readCountingStorageDriver) ReadBlob(account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	d.readBlobCount++
+	return d.StorageDriver.ReadBlob(account, storageID)
+}
+
+func TestManifestConfigCache(t *testing.T) {
+	//the cache is shared by all Processor instances, so start from a clean slate
+	//and do not leave our entries behind for other tests
+	processor.ResetManifestConfigCache()
+	t.Cleanup(processor.ResetManifestConfigCache)
+
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant", RequiredLabels: "foo"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	repo := *s.Repos[0]
+	sd := &readCountingStorageDriver{StorageDriver: s.SD}
+	p := processor.New(s.Config, s.DB, sd, s.ICD, s.Auditor)
+	actx := keppel.AuditContext{UserIdentity: auth.AnonymousUserIdentity}
+
+	image := test.GenerateImageWithCustomConfig(func(cfg map[string]interface{}) {
+		cfg["config"].(map[string]interface{})["Labels"] = map[string]string{"foo": "bar"}
+	}, test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repo, "first")
+
+	//the required-labels check for the push above has already parsed the config
+	//blob, so pushing the same manifest again does not need to read it again
+	pushTag := func(tagName string) {
+		t.Helper()
+		_, err := p.ValidateAndStoreManifest(account, repo, processor.IncomingManifest{
+			Reference: keppel.ManifestReference{Tag: tagName},
+			MediaType: image.Manifest.MediaType,
+			Contents:  image.Manifest.Contents,
+			PushedAt:  time.Unix(10000, 0),
+		}, actx)
+		if err != nil {
+			t.Fatalf("could not push tag %q: %s", tagName, err.Error())
+		}
+	}
+	pushTag("second")
+	assert.DeepEqual(t, "ReadBlob calls", sd.readBlobCount, 0)
+
+	//after the config blob was forgotten (e.g. because it was deleted), it needs to be read again
+	processor.ForgetManifestConfig(image.Config.Digest.String())
+	pushTag("third")
+	assert.DeepEqual(t, "ReadBlob calls", sd.readBlobCount, 1)
+	pushTag("fourth")
+	assert.DeepEqual(t, "ReadBlob calls", sd.readBlobCount, 1)
+}
@@ -0,0 +1,184 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package processor
+
+import (
+	"archive/tar"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+var collectReferencedManifestsQuery = sqlext.SimplifyWhitespace(`
+	WITH RECURSIVE manifest_digests (digest) AS (
+		SELECT $2::TEXT
+		UNION
+		SELECT r.child_digest FROM manifest_manifest_refs r
+		JOIN manifest_digests d ON r.parent_digest = d.digest
+			WHERE r.repo_id = $1
+	)
+	SELECT * FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL AND digest IN (SELECT digest FROM manifest_digests)
+	ORDER BY digest
+`)
+
+// ExportImageLayout writes the contents of the given repository as a tar
+// archive in the OCI Image Layout format [1] into the given writer. If a tag
+// name is given, only that tag is exported; otherwise all tags are exported.
+// Untagged manifests are only exported if they are referenced by an exported
+// list manifest. If the given tag does not exist, sql.ErrNoRows is returned.
+//
+// The archive is streamed, i.e. blob contents are not buffered in memory.
+//
+// [1] Ref: <https://github.com/opencontainers/image-spec/blob/main/image-layout.md>
+func (p *Processor) ExportImageLayout(account keppel.Account, repo keppel.Repository, tagName string, w io.Writer) error {
+	//find which manifests shall be exported
+	var tags []keppel.Tag
+	var err error
+	if tagName == "" {
+		_, err = p.db.Select(&tags, `SELECT * FROM tags WHERE repo_id = $1 ORDER BY name`, repo.ID)
+	} else {
+		_, err = p.db.Select(&tags, `SELECT * FROM tags WHERE repo_id = $1 AND name = $2`, repo.ID, tagName)
+		if err == nil && len(tags) == 0 {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := p.timeNow()
+	writeFile := func(path string, size int64, contents io.Reader) error {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path,
+			Size:     size,
+			Mode:     0o644,
+			ModTime:  now,
+		})
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, contents)
+		return err
+	}
+	writeJSON := func(path string, data any) error {
+		buf, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		return writeFile(path, int64(len(buf)), bytes.NewReader(buf))
+	}
+
+	err = writeJSON(imagespec.ImageLayoutFile, imagespec.ImageLayout{Version: imagespec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+
+	//write all manifests and blobs into the blobs/ directory (each only once,
+	//even if it is referenced by multiple tags)
+	isWritten := make(map[string]bool)
+	manifestSizes := make(map[string]int64)
+	index := imagespec.Index{
+		MediaType: imagespec.MediaTypeImageIndex,
+		Manifests: make([]imagespec.Descriptor, 0, len(tags)),
+	}
+	index.SchemaVersion = 2
+	for _, tag := range tags {
+		var manifests []keppel.Manifest
+		_, err := p.db.Select(&manifests, collectReferencedManifestsQuery, repo.ID, tag.Digest)
+		if err != nil {
+			return err
+		}
+		for _, manifest := range manifests {
+			if isWritten[manifest.Digest] {
+				continue
+			}
+			contents, err := p.ReadManifestContents(account, repo, manifest.Digest)
+			if err != nil {
+				return err
+			}
+			err = writeFile(blobPathInImageLayout(manifest.Digest), int64(len(contents)), bytes.NewReader(contents))
+			if err != nil {
+				return err
+			}
+			isWritten[manifest.Digest] = true
+			manifestSizes[manifest.Digest] = int64(len(contents))
+		}
+
+		//the tagged manifest itself is referenced by the index
+		for _, manifest := range manifests {
+			if manifest.Digest == tag.Digest {
+				index.Manifests = append(index.Manifests, imagespec.Descriptor{
+					MediaType:   manifest.MediaType,
+					Digest:      digest.Digest(manifest.Digest),
+					Size:        manifestSizes[manifest.Digest],
+					Annotations: map[string]string{imagespec.AnnotationRefName: tag.Name},
+				})
+			}
+		}
+
+		blobs, err := p.CollectReferencedBlobs(repo, digest.Digest(tag.Digest))
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			if isWritten[blob.Digest] {
+				continue
+			}
+			err := p.exportBlob(account, blob, writeFile)
+			if err != nil {
+				return err
+			}
+			isWritten[blob.Digest] = true
+		}
+	}
+
+	err = writeJSON("index.json", index)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (p *Processor) exportBlob(account keppel.Account, blob keppel.Blob, writeFile func(string, int64, io.Reader) error) error {
+	if blob.StorageID == "" {
+		return fmt.Errorf("cannot export blob %s: contents have not been replicated yet", blob.Digest)
+	}
+	reader, sizeBytes, err := p.sd.ReadBlob(account, blob.StorageID)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	return writeFile(blobPathInImageLayout(blob.Digest), int64(sizeBytes), reader)
+}
+
+func blobPathInImageLayout(digestStr string) string {
+	d := digest.Digest(digestStr)
+	return fmt.Sprintf("blobs/%s/%s", d.Algorithm().String(), d.Encoded())
+}
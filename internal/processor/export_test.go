@@ -0,0 +1,190 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestExportImageLayout(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	repo := *s.Repos[0]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repo, "latest")
+	//this one shall not be exported since we only ask for "latest"
+	test.GenerateImage(test.GenerateExampleLayer(2)).MustUpload(t, s, repo, "other")
+
+	var buf bytes.Buffer
+	err := p.ExportImageLayout(account, repo, "latest", &buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	//read the archive back
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		files[hdr.Name] = contents
+	}
+
+	//check the layout marker
+	var layout imagespec.ImageLayout
+	must(t, json.Unmarshal(files["oci-layout"], &layout))
+	assert.DeepEqual(t, "image layout version", layout.Version, imagespec.ImageLayoutVersion)
+
+	//check that the index points to the tagged manifest
+	var index imagespec.Index
+	must(t, json.Unmarshal(files["index.json"], &index))
+	assert.DeepEqual(t, "index entries", index.Manifests, []imagespec.Descriptor{{
+		MediaType:   image.Manifest.MediaType,
+		Digest:      image.Manifest.Digest,
+		Size:        int64(len(image.Manifest.Contents)),
+		Annotations: map[string]string{imagespec.AnnotationRefName: "latest"},
+	}})
+
+	//check that exactly the manifest, config and layer are there, and that they are intact
+	expectedBlobs := []test.Bytes{image.Manifest, image.Config, image.Layers[0]}
+	assert.DeepEqual(t, "number of files", len(files), len(expectedBlobs)+2)
+	for _, blob := range expectedBlobs {
+		path := "blobs/sha256/" + blob.Digest.Encoded()
+		contents, exists := files[path]
+		if !exists {
+			t.Errorf("expected %s to exist in the image layout", path)
+			continue
+		}
+		assert.DeepEqual(t, "digest of "+path, digest.Canonical.FromBytes(contents), blob.Digest)
+	}
+}
+
+func TestImportImageLayout(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "bar"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	sourceRepo := *s.Repos[0]
+	targetRepo := *s.Repos[1]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+	actx := keppel.AuditContext{UserIdentity: auth.AnonymousUserIdentity}
+
+	//export an image list with its images from one repo...
+	image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+	image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+	image1.MustUpload(t, s, sourceRepo, "first")
+	image2.MustUpload(t, s, sourceRepo, "")
+	list := test.GenerateImageList(image1, image2)
+	list.MustUpload(t, s, sourceRepo, "list")
+
+	var buf bytes.Buffer
+	must(t, p.ExportImageLayout(account, sourceRepo, "", &buf))
+
+	//...and import it into another
+	must(t, p.ImportImageLayout(account, targetRepo, &buf, actx))
+
+	//all tags shall resolve to the same manifests as before
+	expectations := map[string]test.Bytes{
+		"first": image1.Manifest,
+		"list":  list.Manifest,
+	}
+	for tagName, expectedManifest := range expectations {
+		result, err := p.GetManifest(account, targetRepo, keppel.ManifestReference{Tag: tagName})
+		if err != nil {
+			t.Fatalf("GetManifest(%q) failed: %s", tagName, err.Error())
+		}
+		assert.DeepEqual(t, "digest of "+tagName, result.Manifest.Digest, expectedManifest.Digest.String())
+		assert.DeepEqual(t, "contents of "+tagName, string(result.Contents), string(expectedManifest.Contents))
+	}
+
+	//the untagged image shall have been imported as part of the list
+	_, err := p.GetManifest(account, targetRepo, image2.DigestRef())
+	must(t, err)
+	blobs, err := p.CollectReferencedBlobs(targetRepo, list.Manifest.Digest)
+	must(t, err)
+	assert.DeepEqual(t, "number of blobs in imported list", len(blobs), 4)
+}
+
+func TestImportImageLayoutRejectsCorruptedBlobs(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	repo := *s.Repos[0]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+	actx := keppel.AuditContext{UserIdentity: auth.AnonymousUserIdentity}
+
+	//build a layout where the contents of one blob do not match its digest
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	writeFile := func(path string, contents []byte) {
+		must(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: path, Size: int64(len(contents)), Mode: 0o644}))
+		_, err := tw.Write(contents)
+		must(t, err)
+	}
+	writeFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	writeFile("blobs/sha256/"+digest.Canonical.FromString("foo").Encoded(), []byte("bar"))
+	writeFile("index.json", []byte(`{"schemaVersion":2,"manifests":[]}`))
+	must(t, tw.Close())
+
+	err := p.ImportImageLayout(account, repo, &buf, actx)
+	if err == nil {
+		t.Error("expected import of corrupted layout to fail, but it succeeded")
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
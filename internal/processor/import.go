@@ -0,0 +1,297 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package processor
+
+import (
+	"archive/tar"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-gorp/gorp/v3"
+	"github.com/opencontainers/go-digest"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// Entries in an image layout up to this size are held in memory during
+// ImportImageLayout() since they could be manifests (which we can only import
+// once all the blobs they reference are in place). Larger entries are streamed
+// into the storage directly since they can only be blobs.
+const importBufferLimitBytes = 4 << 20 // 4 MiB
+
+// ImportImageLayout reads a tar archive in the OCI Image Layout format [1]
+// (e.g. as produced by ExportImageLayout) from the given reader, and pushes its
+// contents into the given repository. Manifests referenced by the layout's
+// index are pushed with the tag from their "org.opencontainers.image.ref.name"
+// annotation (if any). The digests of all imported blobs and manifests are
+// validated.
+//
+// [1] Ref: <https://github.com/opencontainers/image-spec/blob/main/image-layout.md>
+func (p *Processor) ImportImageLayout(account keppel.Account, repo keppel.Repository, r io.Reader, actx keppel.AuditContext) error {
+	var (
+		index         *imagespec.Index
+		hasLayoutFile bool
+		//contents of small entries in blobs/, which can be manifests or blobs
+		buffered = make(map[digest.Digest][]byte)
+	)
+
+	//first pass: import all large blobs, and remember everything else for later
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		path := strings.TrimPrefix(hdr.Name, "./")
+
+		switch {
+		case path == imagespec.ImageLayoutFile:
+			var layout imagespec.ImageLayout
+			err := json.NewDecoder(tr).Decode(&layout)
+			if err != nil {
+				return fmt.Errorf("cannot parse %s: %w", path, err)
+			}
+			if layout.Version != imagespec.ImageLayoutVersion {
+				return fmt.Errorf("unsupported image layout version: %q", layout.Version)
+			}
+			hasLayoutFile = true
+
+		case path == "index.json":
+			index = &imagespec.Index{}
+			err := json.NewDecoder(tr).Decode(index)
+			if err != nil {
+				return fmt.Errorf("cannot parse %s: %w", path, err)
+			}
+
+		case strings.HasPrefix(path, "blobs/"):
+			blobDigest, err := digest.Parse(strings.Replace(strings.TrimPrefix(path, "blobs/"), "/", ":", 1))
+			if err != nil {
+				return fmt.Errorf("unexpected file in image layout: %q", hdr.Name)
+			}
+			if hdr.Size > importBufferLimitBytes {
+				err = p.importBlob(account, repo, blobDigest, uint64(hdr.Size), tr)
+				if err != nil {
+					return fmt.Errorf("cannot import blob %s: %w", blobDigest, err)
+				}
+				continue
+			}
+			contents, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if blobDigest.Algorithm().FromBytes(contents) != blobDigest {
+				return fmt.Errorf("contents of %s do not match its digest", hdr.Name)
+			}
+			buffered[blobDigest] = contents
+
+		default:
+			logg.Debug("ignoring unexpected file in image layout: %q", hdr.Name)
+		}
+	}
+	if !hasLayoutFile {
+		return fmt.Errorf("missing %s file in image layout", imagespec.ImageLayoutFile)
+	}
+	if index == nil {
+		return errors.New("missing index.json file in image layout")
+	}
+
+	//second pass: push all manifests that are referenced by the index (and,
+	//before that, the manifests and blobs that they reference)
+	imp := layoutImporter{p, account, repo, actx, buffered, make(map[digest.Digest]bool)}
+	for _, desc := range index.Manifests {
+		ref := keppel.ManifestReference{Digest: desc.Digest}
+		if tagName := desc.Annotations[imagespec.AnnotationRefName]; tagName != "" {
+			ref = keppel.ManifestReference{Tag: tagName}
+		}
+		err := imp.importManifest(desc.MediaType, desc.Digest, ref)
+		if err != nil {
+			return fmt.Errorf("cannot import manifest %s: %w", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+type layoutImporter struct {
+	p          *Processor
+	account    keppel.Account
+	repo       keppel.Repository
+	actx       keppel.AuditContext
+	buffered   map[digest.Digest][]byte
+	isImported map[digest.Digest]bool
+}
+
+func (imp layoutImporter) importManifest(mediaType string, manifestDigest digest.Digest, ref keppel.ManifestReference) error {
+	contents, exists := imp.buffered[manifestDigest]
+	if !exists {
+		return errors.New("manifest is missing in image layout")
+	}
+	parsed, _, err := keppel.ParseManifest(mediaType, contents)
+	if err != nil {
+		return keppel.ErrManifestInvalid.With(err.Error())
+	}
+
+	//everything that this manifest references needs to exist before the manifest itself
+	for _, subDesc := range parsed.ManifestReferences(nil) {
+		if imp.isImported[subDesc.Digest] {
+			continue
+		}
+		err := imp.importManifest(subDesc.MediaType, subDesc.Digest, keppel.ManifestReference{Digest: subDesc.Digest})
+		if err != nil {
+			return fmt.Errorf("cannot import submanifest %s: %w", subDesc.Digest, err)
+		}
+	}
+	for _, blobDesc := range parsed.BlobReferences() {
+		if imp.isImported[blobDesc.Digest] {
+			continue
+		}
+		err := imp.importBufferedBlob(blobDesc.Digest)
+		if err != nil {
+			return fmt.Errorf("cannot import blob %s: %w", blobDesc.Digest, err)
+		}
+	}
+
+	_, err = imp.p.ValidateAndStoreManifest(imp.account, imp.repo, IncomingManifest{
+		Reference: ref,
+		MediaType: mediaType,
+		Contents:  contents,
+		PushedAt:  imp.p.timeNow(),
+	}, imp.actx)
+	if err != nil {
+		return err
+	}
+	imp.isImported[manifestDigest] = true
+	return nil
+}
+
+func (imp layoutImporter) importBufferedBlob(blobDigest digest.Digest) error {
+	contents, exists := imp.buffered[blobDigest]
+	if exists {
+		err := imp.p.importBlob(imp.account, imp.repo, blobDigest, uint64(len(contents)), bytes.NewReader(contents))
+		if err != nil {
+			return err
+		}
+		imp.isImported[blobDigest] = true
+		return nil
+	}
+
+	//large blobs have been imported in the first pass already; otherwise, the
+	//blob must already exist in the account
+	blob, err := keppel.FindBlobByAccountName(imp.p.db, blobDigest, imp.account)
+	if err == sql.ErrNoRows {
+		return errors.New("blob is missing in image layout")
+	}
+	if err != nil {
+		return err
+	}
+	return keppel.MountBlobIntoRepo(imp.p.db, *blob, imp.repo)
+}
+
+var insertImportedBlobQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO blobs (account_name, digest, size_bytes, storage_id, pushed_at, validated_at)
+	VALUES ($1, $2, $3, $4, $5, $5)
+	ON CONFLICT DO NOTHING
+`)
+
+// Uploads the given blob contents into the storage, and creates the blob
+// record in the DB (or reuses an existing one).
+func (p *Processor) importBlob(account keppel.Account, repo keppel.Repository, blobDigest digest.Digest, sizeBytes uint64, contents io.Reader) error {
+	//if we have this blob already, we don't need to upload it again
+	blob, err := keppel.FindBlobByAccountName(p.db, blobDigest, account)
+	if err == nil && blob.StorageID != "" {
+		return keppel.MountBlobIntoRepo(p.db, *blob, repo)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	upload := keppel.Upload{StorageID: p.generateStorageID()}
+	digester := blobDigest.Algorithm().Digester()
+	err = p.AppendToBlob(account, &upload, io.TeeReader(contents, digester.Hash()), &sizeBytes)
+	if err == nil && digester.Digest() != blobDigest {
+		err = fmt.Errorf("expected digest %s, but got %s", blobDigest, digester.Digest())
+	}
+	if err == nil {
+		err = p.sd.FinalizeBlob(account, upload.StorageID, upload.NumChunks)
+	}
+	if err != nil {
+		abortErr := p.sd.AbortBlobUpload(account, upload.StorageID, upload.NumChunks)
+		if abortErr != nil {
+			logg.Error("additional error encountered when aborting upload %s into account %s: %s",
+				upload.StorageID, account.Name, abortErr.Error())
+		}
+		return err
+	}
+
+	err = p.VerifyWrittenBlob(account, upload.StorageID, blobDigest, upload.SizeBytes)
+	if err != nil {
+		deleteErr := p.sd.DeleteBlob(account, upload.StorageID)
+		if deleteErr != nil {
+			logg.Error("additional error encountered when deleting blob %s from account %s after verification failure: %s",
+				upload.StorageID, account.Name, deleteErr.Error())
+		}
+		return err
+	}
+
+	return p.insideTransaction(func(tx *gorp.Transaction) error {
+		now := p.timeNow()
+		_, err := tx.Exec(insertImportedBlobQuery, account.Name, blobDigest.String(), upload.SizeBytes, upload.StorageID, now)
+		if err != nil {
+			return err
+		}
+		blob, err := keppel.FindBlobByAccountName(tx, blobDigest, account)
+		if err != nil {
+			return err
+		}
+		switch blob.StorageID {
+		case upload.StorageID:
+			//we created this blob record
+		case "":
+			//an unbacked blob record existed (from replication), so we back it now
+			blob.StorageID = upload.StorageID
+			blob.PushedAt = now
+			blob.ValidatedAt = now
+			_, err = tx.Update(blob)
+			if err != nil {
+				return err
+			}
+		default:
+			//someone else uploaded this blob concurrently, so we don't need ours
+			err := p.sd.DeleteBlob(account, upload.StorageID)
+			if err != nil {
+				return err
+			}
+		}
+		return keppel.MountBlobIntoRepo(tx, *blob, repo)
+	})
+}
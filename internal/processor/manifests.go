@@ -19,8 +19,10 @@
 package processor
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -28,6 +30,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/docker/distribution"
 	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/go-gorp/gorp/v3"
 	"github.com/opencontainers/go-digest"
@@ -52,10 +55,33 @@ type IncomingManifest struct {
 	MediaType string
 	Contents  []byte
 	PushedAt  time.Time //usually time.Now(), but can be different in unit tests
+	//Further tags that shall point to this manifest in addition to the one in
+	//.Reference (if any), e.g. "v1.2" and "latest" when pushing "v1.2.3". All
+	//tags are set in the same DB transaction as the manifest, so either all of
+	//them are set or none.
+	AdditionalTags []string
+}
+
+// TagNames returns the names of all tags that shall point to this manifest,
+// without duplicates.
+func (m IncomingManifest) TagNames() []string {
+	var result []string
+	isSeen := make(map[string]bool)
+	if m.Reference.IsTag() {
+		result = append(result, m.Reference.Tag)
+		isSeen[m.Reference.Tag] = true
+	}
+	for _, tagName := range m.AdditionalTags {
+		if !isSeen[tagName] {
+			result = append(result, tagName)
+			isSeen[tagName] = true
+		}
+	}
+	return result
 }
 
 var checkManifestExistsQuery = sqlext.SimplifyWhitespace(`
-	SELECT COUNT(*) > 0 FROM manifests WHERE repo_id = $1 AND digest = $2
+	SELECT COUNT(*) > 0 FROM manifests WHERE repo_id = $1 AND digest = $2 AND deleted_at IS NULL
 `)
 var checkTagExistsAtSameDigestQuery = sqlext.SimplifyWhitespace(`
 	SELECT COUNT(*) > 0 FROM tags WHERE repo_id = $1 AND name = $2 AND digest = $3
@@ -64,7 +90,30 @@ var checkTagExistsAtSameDigestQuery = sqlext.SimplifyWhitespace(`
 // ValidateAndStoreManifest validates the given manifest and stores it under the
 // given reference. If the reference is a digest, it is validated. Otherwise, a
 // tag with that name is created that points to the new manifest.
-func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel.Repository, m IncomingManifest, actx keppel.AuditContext) (*keppel.Manifest, error) {
+func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel.Repository, m IncomingManifest, actx keppel.AuditContext) (result *keppel.Manifest, err error) {
+	err = p.traced("processor.ValidateAndStoreManifest", func(p *Processor) error {
+		result, err = p.validateAndStoreManifest(account, repo, m, actx)
+		return err
+	})
+	return result, err
+}
+
+func (p *Processor) validateAndStoreManifest(account keppel.Account, repo keppel.Repository, m IncomingManifest, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	tagNames := m.TagNames()
+	for _, tagName := range tagNames {
+		if !keppel.IsTagName(tagName) {
+			return nil, keppel.ErrTagInvalid.With("invalid tag name: %q", tagName)
+		}
+	}
+	//in strict mode, we do not even try to parse unknown manifest types
+	if p.cfg.StrictManifestMediaTypes && !p.cfg.IsManifestMediaTypeAllowed(m.MediaType) {
+		return nil, keppel.ErrManifestInvalid.With("manifest media type %q is not allowed", m.MediaType)
+	}
+	err := keppel.CheckEmbeddedMediaType(m.MediaType, m.Contents)
+	if err != nil {
+		return nil, keppel.ErrManifestInvalid.With(err.Error())
+	}
+
 	//check if the objects we want to create already exist in the database; this
 	//check is not 100% reliable since it does not run in the same transaction as
 	//the actual upsert, so results should be taken with a grain of salt; but the
@@ -75,13 +124,13 @@ func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel
 		return nil, err
 	}
 	logg.Debug("ValidateAndStoreManifest: in repo %d, manifest %s already exists = %t", repo.ID, contentsDigest.String(), manifestExistsAlready)
-	var tagExistsAlready bool
-	if m.Reference.IsTag() {
-		tagExistsAlready, err = p.db.SelectBool(checkTagExistsAtSameDigestQuery, repo.ID, m.Reference.Tag, contentsDigest.String())
+	tagExistsAlready := make(map[string]bool, len(tagNames))
+	for _, tagName := range tagNames {
+		tagExistsAlready[tagName], err = p.db.SelectBool(checkTagExistsAtSameDigestQuery, repo.ID, tagName, contentsDigest.String())
 		if err != nil {
 			return nil, err
 		}
-		logg.Debug("ValidateAndStoreManifest: in repo %d, tag %s @%s already exists = %t", repo.ID, m.Reference.Tag, contentsDigest.String(), tagExistsAlready)
+		logg.Debug("ValidateAndStoreManifest: in repo %d, tag %s @%s already exists = %t", repo.ID, tagName, contentsDigest.String(), tagExistsAlready[tagName])
 	}
 
 	//the quota check can be skipped if we are sure that we won't need to insert
@@ -105,23 +154,20 @@ func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel
 		//digest against the actual manifest data
 		manifest.Digest = m.Reference.Digest.String()
 	}
-	err = p.validateAndStoreManifestCommon(account, repo, manifest, m.Contents,
+	err = p.validateAndStoreManifestCommon(account, repo, manifest, m.Contents, &manifestPush{TagNames: tagNames},
 		func(tx *gorp.Transaction) error {
-			if m.Reference.IsTag() {
+			for _, tagName := range tagNames {
 				err = upsertTag(tx, keppel.Tag{
 					RepositoryID: repo.ID,
-					Name:         m.Reference.Tag,
+					Name:         tagName,
 					Digest:       manifest.Digest,
 					PushedAt:     m.PushedAt,
-				})
+				}, actx.UserIdentity.UserName())
 				if err != nil {
 					return err
 				}
 			}
-
-			//after making all DB changes, but before committing the DB transaction,
-			//write the manifest into the backend
-			return p.sd.WriteManifest(account, repo.Name, manifest.Digest, m.Contents)
+			return nil
 		},
 	)
 	if err != nil {
@@ -151,15 +197,39 @@ func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel
 				Digest:     manifest.Digest,
 			})
 		}
-		if m.Reference.IsTag() && !tagExistsAlready {
-			record(auditTag{
-				Account:    account,
-				Repository: repo,
-				Digest:     manifest.Digest,
-				TagName:    m.Reference.Tag,
-			})
+		for _, tagName := range tagNames {
+			if !tagExistsAlready[tagName] {
+				record(auditTag{
+					Account:    account,
+					Repository: repo,
+					Digest:     manifest.Digest,
+					TagName:    tagName,
+				})
+			}
 		}
 	}
+
+	//emit events under the same conditions (one per new tag, or one without tag
+	//if only the manifest is new)
+	emitEvent := func(tagName string) {
+		p.emitEvent(keppel.ManifestPushedEvent{
+			Account:    account,
+			Repository: repo,
+			Digest:     manifest.Digest,
+			Tag:        tagName,
+			PushedAt:   m.PushedAt,
+		})
+	}
+	emittedEvent := false
+	for _, tagName := range tagNames {
+		if !tagExistsAlready[tagName] {
+			emitEvent(tagName)
+			emittedEvent = true
+		}
+	}
+	if !manifestExistsAlready && !emittedEvent {
+		emitEvent("")
+	}
 	return manifest, nil
 }
 
@@ -167,7 +237,11 @@ func (p *Processor) ValidateAndStoreManifest(account keppel.Account, repo keppel
 // The `now` argument will be used instead of time.Now() to accommodate unit
 // tests that use a different clock.
 func (p *Processor) ValidateExistingManifest(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, now time.Time) error {
-	manifestBytes, err := p.sd.ReadManifest(account, repo.Name, manifest.Digest)
+	var manifestBytes []byte
+	err := p.withStorageReadTimeout(func(ctx context.Context) (err error) {
+		manifestBytes, err = keppel.ReadManifestWithContext(ctx, p.sd, account, repo.Name, manifest.Digest)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -176,21 +250,81 @@ func (p *Processor) ValidateExistingManifest(account keppel.Account, repo keppel
 	manifest.ValidatedAt = now
 	manifest.ValidationErrorMessage = ""
 
-	return p.validateAndStoreManifestCommon(account, repo, manifest, manifestBytes,
+	return p.validateAndStoreManifestCommon(account, repo, manifest, manifestBytes, nil,
 		func(tx *gorp.Transaction) error { return nil },
 	)
 }
 
-func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, manifestBytes []byte, actionBeforeCommit func(*gorp.Transaction) error) error {
+// ValidateExistingManifestStreaming is like ValidateExistingManifest, but
+// streams the manifest from the storage instead of buffering it in memory
+// entirely. Since the manifest contents are not available afterwards, the
+// manifest_contents table is not updated by this method.
+func (p *Processor) ValidateExistingManifestStreaming(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, now time.Time) error {
+	var (
+		manifestParsed keppel.ParsedManifest
+		manifestDesc   distribution.Descriptor
+	)
+	err := p.withStorageReadTimeout(func(ctx context.Context) error {
+		reader, err := keppel.ReadManifestStreamWithContext(ctx, p.sd, account, repo.Name, manifest.Digest)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		manifestParsed, manifestDesc, err = keppel.ParseManifestStream(manifest.MediaType, reader)
+		if err != nil {
+			return keppel.ErrManifestInvalid.With(err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//if the validation succeeds, these fields will be committed
+	manifest.ValidatedAt = now
+	manifest.ValidationErrorMessage = ""
+
+	return p.validateAndStoreParsedManifest(account, repo, manifest, manifestParsed, manifestDesc, nil, nil,
+		func(tx *gorp.Transaction) error { return nil },
+	)
+}
+
+// Information about a manifest push that is being validated. When an existing
+// manifest is validated again, no such information is given.
+type manifestPush struct {
+	//TagNames are the tags that will point to the manifest once the push is
+	//complete. This is empty when the manifest is pushed by digest without any
+	//`?tag=` parameters (e.g. a platform submanifest that will be referenced by
+	//a list manifest pushed afterwards).
+	TagNames []string
+}
+
+func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, manifestBytes []byte, push *manifestPush, actionBeforeCommit func(*gorp.Transaction) error) error {
 	//parse manifest
 	manifestParsed, manifestDesc, err := keppel.ParseManifest(manifest.MediaType, manifestBytes)
 	if err != nil {
 		return keppel.ErrManifestInvalid.With(err.Error())
 	}
+	return p.validateAndStoreParsedManifest(account, repo, manifest, manifestParsed, manifestDesc, manifestBytes, push, actionBeforeCommit)
+}
+
+// If `manifestBytes` is nil, the manifest contents are not written into the DB.
+// If `push` is nil, the manifest is not being pushed, but an existing manifest
+// is validated again.
+func (p *Processor) validateAndStoreParsedManifest(account keppel.Account, repo keppel.Repository, manifest *keppel.Manifest, manifestParsed keppel.ParsedManifest, manifestDesc distribution.Descriptor, manifestBytes []byte, push *manifestPush, actionBeforeCommit func(*gorp.Transaction) error) error {
 	if manifest.Digest != "" && manifestDesc.Digest.String() != manifest.Digest {
 		return keppel.ErrDigestInvalid.With("actual manifest digest is " + manifestDesc.Digest.String())
 	}
 
+	//a push that does not create any tags is most likely the push of a platform
+	//submanifest, which will be checked once the list manifest is pushed
+	isUntaggedPush := push != nil && len(push.TagNames) == 0
+	admissionAction := keppel.AdmitTaggedPush
+	if isUntaggedPush {
+		admissionAction = keppel.AdmitUntaggedPush
+	}
+
 	//fill in the fields of `manifest` that ValidateAndStoreManifest() could not
 	//fill in yet ()
 	manifest.Digest = manifestDesc.Digest.String()
@@ -204,6 +338,30 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		manifest.SizeBytes += uint64(desc.Size)
 	}
 
+	//pathological manifests with excessive numbers of layers are rejected on
+	//push (but not on later validation, so that lowering the limit does not
+	//break existing images)
+	if push != nil && p.cfg.MaxLayersPerManifest > 0 {
+		layerCount := uint64(len(manifestParsed.FindImageLayerBlobs()))
+		if layerCount > p.cfg.MaxLayersPerManifest {
+			msg := fmt.Sprintf("manifest has %d layers, but at most %d are allowed", layerCount, p.cfg.MaxLayersPerManifest)
+			return keppel.ErrManifestInvalid.With(msg)
+		}
+	}
+
+	//when pushing, write the manifest into the backend before the DB
+	//transaction, so that retries of a flaky write do not hold the transaction
+	//open (if the transaction fails, the storage sweep will clean up the
+	//unreferenced manifest later)
+	if push != nil {
+		err := p.traced("storage.WriteManifest", func(p *Processor) error {
+			return p.sd.WriteManifest(account, repo.Name, manifest.Digest, manifestBytes)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	return p.insideTransaction(func(tx *gorp.Transaction) error {
 		refsInfo, err := findManifestReferencedObjects(tx, account, repo, manifestParsed)
 		if err != nil {
@@ -211,27 +369,25 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		}
 		manifest.SizeBytes += refsInfo.SumChildSizes
 
-		configInfo, err := parseManifestConfig(tx, p.sd, account, manifestParsed)
+		var configInfo manifestConfigInfo
+		err = p.withStorageReadTimeout(func(ctx context.Context) (err error) {
+			configInfo, err = parseManifestConfig(ctx, tx, p.sd, account, manifestParsed)
+			return err
+		})
 		if err != nil {
 			return err
 		}
-
-		//enforce account-specific validation rules on manifest, but not list manifest
-		//and only when pushing (not when validating at a later point in time,
-		//the set of RequiredLabels could have been changed by then)
-		labelsRequired := manifest.PushedAt == manifest.ValidatedAt && account.RequiredLabels != "" &&
-			manifest.MediaType != manifestlist.MediaTypeManifestList && manifest.MediaType != imagespec.MediaTypeImageIndex
-		if labelsRequired {
-			requiredLabels := strings.Split(account.RequiredLabels, ",")
-			var missingLabels []string
-			for _, l := range requiredLabels {
-				if _, exists := configInfo.Labels[l]; !exists {
-					missingLabels = append(missingLabels, l)
-				}
-			}
-			if len(missingLabels) > 0 {
-				msg := "missing required labels: " + strings.Join(missingLabels, ", ")
-				return keppel.ErrManifestInvalid.With(msg)
+		//OCI image manifests may carry metadata as annotations instead of labels
+		configInfo.Labels = mergeLabelsWithAnnotations(configInfo.Labels, manifestParsed.Annotations(), p.cfg.PreferAnnotationsOverLabels)
+
+		//enforce account-specific validation rules only when pushing (not when
+		//validating at a later point in time, the set of RequiredLabels could
+		//have been changed by then)
+		isList := manifest.MediaType == manifestlist.MediaTypeManifestList || manifest.MediaType == imagespec.MediaTypeImageIndex
+		if push != nil && account.RequiredLabels != "" {
+			err := checkRequiredLabels(account, isList, isUntaggedPush, configInfo.Labels, refsInfo.ChildLabels)
+			if err != nil {
+				return err
 			}
 		}
 
@@ -239,7 +395,7 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		//list manifests (which do not have a config), we instead report all the
 		//labels that the constituent manifests agree on
 		reportedLabels := configInfo.Labels
-		if manifest.MediaType == manifestlist.MediaTypeManifestList || manifest.MediaType == imagespec.MediaTypeImageIndex {
+		if isList {
 			reportedLabels = refsInfo.CommonLabels
 		}
 		if len(reportedLabels) > 0 {
@@ -255,6 +411,23 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		manifest.MinLayerCreatedAt = keppel.MinMaybeTime(refsInfo.MinCreationTime, configInfo.MinCreationTime)
 		manifest.MaxLayerCreatedAt = keppel.MaxMaybeTime(refsInfo.MaxCreationTime, configInfo.MaxCreationTime)
 
+		//the admission policy only gets to decide on pushes (for the same reason
+		//as with RequiredLabels above)
+		if push != nil {
+			err := p.cfg.Admission().AdmitManifest(keppel.AdmissionRequest{
+				Action:     admissionAction,
+				Account:    account,
+				Repository: repo,
+				Manifest:   *manifest,
+				Parsed:     manifestParsed,
+				Labels:     reportedLabels,
+				Lookup:     admissionLookup{tx, p.sd, account, repo},
+			})
+			if err != nil {
+				return wrapAdmissionError(err, "manifest rejected by admission policy")
+			}
+		}
+
 		//create or update database entries
 		err = upsertManifest(tx, *manifest, manifestBytes, p.timeNow())
 		if err != nil {
@@ -268,6 +441,10 @@ func (p *Processor) validateAndStoreManifestCommon(account keppel.Account, repo
 		if err != nil {
 			return err
 		}
+		err = maintainManifestPlatforms(tx, *manifest, refsInfo.ManifestDigests, refsInfo.Platforms)
+		if err != nil {
+			return err
+		}
 
 		return actionBeforeCommit(tx)
 	})
@@ -282,7 +459,9 @@ type blobRef struct {
 type manifestRefsInfo struct {
 	BlobRefs        []blobRef
 	ManifestDigests []string
+	Platforms       []manifestlist.PlatformSpec //same order as ManifestDigests
 	CommonLabels    map[string]string
+	ChildLabels     map[string]map[string]string //key = child manifest digest
 	MinCreationTime *time.Time
 	MaxCreationTime *time.Time
 	SumChildSizes   uint64
@@ -325,9 +504,9 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account keppel.Account,
 		}
 		wasHandled[desc.Digest.String()] = true
 
-		//check that the child manifest exists
+		//check that the child manifest exists (and is not soft-deleted)
 		manifest, err := keppel.FindManifest(tx, repo, desc.Digest.String())
-		if err == sql.ErrNoRows {
+		if err == sql.ErrNoRows || (err == nil && manifest.DeletedAt != nil) {
 			return manifestRefsInfo{}, keppel.ErrManifestUnknown.With("").WithDetail(desc.Digest.String())
 		}
 		if err != nil {
@@ -342,6 +521,10 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account keppel.Account,
 				return manifestRefsInfo{}, err
 			}
 		}
+		if result.ChildLabels == nil {
+			result.ChildLabels = make(map[string]map[string]string)
+		}
+		result.ChildLabels[desc.Digest.String()] = labels
 		if idx == 0 {
 			//start with the labels of the first child manifest
 			result.CommonLabels = labels
@@ -357,6 +540,7 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account keppel.Account,
 
 		//compute aggregate information for all child manifests
 		result.ManifestDigests = append(result.ManifestDigests, desc.Digest.String())
+		result.Platforms = append(result.Platforms, desc.Platform)
 		result.MinCreationTime = keppel.MinMaybeTime(result.MinCreationTime, manifest.MinLayerCreatedAt)
 		result.MaxCreationTime = keppel.MaxMaybeTime(result.MaxCreationTime, manifest.MaxLayerCreatedAt)
 		result.SumChildSizes += manifest.SizeBytes
@@ -365,6 +549,65 @@ func findManifestReferencedObjects(tx *gorp.Transaction, account keppel.Account,
 	return result, nil
 }
 
+// Enforces the account's RequiredLabels on a manifest that is being pushed.
+// Image manifests are checked against their own labels, list manifests
+// against the labels of their submanifests according to the account's
+// RequiredLabelsListPolicy.
+func checkRequiredLabels(account keppel.Account, isList, isUntaggedPush bool, labels map[string]string, childLabels map[string]map[string]string) error {
+	requiredLabels := strings.Split(account.RequiredLabels, ",")
+	findMissingLabels := func(labels map[string]string) (result []string) {
+		for _, l := range requiredLabels {
+			if _, exists := labels[l]; !exists {
+				result = append(result, l)
+			}
+		}
+		return result
+	}
+
+	switch {
+	case !isList && isUntaggedPush && account.RequiredLabelsListPolicy != "":
+		//this is probably a platform submanifest, which will be checked when the
+		//list manifest is pushed (as soon as a tag points to an image manifest,
+		//it is always checked on its own)
+		return nil
+
+	case !isList:
+		missingLabels := findMissingLabels(labels)
+		if len(missingLabels) > 0 {
+			return keppel.ErrManifestInvalid.With("missing required labels: " + strings.Join(missingLabels, ", "))
+		}
+		return nil
+
+	case account.RequiredLabelsListPolicy == keppel.RequiredLabelsOnAllPlatforms:
+		childDigests := make([]string, 0, len(childLabels))
+		for childDigest := range childLabels {
+			childDigests = append(childDigests, childDigest)
+		}
+		sort.Strings(childDigests) //for deterministic error messages
+		for _, childDigest := range childDigests {
+			missingLabels := findMissingLabels(childLabels[childDigest])
+			if len(missingLabels) > 0 {
+				msg := fmt.Sprintf("missing required labels on submanifest %s: %s", childDigest, strings.Join(missingLabels, ", "))
+				return keppel.ErrManifestInvalid.With(msg)
+			}
+		}
+		return nil
+
+	case account.RequiredLabelsListPolicy == keppel.RequiredLabelsOnAnyPlatform:
+		for _, labels := range childLabels {
+			if len(findMissingLabels(labels)) == 0 {
+				return nil
+			}
+		}
+		return keppel.ErrManifestInvalid.With("no submanifest has all required labels: " + strings.Join(requiredLabels, ", "))
+
+	default:
+		//without a list policy, list manifests are not checked (they do not have
+		//labels of their own, and their submanifests were checked when they were pushed)
+		return nil
+	}
+}
+
 // Information about a manifest's config blob.
 type manifestConfigInfo struct {
 	Labels          map[string]string
@@ -372,8 +615,28 @@ type manifestConfigInfo struct {
 	MaxCreationTime *time.Time //across all layers
 }
 
+// Merges manifest annotations into the labels from the image configuration.
+// When a key appears in both, the labels win unless `preferAnnotations` is set.
+// The input maps are not modified since they may be shared with the
+// manifestConfigCache.
+func mergeLabelsWithAnnotations(labels, annotations map[string]string, preferAnnotations bool) map[string]string {
+	if len(annotations) == 0 {
+		return labels
+	}
+	result := make(map[string]string, len(labels)+len(annotations))
+	for k, v := range labels {
+		result[k] = v
+	}
+	for k, v := range annotations {
+		if _, exists := result[k]; !exists || preferAnnotations {
+			result[k] = v
+		}
+	}
+	return result
+}
+
 // Returns the list of missing labels, or nil if everything is ok.
-func parseManifestConfig(tx *gorp.Transaction, sd keppel.StorageDriver, account keppel.Account, manifest keppel.ParsedManifest) (result manifestConfigInfo, err error) {
+func parseManifestConfig(ctx context.Context, tx *gorp.Transaction, sd keppel.StorageDriver, account keppel.Account, manifest keppel.ParsedManifest) (result manifestConfigInfo, err error) {
 	//is this manifest an image that has labels?
 	configBlob := manifest.FindImageConfigBlob()
 	if configBlob == nil {
@@ -391,7 +654,20 @@ func parseManifestConfig(tx *gorp.Transaction, sd keppel.StorageDriver, account
 	if storageID == "" {
 		return manifestConfigInfo{}, keppel.ErrManifestBlobUnknown.With("").WithDetail(configBlob.Digest.String())
 	}
-	blobReader, _, err := sd.ReadBlob(account, storageID)
+
+	//we know now that the config blob exists in this account, so we can use the
+	//cache to avoid reading and parsing the same config blob over and over again
+	//(this happens a lot when many images are pushed with the same base image)
+	if cachedResult, exists := manifestConfigCache.Get(configBlob.Digest.String()); exists {
+		return cachedResult, nil
+	}
+	defer func() {
+		if err == nil {
+			manifestConfigCache.Put(configBlob.Digest.String(), result)
+		}
+	}()
+
+	blobReader, _, err := keppel.ReadBlobWithContext(ctx, sd, account, storageID)
 	if err != nil {
 		return manifestConfigInfo{}, err
 	}
@@ -441,7 +717,9 @@ var upsertManifestQuery = sqlext.SimplifyWhitespace(`
 	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	ON CONFLICT (repo_id, digest) DO UPDATE
 		SET size_bytes = EXCLUDED.size_bytes, validated_at = EXCLUDED.validated_at, labels_json = EXCLUDED.labels_json,
-		min_layer_created_at = EXCLUDED.min_layer_created_at, max_layer_created_at = EXCLUDED.max_layer_created_at
+		min_layer_created_at = EXCLUDED.min_layer_created_at, max_layer_created_at = EXCLUDED.max_layer_created_at,
+		-- when a soft-deleted manifest is pushed or replicated again, it is restored
+		deleted_at = NULL
 `)
 
 var upsertManifestContentQuery = sqlext.SimplifyWhitespace(`
@@ -462,9 +740,11 @@ func upsertManifest(db gorp.SqlExecutor, m keppel.Manifest, manifestBytes []byte
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(upsertManifestContentQuery, m.RepositoryID, m.Digest, manifestBytes)
-	if err != nil {
-		return err
+	if manifestBytes != nil {
+		_, err = db.Exec(upsertManifestContentQuery, m.RepositoryID, m.Digest, manifestBytes)
+		if err != nil {
+			return err
+		}
 	}
 
 	_, err = db.Exec(upsertManifestVulnerabilityInfo, m.RepositoryID, m.Digest, clair.PendingVulnerabilityStatus, "", timeNow)
@@ -482,8 +762,22 @@ var upsertTagQuery = sqlext.SimplifyWhitespace(`
 			last_pulled_at = (CASE WHEN tags.digest = EXCLUDED.digest THEN GREATEST(tags.last_pulled_at, EXCLUDED.last_pulled_at) ELSE EXCLUDED.last_pulled_at END)
 `)
 
-func upsertTag(db gorp.SqlExecutor, t keppel.Tag) error {
-	_, err := db.Exec(upsertTagQuery, t.RepositoryID, t.Name, t.Digest, t.PushedAt)
+// NOTE: This must run before upsertTagQuery since it looks at the previous digest of the tag.
+var recordTagMoveQuery = sqlext.SimplifyWhitespace(`
+	INSERT INTO tag_history (repo_id, tag_name, old_digest, new_digest, moved_at, moved_by, account_name, repo_name)
+	SELECT t.repo_id, t.name, t.digest, $3, $4, $5, r.account_name, r.name
+	  FROM tags t JOIN repos r ON r.id = t.repo_id
+	 WHERE t.repo_id = $1 AND t.name = $2 AND t.digest != $3
+`)
+
+// Creates or updates the given tag. If an existing tag is moved to a different
+// manifest, the move is recorded in the tag history.
+func upsertTag(db gorp.SqlExecutor, t keppel.Tag, userName string) error {
+	_, err := db.Exec(recordTagMoveQuery, t.RepositoryID, t.Name, t.Digest, t.PushedAt, userName)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(upsertTagQuery, t.RepositoryID, t.Name, t.Digest, t.PushedAt)
 	return err
 }
 
@@ -567,6 +861,31 @@ func maintainManifestBlobRefs(tx *gorp.Transaction, m keppel.Manifest, reference
 	return nil
 }
 
+// Stores the platforms of the submanifests of a list manifest, so that the
+// platform index can be queried without parsing the manifest contents again.
+// Since the platforms are fully determined by the manifest contents (and the
+// account's PlatformFilter), we can just replace all existing entries.
+func maintainManifestPlatforms(tx *gorp.Transaction, m keppel.Manifest, childDigests []string, platforms []manifestlist.PlatformSpec) error {
+	_, err := tx.Exec(`DELETE FROM manifest_platforms WHERE repo_id = $1 AND digest = $2`, m.RepositoryID, m.Digest)
+	if err != nil || len(childDigests) == 0 {
+		return err
+	}
+
+	return sqlext.WithPreparedStatement(tx,
+		`INSERT INTO manifest_platforms (repo_id, digest, child_digest, os, architecture, variant) VALUES ($1, $2, $3, $4, $5, $6)`,
+		func(stmt *sql.Stmt) error {
+			for idx, childDigest := range childDigests {
+				p := platforms[idx]
+				_, err := stmt.Exec(m.RepositoryID, m.Digest, childDigest, p.OS, p.Architecture, p.Variant)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+}
+
 func maintainManifestManifestRefs(tx *gorp.Transaction, m keppel.Manifest, referencedManifestDigests []string) error {
 	//find existing manifest_manifest_refs entries for this manifest
 	isExistingManifestDigestRef := make(map[string]bool)
@@ -630,6 +949,265 @@ func maintainManifestManifestRefs(tx *gorp.Transaction, m keppel.Manifest, refer
 	return nil
 }
 
+// ResolveManifestReference returns the digest of the manifest that the given
+// reference points to. Digest references are returned as-is. Tag references
+// are resolved using the DB; if the tag does not exist, sql.ErrNoRows is
+// returned.
+func (p *Processor) ResolveManifestReference(repo keppel.Repository, ref keppel.ManifestReference) (digest.Digest, error) {
+	if ref.IsDigest() {
+		return ref.Digest, nil
+	}
+	digestStr, err := p.db.SelectStr(
+		`SELECT digest FROM tags WHERE repo_id = $1 AND name = $2`,
+		repo.ID, ref.Tag,
+	)
+	if err != nil {
+		return "", err
+	}
+	if digestStr == "" {
+		return "", sql.ErrNoRows
+	}
+	return digest.Parse(digestStr)
+}
+
+// FindManifest returns the DB record of the manifest that the given reference
+// points to. If the manifest (or the tag) does not exist, or if the manifest
+// has been soft-deleted, sql.ErrNoRows is returned.
+func (p *Processor) FindManifest(repo keppel.Repository, ref keppel.ManifestReference) (*keppel.Manifest, error) {
+	manifestDigest, err := p.ResolveManifestReference(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := keppel.FindManifest(p.db, repo, manifestDigest.String())
+	if err == nil && manifest.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+	return manifest, err
+}
+
+// ReadManifestContents returns the contents of the given manifest. The
+// contents are read from the DB if possible, with a fallback to reading them
+// from the storage.
+func (p *Processor) ReadManifestContents(account keppel.Account, repo keppel.Repository, manifestDigest string) ([]byte, error) {
+	var contents []byte
+	err := p.db.SelectOne(&contents,
+		`SELECT content FROM manifest_contents WHERE repo_id = $1 AND digest = $2`,
+		repo.ID, manifestDigest,
+	)
+	if err == nil {
+		return contents, nil
+	}
+	if err != sql.ErrNoRows {
+		logg.Info("could not read manifest %s@%s from DB (falling back to read from storage): %s",
+			repo.FullName(), manifestDigest, err.Error())
+	}
+	err = p.traced("storage.ReadManifest", func(p *Processor) (err error) {
+		contents, err = p.sd.ReadManifest(account, repo.Name, manifestDigest)
+		return err
+	})
+	return contents, err
+}
+
+// StoredManifest is returned by GetManifest.
+type StoredManifest struct {
+	//the DB record (this also contains the media type of the manifest)
+	Manifest keppel.Manifest
+	Contents []byte
+	Parsed   keppel.ParsedManifest
+}
+
+// GetManifest retrieves the manifest that the given reference points to,
+// including its contents in raw and parsed form. If the manifest (or the tag)
+// does not exist, sql.ErrNoRows is returned.
+func (p *Processor) GetManifest(account keppel.Account, repo keppel.Repository, ref keppel.ManifestReference) (*StoredManifest, error) {
+	manifest, err := p.FindManifest(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := p.ReadManifestContents(account, repo, manifest.Digest)
+	if err != nil {
+		return nil, err
+	}
+	parsed, _, err := keppel.ParseManifest(manifest.MediaType, contents)
+	if err != nil {
+		return nil, keppel.ErrManifestInvalid.With(err.Error())
+	}
+	return &StoredManifest{*manifest, contents, parsed}, nil
+}
+
+var collectReferencedBlobsQuery = sqlext.SimplifyWhitespace(`
+	WITH RECURSIVE manifest_digests (digest) AS (
+		SELECT $2::TEXT
+		UNION
+		SELECT r.child_digest FROM manifest_manifest_refs r
+		JOIN manifest_digests d ON r.parent_digest = d.digest
+			WHERE r.repo_id = $1
+	)
+	SELECT * FROM blobs WHERE id IN (
+		SELECT blob_id FROM manifest_blob_refs
+			WHERE repo_id = $1 AND digest IN (SELECT digest FROM manifest_digests)
+	) ORDER BY id
+`)
+
+// CollectReferencedBlobs returns all blobs that are referenced by the given
+// manifest, either directly or through any of its submanifests (recursively).
+// Each blob appears only once in the result, even if it is referenced by
+// multiple submanifests. If the manifest does not exist, sql.ErrNoRows is
+// returned.
+func (p *Processor) CollectReferencedBlobs(repo keppel.Repository, manifestDigest digest.Digest) ([]keppel.Blob, error) {
+	manifestExists, err := p.db.SelectBool(checkManifestExistsQuery, repo.ID, manifestDigest.String())
+	if err != nil {
+		return nil, err
+	}
+	if !manifestExists {
+		return nil, sql.ErrNoRows
+	}
+
+	var blobs []keppel.Blob
+	_, err = p.db.Select(&blobs, collectReferencedBlobsQuery, repo.ID, manifestDigest.String())
+	return blobs, err
+}
+
+// ImageSize is returned by ComputeImageSize().
+type ImageSize struct {
+	//sum of the sizes of all blobs referenced by the image (each blob counted once)
+	TotalBytes uint64
+	//sum of the sizes of those blobs that are not referenced by any manifest outside this image
+	UniqueBytes uint64
+	//sum of the sizes of those blobs that are also referenced by other manifests in the same account
+	SharedBytes uint64
+}
+
+var findSharedBlobIDsQuery = sqlext.SimplifyWhitespace(`
+	WITH RECURSIVE manifest_digests (digest) AS (
+		SELECT $2::TEXT
+		UNION
+		SELECT r.child_digest FROM manifest_manifest_refs r
+		JOIN manifest_digests d ON r.parent_digest = d.digest
+			WHERE r.repo_id = $1
+	), image_blob_ids (blob_id) AS (
+		SELECT blob_id FROM manifest_blob_refs
+			WHERE repo_id = $1 AND digest IN (SELECT digest FROM manifest_digests)
+	)
+	SELECT DISTINCT blob_id FROM manifest_blob_refs
+		WHERE blob_id IN (SELECT blob_id FROM image_blob_ids)
+		AND NOT (repo_id = $1 AND digest IN (SELECT digest FROM manifest_digests))
+`)
+
+// ComputeImageSize computes the storage size of the given manifest, including
+// all its submanifests (recursively). Unlike the size_bytes column on the
+// manifest, which naively sums up all referenced descriptors, this accounts
+// for deduplication: Each blob is only counted once, and blobs that are also
+// referenced by manifests outside this image (in any repository of the same
+// account) are reported as shared instead of unique. This is the amount of
+// storage that would be freed by deleting the image and everything that only
+// it references. If the manifest does not exist, sql.ErrNoRows is returned.
+func (p *Processor) ComputeImageSize(repo keppel.Repository, manifestDigest digest.Digest) (ImageSize, error) {
+	blobs, err := p.CollectReferencedBlobs(repo, manifestDigest)
+	if err != nil {
+		return ImageSize{}, err
+	}
+
+	isShared := make(map[int64]bool)
+	err = sqlext.ForeachRow(p.db, findSharedBlobIDsQuery, []any{repo.ID, manifestDigest.String()}, func(rows *sql.Rows) error {
+		var blobID int64
+		err := rows.Scan(&blobID)
+		isShared[blobID] = true
+		return err
+	})
+	if err != nil {
+		return ImageSize{}, err
+	}
+
+	var result ImageSize
+	for _, blob := range blobs {
+		result.TotalBytes += blob.SizeBytes
+		if isShared[blob.ID] {
+			result.SharedBytes += blob.SizeBytes
+		} else {
+			result.UniqueBytes += blob.SizeBytes
+		}
+	}
+	return result, nil
+}
+
+var findChildManifestDigestsQuery = sqlext.SimplifyWhitespace(`
+	SELECT child_digest FROM manifest_manifest_refs
+	 WHERE repo_id = $1 AND parent_digest = $2
+	 ORDER BY child_digest
+`)
+
+// CopyManifest copies the given manifest (including all its submanifests,
+// recursively) from `srcRepo` into `dstRepo`, e.g. to promote an image from a
+// development repository into a production repository. Both repositories must
+// belong to the given account. Since blobs are stored per account, the blob
+// contents are not copied: the referenced blobs are just mounted into
+// `dstRepo`. If `tagName` is not empty, that tag is created in `dstRepo` (or
+// moved if it exists already) to point to the copied manifest.
+//
+// The copied manifests go through the same validation as pushed manifests,
+// so quotas, required labels etc. are enforced for `dstRepo`. If the manifest
+// does not exist in `srcRepo`, sql.ErrNoRows is returned.
+func (p *Processor) CopyManifest(account keppel.Account, srcRepo, dstRepo keppel.Repository, manifestDigest digest.Digest, tagName string, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	if srcRepo.AccountName != account.Name || dstRepo.AccountName != account.Name {
+		return nil, errors.New("cannot copy manifests between different accounts")
+	}
+	_, err := p.FindManifest(srcRepo, keppel.ManifestReference{Digest: manifestDigest})
+	if err != nil {
+		return nil, err
+	}
+
+	//make all blobs of this image visible in the target repo, so that the
+	//manifests can be validated there
+	blobs, err := p.CollectReferencedBlobs(srcRepo, manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range blobs {
+		err := keppel.MountBlobIntoRepo(p.db, blob, dstRepo)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p.copyManifestRecursively(account, srcRepo, dstRepo, manifestDigest, tagName, actx)
+}
+
+func (p *Processor) copyManifestRecursively(account keppel.Account, srcRepo, dstRepo keppel.Repository, manifestDigest digest.Digest, tagName string, actx keppel.AuditContext) (*keppel.Manifest, error) {
+	sm, err := p.GetManifest(account, srcRepo, keppel.ManifestReference{Digest: manifestDigest})
+	if err != nil {
+		return nil, err
+	}
+
+	//submanifests need to exist in the target repo before their parent can be stored there
+	var childDigests []string
+	_, err = p.db.Select(&childDigests, findChildManifestDigestsQuery, srcRepo.ID, manifestDigest.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, childDigestStr := range childDigests {
+		childDigest, err := digest.Parse(childDigestStr)
+		if err != nil {
+			return nil, err
+		}
+		_, err = p.copyManifestRecursively(account, srcRepo, dstRepo, childDigest, "", actx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ref := keppel.ManifestReference{Digest: manifestDigest}
+	if tagName != "" {
+		ref = keppel.ManifestReference{Tag: tagName}
+	}
+	return p.ValidateAndStoreManifest(account, dstRepo, IncomingManifest{
+		Reference: ref,
+		MediaType: sm.Manifest.MediaType,
+		Contents:  sm.Contents,
+		PushedAt:  p.timeNow(),
+	}, actx)
+}
+
 // UpstreamManifestMissingError is returned from ReplicateManifest when a
 // manifest is legitimately nonexistent on upstream (i.e. returning a valid 404 error in the correct format).
 type UpstreamManifestMissingError struct {
@@ -642,10 +1220,48 @@ func (e UpstreamManifestMissingError) Error() string {
 	return e.Inner.Error()
 }
 
+// ReplicationChainHeader is set on manifest requests that a Keppel sends to
+// its upstream peer while replicating on behalf of a client. It contains the
+// comma-separated hostnames of all Keppels that are replicating the manifest
+// so far. A peer that is itself a replica only replicates from its own
+// upstream when asked through this header, and refuses to do so when its own
+// hostname already appears in the chain.
+const ReplicationChainHeader = "X-Keppel-Replication-Chain"
+
+// ParseReplicationChain returns the hostnames listed in the
+// X-Keppel-Replication-Chain header, or nil if the header is not set.
+func ParseReplicationChain(hdr http.Header) []string {
+	var result []string
+	for _, hostName := range strings.Split(hdr.Get(ReplicationChainHeader), ",") {
+		hostName = strings.TrimSpace(hostName)
+		if hostName != "" {
+			result = append(result, hostName)
+		}
+	}
+	return result
+}
+
+// Builds the headers that ask the upstream peer to replicate from its own
+// upstream in turn, if necessary.
+func (p *Processor) replicationChainHeaders(account keppel.Account, actx keppel.AuditContext) http.Header {
+	//the janitor's syncs only ever ask the immediate upstream about its own
+	//contents, so deletions travel down the chain one hop at a time
+	if account.UpstreamPeerHostName == "" || actx.UserIdentity == nil || actx.UserIdentity.UserType() == keppel.JanitorUser {
+		return nil
+	}
+
+	var chain []string
+	if actx.UserIdentity.UserType() == keppel.PeerUser && actx.Request != nil {
+		chain = ParseReplicationChain(actx.Request.Header)
+	}
+	chain = append(chain, p.cfg.APIPublicHostname)
+	return http.Header{ReplicationChainHeader: {strings.Join(chain, ",")}}
+}
+
 // ReplicateManifest replicates the manifest from its account's upstream registry.
 // On success, the manifest's metadata and contents are returned.
 func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Repository, reference keppel.ManifestReference, actx keppel.AuditContext) (*keppel.Manifest, []byte, error) {
-	manifestBytes, manifestMediaType, err := p.downloadManifestViaInboundCache(account, repo, reference)
+	manifestBytes, manifestMediaType, err := p.downloadManifestViaInboundCache(account, repo, reference, p.replicationChainHeaders(account, actx))
 	if err != nil {
 		if errorIsManifestNotFound(err) {
 			return nil, nil, UpstreamManifestMissingError{reference, err}
@@ -653,6 +1269,17 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 		return nil, nil, err
 	}
 
+	//when replicating by digest, verify that upstream actually delivered the
+	//manifest that we asked for (this check also happens when storing the
+	//manifest below, but by then, we would already have replicated everything
+	//that the bogus manifest references)
+	if reference.IsDigest() {
+		actualDigest := reference.Digest.Algorithm().FromBytes(manifestBytes)
+		if actualDigest != reference.Digest {
+			return nil, nil, keppel.ErrDigestInvalid.With("upstream registry delivered manifest %s instead of %s", actualDigest, reference.Digest)
+		}
+	}
+
 	//parse the manifest to discover references to other manifests and blobs
 	manifestParsed, _, err := keppel.ParseManifest(manifestMediaType, manifestBytes)
 	if err != nil {
@@ -661,8 +1288,9 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 
 	//replicate referenced manifests recursively if required
 	for _, desc := range manifestParsed.ManifestReferences(account.PlatformFilter) {
-		_, err := keppel.FindManifest(p.db, repo, desc.Digest.String())
-		if err == sql.ErrNoRows {
+		//(soft-deleted manifests are restored by replicating them again)
+		child, err := keppel.FindManifest(p.db, repo, desc.Digest.String())
+		if err == sql.ErrNoRows || (err == nil && child.DeletedAt != nil) {
 			_, _, err = p.ReplicateManifest(account, repo, keppel.ManifestReference{Digest: desc.Digest}, actx)
 		}
 		if err != nil {
@@ -703,6 +1331,16 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 		}
 	}
 
+	//the admission policy may want to look at other tags when admitting this
+	//manifest (e.g. signatures), so those need to be replicated first
+	manifestDigest := digest.Canonical.FromBytes(manifestBytes).String()
+	for _, tagName := range p.cfg.Admission().TagsRequiredForAdmission(account, manifestDigest, manifestParsed) {
+		err := p.replicateAdmissionDependency(account, repo, tagName, actx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	manifest, err := p.ValidateAndStoreManifest(account, repo, IncomingManifest{
 		Reference: reference,
 		MediaType: manifestMediaType,
@@ -712,11 +1350,54 @@ func (p *Processor) ReplicateManifest(account keppel.Account, repo keppel.Reposi
 	return manifest, manifestBytes, err
 }
 
+func (p *Processor) replicateAdmissionDependency(account keppel.Account, repo keppel.Repository, tagName string, actx keppel.AuditContext) error {
+	ref := keppel.ManifestReference{Tag: tagName}
+	_, err := p.FindManifest(repo, ref)
+	if err == nil {
+		return nil //already replicated
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+
+	manifest, manifestBytes, err := p.ReplicateManifest(account, repo, ref, actx)
+	if err != nil {
+		//if the tag does not exist upstream, the admission policy will complain about it
+		var umerr UpstreamManifestMissingError
+		if errors.As(err, &umerr) {
+			return nil
+		}
+		return err
+	}
+
+	//the admission policy reads the blobs of this manifest from within a DB
+	//transaction, so they cannot be replicated on demand and need to be
+	//replicated right away (this is fine since the blobs in question, e.g.
+	//signature payloads, are usually tiny)
+	manifestParsed, _, err := keppel.ParseManifest(manifest.MediaType, manifestBytes)
+	if err != nil {
+		return keppel.ErrManifestInvalid.With(err.Error())
+	}
+	for _, desc := range manifestParsed.BlobReferences() {
+		blob, err := keppel.FindBlobByAccountName(p.db, desc.Digest, account)
+		if err != nil {
+			return err
+		}
+		if blob.StorageID == "" {
+			_, err = p.ReplicateBlob(*blob, account, repo, nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // CheckManifestOnPrimary checks if the given manifest exists on its account's
 // upstream registry. If not, false is returned, An error is returned only if
 // the account is not a replica, or if the upstream registry cannot be queried.
 func (p *Processor) CheckManifestOnPrimary(account keppel.Account, repo keppel.Repository, reference keppel.ManifestReference) (bool, error) {
-	_, _, err := p.downloadManifestViaInboundCache(account, repo, reference)
+	_, _, err := p.downloadManifestViaInboundCache(account, repo, reference, nil)
 	if err != nil {
 		if errorIsManifestNotFound(err) {
 			return false, nil
@@ -745,7 +1426,7 @@ func errorIsUpstreamRateLimit(err error) bool {
 
 // Downloads a manifest from an account's upstream using
 // RepoClient.DownloadManifest(), but also takes into account the inbound cache.
-func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo keppel.Repository, ref keppel.ManifestReference) (manifestBytes []byte, manifestMediaType string, err error) {
+func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo keppel.Repository, ref keppel.ManifestReference, extraHeaders http.Header) (manifestBytes []byte, manifestMediaType string, err error) {
 	c, err := p.getRepoClientForUpstream(account, repo)
 	if err != nil {
 		return nil, "", err
@@ -770,6 +1451,8 @@ func (p *Processor) downloadManifestViaInboundCache(account keppel.Account, repo
 	//cache miss -> download from actual upstream registry
 	manifestBytes, manifestMediaType, err = c.DownloadManifest(ref, &client.DownloadManifestOpts{
 		DoNotCountTowardsLastPulled: true,
+		ExtraHeaders:                extraHeaders,
+		Timeout:                     p.cfg.ReplicationTimeout,
 	})
 	if err != nil && account.ExternalPeerURL != "" && errorIsUpstreamRateLimit(err) {
 		//when a pull from an external registry runs into a rate limit, ask a
@@ -901,6 +1584,12 @@ func (p *Processor) DeleteManifest(account keppel.Account, repo keppel.Repositor
 		})
 	}
 
+	p.emitEvent(keppel.ManifestDeletedEvent{
+		Account:    account,
+		Repository: repo,
+		Digest:     digestStr,
+		DeletedAt:  p.timeNow(),
+	})
 	return nil
 }
 
@@ -933,6 +1622,83 @@ func (p *Processor) DeleteTag(account keppel.Account, repo keppel.Repository, ta
 		})
 	}
 
+	p.emitEvent(keppel.ManifestDeletedEvent{
+		Account:    account,
+		Repository: repo,
+		Digest:     parsedDigest,
+		Tag:        tagName,
+		DeletedAt:  p.timeNow(),
+	})
+	return nil
+}
+
+var restoreManifestQuery = sqlext.SimplifyWhitespace(`
+	WITH RECURSIVE digests(digest) AS (
+		SELECT $2::TEXT
+		UNION
+		SELECT mmr.child_digest FROM manifest_manifest_refs mmr
+		  JOIN digests d ON mmr.parent_digest = d.digest
+		 WHERE mmr.repo_id = $1
+	)
+	UPDATE manifests SET deleted_at = NULL
+	 WHERE repo_id = $1 AND deleted_at IS NOT NULL AND digest IN (SELECT digest FROM digests)
+`)
+
+// RestoreManifest restores a manifest that was soft-deleted by the manifest
+// sync (see keppel.Configuration.DeletedManifestRetention), including all
+// soft-deleted manifests referenced by it. Manifests that are not soft-deleted
+// are left unchanged. If the manifest does not exist (anymore), sql.ErrNoRows
+// is returned.
+//
+// Blobs are never deleted while a manifest referencing them still exists (even
+// if soft-deleted), so restoring the database rows is sufficient. In replica
+// accounts, blobs that were never replicated are replicated on the next pull
+// as usual.
+func (p *Processor) RestoreManifest(account keppel.Account, repo keppel.Repository, digestStr string, actx keppel.AuditContext) error {
+	exists, err := p.db.SelectInt(
+		`SELECT COUNT(*) FROM manifests WHERE repo_id = $1 AND digest = $2`,
+		repo.ID, digestStr)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+
+	result, err := p.db.Exec(restoreManifestQuery, repo.ID, digestStr)
+	if err != nil {
+		return err
+	}
+	rowsUpdated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsUpdated == 0 {
+		return nil
+	}
+
+	var tagNames []string
+	_, err = p.db.Select(&tagNames,
+		`SELECT name FROM tags WHERE repo_id = $1 AND digest = $2 ORDER BY name`,
+		repo.ID, digestStr)
+	if err != nil {
+		return err
+	}
+	if userInfo := actx.UserIdentity.UserInfo(); userInfo != nil {
+		p.auditor.Record(audittools.EventParameters{
+			Time:       p.timeNow(),
+			Request:    actx.Request,
+			User:       userInfo,
+			ReasonCode: http.StatusOK,
+			Action:     cadf.UpdateAction,
+			Target: auditManifest{
+				Account:    account,
+				Repository: repo,
+				Digest:     digestStr,
+				Tags:       tagNames,
+			},
+		})
+	}
 	return nil
 }
 
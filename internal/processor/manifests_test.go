@@ -0,0 +1,264 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor_test
+
+import (
+	"database/sql"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/auth"
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+func TestGetManifest(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	repo := *s.Repos[0]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, repo, "latest")
+
+	//both a tag reference and a digest reference shall resolve to the same manifest
+	refs := []keppel.ManifestReference{
+		{Tag: "latest"},
+		image.DigestRef(),
+	}
+	for _, ref := range refs {
+		result, err := p.GetManifest(account, repo, ref)
+		if err != nil {
+			t.Fatalf("GetManifest(%q) failed: %s", ref.String(), err.Error())
+		}
+		assert.DeepEqual(t, "manifest digest", result.Manifest.Digest, image.Manifest.Digest.String())
+		assert.DeepEqual(t, "manifest media type", result.Manifest.MediaType, image.Manifest.MediaType)
+		assert.DeepEqual(t, "manifest contents", string(result.Contents), string(image.Manifest.Contents))
+		assert.DeepEqual(t, "number of layers", len(result.Parsed.FindImageLayerBlobs()), 1)
+	}
+
+	//unknown references shall be reported as sql.ErrNoRows
+	_, err := p.GetManifest(account, repo, keppel.ManifestReference{Tag: "unknown"})
+	assert.DeepEqual(t, "error for unknown tag", err, sql.ErrNoRows)
+	_, err = p.GetManifest(account, repo, test.GenerateImage(test.GenerateExampleLayer(2)).DigestRef())
+	assert.DeepEqual(t, "error for unknown digest", err, sql.ErrNoRows)
+}
+
+func TestCollectReferencedBlobs(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+	repo := *s.Repos[0]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+
+	//two images that share one of their layers, and a list containing both
+	sharedLayer := test.GenerateExampleLayer(1)
+	image1 := test.GenerateImage(sharedLayer)
+	image2 := test.GenerateImage(sharedLayer, test.GenerateExampleLayer(2))
+	image1.MustUpload(t, s, repo, "")
+	image2.MustUpload(t, s, repo, "")
+	list := test.GenerateImageList(image1, image2)
+	list.MustUpload(t, s, repo, "list")
+
+	collectDigests := func(manifestDigest digest.Digest) []string {
+		t.Helper()
+		blobs, err := p.CollectReferencedBlobs(repo, manifestDigest)
+		if err != nil {
+			t.Fatalf("CollectReferencedBlobs(%s) failed: %s", manifestDigest, err.Error())
+		}
+		result := make([]string, len(blobs))
+		for idx, blob := range blobs {
+			result[idx] = blob.Digest
+		}
+		sort.Strings(result)
+		return result
+	}
+	expectDigests := func(blobs ...test.Bytes) []string {
+		result := make([]string, len(blobs))
+		for idx, blob := range blobs {
+			result[idx] = blob.Digest.String()
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	//for an image, this is just the direct blob references
+	assert.DeepEqual(t, "blobs of image1", collectDigests(image1.Manifest.Digest),
+		expectDigests(image1.Config, sharedLayer))
+
+	//for the list, all blobs of all submanifests are collected, but the shared layer only once
+	assert.DeepEqual(t, "blobs of list", collectDigests(list.Manifest.Digest),
+		expectDigests(image1.Config, image2.Config, sharedLayer, image2.Layers[1]))
+
+	//unknown manifests are reported as sql.ErrNoRows
+	_, err := p.CollectReferencedBlobs(repo, test.GenerateImage(test.GenerateExampleLayer(3)).Manifest.Digest)
+	assert.DeepEqual(t, "error for unknown manifest", err, sql.ErrNoRows)
+}
+
+func TestComputeImageSize(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "bar"}),
+		test.WithQuotas,
+	)
+	fooRepo := *s.Repos[0]
+	barRepo := *s.Repos[1]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+
+	//two images that share one of their layers, but live in different repos
+	sharedLayer := test.GenerateExampleLayer(1)
+	uniqueLayer := test.GenerateExampleLayer(2)
+	image1 := test.GenerateImage(sharedLayer, uniqueLayer)
+	image2 := test.GenerateImage(sharedLayer)
+	image1.MustUpload(t, s, fooRepo, "")
+	image2.MustUpload(t, s, barRepo, "")
+
+	sizeOf := func(blobs ...test.Bytes) (result uint64) {
+		for _, blob := range blobs {
+			result += uint64(len(blob.Contents))
+		}
+		return result
+	}
+
+	size, err := p.ComputeImageSize(fooRepo, image1.Manifest.Digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "size of image1", size, processor.ImageSize{
+		TotalBytes:  sizeOf(image1.Config, sharedLayer, uniqueLayer),
+		UniqueBytes: sizeOf(image1.Config, uniqueLayer),
+		SharedBytes: sizeOf(sharedLayer),
+	})
+
+	//in a list containing image1, the blobs of image1 are not shared with
+	//anything outside the list (the list itself has no blob references)
+	list := test.GenerateImageList(image1)
+	list.MustUpload(t, s, fooRepo, "list")
+	size, err = p.ComputeImageSize(fooRepo, list.Manifest.Digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "size of list", size, processor.ImageSize{
+		TotalBytes:  sizeOf(image1.Config, sharedLayer, uniqueLayer),
+		UniqueBytes: sizeOf(image1.Config, uniqueLayer),
+		SharedBytes: sizeOf(sharedLayer),
+	})
+
+	//after image2 is deleted, the formerly shared layer is unique to image1
+	_, err = s.DB.Exec(`DELETE FROM manifests WHERE repo_id = $1`, barRepo.ID)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	size, err = p.ComputeImageSize(fooRepo, image1.Manifest.Digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "size of image1 after deleting image2", size, processor.ImageSize{
+		TotalBytes:  sizeOf(image1.Config, sharedLayer, uniqueLayer),
+		UniqueBytes: sizeOf(image1.Config, sharedLayer, uniqueLayer),
+		SharedBytes: 0,
+	})
+
+	//unknown manifests are reported as sql.ErrNoRows
+	_, err = p.ComputeImageSize(fooRepo, image2.Manifest.Digest)
+	assert.DeepEqual(t, "error for unknown manifest", err, sql.ErrNoRows)
+}
+
+func TestCopyManifest(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "dev"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "prod"}),
+		test.WithQuotas,
+	)
+	account := *s.Accounts[0]
+	devRepo := *s.Repos[0]
+	prodRepo := *s.Repos[1]
+	p := processor.New(s.Config, s.DB, s.SD, s.ICD, s.Auditor)
+	actx := keppel.AuditContext{UserIdentity: auth.AnonymousUserIdentity}
+
+	//push an image list with two images into the dev repo
+	image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+	image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+	image1.MustUpload(t, s, devRepo, "")
+	image2.MustUpload(t, s, devRepo, "")
+	list := test.GenerateImageList(image1, image2)
+	list.MustUpload(t, s, devRepo, "latest")
+	blobCountBefore := s.SD.BlobCount()
+
+	//promote the list into the prod repo
+	manifest, err := p.CopyManifest(account, devRepo, prodRepo, list.Manifest.Digest, "v1.0", actx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "digest of copied manifest", manifest.Digest, list.Manifest.Digest.String())
+
+	//the tag and all submanifests are available in the prod repo...
+	result, err := p.GetManifest(account, prodRepo, keppel.ManifestReference{Tag: "v1.0"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "manifest contents", string(result.Contents), string(list.Manifest.Contents))
+	for _, image := range []test.Image{image1, image2} {
+		_, err := p.GetManifest(account, prodRepo, image.DigestRef())
+		if err != nil {
+			t.Errorf("GetManifest(%s) in prod repo failed: %s", image.Manifest.Digest, err.Error())
+		}
+		for _, blob := range append([]test.Bytes{image.Config}, image.Layers...) {
+			_, err := keppel.FindBlobByRepository(s.DB, blob.Digest, prodRepo)
+			if err != nil {
+				t.Errorf("blob %s is not mounted in prod repo: %s", blob.Digest, err.Error())
+			}
+		}
+	}
+
+	//...but no blob contents were copied
+	assert.DeepEqual(t, "blob count in storage", s.SD.BlobCount(), blobCountBefore)
+	blobs, err := p.CollectReferencedBlobs(prodRepo, list.Manifest.Digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	devBlobs, err := p.CollectReferencedBlobs(devRepo, list.Manifest.Digest)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "blobs referenced in prod repo", blobs, devBlobs)
+
+	//copying again is idempotent
+	_, err = p.CopyManifest(account, devRepo, prodRepo, list.Manifest.Digest, "v1.0", actx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "blob count in storage", s.SD.BlobCount(), blobCountBefore)
+
+	//unknown manifests are reported as sql.ErrNoRows
+	_, err = p.CopyManifest(account, devRepo, prodRepo, test.GenerateImage(test.GenerateExampleLayer(3)).Manifest.Digest, "", actx)
+	assert.DeepEqual(t, "error for unknown manifest", err, sql.ErrNoRows)
+}
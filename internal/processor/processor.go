@@ -20,6 +20,8 @@
 package processor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
@@ -42,6 +44,11 @@ type Processor struct {
 	icd         keppel.InboundCacheDriver
 	auditor     keppel.Auditor
 	repoClients map[string]*client.RepoClient //key = account name
+	//used as the parent for tracing spans, see WithContext()
+	ctx context.Context
+	//if not zero, storage reads during manifest validation are aborted after
+	//this long, see WithStorageReadTimeout()
+	storageReadTimeout time.Duration
 
 	//non-pure functions that can be replaced by deterministic doubles for unit tests
 	timeNow           func() time.Time
@@ -50,7 +57,7 @@ type Processor struct {
 
 // New creates a new Processor.
 func New(cfg keppel.Configuration, db *keppel.DB, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, auditor keppel.Auditor) *Processor {
-	return &Processor{cfg, db, sd, icd, auditor, make(map[string]*client.RepoClient), time.Now, keppel.GenerateStorageID}
+	return &Processor{cfg, db, sd, icd, auditor, make(map[string]*client.RepoClient), context.Background(), 0, time.Now, keppel.GenerateStorageID}
 }
 
 // OverrideTimeNow replaces time.Now with a test double.
@@ -65,6 +72,63 @@ func (p *Processor) OverrideGenerateStorageID(generateStorageID func() string) *
 	return p
 }
 
+// WithContext sets the context that the tracing spans of this Processor are
+// attached to. This is usually the context of the HTTP request that is being
+// served.
+func (p *Processor) WithContext(ctx context.Context) *Processor {
+	p.ctx = ctx
+	return p
+}
+
+// WithStorageReadTimeout sets how long ValidateExistingManifest() and
+// ValidateExistingManifestStreaming() wait for each read from the storage
+// before giving up with ErrStorageReadTimeout. A zero value disables the
+// timeout.
+func (p *Processor) WithStorageReadTimeout(timeout time.Duration) *Processor {
+	p.storageReadTimeout = timeout
+	return p
+}
+
+var (
+	//ErrStorageReadTimeout is returned from Processor.ValidateExistingManifest()
+	//and Processor.ValidateExistingManifestStreaming() when reading from the
+	//storage takes longer than the configured timeout.
+	ErrStorageReadTimeout = errors.New("timed out while reading from storage")
+)
+
+// Runs the action callback with a context that expires after the configured
+// storage read timeout. The action must pass this context to all storage
+// reads (see keppel.ContextReader), so that they are aborted when the timeout
+// expires. In that case, ErrStorageReadTimeout is returned.
+func (p *Processor) withStorageReadTimeout(action func(ctx context.Context) error) error {
+	if p.storageReadTimeout <= 0 {
+		return action(p.ctx)
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, p.storageReadTimeout)
+	defer cancel()
+	err := action(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		//NOTE: We do not look at `err` itself here since drivers and parsers
+		//might not preserve the original context error when wrapping it.
+		return fmt.Errorf("%w (timeout = %s)", ErrStorageReadTimeout, p.storageReadTimeout)
+	}
+	return err
+}
+
+// Runs the action callback inside a tracing span with the given name. The
+// action receives a copy of this Processor whose context contains the new
+// span, so that spans started through it are children of this span. (The
+// receiver itself is not modified, since it may be in use concurrently.)
+func (p *Processor) traced(name string, action func(*Processor) error) error {
+	ctx, span := p.cfg.Tracing().StartSpan(p.ctx, name)
+	inner := *p
+	inner.ctx = ctx
+	err := action(&inner)
+	span.End(err)
+	return err
+}
+
 // WithLowlevelAccess lets the caller access the low-level interfaces wrapped by
 // this Processor instance. The existence of this method means that the
 // low-level interfaces are basically public, but having to use this method
@@ -82,6 +146,12 @@ func (p *Processor) WithLowlevelAccess(action func(*keppel.DB, keppel.StorageDri
 // committed.  If it returns an error or panics, the transaction will be rolled
 // back.
 func (p *Processor) insideTransaction(action func(*gorp.Transaction) error) error {
+	return p.traced("db.Transaction", func(p *Processor) error {
+		return p.insideTransactionUntraced(action)
+	})
+}
+
+func (p *Processor) insideTransactionUntraced(action func(*gorp.Transaction) error) error {
 	tx, err := p.db.Begin()
 	if err != nil {
 		return err
@@ -115,13 +185,10 @@ func (p *Processor) insideTransaction(action func(*gorp.Transaction) error) erro
 // Returns nil if and only if the user can push another manifest.
 func (p *Processor) checkQuotaForManifestPush(account keppel.Account) error {
 	//check if user has enough quota to push a manifest
-	quotas, err := keppel.FindQuotas(p.db, account.AuthTenantID)
+	quotas, err := keppel.FindQuotasOrDefault(p.db, account.AuthTenantID)
 	if err != nil {
 		return err
 	}
-	if quotas == nil {
-		quotas = keppel.DefaultQuotas(account.AuthTenantID)
-	}
 	manifestUsage, err := quotas.GetManifestUsage(p.db)
 	if err != nil {
 		return err
@@ -152,11 +219,13 @@ func (p *Processor) getRepoClientForUpstream(account keppel.Account, repo keppel
 		}
 
 		c := &client.RepoClient{
-			Scheme:   "https",
-			Host:     peer.HostName,
-			RepoName: repo.FullName(),
-			UserName: "replication@" + p.cfg.APIPublicHostname,
-			Password: peer.OurPassword,
+			Scheme:     "https",
+			Host:       peer.HostName,
+			RepoName:   repo.FullName(),
+			UserName:   "replication@" + p.cfg.APIPublicHostname,
+			Password:   peer.OurPassword,
+			HTTPClient: p.cfg.HTTPClientForPeers(),
+			RateLimits: p.cfg.UpstreamRateLimits,
 		}
 		p.repoClients[repo.FullName()] = c
 		return c, nil
@@ -164,9 +233,10 @@ func (p *Processor) getRepoClientForUpstream(account keppel.Account, repo keppel
 
 	if account.ExternalPeerURL != "" {
 		c := &client.RepoClient{
-			Scheme:   "https",
-			UserName: account.ExternalPeerUserName,
-			Password: account.ExternalPeerPassword,
+			Scheme:     "https",
+			UserName:   account.ExternalPeerUserName,
+			Password:   account.ExternalPeerPassword,
+			RateLimits: p.cfg.UpstreamRateLimits,
 		}
 		if strings.Contains(account.ExternalPeerURL, "/") {
 			fields := strings.SplitN(account.ExternalPeerURL, "/", 2)
@@ -0,0 +1,226 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// After a failed webhook delivery, the delivery is retried after waiting for
+// each of these durations in turn.
+var webhookRetryDelays = []time.Duration{
+	1 * time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+}
+
+// How many webhook deliveries can be waiting for a worker. When the queue is
+// full (because receivers are slow or unavailable), further events are
+// dropped instead of piling up in memory.
+const webhookQueueSize = 1000
+
+type webhookDelivery struct {
+	URL     string
+	Secret  string
+	Payload []byte
+}
+
+var webhookQueue = make(chan webhookDelivery, webhookQueueSize)
+
+// Sends the given event to the configured event sinks, as well as to the
+// webhook of the respective account (if any).
+func (p *Processor) emitEvent(event keppel.Event) {
+	keppel.MultiEventSink{p.cfg.Events(), webhookEventSink{}}.Emit(event)
+}
+
+// webhookEventSink is a keppel.EventSink that sends manifest events to the
+// webhook of the respective account. Delivery happens in the background (see
+// RunWebhookDeliveryWorkers), so that pushes and deletions are not slowed
+// down by slow or unavailable webhook receivers.
+type webhookEventSink struct{}
+
+// Emit implements the keppel.EventSink interface.
+func (webhookEventSink) Emit(event keppel.Event) {
+	var (
+		account keppel.Account
+		payload keppel.WebhookEvent
+	)
+	switch e := event.(type) {
+	case keppel.ManifestPushedEvent:
+		account = e.Account
+		payload = keppel.WebhookEvent{
+			Action:     keppel.WebhookActionPush,
+			Account:    e.Account.Name,
+			Repository: e.Repository.FullName(),
+			Digest:     e.Digest,
+			Tag:        e.Tag,
+			Timestamp:  e.PushedAt.Unix(),
+		}
+	case keppel.ManifestDeletedEvent:
+		account = e.Account
+		payload = keppel.WebhookEvent{
+			Action:     keppel.WebhookActionDelete,
+			Account:    e.Account.Name,
+			Repository: e.Repository.FullName(),
+			Digest:     e.Digest,
+			Tag:        e.Tag,
+			Timestamp:  e.DeletedAt.Unix(),
+		}
+	default:
+		return
+	}
+	if account.WebhookURL == "" {
+		return
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		logg.Error("cannot serialize webhook payload for account %s: %s", account.Name, err.Error())
+		return
+	}
+	select {
+	case webhookQueue <- webhookDelivery{account.WebhookURL, account.WebhookSecret, payloadBytes}:
+	default:
+		logg.Error("dropping webhook delivery to %s for account %s: delivery queue is full", account.WebhookURL, account.Name)
+	}
+}
+
+// RunWebhookDeliveryWorkers delivers the webhook events emitted by all
+// Processor instances in this process, using the given number of concurrent
+// workers. It blocks until the given context expires. Deliveries that are
+// still queued or being retried at that point are abandoned.
+func RunWebhookDeliveryWorkers(ctx context.Context, cfg keppel.Configuration, workerCount int) {
+	client := newWebhookHTTPClient(cfg.WebhookAllowedHosts)
+	var wg sync.WaitGroup
+	for i := 0; i < workerCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-webhookQueue:
+					deliverWebhook(ctx, client, cfg.WebhookAllowedHosts, d)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Builds the HTTP client for webhook deliveries. Unless the operator
+// restricted webhooks to an explicit list of hosts, connections to internal
+// addresses are refused. This is checked when connecting (instead of when
+// validating the URL) since hostnames can resolve to anything.
+func newWebhookHTTPClient(allowedHosts []string) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if len(allowedHosts) == 0 {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || keppel.IsForbiddenWebhookAddress(ip) {
+				return fmt.Errorf("refusing to connect to %s", address)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	//a proxy would defeat the address check above
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   10 * time.Second,
+		//redirects are not followed since they could point anywhere
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func deliverWebhook(ctx context.Context, client *http.Client, allowedHosts []string, d webhookDelivery) {
+	//the webhook URL was checked when it was configured, but the list of
+	//allowed hosts might have changed since then
+	u, err := url.Parse(d.URL)
+	if err == nil {
+		err = keppel.CheckWebhookURL(u, allowedHosts)
+	}
+	if err != nil {
+		logg.Error("not delivering webhook to %s: %s", d.URL, err.Error())
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := sendWebhookRequest(ctx, client, d)
+		if err == nil {
+			return
+		}
+		if attempt >= len(webhookRetryDelays) {
+			logg.Error("giving up on webhook delivery to %s after %d attempts: %s", d.URL, attempt+1, err.Error())
+			return
+		}
+		logg.Info("webhook delivery to %s failed (will retry in %s): %s", d.URL, webhookRetryDelays[attempt], err.Error())
+		select {
+		case <-ctx.Done():
+			logg.Error("abandoning webhook delivery to %s because of shutdown", d.URL)
+			return
+		case <-time.After(webhookRetryDelays[attempt]):
+		}
+	}
+}
+
+func sendWebhookRequest(ctx context.Context, client *http.Client, d webhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.Secret != "" {
+		req.Header.Set(keppel.WebhookSignatureHeader, keppel.SignWebhookPayload(d.Secret, d.Payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("expected 2xx response, but got %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package processor_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+type webhookDelivery struct {
+	Payload   string
+	Signature string
+}
+
+func newWebhookReceiver(t *testing.T) (chan webhookDelivery, *httptest.Server) {
+	deliveries := make(chan webhookDelivery, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err.Error())
+		}
+		deliveries <- webhookDelivery{string(body), r.Header.Get(keppel.WebhookSignatureHeader)}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return deliveries, server
+}
+
+func TestWebhookOnManifestPush(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+
+	deliveries, server := newWebhookReceiver(t)
+	defer server.Close()
+
+	//the test server listens on a loopback address, so it needs to be allowed explicitly
+	cfg := s.Config
+	cfg.WebhookAllowedHosts = []string{"127.0.0.1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go processor.RunWebhookDeliveryWorkers(ctx, cfg, 1)
+
+	_, err := s.DB.Exec(`UPDATE accounts SET webhook_url = $1, webhook_secret = $2 WHERE name = $3`,
+		server.URL, "supersecret", "test1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, *s.Repos[0], "latest")
+
+	var delivery webhookDelivery
+	select {
+	case delivery = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook delivery")
+	}
+
+	var event keppel.WebhookEvent
+	err = json.Unmarshal([]byte(delivery.Payload), &event)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	assert.DeepEqual(t, "webhook payload", event, keppel.WebhookEvent{
+		Action:     keppel.WebhookActionPush,
+		Account:    "test1",
+		Repository: "test1/foo",
+		Digest:     image.Manifest.Digest.String(),
+		Tag:        "latest",
+		Timestamp:  s.Clock.Now().Unix(),
+	})
+
+	mac := hmac.New(sha256.New, []byte("supersecret"))
+	mac.Write([]byte(delivery.Payload))
+	assert.DeepEqual(t, "webhook signature", delivery.Signature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	//pushing the same manifest again does not generate another event
+	image.MustUpload(t, s, *s.Repos[0], "latest")
+	select {
+	case delivery = <-deliveries:
+		t.Errorf("unexpected webhook delivery: %s", delivery.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookToLoopbackAddressIsRefused(t *testing.T) {
+	s := test.NewSetup(t,
+		test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: "test1authtenant"}),
+		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+		test.WithQuotas,
+	)
+
+	deliveries, server := newWebhookReceiver(t)
+	defer server.Close()
+
+	//without an explicit list of allowed hosts, the delivery workers refuse to
+	//connect to internal addresses like the loopback address of the test server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go processor.RunWebhookDeliveryWorkers(ctx, s.Config, 1)
+
+	_, err := s.DB.Exec(`UPDATE accounts SET webhook_url = $1 WHERE name = $2`, server.URL, "test1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, *s.Repos[0], "latest")
+	select {
+	case delivery := <-deliveries:
+		t.Errorf("unexpected webhook delivery: %s", delivery.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
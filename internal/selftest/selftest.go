@@ -0,0 +1,225 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+// Package selftest contains a smoke test for Keppel deployments, which
+// exercises the most important code paths (account management, token
+// issuance, storage and DB) from the outside, i.e. through the public APIs.
+package selftest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/sapcc/keppel/internal/client"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// RepoName is the name of the repository that the self-test pushes its image into.
+const RepoName = "selftest"
+
+// StepResult is the result of one step of the self-test.
+type StepResult struct {
+	Name string
+	//nil if the step was successful
+	Error error
+	//Skipped is true if the step was not run because a previous step failed.
+	Skipped bool
+	//Note may contain additional information about a successful step.
+	Note string
+}
+
+// Passed returns whether the step ran successfully.
+func (r StepResult) Passed() bool {
+	return !r.Skipped && r.Error == nil
+}
+
+// Run performs the self-test against the Keppel API that the given auth
+// driver is connected to. It creates an account with the given name, pushes a
+// minimal image into it, pulls and validates the image, and finally deletes
+// the image and the account again. Cleanup steps are also attempted if
+// previous steps failed, but only if they are able to run at all.
+func Run(ad client.AuthDriver, accountName string) []StepResult {
+	apiUser, apiPassword := ad.CredentialsForRegistryAPI()
+	st := selfTest{
+		AuthDriver:  ad,
+		AccountName: accountName,
+		RepoClient: &client.RepoClient{
+			Scheme:   ad.ServerScheme(),
+			Host:     ad.ServerHost(),
+			RepoName: accountName + "/" + RepoName,
+			UserName: apiUser,
+			Password: apiPassword,
+		},
+	}
+
+	var results []StepResult
+	runStep := func(name string, canRun bool, action func() (string, error)) bool {
+		if !canRun {
+			results = append(results, StepResult{Name: name, Skipped: true})
+			return false
+		}
+		note, err := action()
+		results = append(results, StepResult{Name: name, Error: err, Note: note})
+		return err == nil
+	}
+
+	accountCreated := runStep("create account", true, st.CreateAccount)
+	imagePushed := runStep("push image", accountCreated, st.PushImage)
+	imagePulled := runStep("pull image", imagePushed, st.PullImage)
+	runStep("validate image", imagePulled, st.ValidateImage)
+	imageDeleted := runStep("delete image", imagePushed, st.DeleteImage)
+	runStep("delete account", accountCreated && (imageDeleted || !imagePushed), st.DeleteAccount)
+	return results
+}
+
+type selfTest struct {
+	AuthDriver  client.AuthDriver
+	AccountName string
+	RepoClient  *client.RepoClient
+	//filled by PushImage()
+	ManifestDigest digest.Digest
+}
+
+func (st *selfTest) CreateAccount() (string, error) {
+	//since the account is deleted at the end of the self-test, we must not take
+	//over an account that existed before
+	//(if we cannot see the account, it either does not exist or belongs to a
+	//different auth tenant, in which case the PUT below will fail)
+	statusCode, _, err := st.doRequest(http.MethodGet, "/keppel/v1/accounts/"+st.AccountName, nil)
+	if err != nil {
+		return "", err
+	}
+	if statusCode == http.StatusOK {
+		return "", fmt.Errorf("account %q already exists, but the self-test needs an account of its own (since it deletes the account afterwards)", st.AccountName)
+	}
+	return "", st.putAccount(false)
+}
+
+func (st *selfTest) PushImage() (string, error) {
+	manifestDigest, err := st.RepoClient.UploadMinimalImage("latest")
+	if err != nil {
+		return "", err
+	}
+	st.ManifestDigest = manifestDigest
+	return "pushed " + manifestDigest.String(), nil
+}
+
+func (st *selfTest) PullImage() (string, error) {
+	contents, _, err := st.RepoClient.DownloadManifest(keppel.ManifestReference{Tag: "latest"}, nil)
+	if err != nil {
+		return "", err
+	}
+	actualDigest := digest.Canonical.FromBytes(contents)
+	if actualDigest != st.ManifestDigest {
+		return "", fmt.Errorf("expected to pull manifest %s, but got %s", st.ManifestDigest, actualDigest)
+	}
+	return "", nil
+}
+
+func (st *selfTest) ValidateImage() (string, error) {
+	return "", st.RepoClient.ValidateManifest(keppel.ManifestReference{Digest: st.ManifestDigest}, nil, nil)
+}
+
+func (st *selfTest) DeleteImage() (string, error) {
+	path := fmt.Sprintf("/keppel/v1/accounts/%s/repositories/%s/_manifests/%s", st.AccountName, RepoName, st.ManifestDigest)
+	_, err := st.sendRequest(http.MethodDelete, path, nil, http.StatusNoContent)
+	return "", err
+}
+
+func (st *selfTest) DeleteAccount() (string, error) {
+	//accounts can only be deleted while in maintenance
+	err := st.putAccount(true)
+	if err != nil {
+		return "", err
+	}
+
+	path := "/keppel/v1/accounts/" + st.AccountName
+	respBody, err := st.sendRequest(http.MethodDelete, path, nil, http.StatusNoContent, http.StatusConflict)
+	if err != nil || len(respBody) == 0 {
+		return "", err
+	}
+
+	//a 409 response is fine if we only need to wait for the janitor to sweep the blobs of this account
+	var data struct {
+		Error              string          `json:"error"`
+		RemainingManifests json.RawMessage `json:"remaining_manifests"`
+		RemainingBlobs     *struct {
+			Count uint64 `json:"count"`
+		} `json:"remaining_blobs"`
+	}
+	err = json.Unmarshal(respBody, &data)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse response from DELETE %s: %w", path, err)
+	}
+	if data.Error != "" || len(data.RemainingManifests) > 0 || data.RemainingBlobs == nil {
+		return "", fmt.Errorf("DELETE %s failed: %s", path, string(respBody))
+	}
+	return fmt.Sprintf("%d blobs remaining; the account will be deleted once the janitor has swept them (retry the deletion then)", data.RemainingBlobs.Count), nil
+}
+
+func (st *selfTest) putAccount(inMaintenance bool) error {
+	reqBody := map[string]interface{}{
+		"account": map[string]interface{}{
+			"auth_tenant_id": st.AuthDriver.CurrentAuthTenantID(),
+			"in_maintenance": inMaintenance,
+		},
+	}
+	reqBodyBytes, _ := json.Marshal(reqBody) //nolint:errcheck
+	_, err := st.sendRequest(http.MethodPut, "/keppel/v1/accounts/"+st.AccountName, reqBodyBytes, http.StatusOK)
+	return err
+}
+
+// Sends a request to the Keppel API and returns the response body, or an
+// error if the response has an unexpected status code.
+func (st *selfTest) sendRequest(method, path string, body []byte, expectedStatusCodes ...int) ([]byte, error) {
+	statusCode, respBody, err := st.doRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range expectedStatusCodes {
+		if statusCode == code {
+			return respBody, nil
+		}
+	}
+	return nil, fmt.Errorf("%s %s returned %d %s: %s", method, path, statusCode, http.StatusText(statusCode), string(bytes.TrimSpace(respBody)))
+}
+
+// Sends a request to the Keppel API and returns the status code and body of
+// the response.
+func (st *selfTest) doRequest(method, path string, body []byte) (statusCode int, respBody []byte, err error) {
+	req, err := http.NewRequest(method, path, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := st.AuthDriver.SendHTTPRequest(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err = io.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, err
+}
@@ -0,0 +1,170 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package selftest_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/selftest"
+	"github.com/sapcc/keppel/internal/test"
+)
+
+const (
+	authTenantID = "test1authtenant"
+	userName     = "correctusername"
+	password     = "correctpassword"
+)
+
+// clientAuthDriver is a client.AuthDriver that talks to the Keppel API from a test.Setup.
+type clientAuthDriver struct {
+	Setup test.Setup
+	Perms string
+}
+
+func (d clientAuthDriver) MatchesEnvironment() bool    { return false }
+func (d clientAuthDriver) Connect() error              { return nil }
+func (d clientAuthDriver) CurrentAuthTenantID() string { return authTenantID }
+func (d clientAuthDriver) ServerHost() string          { return d.Setup.Config.APIPublicHostname }
+func (d clientAuthDriver) ServerScheme() string        { return "https" }
+
+func (d clientAuthDriver) SendHTTPRequest(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = d.ServerScheme()
+	req.URL.Host = d.ServerHost()
+	req.Header.Set("X-Test-Perms", d.Perms)
+	return http.DefaultClient.Do(req)
+}
+
+func (d clientAuthDriver) CredentialsForRegistryAPI() (string, string) {
+	return userName, password
+}
+
+func TestSelfTest(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		//the account "test1" is only there to make WithQuotas set up quotas for our auth tenant
+		s := test.NewSetup(t,
+			test.WithKeppelAPI,
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+			test.WithQuotas,
+		)
+		perms := strings.Join([]string{
+			"view:" + authTenantID,
+			"change:" + authTenantID,
+			"pull:" + authTenantID,
+			"push:" + authTenantID,
+			"delete:" + authTenantID,
+		}, ",")
+		s.AD.ExpectedUserName = userName
+		s.AD.ExpectedPassword = password
+		s.AD.GrantedPermissions = perms
+
+		results := selftest.Run(clientAuthDriver{s, perms}, "selftest1")
+		expectedSteps := []string{"create account", "push image", "pull image", "validate image", "delete image", "delete account"}
+		if len(results) != len(expectedSteps) {
+			t.Fatalf("expected %d steps, but got %d", len(expectedSteps), len(results))
+		}
+		for idx, result := range results {
+			if result.Name != expectedSteps[idx] {
+				t.Errorf("expected step %d to be %q, but got %q", idx, expectedSteps[idx], result.Name)
+			}
+			if !result.Passed() {
+				t.Errorf("expected step %q to pass, but got skipped = %t, error = %v", result.Name, result.Skipped, result.Error)
+			}
+		}
+
+		//the manifest is gone, and the account is in maintenance and waiting for its blobs to be swept
+		manifestCount, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests`)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if manifestCount != 0 {
+			t.Errorf("expected all manifests to be deleted, but found %d", manifestCount)
+		}
+		account, err := keppel.FindAccount(s.DB, "selftest1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if account == nil || !account.InMaintenance {
+			t.Errorf("expected account to be in maintenance and awaiting deletion, but got %#v", account)
+		}
+	})
+}
+
+func TestSelfTestReportsFailures(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		s := test.NewSetup(t,
+			test.WithKeppelAPI,
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+			test.WithQuotas,
+		)
+
+		//without the "change" permission, the account cannot be created, so all other steps are skipped
+		perms := "view:" + authTenantID
+		results := selftest.Run(clientAuthDriver{s, perms}, "selftest1")
+		if results[0].Error == nil {
+			t.Error("expected account creation to fail, but it succeeded")
+		}
+		for _, result := range results[1:] {
+			if !result.Skipped {
+				t.Errorf("expected step %q to be skipped, but it was not", result.Name)
+			}
+		}
+	})
+}
+
+func TestSelfTestRefusesExistingAccount(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		s := test.NewSetup(t,
+			test.WithKeppelAPI,
+			test.WithAccount(keppel.Account{Name: "test1", AuthTenantID: authTenantID}),
+			test.WithQuotas,
+		)
+		perms := strings.Join([]string{
+			"view:" + authTenantID,
+			"change:" + authTenantID,
+			"pull:" + authTenantID,
+			"push:" + authTenantID,
+			"delete:" + authTenantID,
+		}, ",")
+		s.AD.ExpectedUserName = userName
+		s.AD.ExpectedPassword = password
+		s.AD.GrantedPermissions = perms
+
+		//the self-test must not take over (and then delete) an existing account
+		results := selftest.Run(clientAuthDriver{s, perms}, "test1")
+		if results[0].Error == nil || !strings.Contains(results[0].Error.Error(), `account "test1" already exists`) {
+			t.Errorf("expected account creation to fail because the account exists, but got error = %v", results[0].Error)
+		}
+		for _, result := range results[1:] {
+			if !result.Skipped {
+				t.Errorf("expected step %q to be skipped, but it was not", result.Name)
+			}
+		}
+
+		account, err := keppel.FindAccount(s.DB, "test1")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if account == nil || account.InMaintenance {
+			t.Errorf("expected existing account to be left alone, but got %#v", account)
+		}
+	})
+}
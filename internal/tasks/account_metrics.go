@@ -0,0 +1,133 @@
+/******************************************************************************
+*
+*  Copyright 2023 SAP SE
+*
+*  Licensed under the Apache License, Version 2.0 (the "License");
+*  you may not use this file except in compliance with the License.
+*  You may obtain a copy of the License at
+*
+*      http://www.apache.org/licenses/LICENSE-2.0
+*
+*  Unless required by applicable law or agreed to in writing, software
+*  distributed under the License is distributed on an "AS IS" BASIS,
+*  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+*  See the License for the specific language governing permissions and
+*  limitations under the License.
+*
+******************************************************************************/
+
+package tasks
+
+import (
+	"database/sql"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	imagespec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sapcc/go-bits/sqlext"
+
+	"github.com/sapcc/keppel/internal/clair"
+)
+
+// query that aggregates manifests per account and media type class (either
+// "list" for image lists/indexes or "image" for everything else)
+var accountManifestMetricsQuery = sqlext.SimplifyWhitespace(`
+	SELECT r.account_name,
+		CASE WHEN m.media_type IN ($1, $2) THEN 'list' ELSE 'image' END AS media_type_class,
+		COUNT(*), COALESCE(SUM(m.size_bytes), 0)
+	FROM manifests m
+	JOIN repos r ON m.repo_id = r.id
+	WHERE m.deleted_at IS NULL
+	GROUP BY r.account_name, media_type_class
+`)
+
+var accountBlobMetricsQuery = sqlext.SimplifyWhitespace(`
+	SELECT account_name, COUNT(*) FROM blobs GROUP BY account_name
+`)
+
+// query that counts manifests per account whose vulnerability status has not
+// progressed beyond Pending or Unknown since they were pushed a long time ago
+var accountStaleVulnStatusMetricsQuery = sqlext.SimplifyWhitespace(`
+	SELECT r.account_name, vi.status, COUNT(*)
+	FROM vuln_info vi
+	JOIN manifests m ON m.repo_id = vi.repo_id AND m.digest = vi.digest
+	JOIN repos r ON m.repo_id = r.id
+	WHERE vi.status IN ($1, $2) AND m.pushed_at < $3 AND m.deleted_at IS NULL
+	GROUP BY r.account_name, vi.status
+`)
+
+// RefreshAccountMetrics recomputes the per-account gauges for manifest counts,
+// manifest sizes, blob counts and stale vulnerability statuses. These are computed by the janitor in regular
+// intervals instead of on each scrape, since the respective queries are
+// rather expensive on large databases.
+func (j *Janitor) RefreshAccountMetrics() error {
+	type manifestMetrics struct {
+		AccountName    string
+		MediaTypeClass string
+		Count          uint64
+		SizeBytes      uint64
+	}
+	var allManifestMetrics []manifestMetrics
+	err := sqlext.ForeachRow(j.db, accountManifestMetricsQuery, []any{manifestlist.MediaTypeManifestList, imagespec.MediaTypeImageIndex}, func(rows *sql.Rows) error {
+		var m manifestMetrics
+		err := rows.Scan(&m.AccountName, &m.MediaTypeClass, &m.Count, &m.SizeBytes)
+		allManifestMetrics = append(allManifestMetrics, m)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	blobCounts := make(map[string]uint64)
+	err = sqlext.ForeachRow(j.db, accountBlobMetricsQuery, nil, func(rows *sql.Rows) error {
+		var (
+			accountName string
+			count       uint64
+		)
+		err := rows.Scan(&accountName, &count)
+		blobCounts[accountName] = count
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	//stale vulnerability statuses are only reported when vulnerability scanning
+	//is enabled (otherwise all manifests would stay Pending forever)
+	type staleVulnStatusMetrics struct {
+		AccountName string
+		Status      clair.VulnerabilityStatus
+		Count       uint64
+	}
+	var allStaleVulnStatusMetrics []staleVulnStatusMetrics
+	if j.cfg.ClairClient != nil {
+		staleThreshold := j.timeNow().Add(-j.staleVulnStatusAge)
+		queryArgs := []any{clair.PendingVulnerabilityStatus, clair.UnknownSeverity, staleThreshold}
+		err = sqlext.ForeachRow(j.db, accountStaleVulnStatusMetricsQuery, queryArgs, func(rows *sql.Rows) error {
+			var m staleVulnStatusMetrics
+			err := rows.Scan(&m.AccountName, &m.Status, &m.Count)
+			allStaleVulnStatusMetrics = append(allStaleVulnStatusMetrics, m)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	//only update the gauges once all queries have succeeded, and drop series
+	//for accounts that have been deleted in the meantime
+	accountManifestsGauge.Reset()
+	accountManifestsSizeGauge.Reset()
+	accountBlobsGauge.Reset()
+	accountStaleVulnStatusGauge.Reset()
+	for _, m := range allManifestMetrics {
+		accountManifestsGauge.WithLabelValues(m.AccountName, m.MediaTypeClass).Set(float64(m.Count))
+		accountManifestsSizeGauge.WithLabelValues(m.AccountName, m.MediaTypeClass).Set(float64(m.SizeBytes))
+	}
+	for accountName, count := range blobCounts {
+		accountBlobsGauge.WithLabelValues(accountName).Set(float64(count))
+	}
+	for _, m := range allStaleVulnStatusMetrics {
+		accountStaleVulnStatusGauge.WithLabelValues(m.AccountName, string(m.Status)).Set(float64(m.Count))
+	}
+	return nil
+}
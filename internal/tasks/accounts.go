@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
@@ -36,6 +37,8 @@ var accountAnnouncementSearchQuery = sqlext.SimplifyWhitespace(`
 	ORDER BY next_federation_announcement_at IS NULL DESC, next_federation_announcement_at ASC
 	-- only one account at a time
 	LIMIT 1
+	-- prevent other janitors from claiming the same account concurrently (NO KEY allows inserting rows that reference this one)
+	FOR NO KEY UPDATE SKIP LOCKED
 `)
 
 var accountAnnouncementDoneQuery = sqlext.SimplifyWhitespace(`
@@ -58,8 +61,11 @@ func (j *Janitor) AnnounceNextAccountToFederation() (returnErr error) {
 		}
 	}()
 
-	//find account to announce
-	err := j.db.SelectOne(&account, accountAnnouncementSearchQuery, j.timeNow())
+	//find account to announce, and claim it by scheduling the next announcement
+	err := j.claimNextRow(&account, accountAnnouncementSearchQuery, []any{j.timeNow()}, func(tx *gorp.Transaction) error {
+		_, err := tx.Exec(accountAnnouncementDoneQuery, account.Name, j.timeNow().Add(j.addJitter(1*time.Hour)))
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no accounts to announce to federation - slowing down...")
@@ -74,7 +80,5 @@ func (j *Janitor) AnnounceNextAccountToFederation() (returnErr error) {
 		//accept that it can fail and move on regardless
 		logg.Error("cannot announce account %q to federation: %s", account.Name, err.Error())
 	}
-
-	_, err = j.db.Exec(accountAnnouncementDoneQuery, account.Name, j.timeNow().Add(j.addJitter(1*time.Hour)))
-	return err
+	return nil
 }
@@ -20,11 +20,15 @@ package tasks
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sapcc/go-bits/assert"
 
+	"github.com/sapcc/keppel/internal/clair"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/test"
 )
@@ -78,3 +82,85 @@ func expectAccountsAnnouncedJustNow(t *testing.T, s test.Setup, accounts ...kepp
 	//reset for next test step
 	s.FD.RecordedAccounts = nil
 }
+
+func TestRefreshAccountMetrics(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//seed two images and an image list containing both
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+		test.GenerateImage(test.GenerateExampleLayer(2)),
+	}
+	for _, image := range images {
+		image.MustUpload(t, s, fooRepoRef, "")
+	}
+	imageList := test.GenerateImageList(images[0], images[1])
+	imageList.MustUpload(t, s, fooRepoRef, "")
+
+	expectSuccess(t, j.RefreshAccountMetrics())
+	actual := gatherGauges(t, "keppel_account_")
+
+	expected := map[string]float64{
+		"keppel_account_manifests account=test1 media_type_class=image":            2,
+		"keppel_account_manifests account=test1 media_type_class=list":             1,
+		"keppel_account_manifests_size_bytes account=test1 media_type_class=image": float64(images[0].SizeBytes() + images[1].SizeBytes()),
+		"keppel_account_manifests_size_bytes account=test1 media_type_class=list":  float64(imageList.SizeBytes()),
+		"keppel_account_blobs account=test1":                                       4, //two layers and two configs
+	}
+	assert.DeepEqual(t, "account metrics", actual, expected)
+}
+
+func TestRefreshAccountMetricsReportsStaleVulnerabilityStatuses(t *testing.T) {
+	j, s := setup(t, test.WithClairDouble)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//seed three images that will be old by the time we refresh the metrics...
+	images := []test.Image{
+		test.GenerateImage(test.GenerateExampleLayer(1)),
+		test.GenerateImage(test.GenerateExampleLayer(2)),
+		test.GenerateImage(test.GenerateExampleLayer(3)),
+	}
+	for _, image := range images {
+		image.MustUpload(t, s, fooRepoRef, "")
+	}
+	//...one of which stays Pending, while the others have a vulnerability report
+	mustExec(t, s.DB, `UPDATE vuln_info SET status = $1 WHERE digest = $2`, clair.UnknownSeverity, images[1].Manifest.Digest.String())
+	mustExec(t, s.DB, `UPDATE vuln_info SET status = $1 WHERE digest = $2`, clair.CleanSeverity, images[2].Manifest.Digest.String())
+
+	//a recently pushed image is not stale yet, even though it is Pending
+	s.Clock.StepBy(25 * time.Hour)
+	test.GenerateImage(test.GenerateExampleLayer(4)).MustUpload(t, s, fooRepoRef, "")
+
+	expectSuccess(t, j.RefreshAccountMetrics())
+	assert.DeepEqual(t, "stale vulnerability status metrics", gatherGauges(t, "keppel_account_stale_"), map[string]float64{
+		"keppel_account_stale_vulnerability_statuses account=test1 status=Pending": 1,
+		"keppel_account_stale_vulnerability_statuses account=test1 status=Unknown": 1,
+	})
+
+	//when the configured age is not reached yet, nothing is reported
+	j.SetStaleVulnerabilityStatusAge(48 * time.Hour)
+	expectSuccess(t, j.RefreshAccountMetrics())
+	assert.DeepEqual(t, "stale vulnerability status metrics", gatherGauges(t, "keppel_account_stale_"), map[string]float64{})
+}
+
+// Collects all series of the gauges whose names start with the given prefix.
+func gatherGauges(t *testing.T, prefix string) map[string]float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	mustDo(t, err)
+	result := make(map[string]float64)
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), prefix) {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := family.GetName()
+			for _, label := range metric.GetLabel() {
+				key += fmt.Sprintf(" %s=%s", label.GetName(), label.GetValue())
+			}
+			result[key] = metric.GetGauge().GetValue()
+		}
+	}
+	return result
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
@@ -41,6 +42,8 @@ var blobMountSweepSearchQuery = sqlext.SimplifyWhitespace(`
 	ORDER BY next_blob_mount_sweep_at IS NULL DESC, next_blob_mount_sweep_at ASC
 	-- only one repo at a time
 	LIMIT 1
+	-- prevent other janitors from claiming the same repo concurrently (NO KEY allows inserting rows that reference this one)
+	FOR NO KEY UPDATE SKIP LOCKED
 `)
 
 var blobMountMarkQuery = sqlext.SimplifyWhitespace(`
@@ -88,8 +91,11 @@ func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 		}
 	}()
 
-	//find repo to sweep
-	err := j.db.SelectOne(&repo, blobMountSweepSearchQuery, j.timeNow())
+	//find repo to sweep, and claim it by scheduling the next sweep
+	err := j.claimNextRow(&repo, blobMountSweepSearchQuery, []any{j.timeNow()}, func(tx *gorp.Transaction) error {
+		_, err := tx.Exec(blobMountSweepDoneQuery, repo.ID, j.timeNow().Add(j.addJitter(1*time.Hour)))
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no blob mounts to sweep - slowing down...")
@@ -97,6 +103,7 @@ func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 		}
 		return err
 	}
+	defer j.restoreScheduleOnFailure(&returnErr, blobMountSweepDoneQuery, repo.ID, repo.NextBlobMountSweepAt)
 
 	//allow next pass in 1 hour to delete the newly marked blob mounts, but use a
 	//slighly earlier cut-off time to account for the marking taking some time
@@ -127,7 +134,5 @@ func (j *Janitor) SweepBlobMountsInNextRepo() (returnErr error) {
 	if rowsDeleted > 0 {
 		logg.Info("%d blob mounts sweeped in repo %s", rowsDeleted, repo.FullName())
 	}
-
-	_, err = j.db.Exec(blobMountSweepDoneQuery, repo.ID, j.timeNow().Add(j.addJitter(1*time.Hour)))
-	return err
+	return nil
 }
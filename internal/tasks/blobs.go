@@ -23,10 +23,12 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
 )
 
 var blobSweepSearchQuery = sqlext.SimplifyWhitespace(`
@@ -36,6 +38,8 @@ var blobSweepSearchQuery = sqlext.SimplifyWhitespace(`
 	ORDER BY next_blob_sweep_at IS NULL DESC, next_blob_sweep_at ASC
 	-- only one account at a time
 	LIMIT 1
+	-- prevent other janitors from claiming the same account concurrently (NO KEY allows inserting rows that reference this one)
+	FOR NO KEY UPDATE SKIP LOCKED
 `)
 
 var blobMarkQuery = sqlext.SimplifyWhitespace(`
@@ -84,8 +88,11 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 		}
 	}()
 
-	//find account to sweep
-	err := j.db.SelectOne(&account, blobSweepSearchQuery, j.timeNow())
+	//find account to sweep, and claim it by scheduling the next sweep
+	err := j.claimNextRow(&account, blobSweepSearchQuery, []any{j.timeNow()}, func(tx *gorp.Transaction) error {
+		_, err := tx.Exec(blobSweepDoneQuery, account.Name, j.timeNow().Add(j.addJitter(1*time.Hour)))
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no blobs to sweep - slowing down...")
@@ -93,6 +100,7 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 		}
 		return err
 	}
+	defer j.restoreScheduleOnFailure(&returnErr, blobSweepDoneQuery, account.Name, account.NextBlobSweepedAt)
 
 	//allow next pass in 1 hour to delete the newly marked blob mounts, but use a
 	//slighly earlier cut-off time to account for the marking taking some time
@@ -140,6 +148,7 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 		if err != nil {
 			return err
 		}
+		processor.ForgetManifestConfig(blob.Digest)
 		if blob.StorageID != "" { //ignore unbacked blobs that were never replicated
 			err = j.sd.DeleteBlob(account, blob.StorageID)
 			if err != nil {
@@ -148,8 +157,7 @@ func (j *Janitor) SweepBlobsInNextAccount() (returnErr error) {
 		}
 	}
 
-	_, err = j.db.Exec(blobSweepDoneQuery, account.Name, j.timeNow().Add(j.addJitter(1*time.Hour)))
-	return err
+	return nil
 }
 
 var validateBlobSearchQuery = sqlext.SimplifyWhitespace(`
@@ -159,6 +167,14 @@ var validateBlobSearchQuery = sqlext.SimplifyWhitespace(`
 		-- oldest blobs first, but always prefer to recheck a failed validation
 	LIMIT 1
 		-- one at a time
+	FOR UPDATE SKIP LOCKED
+		-- prevent other job loops from claiming the same blob concurrently
+`)
+
+// query that claims a blob for validation by bumping its `validated_at`, such
+// that concurrent job loops will not pick it up again
+var claimBlobForValidationQuery = sqlext.SimplifyWhitespace(`
+	UPDATE blobs SET validated_at = $1 WHERE id = $2
 `)
 
 // ValidateNextBlob validates the next blob that has not been validated for more
@@ -178,7 +194,11 @@ func (j *Janitor) ValidateNextBlob() (returnErr error) {
 	var blob keppel.Blob
 	maxSuccessfulValidatedAt := j.timeNow().Add(-7 * 24 * time.Hour)
 	maxFailedValidatedAt := j.timeNow().Add(-10 * time.Minute)
-	err := j.db.SelectOne(&blob, validateBlobSearchQuery, maxSuccessfulValidatedAt, maxFailedValidatedAt)
+	err := j.claimNextRow(&blob, validateBlobSearchQuery, []any{maxSuccessfulValidatedAt, maxFailedValidatedAt},
+		func(tx *gorp.Transaction) error {
+			_, err := tx.Exec(claimBlobForValidationQuery, j.timeNow(), blob.ID)
+			return err
+		})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no blobs to validate - slowing down...")
@@ -212,7 +232,7 @@ func (j *Janitor) ValidateNextBlob() (returnErr error) {
 		_, updateErr := j.db.Exec(`
 			UPDATE blobs SET validated_at = $1, validation_error_message = $2
 			 WHERE account_name = $3 AND digest = $4`,
-			j.timeNow(), err.Error(), account.Name, blob.Digest,
+			j.timeNow(), j.truncateErrorMessage(err.Error()), account.Name, blob.Digest,
 		)
 		if updateErr != nil {
 			err = fmt.Errorf("%s (additional error encountered while recording validation error: %s)", err.Error(), updateErr.Error())
@@ -38,6 +38,9 @@ INSERT INTO manifest_contents (repo_id, digest, content) VALUES (1, 'sha256:edc5
 INSERT INTO manifest_manifest_refs (repo_id, parent_digest, child_digest) VALUES (1, 'sha256:edc51c987fd8b320a7496ca6bd97c9e5534368f8f8ee9d7ede8a489ee93fec18', 'sha256:207a16511ab28a6c3ff0ad6e483ba79fb59a9ebf3721c94e4b91b825bfecf223');
 INSERT INTO manifest_manifest_refs (repo_id, parent_digest, child_digest) VALUES (1, 'sha256:edc51c987fd8b320a7496ca6bd97c9e5534368f8f8ee9d7ede8a489ee93fec18', 'sha256:7cefe08689844ee549c7168fd99cf844a7c6117e09e1b728cdd6a18e4645d8b3');
 
+INSERT INTO manifest_platforms (repo_id, digest, child_digest, os, architecture) VALUES (1, 'sha256:edc51c987fd8b320a7496ca6bd97c9e5534368f8f8ee9d7ede8a489ee93fec18', 'sha256:207a16511ab28a6c3ff0ad6e483ba79fb59a9ebf3721c94e4b91b825bfecf223', 'linux', 'amd64');
+INSERT INTO manifest_platforms (repo_id, digest, child_digest, os, architecture) VALUES (1, 'sha256:edc51c987fd8b320a7496ca6bd97c9e5534368f8f8ee9d7ede8a489ee93fec18', 'sha256:7cefe08689844ee549c7168fd99cf844a7c6117e09e1b728cdd6a18e4645d8b3', 'linux', 'arm');
+
 INSERT INTO manifests (repo_id, digest, media_type, size_bytes, pushed_at, validated_at, last_pulled_at, min_layer_created_at, max_layer_created_at) VALUES (1, 'sha256:0b5b811e448f3003b03549e2f2c58c89ca8ea944b4594c20c4ca7ea0885024cb', 'application/vnd.docker.distribution.manifest.v2+json', 2099842, 3600, 3600, 42, 1, 1);
 INSERT INTO manifests (repo_id, digest, media_type, size_bytes, pushed_at, validated_at, last_pulled_at, min_layer_created_at, max_layer_created_at) VALUES (1, 'sha256:207a16511ab28a6c3ff0ad6e483ba79fb59a9ebf3721c94e4b91b825bfecf223', 'application/vnd.docker.distribution.manifest.v2+json', 2099842, 3600, 3600, 32, 1, 1);
 INSERT INTO manifests (repo_id, digest, media_type, size_bytes, pushed_at, validated_at, last_pulled_at, min_layer_created_at, max_layer_created_at) VALUES (1, 'sha256:7cefe08689844ee549c7168fd99cf844a7c6117e09e1b728cdd6a18e4645d8b3', 'application/vnd.docker.distribution.manifest.v2+json', 2099842, 3600, 3600, 52, 1, 1);
@@ -25,6 +25,7 @@ import (
 	"sort"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
@@ -39,6 +40,8 @@ var imageGCRepoSelectQuery = sqlext.SimplifyWhitespace(`
 	ORDER BY next_gc_at IS NULL DESC, next_gc_at ASC
 	-- only one repo at a time
 	LIMIT 1
+	-- prevent other janitors from claiming the same repo concurrently (NO KEY allows inserting rows that reference this one)
+	FOR NO KEY UPDATE SKIP LOCKED
 `)
 
 var imageGCResetStatusQuery = sqlext.SimplifyWhitespace(`
@@ -66,8 +69,11 @@ func (j *Janitor) GarbageCollectManifestsInNextRepo() (returnErr error) {
 		}
 	}()
 
-	//find repository to sync
-	err := j.db.SelectOne(&repo, imageGCRepoSelectQuery, j.timeNow())
+	//find repository to GC, and claim it by scheduling the next GC
+	err := j.claimNextRow(&repo, imageGCRepoSelectQuery, []any{j.timeNow()}, func(tx *gorp.Transaction) error {
+		_, err := tx.Exec(imageGCRepoDoneQuery, repo.ID, j.timeNow().Add(j.addJitter(1*time.Hour)))
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no accounts to sync manifests in - slowing down...")
@@ -75,6 +81,7 @@ func (j *Janitor) GarbageCollectManifestsInNextRepo() (returnErr error) {
 		}
 		return err
 	}
+	defer j.restoreScheduleOnFailure(&returnErr, imageGCRepoDoneQuery, repo.ID, repo.NextGarbageCollectionAt)
 
 	//load GC policies for this repository
 	account, err := keppel.FindAccount(j.db, repo.AccountName)
@@ -111,9 +118,7 @@ func (j *Janitor) GarbageCollectManifestsInNextRepo() (returnErr error) {
 			return err
 		}
 	}
-
-	_, err = j.db.Exec(imageGCRepoDoneQuery, repo.ID, j.timeNow().Add(j.addJitter(1*time.Hour)))
-	return err
+	return nil
 }
 
 type manifestData struct {
@@ -125,9 +130,11 @@ type manifestData struct {
 }
 
 func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Repository, policies []keppel.GCPolicy) error {
-	//load manifests in repo
+	//load manifests in repo (soft-deleted manifests are not considered by GC
+	//policies; they are purged by the manifest sync once their retention period
+	//expires)
 	var dbManifests []keppel.Manifest
-	_, err := j.db.Select(&dbManifests, `SELECT * FROM manifests WHERE repo_id = $1`, repo.ID)
+	_, err := j.db.Select(&dbManifests, `SELECT * FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`, repo.ID)
 	if err != nil {
 		return err
 	}
@@ -140,7 +147,6 @@ func (j *Janitor) executeGCPolicies(account keppel.Account, repo keppel.Reposito
 			GCStatus: keppel.GCStatus{
 				ProtectedByRecentUpload: m.PushedAt.After(j.timeNow().Add(-10 * time.Minute)),
 			},
-			IsDeleted: false,
 		})
 	}
 
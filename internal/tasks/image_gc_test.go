@@ -25,8 +25,10 @@ import (
 	"time"
 
 	"github.com/sapcc/go-api-declarations/cadf"
+	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
 
+	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/test"
 )
 
@@ -375,3 +377,23 @@ func TestGCProtectComesTooLate(t *testing.T) {
 		s.Clock.Now().Add(1*time.Hour).Unix(),
 	)
 }
+
+func TestGarbageCollectManifestsConcurrently(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	//setup some more repos in addition to the one from setup()
+	const extraRepoCount = 9
+	for idx := 0; idx < extraRepoCount; idx++ {
+		mustDo(t, s.DB.Insert(&keppel.Repository{AccountName: "test1", Name: fmt.Sprintf("repo%d", idx)}))
+	}
+
+	//run two job loops concurrently until they run out of work: each repo must
+	//have been processed exactly once
+	successCount := runConcurrently(t, 2, j.GarbageCollectManifestsInNextRepo)
+	assert.DeepEqual(t, "number of processed repos", successCount, extraRepoCount+1)
+
+	var unprocessedCount int
+	mustDo(t, s.DB.QueryRow(`SELECT COUNT(*) FROM repos WHERE next_gc_at IS NULL`).Scan(&unprocessedCount))
+	assert.DeepEqual(t, "number of unprocessed repos", unprocessedCount, 0)
+}
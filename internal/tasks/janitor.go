@@ -23,15 +23,20 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-api-declarations/cadf"
 	"github.com/sapcc/go-bits/audittools"
 	"github.com/sapcc/go-bits/logg"
+	"github.com/sapcc/go-bits/sqlext"
 
+	peerclient "github.com/sapcc/keppel/internal/client/peer"
 	"github.com/sapcc/keppel/internal/keppel"
 	"github.com/sapcc/keppel/internal/processor"
 )
@@ -43,6 +48,30 @@ var janitorDummyRequest = &http.Request{URL: &url.URL{
 	Path:   "keppel-janitor",
 }}
 
+const (
+	defaultMaxErrorMessageLength = 2000
+)
+
+// DefaultStorageReadTimeout is the storage read timeout used by
+// ValidateNextManifest() unless configured otherwise (see
+// SetStorageReadTimeout).
+const DefaultStorageReadTimeout = 5 * time.Minute
+
+// DefaultClairIndexPollInterval is how often CheckVulnerabilitiesForNextManifest()
+// polls Clair for the indexing state of a manifest unless configured otherwise
+// (see SetClairIndexPollInterval).
+const DefaultClairIndexPollInterval = 2 * time.Minute
+
+// DefaultClairIndexingTime is how long CheckVulnerabilitiesForNextManifest()
+// expects Clair to take for indexing a manifest unless configured otherwise
+// (see SetClairIndexingTime).
+const DefaultClairIndexingTime = 20 * time.Minute
+
+// DefaultStaleVulnerabilityStatusAge is the age after which
+// RefreshAccountMetrics() reports vulnerability statuses as stale unless
+// configured otherwise (see SetStaleVulnerabilityStatusAge).
+const DefaultStaleVulnerabilityStatusAge = 24 * time.Hour
+
 // Janitor contains the toolbox of the keppel-janitor process.
 type Janitor struct {
 	cfg     keppel.Configuration
@@ -52,6 +81,23 @@ type Janitor struct {
 	db      *keppel.DB
 	auditor keppel.Auditor
 
+	//caches the capabilities of our peers for getReplicaSyncPayload()
+	peerInfoCache *peerclient.InfoCache
+	//caches the vulnerability status of Clair's reports for getVulnerabilityStatusFromClair()
+	vulnReportCache *vulnReportCache
+	//if true, ValidateNextManifest() streams manifests from the storage instead of buffering them
+	streamManifestValidation bool
+	//how long CheckVulnerabilitiesForNextManifest() waits before checking again on manifests that Clair is still indexing
+	clairIndexPollInterval time.Duration
+	//how long Clair is expected to take for indexing a manifest (determines the validity of layer URLs submitted to Clair)
+	clairIndexingTime time.Duration
+	//how long ValidateNextManifest() waits for the storage before rescheduling the validation
+	storageReadTimeout time.Duration
+	//error messages longer than this (in characters) are truncated before being persisted in the DB
+	maxErrorMessageLength int
+	//manifests that have been stuck in vulnerability status Pending or Unknown for longer than this are reported by RefreshAccountMetrics()
+	staleVulnStatusAge time.Duration
+
 	//non-pure functions that can be replaced by deterministic doubles for unit tests
 	timeNow           func() time.Time
 	generateStorageID func() string
@@ -60,7 +106,7 @@ type Janitor struct {
 
 // NewJanitor creates a new Janitor.
 func NewJanitor(cfg keppel.Configuration, fd keppel.FederationDriver, sd keppel.StorageDriver, icd keppel.InboundCacheDriver, db *keppel.DB, auditor keppel.Auditor) *Janitor {
-	j := &Janitor{cfg, fd, sd, icd, db, auditor, time.Now, keppel.GenerateStorageID, addJitter}
+	j := &Janitor{cfg, fd, sd, icd, db, auditor, peerclient.NewInfoCache(), newVulnReportCache(), false, DefaultClairIndexPollInterval, DefaultClairIndexingTime, DefaultStorageReadTimeout, defaultMaxErrorMessageLength, DefaultStaleVulnerabilityStatusAge, time.Now, keppel.GenerateStorageID, addJitter}
 	j.initializeCounters()
 	return j
 }
@@ -82,6 +128,70 @@ func (j *Janitor) DisableJitter() {
 	j.addJitter = func(d time.Duration) time.Duration { return d }
 }
 
+// EnableStreamingManifestValidation makes ValidateNextManifest() stream
+// manifests from the storage instead of buffering them in memory entirely.
+func (j *Janitor) EnableStreamingManifestValidation() {
+	j.streamManifestValidation = true
+}
+
+// SetClairIndexPollInterval sets how long CheckVulnerabilitiesForNextManifest()
+// waits before checking again on a manifest that Clair is still indexing. The
+// actual delay is jittered to avoid all such manifests being checked at once.
+func (j *Janitor) SetClairIndexPollInterval(interval time.Duration) {
+	j.clairIndexPollInterval = interval
+}
+
+// SetClairIndexingTime sets how long Clair is expected to take for indexing a
+// manifest. Layer URLs submitted to Clair stay valid for a multiple of this
+// time. If indexing takes longer than the layer URLs stay valid, the manifest
+// is resubmitted to Clair with fresh layer URLs.
+func (j *Janitor) SetClairIndexingTime(duration time.Duration) {
+	j.clairIndexingTime = duration
+}
+
+// clairLayerURLTTL returns how long layer URLs submitted to Clair stay valid.
+// This comfortably exceeds the expected indexing time since indexing jobs may
+// have to wait in Clair's queue before Clair fetches the layers.
+func (j *Janitor) clairLayerURLTTL() time.Duration {
+	return 3 * j.clairIndexingTime
+}
+
+// SetStorageReadTimeout sets how long ValidateNextManifest() waits for the
+// storage to deliver a manifest. If the timeout expires, the validation is
+// rescheduled instead of being recorded as failed.
+func (j *Janitor) SetStorageReadTimeout(timeout time.Duration) {
+	j.storageReadTimeout = timeout
+}
+
+// SetMaxErrorMessageLength sets how many characters of an error message are
+// persisted in the DB, e.g. as the validation error of a manifest or blob.
+// Longer messages are truncated.
+func (j *Janitor) SetMaxErrorMessageLength(maxLength int) {
+	j.maxErrorMessageLength = maxLength
+}
+
+// SetStaleVulnerabilityStatusAge sets after how long RefreshAccountMetrics()
+// considers a manifest to be stuck if its vulnerability status is still
+// Pending or Unknown. The age is measured from when the manifest was pushed.
+func (j *Janitor) SetStaleVulnerabilityStatusAge(age time.Duration) {
+	j.staleVulnStatusAge = age
+}
+
+// truncateErrorMessage shortens the given error message to the configured
+// maximum length, such that a pathological error (e.g. one that includes an
+// entire response body) does not bloat the DB or the UIs that display it.
+func (j *Janitor) truncateErrorMessage(msg string) string {
+	const ellipsis = "…"
+	runes := []rune(msg)
+	if len(runes) <= j.maxErrorMessageLength {
+		return msg
+	}
+	if j.maxErrorMessageLength <= 1 {
+		return string(runes[:j.maxErrorMessageLength])
+	}
+	return string(runes[:j.maxErrorMessageLength-1]) + ellipsis
+}
+
 // addJitter returns a random duration within +/- 10% of the requested value.
 // This can be used to even out the load on a scheduled job over time, by
 // spreading jobs that would normally be scheduled right next to each other out
@@ -96,6 +206,86 @@ func (j *Janitor) processor() *processor.Processor {
 	return processor.New(j.cfg, j.db, j.sd, j.icd, j.auditor).OverrideTimeNow(j.timeNow).OverrideGenerateStorageID(j.generateStorageID)
 }
 
+// maxTransactionAttempts is how often claimNextRow() tries its transaction
+// before giving up on serialization failures or deadlocks.
+const maxTransactionAttempts = 3
+
+// lockNextRow selects a single row into `target` using a query that ends in
+// `FOR (NO KEY) UPDATE SKIP LOCKED`, and returns the transaction holding the
+// row lock. The caller must commit or roll back the transaction when it is
+// done working on the row. This allows multiple janitor processes to run the
+// same job loop concurrently without working on the same row. If the query
+// does not find anything, sql.ErrNoRows is returned.
+//
+// Since the row lock blocks all other writers on the row (including the API)
+// and the transaction occupies a DB connection for the whole duration of the
+// job, claimNextRow() should be preferred wherever possible.
+//
+// Unlike claimNextRow(), this does not retry on serialization failures: The
+// transaction spans the entire job, so only the caller could retry it as a
+// whole. If the transaction fails, the row is picked up again on the next
+// iteration of the job loop.
+func (j *Janitor) lockNextRow(target any, query string, args ...any) (*gorp.Transaction, error) {
+	tx, err := j.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.SelectOne(target, query, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			//explicit rollback to avoid spamming the log with "implicit rollback done" logs
+			err := tx.Rollback()
+			if err != nil {
+				return nil, err
+			}
+			return nil, sql.ErrNoRows
+		}
+		sqlext.RollbackUnlessCommitted(tx)
+		return nil, err
+	}
+	return tx, nil
+}
+
+// claimNextRow is like lockNextRow, but instead of holding the row lock for
+// the whole duration of the job, it runs `claim` within the transaction to
+// update the row such that the query will not find it again, and commits
+// immediately. Since the transaction is short, it is retried as a whole on
+// serialization failures or deadlocks. Because `claim` may therefore run
+// multiple times, it must not have any side effects outside of the
+// transaction.
+func (j *Janitor) claimNextRow(target any, query string, args []any, claim func(*gorp.Transaction) error) error {
+	return keppel.RetryOnSerializationFailure(maxTransactionAttempts, func() error {
+		tx, err := j.lockNextRow(target, query, args...)
+		if err != nil {
+			return err
+		}
+		defer sqlext.RollbackUnlessCommitted(tx)
+
+		err = claim(tx)
+		if err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// restoreScheduleOnFailure is deferred by tasks that have claimed their row
+// with claimNextRow() by moving the row's `next_*_at` timestamp into the
+// future. If the task fails afterwards, the previous timestamp is
+// restored using `scheduleQuery` (with the arguments `key` and
+// `previousNextAt`), so that the task is retried on the row as soon as
+// possible, same as if the row had never been claimed.
+func (j *Janitor) restoreScheduleOnFailure(returnErr *error, scheduleQuery string, key any, previousNextAt *time.Time) {
+	if *returnErr == nil {
+		return
+	}
+	_, err := j.db.Exec(scheduleQuery, key, previousNextAt)
+	if err != nil {
+		*returnErr = fmt.Errorf("%s (additional error encountered while restoring the previous schedule: %s)", (*returnErr).Error(), err.Error())
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // janitorUserIdentity
 
@@ -233,39 +423,150 @@ type Job interface {
 	Execute() error
 }
 
-// Execute a task repeatedly, but slow down when sql.ErrNoRows is returned by it.
-// (Tasks use this error value to indicate that nothing needs scraping, so we
-// can back off a bit to avoid useless database load.)
+// JobLoopIntervals configures how long RunJobLoop() waits between calls to
+// its task.
+type JobLoopIntervals struct {
+	//how long to wait after the task completed successfully
+	Tick time.Duration
+	//how long to wait after the task returned sql.ErrNoRows (i.e. when it had nothing to do)
+	IdleBackoff time.Duration
+	//how long to wait after the task returned any other error
+	ErrorBackoff time.Duration
+}
+
+// DefaultJobLoopIntervals are the JobLoopIntervals used by keppel-janitor
+// unless configured otherwise.
+var DefaultJobLoopIntervals = JobLoopIntervals{
+	Tick:         0,
+	IdleBackoff:  10 * time.Second,
+	ErrorBackoff: 2 * time.Second,
+}
+
+// DelayAfter returns how long the job loop waits after its task returned the
+// given result.
+func (i JobLoopIntervals) DelayAfter(err error) time.Duration {
+	switch err {
+	case nil:
+		return i.Tick
+	case sql.ErrNoRows:
+		//nothing to do right now - slow down a bit to avoid useless DB polling
+		return i.IdleBackoff
+	default:
+		//slow down a bit after an error to avoid hammering the DB during outages
+		return i.ErrorBackoff
+	}
+}
+
+// RunJobLoop executes a task repeatedly until `ctx` expires, and waits between
+// calls as configured in the given JobLoopIntervals. In particular, it slows
+// down when sql.ErrNoRows is returned by the task. (Tasks use this error value
+// to indicate that nothing needs to be done, so we can back off a bit to avoid
+// useless database load.)
 //
-// TODO: move into go-bits!
-func GoQueuedJobLoop(ctx context.Context, numGoroutines int, poll JobPoller) {
-	ch := make(chan Job) //unbuffered!
+// When `ctx` expires while the task is running, the task is allowed to finish
+// before this function returns. Waits between tasks are interrupted instead.
+func RunJobLoop(ctx context.Context, intervals JobLoopIntervals, task func() error) {
+	runJobLoop(ctx, intervals, task, sleepUnlessDone)
+}
+
+func runJobLoop(ctx context.Context, intervals JobLoopIntervals, task func() error, sleep func(context.Context, time.Duration)) {
+	for ctx.Err() == nil {
+		err := task()
+		if err != nil && err != sql.ErrNoRows {
+			logg.Error(err.Error())
+		}
+		if delay := intervals.DelayAfter(err); delay > 0 {
+			sleep(ctx, delay)
+		}
+	}
+}
+
+func sleepUnlessDone(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// JobLoopGroup coordinates the shutdown of multiple job loops: When its
+// context expires, all job loops stop taking on new tasks, and Wait() blocks
+// until all in-flight tasks have been completed. This ensures that tasks are
+// not interrupted halfway through when the process is shutting down.
+//
+// Tasks that take a context should therefore not be given the context of the
+// JobLoopGroup, since they would be aborted when it expires.
+type JobLoopGroup struct {
+	ctx       context.Context
+	intervals JobLoopIntervals
+	wg        sync.WaitGroup
+}
 
-	//one goroutine to select tasks from the DB
-	go func(ch chan<- Job) {
-		for ctx.Err() == nil {
-			job, err := poll()
-			switch err {
-			case nil:
-				ch <- job
-			case sql.ErrNoRows:
-				//no jobs waiting right now - slow down a bit to avoid useless DB load
-				time.Sleep(3 * time.Second)
-			default:
+// NewJobLoopGroup creates a new JobLoopGroup.
+func NewJobLoopGroup(ctx context.Context, intervals JobLoopIntervals) *JobLoopGroup {
+	return &JobLoopGroup{ctx: ctx, intervals: intervals}
+}
+
+// Go runs RunJobLoop() for the given task in a new goroutine.
+func (g *JobLoopGroup) Go(task func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		RunJobLoop(g.ctx, g.intervals, task)
+	}()
+}
+
+// GoCron runs the given task in a new goroutine once per `interval` until
+// the context expires. Unlike with Go(), the interval does not depend on the
+// result of the task, and errors are only logged.
+func (g *JobLoopGroup) GoCron(interval time.Duration, task func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		for g.ctx.Err() == nil {
+			err := task()
+			if err != nil {
 				logg.Error(err.Error())
 			}
+			sleepUnlessDone(g.ctx, interval)
 		}
+	}()
+}
 
-		//`ctx` has expired -> tell workers to shutdown
-		close(ch)
-	}(ch)
+// GoQueued runs a queued job loop (see JobPoller) with the given number of
+// goroutines: One goroutine polls for jobs, and the others execute them.
+func (g *JobLoopGroup) GoQueued(numGoroutines int, poll JobPoller) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		runQueuedJobLoop(g.ctx, numGoroutines, poll)
+	}()
+}
+
+// Wait blocks until the context has expired and all job loops have returned.
+func (g *JobLoopGroup) Wait() {
+	g.wg.Wait()
+}
+
+// Execute jobs from the given JobPoller until `ctx` expires, but slow down
+// when sql.ErrNoRows is returned by it. (Tasks use this error value to
+// indicate that nothing needs scraping, so we can back off a bit to avoid
+// useless database load.) Returns once all in-flight jobs have completed.
+//
+// TODO: move into go-bits!
+func runQueuedJobLoop(ctx context.Context, numGoroutines int, poll JobPoller) {
+	ch := make(chan Job) //unbuffered!
 
 	//multiple goroutines to execute tasks
 	//
-	//We use `numGoroutines-1` here since we already have spawned one goroutine
-	//for the polling above.
+	//We use `numGoroutines-1` here since the polling below occupies one
+	//goroutine already.
+	var wg sync.WaitGroup
 	for i := 0; i < numGoroutines-1; i++ {
+		wg.Add(1)
 		go func(ch <-chan Job) {
+			defer wg.Done()
 			for job := range ch {
 				err := job.Execute()
 				if err != nil {
@@ -274,6 +575,24 @@ func GoQueuedJobLoop(ctx context.Context, numGoroutines int, poll JobPoller) {
 			}
 		}(ch)
 	}
+
+	//select tasks from the DB
+	for ctx.Err() == nil {
+		job, err := poll()
+		switch err {
+		case nil:
+			ch <- job
+		case sql.ErrNoRows:
+			//no jobs waiting right now - slow down a bit to avoid useless DB load
+			sleepUnlessDone(ctx, 3*time.Second)
+		default:
+			logg.Error(err.Error())
+		}
+	}
+
+	//`ctx` has expired -> tell workers to shutdown
+	close(ch)
+	wg.Wait()
 }
 
 // ExecuteOne is used by unit tests to find and execute exactly one instance of
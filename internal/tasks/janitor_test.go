@@ -20,8 +20,15 @@
 package tasks
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/test"
 )
 
 func TestAddJitter(t *testing.T) {
@@ -61,3 +68,85 @@ func TestAddJitter(t *testing.T) {
 			baseDuration, float64(biggerCount)/1000.)
 	}
 }
+
+func TestNextClairIndexPollAt(t *testing.T) {
+	now := time.Unix(10000, 0)
+	j := &Janitor{timeNow: func() time.Time { return now }, addJitter: addJitter}
+	j.SetClairIndexPollInterval(5 * time.Minute)
+
+	//the reschedule must stay within the +/-10% jitter window around the configured interval
+	lowerBound := now.Add(4*time.Minute + 30*time.Second)
+	upperBound := now.Add(5*time.Minute + 30*time.Second)
+	for idx := 0; idx < 100; idx++ {
+		next := j.nextClairIndexPollAt()
+		if next.Before(lowerBound) || next.After(upperBound) {
+			t.Errorf("expected next check between %s and %s, but got %s", lowerBound, upperBound, next)
+		}
+	}
+}
+
+func TestRunJobLoopBacksOffWhenIdle(t *testing.T) {
+	clock := &test.Clock{}
+	intervals := JobLoopIntervals{
+		Tick:         1 * time.Second,
+		IdleBackoff:  30 * time.Second,
+		ErrorBackoff: 5 * time.Second,
+	}
+
+	//the task returns these results in order, and records the time of each call
+	ctx, cancel := context.WithCancel(context.Background())
+	results := []error{nil, nil, sql.ErrNoRows, sql.ErrNoRows, errors.New("datacenter on fire"), nil}
+	var callTimes []int64
+	task := func() error {
+		callTimes = append(callTimes, clock.Now().Unix())
+		result := results[0]
+		results = results[1:]
+		if len(results) == 0 {
+			cancel()
+		}
+		return result
+	}
+
+	runJobLoop(ctx, intervals, task, func(_ context.Context, d time.Duration) { clock.StepBy(d) })
+
+	//after successful runs, the loop only waits for one tick; after
+	//sql.ErrNoRows, it backs off for much longer
+	assert.DeepEqual(t, "call times", callTimes, []int64{0, 1, 2, 32, 62, 67})
+}
+
+type recordingJob struct {
+	executed chan<- int
+	id       int
+}
+
+func (job recordingJob) Execute() error {
+	job.executed <- job.id
+	return nil
+}
+
+func TestJobLoopGroupWaitsForQueuedJobs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	executed := make(chan int, 10)
+
+	//the poller hands out three jobs and then stops the group
+	nextID := 0
+	poll := func() (Job, error) {
+		nextID++
+		if nextID == 3 {
+			cancel()
+		}
+		return recordingJob{executed, nextID}, nil
+	}
+
+	g := NewJobLoopGroup(ctx, DefaultJobLoopIntervals)
+	g.GoQueued(3, poll)
+	g.Wait()
+
+	//all jobs that were polled must have been executed by the time Wait() returns
+	close(executed)
+	var ids []int
+	for id := range executed {
+		ids = append(ids, id)
+	}
+	assert.DeepEqual(t, "number of executed jobs", len(ids), 3)
+}
@@ -22,6 +22,7 @@ import (
 	"compress/gzip"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -46,11 +47,19 @@ import (
 // query that finds the next manifest to be validated
 var outdatedManifestSearchQuery = sqlext.SimplifyWhitespace(`
 	SELECT * FROM manifests
-		WHERE validated_at < $1 OR (validated_at < $2 AND validation_error_message != '')
+		WHERE deleted_at IS NULL AND (validated_at < $1 OR (validated_at < $2 AND validation_error_message != ''))
 	ORDER BY validation_error_message != '' DESC, validated_at ASC, media_type DESC
 		-- oldest blobs first, but always prefer to recheck a failed validation (see below for why we sort by media_type)
 	LIMIT 1
 		-- one at a time
+	FOR UPDATE SKIP LOCKED
+		-- prevent other job loops from claiming the same manifest concurrently
+`)
+
+// query that claims a manifest for validation by bumping its `validated_at`,
+// such that concurrent job loops will not pick it up again
+var claimManifestForValidationQuery = sqlext.SimplifyWhitespace(`
+	UPDATE manifests SET validated_at = $1 WHERE repo_id = $2 AND digest = $3
 `)
 
 //^ NOTE: The sorting by media_type is completely useless in real-world
@@ -83,7 +92,11 @@ func (j *Janitor) ValidateNextManifest() (returnErr error) {
 	//validation failed
 	maxSuccessfulValidatedAt := j.timeNow().Add(-24 * time.Hour)
 	maxFailedValidatedAt := j.timeNow().Add(-10 * time.Minute)
-	err := j.db.SelectOne(&manifest, outdatedManifestSearchQuery, maxSuccessfulValidatedAt, maxFailedValidatedAt)
+	err := j.claimNextRow(&manifest, outdatedManifestSearchQuery, []any{maxSuccessfulValidatedAt, maxFailedValidatedAt},
+		func(tx *gorp.Transaction) error {
+			_, err := tx.Exec(claimManifestForValidationQuery, j.timeNow(), manifest.RepositoryID, manifest.Digest)
+			return err
+		})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no manifests to validate - slowing down...")
@@ -103,9 +116,45 @@ func (j *Janitor) ValidateNextManifest() (returnErr error) {
 		return fmt.Errorf("cannot find account for manifest %s/%s: %s", repo.FullName(), manifest.Digest, err.Error())
 	}
 
-	//perform validation
-	err = j.processor().ValidateExistingManifest(*account, repo, &manifest, j.timeNow())
-	if err == nil {
+	//skip validation while account is in maintenance (maintenance mode blocks
+	//all kinds of activity on an account's contents); the claim above has
+	//already advanced `validated_at`, so we will come back to this manifest in
+	//the next validation cycle
+	if account.InMaintenance {
+		logg.Debug("skipping validation of manifest %s/%s: account is in maintenance", repo.FullName(), manifest.Digest)
+		return nil
+	}
+
+	//perform validation (this also recomputes the manifest size, so we can
+	//tell if the size in the DB was wrong, e.g. because it was computed by an
+	//older version of Keppel)
+	oldSizeBytes := manifest.SizeBytes
+	proc := j.processor().WithStorageReadTimeout(j.storageReadTimeout)
+	if j.streamManifestValidation {
+		err = proc.ValidateExistingManifestStreaming(*account, repo, &manifest, j.timeNow())
+	} else {
+		err = proc.ValidateExistingManifest(*account, repo, &manifest, j.timeNow())
+	}
+	if errors.Is(err, processor.ErrStorageReadTimeout) {
+		//a slow storage does not say anything about the manifest itself, so we
+		//do not record a validation error; instead we reschedule the validation
+		//to happen after the same delay as for failed validations
+		_, updateErr := j.db.Exec(`
+			UPDATE manifests SET validated_at = $1
+				WHERE repo_id = $2 AND digest = $3`,
+			j.timeNow().Add(-24*time.Hour).Add(10*time.Minute), repo.ID, manifest.Digest,
+		)
+		if updateErr != nil {
+			err = fmt.Errorf("%s (additional error encountered while rescheduling validation: %s)", err.Error(), updateErr.Error())
+		}
+		return err
+	} else if err == nil {
+		if manifest.SizeBytes != oldSizeBytes {
+			logg.Info("corrected size of manifest %s@%s from %d to %d bytes",
+				repo.FullName(), manifest.Digest, oldSizeBytes, manifest.SizeBytes)
+			repairedManifestSizesCounter.Inc()
+		}
+
 		//update `validated_at` and reset error message
 		_, err := j.db.Exec(`
 			UPDATE manifests SET validated_at = $1, validation_error_message = ''
@@ -122,7 +171,7 @@ func (j *Janitor) ValidateNextManifest() (returnErr error) {
 		_, updateErr := j.db.Exec(`
 			UPDATE manifests SET validated_at = $1, validation_error_message = $2
 				WHERE repo_id = $3 AND digest = $4`,
-			j.timeNow(), err.Error(), repo.ID, manifest.Digest,
+			j.timeNow(), j.truncateErrorMessage(err.Error()), repo.ID, manifest.Digest,
 		)
 		if updateErr != nil {
 			err = fmt.Errorf("%s (additional error encountered while recording validation error: %s)", err.Error(), updateErr.Error())
@@ -143,6 +192,8 @@ var syncManifestRepoSelectQuery = sqlext.SimplifyWhitespace(`
 	ORDER BY r.next_manifest_sync_at IS NULL DESC, r.next_manifest_sync_at ASC
 	-- only one repo at a time
 	LIMIT 1
+	-- prevent other janitors from claiming the same repo concurrently (NO KEY allows inserting rows that reference this one)
+	FOR NO KEY UPDATE SKIP LOCKED
 `)
 
 var syncManifestEnumerateRefsQuery = sqlext.SimplifyWhitespace(`
@@ -179,8 +230,21 @@ func (j *Janitor) SyncManifestsInNextRepo() (returnErr error) {
 		}
 	}()
 
-	//find repository to sync
-	err := j.db.SelectOne(&repo, syncManifestRepoSelectQuery, j.timeNow())
+	//find repository to sync, and claim it by scheduling the next sync
+	var account *keppel.Account
+	err := j.claimNextRow(&repo, syncManifestRepoSelectQuery, []any{j.timeNow()}, func(tx *gorp.Transaction) (err error) {
+		account, err = keppel.FindAccount(tx, repo.AccountName)
+		if err != nil {
+			return fmt.Errorf("cannot find account for repo %s: %s", repo.FullName(), err.Error())
+		}
+		//external replicas can have a specific cache TTL that overrides the default sync interval
+		syncInterval := 1 * time.Hour
+		if ttl := account.ExternalPeerCacheTTL(); ttl > 0 {
+			syncInterval = ttl
+		}
+		_, err = tx.Exec(syncManifestDoneQuery, repo.ID, j.timeNow().Add(j.addJitter(syncInterval)))
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no accounts to sync manifests in - slowing down...")
@@ -188,15 +252,11 @@ func (j *Janitor) SyncManifestsInNextRepo() (returnErr error) {
 		}
 		return err
 	}
+	defer j.restoreScheduleOnFailure(&returnErr, syncManifestDoneQuery, repo.ID, repo.NextManifestSyncAt)
 
-	//find corresponding account
-	account, err := keppel.FindAccount(j.db, repo.AccountName)
-	if err != nil {
-		return fmt.Errorf("cannot find account for repo %s: %s", repo.FullName(), err.Error())
-	}
-
-	//do not perform manifest sync while account is in maintenance (maintenance mode blocks all kinds of replication)
-	if !account.InMaintenance {
+	//do not perform manifest sync while account is in maintenance (maintenance mode blocks all kinds of replication),
+	//or if this repo is excluded from replication by the account's replication policy
+	if !account.InMaintenance && account.ReplicatesRepository(repo.Name) {
 		syncPayload, err := j.getReplicaSyncPayload(*account, repo)
 		if err != nil {
 			return err
@@ -205,16 +265,18 @@ func (j *Janitor) SyncManifestsInNextRepo() (returnErr error) {
 		if err != nil {
 			return err
 		}
+		//this needs to run after the tag sync: manifests that were just replicated
+		//because a tag moved upstream shall not be evicted right away
+		err = j.evictUnusedCachedManifests(*account, repo)
+		if err != nil {
+			return err
+		}
 		err = j.performManifestSync(*account, repo, syncPayload)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err = j.db.Exec(syncManifestDoneQuery, repo.ID, j.timeNow().Add(j.addJitter(1*time.Hour)))
-	if err != nil {
-		return err
-	}
 	_, err = j.db.Exec(syncManifestCleanupEmptyQuery, repo.ID)
 	return err
 }
@@ -243,6 +305,19 @@ func (j *Janitor) getReplicaSyncPayload(account keppel.Account, repo keppel.Repo
 		return nil, err
 	}
 
+	//if the peer does not support the replica-sync API, we need to fall back to
+	//checking each manifest and tag individually
+	info, err := j.peerInfoCache.GetPeerInfo(client, j.timeNow())
+	if err != nil {
+		//this is not a reason to abort the sync; the peer info API is only used to
+		//opt out of the replica-sync API, so assume that the peer supports it
+		logg.Error("cannot get peer info from %s, assuming that it supports the replica-sync API: %s", peer.HostName, err.Error())
+		info = keppel.LegacyPeerInfo()
+	}
+	if !info.HasCapability(keppel.PeerCapabilityReplicaSync) {
+		return nil, nil
+	}
+
 	//assemble request body
 	tagsByDigest := make(map[string][]keppel.TagForSync)
 	query := `SELECT name, digest, last_pulled_at FROM tags WHERE repo_id = $1`
@@ -267,7 +342,7 @@ func (j *Janitor) getReplicaSyncPayload(account keppel.Account, repo keppel.Repo
 	}
 
 	var manifests []keppel.ManifestForSync
-	query = `SELECT digest, last_pulled_at FROM manifests WHERE repo_id = $1`
+	query = `SELECT digest, last_pulled_at FROM manifests WHERE repo_id = $1 AND deleted_at IS NULL`
 	err = sqlext.ForeachRow(j.db, query, []interface{}{repo.ID}, func(rows *sql.Rows) error {
 		var (
 			digest       string
@@ -350,10 +425,14 @@ TAG:
 
 var repoUntaggedManifestsSelectQuery = sqlext.SimplifyWhitespace(`
 	SELECT m.* FROM manifests m
-		WHERE repo_id = $1
+		WHERE repo_id = $1 AND deleted_at IS NULL
 		AND digest NOT IN (SELECT DISTINCT digest FROM tags WHERE repo_id = $1)
 `)
 
+var softDeleteManifestQuery = sqlext.SimplifyWhitespace(`
+	UPDATE manifests SET deleted_at = $3 WHERE repo_id = $1 AND digest = $2
+`)
+
 func (j *Janitor) performManifestSync(account keppel.Account, repo keppel.Repository, syncPayload *keppel.ReplicaSyncPayload) error {
 	//enumerate manifests in this repo (this only needs to consider untagged
 	//manifests: we run right after performTagSync, therefore all images that are
@@ -389,17 +468,141 @@ func (j *Janitor) performManifestSync(account keppel.Account, repo keppel.Reposi
 
 	//if nothing needs to be deleted, we're done here
 	if len(shallDeleteManifest) == 0 {
+		return j.purgeSoftDeletedManifests(account, repo)
+	}
+
+	//if a retention period is configured, only mark the manifests as deleted
+	//(they will be purged once the retention period expires)
+	if j.cfg.DeletedManifestRetention > 0 {
+		logg.Info("soft-deleting %d manifests in repo %s that were deleted on corresponding primary account", len(shallDeleteManifest), repo.FullName())
+		err := sqlext.WithPreparedStatement(j.db, softDeleteManifestQuery, func(stmt *sql.Stmt) error {
+			for digest := range shallDeleteManifest {
+				_, err := stmt.Exec(repo.ID, digest, j.timeNow())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("cannot soft-delete manifests in repo %s: %w", repo.FullName(), err)
+		}
+		return j.purgeSoftDeletedManifests(account, repo)
+	}
+
+	parentDigestsOf, err := j.getParentDigests(repo)
+	if err != nil {
+		return err
+	}
+	logg.Info("deleting %d manifests in repo %s that were deleted on corresponding primary account", len(shallDeleteManifest), repo.FullName())
+	return j.deleteManifestsInOrder(account, repo, shallDeleteManifest, parentDigestsOf, "manifest-sync")
+}
+
+var purgeSoftDeletedManifestsSelectQuery = sqlext.SimplifyWhitespace(`
+	SELECT digest FROM manifests WHERE repo_id = $1 AND deleted_at < $2
+`)
+
+// Deletes manifests that were soft-deleted by performManifestSync and whose
+// retention period has expired. If the retention period is not configured
+// (anymore), all soft-deleted manifests are deleted.
+func (j *Janitor) purgeSoftDeletedManifests(account keppel.Account, repo keppel.Repository) error {
+	shallPurgeManifest := make(map[string]bool)
+	cutoff := j.timeNow().Add(-j.cfg.DeletedManifestRetention)
+	err := sqlext.ForeachRow(j.db, purgeSoftDeletedManifestsSelectQuery, []interface{}{repo.ID, cutoff}, func(rows *sql.Rows) error {
+		var digest string
+		err := rows.Scan(&digest)
+		shallPurgeManifest[digest] = true
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot find soft-deleted manifests in repo %s: %w", repo.FullName(), err)
+	}
+	if len(shallPurgeManifest) == 0 {
+		return nil
+	}
+
+	parentDigestsOf, err := j.getParentDigests(repo)
+	if err != nil {
+		return err
+	}
+	keepManifestsWithRemainingParents(shallPurgeManifest, parentDigestsOf)
+	if len(shallPurgeManifest) == 0 {
+		return nil
+	}
+
+	logg.Info("purging %d soft-deleted manifests in repo %s whose retention period has expired", len(shallPurgeManifest), repo.FullName())
+	return j.deleteManifestsInOrder(account, repo, shallPurgeManifest, parentDigestsOf, "manifest-sync")
+}
+
+var evictUnusedCachedManifestsSelectQuery = sqlext.SimplifyWhitespace(`
+	SELECT digest FROM manifests
+		WHERE repo_id = $1 AND COALESCE(last_pulled_at, pushed_at) < $2 AND deleted_at IS NULL
+`)
+
+// For external replicas with a cache TTL, manifests that have not been pulled
+// within the TTL are evicted. Their blobs will then be cleaned up by the
+// regular blob mount GC and blob GC. Tags pointing to evicted manifests are
+// removed as well. If they are needed again later, they will be replicated
+// again on the next pull.
+func (j *Janitor) evictUnusedCachedManifests(account keppel.Account, repo keppel.Repository) error {
+	ttl := account.ExternalPeerCacheTTL()
+	if ttl <= 0 {
 		return nil
 	}
 
-	//enumerate manifest-manifest refs in this repo
+	shallEvictManifest := make(map[string]bool)
+	err := sqlext.ForeachRow(j.db, evictUnusedCachedManifestsSelectQuery, []interface{}{repo.ID, j.timeNow().Add(-ttl)}, func(rows *sql.Rows) error {
+		var digest string
+		err := rows.Scan(&digest)
+		shallEvictManifest[digest] = true
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot find unused manifests in repo %s: %w", repo.FullName(), err)
+	}
+	if len(shallEvictManifest) == 0 {
+		return nil
+	}
+
+	//manifests that are referenced by a manifest that is not being evicted need
+	//to stay (e.g. when clients only pull the image list, but not its submanifests)
+	parentDigestsOf, err := j.getParentDigests(repo)
+	if err != nil {
+		return err
+	}
+	keepManifestsWithRemainingParents(shallEvictManifest, parentDigestsOf)
+	if len(shallEvictManifest) == 0 {
+		return nil
+	}
+
+	logg.Info("evicting %d manifests in repo %s that were not pulled within the cache TTL", len(shallEvictManifest), repo.FullName())
+	return j.deleteManifestsInOrder(account, repo, shallEvictManifest, parentDigestsOf, "cache-eviction")
+}
+
+// Removes all manifests from the given set that are referenced by a manifest
+// outside the set, since those cannot be deleted.
+func keepManifestsWithRemainingParents(shallDeleteManifest map[string]bool, parentDigestsOf map[string][]string) {
+	for keepGoing := true; keepGoing; {
+		keepGoing = false
+		for digest := range shallDeleteManifest {
+			if slices.ContainsFunc(parentDigestsOf[digest], func(parentDigest string) bool { return !shallDeleteManifest[parentDigest] }) {
+				delete(shallDeleteManifest, digest)
+				keepGoing = true
+			}
+		}
+	}
+}
+
+// Returns a map of child digest -> list of parent digests for all
+// manifest-manifest refs in this repo.
+func (j *Janitor) getParentDigests(repo keppel.Repository) (map[string][]string, error) {
 	parentDigestsOf := make(map[string][]string)
-	err = sqlext.ForeachRow(j.db, syncManifestEnumerateRefsQuery, []interface{}{repo.ID}, func(rows *sql.Rows) error {
+	err := sqlext.ForeachRow(j.db, syncManifestEnumerateRefsQuery, []interface{}{repo.ID}, func(rows *sql.Rows) error {
 		var (
 			parentDigest string
 			childDigest  string
 		)
-		err = rows.Scan(&parentDigest, &childDigest)
+		err := rows.Scan(&parentDigest, &childDigest)
 		if err != nil {
 			return err
 		}
@@ -407,15 +610,15 @@ func (j *Janitor) performManifestSync(account keppel.Account, repo keppel.Reposi
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("cannot enumerate manifest-manifest refs in repo %s: %s", repo.FullName(), err.Error())
+		return nil, fmt.Errorf("cannot enumerate manifest-manifest refs in repo %s: %s", repo.FullName(), err.Error())
 	}
+	return parentDigestsOf, nil
+}
 
-	//delete manifests in correct order (if there is a parent-child relationship,
-	//we always need to delete the parent manifest first, otherwise the database
-	//will complain because of its consistency checks)
-	if len(shallDeleteManifest) > 0 {
-		logg.Info("deleting %d manifests in repo %s that were deleted on corresponding primary account", len(shallDeleteManifest), repo.FullName())
-	}
+// Deletes the given manifests in correct order (if there is a parent-child
+// relationship, we always need to delete the parent manifest first, otherwise
+// the database will complain because of its consistency checks).
+func (j *Janitor) deleteManifestsInOrder(account keppel.Account, repo keppel.Repository, shallDeleteManifest map[string]bool, parentDigestsOf map[string][]string, taskName string) error {
 	manifestWasDeleted := make(map[string]bool)
 	for len(shallDeleteManifest) > 0 {
 		deletedSomething := false
@@ -428,7 +631,7 @@ func (j *Janitor) performManifestSync(account keppel.Account, repo keppel.Reposi
 
 			//no manifests left that reference this one - we can delete it
 			err := j.processor().DeleteManifest(account, repo, digest, keppel.AuditContext{
-				UserIdentity: janitorUserIdentity{TaskName: "manifest-sync"},
+				UserIdentity: janitorUserIdentity{TaskName: taskName},
 				Request:      janitorDummyRequest,
 			})
 			if err != nil {
@@ -458,6 +661,7 @@ func (j *Janitor) performManifestSync(account keppel.Account, repo keppel.Reposi
 var vulnCheckSelectQuery = sqlext.SimplifyWhitespace(`
 	SELECT * FROM vuln_info
 		WHERE next_check_at <= $1
+		AND (repo_id, digest) IN (SELECT repo_id, digest FROM manifests WHERE deleted_at IS NULL)
 	-- manifests without any check first, then prefer manifests without a finished check, then sorted by schedule, then sorted by digest for deterministic behavior in unit test
 	ORDER BY next_check_at IS NULL DESC, status = 'Pending' DESC, next_check_at ASC, digest ASC
 	-- only one manifests at a time
@@ -486,7 +690,7 @@ var vulnCheckSubmanifestInfoQuery = sqlext.SimplifyWhitespace(`
 // This assumes that `j.cfg.Clair != nil`.
 //
 // If no manifest needs checking, sql.ErrNoRows is returned.
-func (j *Janitor) CheckVulnerabilitiesForNextManifest() JobPoller {
+func (j *Janitor) CheckVulnerabilitiesForNextManifest(ctx context.Context) JobPoller {
 	return func() (job Job, returnErr error) {
 		defer func() {
 			if returnErr == nil {
@@ -497,35 +701,33 @@ func (j *Janitor) CheckVulnerabilitiesForNextManifest() JobPoller {
 			}
 		}()
 
-		//we need a DB transaction for the row-level locking to work correctly
-		tx, err := j.db.Begin()
-		if err != nil {
-			return nil, err
-		}
-		defer func() {
-			if returnErr != nil {
-				sqlext.RollbackUnlessCommitted(tx)
-			}
-		}()
-
-		//find vulnInfo to sync
+		//find vulnInfo to sync (we need a DB transaction for the row-level locking to work correctly)
+		//
+		//NOTE: Unlike most other tasks, this one holds the row lock for the
+		//entire check instead of using claimNextRow(). The vuln_info row is not
+		//written by the API, and CheckClairManifestState() relies on the
+		//next_check_at of rows in flight not being moved into the future.
 		var vulnInfo keppel.VulnerabilityInfo
-		err = tx.SelectOne(&vulnInfo, vulnCheckSelectQuery, j.timeNow())
+		tx, err := j.lockNextRow(&vulnInfo, vulnCheckSelectQuery, j.timeNow())
 		if err != nil {
 			if err == sql.ErrNoRows {
 				logg.Debug("no vulnerability to update status for - slowing down...")
-				//nolint:errcheck
-				tx.Rollback() //avoid the log line generated by sqlext.RollbackUnlessCommitted()
 				return nil, sql.ErrNoRows
 			}
 			return nil, err
 		}
+		defer func() {
+			if returnErr != nil {
+				sqlext.RollbackUnlessCommitted(tx)
+			}
+		}()
 
-		return checkVulnerabilitiesJob{j, tx, vulnInfo}, nil
+		return checkVulnerabilitiesJob{ctx, j, tx, vulnInfo}, nil
 	}
 }
 
 type checkVulnerabilitiesJob struct {
+	ctx      context.Context
 	j        *Janitor
 	tx       *gorp.Transaction
 	vulnInfo keppel.VulnerabilityInfo
@@ -552,7 +754,7 @@ func (job checkVulnerabilitiesJob) Execute() (returnError error) {
 		return fmt.Errorf("cannot find manifest for repo %s and digest %s: %s", repo.FullName(), vulnInfo.Digest, err.Error())
 	}
 
-	err = j.doVulnerabilityCheck(*account, *repo, *manifest, &vulnInfo)
+	err = j.doVulnerabilityCheck(job.ctx, *account, *repo, *manifest, &vulnInfo)
 	if err != nil {
 		return err
 	}
@@ -642,8 +844,8 @@ func (j *Janitor) checkPreConditionsForClair(account keppel.Account, repo keppel
 	for _, blob := range layerBlobs {
 		if blob.StorageID == "" {
 			//if the manifest is fairly new, the user who replicated it is probably
-			//still replicating it; give them 10 minutes to finish replicating it
-			vulnInfo.NextCheckAt = manifest.PushedAt.Add(j.addJitter(10 * time.Minute))
+			//still replicating it; give them some time to finish replicating it
+			vulnInfo.NextCheckAt = manifest.PushedAt.Add(j.addJitter(account.BlobReplicationGracePeriod()))
 			if vulnInfo.NextCheckAt.After(j.timeNow()) {
 				return nil, false, nil
 			}
@@ -697,12 +899,33 @@ func (j *Janitor) checkPreConditionsForClair(account keppel.Account, repo keppel
 	return layerBlobs, true, nil
 }
 
-func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repository, manifest keppel.Manifest, vulnInfo *keppel.VulnerabilityInfo) (returnedError error) {
+func (j *Janitor) doVulnerabilityCheck(ctx context.Context, account keppel.Account, repo keppel.Repository, manifest keppel.Manifest, vulnInfo *keppel.VulnerabilityInfo) (returnedError error) {
 	//clear timing information (this will be filled down below once we actually talk to Clair;
 	//if any preflight check fails, the fields stay at nil)
 	vulnInfo.CheckedAt = nil
 	vulnInfo.CheckDurationSecs = nil
 
+	//if the check concludes with a different status than before, tell everyone who is interested
+	oldStatus := vulnInfo.Status
+	defer func() {
+		if returnedError == nil && vulnInfo.Status != oldStatus {
+			event := keppel.VulnerabilityStatusChangedEvent{
+				Account:    account,
+				Repository: repo,
+				Digest:     manifest.Digest,
+				OldStatus:  oldStatus,
+				NewStatus:  vulnInfo.Status,
+				ChangedAt:  j.timeNow(),
+			}
+			if event.IsWorsening() {
+				logg.Info("WARNING: vulnerability status of %s@%s has worsened from %s to %s",
+					repo.FullName(), manifest.Digest, oldStatus, vulnInfo.Status)
+				vulnerabilityStatusWorsenedCounter.Inc()
+			}
+			j.cfg.Events().Emit(event)
+		}
+	}()
+
 	//skip validation while account is in maintenance (maintenance mode blocks
 	//all kinds of activity on an account's contents)
 	if account.InMaintenance {
@@ -731,7 +954,7 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 	}()
 	//also we don't allow Clair to take more than 10 minutes on a single image (which is already an
 	//insanely generous timeout)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	defer cancel()
 
 	//collect vulnerability status of constituent images
@@ -749,43 +972,11 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 	//ask Clair for vulnerability status of blobs in this image
 	vulnInfo.Message = "" //unless it gets set to something else below
 	if len(layerBlobs) > 0 {
-		clairState, err := j.cfg.ClairClient.CheckManifestState(ctx, manifest.Digest, func() (clair.Manifest, error) {
-			return j.buildClairManifest(account, manifest, layerBlobs)
-		})
+		vulnStatus, err := j.getVulnerabilityStatusFromClair(ctx, account, manifest, layerBlobs, vulnInfo, oldStatus)
 		if err != nil {
 			return err
 		}
-		now := j.timeNow()
-		if vulnInfo.IndexStartedAt == nil {
-			vulnInfo.IndexStartedAt = &now
-			vulnInfo.IndexState = clairState.IndexState
-		}
-
-		if clairState.IndexingWasRestarted {
-			vulnStatuses = append(vulnStatuses, clair.PendingVulnerabilityStatus)
-			vulnInfo.IndexStartedAt = &now
-			vulnInfo.IndexState = clairState.IndexState
-			checkVulnerabilityRetriedCounter.Inc()
-		} else if clairState.IsErrored {
-			vulnStatuses = append(vulnStatuses, clair.ErrorVulnerabilityStatus)
-			vulnInfo.Message = clairState.ErrorMessage
-		} else if clairState.IsIndexed {
-			if vulnInfo.IndexFinishedAt == nil {
-				vulnInfo.IndexFinishedAt = &now
-			}
-
-			clairReport, err := j.cfg.ClairClient.GetVulnerabilityReport(ctx, manifest.Digest)
-			if err != nil {
-				return err
-			}
-			if clairReport == nil {
-				//nolint:stylecheck // Clair is a proper name
-				return fmt.Errorf("Clair reports indexing of %s as finished, but vulnerability report is 404", manifest.Digest)
-			}
-			vulnStatuses = append(vulnStatuses, clairReport.VulnerabilityStatus())
-		} else {
-			vulnStatuses = append(vulnStatuses, clair.PendingVulnerabilityStatus)
-		}
+		vulnStatuses = append(vulnStatuses, vulnStatus)
 	}
 
 	//merge all vulnerability statuses
@@ -793,7 +984,7 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 	if vulnInfo.Status == clair.PendingVulnerabilityStatus {
 		logg.Info("skipping vulnerability check for %s: indexing is not finished yet", manifest.Digest)
 		//wait a bit for indexing to finish, then come back to update the vulnerability status
-		vulnInfo.NextCheckAt = j.timeNow().Add(j.addJitter(2 * time.Minute))
+		vulnInfo.NextCheckAt = j.nextClairIndexPollAt()
 	} else {
 		//regular recheck loop (vulnerability status might change if Clair adds new vulnerabilities to its DB)
 		vulnInfo.NextCheckAt = j.timeNow().Add(j.addJitter(1 * time.Hour))
@@ -801,13 +992,130 @@ func (j *Janitor) doVulnerabilityCheck(account keppel.Account, repo keppel.Repos
 	return nil
 }
 
-func (j *Janitor) buildClairManifest(account keppel.Account, manifest keppel.Manifest, layerBlobs []keppel.Blob) (clair.Manifest, error) {
+// Asks Clair for the vulnerability status of the layers of this manifest.
+// Indexing-related fields in `vulnInfo` are updated along the way.
+//
+// If another manifest with the same layers has been submitted to Clair before,
+// its index report is used instead of submitting this manifest as well (see
+// type vulnReportCache).
+func (j *Janitor) getVulnerabilityStatusFromClair(ctx context.Context, account keppel.Account, manifest keppel.Manifest, layerBlobs []keppel.Blob, vulnInfo *keppel.VulnerabilityInfo, oldStatus clair.VulnerabilityStatus) (clair.VulnerabilityStatus, error) {
+	cacheKey := vulnReportCacheKey(layerBlobs)
+	clairDigest := j.vulnReportCache.IndexedManifestDigest(cacheKey, manifest.Digest)
+	if clairDigest != manifest.Digest {
+		logg.Debug("checking vulnerabilities of %s using the index report of %s (same layers)", manifest.Digest, clairDigest)
+	}
+
+	//if the manifest was fully indexed before and has not been resubmitted since
+	//then (resubmission resets the status to Pending), we can go straight to the
+	//vulnerability report; this saves a roundtrip to Clair in the regular
+	//recheck loop (if the report is gone, we fall back to the full check below)
+	if vulnInfo.IndexFinishedAt != nil && oldStatus.HasReport() {
+		vulnStatus, found, err := j.getVulnerabilityStatusFromReport(ctx, clairDigest, cacheKey)
+		if err != nil {
+			return "", err
+		}
+		if found {
+			return vulnStatus, nil
+		}
+	}
+
+	renderManifest := func() (clair.Manifest, error) {
+		return j.buildClairManifest(account, clairDigest, layerBlobs)
+	}
+	clairState, err := j.cfg.ClairClient.CheckManifestState(ctx, clairDigest, renderManifest)
+	if err != nil {
+		return "", err
+	}
+	now := j.timeNow()
+	if vulnInfo.IndexStartedAt == nil {
+		vulnInfo.IndexStartedAt = &now
+		vulnInfo.IndexState = clairState.IndexState
+	}
+
+	switch {
+	case clairState.IndexingWasRestarted:
+		vulnInfo.IndexStartedAt = &now
+		vulnInfo.IndexState = clairState.IndexState
+		checkVulnerabilityRetriedCounter.Inc()
+		return clair.PendingVulnerabilityStatus, nil
+	case clairState.IsErrored:
+		vulnInfo.Message = j.truncateErrorMessage(clairState.ErrorMessage)
+		return clair.ErrorVulnerabilityStatus, nil
+	case clairState.IsIndexed:
+		if vulnInfo.IndexFinishedAt == nil {
+			vulnInfo.IndexFinishedAt = &now
+		}
+
+		vulnStatus, found, err := j.getVulnerabilityStatusFromReport(ctx, clairDigest, cacheKey)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			//nolint:stylecheck // Clair is a proper name
+			return "", fmt.Errorf("Clair reports indexing of %s as finished, but vulnerability report is 404", clairDigest)
+		}
+		return vulnStatus, nil
+	default:
+		//if indexing takes longer than the layer URLs stay valid, Clair cannot
+		//fetch the layers anymore, so resubmit the manifest with fresh layer URLs
+		if now.Sub(*vulnInfo.IndexStartedAt) > j.clairLayerURLTTL() {
+			err := j.cfg.ClairClient.DeleteManifest(ctx, clairDigest)
+			if err != nil {
+				return "", err
+			}
+			clairState, err := j.cfg.ClairClient.CheckManifestState(ctx, clairDigest, renderManifest)
+			if err != nil {
+				return "", err
+			}
+			vulnInfo.IndexStartedAt = &now
+			vulnInfo.IndexState = clairState.IndexState
+			checkVulnerabilityRetriedCounter.Inc()
+		}
+		return clair.PendingVulnerabilityStatus, nil
+	}
+}
+
+// Returns the vulnerability status from Clair's vulnerability report for the
+// manifest that was indexed under `clairDigest`, or found = false if Clair does
+// not have a report. Since images with the same layers have the same report,
+// the status is cached by layer list until Clair's vulnerability database gets
+// updated.
+func (j *Janitor) getVulnerabilityStatusFromReport(ctx context.Context, clairDigest, cacheKey string) (vulnStatus clair.VulnerabilityStatus, found bool, err error) {
+	//NOTE: The matcher version needs to be retrieved before the report. If the
+	//vulnerability database gets updated in between, the report is recorded
+	//under the old version and thus discarded on the next check.
+	matcherVersion := j.vulnReportCache.MatcherVersion(j.timeNow(), func() (string, error) {
+		return j.cfg.ClairClient.GetMatcherVersion(ctx)
+	})
+	vulnStatus, found = j.vulnReportCache.Get(cacheKey, matcherVersion)
+	if found {
+		vulnReportCacheHitCounter.Inc()
+		return vulnStatus, true, nil
+	}
+
+	clairReport, err := j.cfg.ClairClient.GetVulnerabilityReport(ctx, clairDigest)
+	if err != nil || clairReport == nil {
+		return "", false, err
+	}
+	vulnStatus = clairReport.VulnerabilityStatus()
+	j.vulnReportCache.Put(cacheKey, clairDigest, matcherVersion, vulnStatus)
+	return vulnStatus, true, nil
+}
+
+// Returns when a manifest that Clair is still indexing shall be checked again.
+// This is jittered since manifests are usually pushed in batches, and we don't
+// want to poll Clair for all of them at the same time.
+func (j *Janitor) nextClairIndexPollAt() time.Time {
+	return j.timeNow().Add(j.addJitter(j.clairIndexPollInterval))
+}
+
+func (j *Janitor) buildClairManifest(account keppel.Account, clairDigest string, layerBlobs []keppel.Blob) (clair.Manifest, error) {
 	result := clair.Manifest{
-		Digest: manifest.Digest,
+		Digest: clairDigest,
 	}
 
 	for _, blob := range layerBlobs {
-		blobURL, err := j.sd.URLForBlob(account, blob.StorageID)
+		blobURL, err := keppel.URLForBlobWithTTL(j.sd, account, blob.StorageID, j.clairLayerURLTTL())
 		//TODO handle ErrCannotGenerateURL (currently not a problem because all storage drivers can make URLs)
 		if err != nil {
 			return clair.Manifest{}, err
@@ -830,9 +1138,9 @@ var getDigestForIndexStatesToResubmitQuery = sqlext.SimplifyWhitespace(fmt.Sprin
 	LIMIT $3
 `, clair.PendingVulnerabilityStatus))
 
-func (j *Janitor) CheckClairManifestState() error {
+func (j *Janitor) CheckClairManifestState(ctx context.Context) error {
 	//limit the total runtime of this task
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	defer cancel()
 
 	indexStateHash, err := j.cfg.ClairClient.GetIndexStateHash(ctx)
@@ -876,8 +1184,11 @@ func (j *Janitor) CheckClairManifestState() error {
 }
 
 func (j *Janitor) setManifestAndParentsToPending(ctx context.Context, manifestDigest string) error {
+	//NOTE: 404 is not an error here: manifests that share their layers with
+	//another manifest are not indexed under their own digest (see type
+	//vulnReportCache)
 	err := j.cfg.ClairClient.DeleteManifest(ctx, manifestDigest)
-	if err != nil {
+	if err != nil && !strings.Contains(err.Error(), "got 404 response") {
 		return err
 	}
 
@@ -19,17 +19,25 @@
 package tasks
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/sapcc/go-bits/assert"
 	"github.com/sapcc/go-bits/easypg"
+	"github.com/sapcc/go-bits/respondwith"
 
 	"github.com/sapcc/keppel/internal/clair"
 	"github.com/sapcc/keppel/internal/keppel"
+	"github.com/sapcc/keppel/internal/processor"
 	"github.com/sapcc/keppel/internal/test"
 )
 
@@ -94,9 +102,14 @@ func testValidateNextManifestFixesDisturbance(t *testing.T, disturb func(*keppel
 }
 
 func TestValidateNextManifestFixesWrongSize(t *testing.T) {
+	//counters are global, so we need to compare against the value before the test
+	repairedBefore := getCounterValue(t, repairedManifestSizesCounter)
 	testValidateNextManifestFixesDisturbance(t, func(db *keppel.DB, allBlobIDs []int64, allManifestDigests []string) {
 		mustExec(t, db, `UPDATE manifests SET size_bytes = 1337`)
 	})
+	//only the validation after the disturbance had to correct sizes
+	repairedCount := getCounterValue(t, repairedManifestSizesCounter) - repairedBefore
+	assert.DeepEqual(t, "number of repaired manifest sizes", repairedCount, float64(3))
 }
 
 func TestValidateNextManifestFixesMissingManifestBlobRefs(t *testing.T) {
@@ -180,6 +193,252 @@ func TestValidateNextManifestError(t *testing.T) {
 	easypg.AssertDBContent(t, s.DB.DbMap.Db, "fixtures/manifest-validate-error-002.sql")
 }
 
+func TestValidateNextManifestSkipsAccountsInMaintenance(t *testing.T) {
+	j, s := setup(t)
+
+	//setup a manifest that does not exist in the storage at all, so any attempt
+	//to validate it would fail
+	s.Clock.StepBy(1 * time.Hour)
+	image := test.GenerateImage( /* no layers */ )
+	mustDo(t, s.DB.Insert(&keppel.Manifest{
+		RepositoryID: 1,
+		Digest:       image.Manifest.Digest.String(),
+		MediaType:    image.Manifest.MediaType,
+		SizeBytes:    image.SizeBytes(),
+		PushedAt:     s.Clock.Now(),
+		ValidatedAt:  s.Clock.Now(),
+	}))
+	mustExec(t, s.DB, `UPDATE accounts SET in_maintenance = TRUE WHERE name = $1`, "test1")
+
+	//while the account is in maintenance, validation is skipped without
+	//touching the storage, but `validated_at` is still advanced
+	s.Clock.StepBy(36 * time.Hour)
+	expectSuccess(t, j.ValidateNextManifest())
+	var manifest keppel.Manifest
+	mustDo(t, s.DB.SelectOne(&manifest, `SELECT * FROM manifests WHERE digest = $1`, image.Manifest.Digest.String()))
+	if !manifest.ValidatedAt.Equal(s.Clock.Now()) {
+		t.Errorf("expected validated_at = %s, but got %s", s.Clock.Now(), manifest.ValidatedAt)
+	}
+	if manifest.ValidationErrorMessage != "" {
+		t.Errorf("expected no validation error, but got %q", manifest.ValidationErrorMessage)
+	}
+	expectError(t, sql.ErrNoRows.Error(), j.ValidateNextManifest())
+
+	//once maintenance ends, the next validation finds the problem
+	mustExec(t, s.DB, `UPDATE accounts SET in_maintenance = FALSE WHERE name = $1`, "test1")
+	s.Clock.StepBy(36 * time.Hour)
+	err := j.ValidateNextManifest()
+	if err == nil {
+		t.Error("expected validation error after maintenance ended, but got none")
+	}
+}
+
+func TestClearManifestValidationError(t *testing.T) {
+	j, s := setup(t)
+
+	//setup a manifest that is missing a referenced blob (same as in TestValidateNextManifestError)
+	s.Clock.StepBy(1 * time.Hour)
+	image := test.GenerateImage( /* no layers */ )
+	mustDo(t, s.DB.Insert(&keppel.Manifest{
+		RepositoryID: 1,
+		Digest:       image.Manifest.Digest.String(),
+		MediaType:    image.Manifest.MediaType,
+		SizeBytes:    image.SizeBytes(),
+		PushedAt:     s.Clock.Now(),
+		ValidatedAt:  s.Clock.Now(),
+	}))
+	mustDo(t, s.SD.WriteManifest(*s.Accounts[0], "foo", image.Manifest.Digest.String(), image.Manifest.Contents))
+
+	//validation fails and the manifest is not revalidated right away
+	s.Clock.StepBy(36 * time.Hour)
+	expectError(t, fmt.Sprintf("while validating manifest %s in repo 1: manifest blob unknown to registry: %s",
+		image.Manifest.Digest.String(), image.Config.Digest.String(),
+	), j.ValidateNextManifest())
+	expectError(t, sql.ErrNoRows.Error(), j.ValidateNextManifest())
+
+	//fix the underlying problem and clear the validation error
+	image.Config.MustUpload(t, s, fooRepoRef)
+	mustDo(t, keppel.ClearManifestValidationError(s.DB, 1, image.Manifest.Digest.String()))
+	var manifest keppel.Manifest
+	mustDo(t, s.DB.SelectOne(&manifest, `SELECT * FROM manifests WHERE digest = $1`, image.Manifest.Digest.String()))
+	assert.DeepEqual(t, "validation_error_message", manifest.ValidationErrorMessage, "")
+
+	//the manifest is eligible for validation immediately, without waiting for the clock
+	expectSuccess(t, j.ValidateNextManifest())
+	expectError(t, sql.ErrNoRows.Error(), j.ValidateNextManifest())
+
+	//clearing the error for a nonexistent manifest fails
+	err := keppel.ClearManifestValidationError(s.DB, 1, "sha256:"+strings.Repeat("0", 64))
+	if err != sql.ErrNoRows {
+		t.Errorf("expected sql.ErrNoRows, but got %v", err)
+	}
+}
+
+func TestValidateNextManifestTruncatesErrorMessage(t *testing.T) {
+	j, s := setup(t)
+	j.SetMaxErrorMessageLength(40)
+
+	//setup a manifest that is missing a referenced blob (same as in TestValidateNextManifestError)
+	s.Clock.StepBy(1 * time.Hour)
+	image := test.GenerateImage( /* no layers */ )
+	mustDo(t, s.DB.Insert(&keppel.Manifest{
+		RepositoryID: 1,
+		Digest:       image.Manifest.Digest.String(),
+		MediaType:    image.Manifest.MediaType,
+		SizeBytes:    image.SizeBytes(),
+		PushedAt:     s.Clock.Now(),
+		ValidatedAt:  s.Clock.Now(),
+	}))
+	mustDo(t, s.SD.WriteManifest(*s.Accounts[0], "foo", image.Manifest.Digest.String(), image.Manifest.Contents))
+
+	//the error is returned in full...
+	s.Clock.StepBy(36 * time.Hour)
+	fullMessage := "manifest blob unknown to registry: " + image.Config.Digest.String()
+	expectError(t, fmt.Sprintf("while validating manifest %s in repo 1: %s", image.Manifest.Digest.String(), fullMessage), j.ValidateNextManifest())
+
+	//...but only stored in truncated form
+	var manifest keppel.Manifest
+	mustDo(t, s.DB.SelectOne(&manifest, `SELECT * FROM manifests WHERE digest = $1`, image.Manifest.Digest.String()))
+	assert.DeepEqual(t, "validation_error_message", manifest.ValidationErrorMessage, fullMessage[:39]+"…")
+
+	//truncation does not split multi-byte characters
+	j.SetMaxErrorMessageLength(4)
+	assert.DeepEqual(t, "truncated message", j.truncateErrorMessage("äöüßäöüß"), "äöü…")
+	assert.DeepEqual(t, "short message", j.truncateErrorMessage("äöüß"), "äöüß")
+}
+
+// slowStorageDriver is a keppel.StorageDriver whose reads of manifests (or
+// blobs) block until the caller's context expires.
+type slowStorageDriver struct {
+	keppel.StorageDriver
+	slowManifests bool
+	slowBlobs     bool
+}
+
+func (d slowStorageDriver) ReadManifestStreamWithContext(ctx context.Context, account keppel.Account, repoName, digest string) (io.ReadCloser, error) {
+	if d.slowManifests {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return keppel.ReadManifestStreamWithContext(ctx, d.StorageDriver, account, repoName, digest)
+}
+
+func (d slowStorageDriver) ReadBlobWithContext(ctx context.Context, account keppel.Account, storageID string) (io.ReadCloser, uint64, error) {
+	if d.slowBlobs {
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+	return keppel.ReadBlobWithContext(ctx, d.StorageDriver, account, storageID)
+}
+
+func TestValidateNextManifestStorageTimeout(t *testing.T) {
+	_, s := setup(t)
+	sd := slowStorageDriver{StorageDriver: s.SD, slowManifests: true}
+	j := NewJanitor(s.Config, s.FD, sd, s.ICD, s.DB, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+	j.DisableJitter()
+	j.SetStorageReadTimeout(10 * time.Millisecond)
+
+	//upload a manifest that is perfectly valid
+	s.Clock.StepBy(1 * time.Hour)
+	image := test.GenerateImage( /* no layers */ )
+	image.MustUpload(t, s, fooRepoRef, "")
+
+	//validation times out because the storage does not respond
+	s.Clock.StepBy(36 * time.Hour)
+	expectError(t, fmt.Sprintf("while validating manifest %s in repo 1: %s (timeout = 10ms)",
+		image.Manifest.Digest.String(), processor.ErrStorageReadTimeout.Error(),
+	), j.ValidateNextManifest())
+
+	//the timeout is not recorded as a validation error...
+	var manifest keppel.Manifest
+	mustDo(t, s.DB.SelectOne(&manifest, `SELECT * FROM manifests WHERE digest = $1`, image.Manifest.Digest.String()))
+	if manifest.ValidationErrorMessage != "" {
+		t.Errorf("expected no validation error, but got %q", manifest.ValidationErrorMessage)
+	}
+
+	//...but the validation is rescheduled to happen again in 10 minutes
+	expectError(t, sql.ErrNoRows.Error(), j.ValidateNextManifest())
+	s.Clock.StepBy(9 * time.Minute)
+	expectError(t, sql.ErrNoRows.Error(), j.ValidateNextManifest())
+	s.Clock.StepBy(2 * time.Minute)
+	expectError(t, fmt.Sprintf("while validating manifest %s in repo 1: %s (timeout = 10ms)",
+		image.Manifest.Digest.String(), processor.ErrStorageReadTimeout.Error(),
+	), j.ValidateNextManifest())
+}
+
+func TestValidateNextManifestConfigBlobTimeout(t *testing.T) {
+	_, s := setup(t)
+	sd := slowStorageDriver{StorageDriver: s.SD, slowBlobs: true}
+	j := NewJanitor(s.Config, s.FD, sd, s.ICD, s.DB, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
+	j.DisableJitter()
+	j.SetStorageReadTimeout(10 * time.Millisecond)
+
+	//upload a manifest that is perfectly valid
+	s.Clock.StepBy(1 * time.Hour)
+	image := test.GenerateImage(test.GenerateExampleLayer(1))
+	image.MustUpload(t, s, fooRepoRef, "")
+
+	//the read of the config blob is also covered by the timeout (the config
+	//blob needs to be evicted from the cache to force the validation to read it)
+	processor.ForgetManifestConfig(image.Config.Digest.String())
+	s.Clock.StepBy(36 * time.Hour)
+	expectError(t, fmt.Sprintf("while validating manifest %s in repo 1: %s (timeout = 10ms)",
+		image.Manifest.Digest.String(), processor.ErrStorageReadTimeout.Error(),
+	), j.ValidateNextManifest())
+}
+
+func TestValidateNextManifestConcurrently(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	const imageCount = 10
+	for idx := 0; idx < imageCount; idx++ {
+		image := test.GenerateImage(test.GenerateExampleLayer(int64(idx)))
+		image.MustUpload(t, s, fooRepoRef, "")
+	}
+
+	//run two job loops concurrently until they run out of work; since each
+	//successful run validates exactly one manifest, the total number of
+	//successful runs must match the number of manifests if no manifest was
+	//picked up by both job loops
+	s.Clock.StepBy(36 * time.Hour)
+	successCount := runConcurrently(t, 2, j.ValidateNextManifest)
+	assert.DeepEqual(t, "number of validated manifests", successCount, imageCount)
+}
+
+func TestValidateNextManifestFinishesOnShutdown(t *testing.T) {
+	j, s := setup(t)
+	s.Clock.StepBy(1 * time.Hour)
+
+	for idx := 0; idx < 2; idx++ {
+		image := test.GenerateImage(test.GenerateExampleLayer(int64(idx)))
+		image.MustUpload(t, s, fooRepoRef, "")
+	}
+
+	//simulate a shutdown signal arriving right when the job loop starts working
+	//on the first manifest: that task must be completed, but no further task
+	//shall be started
+	s.Clock.StepBy(36 * time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	jobLoops := NewJobLoopGroup(ctx, DefaultJobLoopIntervals)
+	jobLoops.Go(func() error {
+		cancel()
+		return j.ValidateNextManifest()
+	})
+	jobLoops.Wait()
+
+	var validatedCount, unvalidatedCount int
+	mustDo(t, s.DB.QueryRow(`SELECT COUNT(*) FROM manifests WHERE validated_at = $1`, s.Clock.Now()).Scan(&validatedCount))
+	mustDo(t, s.DB.QueryRow(`SELECT COUNT(*) FROM manifests WHERE validated_at < $1`, s.Clock.Now()).Scan(&unvalidatedCount))
+	assert.DeepEqual(t, "number of validated manifests", validatedCount, 1)
+	assert.DeepEqual(t, "number of unvalidated manifests", unvalidatedCount, 1)
+
+	//the interrupted job loop did not leave any half-finished work behind: the
+	//remaining manifest can be validated as usual
+	expectSuccess(t, j.ValidateNextManifest())
+	expectError(t, sql.ErrNoRows.Error(), j.ValidateNextManifest())
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // tests for SyncManifestsInNextRepo
 
@@ -385,6 +644,7 @@ func TestSyncManifestsInNextRepo(t *testing.T) {
 					DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
 					%[5]sUPDATE manifests SET validated_at = %[2]d WHERE repo_id = 1 AND digest = '%[3]s';
 					UPDATE repos SET next_manifest_sync_at = %[4]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+					INSERT INTO tag_history (id, repo_id, tag_name, old_digest, new_digest, moved_at, account_name, repo_name) VALUES (1, 1, 'latest', '%[6]s', '%[3]s', %[2]d, 'test1', 'foo');
 					UPDATE tags SET digest = '%[3]s', pushed_at = %[2]d, last_pulled_at = NULL WHERE repo_id = 1 AND name = 'latest';
 					DELETE FROM vuln_info WHERE repo_id = 1 AND digest = '%[1]s';
 				`,
@@ -393,6 +653,7 @@ func TestSyncManifestsInNextRepo(t *testing.T) {
 				images[2].Manifest.Digest.String(), //the manifest now tagged as "latest"
 				s1.Clock.Now().Add(1*time.Hour).Unix(),
 				manifestValidationBecauseOfExistingTag,
+				images[1].Manifest.Digest.String(), //the manifest previously tagged as "latest"
 			)
 			expectError(t, sql.ErrNoRows.Error(), j2.SyncManifestsInNextRepo())
 			tr.DBChanges().AssertEmpty()
@@ -451,6 +712,8 @@ func TestSyncManifestsInNextRepo(t *testing.T) {
 					DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[2]s';
 					DELETE FROM manifest_manifest_refs WHERE repo_id = 1 AND parent_digest = '%[2]s' AND child_digest = '%[3]s';
 					DELETE FROM manifest_manifest_refs WHERE repo_id = 1 AND parent_digest = '%[2]s' AND child_digest = '%[1]s';
+					DELETE FROM manifest_platforms WHERE repo_id = 1 AND digest = '%[2]s' AND child_digest = '%[3]s';
+					DELETE FROM manifest_platforms WHERE repo_id = 1 AND digest = '%[2]s' AND child_digest = '%[1]s';
 					DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
 					DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[2]s';
 					UPDATE repos SET next_manifest_sync_at = %[4]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
@@ -538,6 +801,363 @@ func answerMostWith404(h http.Handler) http.HandlerFunc {
 	}
 }
 
+func TestSyncManifestsWithoutReplicaSyncCapability(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use")
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//upload an image to the primary account and replicate it
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s2.Handler)
+
+		//the primary advertises that it does not support the replica-sync API (the
+		//endpoint is made unusable to verify that it does not get called)
+		tt.Handlers["registry.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/peer/v1/info":
+				respondwith.JSON(w, http.StatusOK, keppel.PeerInfo{Version: "test", Capabilities: []string{}})
+			case strings.HasPrefix(r.URL.Path, "/peer/v1/sync-replica/"):
+				http.Error(w, "unexpected call to sync-replica API", http.StatusInternalServerError)
+			default:
+				s1.Handler.ServeHTTP(w, r)
+			}
+		})
+
+		//delete the manifest on the primary side
+		s1.Clock.StepBy(2 * time.Hour)
+		mustExec(t, s1.DB, `DELETE FROM manifests WHERE digest = $1`, image.Manifest.Digest.String())
+
+		//SyncManifestsInNextRepo on the replica side should fall back to checking
+		//each manifest individually, and thus still notice the deletion
+		tr, _ := easypg.NewTracker(t, s2.DB.DbMap.Db)
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		tr.DBChanges().AssertEqualf(`
+				DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 1;
+				DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 2;
+				DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[1]s';
+				DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
+				UPDATE repos SET next_manifest_sync_at = %[2]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+				DELETE FROM vuln_info WHERE repo_id = 1 AND digest = '%[1]s';
+			`,
+			image.Manifest.Digest.String(),
+			s1.Clock.Now().Add(1*time.Hour).Unix(),
+		)
+	})
+}
+
+func TestSyncManifestsWithUnavailablePeerInfo(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use")
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//upload an image to the primary account and replicate it
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s2.Handler)
+
+		//the peer info API on the primary side is broken
+		replicaSyncCalls := 0
+		tt.Handlers["registry.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/peer/v1/info" {
+				http.Error(w, "database is on fire", http.StatusInternalServerError)
+				return
+			}
+			if strings.HasPrefix(r.URL.Path, "/peer/v1/sync-replica/") {
+				replicaSyncCalls++
+			}
+			s1.Handler.ServeHTTP(w, r)
+		})
+
+		//delete the manifest on the primary side
+		s1.Clock.StepBy(2 * time.Hour)
+		mustExec(t, s1.DB, `DELETE FROM manifests WHERE digest = $1`, image.Manifest.Digest.String())
+
+		//SyncManifestsInNextRepo on the replica side should not be aborted by this,
+		//but use the replica-sync API like before the peer info API existed
+		tr, _ := easypg.NewTracker(t, s2.DB.DbMap.Db)
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		tr.DBChanges().AssertEqualf(`
+				DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 1;
+				DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 2;
+				DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[1]s';
+				DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
+				UPDATE repos SET next_manifest_sync_at = %[2]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+				DELETE FROM vuln_info WHERE repo_id = 1 AND digest = '%[1]s';
+			`,
+			image.Manifest.Digest.String(),
+			s1.Clock.Now().Add(1*time.Hour).Unix(),
+		)
+		assert.DeepEqual(t, "calls to sync-replica API", replicaSyncCalls, 1)
+	})
+}
+
+func TestSyncManifestsWithDeletedManifestRetention(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use",
+			test.WithKeppelAPI,
+			test.WithDeletedManifestRetention(24*time.Hour),
+		)
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//upload two images to the primary account and replicate them (the second
+		//one stays on the primary side, so that the replica repo does not get empty)
+		images := []test.Image{
+			test.GenerateImage(test.GenerateExampleLayer(1)),
+			test.GenerateImage(test.GenerateExampleLayer(2)),
+		}
+		for _, image := range images {
+			image.MustUpload(t, s1, fooRepoRef, "")
+			assert.HTTPRequest{
+				Method:       "GET",
+				Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+				Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+				ExpectStatus: http.StatusOK,
+				ExpectBody:   assert.ByteData(image.Manifest.Contents),
+			}.Check(t, s2.Handler)
+		}
+		deletedDigest := images[0].Manifest.Digest.String()
+
+		//delete a manifest on the primary side
+		s1.Clock.StepBy(2 * time.Hour)
+		mustExec(t, s1.DB, `DELETE FROM manifests WHERE digest = $1`, deletedDigest)
+
+		//SyncManifestsInNextRepo on the replica side should only soft-delete the manifest
+		tr, _ := easypg.NewTracker(t, s2.DB.DbMap.Db)
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		tr.DBChanges().AssertEqualf(`
+				UPDATE manifests SET deleted_at = %[2]d WHERE repo_id = 1 AND digest = '%[1]s';
+				UPDATE repos SET next_manifest_sync_at = %[3]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+			`,
+			deletedDigest,
+			s1.Clock.Now().Unix(),
+			s1.Clock.Now().Add(1*time.Hour).Unix(),
+		)
+
+		//the soft-deleted manifest cannot be pulled anymore...
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + deletedDigest,
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusNotFound,
+		}.Check(t, s2.Handler)
+		tr.DBChanges().Ignore()
+
+		//...until it gets restored within the retention period
+		s1.Clock.StepBy(12 * time.Hour)
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         fmt.Sprintf("/keppel/v1/accounts/test1/repositories/foo/_manifests/%s/restore", deletedDigest),
+			Header:       map[string]string{"X-Test-Perms": "view:test1authtenant,pull:test1authtenant"},
+			ExpectStatus: http.StatusForbidden,
+		}.Check(t, s2.Handler)
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         fmt.Sprintf("/keppel/v1/accounts/test1/repositories/foo/_manifests/%s/restore", deletedDigest),
+			Header:       map[string]string{"X-Test-Perms": "view:test1authtenant,delete:test1authtenant"},
+			ExpectStatus: http.StatusNoContent,
+		}.Check(t, s2.Handler)
+		tr.DBChanges().AssertEqualf(`
+				UPDATE manifests SET deleted_at = NULL WHERE repo_id = 1 AND digest = '%s';
+			`,
+			deletedDigest,
+		)
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/" + deletedDigest,
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(images[0].Manifest.Contents),
+		}.Check(t, s2.Handler)
+		tr.DBChanges().Ignore()
+
+		//since the manifest is still missing on the primary side, the next sync
+		//soft-deletes it again...
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		tr.DBChanges().AssertEqualf(`
+				UPDATE manifests SET deleted_at = %[2]d WHERE repo_id = 1 AND digest = '%[1]s';
+				UPDATE repos SET next_manifest_sync_at = %[3]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+			`,
+			deletedDigest,
+			s1.Clock.Now().Unix(),
+			s1.Clock.Now().Add(1*time.Hour).Unix(),
+		)
+
+		//...and once the retention period has expired, the manifest is purged for good
+		s1.Clock.StepBy(25 * time.Hour)
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		tr.DBChanges().AssertEqualf(`
+				DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 1;
+				DELETE FROM manifest_blob_refs WHERE repo_id = 1 AND digest = '%[1]s' AND blob_id = 2;
+				DELETE FROM manifest_contents WHERE repo_id = 1 AND digest = '%[1]s';
+				DELETE FROM manifests WHERE repo_id = 1 AND digest = '%[1]s';
+				UPDATE repos SET next_manifest_sync_at = %[2]d WHERE id = 1 AND account_name = 'test1' AND name = 'foo';
+				DELETE FROM vuln_info WHERE repo_id = 1 AND digest = '%[1]s';
+			`,
+			deletedDigest,
+			s1.Clock.Now().Add(1*time.Hour).Unix(),
+		)
+
+		//at this point, the manifest cannot be restored anymore
+		assert.HTTPRequest{
+			Method:       "POST",
+			Path:         fmt.Sprintf("/keppel/v1/accounts/test1/repositories/foo/_manifests/%s/restore", deletedDigest),
+			Header:       map[string]string{"X-Test-Perms": "view:test1authtenant,delete:test1authtenant"},
+			ExpectStatus: http.StatusNotFound,
+		}.Check(t, s2.Handler)
+	})
+}
+
+func TestSyncManifestsAcrossReplicationChain(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		//setup a chain of three registries: primary -> secondary -> tertiary
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use")
+		s3 := test.NewSetup(t,
+			test.IsTertiaryTo(&s2),
+			test.WithPeerAPI,
+			test.WithAccount(keppel.Account{
+				Name:                 "test1",
+				AuthTenantID:         "test1authtenant",
+				UpstreamPeerHostName: "registry-secondary.example.org",
+			}),
+			test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
+			test.WithQuotas,
+		)
+		j3 := NewJanitor(s3.Config, s3.FD, s3.SD, s3.ICD, s3.DB, s3.Auditor).OverrideTimeNow(s3.Clock.Now).OverrideGenerateStorageID(s3.SIDGenerator.Next)
+		j3.DisableJitter()
+		s1.Clock.StepBy(1 * time.Hour)
+
+		//upload an image to the primary account and pull it from the tertiary;
+		//this replicates it through the secondary
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+			Header:       map[string]string{"Authorization": "Bearer " + s3.GetToken(t, "repository:test1/foo:pull")},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s3.Handler)
+
+		expectManifestCount := func(s test.Setup, expected int) {
+			t.Helper()
+			count, err := s.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE digest = $1`, image.Manifest.Digest.String())
+			mustDo(t, err)
+			if count != int64(expected) {
+				t.Errorf("expected %d manifests in %s, but got %d", expected, s.Config.APIPublicHostname, count)
+			}
+		}
+		expectManifestCount(s2, 1)
+		expectManifestCount(s3, 1)
+
+		//delete the manifest on the primary side
+		s1.Clock.StepBy(2 * time.Hour)
+		mustExec(t, s1.DB, `DELETE FROM manifests WHERE digest = $1`, image.Manifest.Digest.String())
+
+		//the tertiary only asks its immediate upstream, which still has the manifest
+		expectSuccess(t, j3.SyncManifestsInNextRepo())
+		expectManifestCount(s3, 1)
+
+		//once the deletion has reached the secondary...
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		expectManifestCount(s2, 0)
+
+		//...the next sync propagates it to the tertiary as well
+		s1.Clock.StepBy(2 * time.Hour)
+		expectSuccess(t, j3.SyncManifestsInNextRepo())
+		expectManifestCount(s3, 0)
+	})
+}
+
+func TestReplicateBlobIsIdempotent(t *testing.T) {
+	test.WithRoundTripper(func(tt *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use")
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//upload an image to the primary account and replicate only its manifest,
+		//so that the replica has an unbacked blob for the layer
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s2.Handler)
+		blob, err := keppel.FindBlobByAccountName(s2.DB, image.Layers[0].Digest, *s2.Accounts[0])
+		mustDo(t, err)
+		assert.DeepEqual(t, "blob storage ID before replication", blob.StorageID, "")
+
+		//count how often the blob gets downloaded from the primary
+		var (
+			mutex         sync.Mutex
+			downloadCount int
+		)
+		blobPath := fmt.Sprintf("/v2/test1/foo/blobs/%s", image.Layers[0].Digest.String())
+		tt.Handlers["registry.example.org"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && r.URL.Path == blobPath {
+				mutex.Lock()
+				downloadCount++
+				mutex.Unlock()
+			}
+			s1.Handler.ServeHTTP(w, r)
+		})
+
+		//replicate the blob twice concurrently (both callers only know the
+		//unbacked blob): either the second call finds the replication in progress,
+		//or it finds that the blob has arrived in the meantime
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for idx := range errs {
+			wg.Add(1)
+			go func(idx int) {
+				defer wg.Done()
+				_, errs[idx] = j2.processor().ReplicateBlob(*blob, *s2.Accounts[0], *s2.Repos[0], nil)
+			}(idx)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil && err != processor.ErrConcurrentReplication {
+				t.Errorf("unexpected error from ReplicateBlob: %s", err.Error())
+			}
+		}
+		assert.DeepEqual(t, "download count", downloadCount, 1)
+
+		//retrying with the outdated blob after the replication has finished is a no-op
+		_, err = j2.processor().ReplicateBlob(*blob, *s2.Accounts[0], *s2.Repos[0], nil)
+		mustDo(t, err)
+		assert.DeepEqual(t, "download count", downloadCount, 1)
+
+		replicatedBlob, err := keppel.FindBlobByAccountName(s2.DB, image.Layers[0].Digest, *s2.Accounts[0])
+		mustDo(t, err)
+		if replicatedBlob.StorageID == "" {
+			t.Error("expected blob to be replicated, but it is still unbacked")
+		}
+	})
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // tests for CheckVulnerabilitiesForNextManifest
 
@@ -586,8 +1206,8 @@ func TestCheckVulnerabilitiesForNextManifest(t *testing.T) {
 		//stay in vulnerability status "Pending" for now
 		s.Clock.StepBy(30 * time.Minute)
 		//once for each manifest
-		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(), 5))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 5))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE blobs SET blocks_vuln_scanning = FALSE WHERE id = 1 AND account_name = 'test1' AND digest = '%[8]s';
 			UPDATE blobs SET blocks_vuln_scanning = FALSE WHERE id = 3 AND account_name = 'test1' AND digest = '%[9]s';
@@ -608,8 +1228,8 @@ func TestCheckVulnerabilitiesForNextManifest(t *testing.T) {
 		//five minutes later, indexing is still not finished
 		s.Clock.StepBy(5 * time.Minute)
 		//once for each manifest
-		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(), 3))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 3))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET next_check_at = 5820, checked_at = 5700 WHERE repo_id = 1 AND digest = '%s';
 			UPDATE vuln_info SET next_check_at = 5820, checked_at = 5700 WHERE repo_id = 1 AND digest = '%s';
@@ -621,8 +1241,8 @@ func TestCheckVulnerabilitiesForNextManifest(t *testing.T) {
 		s.ClairDouble.ReportFixtures[images[1].Manifest.Digest.String()] = "fixtures/clair/report-clean.json"
 		s.Clock.StepBy(5 * time.Minute)
 		//once for each manifest
-		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(), 3))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 3))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET status = 'Low', next_check_at = 9600, checked_at = 6000, index_finished_at = 6000 WHERE repo_id = 1 AND digest = '%s';
 			UPDATE vuln_info SET next_check_at = 6120, checked_at = 6000 WHERE repo_id = 1 AND digest = '%s';
@@ -630,19 +1250,243 @@ func TestCheckVulnerabilitiesForNextManifest(t *testing.T) {
 		`, images[0].Manifest.Digest, images[2].Manifest.Digest, images[1].Manifest.Digest)
 
 		// check that a changed vulnerability status does not have side effects
+		s.Events.IgnoreEventsUntilNow()
 		s.ClairDouble.ReportFixtures[images[1].Manifest.Digest.String()] = "fixtures/clair/report-vulnerable.json"
+		s.ClairDouble.MatcherVersion = `"e0b6c5b1-6f0e-4a0c-8d36-2d2f3a4b5c6d"` //the report only changes when Clair's vulnerability DB was updated
 		s.Clock.StepBy(1 * time.Hour)
 		//once for each manifest
-		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(), 3))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 3))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET next_check_at = 13200, checked_at = 9600 WHERE repo_id = 1 AND digest = '%[1]s';
-			UPDATE vuln_info SET next_check_at = 9720, checked_at = 9600 WHERE repo_id = 1 AND digest = '%[2]s';
+			UPDATE vuln_info SET next_check_at = 9720, checked_at = 9600, index_started_at = 9600 WHERE repo_id = 1 AND digest = '%[2]s';
 			UPDATE vuln_info SET status = 'Low', next_check_at = 13200, checked_at = 9600 WHERE repo_id = 1 AND digest = '%[3]s';
 		`, images[0].Manifest.Digest, images[2].Manifest.Digest, images[1].Manifest.Digest)
+
+		//images[2] has been indexing for longer than the layer URLs stay valid, so it was resubmitted with fresh URLs
+		assert.DeepEqual(t, "delete counter", s.ClairDouble.IndexDeleteCounter, 1)
+
+		//...except for the event that reports the status change
+		s.Events.ExpectEvents(t, keppel.VulnerabilityStatusChangedEventType, keppel.VulnerabilityStatusChangedEvent{
+			Account:    *s.Accounts[0],
+			Repository: *s.Repos[0],
+			Digest:     images[1].Manifest.Digest.String(),
+			OldStatus:  clair.CleanSeverity,
+			NewStatus:  clair.LowSeverity,
+			ChangedAt:  s.Clock.Now(),
+		})
 	})
 }
 
+func TestCheckVulnerabilitiesResubmitsAfterLayerURLsExpire(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		j, s := setup(t, test.WithClairDouble)
+		j.SetClairIndexingTime(10 * time.Minute) //layer URLs stay valid for 30 minutes
+		s.Clock.StepBy(1 * time.Hour)
+		tr, _ := easypg.NewTracker(t, s.DB.DbMap.Db)
+
+		image := test.GenerateImage(test.GenerateExampleLayer(4))
+		image.MustUpload(t, s, fooRepoRef, "")
+		tr.DBChanges().Ignore()
+
+		//submit manifest to Clair, which then does not get around to indexing it
+		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-004.json"
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		tr.DBChanges().Ignore()
+		assert.DeepEqual(t, "submit counter", s.ClairDouble.IndexSubmitCounter, 1)
+
+		//while the layer URLs are still valid, we keep waiting for Clair
+		s.Clock.StepBy(20 * time.Minute)
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		tr.DBChanges().AssertEqualf(`
+			UPDATE vuln_info SET next_check_at = %[2]d, checked_at = %[3]d WHERE repo_id = 1 AND digest = '%[1]s';
+		`, image.Manifest.Digest, s.Clock.Now().Add(2*time.Minute).Unix(), s.Clock.Now().Unix())
+		assert.DeepEqual(t, "delete counter", s.ClairDouble.IndexDeleteCounter, 0)
+		assert.DeepEqual(t, "submit counter", s.ClairDouble.IndexSubmitCounter, 1)
+
+		//once the layer URLs have expired, the manifest is resubmitted with fresh layer URLs
+		s.Clock.StepBy(20 * time.Minute)
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		tr.DBChanges().AssertEqualf(`
+			UPDATE vuln_info SET next_check_at = %[2]d, checked_at = %[3]d, index_started_at = %[3]d WHERE repo_id = 1 AND digest = '%[1]s';
+		`, image.Manifest.Digest, s.Clock.Now().Add(2*time.Minute).Unix(), s.Clock.Now().Unix())
+		assert.DeepEqual(t, "delete counter", s.ClairDouble.IndexDeleteCounter, 1)
+		assert.DeepEqual(t, "submit counter", s.ClairDouble.IndexSubmitCounter, 2)
+	})
+}
+
+func TestCheckVulnerabilitiesReusesReportForSameLayers(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		j, s := setup(t, test.WithClairDouble)
+		s.Clock.StepBy(1 * time.Hour)
+
+		//push the same image into two repos, so that we have two manifests with the same layers
+		barRepoRef := keppel.Repository{AccountName: "test1", Name: "bar"}
+		image := test.GenerateImage(test.GenerateExampleLayer(0))
+		image.MustUpload(t, s, fooRepoRef, "")
+		image.Layers[0].MustUpload(t, s, barRepoRef)
+		image.Config.MustUpload(t, s, barRepoRef)
+		image.MustUpload(t, s, barRepoRef, "")
+
+		//Clair finishes indexing immediately, so that we get to the vulnerability report right away
+		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-001.json"
+		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-vulnerable.json"
+
+		//the vulnerability report is only retrieved for the first manifest, the
+		//second manifest reuses it since it has the same set of layers
+		s.Clock.StepBy(30 * time.Minute)
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 2))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		assert.DeepEqual(t, "report request counter", s.ClairDouble.ReportRequestCounter, 1)
+		//the image is also only submitted to Clair for indexing once
+		assert.DeepEqual(t, "submit counter", s.ClairDouble.IndexSubmitCounter, 1)
+		expectVulnerabilityStatus(t, s, image.Manifest.Digest.String(), clair.LowSeverity, clair.LowSeverity)
+		//the matcher version is also only asked for once, not once per check
+		assert.DeepEqual(t, "matcher version request counter", s.ClairDouble.MatcherVersionRequestCounter, 1)
+
+		//when Clair's vulnerability DB gets updated, the cached report is discarded
+		//and the new report is retrieved (again only once)
+		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-clean.json"
+		s.ClairDouble.MatcherVersion = `"e0b6c5b1-6f0e-4a0c-8d36-2d2f3a4b5c6d"`
+		s.Clock.StepBy(1 * time.Hour)
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 2))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		assert.DeepEqual(t, "report request counter", s.ClairDouble.ReportRequestCounter, 2)
+		expectVulnerabilityStatus(t, s, image.Manifest.Digest.String(), clair.CleanSeverity, clair.CleanSeverity)
+	})
+}
+
+func TestVulnReportCacheSharesIndexForSameLayerOrder(t *testing.T) {
+	layers := []keppel.Blob{{Digest: "sha256:aaaa"}, {Digest: "sha256:bbbb"}}
+	reversedLayers := []keppel.Blob{layers[1], layers[0]}
+	key := vulnReportCacheKey(layers)
+
+	//the layer order is part of the image, so it must be part of the key
+	if key == vulnReportCacheKey(reversedLayers) {
+		t.Error("expected different cache keys for different layer orders")
+	}
+
+	//the first manifest with a given layer list gets indexed, all later
+	//manifests with the same layer list reuse its index report
+	c := newVulnReportCache()
+	assert.DeepEqual(t, "indexed manifest", c.IndexedManifestDigest(key, "sha256:first"), "sha256:first")
+	assert.DeepEqual(t, "indexed manifest", c.IndexedManifestDigest(key, "sha256:second"), "sha256:first")
+
+	//the index report stays shared when the matcher version changes, only the
+	//vulnerability status is discarded
+	c.Put(key, "sha256:first", "v1", clair.LowSeverity)
+	status, ok := c.Get(key, "v1")
+	assert.DeepEqual(t, "cache hit", ok, true)
+	assert.DeepEqual(t, "status", status, clair.LowSeverity)
+	_, ok = c.Get(key, "v2")
+	assert.DeepEqual(t, "cache hit", ok, false)
+	assert.DeepEqual(t, "indexed manifest", c.IndexedManifestDigest(key, "sha256:third"), "sha256:first")
+}
+
+func TestCheckVulnerabilitiesWithoutMatcherVersion(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		j, s := setup(t, test.WithClairDouble)
+		s.Clock.StepBy(1 * time.Hour)
+
+		//push the same image into two repos, so that we have two manifests with the same layers
+		barRepoRef := keppel.Repository{AccountName: "test1", Name: "bar"}
+		image := test.GenerateImage(test.GenerateExampleLayer(0))
+		image.MustUpload(t, s, fooRepoRef, "")
+		image.Layers[0].MustUpload(t, s, barRepoRef)
+		image.Config.MustUpload(t, s, barRepoRef)
+		image.MustUpload(t, s, barRepoRef, "")
+
+		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-001.json"
+		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-vulnerable.json"
+
+		//if Clair cannot tell us its matcher version, the vulnerability checks
+		//still succeed, but the report cache is bypassed
+		s.ClairDouble.MatcherVersionFails = true
+		s.Clock.StepBy(30 * time.Minute)
+		expectSuccess(t, ExecuteN(j.CheckVulnerabilitiesForNextManifest(context.Background()), 2))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		assert.DeepEqual(t, "report request counter", s.ClairDouble.ReportRequestCounter, 2)
+		expectVulnerabilityStatus(t, s, image.Manifest.Digest.String(), clair.LowSeverity, clair.LowSeverity)
+	})
+}
+
+func TestVulnerabilityCheckDetectsWorseningStatus(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		j, s := setup(t, test.WithClairDouble)
+		s.Clock.StepBy(1 * time.Hour)
+
+		image := test.GenerateImage(test.GenerateExampleLayer(0))
+		image.MustUpload(t, s, fooRepoRef, "")
+		manifest, err := keppel.FindManifest(s.DB, *s.Repos[0], image.Manifest.Digest.String())
+		mustDo(t, err)
+
+		//Clair finishes indexing immediately, and initially the image is clean
+		s.Clock.StepBy(30 * time.Minute)
+		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-001.json"
+		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-clean.json"
+		vulnInfo, err := keppel.GetVulnerabilityInfo(s.DB, s.Repos[0].ID, image.Manifest.Digest.String())
+		mustDo(t, err)
+		mustDo(t, j.doVulnerabilityCheck(context.Background(), *s.Accounts[0], *s.Repos[0], *manifest, vulnInfo))
+		assert.DeepEqual(t, "vulnerability status", vulnInfo.Status, clair.CleanSeverity)
+		s.Events.IgnoreEventsUntilNow()
+
+		//a new CVE gets published that affects the image: the next check shall
+		//report the worsened status through an event and a metric
+		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-vulnerable.json"
+		s.ClairDouble.MatcherVersion = `"e0b6c5b1-6f0e-4a0c-8d36-2d2f3a4b5c6d"` //the report only changes when Clair's vulnerability DB was updated
+		s.Clock.StepBy(1 * time.Hour)
+		worsenedCountBefore := getCounterValue(t, vulnerabilityStatusWorsenedCounter)
+		mustDo(t, j.doVulnerabilityCheck(context.Background(), *s.Accounts[0], *s.Repos[0], *manifest, vulnInfo))
+		assert.DeepEqual(t, "vulnerability status", vulnInfo.Status, clair.LowSeverity)
+		assert.DeepEqual(t, "worsened statuses", getCounterValue(t, vulnerabilityStatusWorsenedCounter)-worsenedCountBefore, float64(1))
+		expectedEvent := keppel.VulnerabilityStatusChangedEvent{
+			Account:    *s.Accounts[0],
+			Repository: *s.Repos[0],
+			Digest:     image.Manifest.Digest.String(),
+			OldStatus:  clair.CleanSeverity,
+			NewStatus:  clair.LowSeverity,
+			ChangedAt:  s.Clock.Now(),
+		}
+		assert.DeepEqual(t, "IsWorsening", expectedEvent.IsWorsening(), true)
+		s.Events.ExpectEvents(t, keppel.VulnerabilityStatusChangedEventType, expectedEvent)
+
+		//when the CVE gets fixed, the improvement is reported as a status change,
+		//but not counted as worsening
+		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-clean.json"
+		s.ClairDouble.MatcherVersion = `"9a7e5d0c-2b4f-4e61-a3c8-5f1d7b9e0c2a"`
+		s.Clock.StepBy(1 * time.Hour)
+		worsenedCountBefore = getCounterValue(t, vulnerabilityStatusWorsenedCounter)
+		mustDo(t, j.doVulnerabilityCheck(context.Background(), *s.Accounts[0], *s.Repos[0], *manifest, vulnInfo))
+		assert.DeepEqual(t, "vulnerability status", vulnInfo.Status, clair.CleanSeverity)
+		assert.DeepEqual(t, "worsened statuses", getCounterValue(t, vulnerabilityStatusWorsenedCounter)-worsenedCountBefore, float64(0))
+		s.Events.ExpectEvents(t, keppel.VulnerabilityStatusChangedEventType, keppel.VulnerabilityStatusChangedEvent{
+			Account:    *s.Accounts[0],
+			Repository: *s.Repos[0],
+			Digest:     image.Manifest.Digest.String(),
+			OldStatus:  clair.LowSeverity,
+			NewStatus:  clair.CleanSeverity,
+			ChangedAt:  s.Clock.Now(),
+		})
+	})
+}
+
+func getCounterValue(t *testing.T, counter prometheus.Counter) float64 {
+	t.Helper()
+	var metric dto.Metric
+	mustDo(t, counter.Write(&metric))
+	return metric.GetCounter().GetValue()
+}
+
+func expectVulnerabilityStatus(t *testing.T, s test.Setup, digest string, expected ...clair.VulnerabilityStatus) {
+	t.Helper()
+	var actual []clair.VulnerabilityStatus
+	_, err := s.DB.Select(&actual, `SELECT status FROM vuln_info WHERE digest = $1 ORDER BY repo_id`, digest)
+	mustDo(t, err)
+	assert.DeepEqual(t, "vulnerability statuses", actual, expected)
+}
+
 func TestCheckVulnerabilitiesForNextManifestWithError(t *testing.T) {
 	test.WithRoundTripper(func(_ *test.RoundTripper) {
 		j, s := setup(t, test.WithClairDouble)
@@ -655,8 +1499,8 @@ func TestCheckVulnerabilitiesForNextManifestWithError(t *testing.T) {
 
 		// submit manifest to clair
 		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-004.json"
-		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE blobs SET blocks_vuln_scanning = FALSE WHERE id = 1 AND account_name = 'test1' AND digest = '%[1]s';
 			UPDATE vuln_info SET next_check_at = %[3]d, checked_at = %[4]d, index_started_at = %[4]d, index_state = '%[5]s', check_duration_secs = 0 WHERE repo_id = 1 AND digest = '%[2]s';
@@ -667,8 +1511,8 @@ func TestCheckVulnerabilitiesForNextManifestWithError(t *testing.T) {
 		s.Clock.StepBy(30 * time.Minute)
 		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-004.json"
 		s.ClairDouble.IndexReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-error.json"
-		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET next_check_at = %[2]d, checked_at = %[3]d, index_started_at = %[3]d WHERE repo_id = 1 AND digest = '%[1]s';
 		`, image.Manifest.Digest, s.Clock.Now().Add(2*time.Minute).Unix(), s.Clock.Now().Unix())
@@ -679,8 +1523,8 @@ func TestCheckVulnerabilitiesForNextManifestWithError(t *testing.T) {
 		s.ClairDouble.IndexFixtures[image.Manifest.Digest.String()] = "fixtures/clair/manifest-004.json"
 		s.ClairDouble.IndexReportFixtures[image.Manifest.Digest.String()] = ""
 		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-vulnerable.json"
-		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET status = '%[4]s', next_check_at = %[2]d, checked_at = %[3]d, index_finished_at = %[3]d WHERE repo_id = 1 AND digest = '%[1]s';
 		`, image.Manifest.Digest, s.Clock.Now().Add(60*time.Minute).Unix(), s.Clock.Now().Unix(), clair.LowSeverity)
@@ -689,15 +1533,15 @@ func TestCheckVulnerabilitiesForNextManifestWithError(t *testing.T) {
 		// also the clair configuration was updated to make transient errors less likely to happen
 		s.Clock.StepBy(10 * time.Minute)
 		s.ClairDouble.IndexState = "a8b9e94aa9c8e4bb2818af1f52507b0b"
-		expectSuccess(t, j.CheckClairManifestState())
+		expectSuccess(t, j.CheckClairManifestState(context.Background()))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET status = '%[3]s', next_check_at = %[2]d, index_state = '' WHERE repo_id = 1 AND digest = '%[1]s';
 		`, image.Manifest.Digest, s.Clock.Now().Unix(), clair.PendingVulnerabilityStatus)
 		assert.DeepEqual(t, "delete counter", s.ClairDouble.IndexDeleteCounter, 2)
 
 		// clair is not done yet creating the report
-		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET next_check_at = %[2]d, checked_at = %[3]d WHERE repo_id = 1 AND digest = '%[1]s';
 		`, image.Manifest.Digest, s.Clock.Now().Add(2*time.Minute).Unix(), s.Clock.Now().Unix())
@@ -705,10 +1549,150 @@ func TestCheckVulnerabilitiesForNextManifestWithError(t *testing.T) {
 		// now clair is done
 		s.Clock.StepBy(10 * time.Minute)
 		s.ClairDouble.ReportFixtures[image.Manifest.Digest.String()] = "fixtures/clair/report-vulnerable.json"
-		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
-		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest()))
+		expectSuccess(t, ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
+		expectError(t, sql.ErrNoRows.Error(), ExecuteOne(j.CheckVulnerabilitiesForNextManifest(context.Background())))
 		tr.DBChanges().AssertEqualf(`
 			UPDATE vuln_info SET status = '%[4]s', next_check_at = %[2]d, checked_at = %[3]d WHERE repo_id = 1 AND digest = '%[1]s';
 		`, image.Manifest.Digest, s.Clock.Now().Add(60*time.Minute).Unix(), s.Clock.Now().Unix(), clair.LowSeverity)
 	})
 }
+
+func TestCheckVulnerabilitiesWaitsForBlobReplicationGracePeriod(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use", test.WithClairDouble)
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//configure a grace period that is longer than the default
+		mustExec(t, s2.DB, `UPDATE accounts SET blob_replication_grace_period_secs = $1`, 1800)
+
+		//replicate only the manifest, so that the replica has an unbacked blob for the layer
+		image := test.GenerateImage(test.GenerateExampleLayer(1))
+		image.MustUpload(t, s1, fooRepoRef, "")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s2.Handler)
+		manifest, err := keppel.FindManifest(s2.DB, *s2.Repos[0], image.Manifest.Digest.String())
+		mustDo(t, err)
+
+		//after the default grace period, but within the configured one, the
+		//vulnerability check waits for the blob to be replicated by the user
+		s2.Clock.StepBy(20 * time.Minute)
+		expectSuccess(t, ExecuteOne(j2.CheckVulnerabilitiesForNextManifest(context.Background())))
+		blob, err := keppel.FindBlobByAccountName(s2.DB, image.Layers[0].Digest, *s2.Accounts[0])
+		mustDo(t, err)
+		assert.DeepEqual(t, "blob storage ID within grace period", blob.StorageID, "")
+		vulnInfo, err := keppel.GetVulnerabilityInfo(s2.DB, s2.Repos[0].ID, image.Manifest.Digest.String())
+		mustDo(t, err)
+		assert.DeepEqual(t, "next check", vulnInfo.NextCheckAt.Unix(), manifest.PushedAt.Add(30*time.Minute).Unix())
+
+		//after the configured grace period, the vulnerability check replicates
+		//the blob itself (the subsequent submission to Clair is not relevant for
+		//this test, so we do not check its result)
+		s2.Clock.StepBy(15 * time.Minute)
+		_ = ExecuteOne(j2.CheckVulnerabilitiesForNextManifest(context.Background()))
+		blob, err = keppel.FindBlobByAccountName(s2.DB, image.Layers[0].Digest, *s2.Accounts[0])
+		mustDo(t, err)
+		if blob.StorageID == "" {
+			t.Error("expected blob to be replicated after the grace period, but it is still unbacked")
+		}
+	})
+}
+
+func TestCheckVulnerabilitiesUsesJanitorClockForBlobReplicationGracePeriod(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "on_first_use", test.WithClairDouble)
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//replicate only the manifest, so that the replica has an unbacked blob for the layer
+		image := test.GenerateImage(test.GenerateExampleLayer(2))
+		image.MustUpload(t, s1, fooRepoRef, "")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         fmt.Sprintf("/v2/test1/foo/manifests/%s", image.Manifest.Digest.String()),
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image.Manifest.Contents),
+		}.Check(t, s2.Handler)
+
+		//the fake clock is far behind the real clock, so this only works if the
+		//grace period is measured with the janitor's clock: right before the end
+		//of the default grace period, the check still waits...
+		s2.Clock.StepBy(keppel.DefaultBlobReplicationGracePeriod - time.Second)
+		expectSuccess(t, ExecuteOne(j2.CheckVulnerabilitiesForNextManifest(context.Background())))
+		blob, err := keppel.FindBlobByAccountName(s2.DB, image.Layers[0].Digest, *s2.Accounts[0])
+		mustDo(t, err)
+		assert.DeepEqual(t, "blob storage ID within grace period", blob.StorageID, "")
+
+		//...and right after it, the check replicates the blob itself (the
+		//subsequent submission to Clair is not relevant for this test)
+		s2.Clock.StepBy(2 * time.Second)
+		_ = ExecuteOne(j2.CheckVulnerabilitiesForNextManifest(context.Background()))
+		blob, err = keppel.FindBlobByAccountName(s2.DB, image.Layers[0].Digest, *s2.Accounts[0])
+		mustDo(t, err)
+		if blob.StorageID == "" {
+			t.Error("expected blob to be replicated after the grace period, but it is still unbacked")
+		}
+	})
+}
+
+func TestSyncManifestsWithExternalPeerCacheTTL(t *testing.T) {
+	test.WithRoundTripper(func(_ *test.RoundTripper) {
+		_, s1 := setup(t)
+		j2, s2 := setupReplica(t, s1, "from_external_on_first_use")
+		mustExec(t, s2.DB, `UPDATE accounts SET external_peer_cache_ttl_secs = $1`, int64((3 * time.Hour).Seconds()))
+		s1.Clock.StepBy(1 * time.Hour)
+		replicaToken := s2.GetToken(t, "repository:test1/foo:pull")
+
+		//upload an image to the upstream registry and pull it through the replica
+		image1 := test.GenerateImage(test.GenerateExampleLayer(1))
+		image1.MustUpload(t, s1, fooRepoRef, "latest")
+		assert.HTTPRequest{
+			Method:       "GET",
+			Path:         "/v2/test1/foo/manifests/latest",
+			Header:       map[string]string{"Authorization": "Bearer " + replicaToken},
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   assert.ByteData(image1.Manifest.Contents),
+		}.Check(t, s2.Handler)
+
+		//the first sync does not change anything, but schedules the next sync
+		//according to the cache TTL instead of the default interval
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		expectTagDigest := func(expected string) {
+			t.Helper()
+			actual, err := s2.DB.SelectStr(`SELECT digest FROM tags WHERE repo_id = 1 AND name = 'latest'`)
+			mustDo(t, err)
+			if actual != expected {
+				t.Errorf("expected tag to point to %s, but got %q", expected, actual)
+			}
+		}
+		expectTagDigest(image1.Manifest.Digest.String())
+
+		//move the tag upstream
+		image2 := test.GenerateImage(test.GenerateExampleLayer(2))
+		image2.MustUpload(t, s1, fooRepoRef, "latest")
+
+		//before the TTL has expired, the replica does not re-validate its cache
+		s1.Clock.StepBy(2 * time.Hour)
+		expectError(t, sql.ErrNoRows.Error(), j2.SyncManifestsInNextRepo())
+		expectTagDigest(image1.Manifest.Digest.String())
+
+		//after the TTL has expired, the tag is re-resolved, and the old manifest
+		//(which is not pulled anymore) is evicted from the cache
+		s1.Clock.StepBy(2 * time.Hour)
+		expectSuccess(t, j2.SyncManifestsInNextRepo())
+		expectTagDigest(image2.Manifest.Digest.String())
+		count, err := s2.DB.SelectInt(`SELECT COUNT(*) FROM manifests WHERE digest = $1`, image1.Manifest.Digest.String())
+		mustDo(t, err)
+		if count != 0 {
+			t.Errorf("expected manifest %s to be evicted, but it is still there", image1.Manifest.Digest)
+		}
+	})
+}
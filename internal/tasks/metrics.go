@@ -41,6 +41,14 @@ var (
 		Name: "keppel_retried_vulnerability_checks",
 		Help: "Counter for vulnerability checks that were retried due to transient errors in Clair.",
 	})
+	vulnReportCacheHitCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_vulnerability_report_cache_hits",
+		Help: "Counter for vulnerability checks that reused the vulnerability report of an image with the same layers.",
+	})
+	vulnerabilityStatusWorsenedCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_worsened_vulnerability_statuses",
+		Help: "Counter for vulnerability checks that found a more severe vulnerability status than before.",
+	})
 	cleanupAbandonedUploadSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "keppel_successful_abandoned_upload_cleanups",
 		Help: "Counter for successful cleanup of abandoned uploads.",
@@ -89,6 +97,10 @@ var (
 		Name: "keppel_failed_manifest_syncs",
 		Help: "Counter for failed manifest syncs in replica repos.",
 	})
+	repairedManifestSizesCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "keppel_repaired_manifest_sizes",
+		Help: "Counter for manifests whose size_bytes was found to be wrong during validation and has been corrected.",
+	})
 	validateBlobSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "keppel_successful_blob_validations",
 		Help: "Counter for successful blob validations.",
@@ -106,6 +118,23 @@ var (
 		Help: "Counter for failed manifest validations.",
 	})
 
+	accountManifestsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keppel_account_manifests",
+		Help: "Number of manifests in each account, by media type class (image or list).",
+	}, []string{"account", "media_type_class"})
+	accountManifestsSizeGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keppel_account_manifests_size_bytes",
+		Help: "Total logical size of the manifests in each account, by media type class (image or list).",
+	}, []string{"account", "media_type_class"})
+	accountBlobsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keppel_account_blobs",
+		Help: "Number of blobs in each account.",
+	}, []string{"account"})
+	accountStaleVulnStatusGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "keppel_account_stale_vulnerability_statuses",
+		Help: "Number of manifests in each account that have been stuck in vulnerability status Pending or Unknown for too long, by status.",
+	}, []string{"account", "status"})
+
 	metricsRegistered = false
 )
 
@@ -117,6 +146,8 @@ func (j *Janitor) initializeCounters() {
 		prometheus.MustRegister(checkVulnerabilitySuccessCounter)
 		prometheus.MustRegister(checkVulnerabilityFailedCounter)
 		prometheus.MustRegister(checkVulnerabilityRetriedCounter)
+		prometheus.MustRegister(vulnReportCacheHitCounter)
+		prometheus.MustRegister(vulnerabilityStatusWorsenedCounter)
 		prometheus.MustRegister(cleanupAbandonedUploadSuccessCounter)
 		prometheus.MustRegister(cleanupAbandonedUploadFailedCounter)
 		prometheus.MustRegister(imageGCSuccessCounter)
@@ -129,10 +160,15 @@ func (j *Janitor) initializeCounters() {
 		prometheus.MustRegister(sweepStorageFailedCounter)
 		prometheus.MustRegister(syncManifestsSuccessCounter)
 		prometheus.MustRegister(syncManifestsFailedCounter)
+		prometheus.MustRegister(repairedManifestSizesCounter)
 		prometheus.MustRegister(validateBlobSuccessCounter)
 		prometheus.MustRegister(validateBlobFailedCounter)
 		prometheus.MustRegister(validateManifestSuccessCounter)
 		prometheus.MustRegister(validateManifestFailedCounter)
+		prometheus.MustRegister(accountManifestsGauge)
+		prometheus.MustRegister(accountManifestsSizeGauge)
+		prometheus.MustRegister(accountBlobsGauge)
+		prometheus.MustRegister(accountStaleVulnStatusGauge)
 	}
 
 	//add 0 to all counters to ensure that the relevant timeseries exist
@@ -141,6 +177,8 @@ func (j *Janitor) initializeCounters() {
 	checkVulnerabilitySuccessCounter.Add(0)
 	checkVulnerabilityFailedCounter.Add(0)
 	checkVulnerabilityRetriedCounter.Add(0)
+	vulnReportCacheHitCounter.Add(0)
+	vulnerabilityStatusWorsenedCounter.Add(0)
 	cleanupAbandonedUploadSuccessCounter.Add(0)
 	cleanupAbandonedUploadFailedCounter.Add(0)
 	imageGCSuccessCounter.Add(0)
@@ -153,6 +191,7 @@ func (j *Janitor) initializeCounters() {
 	sweepStorageFailedCounter.Add(0)
 	syncManifestsSuccessCounter.Add(0)
 	syncManifestsFailedCounter.Add(0)
+	repairedManifestSizesCounter.Add(0)
 	validateBlobSuccessCounter.Add(0)
 	validateBlobFailedCounter.Add(0)
 	validateManifestSuccessCounter.Add(0)
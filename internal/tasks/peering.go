@@ -104,7 +104,7 @@ func IssueNewPasswordForPeer(cfg keppel.Configuration, db *keppel.DB, tx *gorp.T
 		Password:     newPassword,
 	})
 	peerURL := fmt.Sprintf("https://%s/keppel/v1/auth/peering", peer.HostName)
-	resp, err := http.Post(peerURL, "application/json", bytes.NewReader(bodyBytes)) //nolint:gosec // the URL is read from static configuration files
+	resp, err := cfg.HTTPClientForPeers().Post(peerURL, "application/json", bytes.NewReader(bodyBytes))
 	if err != nil {
 		return err
 	}
@@ -19,6 +19,8 @@
 package tasks
 
 import (
+	"database/sql"
+	"sync"
 	"testing"
 
 	"github.com/go-gorp/gorp/v3"
@@ -51,7 +53,7 @@ func forAllReplicaTypes(t *testing.T, action func(string)) {
 	action("from_external_on_first_use")
 }
 
-func setupReplica(t *testing.T, s1 test.Setup, strategy string) (*Janitor, test.Setup) {
+func setupReplica(t *testing.T, s1 test.Setup, strategy string, opts ...test.SetupOption) (*Janitor, test.Setup) {
 	testAccount := keppel.Account{
 		Name:         "test1",
 		AuthTenantID: "test1authtenant",
@@ -67,13 +69,14 @@ func setupReplica(t *testing.T, s1 test.Setup, strategy string) (*Janitor, test.
 		t.Fatalf("unknown strategy: %q", strategy)
 	}
 
-	s := test.NewSetup(t,
+	opts = append([]test.SetupOption{
 		test.IsSecondaryTo(&s1),
 		test.WithPeerAPI,
 		test.WithAccount(testAccount),
 		test.WithRepo(keppel.Repository{AccountName: "test1", Name: "foo"}),
 		test.WithQuotas,
-	)
+	}, opts...)
+	s := test.NewSetup(t, opts...)
 
 	j2 := NewJanitor(s.Config, s.FD, s.SD, s.ICD, s.DB, s.Auditor).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next)
 	j2.DisableJitter()
@@ -110,3 +113,37 @@ func expectError(t *testing.T, expected string, actual error) {
 		t.Errorf("expected err = %q, but got %q", expected, actual.Error())
 	}
 }
+
+// runConcurrently runs the given job loop on the given number of goroutines
+// until all of them run out of work, and returns how many successful runs
+// there were in total.
+func runConcurrently(t *testing.T, workerCount int, task func() error) int {
+	t.Helper()
+	var (
+		wg           sync.WaitGroup
+		mutex        sync.Mutex
+		successCount int
+	)
+	for worker := 0; worker < workerCount; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				err := task()
+				switch err {
+				case nil:
+					mutex.Lock()
+					successCount++
+					mutex.Unlock()
+				case sql.ErrNoRows:
+					return
+				default:
+					t.Error(err.Error())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return successCount
+}
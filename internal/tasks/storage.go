@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
@@ -36,6 +37,8 @@ var storageSweepSearchQuery = sqlext.SimplifyWhitespace(`
 	ORDER BY next_storage_sweep_at IS NULL DESC, next_storage_sweep_at ASC
 	-- only one account at a time
 	LIMIT 1
+	-- prevent other janitors from claiming the same account concurrently (NO KEY allows inserting rows that reference this one)
+	FOR NO KEY UPDATE SKIP LOCKED
 `)
 
 var storageSweepDoneQuery = sqlext.SimplifyWhitespace(`
@@ -67,8 +70,11 @@ func (j *Janitor) SweepStorageInNextAccount() (returnErr error) {
 		}
 	}()
 
-	//find account to sweep
-	err := j.db.SelectOne(&account, storageSweepSearchQuery, j.timeNow())
+	//find account to sweep, and claim it by scheduling the next sweep
+	err := j.claimNextRow(&account, storageSweepSearchQuery, []any{j.timeNow()}, func(tx *gorp.Transaction) error {
+		_, err := tx.Exec(storageSweepDoneQuery, account.Name, j.timeNow().Add(j.addJitter(6*time.Hour)))
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no storages to sweep - slowing down...")
@@ -76,6 +82,7 @@ func (j *Janitor) SweepStorageInNextAccount() (returnErr error) {
 		}
 		return err
 	}
+	defer j.restoreScheduleOnFailure(&returnErr, storageSweepDoneQuery, account.Name, account.NextStorageSweepedAt)
 
 	//enumerate blobs and manifests in the backing storage
 	actualBlobs, actualManifests, err := j.sd.ListStorageContents(account)
@@ -94,13 +101,7 @@ func (j *Janitor) SweepStorageInNextAccount() (returnErr error) {
 	if err != nil {
 		return err
 	}
-	err = j.sweepManifestStorage(account, actualManifests, canBeDeletedAt)
-	if err != nil {
-		return err
-	}
-
-	_, err = j.db.Exec(storageSweepDoneQuery, account.Name, j.timeNow().Add(j.addJitter(6*time.Hour)))
-	return err
+	return j.sweepManifestStorage(account, actualManifests, canBeDeletedAt)
 }
 
 func (j *Janitor) sweepBlobStorage(account keppel.Account, actualBlobs []keppel.StoredBlobInfo, canBeDeletedAt time.Time) error {
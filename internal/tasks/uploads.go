@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/go-gorp/gorp/v3"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/sqlext"
 
@@ -57,43 +58,34 @@ func (j *Janitor) DeleteNextAbandonedUpload() (returnErr error) {
 		}
 	}()
 
-	//we need a database transaction to be able to lock the `uploads` table row
-	tx, err := j.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer sqlext.RollbackUnlessCommitted(tx)
-
-	//find upload
-	var upload keppel.Upload
+	//find upload and claim it by removing it from the DB right away (the row
+	//lock during the claim blocks concurrent continuation of the upload)
+	//
+	//The DB record is removed *before* the upload is cleaned up in the backing
+	//storage, so that we do not need to hold the row lock while talking to the
+	//storage. If the cleanup in the storage fails, the leftover chunks will be
+	//removed by SweepStorageInNextAccount eventually.
+	var (
+		upload  keppel.Upload
+		account keppel.Account
+	)
 	maxUpdatedAt := j.timeNow().Add(-24 * time.Hour)
-	err = tx.SelectOne(&upload, abandonedUploadSearchQuery, maxUpdatedAt)
+	err := j.claimNextRow(&upload, abandonedUploadSearchQuery, []any{maxUpdatedAt}, func(tx *gorp.Transaction) error {
+		err := tx.SelectOne(&account, findAccountForRepoQuery, upload.RepositoryID)
+		if err != nil {
+			return fmt.Errorf("cannot find account for abandoned upload %s: %s", upload.UUID, err.Error())
+		}
+		_, err = tx.Delete(&upload)
+		return err
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
 			logg.Debug("no abandoned uploads to clean up - slowing down...")
-			//explicit rollback to avoid spamming the log with "implicit rollback done" logs
-			err := tx.Rollback()
-			if err != nil {
-				return err
-			}
 			return sql.ErrNoRows
 		}
 		return err
 	}
 
-	//find corresponding account
-	var account keppel.Account
-	err = tx.SelectOne(&account, findAccountForRepoQuery, upload.RepositoryID)
-	if err != nil {
-		return fmt.Errorf("cannot find account for abandoned upload %s: %s", upload.UUID, err.Error())
-	}
-
-	//remove from DB
-	_, err = tx.Delete(&upload)
-	if err != nil {
-		return err
-	}
-
 	//remove from backing storage if necessary
 	if upload.NumChunks > 0 {
 		err := j.sd.AbortBlobUpload(account, upload.StorageID, upload.NumChunks)
@@ -101,6 +93,5 @@ func (j *Janitor) DeleteNextAbandonedUpload() (returnErr error) {
 			return fmt.Errorf("cannot AbortBlobUpload for abandoned upload %s: %s", upload.UUID, err.Error())
 		}
 	}
-
-	return tx.Commit()
+	return nil
 }
@@ -0,0 +1,168 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sapcc/go-bits/logg"
+
+	"github.com/sapcc/keppel/internal/clair"
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+const (
+	//How long the matcher version reported by Clair is reused before asking
+	//Clair again. This avoids an extra request to Clair for every single
+	//vulnerability check, at the cost of reusing cached reports for up to this
+	//long after Clair's vulnerability database has been updated.
+	matcherVersionMaxAge = 1 * time.Minute
+	//The maximum number of layer lists that are remembered.
+	vulnReportCacheMaxEntries = 10000
+)
+
+// vulnReportCache remembers Clair's index and vulnerability reports by the
+// list of layers that were scanned. Images with the same layers in the same
+// order (e.g. images that only differ in their config) have identical index
+// reports and vulnerability reports, so the layers only need to be indexed
+// once, and the report only needs to be retrieved once. To this end, the first
+// manifest that is checked for a given list of layers is submitted to Clair,
+// and all other manifests with the same layers use its index report.
+//
+// Since reports change when Clair's vulnerability database is updated,
+// vulnerability statuses are tied to the matcher version that was current when
+// they were recorded, and are ignored when the matcher version changes.
+//
+// NOTE: This cache only lives in the memory of one janitor process, so
+// multiple janitor processes (or a restarted janitor) may still submit the
+// same layers to Clair once each.
+type vulnReportCache struct {
+	mutex   sync.Mutex
+	entries map[string]*vulnReportCacheEntry
+	//the result of the last GetMatcherVersion() call
+	latestMatcherVersion   string
+	matcherVersionCachedAt time.Time
+}
+
+type vulnReportCacheEntry struct {
+	//the manifest under which this list of layers was submitted to Clair
+	IndexedManifestDigest string
+	//the vulnerability status from the report for that manifest (only valid
+	//if MatcherVersion is current)
+	MatcherVersion string
+	Status         clair.VulnerabilityStatus
+}
+
+func newVulnReportCache() *vulnReportCache {
+	return &vulnReportCache{entries: make(map[string]*vulnReportCacheEntry)}
+}
+
+// vulnReportCacheKey computes the cache key for the given list of layers. The
+// order of the layers is significant since Clair scans the layers as a stack
+// (e.g. a file deleted in one layer may be added back in a later one).
+func vulnReportCacheKey(layerBlobs []keppel.Blob) string {
+	digests := make([]string, len(layerBlobs))
+	for idx, blob := range layerBlobs {
+		digests[idx] = blob.Digest
+	}
+	hash := sha256.Sum256([]byte(strings.Join(digests, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// MatcherVersion returns the current matcher version of Clair, using the
+// given callback to ask Clair if the last known version is older than
+// matcherVersionMaxAge. If Clair cannot be asked, an empty string is returned,
+// which disables the cache instead of failing the vulnerability check.
+func (c *vulnReportCache) MatcherVersion(now time.Time, getMatcherVersion func() (string, error)) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.matcherVersionCachedAt.IsZero() && now.Sub(c.matcherVersionCachedAt) < matcherVersionMaxAge {
+		return c.latestMatcherVersion
+	}
+
+	//NOTE: Failures are remembered just like successes, so that we do not ask
+	//Clair again on every check while it has trouble.
+	matcherVersion, err := getMatcherVersion()
+	if err != nil {
+		logg.Error("cannot get matcher version from Clair (continuing without cached vulnerability reports): %s", err.Error())
+		matcherVersion = ""
+	}
+	c.latestMatcherVersion = matcherVersion
+	c.matcherVersionCachedAt = now
+	return matcherVersion
+}
+
+// IndexedManifestDigest returns the digest of the manifest under which this
+// list of layers is indexed by Clair. If this list of layers has not been seen
+// before, the given manifest is recorded as the one that gets indexed.
+func (c *vulnReportCache) IndexedManifestDigest(key, manifestDigest string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		entry = &vulnReportCacheEntry{IndexedManifestDigest: manifestDigest}
+		c.insert(key, entry)
+	}
+	return entry.IndexedManifestDigest
+}
+
+// Get returns the cached vulnerability status for this key, if any. An empty
+// matcher version disables the cache.
+func (c *vulnReportCache) Get(key, matcherVersion string) (clair.VulnerabilityStatus, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := c.entries[key]
+	if matcherVersion == "" || entry == nil || entry.MatcherVersion != matcherVersion {
+		return "", false
+	}
+	return entry.Status, true
+}
+
+// Put records the vulnerability status for this key.
+func (c *vulnReportCache) Put(key, indexedManifestDigest, matcherVersion string, status clair.VulnerabilityStatus) {
+	if matcherVersion == "" {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		entry = &vulnReportCacheEntry{IndexedManifestDigest: indexedManifestDigest}
+		c.insert(key, entry)
+	}
+	entry.MatcherVersion = matcherVersion
+	entry.Status = status
+}
+
+func (c *vulnReportCache) insert(key string, entry *vulnReportCacheEntry) {
+	//when the cache is full, evict an arbitrary entry (map iteration order is
+	//randomized, so this is random eviction)
+	if len(c.entries) >= vulnReportCacheMaxEntries {
+		for evictKey := range c.entries {
+			delete(c.entries, evictKey)
+			break
+		}
+	}
+	c.entries[key] = entry
+}
@@ -22,6 +22,7 @@ package test
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -62,6 +63,14 @@ func (d *AuthDriver) ValidateTenantID(tenantID string) error {
 	return nil
 }
 
+// ValidateAccount implements the keppel.AccountValidator interface.
+func (d *AuthDriver) ValidateAccount(accountName, tenantID string) (string, error) {
+	if tenantID == "vetoed" {
+		return "", fmt.Errorf("cannot create account %q in tenant %q", accountName, tenantID)
+	}
+	return strings.TrimSpace(tenantID), nil
+}
+
 // AuthenticateUser implements the keppel.AuthDriver interface.
 func (d *AuthDriver) AuthenticateUser(userName, password string) (keppel.UserIdentity, *keppel.RegistryV2Error) {
 	is := func(a, b string) bool {
@@ -83,6 +83,7 @@ func (s Setup) getToken(t *testing.T, audience auth.Audience, scopes ...string)
 		string(keppel.CanPullFromAccount):   make(map[string]bool),
 		string(keppel.CanPushToAccount):     make(map[string]bool),
 		string(keppel.CanDeleteFromAccount): make(map[string]bool),
+		string(keppel.CanChangeAccount):     make(map[string]bool),
 	}
 	for _, scope := range ss {
 		switch scope.ResourceType {
@@ -103,6 +104,8 @@ func (s Setup) getToken(t *testing.T, audience auth.Audience, scopes ...string)
 					perms[string(keppel.CanPushToAccount)][authTenantID] = true
 				case "delete":
 					perms[string(keppel.CanDeleteFromAccount)][authTenantID] = true
+				case "override_pull_block":
+					perms[string(keppel.CanChangeAccount)][authTenantID] = true
 				default:
 					t.Fatalf("do not know how to handle action %q in scope %q", action, scope.String())
 				}
@@ -40,24 +40,34 @@ import (
 type ClairDouble struct {
 	T *testing.T
 	//key = manifest digest, value = path to JSON fixture file containing `clair.Manifest` for this image
-	IndexFixtures     map[string]string
-	WasIndexSubmitted map[string]bool
+	IndexFixtures      map[string]string
+	WasIndexSubmitted  map[string]bool
+	IndexSubmitCounter int
 	//key = manifest digest, value = path to JSON fixture file containing `clair.IndexReport` for this image
 	IndexReportFixtures map[string]string
 	IndexDeleteCounter  int
 	//key = manifest digest, value = path to JSON fixture file containing `clair.VulnerabilityReport` for this image
-	ReportFixtures map[string]string
-	IndexState     string
+	ReportFixtures       map[string]string
+	ReportRequestCounter int
+	IndexState           string
+	//reported as the ETag of the latest update operation of Clair's matcher
+	MatcherVersion               string
+	MatcherVersionRequestCounter int
+	//if true, requests for the latest update operation fail
+	MatcherVersionFails bool
 }
 
 const IndexStateHash = "aae368a064d7c5a433d0bf2c4f5554cc"
 
+const MatcherVersion = `"7c9f1c2e-3b1d-4f7e-9a51-0d3c6a0e8b42"`
+
 // NewClairDouble creates a ClairDouble.
 func NewClairDouble() *ClairDouble {
 	return &ClairDouble{
 		IndexFixtures:       make(map[string]string),
 		IndexReportFixtures: make(map[string]string),
 		IndexState:          IndexStateHash,
+		MatcherVersion:      MatcherVersion,
 		WasIndexSubmitted:   make(map[string]bool),
 		ReportFixtures:      make(map[string]string),
 	}
@@ -80,6 +90,9 @@ func (c *ClairDouble) AddTo(r *mux.Router) {
 	r.Methods("GET").
 		Path("/matcher/api/v1/vulnerability_report/{digest}").
 		HandlerFunc(c.getVulnerabilityReport)
+	r.Methods("GET").
+		Path("/matcher/api/v1/internal/update_operation").
+		HandlerFunc(c.getUpdateOperations)
 }
 
 func (c *ClairDouble) postIndexReport(w http.ResponseWriter, r *http.Request) {
@@ -132,6 +145,7 @@ func (c *ClairDouble) postIndexReport(w http.ResponseWriter, r *http.Request) {
 
 	//minimal valid response to keep Keppel going
 	c.WasIndexSubmitted[digest] = true
+	c.IndexSubmitCounter++
 	state := "CheckManifest"
 	if c.ReportFixtures[digest] != "" {
 		state = "IndexFinished"
@@ -202,6 +216,7 @@ func (c *ClairDouble) deleteIndexReport(w http.ResponseWriter, r *http.Request)
 func (c *ClairDouble) getVulnerabilityReport(w http.ResponseWriter, r *http.Request) {
 	httpapi.IdentifyEndpoint(r, "/matcher/api/v1/vulnerability_report/{digest}")
 
+	c.ReportRequestCounter++
 	digest := mux.Vars(r)["digest"]
 	fixturePath := c.ReportFixtures[digest]
 	if !c.WasIndexSubmitted[digest] || digest == "" {
@@ -221,3 +236,16 @@ func (c *ClairDouble) getIndexState(w http.ResponseWriter, r *http.Request) {
 
 	respondwith.JSON(w, http.StatusOK, clair.IndexState{State: c.IndexState})
 }
+
+func (c *ClairDouble) getUpdateOperations(w http.ResponseWriter, r *http.Request) {
+	httpapi.IdentifyEndpoint(r, "/matcher/api/v1/internal/update_operation")
+	c.MatcherVersionRequestCounter++
+	if c.MatcherVersionFails {
+		http.Error(w, "matcher is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	//we only care about the ETag, so we don't bother reporting any actual update operations
+	w.Header().Set("Etag", c.MatcherVersion)
+	respondwith.JSON(w, http.StatusOK, map[string]interface{}{})
+}
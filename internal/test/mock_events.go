@@ -0,0 +1,63 @@
+/*******************************************************************************
+*
+* Copyright 2023 SAP SE
+*
+* Licensed under the Apache License, Version 2.0 (the "License");
+* you may not use this file except in compliance with the License.
+* You should have received a copy of the License along with this
+* program. If not, you may obtain a copy of the License at
+*
+*     http://www.apache.org/licenses/LICENSE-2.0
+*
+* Unless required by applicable law or agreed to in writing, software
+* distributed under the License is distributed on an "AS IS" BASIS,
+* WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+* See the License for the specific language governing permissions and
+* limitations under the License.
+*
+*******************************************************************************/
+
+package test
+
+import (
+	"testing"
+
+	"github.com/sapcc/go-bits/assert"
+
+	"github.com/sapcc/keppel/internal/keppel"
+)
+
+// EventRecorder is a test recorder that satisfies the keppel.EventSink interface.
+type EventRecorder struct {
+	events []keppel.Event
+}
+
+// Emit implements the keppel.EventSink interface.
+func (r *EventRecorder) Emit(event keppel.Event) {
+	r.events = append(r.events, event)
+}
+
+// ExpectEvents checks that the recorded events are equal to the supplied
+// expectation. Only events of the given types are considered.
+func (r *EventRecorder) ExpectEvents(t *testing.T, eventType keppel.EventType, expectedEvents ...keppel.Event) {
+	t.Helper()
+	var actualEvents []keppel.Event
+	for _, event := range r.events {
+		if event.EventType() == eventType {
+			actualEvents = append(actualEvents, event)
+		}
+	}
+	if len(expectedEvents) == 0 {
+		expectedEvents = nil
+	}
+	assert.DeepEqual(t, "events", actualEvents, expectedEvents)
+
+	//reset state for next test
+	r.events = nil
+}
+
+// IgnoreEventsUntilNow clears the list of recorded events, so that the next
+// ExpectEvents() will only cover events generated after this point.
+func (r *EventRecorder) IgnoreEventsUntilNow() {
+	r.events = nil
+}
@@ -68,6 +68,11 @@ func (t *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 
 	w := httptest.NewRecorder()
 	h.ServeHTTP(w, req)
+	//like net/http's actual transport, do not deliver a response when the
+	//request was canceled or timed out in the meantime
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
 	resp := w.Result()
 
 	//in practice, most HTTP handlers for GET/HEAD requests write into the
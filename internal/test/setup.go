@@ -24,13 +24,17 @@ import (
 	"net/http"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/sapcc/go-bits/easypg"
 	"github.com/sapcc/go-bits/httpapi"
 	"github.com/sapcc/go-bits/logg"
 	"github.com/sapcc/go-bits/osext"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/crypto/bcrypt"
 
+	"github.com/sapcc/keppel/internal/api"
 	authapi "github.com/sapcc/keppel/internal/api/auth"
 	keppelv1 "github.com/sapcc/keppel/internal/api/keppel"
 	peerv1 "github.com/sapcc/keppel/internal/api/peer"
@@ -43,6 +47,7 @@ import (
 type setupParams struct {
 	//all false/empty by default
 	IsSecondary             bool
+	IsTertiary              bool
 	WithAnycast             bool
 	WithKeppelAPI           bool
 	WithPeerAPI             bool
@@ -50,8 +55,19 @@ type setupParams struct {
 	WithQuotas              bool
 	WithPreviousIssuerKey   bool
 	WithoutCurrentIssuerKey bool
+	WithoutCatalog          bool
 	RateLimitEngine         *keppel.RateLimitEngine
-	SetupOfPrimary          *Setup
+	ReplicationTimeout      time.Duration
+	ManifestRetention       time.Duration
+	VerifyOnReadSampleRate  float64
+	VerifyOnWrite           bool
+	MaxRequestBodySizeBytes uint64
+	MaxLayersPerManifest    uint64
+	AdmissionPolicy         keppel.AdmissionPolicy
+	StrictMediaTypes        []string
+	CORSPolicy              keppel.CORSPolicy
+	TrustedProxies          []string
+	SetupOfUpstream         *Setup
 	Accounts                []*keppel.Account
 	Repos                   []*keppel.Repository
 }
@@ -66,7 +82,18 @@ type SetupOption func(*setupParams)
 func IsSecondaryTo(s *Setup) SetupOption {
 	return func(params *setupParams) {
 		params.IsSecondary = true
-		params.SetupOfPrimary = s
+		params.SetupOfUpstream = s
+	}
+}
+
+// IsTertiaryTo is a SetupOption that configures registry-tertiary.example.org
+// instead of registry.example.org. This is used to test replication chains:
+// The given Setup instance is usually the one for registry-secondary.example.org,
+// and both sides will be configured to peer with each other.
+func IsTertiaryTo(s *Setup) SetupOption {
+	return func(params *setupParams) {
+		params.IsTertiary = true
+		params.SetupOfUpstream = s
 	}
 }
 
@@ -104,6 +131,83 @@ func WithRateLimitEngine(rle *keppel.RateLimitEngine) SetupOption {
 	}
 }
 
+// WithReplicationTimeout is a SetupOption that sets the ReplicationTimeout
+// field in keppel.Configuration.
+func WithReplicationTimeout(timeout time.Duration) SetupOption {
+	return func(params *setupParams) {
+		params.ReplicationTimeout = timeout
+	}
+}
+
+// WithDeletedManifestRetention is a SetupOption that sets the
+// DeletedManifestRetention field in keppel.Configuration.
+func WithDeletedManifestRetention(retention time.Duration) SetupOption {
+	return func(params *setupParams) {
+		params.ManifestRetention = retention
+	}
+}
+
+// WithVerifyOnRead is a SetupOption that sets the VerifyOnReadSampleRate
+// field in keppel.Configuration.
+func WithVerifyOnRead(sampleRate float64) SetupOption {
+	return func(params *setupParams) {
+		params.VerifyOnReadSampleRate = sampleRate
+	}
+}
+
+// WithVerifyOnWrite is a SetupOption that sets the VerifyOnWrite field in
+// keppel.Configuration.
+func WithVerifyOnWrite(params *setupParams) {
+	params.VerifyOnWrite = true
+}
+
+// WithMaxRequestBodySize is a SetupOption that sets the
+// MaxRequestBodySizeBytes field in keppel.Configuration.
+func WithMaxRequestBodySize(sizeBytes uint64) SetupOption {
+	return func(params *setupParams) {
+		params.MaxRequestBodySizeBytes = sizeBytes
+	}
+}
+
+// WithMaxLayersPerManifest is a SetupOption that sets the
+// MaxLayersPerManifest field in keppel.Configuration.
+func WithMaxLayersPerManifest(count uint64) SetupOption {
+	return func(params *setupParams) {
+		params.MaxLayersPerManifest = count
+	}
+}
+
+// WithAdmissionPolicy is a SetupOption that sets the AdmissionPolicy field in
+// keppel.Configuration.
+func WithAdmissionPolicy(ap keppel.AdmissionPolicy) SetupOption {
+	return func(params *setupParams) {
+		params.AdmissionPolicy = ap
+	}
+}
+
+// WithStrictManifestMediaTypes is a SetupOption that enables strict checking of
+// manifest media types. If no media types are given, the default set is allowed.
+func WithStrictManifestMediaTypes(allowed ...string) SetupOption {
+	return func(params *setupParams) {
+		params.StrictMediaTypes = append([]string{}, allowed...)
+	}
+}
+
+// WithCORSPolicy is a SetupOption that sets the CORS field in keppel.Configuration.
+func WithCORSPolicy(policy keppel.CORSPolicy) SetupOption {
+	return func(params *setupParams) {
+		params.CORSPolicy = policy
+	}
+}
+
+// WithTrustedProxies is a SetupOption that sets the TrustedProxies field in
+// keppel.Configuration.
+func WithTrustedProxies(entries ...string) SetupOption {
+	return func(params *setupParams) {
+		params.TrustedProxies = append(params.TrustedProxies, entries...)
+	}
+}
+
 // WithAccount is a SetupOption that adds the given keppel.Account to the DB during NewSetup().
 func WithAccount(account keppel.Account) SetupOption {
 	return func(params *setupParams) {
@@ -132,6 +236,11 @@ func WithoutCurrentIssuerKey(params *setupParams) {
 	params.WithoutCurrentIssuerKey = true
 }
 
+// WithoutCatalog is a SetupOption that disables the GET /v2/_catalog endpoint.
+func WithoutCatalog(params *setupParams) {
+	params.WithoutCatalog = true
+}
+
 // Setup contains all the pieces that are needed for most tests.
 type Setup struct {
 	//fields that are always set
@@ -140,6 +249,8 @@ type Setup struct {
 	Clock        *Clock
 	SIDGenerator *StorageIDGenerator
 	Auditor      *Auditor
+	Events       *EventRecorder
+	Spans        *tracetest.InMemoryExporter
 	AD           *AuthDriver
 	FD           *FederationDriver
 	SD           *trivial.StorageDriver
@@ -188,10 +299,14 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 		dbName            string
 		apiPublicHostname string
 	)
-	if params.IsSecondary {
+	switch {
+	case params.IsSecondary:
 		dbName = "keppel_secondary"
 		apiPublicHostname = "registry-secondary.example.org"
-	} else {
+	case params.IsTertiary:
+		dbName = "keppel_tertiary"
+		apiPublicHostname = "registry-tertiary.example.org"
+	default:
 		dbName = "keppel"
 		apiPublicHostname = "registry.example.org"
 	}
@@ -204,11 +319,27 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	mustDo(t, err)
 	s := Setup{
 		Config: keppel.Configuration{
-			APIPublicHostname: apiPublicHostname,
-			DatabaseURL:       dbURL,
+			APIPublicHostname:       apiPublicHostname,
+			DatabaseURL:             dbURL,
+			DisableCatalog:          params.WithoutCatalog,
+			ReplicationTimeout:      params.ReplicationTimeout,
+			VerifyOnReadSampleRate:  params.VerifyOnReadSampleRate,
+			VerifyOnWrite:           params.VerifyOnWrite,
+			MaxRequestBodySizeBytes: params.MaxRequestBodySizeBytes,
+			MaxLayersPerManifest:    params.MaxLayersPerManifest,
+			AdmissionPolicy:         params.AdmissionPolicy,
+			ReplicationLimits:       keppel.NewReplicationLimits(0),
 		},
 		tokenCache: make(map[string]string),
 	}
+	if params.StrictMediaTypes != nil {
+		s.Config.StrictManifestMediaTypes = true
+		s.Config.AllowedManifestMediaTypes = params.StrictMediaTypes
+	}
+	s.Config.CORS = params.CORSPolicy
+	s.Config.TrustedProxies, err = keppel.ParseTrustedProxies(params.TrustedProxies)
+	mustDo(t, err)
+	s.Config.DeletedManifestRetention = params.ManifestRetention
 
 	//select issuer keys
 	if params.WithoutCurrentIssuerKey && !params.WithPreviousIssuerKey {
@@ -241,7 +372,7 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	}
 
 	//connect to DB
-	s.DB, err = keppel.InitDB(s.Config.DatabaseURL)
+	s.DB, err = keppel.InitDB(s.Config.DatabaseURL, keppel.DefaultDBPoolConfiguration())
 	if err != nil {
 		t.Error(err)
 		t.Log("Try prepending ./testing/with-postgres-db.sh to your command.")
@@ -265,7 +396,10 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 
 	//wipe the DB clean if there are any leftovers from the previous test run
 	easypg.ClearTables(t, s.DB.Db, "manifest_blob_refs", "accounts", "peers", "quotas")
-	easypg.ResetPrimaryKeys(t, s.DB.Db, "blobs", "repos")
+	//(tag_history is append-only and refuses row deletions, but not TRUNCATE)
+	_, err = s.DB.Exec(`TRUNCATE tag_history`)
+	mustDo(t, err)
+	easypg.ResetPrimaryKeys(t, s.DB.Db, "blobs", "repos", "tag_history")
 
 	//setup anycast if requested
 	if params.WithAnycast {
@@ -287,10 +421,14 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	s.Clock = &Clock{}
 	s.SIDGenerator = &StorageIDGenerator{}
 	s.Auditor = &Auditor{}
-
-	//if we are secondary and we know the primary, share the clock with it
-	if params.SetupOfPrimary != nil {
-		s.Clock = params.SetupOfPrimary.Clock
+	s.Events = &EventRecorder{}
+	s.Config.EventSink = s.Events
+	s.Spans = tracetest.NewInMemoryExporter()
+	s.Config.Tracer = keppel.NewTracer(sdktrace.NewTracerProvider(sdktrace.WithSyncer(s.Spans)))
+
+	//if we are secondary (or tertiary) and we know our upstream, share the clock with it
+	if params.SetupOfUpstream != nil {
+		s.Clock = params.SetupOfUpstream.Clock
 	}
 
 	//setup essential drivers
@@ -302,7 +440,7 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	s.FD = fd.(*FederationDriver) //nolint:errcheck
 	sd, err := keppel.NewStorageDriver("in-memory-for-testing", ad, s.Config)
 	mustDo(t, err)
-	s.SD = sd.(*trivial.StorageDriver) //nolint:errcheck
+	s.SD = keppel.UnwrapStorageDriver(sd).(*trivial.StorageDriver) //nolint:errcheck
 	icd, err := keppel.NewInboundCacheDriver("unittest", s.Config)
 	mustDo(t, err)
 	s.ICD = icd.(*InboundCacheDriver) //nolint:errcheck
@@ -315,6 +453,7 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	//setup APIs
 	apis := []httpapi.API{
 		httpapi.WithoutLogging(),
+		api.CORSMiddleware(s.Config.CORS),
 		//Registry API (and thus Auth API) are nearly always needed for
 		//Bytes.Upload, Image.Upload and ImageList.Upload
 		registryv2.NewAPI(s.Config, ad, fd, sd, icd, s.DB, s.Auditor, params.RateLimitEngine).OverrideTimeNow(s.Clock.Now).OverrideGenerateStorageID(s.SIDGenerator.Next),
@@ -355,20 +494,17 @@ func NewSetup(t *testing.T, opts ...SetupOption) Setup {
 	}
 	s.Repos = params.Repos
 
-	//setup peering with primary if requested
-	if params.IsSecondary {
-		s1 := params.SetupOfPrimary
-		if s1 != nil {
-			//give the secondary registry credentials for replicating from the primary
-			mustDo(t, s.DB.Insert(&keppel.Peer{
-				HostName:    "registry.example.org",
-				OurPassword: GetReplicationPassword(),
-			}))
-			mustDo(t, s1.DB.Insert(&keppel.Peer{
-				HostName:                 "registry-secondary.example.org",
-				TheirCurrentPasswordHash: replicationPasswordHash,
-			}))
-		}
+	//setup peering with upstream if requested
+	if s1 := params.SetupOfUpstream; s1 != nil {
+		//give us credentials for replicating from the upstream
+		mustDo(t, s.DB.Insert(&keppel.Peer{
+			HostName:    s1.Config.APIPublicHostname,
+			OurPassword: GetReplicationPassword(),
+		}))
+		mustDo(t, s1.DB.Insert(&keppel.Peer{
+			HostName:                 s.Config.APIPublicHostname,
+			TheirCurrentPasswordHash: replicationPasswordHash,
+		}))
 	}
 
 	return s
@@ -30,15 +30,18 @@ import (
 	apicmd "github.com/sapcc/keppel/cmd/api"
 	healthmonitorcmd "github.com/sapcc/keppel/cmd/healthmonitor"
 	janitorcmd "github.com/sapcc/keppel/cmd/janitor"
+	selftestcmd "github.com/sapcc/keppel/cmd/selftest"
 	validatecmd "github.com/sapcc/keppel/cmd/validate"
 	"github.com/sapcc/keppel/internal/keppel"
 
 	//include all known driver implementations
 	_ "github.com/sapcc/keppel/internal/drivers/basic"
+	_ "github.com/sapcc/keppel/internal/drivers/cosign"
 	_ "github.com/sapcc/keppel/internal/drivers/filesystem"
 	_ "github.com/sapcc/keppel/internal/drivers/multi"
 	_ "github.com/sapcc/keppel/internal/drivers/openstack"
 	_ "github.com/sapcc/keppel/internal/drivers/redis"
+	_ "github.com/sapcc/keppel/internal/drivers/s3"
 	_ "github.com/sapcc/keppel/internal/drivers/trivial"
 )
 
@@ -58,6 +61,7 @@ func main() {
 			cmd.Help()
 		},
 	}
+	selftestcmd.AddCommandTo(rootCmd)
 	validatecmd.AddCommandTo(rootCmd)
 
 	serverCmd := &cobra.Command{